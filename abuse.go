@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AbuseLimits temporarily ban clients that keep making failing requests, e.g.
+// a misconfigured client retrying PUT /orders/{id} in a tight loop. Clients
+// are API keys or, for requests without one, IP addresses. A zero MaxErrors
+// disables bans.
+type AbuseLimits struct {
+	// Responses with status 400, 401 or 409 allowed per client within
+	// Window.
+	MaxErrors int
+	Window    time.Duration
+	// How long a client exceeding MaxErrors is refused with 429.
+	Ban time.Duration
+}
+
+// abuseClient is the recent history of a single client.
+type abuseClient struct {
+	errors      []time.Time // Times of failed requests within the window.
+	bannedUntil time.Time
+}
+
+// Ban is a client currently refused, as listed by GET /admin/bans.
+type Ban struct {
+	Client string    `json:"client"` // "key:{id}" or "ip:{address}".
+	Until  time.Time `json:"until"`
+}
+
+// abuseTracker counts failing requests per client and bans clients exceeding
+// the limits. Bans are kept in memory, each replica bans on its own, or in
+// Redis, shared by the replicas, if redis is set.
+type abuseTracker struct {
+	mu        sync.Mutex
+	limits    AbuseLimits
+	clients   map[string]*abuseClient
+	lastSweep time.Time
+	now       func() time.Time
+	redis     *redisClient
+}
+
+// Keys of the errors, a sorted set of their times, and ban, its end in Unix
+// milliseconds, of a client in Redis.
+const (
+	redisAbuseErrors = "abuse:errors:"
+	redisAbuseBan    = "abuse:ban:"
+)
+
+func newAbuseTracker(limits AbuseLimits) *abuseTracker {
+	return &abuseTracker{limits: limits, clients: map[string]*abuseClient{}, now: time.Now}
+}
+
+// isAbuse returns true for the responses counted against a client.
+func isAbuse(code int) bool {
+	return code == 400 || code == 401 || code == 409
+}
+
+// abuseClientID returns the client a request is counted against, its API key
+// if it has a verified one, otherwise the address it comes from.
+func abuseClientID(req *http.Request) string {
+	if key := apiKeyFromRequest(req); key != nil {
+		return "key:" + key.ID
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// bannedUntil returns when the ban of client ends, the zero time if it is not
+// banned.
+func (t *abuseTracker) bannedUntil(client string) time.Time {
+	if t.limits.MaxErrors <= 0 {
+		return time.Time{}
+	}
+	if t.redis != nil {
+		// Requests are let through while Redis is down.
+		ms, err := redisInt(t.redis.do(context.Background(), "GET", redisAbuseBan+client))
+		if err != nil {
+			fmt.Printf("Abuse: %s\n", err)
+		}
+		if ms == 0 {
+			return time.Time{}
+		}
+		return time.Unix(0, ms*int64(time.Millisecond))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.clients[client]; ok && t.now().Before(c.bannedUntil) {
+		return c.bannedUntil
+	}
+	return time.Time{}
+}
+
+// observe counts a response with status code against client and bans it once
+// it has too many errors.
+func (t *abuseTracker) observe(client string, code int) {
+	if t.limits.MaxErrors <= 0 || !isAbuse(code) {
+		return
+	}
+	if t.redis != nil {
+		if err := t.observeRedis(client); err != nil {
+			fmt.Printf("Abuse: %s\n", err)
+		}
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.sweep(now)
+	c, ok := t.clients[client]
+	if !ok {
+		c = &abuseClient{}
+		t.clients[client] = c
+	}
+	c.errors = append(recentErrors(c.errors, now.Add(-t.limits.Window)), now)
+	if len(c.errors) >= t.limits.MaxErrors {
+		c.errors = nil
+		c.bannedUntil = now.Add(t.limits.Ban)
+		fmt.Printf("Abuse: banned %s until %s after %d errors within %s\n", client,
+			c.bannedUntil.Format(time.RFC3339), t.limits.MaxErrors, t.limits.Window)
+	}
+}
+
+// observeRedis is observe with the errors and bans in Redis.
+func (t *abuseTracker) observeRedis(client string) error {
+	ctx := context.Background()
+	now := t.now()
+	key := redisAbuseErrors + client
+	member := strconv.FormatInt(now.UnixNano(), 10) + randomHex(4)
+	if _, err := t.redis.do(ctx, "ZADD", key, now.UnixNano(), member); err != nil {
+		return err
+	}
+	if _, err := t.redis.do(ctx, "ZREMRANGEBYSCORE", key, "-inf", now.Add(-t.limits.Window).UnixNano()); err != nil {
+		return err
+	}
+	if _, err := t.redis.do(ctx, "PEXPIRE", key, t.limits.Window.Milliseconds()); err != nil {
+		return err
+	}
+	n, err := redisInt(t.redis.do(ctx, "ZCARD", key))
+	if err != nil || n < int64(t.limits.MaxErrors) {
+		return err
+	}
+	until := now.Add(t.limits.Ban)
+	if _, err := t.redis.do(ctx, "SET", redisAbuseBan+client, until.UnixNano()/int64(time.Millisecond), "PX",
+		t.limits.Ban.Milliseconds()); err != nil {
+		return err
+	}
+	fmt.Printf("Abuse: banned %s until %s after %d errors within %s\n", client, until.Format(time.RFC3339),
+		t.limits.MaxErrors, t.limits.Window)
+	_, err = t.redis.do(ctx, "DEL", key)
+	return err
+}
+
+// recentErrors drops the times before since, reusing errors.
+func recentErrors(errors []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(errors) && errors[i].Before(since) {
+		i++
+	}
+	return append(errors[:0], errors[i:]...)
+}
+
+// sweep forgets clients that are neither banned nor had errors within the
+// window, at most once per window. Must hold t.mu.
+func (t *abuseTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.limits.Window {
+		return
+	}
+	t.lastSweep = now
+	since := now.Add(-t.limits.Window)
+	for client, c := range t.clients {
+		c.errors = recentErrors(c.errors, since)
+		if len(c.errors) == 0 && !now.Before(c.bannedUntil) {
+			delete(t.clients, client)
+		}
+	}
+}
+
+// Bans returns the clients currently banned, ordered by client.
+func (t *abuseTracker) Bans() ([]Ban, error) {
+	if t.redis != nil {
+		return t.redisBans()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	bans := []Ban{}
+	for client, c := range t.clients {
+		if now.Before(c.bannedUntil) {
+			bans = append(bans, Ban{Client: client, Until: c.bannedUntil})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Client < bans[j].Client })
+	return bans, nil
+}
+
+// redisBans is Bans of the bans in Redis.
+func (t *abuseTracker) redisBans() ([]Ban, error) {
+	ctx := context.Background()
+	bans := []Ban{}
+	cursor := "0"
+	for {
+		reply, err := t.redis.do(ctx, "SCAN", cursor, "MATCH", redisAbuseBan+"*", "COUNT", 100)
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected Redis reply %v", reply)
+		}
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			key, _ := key.([]byte)
+			ms, err := redisInt(t.redis.do(ctx, "GET", string(key)))
+			if err != nil {
+				return nil, err
+			}
+			if ms != 0 {
+				bans = append(bans, Ban{Client: strings.TrimPrefix(string(key), redisAbuseBan),
+					Until: time.Unix(0, ms*int64(time.Millisecond)).UTC()})
+			}
+		}
+		if cursor, err = redisString(page[0], nil); err != nil || cursor == "0" {
+			break
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Client < bans[j].Client })
+	return bans, nil
+}
+
+// Unban lifts the ban of client and forgets its errors. Returns false if it
+// was not banned.
+func (t *abuseTracker) Unban(client string) (bool, error) {
+	if t.redis != nil {
+		n, err := redisInt(t.redis.do(context.Background(), "DEL", redisAbuseBan+client))
+		if err != nil {
+			return false, err
+		}
+		_, err = t.redis.do(context.Background(), "DEL", redisAbuseErrors+client)
+		return n > 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.clients[client]
+	if !ok {
+		return false, nil
+	}
+	delete(t.clients, client)
+	return t.now().Before(c.bannedUntil), nil
+}
+
+// statusWriter remembers the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed listings working through a statusWriter.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// refuseBanned writes a 429 and returns true if client is banned.
+func (s *OrderService) refuseBanned(w http.ResponseWriter, req *http.Request, client string) bool {
+	until := s.abuse.bannedUntil(client)
+	if until.IsZero() {
+		return false
+	}
+	retryAfter := int64(until.Sub(s.abuse.now())/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	respond(w, req, 429, HTTPResponseError{Error: "BANNED", Detail: "too many failed requests"}, "%s banned", client)
+	return true
+}
+
+// handleBans serves /admin/bans.
+//
+//	GET    /admin/bans           lists the current bans.
+//	DELETE /admin/bans/{client}  lifts a ban, e.g. /admin/bans/ip:10.0.0.7.
+func (s *OrderService) handleBans(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	client := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/admin/bans"), "/")
+	switch {
+	case req.Method == http.MethodGet && client == "":
+		bans, err := s.abuse.Bans()
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Bans(): %s", err)
+			return
+		}
+		respond(w, req, 200, bans, "%d bans", len(bans))
+	case req.Method == http.MethodDelete && client != "":
+		banned, err := s.abuse.Unban(client)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Unban(): %s", err)
+			return
+		}
+		if !banned {
+			respond(w, req, 404, HTTPResponseError{Error: "NOT_BANNED"}, "%s not banned", client)
+			return
+		}
+		fmt.Printf("Abuse: unbanned %s\n", client)
+		respond(w, req, 200, HTTPResponseStatus{Status: "SUCCESS"}, "unbanned %s", client)
+	default:
+		respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+	}
+}
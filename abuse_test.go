@@ -0,0 +1,84 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAbuseBans(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret",
+		Abuse: AbuseLimits{MaxErrors: 3, Window: time.Minute, Ban: 10 * time.Minute}})
+	key := createKey(t, svc, "acme", scopeRead, scopeWrite)
+
+	// Errors of requests with a key count against the key, not the address.
+	for i := 0; i < 3; i++ {
+		if w := serveKey(svc, "POST", "/orders", key.Key, "{"); w.Code != 400 {
+			t.Fatalf("malformed POST returned %d", w.Code)
+		}
+	}
+	w := serveKey(svc, "GET", "/orders", key.Key, "")
+	if w.Code != 429 || w.Header().Get("Retry-After") != "600" {
+		t.Errorf("banned key got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 200 {
+		t.Errorf("request without the key returned %d", w.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		serveKey(svc, "GET", "/orders", "osk_bogus_key", "")
+	}
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 429 {
+		t.Errorf("request from banned address returned %d", w.Code)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/bans", "")
+	var bans []Ban
+	if err := json.NewDecoder(w.Body).Decode(&bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 2 || bans[0].Client != "ip:192.0.2.1" || bans[1].Client != "key:"+key.ID {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/bans/ip:192.0.2.1", ""); w.Code != 200 {
+		t.Errorf("unban returned %d: %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/bans/ip:192.0.2.1", ""); w.Code != 404 {
+		t.Errorf("second unban returned %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 200 {
+		t.Errorf("request from unbanned address returned %d", w.Code)
+	}
+}
+
+func TestAbuseWindow(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tracker := newAbuseTracker(AbuseLimits{MaxErrors: 2, Window: time.Minute, Ban: time.Hour})
+	tracker.now = func() time.Time { return now }
+
+	tracker.observe("ip:a", 409)
+	tracker.observe("ip:a", 200)
+	tracker.observe("ip:a", 404)
+	now = now.Add(2 * time.Minute)
+	tracker.observe("ip:a", 409)
+	if !tracker.bannedUntil("ip:a").IsZero() {
+		t.Fatal("banned for errors outside the window")
+	}
+	now = now.Add(30 * time.Second)
+	tracker.observe("ip:a", 401)
+	if got := tracker.bannedUntil("ip:a"); !got.Equal(now.Add(time.Hour)) {
+		t.Fatalf("got ban until %s", got)
+	}
+	now = now.Add(time.Hour)
+	if !tracker.bannedUntil("ip:a").IsZero() {
+		t.Error("ban did not expire")
+	}
+	now = now.Add(time.Minute)
+	tracker.observe("ip:b", 400)
+	if _, ok := tracker.clients["ip:a"]; ok {
+		t.Error("expired client not forgotten")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAdjustmentNote is the longest note of an adjustment in bytes.
+const maxAdjustmentNote = 500
+
+// adjustmentReasons are the reason codes of adjustments, with the sign their
+// amount must have, 0 for either.
+var adjustmentReasons = map[string]int64{
+	"refund":          -1, // Money given back to the customer.
+	"goodwill":        -1, // A gesture, e.g. after a complaint.
+	"service_failure": -1, // Late, damaged or lost.
+	"surcharge":       1,  // Extra work, e.g. waiting or stairs.
+	"correction":      0,  // The price was wrong.
+}
+
+// errNegativeFinalPrice is returned by Adjust when an adjustment would take
+// more off an order than was charged for it.
+var errNegativeFinalPrice = fmt.Errorf("final price would be negative")
+
+// orderAdjusted is the data of an EventAdjusted.
+type orderAdjusted struct {
+	Amount   int64  `json:"amount"` // In minor units of Currency, negative for refunds.
+	Currency string `json:"currency,omitempty"`
+	Reason   string `json:"reason"`
+	Note     string `json:"note,omitempty"`
+	Actor    string `json:"actor"` // An audit log actor.
+}
+
+// Adjustment is a change of the price charged for an order after its
+// creation, an item of GET /orders/{id}/adjustments.
+type Adjustment struct {
+	ID      int64 `json:"id"` // Of the event.
+	OrderID int64 `json:"order_id"`
+	orderAdjusted
+	Time time.Time `json:"time"`
+}
+
+// validateAdjustment returns an error describing what is wrong with an
+// adjustment of amount for reason.
+func validateAdjustment(amount int64, reason, note string) error {
+	sign, ok := adjustmentReasons[reason]
+	if !ok {
+		reasons := make([]string, 0, len(adjustmentReasons))
+		for reason := range adjustmentReasons {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		return fmt.Errorf("reason must be one of %s", strings.Join(reasons, ", "))
+	}
+	switch {
+	case amount == 0:
+		return fmt.Errorf("amount must not be 0")
+	case sign < 0 && amount > 0:
+		return fmt.Errorf("%s amounts must be negative", reason)
+	case sign > 0 && amount < 0:
+		return fmt.Errorf("%s amounts must be positive", reason)
+	case len(note) > maxAdjustmentNote:
+		return fmt.Errorf("note must be at most %d bytes", maxAdjustmentNote)
+	}
+	return nil
+}
+
+// Adjust records an adjustment of the price of an order, billed to its
+// tenant. Returns errNoSuchOrder if there is no such order, archived orders
+// cannot be adjusted, and errNegativeFinalPrice if the order's final price
+// would go below 0.
+func (s *OrderService) Adjust(orderID, amount int64, reason, note, actor string) (*Adjustment, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed at Begin: %s", err)
+	}
+	defer tx.Rollback()
+	var (
+		tenant, currency string
+		price, adjusted  int64
+	)
+	err = tx.QueryRow(`SELECT tenant_id, COALESCE(price, 0), COALESCE(price_adjustments, 0),
+		COALESCE(currency, '') FROM orders WHERE id = ?`, orderID).Scan(&tenant, &price, &adjusted, &currency)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchOrder
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query order %d: %s", orderID, err)
+	}
+	if price+adjusted+amount < 0 {
+		return nil, errNegativeFinalPrice
+	}
+
+	data := orderAdjusted{Amount: amount, Currency: currency, Reason: reason, Note: note, Actor: actor}
+	event, err := newEvent(orderID, EventAdjusted, data)
+	if err == nil {
+		err = record(tx, s.config.FieldKey, event)
+	}
+	if err == nil {
+		err = audit(tx, orderID, "adjust", actor, data)
+	}
+	if err == nil {
+		err = bill(tx, tenant, billAdjustment, orderID, amount, currency, event.Time)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to adjust order %d: %s", orderID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit adjustment of order %d: %s", orderID, err)
+	}
+	s.orderCache.invalidate(orderID)
+	return &Adjustment{ID: event.ID, OrderID: orderID, orderAdjusted: data,
+		Time: event.Time.UTC().Truncate(time.Second)}, nil
+}
+
+// Adjustments returns the adjustments of an order, oldest first.
+func (s *OrderService) Adjustments(orderID int64) ([]Adjustment, error) {
+	rows, err := s.DB.Query("SELECT id, order_id, type, data, created_at FROM events WHERE order_id = ? AND type = ? "+
+		"ORDER BY id", orderID, string(EventAdjusted))
+	if err != nil {
+		return nil, fmt.Errorf("unable to query adjustments: %s", err)
+	}
+	defer rows.Close()
+	adjustments := []Adjustment{}
+	for rows.Next() {
+		event, err := scanEvent(s.config.FieldKey, rows)
+		if err != nil {
+			return nil, err
+		}
+		adjustment := Adjustment{ID: event.ID, OrderID: event.OrderID, Time: event.Time}
+		if err := json.Unmarshal(event.Data, &adjustment.orderAdjusted); err != nil {
+			return nil, fmt.Errorf("invalid %s event %d: %s", event.Type, event.ID, err)
+		}
+		adjustments = append(adjustments, adjustment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query adjustments: %s", err)
+	}
+	return adjustments, nil
+}
+
+// handleAdjustments serves the adjustments of an order, admin only.
+//
+//	GET  /orders/{id}/adjustments  lists them, oldest first.
+//	POST /orders/{id}/adjustments  adds one, {"amount": -500, "reason": "refund", "note": "late"}.
+func (s *OrderService) handleAdjustments(w http.ResponseWriter, req *http.Request, orderID int64) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	if req.Method == http.MethodGet {
+		if _, err := s.Get(orderID); err == errNoSuchOrder {
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+			return
+		}
+		adjustments, err := s.Adjustments(orderID)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Adjustments() %d failed: %s",
+				orderID, err)
+			return
+		}
+		respond(w, req, 200, adjustments, "order %d, %d adjustments", orderID, len(adjustments))
+		return
+	}
+
+	var buf bytes.Buffer
+	io.Copy(&buf, req.Body)
+	var body struct {
+		Amount int64  `json:"amount"`
+		Reason string `json:"reason"`
+		Note   string `json:"note"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+		return
+	}
+	body.Note = strings.TrimSpace(body.Note)
+	if err := validateAdjustment(body.Amount, body.Reason, body.Note); err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_ADJUSTMENT", Detail: err.Error()}, "%s", err)
+		return
+	}
+	adjustment, err := s.Adjust(orderID, body.Amount, body.Reason, body.Note, s.auditActor(req))
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case errNegativeFinalPrice:
+		respond(w, req, 409, HTTPResponseError{Error: "NEGATIVE_FINAL_PRICE", Detail: err.Error()},
+			"order %d: %s", orderID, err)
+	case nil:
+		respond(w, req, 201, adjustment, "adjustment %d of order %d", adjustment.ID, orderID)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Adjust() %d failed: %s", orderID, err)
+	}
+}
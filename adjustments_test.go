@@ -0,0 +1,94 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdjustments(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Tariff: Tariff{BaseFare: 1000, Currency: "EUR"}})
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+
+	if w := serve(svc, "POST", "/orders/1/adjustments", "acme", `{"amount": -100, "reason": "refund"}`); w.Code != 401 {
+		t.Errorf("expected adjustments to be admin only, got %d", w.Code)
+	}
+	for _, body := range []string{
+		`{"amount": 0, "reason": "correction"}`,
+		`{"amount": 100, "reason": "refund"}`,
+		`{"amount": -100, "reason": "surcharge"}`,
+		`{"amount": -100, "reason": "because"}`,
+	} {
+		if w := serveAdmin(svc, "POST", "/orders/1/adjustments", body); w.Code != 400 {
+			t.Errorf("POST %s returned %d", body, w.Code)
+		}
+	}
+	if w := serveAdmin(svc, "POST", "/orders/2/adjustments", `{"amount": -100, "reason": "refund"}`); w.Code != 404 {
+		t.Errorf("adjusting a missing order returned %d", w.Code)
+	}
+
+	for _, body := range []string{
+		`{"amount": -300, "reason": "refund", "note": "late"}`,
+		`{"amount": 50, "reason": "surcharge"}`,
+	} {
+		w := serveAdmin(svc, "POST", "/orders/1/adjustments", body)
+		var adjustment Adjustment
+		if err := json.NewDecoder(w.Body).Decode(&adjustment); err != nil || w.Code != 201 ||
+			adjustment.Currency != "EUR" || adjustment.Actor != auditActorAdmin {
+			t.Fatalf("POST %s returned %d %+v, %v", body, w.Code, adjustment, err)
+		}
+	}
+	if w := serveAdmin(svc, "POST", "/orders/1/adjustments", `{"amount": -751, "reason": "refund"}`); w.Code != 409 {
+		t.Errorf("refunding more than the final price returned %d", w.Code)
+	}
+
+	w := serveAdmin(svc, "GET", "/orders/1/adjustments", "")
+	var adjustments []Adjustment
+	if err := json.NewDecoder(w.Body).Decode(&adjustments); err != nil || len(adjustments) != 2 ||
+		adjustments[0].Amount != -300 || adjustments[0].Note != "late" || adjustments[1].Reason != "surcharge" {
+		t.Errorf("unexpected adjustments %+v, %v", adjustments, err)
+	}
+
+	var order OrderDTO
+	w = serve(svc, "GET", "/orders/1", "acme", "")
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 1000 || order.FinalPrice == nil ||
+		*order.FinalPrice != 750 {
+		t.Errorf("unexpected order %+v, %v", order, err)
+	}
+	w = serve(svc, "GET", "/orders?fields=id,final_price", "acme", "")
+	if listing := strings.TrimSpace(w.Body.String()); listing != `[{"id":1,"final_price":750}]` {
+		t.Errorf("unexpected listing %s", w.Body)
+	}
+
+	// Replays keep the adjustments.
+	if _, err := Replay(svc.DB, svc.config.FieldKey); err != nil {
+		t.Fatal(err)
+	}
+	if order, err := svc.Get(1); err != nil || order.FinalPrice == nil || *order.FinalPrice != 750 {
+		t.Errorf("unexpected order after replay %+v, %v", order, err)
+	}
+
+	export, err := svc.BillingExport(time.Date(time.Now().UTC().Year(), time.Now().UTC().Month(), 1, 0, 0, 0, 0,
+		time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, line := range export.Lines {
+		if line.Kind == billAdjustment {
+			found = true
+			if line.Quantity != 2 || line.Amount != -250 || line.Currency != "EUR" {
+				t.Errorf("unexpected billing line %+v", line)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("adjustments missing from the billing export %+v", export)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// adminTokenEnv names the environment variable holding the bearer token that
+// grants access to the /admin/ endpoints. Without it they are disabled.
+const adminTokenEnv = "ORDERSERVICE_ADMIN_TOKEN"
+
+// bearerToken returns the token of an "Authorization: Bearer" header or "".
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// isAdmin returns true if req carries the admin token or is made by a
+// dashboard user with the admin role.
+func (s *OrderService) isAdmin(req *http.Request) bool {
+	if user := dashboardUserFromRequest(req); user != nil && user.HasRole(scopeAdmin) {
+		return true
+	}
+	token := bearerToken(req)
+	return s.config.AdminToken != "" && token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1
+}
+
+// requireAdmin writes a 401 and returns false unless req is from an admin.
+func (s *OrderService) requireAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if s.isAdmin(req) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="orderservice"`)
+	respond(w, req, 401, HTTPResponseError{Error: "UNAUTHORIZED"}, "admin token required")
+	return false
+}
+
+// MaintenanceStatus is the body of GET and PUT /admin/maintenance.
+type MaintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode
+// requests that change state are rejected with 503, reads still work.
+func (s *OrderService) SetMaintenance(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&s.maintenance, value)
+}
+
+// InMaintenance returns true if maintenance mode is on.
+func (s *OrderService) InMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// isMutating returns true for requests that may change state.
+func isMutating(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	// Quotes are POSTed but store nothing.
+	return req.URL.Path != "/orders/quote"
+}
+
+// handleMaintenance serves /admin/maintenance.
+//
+//	GET /admin/maintenance  returns the MaintenanceStatus.
+//	PUT /admin/maintenance  sets it, e.g. {"enabled": true}.
+func (s *OrderService) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var status MaintenanceStatus
+		if err := json.Unmarshal(buf.Bytes(), &status); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		s.SetMaintenance(status.Enabled)
+	default:
+		respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+		return
+	}
+	status := MaintenanceStatus{Enabled: s.InMaintenance()}
+	respond(w, req, 200, status, "maintenance=%t", status.Enabled)
+}
@@ -0,0 +1,55 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveAdmin sends a request with the admin token "secret".
+func serveAdmin(svc *OrderService, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+
+	if w := serve(svc, "PUT", "/admin/maintenance", "", `{"enabled": true}`); w.Code != 401 {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/maintenance", `{"enabled": true}`); w.Code != 200 {
+		t.Fatalf("PUT /admin/maintenance returned %d: %s", w.Code, w.Body)
+	}
+
+	w := serve(svc, "POST", "/orders", "", createOrderDetails)
+	if w.Code != 503 || !strings.Contains(w.Body.String(), "MAINTENANCE") {
+		t.Errorf("expected 503 MAINTENANCE, got %d %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "", ""); w.Code != 503 {
+		t.Errorf("expected 503 for take, got %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 200 {
+		t.Errorf("expected reads to work, got %d", w.Code)
+	}
+
+	if w := serveAdmin(svc, "PUT", "/admin/maintenance", `{"enabled": false}`); w.Code != 200 {
+		t.Fatalf("PUT /admin/maintenance returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Errorf("expected writes to work again, got %d", w.Code)
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serveAdmin(svc, "GET", "/admin/maintenance", ""); w.Code != 401 {
+		t.Errorf("expected 401 without configured token, got %d", w.Code)
+	}
+}
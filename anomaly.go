@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of creation anomalies.
+const (
+	anomalySpike     = "creation_spike"   // Many more orders than usual.
+	anomalyIdentical = "identical_orders" // The same origin and destination over and over.
+)
+
+// spikeSmoothing is the weight of the latest window in a tenant's average
+// orders per window.
+const spikeSmoothing = 0.2
+
+// creationAnomalies counts the anomalies detected per kind.
+var creationAnomalies = expvar.NewMap("creation_anomalies")
+
+// AnomalyConfig configures the detection of unusual order creation per
+// tenant, e.g. a runaway integration creating orders in a loop. Orders are
+// counted per Window, in memory, each replica on its own.
+type AnomalyConfig struct {
+	Window time.Duration
+	// Creation is a spike when the orders of a window exceed both SpikeFactor
+	// times the tenant's average per window and MinOrders. A zero SpikeFactor
+	// disables spike detection.
+	SpikeFactor float64
+	MinOrders   int
+	// Orders with the same origin and destination allowed per window, 0 is
+	// unlimited.
+	MaxIdentical int
+	// Refuse the orders over the limits for the rest of the window with 429,
+	// rather than only alerting.
+	Throttle bool
+}
+
+// errAnomalyThrottled is returned by Insert for orders refused as part of an
+// anomaly.
+type errAnomalyThrottled struct {
+	Kind  string
+	Until time.Time // End of the window.
+}
+
+func (e errAnomalyThrottled) Error() string {
+	return "order creation throttled: " + e.Kind
+}
+
+// tenantCreations are the orders of a tenant in the current window.
+type tenantCreations struct {
+	windowStart time.Time
+	orders      int
+	average     float64        // Orders per window before this one, smoothed.
+	identical   map[string]int // Orders per origin and destination.
+	alerted     map[string]bool
+}
+
+// anomalyDetector watches the orders tenants create.
+type anomalyDetector struct {
+	config  AnomalyConfig
+	db      *sql.DB
+	mu      sync.Mutex
+	tenants map[string]*tenantCreations
+	now     func() time.Time
+}
+
+func newAnomalyDetector(config AnomalyConfig, db *sql.DB) *anomalyDetector {
+	return &anomalyDetector{config: config, db: db, tenants: map[string]*tenantCreations{}, now: time.Now}
+}
+
+// enabled returns whether any anomaly is detected.
+func (d *anomalyDetector) enabled() bool {
+	return d.config.Window > 0 && (d.config.SpikeFactor > 0 || d.config.MaxIdentical > 0)
+}
+
+// creations returns the counts of tenant for the window of now, starting a
+// new window if the last one is over.
+func (d *anomalyDetector) creations(tenant string, now time.Time) *tenantCreations {
+	start := now.Truncate(d.config.Window)
+	c, ok := d.tenants[tenant]
+	if !ok {
+		c = &tenantCreations{windowStart: start}
+		d.tenants[tenant] = c
+	}
+	if c.windowStart.Before(start) {
+		c.average = (1-spikeSmoothing)*c.average + spikeSmoothing*float64(c.orders)
+		// Windows without orders lower the average too, up to a point
+		// where it is as good as zero.
+		for missed := int(start.Sub(c.windowStart)/d.config.Window) - 1; missed > 0 && c.average > 0.01; missed-- {
+			c.average *= 1 - spikeSmoothing
+		}
+		c.windowStart, c.orders, c.identical, c.alerted = start, 0, nil, nil
+	}
+	if c.identical == nil {
+		c.identical, c.alerted = map[string]int{}, map[string]bool{}
+	}
+	return c
+}
+
+// observe counts an order of tenant from origin to destination. It returns
+// errAnomalyThrottled if the order is part of an anomaly and throttling is
+// on, in which case it is not counted.
+func (d *anomalyDetector) observe(tenant string, details CreateOrderDetails) error {
+	if !d.enabled() {
+		return nil
+	}
+	route := strings.Join(details.Origin, ",") + ">" + strings.Join(details.Destination, ",")
+	d.mu.Lock()
+	now := d.now()
+	c := d.creations(tenant, now)
+	var kind, detail string
+	switch {
+	case d.config.MaxIdentical > 0 && c.identical[route]+1 > d.config.MaxIdentical:
+		kind = anomalyIdentical
+		detail = fmt.Sprintf("over %d orders from %s to %s within %s", d.config.MaxIdentical,
+			strings.Join(details.Origin, ","), strings.Join(details.Destination, ","), d.config.Window)
+	case d.config.SpikeFactor > 0 && c.orders+1 > d.config.MinOrders &&
+		float64(c.orders+1) > d.config.SpikeFactor*c.average:
+		kind = anomalySpike
+		detail = fmt.Sprintf("over %d orders within %s, %.1f on average", c.orders, d.config.Window, c.average)
+	}
+	alert := kind != "" && !c.alerted[kind]
+	if alert {
+		c.alerted[kind] = true
+	}
+	throttled := kind != "" && d.config.Throttle
+	if !throttled {
+		c.orders++
+		c.identical[route]++
+	}
+	until := c.windowStart.Add(d.config.Window)
+	d.mu.Unlock()
+
+	if alert {
+		creationAnomalies.Add(kind, 1)
+		fmt.Printf("Anomaly: tenant %q %s: %s\n", tenant, kind, detail)
+		if err := raiseAlert(d.db, tenant, kind, detail, now); err != nil {
+			fmt.Printf("Anomaly: %s\n", err)
+		}
+	}
+	if throttled {
+		return errAnomalyThrottled{Kind: kind, Until: until}
+	}
+	return nil
+}
+
+// Alert is an item of GET /admin/tenants/{tenant}/alerts.
+type Alert struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"` // "creation_spike" or "identical_orders".
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// raiseAlert records an anomaly of tenant.
+func raiseAlert(db *sql.DB, tenant, kind, detail string, now time.Time) error {
+	_, err := db.Exec("INSERT INTO alerts (tenant_id, kind, detail, created_at) VALUES (?, ?, ?, ?)", tenant, kind,
+		detail, now.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to record %s alert of tenant %q: %s", kind, tenant, err)
+	}
+	return nil
+}
+
+// Alerts returns the latest limit alerts of tenant, newest first.
+func (s *OrderService) Alerts(tenant string, limit int) ([]Alert, error) {
+	rows, err := s.DB.Query("SELECT id, kind, detail, created_at FROM alerts WHERE tenant_id = ? ORDER BY id DESC LIMIT ?",
+		tenant, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query alerts of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	alerts := []Alert{}
+	for rows.Next() {
+		var (
+			alert     Alert
+			createdAt int64
+		)
+		if err := rows.Scan(&alert.ID, &alert.Kind, &alert.Detail, &createdAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		alert.CreatedAt = time.Unix(createdAt, 0).UTC()
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// handleTenantAlerts serves GET /admin/tenants/{tenant}/alerts?limit=100, the
+// anomalies detected in the tenant's order creation.
+func (s *OrderService) handleTenantAlerts(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	limit := 100
+	if param := req.URL.Query().Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 1 || limit > 1000 {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: "limit must be 1 to 1000"},
+				"limit %q", param)
+			return
+		}
+	}
+	alerts, err := s.Alerts(tenant, limit)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Alerts(): %s", err)
+		return
+	}
+	respond(w, req, 200, alerts, "tenant %q %d alerts", tenant, len(alerts))
+}
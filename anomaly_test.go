@@ -0,0 +1,80 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAnomalySpike(t *testing.T) {
+	d := newAnomalyDetector(AnomalyConfig{Window: time.Minute, SpikeFactor: 3, MinOrders: 2}, openTestDB(t))
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+	details := CreateOrderDetails{Origin: []string{"1", "2"}, Destination: []string{"3", "4"}}
+	create := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := d.observe("acme", details); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A new tenant may create MinOrders per window.
+	create(2)
+	if creationAnomalies.Get(anomalySpike) != nil {
+		t.Fatalf("unexpected spike")
+	}
+	// The average grows with the windows at about 10 orders.
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Minute)
+		create(10)
+	}
+	spikes := creationAnomalies.Get(anomalySpike).String()
+	now = now.Add(time.Minute)
+	create(25)
+	if creationAnomalies.Get(anomalySpike).String() != spikes {
+		t.Fatalf("unexpected spike %s", creationAnomalies.Get(anomalySpike))
+	}
+	now = now.Add(time.Minute)
+	create(60)
+	if creationAnomalies.Get(anomalySpike).String() == spikes {
+		t.Fatalf("expected a spike")
+	}
+}
+
+func TestAnomalyThrottle(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret",
+		Anomalies: AnomalyConfig{Window: time.Hour, MaxIdentical: 2, Throttle: true}})
+	for i := 0; i < 2; i++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+		}
+	}
+	w := serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("identical POST /orders returned %d: %s", w.Code, w.Body)
+	}
+	serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	// Other tenants and other routes are not throttled.
+	if w := serve(svc, "POST", "/orders", "other", createOrderDetails); w.Code != 200 {
+		t.Errorf("POST /orders of another tenant returned %d", w.Code)
+	}
+	if w := serve(svc, "POST", "/orders", "acme", `{"origin": ["1", "2"], "destination": ["3", "4"]}`); w.Code != 200 {
+		t.Errorf("POST /orders to another destination returned %d: %s", w.Code, w.Body)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/alerts", "")
+	var alerts []Alert
+	if err := json.NewDecoder(w.Body).Decode(&alerts); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || len(alerts) != 1 || alerts[0].Kind != anomalyIdentical {
+		t.Errorf("unexpected alerts %d %+v", w.Code, alerts)
+	}
+	if w := serve(svc, "GET", "/admin/tenants/acme/alerts", "acme", ""); w.Code != 401 {
+		t.Errorf("alerts without credentials returned %d", w.Code)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys are "osk_<id>_<secret>". Only a hash of the secret is stored.
+const apiKeyPrefix = "osk_"
+
+// Scopes of API keys.
+const (
+	scopeRead  = "read"  // GET requests and quotes.
+	scopeWrite = "write" // Requests that change state.
+	scopeAdmin = "admin" // Managing the tenant's own keys.
+)
+
+var validScopes = map[string]bool{scopeRead: true, scopeWrite: true, scopeAdmin: true}
+
+const (
+	// apiKeyCacheTTL is how long a verified key is trusted without looking
+	// at the database again.
+	apiKeyCacheTTL = time.Minute
+	// revocationPollEvery is how often keys revoked by other replicas are
+	// loaded into the revocation cache.
+	revocationPollEvery = time.Second
+	// lastUsedEvery limits writes of last_used_at to one per key per period.
+	lastUsedEvery = time.Minute
+)
+
+var (
+	errInvalidAPIKey = fmt.Errorf("invalid API key")
+	errRevokedAPIKey = fmt.Errorf("revoked API key")
+	errNoSuchAPIKey  = fmt.Errorf("no such API key")
+)
+
+// APIKey is a key a tenant's machine clients authenticate with.
+type APIKey struct {
+	ID         string     `json:"id"`
+	TenantID   string     `json:"tenant_id"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// The key itself, SECRET. Only returned when the key is created.
+	Key string `json:"key,omitempty"`
+	// Stands in for the client certificate binding a client to a tenant,
+	// which is not a stored key.
+	Certificate bool `json:"-"`
+}
+
+// HasScope returns true if the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPISecret returns the hash stored for the secret part of a key.
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// apiKeyCache holds recently verified keys and the ids of revoked keys. It is
+// shared by the requests of one process, replicas learn about each other's
+// revocations by polling the api_keys table.
+type apiKeyCache struct {
+	mu       sync.Mutex
+	verified map[string]cachedAPIKey
+	revoked  map[string]bool
+	lastUsed map[string]time.Time // When last_used_at was last written.
+	polledAt time.Time
+	now      func() time.Time
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	hash    string
+	expires time.Time
+}
+
+func newAPIKeyCache() *apiKeyCache {
+	return &apiKeyCache{verified: map[string]cachedAPIKey{}, revoked: map[string]bool{},
+		lastUsed: map[string]time.Time{}, now: time.Now}
+}
+
+// revoke drops a key from the cache and refuses it from now on.
+func (c *apiKeyCache) revoke(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.verified, id)
+	c.revoked[id] = true
+}
+
+// pollRevocations loads keys revoked since the last poll, at most once per
+// revocationPollEvery.
+func (c *apiKeyCache) pollRevocations(db *sql.DB) error {
+	c.mu.Lock()
+	now := c.now()
+	since := c.polledAt
+	if now.Sub(since) < revocationPollEvery {
+		c.mu.Unlock()
+		return nil
+	}
+	c.polledAt = now
+	c.mu.Unlock()
+
+	// Look back a little for revocations committed during the last poll.
+	rows, err := db.Query("SELECT id FROM api_keys WHERE revoked_at >= ?", since.Add(-revocationPollEvery).Unix())
+	if err != nil {
+		return fmt.Errorf("unable to poll revoked keys: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		c.revoke(id)
+	}
+	return rows.Err()
+}
+
+// authenticate returns the API key req is made with, or nil if it has none.
+func (s *OrderService) authenticate(req *http.Request) (*APIKey, error) {
+	token := bearerToken(req)
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidAPIKey
+	}
+	id, hash := parts[0], hashAPISecret(parts[1])
+
+	cache := s.apiKeys
+	if err := cache.pollRevocations(s.DB); err != nil {
+		fmt.Printf("authenticate: %s\n", err)
+	}
+	cache.mu.Lock()
+	now := cache.now()
+	if cache.revoked[id] {
+		cache.mu.Unlock()
+		return nil, errRevokedAPIKey
+	}
+	cached, ok := cache.verified[id]
+	cache.mu.Unlock()
+
+	if !ok || now.After(cached.expires) {
+		key, storedHash, err := s.loadAPIKey(id)
+		if err == errNoSuchAPIKey {
+			return nil, errInvalidAPIKey
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key.RevokedAt != nil {
+			cache.revoke(id)
+			return nil, errRevokedAPIKey
+		}
+		cached = cachedAPIKey{key: key, hash: storedHash, expires: now.Add(apiKeyCacheTTL)}
+		cache.mu.Lock()
+		cache.verified[id] = cached
+		cache.mu.Unlock()
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(cached.hash)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+
+	cache.mu.Lock()
+	touch := now.Sub(cache.lastUsed[id]) >= lastUsedEvery
+	if touch {
+		cache.lastUsed[id] = now
+	}
+	cache.mu.Unlock()
+	if touch {
+		if _, err := s.DB.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now.Unix(), id); err != nil {
+			fmt.Printf("authenticate: unable to record use of key %s: %s\n", id, err)
+		}
+	}
+	return cached.key, nil
+}
+
+// apiKeyContextKey is the context key of the APIKey a request is made with.
+type apiKeyContextKey struct{}
+
+// apiKeyFromRequest returns the API key req was authenticated with, or nil.
+func apiKeyFromRequest(req *http.Request) *APIKey {
+	key, _ := req.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// checkCredentials authenticates req. Requests with a key act for the key's
+// tenant and only within its scopes, dashboard users within their roles and
+// clients with certificates as their identity says.
+// Without either requests are refused if keys are required, except under
+// /admin/ which has its own token. Returns the request to serve, or nil after
+// responding with an error.
+func (s *OrderService) checkCredentials(w http.ResponseWriter, req *http.Request) *http.Request {
+	token := bearerToken(req)
+	if s.oidc != nil && looksLikeJWT(token) && !s.isAdmin(req) {
+		return s.checkIDToken(w, req, token)
+	}
+	// Bearer tokens take precedence over client certificates.
+	if sans := certSANs(req); token == "" && len(sans) > 0 {
+		return s.checkClientCert(w, req, sans)
+	}
+	key, err := s.authenticate(req)
+	if err == errInvalidAPIKey || err == errRevokedAPIKey {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="orderservice"`)
+		respond(w, req, 401, HTTPResponseError{Error: "INVALID_API_KEY"}, "%s", err)
+		return nil
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "authenticate(): %s", err)
+		return nil
+	}
+	if key == nil {
+		if s.config.RequireAPIKeys && !strings.HasPrefix(req.URL.Path, "/admin/") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="orderservice"`)
+			respond(w, req, 401, HTTPResponseError{Error: "API_KEY_REQUIRED"}, "no API key")
+			return nil
+		}
+		return req
+	}
+
+	if tenant := strings.TrimSpace(req.Header.Get(tenantHeader)); tenant != "" && tenant != key.TenantID {
+		respond(w, req, 403, HTTPResponseError{Error: "TENANT_MISMATCH"}, "key %s belongs to tenant %q, not %q",
+			key.ID, key.TenantID, tenant)
+		return nil
+	}
+	if scope := requiredScope(req); scope != "" && !key.HasScope(scope) {
+		respond(w, req, 403, HTTPResponseError{Error: "INSUFFICIENT_SCOPE", Detail: scope + " scope required"},
+			"key %s lacks %s", key.ID, scope)
+		return nil
+	}
+	return req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+}
+
+// checkIDToken authenticates a dashboard user by their ID token.
+func (s *OrderService) checkIDToken(w http.ResponseWriter, req *http.Request, token string) *http.Request {
+	user, err := s.oidc.Verify(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="orderservice"`)
+		respond(w, req, 401, HTTPResponseError{Error: "INVALID_ID_TOKEN"}, "%s", err)
+		return nil
+	}
+	if scope := requiredScope(req); scope != "" && !user.HasRole(scope) {
+		respond(w, req, 403, HTTPResponseError{Error: "INSUFFICIENT_SCOPE", Detail: scope + " role required"},
+			"user %s lacks %s", user.Subject, scope)
+		return nil
+	}
+	return req.WithContext(context.WithValue(req.Context(), dashboardUserContextKey{}, user))
+}
+
+// requiredScope returns the scope or role needed for req, "" for /admin/
+// endpoints which check for themselves.
+func requiredScope(req *http.Request) string {
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/admin/"):
+		return ""
+	case isMutating(req):
+		return scopeWrite
+	default:
+		return scopeRead
+	}
+}
+
+// serveAuthenticated serves req with the mux of its tenant's shard once its
+// credentials check out, unless the client is banned for making too many
+// failing requests.
+func (s *OrderService) serveAuthenticated(w http.ResponseWriter, req *http.Request) {
+	// /admin/ is exempt from bans so operators can always lift them.
+	if strings.HasPrefix(req.URL.Path, "/admin/") {
+		if req = s.checkCredentials(w, req); req != nil {
+			s.markDeprecated(w, req)
+			s.shardOf(shardTenant(req)).ServeMux.ServeHTTP(w, req)
+		}
+		return
+	}
+	client := abuseClientID(req)
+	if s.refuseBanned(w, req, client) {
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() { s.abuse.observe(client, sw.code) }()
+	if req = s.checkCredentials(sw, req); req == nil {
+		return
+	}
+	if key := apiKeyFromRequest(req); key != nil && !key.Certificate {
+		defer func() { s.keyUsage.record(key.ID, req, sw.code) }()
+	}
+	if keyClient := abuseClientID(req); keyClient != client {
+		if client = keyClient; s.refuseBanned(w, req, client) {
+			return
+		}
+	}
+	if shard := s.shardOf(shardTenant(req)); shard.checkSignature(sw, req) {
+		s.markDeprecated(sw, req)
+		shard.serveIdempotent(sw, req, shard.ServeMux)
+	}
+}
+
+// CreateAPIKey makes a new key for tenant. The returned key is the only copy
+// of the secret.
+func (s *OrderService) CreateAPIKey(tenant string, scopes []string) (*APIKey, error) {
+	key := &APIKey{ID: randomHex(8), TenantID: tenant, Scopes: scopes, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	secret := randomHex(24)
+	key.Key = apiKeyPrefix + key.ID + "_" + secret
+	_, err := s.DB.Exec("INSERT INTO api_keys (id, tenant_id, hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+		key.ID, tenant, hashAPISecret(secret), strings.Join(scopes, ","), key.CreatedAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to save API key: %s", err)
+	}
+	return key, nil
+}
+
+// RevokeAPIKey revokes a key of tenant. Returns errNoSuchAPIKey if the tenant
+// has no such key.
+func (s *OrderService) RevokeAPIKey(tenant, id string) error {
+	result, err := s.DB.Exec("UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ? AND tenant_id = ?",
+		time.Now().Unix(), id, tenant)
+	if err != nil {
+		return fmt.Errorf("unable to revoke API key: %s", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errNoSuchAPIKey
+	}
+	s.apiKeys.revoke(id)
+	return nil
+}
+
+const apiKeyColumns = "id, tenant_id, hash, scopes, created_at, last_used_at, revoked_at"
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, string, error) {
+	var (
+		key                 APIKey
+		hash, scopes        string
+		createdAt           int64
+		lastUsed, revokedAt sql.NullInt64
+	)
+	if err := row.Scan(&key.ID, &key.TenantID, &hash, &scopes, &createdAt, &lastUsed, &revokedAt); err != nil {
+		return nil, "", err
+	}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	key.CreatedAt = time.Unix(createdAt, 0).UTC()
+	if lastUsed.Valid {
+		t := time.Unix(lastUsed.Int64, 0).UTC()
+		key.LastUsedAt = &t
+	}
+	if revokedAt.Valid {
+		t := time.Unix(revokedAt.Int64, 0).UTC()
+		key.RevokedAt = &t
+	}
+	return &key, hash, nil
+}
+
+// loadAPIKey returns a key and the hash of its secret.
+func (s *OrderService) loadAPIKey(id string) (*APIKey, string, error) {
+	key, hash, err := scanAPIKey(s.DB.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, "", errNoSuchAPIKey
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to load API key %s: %s", id, err)
+	}
+	return key, hash, nil
+}
+
+// ListAPIKeys returns the keys of tenant, without their secrets.
+func (s *OrderService) ListAPIKeys(tenant string) ([]APIKey, error) {
+	rows, err := s.DB.Query("SELECT "+apiKeyColumns+" FROM api_keys WHERE tenant_id = ? ORDER BY created_at, id",
+		tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query API keys: %s", err)
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		key, _, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// requireTenantAdmin writes a 401 and returns false unless req is from an
+// admin or made with a key of tenant that has the admin scope.
+func (s *OrderService) requireTenantAdmin(w http.ResponseWriter, req *http.Request, tenant string) bool {
+	if key := apiKeyFromRequest(req); key != nil && key.TenantID == tenant && key.HasScope(scopeAdmin) {
+		return true
+	}
+	return s.requireAdmin(w, req)
+}
+
+// handleTenantKeys serves the API keys of a tenant.
+//
+//	GET    /admin/tenants/{tenant}/keys       lists the keys, without secrets.
+//	POST   /admin/tenants/{tenant}/keys       creates one, {"scopes": ["read"]}.
+//	DELETE /admin/tenants/{tenant}/keys/{id}  revokes one.
+func (s *OrderService) handleTenantKeys(w http.ResponseWriter, req *http.Request, tenant, id string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	switch {
+	case id == "" && req.Method == http.MethodGet:
+		keys, err := s.ListAPIKeys(tenant)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "ListAPIKeys(): %s", err)
+			return
+		}
+		respond(w, req, 200, keys, "%d keys of tenant %q", len(keys), tenant)
+	case id == "" && req.Method == http.MethodPost:
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var body struct {
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if len(body.Scopes) == 0 {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_SCOPES", Detail: "at least one scope required"}, "")
+			return
+		}
+		for _, scope := range body.Scopes {
+			if !validScopes[scope] {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_SCOPES", Detail: "unknown scope " + scope},
+					"scope %q", scope)
+				return
+			}
+		}
+		key, err := s.CreateAPIKey(tenant, body.Scopes)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "CreateAPIKey(): %s", err)
+			return
+		}
+		respond(w, req, 201, key, "created key %s for tenant %q", key.ID, tenant)
+	case id != "" && req.Method == http.MethodDelete:
+		switch err := s.RevokeAPIKey(tenant, id); err {
+		case nil:
+			respond(w, req, 200, HTTPResponseStatus{"SUCCESS"}, "revoked key %s of tenant %q", id, tenant)
+		case errNoSuchAPIKey:
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_KEY"}, "key %s of tenant %q", id, tenant)
+		default:
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "RevokeAPIKey(): %s", err)
+		}
+	default:
+		respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+	}
+}
@@ -0,0 +1,200 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveKey serves a request made with an API key.
+func serveKey(svc *OrderService, method, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+// createKey creates an API key for tenant with the admin token.
+func createKey(t *testing.T, svc *OrderService, tenant string, scopes ...string) *APIKey {
+	t.Helper()
+	body, _ := json.Marshal(map[string][]string{"scopes": scopes})
+	w := serveAdmin(svc, "POST", "/admin/tenants/"+tenant+"/keys", string(body))
+	if w.Code != 201 {
+		t.Fatalf("creating key returned %d: %s", w.Code, w.Body)
+	}
+	var key APIKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	return &key
+}
+
+func TestAPIKeys(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	reader := createKey(t, svc, "acme", scopeRead)
+	writer := createKey(t, svc, "acme", scopeRead, scopeWrite)
+	if !strings.HasPrefix(reader.Key, apiKeyPrefix+reader.ID+"_") {
+		t.Fatalf("unexpected key %+v", reader)
+	}
+
+	// Orders are created for the key's tenant.
+	if w := serveKey(svc, "POST", "/orders", writer.Key, createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	var tenant string
+	if err := svc.DB.QueryRow("SELECT tenant_id FROM orders WHERE id = 1").Scan(&tenant); err != nil || tenant != "acme" {
+		t.Errorf("order belongs to %q, %v", tenant, err)
+	}
+
+	if w := serveKey(svc, "GET", "/orders", reader.Key, ""); w.Code != 200 {
+		t.Errorf("GET with read key returned %d", w.Code)
+	}
+	if w := serveKey(svc, "POST", "/orders", reader.Key, createOrderDetails); w.Code != 403 {
+		t.Errorf("POST with read key returned %d", w.Code)
+	}
+	if w := serveKey(svc, "GET", "/orders", reader.Key+"x", ""); w.Code != 401 {
+		t.Errorf("GET with wrong secret returned %d", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+reader.Key)
+	req.Header.Set(tenantHeader, "other")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("GET with another tenant's header returned %d", w.Code)
+	}
+
+	// Keys are listed without secrets and with their last use.
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/keys", "")
+	var keys []APIKey
+	if err := json.NewDecoder(w.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Key != "" || keys[0].LastUsedAt == nil {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+	var hash string
+	svc.DB.QueryRow("SELECT hash FROM api_keys WHERE id = ?", reader.ID).Scan(&hash)
+	if strings.Contains(reader.Key, hash) {
+		t.Errorf("key stored in the clear")
+	}
+
+	// Revocation takes effect right away.
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/keys/"+reader.ID, ""); w.Code != 200 {
+		t.Fatalf("DELETE returned %d", w.Code)
+	}
+	if w := serveKey(svc, "GET", "/orders", reader.Key, ""); w.Code != 401 {
+		t.Errorf("GET with revoked key returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/other/keys/"+writer.ID, ""); w.Code != 404 {
+		t.Errorf("DELETE of another tenant's key returned %d", w.Code)
+	}
+}
+
+func TestAPIKeyRevokedByReplica(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	replica, err := NewOrderService(svc.DB, Config{DistanceProvider: providerHaversine}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	replica.apiKeys.now = func() time.Time { return now }
+
+	key := createKey(t, svc, "acme", scopeRead)
+	if w := serveKey(replica, "GET", "/orders", key.Key, ""); w.Code != 200 {
+		t.Fatalf("GET returned %d", w.Code)
+	}
+	if err := svc.RevokeAPIKey("acme", key.ID); err != nil {
+		t.Fatal(err)
+	}
+	// The replica trusts its cache until it polls for revocations.
+	now = now.Add(revocationPollEvery)
+	if w := serveKey(replica, "GET", "/orders", key.Key, ""); w.Code != 401 {
+		t.Errorf("GET on replica with revoked key returned %d", w.Code)
+	}
+}
+
+func TestRequireAPIKeys(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", RequireAPIKeys: true})
+	if w := serve(svc, "GET", "/orders", "acme", ""); w.Code != 401 {
+		t.Errorf("GET without key returned %d", w.Code)
+	}
+	admin := createKey(t, svc, "acme", scopeAdmin)
+	if w := serveKey(svc, "GET", "/orders", admin.Key, ""); w.Code != 403 {
+		t.Errorf("GET with admin-only key returned %d", w.Code)
+	}
+	// Tenant admins manage their own keys only.
+	if w := serveKey(svc, "POST", "/admin/tenants/acme/keys", admin.Key, `{"scopes": ["read"]}`); w.Code != 201 {
+		t.Errorf("tenant admin creating a key returned %d", w.Code)
+	}
+	if w := serveKey(svc, "GET", "/admin/tenants/other/keys", admin.Key, ""); w.Code != 401 {
+		t.Errorf("tenant admin listing another tenant's keys returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "POST", "/admin/tenants/acme/keys", `{"scopes": ["root"]}`); w.Code != 400 {
+		t.Errorf("unknown scope returned %d", w.Code)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	acme, globex := createKey(t, svc, "acme", scopeRead, scopeWrite), createKey(t, svc, "globex", scopeRead, scopeWrite)
+	if w := serveKey(svc, "POST", "/orders", acme.Key, createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/orders", "/orders?status=UNASSIGNED", "/orders?updated_since=2000-01-01T00:00:00Z"} {
+		if w := serveKey(svc, "GET", path, acme.Key, ""); !strings.Contains(w.Body.String(), `"id":1`) {
+			t.Errorf("GET %s by acme returned %d %s", path, w.Code, w.Body)
+		}
+		if w := serveKey(svc, "GET", path, globex.Key, ""); w.Code != 200 || strings.Contains(w.Body.String(), `"id":1`) {
+			t.Errorf("GET %s by globex returned %d %s", path, w.Code, w.Body)
+		}
+	}
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+globex.Key)
+	req.Header.Set("Range", "orders=0-9")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if w.Code != 416 || w.Header().Get("Content-Range") != "orders */0" {
+		t.Errorf("range by globex returned %d %q", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	for _, c := range []struct{ method, path, body string }{
+		{"GET", "/orders/1", ""},
+		{"GET", "/orders/1/history", ""},
+		{"GET", "/orders/1/timeline", ""},
+		{"POST", "/orders/1/requote", ""},
+		{"PATCH", "/orders/1", `{"status": "TAKEN"}`},
+		{"POST", "/couriers/bob/batch-take", `{"orders": [1]}`},
+	} {
+		if w := serveKey(svc, c.method, c.path, globex.Key, c.body); w.Code != 404 {
+			t.Errorf("%s %s by globex returned %d %s", c.method, c.path, w.Code, w.Body)
+		}
+	}
+	req = httptest.NewRequest("PATCH", "/orders/1", strings.NewReader(`{"notes": "hi"}`))
+	req.Header.Set("Authorization", "Bearer "+globex.Key)
+	req.Header.Set("Content-Type", mergePatchMediaType)
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("update by globex returned %d %s", w.Code, w.Body)
+	}
+	if order, err := svc.Get(1); err != nil || order.State != StateUnassigned || order.Notes != "" {
+		t.Errorf("order after globex requests is %+v, %v", order, err)
+	}
+
+	// Staff reach the orders of every tenant.
+	if w := serveAdmin(svc, "GET", "/orders/1/history", ""); w.Code != 200 {
+		t.Errorf("GET history by admin returned %d", w.Code)
+	}
+	if w := serveKey(svc, "PATCH", "/orders/1", acme.Key, ""); w.Code != 200 {
+		t.Errorf("take by acme returned %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiVersionHeader names the request header with which clients pick the API
+// version. Requests without it get apiV1 so existing clients keep working.
+const apiVersionHeader = "API-Version"
+
+const (
+	// apiV1 is the original API.
+	apiV1 = 1
+	// apiV2 rejects request bodies with unknown fields.
+	apiV2 = 2
+	// apiV3 encodes ids in responses as strings, JavaScript numbers lose
+	// the precision of large int64s.
+	apiV3 = 3
+
+	latestAPIVersion = apiV3
+)
+
+// idMembers are the JSON members holding an id, idListMembers those holding
+// an array of ids.
+var (
+	idMembers = map[string]bool{"id": true, "order_id": true, "event_id": true, "duplicate_of": true,
+		"linked_order_id": true}
+	idListMembers = map[string]bool{"orders": true}
+)
+
+// apiVersion returns the API version requested by req.
+func apiVersion(req *http.Request) (int, error) {
+	value := strings.TrimSpace(req.Header.Get(apiVersionHeader))
+	if value == "" {
+		return apiV1, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < apiV1 || version > latestAPIVersion {
+		return 0, fmt.Errorf("unsupported API version %q, expected 1 to %d", value, latestAPIVersion)
+	}
+	return version, nil
+}
+
+// strictDecoding returns true if request bodies of version must not contain
+// unknown fields.
+func strictDecoding(version int) bool {
+	return version >= apiV2
+}
+
+// stringIDs returns true if responses to req encode ids as strings.
+// Unsupported versions are left to the handlers to reject.
+func stringIDs(req *http.Request) bool {
+	version, err := apiVersion(req)
+	return err == nil && version >= apiV3
+}
+
+// rewriteIDs re-encodes the JSON document data, keeping the order of its
+// members. If quote is set the numbers in idMembers and idListMembers become
+// strings, else the strings there holding an integer become numbers, so
+// request bodies may give ids either way.
+func rewriteIDs(data []byte, quote bool) ([]byte, error) {
+	type container struct {
+		object    bool
+		expectKey bool   // In an object, the next token is a member name.
+		member    string // In an object, the member of the next value.
+		ids       bool   // An array of ids.
+		n         int    // Members or elements written.
+	}
+	var (
+		out   bytes.Buffer
+		stack []container
+	)
+	writeString := func(s string) {
+		encoder := json.NewEncoder(&out)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(s)
+		out.Truncate(out.Len() - 1) // Encode's newline.
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if delim, ok := token.(json.Delim); ok && (delim == '}' || delim == ']') {
+			out.WriteByte(byte(delim))
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		var parent *container
+		if len(stack) > 0 {
+			parent = &stack[len(stack)-1]
+		}
+		isID := false
+		switch {
+		case parent == nil:
+		case parent.object && parent.expectKey:
+			if parent.n > 0 {
+				out.WriteByte(',')
+			}
+			parent.n++
+			parent.member, parent.expectKey = token.(string), false
+			writeString(parent.member)
+			out.WriteByte(':')
+			continue
+		case parent.object:
+			isID, parent.expectKey = idMembers[parent.member], true
+		default:
+			if parent.n > 0 {
+				out.WriteByte(',')
+			}
+			parent.n++
+			isID = parent.ids
+		}
+
+		switch value := token.(type) {
+		case json.Delim:
+			out.WriteByte(byte(value))
+			stack = append(stack, container{object: value == '{', expectKey: value == '{',
+				ids: value == '[' && parent != nil && parent.object && idListMembers[parent.member]})
+		case json.Number:
+			if isID && quote {
+				writeString(value.String())
+			} else {
+				out.WriteString(value.String())
+			}
+		case string:
+			if _, err := strconv.ParseInt(value, 10, 64); isID && !quote && err == nil {
+				out.WriteString(value)
+			} else {
+				writeString(value)
+			}
+		case bool:
+			out.WriteString(strconv.FormatBool(value))
+		case nil:
+			out.WriteString("null")
+		}
+	}
+	if len(stack) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return out.Bytes(), nil
+}
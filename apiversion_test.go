@@ -0,0 +1,63 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteIDs(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		quote  bool
+		expect string
+	}{
+		{`{"id":9007199254740993,"distance":1.5,"orders":[1,2],"links":[{"id":3,"status":"TAKEN"}]}`, true,
+			`{"id":"9007199254740993","distance":1.5,"orders":["1","2"],"links":[{"id":"3","status":"TAKEN"}]}`},
+		{`{"orders":4,"tenant_id":"acme","notes":"a & b","tags":null,"paid":true}`, true,
+			`{"orders":4,"tenant_id":"acme","notes":"a & b","tags":null,"paid":true}`},
+		{`[{"order_id":7},{"order_id":8}]`, true, `[{"order_id":"7"},{"order_id":"8"}]`},
+		{`{"linked_order_id": "12", "orders": ["1", 2, "x"], "promo_code": "34"}`, false,
+			`{"linked_order_id":12,"orders":[1,2,"x"],"promo_code":"34"}`},
+	} {
+		out, err := rewriteIDs([]byte(c.in), c.quote)
+		if err != nil || string(out) != c.expect {
+			t.Errorf("rewriteIDs(%s, %t) = %s %v, expected %s", c.in, c.quote, out, err, c.expect)
+		}
+	}
+	if _, err := rewriteIDs([]byte(`{"id": `), true); err == nil {
+		t.Error("truncated document rewritten")
+	}
+}
+
+func TestStringIDs(t *testing.T) {
+	svc := newTestService(t, Config{})
+	serveVersion := func(method, path, version, body string) string {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(apiVersionHeader, version)
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s %s returned %d: %s", method, path, w.Code, w.Body)
+		}
+		return w.Body.String()
+	}
+	if body := serveVersion("POST", "/orders", "3", createOrderDetails); !strings.HasPrefix(body, `{"id":"1",`) {
+		t.Errorf("POST /orders returned %s", body)
+	}
+	// Ids are accepted as strings in any version.
+	returnLeg := `{"origin": ["37.80", "-122.27"], "destination": ["37.80", "-122.29"], "linked_order_id": "1"}`
+	if body := serveVersion("POST", "/orders", "1", returnLeg); !strings.Contains(body, `"linked_order_id":1`) {
+		t.Errorf("POST /orders of a return leg returned %s", body)
+	}
+	if body := serveVersion("GET", "/orders?page=1&limit=10", "3", ""); !strings.HasPrefix(body, `[{"id":"1",`) ||
+		!strings.Contains(body, `"linked_order_id":"1"`) {
+		t.Errorf("GET /orders returned %s", body)
+	}
+	if body := serveVersion("GET", "/orders/2", "2", ""); !strings.HasPrefix(body, `{"id":2,`) {
+		t.Errorf("GET /orders/2 in version 2 returned %s", body)
+	}
+}
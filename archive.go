@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ArchiveConfig configures the archiver, which moves orders that can no
+// longer change out of the orders table into orders_archive, keeping the
+// table listings and duplicate checks scan small.
+type ArchiveConfig struct {
+	// TAKEN orders created longer than After ago are archived, 0 disables
+	// the archiver.
+	After time.Duration
+	// Time between runs.
+	Interval time.Duration
+	// Orders moved per transaction, so a large backlog does not hold the
+	// database lock for long.
+	BatchSize int
+}
+
+// defaultArchiveBatchSize is used for a zero ArchiveConfig.BatchSize.
+const defaultArchiveBatchSize = 500
+
+// archiver periodically moves old TAKEN orders to orders_archive. Archived
+// orders are still returned by Get and keep their events, but are no longer
+// listed.
+type archiver struct {
+	config ArchiveConfig
+	db     *sql.DB
+	now    func() time.Time
+}
+
+func newArchiver(config ArchiveConfig, db *sql.DB) *archiver {
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultArchiveBatchSize
+	}
+	return &archiver{config: config, db: db, now: time.Now}
+}
+
+// run archives every config.Interval until ctx is done.
+func (a *archiver) run(ctx context.Context) {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := a.archive(ctx)
+			if err != nil {
+				fmt.Printf("Archiver: %s\n", err)
+			}
+			if n > 0 {
+				fmt.Printf("Archiver: archived %d orders\n", n)
+			}
+		}
+	}
+}
+
+// archive moves every order due for archival, in batches. Returns the number
+// of orders moved.
+func (a *archiver) archive(ctx context.Context) (int, error) {
+	cutoff := a.now().Add(-a.config.After)
+	total := 0
+	for {
+		n, err := a.archiveBatch(ctx, cutoff)
+		total += n
+		if err != nil || n < a.config.BatchSize {
+			return total, err
+		}
+	}
+}
+
+// archiveBatch moves up to config.BatchSize TAKEN orders created before
+// cutoff in one transaction.
+func (a *archiver) archiveBatch(ctx context.Context, cutoff time.Time) (int, error) {
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed at BeginTx: %s", err)
+	}
+	defer tx.Rollback()
+
+	query, args, err := selectFrom("id", "orders").where("status = ?", string(StateTaken)).
+		where("created_at < ?", cutoff.Unix()).order("id").page(a.config.BatchSize, 0).build()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("unable to query orders to archive: %s", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to query orders to archive: %s", err)
+	}
+
+	archivedAt := a.now().Unix()
+	for _, id := range ids {
+		_, err := tx.Exec("INSERT INTO orders_archive ("+projectionColumns+", archived_at) SELECT "+
+			projectionColumns+", ? FROM orders WHERE id = ?", archivedAt, id)
+		if err != nil {
+			return 0, fmt.Errorf("unable to archive order %d: %s", id, err)
+		}
+		err = recordTombstones(tx, tombstoneArchived, time.Unix(archivedAt, 0),
+			"SELECT id, tenant_id FROM orders WHERE id = ?", id)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("DELETE FROM orders WHERE id = ?", id); err != nil {
+			return 0, fmt.Errorf("unable to archive order %d: %s", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit archived orders: %s", err)
+	}
+	return len(ids), nil
+}
+
+// getArchived returns the archived order with the given id or
+// errNoSuchOrder.
+func (s *OrderService) getArchived(orderID int64) (*Order, error) {
+	query, args, err := selectFrom(orderColumns, "orders_archive").where("id = ?", orderID).build()
+	if err != nil {
+		return nil, err
+	}
+	order, err := scanOrder(s.config.FieldKey, s.DB.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchOrder
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query archived order %d: %s", orderID, err)
+	}
+	return order, nil
+}
@@ -0,0 +1,61 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestArchiver(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for i := 0; i < 5; i++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	for _, id := range []int64{1, 2, 4} {
+		if err := svc.Take(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two batches of one, the third finds nothing left.
+	a := newArchiver(ArchiveConfig{After: time.Hour, BatchSize: 1}, svc.DB)
+	if n, err := a.archive(context.Background()); err != nil || n != 0 {
+		t.Fatalf("archived %d recent orders, %v", n, err)
+	}
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if n, err := a.archive(context.Background()); err != nil || n != 3 {
+		t.Fatalf("archived %d orders, %v", n, err)
+	}
+
+	if count, err := svc.Count(OrderFilter{}); err != nil || count != 2 {
+		t.Errorf("%d orders left, %v", count, err)
+	}
+	if order, err := svc.Get(2); err != nil || order.State != StateTaken {
+		t.Errorf("archived order 2: %+v, %v", order, err)
+	}
+	if w := serve(svc, "GET", "/orders/4", "", ""); w.Code != 200 {
+		t.Errorf("GET /orders/4 returned %d", w.Code)
+	}
+	if err := svc.Take(4); err != errTaken {
+		t.Errorf("taking archived order: %v", err)
+	}
+	if _, err := svc.Get(6); err != errNoSuchOrder {
+		t.Errorf("order 6: %v", err)
+	}
+
+	// Replaying the events does not bring archived orders back.
+	if problems, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(problems) != 0 {
+		t.Errorf("verify: %v, %v", problems, err)
+	}
+	if _, err := Replay(svc.DB, svc.config.FieldKey); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := svc.Count(OrderFilter{}); err != nil || count != 2 {
+		t.Errorf("%d orders after replay, %v", count, err)
+	}
+}
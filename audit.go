@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// auditActorAdmin is the actor recorded for changes made with the admin
+// token.
+const auditActorAdmin = "admin"
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// auditActor returns who is making req, for the audit log: "admin", the API
+// key, the dashboard user or else the tenant.
+func (s *OrderService) auditActor(req *http.Request) string {
+	if s.isAdmin(req) {
+		return auditActorAdmin
+	}
+	if key := apiKeyFromRequest(req); key != nil {
+		return "key:" + key.ID
+	}
+	if user := dashboardUserFromRequest(req); user != nil {
+		return "user:" + user.Subject
+	}
+	return "tenant:" + tenantFromRequest(req)
+}
+
+// audit appends an entry to the audit log of an order. details is stored as
+// JSON.
+func audit(db execer, orderID int64, action, actor string, details interface{}) error {
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit details: %s", err)
+	}
+	_, err = db.Exec("INSERT INTO audit_log (order_id, action, actor, details, created_at) VALUES (?, ?, ?, ?, ?)",
+		orderID, action, actor, string(encoded), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("unable to write audit log: %s", err)
+	}
+	return nil
+}
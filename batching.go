@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// routeDefaultOrders and routeMaxOrders bound the orders of a route
+	// suggestion, and of a batch take.
+	routeDefaultOrders = 5
+	routeMaxOrders     = 10
+	// routeDefaultRadius is how far from the courier, in meters, the orders
+	// of a route suggestion are picked up unless the request says otherwise.
+	routeDefaultRadius = 5000
+)
+
+// Actions of a RouteStop.
+const (
+	stopPickup  = "pickup"
+	stopDropoff = "dropoff"
+)
+
+// RouteStop is a stop of a RouteSuggestion.
+type RouteStop struct {
+	OrderID  int64      `json:"order_id"`
+	Action   string     `json:"action"`   // "pickup" or "dropoff".
+	Location [2]float64 `json:"location"` // [latitude, longitude].
+	// Length and expected travel time of the leg from the previous stop, or
+	// from the courier for the first.
+	Distance int64 `json:"distance"` // Meters.
+	Duration int64 `json:"duration"` // Seconds.
+}
+
+// RouteSuggestion is the body of GET /couriers/{id}/route-suggestion: a
+// batch of orders to pick up one after the other, then drop off.
+type RouteSuggestion struct {
+	Orders   []int64     `json:"orders"` // In pickup order, the body of a batch take.
+	Stops    []RouteStop `json:"stops"`
+	Distance int64       `json:"distance"` // Meters, of the whole route.
+	Duration int64       `json:"duration"` // Seconds, of the whole route.
+}
+
+// BatchTake is the body of POST /couriers/{id}/batch-take.
+type BatchTake struct {
+	Orders []int64 `json:"orders"`
+}
+
+// nearest returns the index of the point closest to lat, lng as the crow
+// flies, -1 if there is none.
+func nearest(lat, lng float64, points [][2]float64) int {
+	best, bestMeters := -1, math.Inf(1)
+	for i, point := range points {
+		if meters := haversine(lat, lng, point[0], point[1]); meters < bestMeters {
+			best, bestMeters = i, meters
+		}
+	}
+	return best
+}
+
+// RouteSuggestion returns a batch of up to maxOrders unassigned orders of
+// tenant for courier, picked up within radius meters of lat, lng. Orders are
+// chosen greedily, the next pickup being the nearest to the previous one as
+// the crow flies, while they fit in the courier's vehicle together; they
+// are dropped off in nearest neighbor order too. The legs between stops are
+// routed by the tenant's distance provider, in the vehicle's travel mode.
+func (s *OrderService) RouteSuggestion(tenant, courier string, lat, lng float64, maxOrders int,
+	radius float64) (*RouteSuggestion, error) {
+	candidates, vehicle, err := s.courierCandidates(tenant, courier)
+	if err != nil {
+		return nil, err
+	}
+	var nearby []courierCandidate
+	for _, c := range candidates {
+		if c.lat.Valid && c.dstLat.Valid && haversine(lat, lng, c.lat.Float64, c.lng.Float64) <= radius {
+			nearby = append(nearby, c)
+		}
+	}
+
+	// Pickups.
+	var (
+		batch          []courierCandidate
+		stops          []RouteStop
+		weight, volume int64
+	)
+	at := [2]float64{lat, lng}
+	for len(batch) < maxOrders {
+		var fits []courierCandidate
+		var points [][2]float64
+		for _, c := range nearby {
+			load := &Order{Weight: weight + c.weight, Volume: volume + c.volume}
+			if vehicle == nil || vehicle.carries(load) {
+				fits = append(fits, c)
+				points = append(points, [2]float64{c.lat.Float64, c.lng.Float64})
+			}
+		}
+		i := nearest(at[0], at[1], points)
+		if i < 0 {
+			break
+		}
+		next := fits[i]
+		batch = append(batch, next)
+		weight, volume = weight+next.weight, volume+next.volume
+		at = points[i]
+		stops = append(stops, RouteStop{OrderID: next.id, Action: stopPickup, Location: at})
+		for j := range nearby {
+			if nearby[j].id == next.id {
+				nearby = append(nearby[:j], nearby[j+1:]...)
+				break
+			}
+		}
+	}
+	// Dropoffs.
+	left := append([]courierCandidate(nil), batch...)
+	for len(left) > 0 {
+		points := make([][2]float64, len(left))
+		for j, c := range left {
+			points[j] = [2]float64{c.dstLat.Float64, c.dstLng.Float64}
+		}
+		i := nearest(at[0], at[1], points)
+		at = points[i]
+		stops = append(stops, RouteStop{OrderID: left[i].id, Action: stopDropoff, Location: at})
+		left = append(left[:i], left[i+1:]...)
+	}
+
+	suggestion := &RouteSuggestion{Orders: []int64{}, Stops: []RouteStop{}}
+	for _, c := range batch {
+		suggestion.Orders = append(suggestion.Orders, c.id)
+	}
+	if len(stops) == 0 {
+		return suggestion, nil
+	}
+	provider, err := s.distanceProvider(tenant)
+	if err != nil {
+		return nil, err
+	}
+	mode := ""
+	if vehicle != nil {
+		mode = vehicle.Mode
+	}
+	point := func(p [2]float64) []string {
+		return []string{strconv.FormatFloat(p[0], 'f', -1, 64), strconv.FormatFloat(p[1], 'f', -1, 64)}
+	}
+	from := [2]float64{lat, lng}
+	for i := range stops {
+		route, err := routeMode(provider, point(from), point(stops[i].Location), mode)
+		if err != nil {
+			return nil, err
+		}
+		stops[i].Distance, stops[i].Duration = route.Distance, route.Duration
+		suggestion.Distance += route.Distance
+		suggestion.Duration += route.Duration
+		from = stops[i].Location
+	}
+	suggestion.Stops = stops
+	return suggestion, nil
+}
+
+// handleRouteSuggestion serves GET
+// /couriers/{id}/route-suggestion?origin=LAT,LNG&max_orders=N&radius=M, the
+// route of a courier at origin.
+func (s *OrderService) handleRouteSuggestion(w http.ResponseWriter, req *http.Request, courier string) {
+	query := req.URL.Query()
+	lat, lng, err := parseLatLng(strings.Split(query.Get("origin"), ","))
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+			Detail: "origin must be LATITUDE,LONGITUDE: " + err.Error()}, "")
+		return
+	}
+	maxOrders, radius := routeDefaultOrders, float64(routeDefaultRadius)
+	if v := query.Get("max_orders"); v != "" {
+		if maxOrders, err = strconv.Atoi(v); err != nil || maxOrders < 1 || maxOrders > routeMaxOrders {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: fmt.Sprintf("max_orders must be 1 to %d", routeMaxOrders)}, "max_orders %q", v)
+			return
+		}
+	}
+	if v := query.Get("radius"); v != "" {
+		if radius, err = strconv.ParseFloat(v, 64); err != nil || !(radius > 0) {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: "radius must be a positive number of meters"}, "radius %q", v)
+			return
+		}
+	}
+	suggestion, err := s.RouteSuggestion(tenantFromRequest(req), courier, lat, lng, maxOrders, radius)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "RouteSuggestion(): %s", err)
+		return
+	}
+	respond(w, req, 200, suggestion, "courier %q route of %d orders", courier, len(suggestion.Orders))
+}
+
+// handleBatchTake serves POST /couriers/{id}/batch-take, {"orders": [1, 2]}:
+// the courier takes every order, e.g. of a route suggestion, or none. The
+// orders must fit in the courier's vehicle together.
+func (s *OrderService) handleBatchTake(w http.ResponseWriter, req *http.Request, courier string) {
+	var buf bytes.Buffer
+	io.Copy(&buf, req.Body)
+	var batch BatchTake
+	body, err := rewriteIDs(buf.Bytes(), false)
+	if err == nil {
+		err = json.Unmarshal(body, &batch)
+	}
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+		return
+	}
+	if len(batch.Orders) == 0 || len(batch.Orders) > routeMaxOrders {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+			Detail: fmt.Sprintf("orders must list 1 to %d orders", routeMaxOrders)}, "%d orders", len(batch.Orders))
+		return
+	}
+	seen := map[int64]bool{}
+	for _, orderID := range batch.Orders {
+		if seen[orderID] {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: fmt.Sprintf("order %d given twice", orderID)}, "")
+			return
+		}
+		seen[orderID] = true
+	}
+
+	var (
+		taken          []*orderTaken
+		weight, volume int64
+	)
+	_, vehicle, err := courierVehicle(s.DB, tenantFromRequest(req), courier)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_ERROR"}, "courierVehicle(): %s", err)
+		return
+	}
+	for _, orderID := range batch.Orders {
+		switch _, err := s.tenantOrderID(s.orderScope(req), "id", orderID); err {
+		case errNoSuchOrder:
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER", Detail: fmt.Sprintf("order %d", orderID)},
+				"no such order %d", orderID)
+			return
+		case nil:
+		default:
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_ERROR"}, "%s", err)
+			return
+		}
+		if !s.authorize(w, req, policyTake, orderID) {
+			return
+		}
+		t, err := s.courierTake(courier, orderID)
+		switch err {
+		case errCourierBlocked:
+			respond(w, req, 403, HTTPResponseError{Error: "COURIER_BLOCKED", Detail: fmt.Sprintf("order %d", orderID)},
+				"courier %q blocked from order %d", courier, orderID)
+			return
+		case errVehicleTooSmall:
+			respond(w, req, 403, HTTPResponseError{Error: "VEHICLE_TOO_SMALL",
+				Detail: fmt.Sprintf("order %d", orderID)}, "order %d too large for courier %q", orderID, courier)
+			return
+		case nil:
+		default:
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_ERROR"}, "courierTake() %d failed: %s", orderID,
+				err)
+			return
+		}
+		taken = append(taken, t)
+		if vehicle == nil {
+			continue
+		}
+		if order, err := s.Get(orderID); err == nil {
+			weight, volume = weight+order.Weight, volume+order.Volume
+		}
+	}
+	if vehicle != nil && !vehicle.carries(&Order{Weight: weight, Volume: volume}) {
+		respond(w, req, 403, HTTPResponseError{Error: "VEHICLE_TOO_SMALL", Detail: "the orders do not fit together"},
+			"orders %v too large for courier %q", batch.Orders, courier)
+		return
+	}
+
+	failed, err := s.TakeBatch(batch.Orders, taken)
+	detail := fmt.Sprintf("order %d", failed)
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER", Detail: detail}, "no such order %d", failed)
+	case errTaken:
+		respond(w, req, 409, HTTPResponseError{Error: "ORDER_ALREADY_BEEN_TAKEN", Detail: detail},
+			"order %d already taken", failed)
+	case errPaymentRequired:
+		respond(w, req, 402, HTTPResponseError{Error: "PAYMENT_REQUIRED", Detail: detail}, "order %d not paid", failed)
+	case errLinkedOrderPending:
+		respond(w, req, 409, HTTPResponseError{Error: "LINKED_ORDER_PENDING", Detail: detail},
+			"order %d waits for its outbound order", failed)
+	case nil:
+		respond(w, req, 200, HTTPResponseStatus{"SUCCESS"}, "courier %q took orders %v", courier, batch.Orders)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_ERROR"}, "TakeBatch() %v failed: %s", batch.Orders,
+			err)
+	}
+}
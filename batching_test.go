@@ -0,0 +1,103 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRouteSuggestion(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/couriers/bob", `{"vehicle": "car"}`); w.Code != 200 {
+		t.Fatalf("PUT courier returned %d", w.Code)
+	}
+	journey := func(from, to [2]string) string {
+		return fmt.Sprintf(`{"origin": ["%s", "%s"], "destination": ["%s", "%s"]}`, from[0], from[1], to[0], to[1])
+	}
+	for i, body := range []string{
+		createOrderDetails,
+		journey([2]string{"37.8095", "-122.2745"}, [2]string{"37.807", "-122.29"}),
+		journey([2]string{"37.9", "-122.5"}, [2]string{"37.91", "-122.51"}), // Too far.
+		journey([2]string{"37.81", "-122.276"}, [2]string{"37.807", "-122.29"}),
+	} {
+		if w := serve(svc, "POST", "/orders", "acme", body); w.Code != 200 {
+			t.Fatalf("POST order %d returned %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	// Orders 2 and 4 don't fit in a car together.
+	for path, patch := range map[string]string{"/orders/2": `{"weight": 20000}`, "/orders/4": `{"weight": 90000}`} {
+		if w := servePatchTenant(svc, path, "acme", patch); w.Code != 200 {
+			t.Fatalf("PATCH %s returned %d", path, w.Code)
+		}
+	}
+
+	suggest := func(query string) (RouteSuggestion, int) {
+		t.Helper()
+		w := serve(svc, "GET", "/couriers/bob/route-suggestion"+query, "acme", "")
+		var suggestion RouteSuggestion
+		if w.Code == 200 {
+			if err := json.NewDecoder(w.Body).Decode(&suggestion); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return suggestion, w.Code
+	}
+	suggestion, code := suggest("?origin=37.8093475,-122.2740787")
+	var stops []string
+	for _, stop := range suggestion.Stops {
+		stops = append(stops, fmt.Sprintf("%s %d", stop.Action, stop.OrderID))
+	}
+	if code != 200 || fmt.Sprint(suggestion.Orders) != "[1 2]" ||
+		strings.Join(stops, ", ") != "pickup 1, pickup 2, dropoff 2, dropoff 1" {
+		t.Fatalf("unexpected suggestion %d %+v", code, suggestion)
+	}
+	var total int64
+	for _, stop := range suggestion.Stops {
+		total += stop.Distance
+	}
+	if suggestion.Stops[0].Distance != 0 || total != suggestion.Distance || suggestion.Duration == 0 {
+		t.Errorf("unexpected legs %+v", suggestion)
+	}
+	if suggestion, _ := suggest("?origin=37.8093475,-122.2740787&max_orders=1"); fmt.Sprint(suggestion.Orders) != "[1]" {
+		t.Errorf("suggestion of 1 order is %+v", suggestion)
+	}
+	if suggestion, _ := suggest("?origin=37.9,-122.5&radius=100"); fmt.Sprint(suggestion.Orders) != "[3]" {
+		t.Errorf("suggestion far away is %+v", suggestion)
+	}
+	for _, query := range []string{"", "?origin=north", "?origin=37.8,-122.2&max_orders=11", "?origin=37.8,-122.2&radius=-1"} {
+		if _, code := suggest(query); code != 400 {
+			t.Errorf("suggestion%s returned %d", query, code)
+		}
+	}
+
+	take := func(body string) (int, string) {
+		w := serve(svc, "POST", "/couriers/bob/batch-take", "acme", body)
+		return w.Code, w.Body.String()
+	}
+	for body, want := range map[string]int{
+		`{"orders": []}`:     400,
+		`{"orders": [1, 1]}`: 400,
+		`{"orders": [2, 4]}`: 403,
+		`{"orders": [1, 9]}`: 404,
+	} {
+		if code, resp := take(body); code != want {
+			t.Errorf("batch take %s returned %d %s, want %d", body, code, resp, want)
+		}
+	}
+	if code, resp := take(`{"orders": [1, 2]}`); code != 200 {
+		t.Fatalf("batch take returned %d %s", code, resp)
+	}
+	// All or none.
+	if code, resp := take(`{"orders": [3, 1]}`); code != 409 || !strings.Contains(resp, "order 1") {
+		t.Errorf("batch take of a taken order returned %d %s", code, resp)
+	}
+	for id, want := range map[int64]OrderState{1: StateTaken, 2: StateTaken, 3: StateUnassigned} {
+		if order, err := svc.Get(id); err != nil || order.State != want {
+			t.Errorf("order %d is %+v, %v", id, order, err)
+		}
+	}
+}
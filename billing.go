@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Kinds of billable events.
+const (
+	billOrderCreated     = "order_created"     // Amount is the order's price.
+	billDistanceComputed = "distance_computed" // A call to the distance provider.
+	billAdjustment       = "adjustment"        // Amount is added to the order's price, see Adjust.
+)
+
+// bill records a billable event of tenant. orderID may be 0 and currency ""
+// for events without an amount.
+func bill(db execer, tenant, kind string, orderID, amount int64, currency string, at time.Time) error {
+	var order interface{}
+	if orderID != 0 {
+		order = orderID
+	}
+	_, err := db.Exec(`INSERT INTO billing_events (tenant_id, kind, order_id, amount, currency, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, tenant, kind, order, amount, currency, at.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to record %s of tenant %q: %s", kind, tenant, err)
+	}
+	return nil
+}
+
+// BillingLine is the total of one kind of billable event of a tenant in a
+// month.
+type BillingLine struct {
+	TenantID string `json:"tenant_id"`
+	Kind     string `json:"kind"`
+	Quantity int64  `json:"quantity"`
+	Amount   int64  `json:"amount"` // In minor units of Currency.
+	Currency string `json:"currency,omitempty"`
+}
+
+// BillingExport is the JSON body of GET /admin/billing/export.
+type BillingExport struct {
+	Month string        `json:"month"` // YYYY-MM.
+	Lines []BillingLine `json:"lines"`
+}
+
+// billingColumns are the CSV columns of GET /admin/billing/export.
+var billingColumns = []string{"month", "tenant_id", "kind", "quantity", "amount", "currency"}
+
+// BillingExport totals the billable events of every tenant in the UTC month
+// starting at start, ordered by tenant, kind and currency.
+func (s *OrderService) BillingExport(start time.Time) (*BillingExport, error) {
+	export := &BillingExport{Month: start.Format("2006-01"), Lines: []BillingLine{}}
+	rows, err := s.DB.Query(`SELECT tenant_id, kind, COUNT(*), SUM(amount), currency FROM billing_events
+		WHERE created_at >= ? AND created_at < ? GROUP BY tenant_id, kind, currency
+		ORDER BY tenant_id, kind, currency`, start.Unix(), start.AddDate(0, 1, 0).Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to query billing events: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var line BillingLine
+		if err := rows.Scan(&line.TenantID, &line.Kind, &line.Quantity, &line.Amount, &line.Currency); err != nil {
+			return nil, fmt.Errorf("unable to scan billing events: %s", err)
+		}
+		export.Lines = append(export.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query billing events: %s", err)
+	}
+	return export, nil
+}
+
+// shardedBillingExport is the BillingExport of every shard, lines of the
+// same tenant, kind and currency added up, e.g. of a tenant that moved.
+func (s *OrderService) shardedBillingExport(start time.Time) (*BillingExport, error) {
+	merged := &BillingExport{Month: start.Format("2006-01"), Lines: []BillingLine{}}
+	lines := map[BillingLine]int{} // Index in merged.Lines by tenant, kind and currency.
+	for _, shard := range s.allShards() {
+		export, err := shard.BillingExport(start)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range export.Lines {
+			key := BillingLine{TenantID: line.TenantID, Kind: line.Kind, Currency: line.Currency}
+			if i, ok := lines[key]; ok {
+				merged.Lines[i].Quantity += line.Quantity
+				merged.Lines[i].Amount += line.Amount
+				continue
+			}
+			lines[key] = len(merged.Lines)
+			merged.Lines = append(merged.Lines, line)
+		}
+	}
+	sort.Slice(merged.Lines, func(i, j int) bool {
+		a, b := merged.Lines[i], merged.Lines[j]
+		if a.TenantID != b.TenantID {
+			return a.TenantID < b.TenantID
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Currency < b.Currency
+	})
+	return merged, nil
+}
+
+// handleBillingExport serves GET /admin/billing/export?month=YYYY-MM, the
+// previous month by default. The export is CSV with format=csv or Accept:
+// text/csv, JSON otherwise.
+func (s *OrderService) handleBillingExport(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	var start time.Time
+	if month := req.URL.Query().Get("month"); month != "" {
+		var err error
+		if start, err = time.Parse("2006-01", month); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: "month must be YYYY-MM"},
+				"invalid month %q", month)
+			return
+		}
+	} else {
+		now := time.Now().UTC()
+		start = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	export, err := s.shardedBillingExport(start)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "BillingExport(): %s", err)
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" && accepts(req, "text/csv") {
+		format = "csv"
+	}
+	switch format {
+	case "", "json":
+		respond(w, req, 200, export, "billing export of %s, %d lines", export.Month, len(export.Lines))
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="billing-%s.csv"`, export.Month))
+		fmt.Printf("Method:%s; Path:%s, %d billing export of %s, %d lines\n", req.Method, req.URL.Path, 200,
+			export.Month, len(export.Lines))
+		out := csv.NewWriter(w)
+		out.Write(billingColumns)
+		for _, line := range export.Lines {
+			out.Write([]string{export.Month, line.TenantID, line.Kind, strconv.FormatInt(line.Quantity, 10),
+				strconv.FormatInt(line.Amount, 10), line.Currency})
+		}
+		out.Flush()
+	default:
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: "format must be csv or json"},
+			"invalid format %q", format)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBillingExport(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Tariff: Tariff{BaseFare: 250, Currency: "EUR"}})
+	for i := 0; i < 2; i++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+		}
+	}
+	if w := serve(svc, "POST", "/orders/quote", "beta", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders/quote returned %d: %s", w.Code, w.Body)
+	}
+	month := time.Now().UTC().Format("2006-01")
+
+	w := serveAdmin(svc, "GET", "/admin/billing/export?month="+month, "")
+	var export BillingExport
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+		t.Fatalf("export returned %d: %s", w.Code, err)
+	}
+	want := []BillingLine{
+		{TenantID: "acme", Kind: billDistanceComputed, Quantity: 2},
+		{TenantID: "acme", Kind: billOrderCreated, Quantity: 2, Amount: 500, Currency: "EUR"},
+		{TenantID: "beta", Kind: billDistanceComputed, Quantity: 1},
+	}
+	if export.Month != month || !reflect.DeepEqual(export.Lines, want) {
+		t.Errorf("got export %+v", export)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/billing/export?format=csv&month="+month, "")
+	wantCSV := "month,tenant_id,kind,quantity,amount,currency\n" +
+		month + ",acme,distance_computed,2,0,\n" +
+		month + ",acme,order_created,2,500,EUR\n" +
+		month + ",beta,distance_computed,1,0,\n"
+	if w.Code != 200 || w.Header().Get("Content-Type") != "text/csv" || w.Body.String() != wantCSV {
+		t.Errorf("CSV export returned %d %q:\n%s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	if w := serveAdmin(svc, "GET", "/admin/billing/export?month=2001-01", ""); !strings.Contains(w.Body.String(), `"lines":[]`) {
+		t.Errorf("export of an empty month returned %d %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/billing/export?month=June", ""); w.Code != 400 {
+		t.Errorf("export with invalid month returned %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/admin/billing/export", "acme", ""); w.Code != 401 {
+		t.Errorf("export without admin token returned %d", w.Code)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time by the Makefile, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD)"
+//
+// Without them the commit and build time come from the version control
+// information go build records, if any.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = "" // RFC 3339.
+)
+
+// BuildInfo identifies the build of the running binary, the body of GET
+// /version.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes.
+}
+
+// currentBuild returns the build of the running binary.
+func currentBuild() BuildInfo {
+	build := BuildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if build.Commit == "" {
+					build.Commit = setting.Value
+				}
+			case "vcs.time":
+				if build.BuildTime == "" {
+					build.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				build.Modified = setting.Value == "true"
+			}
+		}
+	}
+	return build
+}
+
+// String returns the build for the startup banner.
+func (b BuildInfo) String() string {
+	s := "orderservice " + b.Version
+	if b.Commit != "" {
+		s += " (commit " + b.Commit
+		if b.Modified {
+			s += ", modified"
+		}
+		s += ")"
+	}
+	if b.BuildTime != "" {
+		s += " built " + b.BuildTime
+	}
+	return s + " with " + b.GoVersion
+}
+
+// handleVersion serves GET /version, without credentials like GET /readyz.
+func (s *OrderService) handleVersion(w http.ResponseWriter, req *http.Request) {
+	build := currentBuild()
+	respond(w, req, 200, build, "%s", build)
+}
@@ -0,0 +1,35 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", RequireAPIKeys: true})
+	w := serve(svc, "GET", "/version", "", "")
+	var build BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &build); err != nil || w.Code != 200 {
+		t.Fatalf("GET /version returned %d: %s", w.Code, w.Body)
+	}
+	if build.Version != "dev" || !strings.HasPrefix(build.GoVersion, "go") {
+		t.Errorf("build %+v", build)
+	}
+
+	var ready Readiness
+	if err := json.Unmarshal(serve(svc, "GET", "/readyz", "", "").Body.Bytes(), &ready); err != nil ||
+		ready.Version != "dev" {
+		t.Errorf("readiness %+v, %v", ready, err)
+	}
+
+	build = BuildInfo{Version: "v1.2.0", Commit: "0123abc", BuildTime: "2026-10-18T09:00:00Z", GoVersion: "go1.27.1",
+		Modified: true}
+	expect := "orderservice v1.2.0 (commit 0123abc, modified) built 2026-10-18T09:00:00Z with go1.27.1"
+	if build.String() != expect {
+		t.Errorf("banner %q, expected %q", build, expect)
+	}
+}
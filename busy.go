@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// busyRetries is how many times a statement failing with SQLITE_BUSY or
+	// SQLITE_LOCKED is retried before the error is returned.
+	busyRetries = 5
+	// busyBackoff is the wait before the first retry, doubled for every
+	// further retry. Half of each wait is random, so writers contending for
+	// the database don't retry in lockstep.
+	busyBackoff = 10 * time.Millisecond
+	// txRetries is how many times withTx runs a transaction again after it
+	// failed on a busy database.
+	txRetries = 3
+)
+
+// Retries of statements the database was too busy for, and statements still
+// failing after busyRetries retries. Likewise for transactions of withTx.
+var (
+	sqlBusyRetries    = expvar.NewInt("sqlite_busy_retries")
+	sqlBusyFailures   = expvar.NewInt("sqlite_busy_failures")
+	sqlTxRetries      = expvar.NewInt("sqlite_tx_retries")
+	sqlTxBusyFailures = expvar.NewInt("sqlite_tx_busy_failures")
+)
+
+// isBusy returns whether err is sqlite3's SQLITE_BUSY or SQLITE_LOCKED, which
+// another connection writing at the same time causes.
+func isBusy(err error) bool {
+	var code sqlite3.ErrNo
+	switch e := err.(type) {
+	case sqlite3.Error:
+		code = e.Code
+	case *sqlite3.Error:
+		code = e.Code
+	default:
+		return false
+	}
+	return code == sqlite3.ErrBusy || code == sqlite3.ErrLocked
+}
+
+// singleStatement returns whether query is one statement. Retrying a failed
+// script could run its first statements twice.
+func singleStatement(query string) bool {
+	return !strings.Contains(strings.TrimRight(strings.TrimSpace(query), "; \t\n"), ";")
+}
+
+// retryBusy calls fn until it doesn't fail with a busy error, at most
+// busyRetries more times, waiting with backoff in between. It gives up early
+// when ctx is done.
+func retryBusy(ctx context.Context, fn func() error) error {
+	for retry := 0; ; retry++ {
+		err := fn()
+		if !isBusy(err) {
+			return err
+		}
+		if retry == busyRetries || !backoff(ctx, retry) {
+			sqlBusyFailures.Add(1)
+			return err
+		}
+		sqlBusyRetries.Add(1)
+	}
+}
+
+// backoff waits before retry number retry+1, busyBackoff doubled for every
+// retry before. Returns false if ctx was done first.
+func backoff(ctx context.Context, retry int) bool {
+	wait := busyBackoff << uint(retry)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))):
+		return true
+	}
+}
+
+// txAttempt records whether a statement of a transaction begun by withTx
+// failed on a busy database. fn usually returns such errors wrapped into its
+// own, so withTx can't tell from the error alone. loggedConn finds the
+// attempt in the context of BeginTx.
+type txAttempt struct {
+	busy bool
+}
+
+type txAttemptKey struct{}
+
+// withTx runs fn in a transaction of db and commits it. When fn or the commit
+// fails because another connection holds the database, the transaction is
+// rolled back and run again, at most txRetries more times, as sqlite doesn't
+// wait for locks within a transaction. fn may thus run more than once and
+// must not have effects outside of tx. Other errors of fn are returned as is.
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	for retry := 0; ; retry++ {
+		attempt := &txAttempt{}
+		err := runTx(context.WithValue(ctx, txAttemptKey{}, attempt), db, fn)
+		if err == nil || !(attempt.busy || isBusy(err)) {
+			return err
+		}
+		if retry == txRetries || !backoff(ctx, retry) {
+			sqlTxBusyFailures.Add(1)
+			return err
+		}
+		sqlTxRetries.Add(1)
+	}
+}
+
+// runTx runs fn in a transaction of db once, see withTx.
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed at BeginTx: %s", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
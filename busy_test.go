@@ -0,0 +1,140 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openBusyDB returns a database of a table counters, without sqlite3's own
+// busy timeout so that every busy statement fails at once, and lock, which
+// locks the database from another connection until the returned func is
+// called.
+func openBusyDB(t *testing.T) (db *sql.DB, lock func() func()) {
+	path := filepath.Join(t.TempDir(), "orders.db")
+	holder := openDB(path, 0)
+	t.Cleanup(func() { holder.Close() })
+	if _, err := holder.Exec("CREATE TABLE counters (n INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	db = openDB(path+"?_busy_timeout=0", 0)
+	t.Cleanup(func() { db.Close() })
+	return db, func() func() {
+		t.Helper()
+		conn, err := holder.Conn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE"); err != nil {
+			t.Fatal(err)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "COMMIT")
+			conn.Close()
+		}
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	db, lock := openBusyDB(t)
+
+	// A statement waits for a lock held briefly.
+	unlock := lock()
+	time.AfterFunc(50*time.Millisecond, unlock)
+	retries, failures := sqlBusyRetries.Value(), sqlBusyFailures.Value()
+	if _, err := db.Exec("INSERT INTO counters (n) VALUES (1)"); err != nil {
+		t.Fatalf("insert during a short lock: %s", err)
+	}
+	if sqlBusyRetries.Value() == retries || sqlBusyFailures.Value() != failures {
+		t.Errorf("%d retries and %d failures counted", sqlBusyRetries.Value()-retries,
+			sqlBusyFailures.Value()-failures)
+	}
+
+	// A lock held too long fails the statement after busyRetries retries.
+	unlock = lock()
+	retries = sqlBusyRetries.Value()
+	_, err := db.Exec("INSERT INTO counters (n) VALUES (2)")
+	unlock()
+	if !isBusy(err) {
+		t.Fatalf("insert during a long lock: %v", err)
+	}
+	if sqlBusyRetries.Value()-retries != busyRetries || sqlBusyFailures.Value() != failures+1 {
+		t.Errorf("%d retries and %d failures counted", sqlBusyRetries.Value()-retries,
+			sqlBusyFailures.Value()-failures)
+	}
+
+	// Within a transaction a busy statement fails at once.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock = lock()
+	retries = sqlBusyRetries.Value()
+	_, err = tx.Exec("INSERT INTO counters (n) VALUES (3)")
+	unlock()
+	tx.Rollback()
+	if !isBusy(err) || sqlBusyRetries.Value() != retries {
+		t.Errorf("insert in a transaction: %v after %d retries", err, sqlBusyRetries.Value()-retries)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM counters").Scan(&n); err != nil || n != 1 {
+		t.Errorf("%d rows, %v", n, err)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	db, lock := openBusyDB(t)
+	if _, err := db.Exec("INSERT INTO counters (n) VALUES (0)"); err != nil {
+		t.Fatal(err)
+	}
+	increment := func(runs *int) func(tx *sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			*runs++
+			if _, err := tx.Exec("UPDATE counters SET n = n + 1"); err != nil {
+				return fmt.Errorf("unable to increment: %s", err)
+			}
+			return nil
+		}
+	}
+
+	// A transaction failing on a lock held briefly runs again, once it
+	// succeeds its changes are committed once.
+	unlock := lock()
+	time.AfterFunc(20*time.Millisecond, unlock)
+	retries, runs := sqlTxRetries.Value(), 0
+	if err := withTx(context.Background(), db, increment(&runs)); err != nil {
+		t.Fatalf("withTx during a short lock: %s", err)
+	}
+	if runs < 2 || sqlTxRetries.Value()-retries != int64(runs-1) {
+		t.Errorf("%d runs, %d retries counted", runs, sqlTxRetries.Value()-retries)
+	}
+	var n int
+	if err := db.QueryRow("SELECT n FROM counters").Scan(&n); err != nil || n != 1 {
+		t.Errorf("counter is %d, %v", n, err)
+	}
+
+	// A lock held too long fails it after txRetries retries.
+	unlock = lock()
+	failures, runs := sqlTxBusyFailures.Value(), 0
+	err := withTx(context.Background(), db, increment(&runs))
+	unlock()
+	if err == nil || runs != txRetries+1 || sqlTxBusyFailures.Value() != failures+1 {
+		t.Errorf("withTx during a long lock: %v after %d runs", err, runs)
+	}
+
+	// Other errors are returned at once.
+	runs = 0
+	err = withTx(context.Background(), db, func(tx *sql.Tx) error {
+		runs++
+		return errTaken
+	})
+	if err != errTaken || runs != 1 {
+		t.Errorf("withTx returned %v after %d runs", err, runs)
+	}
+}
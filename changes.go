@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultChangesLimit and maxChangesLimit bound the changes of a response.
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+	// maxChangesWait is the longest a GET /changes waits for new changes.
+	maxChangesWait = 30 * time.Second
+	// changesPollInterval is how often a waiting GET /changes looks for new
+	// changes. Events may be written by any replica, so it polls.
+	changesPollInterval = 500 * time.Millisecond
+)
+
+// Change is an event of an order as served by GET /changes.
+type Change struct {
+	Seq     int64           `json:"seq"` // The id of the event, increasing.
+	OrderID int64           `json:"order_id"`
+	Type    EventType       `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// ChangeFeed is the body of GET /changes.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	Next    int64    `json:"next"` // after of the next request.
+}
+
+// Changes returns up to limit events of the orders of tenant after the event
+// with id after, oldest first.
+func (s *OrderService) Changes(ctx context.Context, tenant string, after int64, limit int) (_ *ChangeFeed,
+	err error) {
+	defer observeStore("Changes", time.Now(), &err)
+	rows, err := s.DB.QueryContext(ctx, `SELECT e.id, e.order_id, e.type, COALESCE(e.data, ''), e.created_at
+		FROM events e
+		LEFT JOIN orders o ON o.id = e.order_id
+		LEFT JOIN orders_archive a ON a.id = e.order_id
+		WHERE e.id > ? AND COALESCE(o.tenant_id, a.tenant_id, '') = ? ORDER BY e.id LIMIT ?`, after, tenant, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query changes of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	feed := &ChangeFeed{Changes: []Change{}, Next: after}
+	for rows.Next() {
+		var (
+			change    Change
+			data      string
+			createdAt int64
+		)
+		if err := rows.Scan(&change.Seq, &change.OrderID, &change.Type, &data, &createdAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		opened, err := openField(s.config.FieldKey, []byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid event %d: %s", change.Seq, err)
+		}
+		if len(opened) > 0 {
+			change.Data = opened
+		}
+		change.Time = time.Unix(createdAt, 0).UTC()
+		feed.Changes = append(feed.Changes, change)
+		feed.Next = change.Seq
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query changes of tenant %q: %s", tenant, err)
+	}
+	return feed, nil
+}
+
+// handleChanges serves GET /changes?after=SEQ&limit=N&wait=SECONDS, the
+// events of the tenant's orders after seq, by default from the first. With
+// wait it holds the request until there are any, for at most that long, so
+// consumers can tail the feed.
+func (s *OrderService) handleChanges(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	after, limit, waitSeconds := int64(0), int64(defaultChangesLimit), int64(0)
+	for name, param := range map[string]struct {
+		dest     *int64
+		min, max int64
+	}{
+		"after": {&after, 0, math.MaxInt64},
+		"limit": {&limit, 1, maxChangesLimit},
+		"wait":  {&waitSeconds, 0, int64(maxChangesWait / time.Second)},
+	} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < param.min || parsed > param.max {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: fmt.Sprintf("%s must be an integer from %d to %d", name, param.min, param.max)}, "%s=%q",
+				name, value)
+			return
+		}
+		*param.dest = parsed
+	}
+
+	tenant := tenantFromRequest(req)
+	ctx := req.Context()
+	deadline := time.Now().Add(time.Duration(waitSeconds) * time.Second)
+	for {
+		feed, err := s.Changes(ctx, tenant, after, int(limit))
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Printf("GET /changes: client gone: %s\n", ctx.Err())
+				return
+			}
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Changes(): %s", err)
+			return
+		}
+		if len(feed.Changes) > 0 || !time.Now().Add(changesPollInterval).Before(deadline) {
+			respond(w, req, 200, feed, "tenant %q %d changes after %d", tenant, len(feed.Changes), after)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Printf("GET /changes: client gone: %s\n", ctx.Err())
+			return
+		case <-time.After(changesPollInterval):
+		}
+	}
+}
@@ -0,0 +1,72 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for _, tenant := range []string{"acme", "globex", "acme"} {
+		if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if err := svc.Take(1); err != nil {
+		t.Fatal(err)
+	}
+	changes := func(query string) ChangeFeed {
+		t.Helper()
+		w := serve(svc, "GET", "/changes"+query, "acme", "")
+		if w.Code != 200 {
+			t.Fatalf("GET /changes%s returned %d: %s", query, w.Code, w.Body)
+		}
+		var feed ChangeFeed
+		if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		return feed
+	}
+
+	feed := changes("?limit=2")
+	if len(feed.Changes) != 2 || feed.Changes[0].OrderID != 1 || feed.Changes[0].Type != EventCreated ||
+		feed.Changes[1].OrderID != 3 || feed.Next != feed.Changes[1].Seq {
+		t.Fatalf("first page %+v", feed)
+	}
+	var created orderCreated
+	if err := json.Unmarshal(feed.Changes[0].Data, &created); err != nil || created.TenantID != "acme" {
+		t.Errorf("data of the created event %s: %v", feed.Changes[0].Data, err)
+	}
+	feed = changes("?after=" + strconv.FormatInt(feed.Next, 10))
+	if len(feed.Changes) != 1 || feed.Changes[0].OrderID != 1 || feed.Changes[0].Type != EventTaken {
+		t.Fatalf("second page %+v", feed)
+	}
+	next := strconv.FormatInt(feed.Next, 10)
+	if feed = changes("?after=" + next); len(feed.Changes) != 0 || strconv.FormatInt(feed.Next, 10) != next {
+		t.Errorf("no changes %+v", feed)
+	}
+
+	// A waiting request returns once there is a change.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	}()
+	start := time.Now()
+	if feed = changes("?wait=5&after=" + next); len(feed.Changes) != 1 || feed.Changes[0].OrderID != 4 {
+		t.Errorf("waited for %+v", feed)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("waited %s", elapsed)
+	}
+
+	for _, query := range []string{"?after=-1", "?limit=0", "?limit=1001", "?wait=31", "?after=x"} {
+		if w := serve(svc, "GET", "/changes"+query, "acme", ""); w.Code != 400 {
+			t.Errorf("GET /changes%s returned %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// Clone creates an order of tenant on the route of an existing one, e.g. to
+// book a failed delivery again. Distance and price are looked up afresh, the
+// fields of the order are copied but for scheduled_at, then patch, a JSON
+// merge patch, is applied to them if not empty. Returns errNoSuchOrder if
+// tenant has no such order, archived or not.
+func (s *OrderService) Clone(tenant string, orderID int64, patch []byte) (*Order, error) {
+	var (
+		source                                               string
+		originLat, originLng, destinationLat, destinationLng sql.NullFloat64
+	)
+	err := s.DB.QueryRow(`SELECT tenant_id, origin_lat, origin_lng, destination_lat, destination_lng
+		FROM orders WHERE id = ? UNION ALL SELECT tenant_id, origin_lat, origin_lng, destination_lat, destination_lng
+		FROM orders_archive WHERE id = ?`, orderID, orderID).Scan(&source, &originLat, &originLng, &destinationLat,
+		&destinationLng)
+	if err == sql.ErrNoRows || err == nil && source != tenant {
+		return nil, errNoSuchOrder
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query order %d: %s", orderID, err)
+	}
+	if !originLat.Valid || !destinationLat.Valid {
+		return nil, fmt.Errorf("order %d has no stored route", orderID)
+	}
+	order, err := s.Get(orderID)
+	if err != nil {
+		return nil, err
+	}
+	fields := order.fields()
+	fields.ScheduledAt = nil
+	if len(bytes.TrimSpace(patch)) > 0 {
+		loc, err := tenantLocation(s.DB, tenant)
+		if err != nil {
+			return nil, err
+		}
+		if fields, err = mergePatch(fields, patch, loc); err != nil {
+			return nil, err
+		}
+	}
+
+	formatPoint := func(lat, lng sql.NullFloat64) []string {
+		return []string{strconv.FormatFloat(lat.Float64, 'f', -1, 64), strconv.FormatFloat(lng.Float64, 'f', -1, 64)}
+	}
+	details := CreateOrderDetails{
+		Origin:      formatPoint(originLat, originLng),
+		Destination: formatPoint(destinationLat, destinationLng),
+	}
+	if reflect.DeepEqual(fields, OrderFields{}) {
+		return s.Insert(tenant, details)
+	}
+	return s.InsertWith(tenant, details, &fields)
+}
+
+// handleClone serves POST /orders/{id}/clone, with an optional merge patch of
+// the fields of the new order as the body.
+func (s *OrderService) handleClone(w http.ResponseWriter, req *http.Request, orderID int64) {
+	var buf bytes.Buffer
+	io.Copy(&buf, req.Body)
+	order, err := s.Clone(tenantFromRequest(req), orderID, buf.Bytes())
+	if invalid, ok := err.(errInvalidPatch); ok {
+		respond(w, req, 400, HTTPResponseError{Error: invalid.Code, Detail: invalid.Detail}, "order %d: %s",
+			orderID, invalid)
+		return
+	}
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case nil:
+		s.respondOrder(w, req, 200, order, "cloned order %d as %d", orderID, order.Id)
+	default:
+		s.respondInsertError(w, req, err)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+	patch := `{"notes": "fragile", "tags": ["glass"], "weight": 2000, "scheduled_at": "2030-01-01T09:00:00Z"}`
+	if w := servePatchTenant(svc, "/orders/1", "acme", patch); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "acme", ""); w.Code != 200 {
+		t.Fatalf("take returned %d", w.Code)
+	}
+
+	clone := func(body string) (OrderDTO, int) {
+		t.Helper()
+		w := serve(svc, "POST", "/orders/1/clone", "acme", body)
+		var order OrderDTO
+		if w.Code == 200 {
+			if err := json.NewDecoder(w.Body).Decode(&order); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return order, w.Code
+	}
+	order, code := clone("")
+	if code != 200 || order.ID != 2 || order.Status != StateUnassigned || order.Distance != 1816 ||
+		order.Notes != "fragile" || order.Weight != 2000 || order.ScheduledAt != nil {
+		t.Errorf("clone returned %d %+v", code, order)
+	}
+	order, code = clone(`{"notes": "second attempt", "tags": null}`)
+	if code != 200 || order.ID != 3 || order.Notes != "second attempt" || order.Tags != nil || order.Weight != 2000 {
+		t.Errorf("clone with a patch returned %d %+v", code, order)
+	}
+
+	for body, want := range map[string]int{`{"status": "TAKEN"}`: 400, `{"weight": -1}`: 400} {
+		if _, code := clone(body); code != want {
+			t.Errorf("clone with %s returned %d, want %d", body, code, want)
+		}
+	}
+	for tenant, path := range map[string]string{"other": "/orders/1/clone", "acme": "/orders/9/clone"} {
+		if w := serve(svc, "POST", path, tenant, ""); w.Code != 404 {
+			t.Errorf("clone of %s by %s returned %d", path, tenant, w.Code)
+		}
+	}
+}
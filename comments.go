@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxCommentLength is the longest comment body in bytes.
+const maxCommentLength = 4000
+
+// Comment is an internal note of support staff on an order. Comments are
+// only shown to dashboard users and admins, never to tenants' API keys.
+type Comment struct {
+	ID      int64     `json:"id"`
+	OrderID int64     `json:"order_id"`
+	Author  string    `json:"author"` // An audit log actor, e.g. "user:{subject}".
+	Body    string    `json:"body"`
+	Time    time.Time `json:"time"`
+}
+
+// AddComment adds a comment to an order. Returns errNoSuchOrder if the order
+// does not exist, archived orders may still be commented on.
+func (s *OrderService) AddComment(orderID int64, author, body string) (*Comment, error) {
+	if _, err := s.Get(orderID); err != nil {
+		return nil, err
+	}
+	comment := &Comment{OrderID: orderID, Author: author, Body: body, Time: time.Now().UTC().Truncate(time.Second)}
+	sealed, err := sealField(s.config.FieldKey, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt comment: %s", err)
+	}
+	result, err := s.DB.Exec("INSERT INTO order_comments (order_id, author, body, created_at) VALUES (?, ?, ?, ?)",
+		orderID, author, sealed, comment.Time.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to add comment to order %d: %s", orderID, err)
+	}
+	if comment.ID, err = result.LastInsertId(); err != nil {
+		return nil, fmt.Errorf("unable to add comment to order %d, no row: %s", orderID, err)
+	}
+	return comment, nil
+}
+
+// Comments returns the comments of an order, oldest first.
+func (s *OrderService) Comments(orderID int64) ([]Comment, error) {
+	rows, err := s.DB.Query(`SELECT id, order_id, author, body, created_at FROM order_comments WHERE order_id = ?
+		ORDER BY id`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query comments: %s", err)
+	}
+	defer rows.Close()
+	comments := []Comment{}
+	for rows.Next() {
+		var (
+			comment   Comment
+			createdAt int64
+		)
+		var body []byte
+		if err := rows.Scan(&comment.ID, &comment.OrderID, &comment.Author, &body, &createdAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if body, err = openField(s.config.FieldKey, body); err != nil {
+			return nil, fmt.Errorf("invalid comment %d: %s", comment.ID, err)
+		}
+		comment.Body = string(body)
+		comment.Time = time.Unix(createdAt, 0).UTC()
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query comments: %s", err)
+	}
+	return comments, nil
+}
+
+// requireSupport writes a 403 and returns false unless req is from an admin
+// or a dashboard user. The role the method needs was checked with the ID
+// token.
+func (s *OrderService) requireSupport(w http.ResponseWriter, req *http.Request) bool {
+	if s.isAdmin(req) || dashboardUserFromRequest(req) != nil {
+		return true
+	}
+	respond(w, req, 403, HTTPResponseError{Error: "SUPPORT_ONLY", Detail: "comments are for dashboard users"},
+		"not a dashboard user")
+	return false
+}
+
+// handleComments serves the comments of an order.
+//
+//	GET  /orders/{id}/comments  lists them, oldest first.
+//	POST /orders/{id}/comments  adds one, {"body": "customer called"}.
+func (s *OrderService) handleComments(w http.ResponseWriter, req *http.Request, orderID int64) {
+	if !s.requireSupport(w, req) {
+		return
+	}
+	if req.Method == http.MethodGet {
+		comments, err := s.Comments(orderID)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Comments() %d failed: %s", orderID, err)
+			return
+		}
+		respond(w, req, 200, comments, "order %d, %d comments", orderID, len(comments))
+		return
+	}
+
+	var buf bytes.Buffer
+	io.Copy(&buf, req.Body)
+	var body struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+		return
+	}
+	if body.Body = strings.TrimSpace(body.Body); body.Body == "" || len(body.Body) > maxCommentLength {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_COMMENT",
+			Detail: fmt.Sprintf("body must be 1 to %d bytes", maxCommentLength)}, "%d bytes", len(body.Body))
+		return
+	}
+	comment, err := s.AddComment(orderID, s.auditActor(req), body.Body)
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case nil:
+		respond(w, req, 201, comment, "comment %d on order %d", comment.ID, orderID)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "AddComment() %d failed: %s", orderID, err)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestComments(t *testing.T) {
+	idp := newTestIdP(t)
+	svc := newTestService(t, Config{AdminToken: "secret", OIDC: OIDCConfig{Issuer: idp.URL, ClientID: "dashboard",
+		GroupRoles: map[string]string{"support": scopeWrite, "sales": scopeRead}}})
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	support := idp.token(t, map[string]interface{}{"groups": []string{"support"}})
+	sales := idp.token(t, map[string]interface{}{"sub": "u2", "groups": []string{"sales"}})
+	key := createKey(t, svc, "acme", scopeWrite)
+
+	tests := []struct {
+		name, method, path, token, body string
+		code                            int
+	}{
+		{"support may comment", "POST", "/orders/1/comments", support, `{"body": "customer called"}`, 201},
+		{"admin may comment", "POST", "/orders/1/comments", "secret", `{"body": "refunded"}`, 201},
+		{"read role may not comment", "POST", "/orders/1/comments", sales, `{"body": "hi"}`, 403},
+		{"API keys may not comment", "POST", "/orders/1/comments", key.Key, `{"body": "hi"}`, 403},
+		{"empty", "POST", "/orders/1/comments", support, `{"body": " "}`, 400},
+		{"too long", "POST", "/orders/1/comments", support,
+			`{"body": "` + strings.Repeat("x", maxCommentLength+1) + `"}`, 400},
+		{"no such order", "POST", "/orders/2/comments", support, `{"body": "hi"}`, 404},
+		{"API keys may not read", "GET", "/orders/1/comments", key.Key, "", 403},
+	}
+	for _, test := range tests {
+		if w := serveKey(svc, test.method, test.path, test.token, test.body); w.Code != test.code {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.code, w.Body)
+		}
+	}
+
+	w := serveKey(svc, "GET", "/orders/1/comments", sales, "")
+	var comments []Comment
+	if err := json.Unmarshal(w.Body.Bytes(), &comments); err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].Author != "user:u1" || comments[0].Body != "customer called" ||
+		comments[1].Author != auditActorAdmin {
+		t.Errorf("comments %s", w.Body)
+	}
+	// Comments are not part of what API keys see of the order.
+	for _, path := range []string{"/orders/1", "/orders/1/timeline"} {
+		if w := serveKey(svc, "GET", path, key.Key, ""); strings.Contains(w.Body.String(), "customer called") {
+			t.Errorf("%s shows comments: %s", path, w.Body)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contractCase makes a documented operation respond with a documented
+// status.
+type contractCase struct {
+	method, path string // As in openapi.json.
+	code         int
+	config       Config
+	// Prepares svc and returns the request to make.
+	request func(t *testing.T, svc *OrderService) *http.Request
+}
+
+// contractRequest returns a request to path with an optional body.
+func contractRequest(method, path, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body == "" {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	return req
+}
+
+// contractOrder creates an order of tenant.
+func contractOrder(t *testing.T, svc *OrderService, tenant string) {
+	t.Helper()
+	if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+}
+
+// request returns a contractCase.request making the given request, after
+// creating an order if withOrder.
+func request(method, path, body string, withOrder bool) func(*testing.T, *OrderService) *http.Request {
+	return func(t *testing.T, svc *OrderService) *http.Request {
+		if withOrder {
+			contractOrder(t, svc, "")
+		}
+		return contractRequest(method, path, body)
+	}
+}
+
+var contractCases = []contractCase{
+	{method: "get", path: "/orders", code: 200, request: request("GET", "/orders", "", true)},
+	{method: "get", path: "/orders", code: 200, request: request("GET", "/orders?updated_since=2024-01-01T00:00:00Z", "", true)},
+	{method: "get", path: "/orders", code: 206, request: func(t *testing.T, svc *OrderService) *http.Request {
+		contractOrder(t, svc, "")
+		req := contractRequest("GET", "/orders", "")
+		req.Header.Set("Range", "orders=0-9")
+		return req
+	}},
+	{method: "get", path: "/orders", code: 400, request: request("GET", "/orders?page=x", "", false)},
+	{method: "get", path: "/orders", code: 416, request: func(t *testing.T, svc *OrderService) *http.Request {
+		req := contractRequest("GET", "/orders", "")
+		req.Header.Set("Range", "orders=10-19")
+		return req
+	}},
+
+	{method: "post", path: "/orders", code: 200, request: request("POST", "/orders", createOrderDetails, false)},
+	{method: "post", path: "/orders", code: 400, request: request("POST", "/orders", `{"origin": `, false)},
+	{method: "post", path: "/orders", code: 409, config: Config{DuplicateWindow: time.Hour, RejectDuplicates: true},
+		request: request("POST", "/orders", createOrderDetails, true)},
+	{method: "post", path: "/orders", code: 422, config: Config{AdminToken: "secret"},
+		request: func(t *testing.T, svc *OrderService) *http.Request {
+			if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/areas/elsewhere",
+				`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 0]]]}`); w.Code != 200 {
+				t.Fatalf("PUT area returned %d", w.Code)
+			}
+			req := contractRequest("POST", "/orders", createOrderDetails)
+			req.Header.Set(tenantHeader, "acme")
+			return req
+		}},
+	{method: "post", path: "/orders", code: 429, config: Config{OrderQuota: OrderQuota{Daily: 1}},
+		request: request("POST", "/orders", createOrderDetails, true)},
+	{method: "post", path: "/orders", code: 503, request: func(t *testing.T, svc *OrderService) *http.Request {
+		svc.SetMaintenance(true)
+		return contractRequest("POST", "/orders", createOrderDetails)
+	}},
+
+	{method: "post", path: "/orders/quote", code: 200, request: request("POST", "/orders/quote", createOrderDetails, false)},
+	{method: "post", path: "/orders/quote", code: 400, request: request("POST", "/orders/quote", "[]", false)},
+	{method: "post", path: "/orders/quote", code: 422, request: request("POST", "/orders/quote",
+		`{"origin": ["37.8093475", "-122.2740787"], "destination": ["37.8061044", "-122.2943356"], "promo_code": "NONE"}`,
+		false)},
+	{method: "post", path: "/orders/quote", code: 503, config: Config{DistanceHealth: DistanceHealthConfig{MaxFailures: 1,
+		ProbeInterval: time.Hour}}, request: func(t *testing.T, svc *OrderService) *http.Request {
+		down, calls := true, 0
+		svc.defaultDistance = flakyDistance{down: &down, calls: &calls}
+		serve(svc, "POST", "/orders/quote", "", createOrderDetails)
+		return contractRequest("POST", "/orders/quote", createOrderDetails)
+	}},
+
+	{method: "get", path: "/orders/{id}", code: 200, request: request("GET", "/orders/1", "", true)},
+	{method: "get", path: "/orders/{id}", code: 404, request: request("GET", "/orders/1", "", false)},
+
+	{method: "patch", path: "/orders/{id}", code: 200, request: request("PATCH", "/orders/1", `{"status": "TAKEN"}`, true)},
+	{method: "patch", path: "/orders/{id}", code: 400, request: func(t *testing.T, svc *OrderService) *http.Request {
+		contractOrder(t, svc, "")
+		req := contractRequest("PATCH", "/orders/1", `{"distance": 1}`)
+		req.Header.Set("Content-Type", mergePatchMediaType)
+		return req
+	}},
+	{method: "patch", path: "/orders/{id}", code: 402, config: Config{AdminToken: "secret"},
+		request: func(t *testing.T, svc *OrderService) *http.Request {
+			contractOrder(t, svc, "acme")
+			if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/payments", `{"require_prepayment": true}`); w.Code != 200 {
+				t.Fatalf("PUT payments returned %d", w.Code)
+			}
+			req := contractRequest("PATCH", "/orders/1", `{"status": "TAKEN"}`)
+			req.Header.Set(tenantHeader, "acme")
+			return req
+		}},
+	{method: "patch", path: "/orders/{id}", code: 403, config: Config{AdminToken: "secret"},
+		request: func(t *testing.T, svc *OrderService) *http.Request {
+			contractOrder(t, svc, "acme")
+			if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/policy",
+				`{"rules": [{"action": "take", "when": [{"field": "status", "op": "==", "value": "UNASSIGNED"}]}]}`); w.Code != 200 {
+				t.Fatalf("PUT policy returned %d", w.Code)
+			}
+			req := contractRequest("PATCH", "/orders/1", `{"status": "TAKEN"}`)
+			req.Header.Set(tenantHeader, "acme")
+			return req
+		}},
+	{method: "patch", path: "/orders/{id}", code: 404, request: request("PATCH", "/orders/1", `{"status": "TAKEN"}`, false)},
+	{method: "patch", path: "/orders/{id}", code: 409, request: func(t *testing.T, svc *OrderService) *http.Request {
+		contractOrder(t, svc, "")
+		serve(svc, "PATCH", "/orders/1", "", `{"status": "TAKEN"}`)
+		return contractRequest("PATCH", "/orders/1", `{"status": "TAKEN"}`)
+	}},
+
+	{method: "get", path: "/orders/{id}/history", code: 200, request: request("GET", "/orders/1/history", "", true)},
+	{method: "get", path: "/orders/{id}/history", code: 404, request: request("GET", "/orders/1/history", "", false)},
+	{method: "get", path: "/changes", code: 200, request: request("GET", "/changes", "", true)},
+	{method: "get", path: "/changes", code: 400, request: request("GET", "/changes?limit=0", "", false)},
+	{method: "get", path: "/orders/{id}/timeline", code: 200, request: request("GET", "/orders/1/timeline", "", true)},
+	{method: "get", path: "/orders/{id}/timeline", code: 404, request: request("GET", "/orders/1/timeline", "", false)},
+	{method: "get", path: "/orders/{id}/tracking", code: 200, config: Config{TrackingSecret: "s3cret"},
+		request: request("GET", "/orders/1/tracking", "", true)},
+	{method: "get", path: "/orders/{id}/tracking", code: 404, config: Config{TrackingSecret: "s3cret"},
+		request: request("GET", "/orders/1/tracking", "", false)},
+
+	{method: "post", path: "/orders/{id}/clone", code: 200, request: request("POST", "/orders/1/clone", "", true)},
+	{method: "post", path: "/orders/{id}/clone", code: 400,
+		request: request("POST", "/orders/1/clone", `{"distance": 1}`, true)},
+	{method: "post", path: "/orders/{id}/clone", code: 404, request: request("POST", "/orders/1/clone", "", false)},
+	{method: "post", path: "/orders/{id}/clone", code: 409,
+		config:  Config{DuplicateWindow: time.Hour, RejectDuplicates: true},
+		request: request("POST", "/orders/1/clone", "", true)},
+	{method: "post", path: "/orders/{id}/clone", code: 422, config: Config{AdminToken: "secret"},
+		request: func(t *testing.T, svc *OrderService) *http.Request {
+			contractOrder(t, svc, "acme")
+			if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/areas/elsewhere",
+				`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 0]]]}`); w.Code != 200 {
+				t.Fatalf("PUT area returned %d", w.Code)
+			}
+			req := contractRequest("POST", "/orders/1/clone", "")
+			req.Header.Set(tenantHeader, "acme")
+			return req
+		}},
+	{method: "post", path: "/orders/{id}/clone", code: 429, config: Config{OrderQuota: OrderQuota{Daily: 1}},
+		request: request("POST", "/orders/1/clone", "", true)},
+	{method: "post", path: "/orders/{id}/clone", code: 503, request: func(t *testing.T, svc *OrderService) *http.Request {
+		contractOrder(t, svc, "")
+		svc.SetMaintenance(true)
+		return contractRequest("POST", "/orders/1/clone", "")
+	}},
+
+	{method: "get", path: "/track/{token}", code: 200, config: Config{TrackingSecret: "s3cret"},
+		request: request("GET", "/track/"+trackingToken("s3cret", 1), "", true)},
+	{method: "get", path: "/track/{token}", code: 404, config: Config{TrackingSecret: "s3cret"},
+		request: request("GET", "/track/"+trackingToken("other", 1), "", true)},
+
+	{method: "get", path: "/readyz", code: 200, request: request("GET", "/readyz", "", false)},
+	{method: "get", path: "/readyz", code: 503, request: func(t *testing.T, svc *OrderService) *http.Request {
+		svc.DB.Close()
+		return contractRequest("GET", "/readyz", "")
+	}},
+
+	{method: "get", path: "/version", code: 200, request: request("GET", "/version", "", false)},
+}
+
+// TestContract makes every documented operation respond with each of its
+// documented statuses and checks the responses against openapi.json. A new
+// status or operation in the spec needs a case here.
+func TestContract(t *testing.T) {
+	v, err := newOpenAPIValidator(openAPIStrict, openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered := map[string]bool{}
+	for _, c := range contractCases {
+		name := strings.ToUpper(c.method) + " " + c.path + " " + strconv.Itoa(c.code)
+		covered[name] = true
+		var operation *openAPIOperation
+		for _, p := range v.paths {
+			if p.path == c.path {
+				operation = p.operations[c.method]
+			}
+		}
+		if operation == nil || operation.Responses[strconv.Itoa(c.code)] == nil {
+			t.Errorf("%s is not documented", name)
+			continue
+		}
+
+		svc := newTestService(t, c.config)
+		req := c.request(t, svc)
+		if err := v.checkRequest(operation, req); err != nil && c.code/100 != 4 {
+			t.Errorf("%s: request does not match the spec: %s", name, err)
+		}
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s: got %d: %s", name, w.Code, w.Body)
+			continue
+		}
+		if err := v.checkResponse(operation, w.Code, w.Header(), w.Body.Bytes()); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	for _, p := range v.paths {
+		for method, operation := range p.operations {
+			for code := range operation.Responses {
+				name := strings.ToUpper(method) + " " + p.path + " " + code
+				if code != "default" && !covered[name] {
+					t.Errorf("no contract case for %s", name)
+				}
+			}
+		}
+	}
+}
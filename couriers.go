@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// courierHeader identifies the courier taking an order, for the courier
+// preferences of the tenant.
+const courierHeader = "X-Courier-ID"
+
+// Preferences of a CourierPreference.
+const (
+	preferencePreferred = "preferred"
+	preferenceBlocked   = "blocked"
+)
+
+var courierIDRE = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+// CourierPreference prefers or blocks a courier for the orders picked up in
+// a pricing zone of the tenant.
+type CourierPreference struct {
+	Courier    string `json:"courier"`
+	Zone       string `json:"zone"`       // Pricing zone of the origin, or "*" for any.
+	Preference string `json:"preference"` // "preferred" or "blocked".
+}
+
+// CourierPreferences is the body of GET and PUT
+// /admin/tenants/{tenant}/courier-preferences. A preference for a zone
+// overrides the courier's preference for "*".
+type CourierPreferences struct {
+	Preferences []CourierPreference `json:"preferences"`
+}
+
+// validateCourierPreferences returns an error describing the first invalid
+// preference.
+func validateCourierPreferences(prefs CourierPreferences) error {
+	seen := map[[2]string]bool{}
+	for i, pref := range prefs.Preferences {
+		if !courierIDRE.MatchString(pref.Courier) {
+			return fmt.Errorf("preference %d: invalid courier %q", i, pref.Courier)
+		}
+		if pref.Zone != anyZone && !areaNameRE.MatchString(pref.Zone) {
+			return fmt.Errorf("preference %d: invalid zone %q", i, pref.Zone)
+		}
+		if pref.Preference != preferencePreferred && pref.Preference != preferenceBlocked {
+			return fmt.Errorf("preference %d: want %q or %q, got %q", i, preferencePreferred, preferenceBlocked,
+				pref.Preference)
+		}
+		key := [2]string{pref.Courier, pref.Zone}
+		if seen[key] {
+			return fmt.Errorf("preference %d: courier %q given twice for zone %q", i, pref.Courier, pref.Zone)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// CourierPreferences returns the courier preferences of tenant, by courier
+// and zone.
+func (s *OrderService) CourierPreferences(tenant string) (CourierPreferences, error) {
+	prefs := CourierPreferences{Preferences: []CourierPreference{}}
+	rows, err := s.DB.Query(`SELECT courier_id, zone, preference FROM courier_preferences WHERE tenant_id = ?
+		ORDER BY courier_id, zone`, tenant)
+	if err != nil {
+		return prefs, fmt.Errorf("unable to query courier preferences of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pref CourierPreference
+		if err := rows.Scan(&pref.Courier, &pref.Zone, &pref.Preference); err != nil {
+			return prefs, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		prefs.Preferences = append(prefs.Preferences, pref)
+	}
+	return prefs, rows.Err()
+}
+
+// SetCourierPreferences replaces the courier preferences of tenant.
+func (s *OrderService) SetCourierPreferences(tenant string, prefs CourierPreferences) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed at Begin: %s", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM courier_preferences WHERE tenant_id = ?", tenant); err != nil {
+		return fmt.Errorf("unable to delete courier preferences of tenant %q: %s", tenant, err)
+	}
+	for _, pref := range prefs.Preferences {
+		_, err := tx.Exec(`INSERT INTO courier_preferences (tenant_id, courier_id, zone, preference)
+			VALUES (?, ?, ?, ?)`, tenant, pref.Courier, pref.Zone, pref.Preference)
+		if err != nil {
+			return fmt.Errorf("unable to insert courier preference: %s", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to commit courier preferences: %s", err)
+	}
+	return nil
+}
+
+// courierZones are the preferences of a courier by zone.
+type courierZones map[string]string
+
+// loadCourierZones returns the preferences of courier for the zones of
+// tenant.
+func loadCourierZones(db *sql.DB, tenant, courier string) (courierZones, error) {
+	rows, err := db.Query("SELECT zone, preference FROM courier_preferences WHERE tenant_id = ? AND courier_id = ?",
+		tenant, courier)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query preferences of courier %q: %s", courier, err)
+	}
+	defer rows.Close()
+	zones := courierZones{}
+	for rows.Next() {
+		var zone, pref string
+		if err := rows.Scan(&zone, &pref); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		zones[zone] = pref
+	}
+	return zones, rows.Err()
+}
+
+// of returns the preference for orders picked up in zone, "" outside of any
+// zone, or "" if there is none.
+func (z courierZones) of(zone string) string {
+	if pref, ok := z[zone]; ok && zone != "" {
+		return pref
+	}
+	return z[anyZone]
+}
+
+// originZone returns the pricing zone of the origin of an order, "" outside
+// of any.
+func originZone(zones []Area, lat, lng sql.NullFloat64) (string, error) {
+	if !lat.Valid || !lng.Valid {
+		return "", nil
+	}
+	return zoneOf(zones, lat.Float64, lng.Float64)
+}
+
+var (
+	errCourierBlocked  = fmt.Errorf("courier blocked")
+	errVehicleTooSmall = fmt.Errorf("order too large for the vehicle")
+)
+
+// courierTake checks that courier may take the order orderID and returns the
+// data of its EventTaken: errCourierBlocked if its tenant blocked the
+// courier from the zone of its origin, errVehicleTooSmall if it doesn't fit
+// in the courier's vehicle. The travel time is that of the vehicle, unless
+// the distance provider fails. Missing orders are left to Take.
+func (s *OrderService) courierTake(courier string, orderID int64) (*orderTaken, error) {
+	taken := &orderTaken{Courier: courier}
+	var (
+		tenant                   string
+		lat, lng, dstLat, dstLng sql.NullFloat64
+		weight, volume           sql.NullInt64
+	)
+	err := s.DB.QueryRow(`SELECT COALESCE(tenant_id, ''), origin_lat, origin_lng, destination_lat, destination_lng,
+		weight, volume FROM orders WHERE id = ?`, orderID).Scan(&tenant, &lat, &lng, &dstLat, &dstLng, &weight,
+		&volume)
+	if err == sql.ErrNoRows {
+		return taken, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query order %d: %s", orderID, err)
+	}
+
+	prefs, err := loadCourierZones(s.DB, tenant, courier)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefs) > 0 {
+		zones, err := loadAreas(s.DB, pricingZonesTable, tenant)
+		if err != nil {
+			return nil, err
+		}
+		zone, err := originZone(zones, lat, lng)
+		if err != nil {
+			return nil, err
+		}
+		if prefs.of(zone) == preferenceBlocked {
+			return nil, errCourierBlocked
+		}
+	}
+
+	vehicle, profile, err := courierVehicle(s.DB, tenant, courier)
+	if err != nil || profile == nil {
+		return taken, err
+	}
+	taken.Vehicle = vehicle
+	if !profile.carries(&Order{Weight: weight.Int64, Volume: volume.Int64}) {
+		return nil, errVehicleTooSmall
+	}
+	if profile.Mode == travelDriving || !lat.Valid || !dstLat.Valid {
+		// Orders are routed for driving when created.
+		return taken, nil
+	}
+	provider, err := s.distanceProvider(tenant)
+	if err != nil {
+		fmt.Printf("Unable to route order %d by %s: %s\n", orderID, vehicle, err)
+		return taken, nil
+	}
+	point := func(lat, lng sql.NullFloat64) []string {
+		return []string{strconv.FormatFloat(lat.Float64, 'f', -1, 64), strconv.FormatFloat(lng.Float64, 'f', -1, 64)}
+	}
+	route, err := routeMode(provider, point(lat, lng), point(dstLat, dstLng), profile.Mode)
+	if err != nil {
+		fmt.Printf("Unable to route order %d by %s: %s\n", orderID, vehicle, err)
+		return taken, nil
+	}
+	taken.Duration = route.Duration
+	return taken, nil
+}
+
+// courierCandidate is an unassigned order a courier may take.
+type courierCandidate struct {
+	id        int64
+	preferred bool // Picked up in a zone the courier is preferred for.
+	// Ends of the journey, invalid for orders created without coordinates.
+	lat, lng, dstLat, dstLng sql.NullFloat64
+	weight, volume           int64
+}
+
+// courierCandidates returns the unassigned orders of tenant courier may take,
+// oldest first: those not picked up in a zone the courier is blocked from
+// and that fit in its vehicle. Returns the vehicle too, nil if the courier
+// has none.
+func (s *OrderService) courierCandidates(tenant, courier string) ([]courierCandidate, *vehicleProfile, error) {
+	prefs, err := loadCourierZones(s.DB, tenant, courier)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, vehicle, err := courierVehicle(s.DB, tenant, courier)
+	if err != nil {
+		return nil, nil, err
+	}
+	zones, err := loadAreas(s.DB, pricingZonesTable, tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := s.DB.Query(`SELECT id, origin_lat, origin_lng, destination_lat, destination_lng,
+		COALESCE(weight, 0), COALESCE(volume, 0) FROM orders WHERE tenant_id = ? AND status = ?
+		ORDER BY created_at, id`, tenant, string(StateUnassigned))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to query unassigned orders: %s", err)
+	}
+	defer rows.Close()
+	var candidates []courierCandidate
+	for rows.Next() {
+		var c courierCandidate
+		if err := rows.Scan(&c.id, &c.lat, &c.lng, &c.dstLat, &c.dstLng, &c.weight, &c.volume); err != nil {
+			return nil, nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if vehicle != nil && !vehicle.carries(&Order{Weight: c.weight, Volume: c.volume}) {
+			continue
+		}
+		zone, err := originZone(zones, c.lat, c.lng)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch prefs.of(zone) {
+		case preferenceBlocked:
+			continue
+		case preferencePreferred:
+			c.preferred = true
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("unable to query unassigned orders: %s", err)
+	}
+	return candidates, vehicle, nil
+}
+
+// SuggestedOrders returns up to limit unassigned orders of tenant for
+// courier: those picked up in the courier's preferred zones first, then the
+// others, oldest first, leaving out those of the zones the courier is
+// blocked from and those too large for its vehicle.
+func (s *OrderService) SuggestedOrders(tenant, courier string, limit int) ([]Order, error) {
+	candidates, _, err := s.courierCandidates(tenant, courier)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].preferred && !candidates[j].preferred })
+
+	orders := []Order{}
+	for _, c := range candidates {
+		if len(orders) == limit {
+			break
+		}
+		order, err := s.Get(c.id)
+		if err == errNoSuchOrder {
+			continue // Purged meanwhile.
+		}
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
+
+// handleTenantCourierPreferences serves
+// /admin/tenants/{tenant}/courier-preferences.
+//
+//	GET /admin/tenants/{tenant}/courier-preferences  returns the
+//	                                                 CourierPreferences.
+//	PUT /admin/tenants/{tenant}/courier-preferences  replaces them,
+//	                                                 {"preferences":
+//	                                                 [{"courier": "bob",
+//	                                                 "zone": "airport",
+//	                                                 "preference": "blocked"}]}.
+func (s *OrderService) handleTenantCourierPreferences(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var prefs CourierPreferences
+		if err := json.Unmarshal(buf.Bytes(), &prefs); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if err := validateCourierPreferences(prefs); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PREFERENCES", Detail: err.Error()}, "%s", err)
+			return
+		}
+		if err := s.SetCourierPreferences(tenant, prefs); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetCourierPreferences(): %s", err)
+			return
+		}
+	}
+	prefs, err := s.CourierPreferences(tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "CourierPreferences(): %s", err)
+		return
+	}
+	respond(w, req, 200, prefs, "tenant %q %d courier preferences", tenant, len(prefs.Preferences))
+}
+
+// handleCouriers serves the endpoints of a courier of the tenant under
+// /couriers/{id}/.
+func (s *OrderService) handleCouriers(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/couriers/"), "/")
+	if len(parts) != 2 {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+		return
+	}
+	if !courierIDRE.MatchString(parts[0]) {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_COURIER"}, "courier %q", parts[0])
+		return
+	}
+	switch parts[1] {
+	case "suggested-orders":
+		s.handleSuggestedOrders(w, req, parts[0])
+	case "route-suggestion":
+		s.handleRouteSuggestion(w, req, parts[0])
+	case "batch-take":
+		s.handleBatchTake(w, req, parts[0])
+	default:
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+	}
+}
+
+// handleSuggestedOrders serves /couriers/{id}/suggested-orders?limit=N, the
+// unassigned orders of the tenant a courier should take next.
+func (s *OrderService) handleSuggestedOrders(w http.ResponseWriter, req *http.Request, courier string) {
+	_, limit, err := parseQueryParametersForList(req.URL.Query(), s.listLimits(req))
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: err.Error()}, "")
+		return
+	}
+	orders, err := s.SuggestedOrders(tenantFromRequest(req), courier, limit)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SuggestedOrders(): %s", err)
+		return
+	}
+	respond(w, req, 200, newOrderDTOs(orders), "courier %q %d suggested orders", courier,
+		len(orders))
+}
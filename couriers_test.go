@@ -0,0 +1,115 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveTake takes an order as courier of tenant.
+func serveTake(svc *OrderService, path, tenant, courier string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PATCH", path, strings.NewReader(`{"status": "TAKEN"}`))
+	req.Header.Set(tenantHeader, tenant)
+	req.Header.Set(courierHeader, courier)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func TestCourierPreferences(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	for name, geometry := range map[string]string{
+		"east": `{"type": "Polygon", "coordinates": [[[-122.28, 37.8], [-122.27, 37.8], [-122.27, 37.82], [-122.28, 37.82], [-122.28, 37.8]]]}`,
+		"west": `{"type": "Polygon", "coordinates": [[[-122.3, 37.8], [-122.29, 37.8], [-122.29, 37.81], [-122.3, 37.81], [-122.3, 37.8]]]}`,
+	} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/zones/"+name, geometry); w.Code != 200 {
+			t.Fatalf("PUT zone returned %d: %s", w.Code, w.Body)
+		}
+	}
+	// Orders 1 and 3 are picked up in the east, 2 in the west.
+	westward := createOrderDetails
+	eastward := `{"origin": ["37.8061044", "-122.2943356"], "destination": ["37.8093475", "-122.2740787"]}`
+	for _, body := range []string{westward, eastward, westward} {
+		if w := serve(svc, "POST", "/orders", "acme", body); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+		}
+	}
+
+	for _, body := range []string{
+		`{"preferences": [{"courier": "", "zone": "east", "preference": "blocked"}]}`,
+		`{"preferences": [{"courier": "bob", "zone": "", "preference": "blocked"}]}`,
+		`{"preferences": [{"courier": "bob", "zone": "east", "preference": "maybe"}]}`,
+		`{"preferences": [{"courier": "bob", "zone": "east", "preference": "blocked"},
+			{"courier": "bob", "zone": "east", "preference": "preferred"}]}`,
+	} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/courier-preferences", body); w.Code != 400 {
+			t.Errorf("PUT %s returned %d", body, w.Code)
+		}
+	}
+	prefs := `{"preferences": [
+		{"courier": "alice", "zone": "west", "preference": "preferred"},
+		{"courier": "bob", "zone": "*", "preference": "blocked"},
+		{"courier": "bob", "zone": "west", "preference": "preferred"}
+	]}`
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/courier-preferences", prefs); w.Code != 200 {
+		t.Fatalf("PUT courier preferences returned %d: %s", w.Code, w.Body)
+	}
+	w := serveAdmin(svc, "GET", "/admin/tenants/acme/courier-preferences", "")
+	var got CourierPreferences
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got.Preferences) != 3 ||
+		got.Preferences[1] != (CourierPreference{Courier: "bob", Zone: "*", Preference: "blocked"}) {
+		t.Errorf("GET courier preferences returned %+v, %v", got, err)
+	}
+
+	suggested := func(courier, query string) []int64 {
+		t.Helper()
+		w := serve(svc, "GET", "/couriers/"+courier+"/suggested-orders"+query, "acme", "")
+		var orders []OrderDTO
+		if err := json.NewDecoder(w.Body).Decode(&orders); err != nil || w.Code != 200 {
+			t.Fatalf("GET suggested orders of %s returned %d, %v", courier, w.Code, err)
+		}
+		var ids []int64
+		for _, order := range orders {
+			ids = append(ids, order.ID)
+		}
+		return ids
+	}
+	for courier, want := range map[string]string{
+		"alice": "[2 1 3]", // West first.
+		"bob":   "[2]",     // Blocked everywhere else.
+		"carol": "[1 2 3]",
+	} {
+		if ids := suggested(courier, ""); fmt.Sprint(ids) != want {
+			t.Errorf("suggested orders of %s are %v, want %s", courier, ids, want)
+		}
+	}
+	if ids := suggested("alice", "?limit=1"); len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("suggested orders of alice with limit=1 are %v", ids)
+	}
+	if w := serve(svc, "GET", "/couriers/a%20b/suggested-orders", "acme", ""); w.Code != 400 {
+		t.Errorf("GET suggested orders of an invalid courier returned %d", w.Code)
+	}
+
+	if w := serveTake(svc, "/orders/1", "acme", "bob"); w.Code != 403 ||
+		!strings.Contains(w.Body.String(), "COURIER_BLOCKED") {
+		t.Errorf("take by a blocked courier returned %d %s", w.Code, w.Body)
+	}
+	if w := serveTake(svc, "/orders/2", "acme", "bob"); w.Code != 200 {
+		t.Errorf("take in a preferred zone returned %d %s", w.Code, w.Body)
+	}
+	if w := serveTake(svc, "/orders/1", "acme", "alice"); w.Code != 200 {
+		t.Errorf("take by another courier returned %d %s", w.Code, w.Body)
+	}
+	if ids := suggested("alice", ""); len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("suggested orders after takes are %v", ids)
+	}
+	w = serve(svc, "GET", "/couriers/alice/suggested-orders", "other", "")
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("suggested orders of another tenant are %s", w.Body)
+	}
+}
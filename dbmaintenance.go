@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DBMaintenanceConfig schedules the upkeep of the SQLite database: an
+// integrity check, an incremental vacuum and ANALYZE.
+type DBMaintenanceConfig struct {
+	// Time of day of low traffic, "HH:MM-HH:MM" in UTC, possibly across
+	// midnight, maintenance runs once in. Empty disables it.
+	Window string
+}
+
+// dbMaintenanceCheckInterval is the time between checks for the window.
+const dbMaintenanceCheckInterval = 10 * time.Minute
+
+// DBMaintenanceReport is the outcome of the last maintenance, in GET /readyz.
+type DBMaintenanceReport struct {
+	Time time.Time `json:"time"`
+	// "ok", or the problems PRAGMA integrity_check found.
+	Integrity string `json:"integrity"`
+	// Pages the incremental vacuum returned to the file system, and the
+	// free pages left, which only a full VACUUM returns without
+	// auto_vacuum=INCREMENTAL.
+	FreedPages int64 `json:"freed_pages"`
+	FreePages  int64 `json:"free_pages"`
+	// Seconds the maintenance took.
+	Duration float64 `json:"duration"`
+	// Why maintenance stopped short, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// dbMaintainer maintains the database in the window of its config.
+type dbMaintainer struct {
+	start, end time.Duration // Of the window, since midnight UTC.
+	db         *sql.DB
+	now        func() time.Time
+
+	mu   sync.Mutex
+	last *DBMaintenanceReport // nil until maintenance ran.
+}
+
+func newDBMaintainer(config DBMaintenanceConfig, db *sql.DB) (*dbMaintainer, error) {
+	m := &dbMaintainer{db: db, now: time.Now}
+	if config.Window == "" {
+		return m, nil
+	}
+	parts := strings.Split(config.Window, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid maintenance window %q, want HH:MM-HH:MM", config.Window)
+	}
+	for i, bound := range []*time.Duration{&m.start, &m.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q, want HH:MM-HH:MM", config.Window)
+		}
+		*bound = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if m.start == m.end {
+		return nil, fmt.Errorf("invalid maintenance window %q, it is empty", config.Window)
+	}
+	return m, nil
+}
+
+// due returns true if now is in the window and maintenance did not run in
+// it yet.
+func (m *dbMaintainer) due(now time.Time) bool {
+	now = now.UTC()
+	sinceMidnight := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC))
+	length := m.end - m.start
+	if length < 0 {
+		length += 24 * time.Hour
+	}
+	intoWindow := sinceMidnight - m.start
+	if intoWindow < 0 {
+		intoWindow += 24 * time.Hour
+	}
+	if intoWindow >= length {
+		return false
+	}
+	last := m.Last()
+	return last == nil || now.Sub(last.Time) > intoWindow
+}
+
+// run maintains the database once a day in the window until ctx is done.
+func (m *dbMaintainer) run(ctx context.Context) {
+	ticker := time.NewTicker(dbMaintenanceCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if m.due(m.now()) {
+				m.maintain(ctx)
+			}
+		}
+	}
+}
+
+// maintain checks the integrity of the database, returns its free pages to
+// the file system if auto_vacuum allows, and updates the statistics of the
+// query planner, logging the outcome.
+func (m *dbMaintainer) maintain(ctx context.Context) DBMaintenanceReport {
+	start := m.now()
+	report := DBMaintenanceReport{Time: start}
+	err := m.checkIntegrity(ctx, &report)
+	if err == nil {
+		err = m.vacuum(ctx, &report)
+	}
+	if err == nil {
+		_, err = m.db.ExecContext(ctx, "ANALYZE")
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Duration = m.now().Sub(start).Seconds()
+
+	m.mu.Lock()
+	m.last = &report
+	m.mu.Unlock()
+	fmt.Printf("DB maintenance: integrity %s, freed %d pages, %d free pages left, took %.1fs\n",
+		report.Integrity, report.FreedPages, report.FreePages, report.Duration)
+	if report.Error != "" {
+		fmt.Printf("DB maintenance failed: %s\n", report.Error)
+	}
+	return report
+}
+
+// checkIntegrity runs PRAGMA integrity_check, reporting up to 10 problems.
+func (m *dbMaintainer) checkIntegrity(ctx context.Context, report *DBMaintenanceReport) error {
+	rows, err := m.db.QueryContext(ctx, "PRAGMA integrity_check(10)")
+	if err != nil {
+		return fmt.Errorf("integrity check failed: %s", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			return fmt.Errorf("integrity check failed: %s", err)
+		}
+		problems = append(problems, problem)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check failed: %s", err)
+	}
+	report.Integrity = strings.Join(problems, "; ")
+	return nil
+}
+
+// vacuum runs PRAGMA incremental_vacuum on one connection, counting the
+// pages it freed.
+func (m *dbMaintainer) vacuum(ctx context.Context, report *DBMaintenanceReport) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var before int64
+	if err := conn.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&before); err != nil {
+		return fmt.Errorf("incremental vacuum failed: %s", err)
+	}
+	// The vacuum frees a page per step, its rows must be read through.
+	rows, err := conn.QueryContext(ctx, "PRAGMA incremental_vacuum")
+	if err != nil {
+		return fmt.Errorf("incremental vacuum failed: %s", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("incremental vacuum failed: %s", err)
+	}
+	if err := conn.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&report.FreePages); err != nil {
+		return fmt.Errorf("incremental vacuum failed: %s", err)
+	}
+	report.FreedPages = before - report.FreePages
+	return nil
+}
+
+// Last returns the report of the last maintenance, nil if none ran.
+func (m *dbMaintainer) Last() *DBMaintenanceReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// enableIncrementalVacuum switches the database to auto_vacuum=INCREMENTAL
+// with a full VACUUM, which rewrites the database and holds its lock while
+// it does.
+func enableIncrementalVacuum(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+// maintainMain implements "orderservice maintain", maintaining the database
+// right away, e.g. from cron while the service is stopped.
+func maintainMain(args []string) error {
+	flags := flag.NewFlagSet("maintain", flag.ContinueOnError)
+	dbpath := flags.String("dbpath", "", "Path to database")
+	vacuum := flags.Bool("vacuum", false, "First VACUUM the database and turn on incremental vacuums")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dbpath == "" {
+		return fmt.Errorf("missing db name")
+	}
+	db, err := sql.Open("sqlite3", *dbpath)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if *vacuum {
+		if err := enableIncrementalVacuum(ctx, db); err != nil {
+			return fmt.Errorf("VACUUM failed: %s", err)
+		}
+	}
+	m, _ := newDBMaintainer(DBMaintenanceConfig{}, db)
+	report := m.maintain(ctx)
+	if report.Error != "" {
+		return fmt.Errorf("maintenance failed: %s", report.Error)
+	}
+	if report.Integrity != "ok" {
+		return fmt.Errorf("database is corrupt: %s", report.Integrity)
+	}
+	return nil
+}
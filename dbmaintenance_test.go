@@ -0,0 +1,85 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDBMaintainerWindow(t *testing.T) {
+	for _, window := range []string{"02:00", "2-4", "25:00-04:00", "03:00-03:00"} {
+		if _, err := newDBMaintainer(DBMaintenanceConfig{Window: window}, nil); err == nil {
+			t.Errorf("no error for window %q", window)
+		}
+	}
+
+	m, err := newDBMaintainer(DBMaintenanceConfig{Window: "23:00-01:30"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		at   time.Duration
+		last time.Duration // Since day, 0 for none.
+		due  bool
+	}{
+		{at: 22 * time.Hour, due: false},
+		{at: 23 * time.Hour, due: true},
+		{at: 25 * time.Hour, due: true},
+		{at: 25*time.Hour + 30*time.Minute, due: false},
+		{at: 25 * time.Hour, last: 23*time.Hour + 10*time.Minute, due: false},
+		{at: 47 * time.Hour, last: 23*time.Hour + 10*time.Minute, due: true},
+	} {
+		m.last = nil
+		if c.last != 0 {
+			m.last = &DBMaintenanceReport{Time: day.Add(c.last)}
+		}
+		if due := m.due(day.Add(c.at)); due != c.due {
+			t.Errorf("due at %s after %s: %t, want %t", c.at, c.last, due, c.due)
+		}
+	}
+}
+
+func TestDBMaintainer(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if err := enableIncrementalVacuum(context.Background(), svc.DB); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if _, err := svc.DB.Exec("DELETE FROM events"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(svc, "GET", "/readyz", "", "")
+	var ready Readiness
+	if err := json.NewDecoder(w.Body).Decode(&ready); err != nil || ready.Maintenance != nil {
+		t.Fatalf("unexpected readiness %+v, %v", ready, err)
+	}
+
+	report := svc.dbMaintainer.maintain(context.Background())
+	if report.Integrity != "ok" || report.Error != "" || report.FreedPages == 0 ||
+		report.FreePages != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	var analyzed int
+	svc.DB.QueryRow("SELECT COUNT(*) FROM sqlite_stat1").Scan(&analyzed)
+	if analyzed == 0 {
+		t.Error("expected ANALYZE to fill sqlite_stat1")
+	}
+
+	svc.dbMaintainer.last.Integrity = "row 3 missing from index orders_status"
+	w = serve(svc, "GET", "/readyz", "", "")
+	ready = Readiness{}
+	json.NewDecoder(w.Body).Decode(&ready)
+	if w.Code != 200 || ready.Status != "degraded" || ready.DB != "corrupt" || ready.Maintenance == nil {
+		t.Errorf("readiness of a corrupt database %d %+v", w.Code, ready)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deprecation describes a route or field clients should stop using.
+type Deprecation struct {
+	Feature string    // Name usage is counted under, e.g. "GET /orders/{id}/history".
+	Since   time.Time // When it was deprecated.
+	Sunset  time.Time // When it will be removed, zero until that is planned.
+	Link    string    // Documentation of what replaces it, optional.
+}
+
+// deprecatedRoute marks the requests matching pattern deprecated.
+type deprecatedRoute struct {
+	pattern *regexp.Regexp
+	methods []string // All of them if empty.
+	Deprecation
+}
+
+// deprecatedRoutes are the deprecated endpoints of the service. Requests
+// matching them are still served, with Deprecation and Sunset headers.
+var deprecatedRoutes = []deprecatedRoute{}
+
+// deprecatedFields are the deprecated fields of OrderDTO by JSON name.
+// Requests selecting them with the "fields" query parameter get Deprecation
+// and Sunset headers.
+var deprecatedFields = map[string]Deprecation{}
+
+// deprecatedUsage counts the requests using each deprecated feature, per
+// actor ("key:{id}", "user:{subject}", "tenant:{tenant}"), shown by GET
+// /admin/metrics. A feature no longer counted is safe to remove.
+var deprecatedUsage = expvar.NewMap("deprecated_usage")
+
+// deprecatedUsageMu serializes creating the map of a feature.
+var deprecatedUsageMu sync.Mutex
+
+// countDeprecatedUsage counts a request of actor using feature.
+func countDeprecatedUsage(feature, actor string) {
+	deprecatedUsageMu.Lock()
+	actors, ok := deprecatedUsage.Get(feature).(*expvar.Map)
+	if !ok {
+		actors = new(expvar.Map).Init()
+		deprecatedUsage.Set(feature, actors)
+	}
+	deprecatedUsageMu.Unlock()
+	actors.Add(actor, 1)
+}
+
+// deprecationsOf returns the deprecated features req uses.
+func deprecationsOf(req *http.Request) []Deprecation {
+	var deprecations []Deprecation
+	for _, r := range deprecatedRoutes {
+		if r.pattern.MatchString(req.URL.Path) && (len(r.methods) == 0 || containsString(r.methods, req.Method)) {
+			deprecations = append(deprecations, r.Deprecation)
+		}
+	}
+	if len(deprecatedFields) > 0 {
+		for _, fields := range req.URL.Query()["fields"] {
+			for _, name := range strings.Split(fields, ",") {
+				if d, ok := deprecatedFields[strings.TrimSpace(name)]; ok {
+					deprecations = append(deprecations, d)
+				}
+			}
+		}
+	}
+	return deprecations
+}
+
+// markDeprecated sets the Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers of the response to req if it uses deprecated features, and counts
+// their usage. Of several features, the earliest dates are reported and every
+// link.
+func (s *OrderService) markDeprecated(w http.ResponseWriter, req *http.Request) {
+	deprecations := deprecationsOf(req)
+	if len(deprecations) == 0 {
+		return
+	}
+	actor := s.auditActor(req)
+	var since, sunset time.Time
+	for _, d := range deprecations {
+		countDeprecatedUsage(d.Feature, actor)
+		if since.IsZero() || d.Since.Before(since) {
+			since = d.Since
+		}
+		if !d.Sunset.IsZero() && (sunset.IsZero() || d.Sunset.Before(sunset)) {
+			sunset = d.Sunset
+		}
+		if d.Link != "" {
+			w.Header().Add("Link", "<"+d.Link+`>; rel="deprecation"`)
+		}
+	}
+	w.Header().Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+	if !sunset.IsZero() {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"expvar"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestDeprecation(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	key := createKey(t, svc, "acme", scopeRead)
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(routes []deprecatedRoute, fields map[string]Deprecation) {
+		deprecatedRoutes, deprecatedFields = routes, fields
+	}(deprecatedRoutes, deprecatedFields)
+	deprecatedRoutes = []deprecatedRoute{{pattern: regexp.MustCompile(`^/orders/[[:alnum:]-]+/history$`),
+		Deprecation: Deprecation{Feature: "test history", Since: since, Sunset: sunset, Link: "https://example.com/timeline"}}}
+	deprecatedFields = map[string]Deprecation{"sla_breached": {Feature: "test sla_breached", Since: since.AddDate(0, 6, 0)}}
+
+	w := serveKey(svc, "GET", "/orders", key.Key, "")
+	if w.Code != 200 || w.Header().Get("Deprecation") != "" || w.Header().Get("Sunset") != "" {
+		t.Fatalf("GET /orders returned %d, %v", w.Code, w.Header())
+	}
+	w = serveKey(svc, "GET", "/orders/1/history", key.Key, "")
+	if w.Code != 404 || w.Header().Get("Deprecation") != "@1704067200" ||
+		w.Header().Get("Sunset") != "Wed, 01 Jan 2025 00:00:00 GMT" ||
+		w.Header().Get("Link") != `<https://example.com/timeline>; rel="deprecation"` {
+		t.Errorf("GET /orders/1/history returned %d, %v", w.Code, w.Header())
+	}
+	w = serveKey(svc, "GET", "/orders?fields=id,sla_breached", key.Key, "")
+	if w.Code != 200 || w.Header().Get("Deprecation") != "@1719792000" || w.Header().Get("Sunset") != "" {
+		t.Errorf("GET /orders?fields=id,sla_breached returned %d, %v", w.Code, w.Header())
+	}
+	serveKey(svc, "GET", "/orders/2/history", key.Key, "")
+
+	actors, ok := deprecatedUsage.Get("test history").(*expvar.Map)
+	if !ok || actors.Get("key:"+key.ID).String() != "2" {
+		t.Errorf("unexpected usage %v", deprecatedUsage.Get("test history"))
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Names of the distance providers that can be configured globally or per
+// tenant.
+const (
+	providerGoogle    = "google"
+	providerHaversine = "haversine"
+)
+
+// Route is the length and expected travel time of a journey.
+type Route struct {
+	Distance int64 // Meters.
+	Duration int64 // Seconds.
+}
+
+// DistanceProvider computes routes. origin and destination are [latitude,
+// longitude] pairs as accepted by POST /orders.
+type DistanceProvider interface {
+	Route(origin, destination []string) (Route, error)
+}
+
+// Travel modes of the vehicles of couriers, as named by Google Maps.
+const (
+	travelDriving   = "driving"
+	travelBicycling = "bicycling"
+)
+
+// modeRouter is implemented by DistanceProviders that route by travel mode.
+type modeRouter interface {
+	RouteMode(origin, destination []string, mode string) (Route, error)
+}
+
+// routeMode routes by mode with providers that know travel modes, by their
+// default one with the others.
+func routeMode(provider DistanceProvider, origin, destination []string, mode string) (Route, error) {
+	if router, ok := provider.(modeRouter); ok {
+		return router.RouteMode(origin, destination, mode)
+	}
+	return provider.Route(origin, destination)
+}
+
+// defaultMapsBaseURL is where the distancematrix API is called unless
+// Config.MapsBaseURL says otherwise.
+const defaultMapsBaseURL = "https://maps.googleapis.com"
+
+// googleDistance uses the Google Maps distancematrix API.
+type googleDistance struct {
+	keys    *KeyPool
+	client  *http.Client
+	baseURL string // Empty for defaultMapsBaseURL.
+}
+
+// parseMapsBaseURL checks the base URL of the Google Maps API, e.g. of a
+// caching proxy, and returns it without a trailing slash.
+func parseMapsBaseURL(base string) (string, error) {
+	if base == "" {
+		return "", nil
+	}
+	u, err := url.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return "", fmt.Errorf("invalid Google Maps base URL %q, want http(s)://host[/path]", base)
+	}
+	return strings.TrimSuffix(base, "/"), nil
+}
+
+func (g *googleDistance) Route(origin, destination []string) (Route, error) {
+	return g.RouteMode(origin, destination, "")
+}
+
+// RouteMode routes by travel mode, "" for Google's default, driving.
+func (g *googleDistance) RouteMode(origin, destination []string, mode string) (Route, error) {
+	encode := func(input []string) string {
+		return fmt.Sprintf("%s,%s", url.QueryEscape(input[0]), url.QueryEscape(input[1]))
+	}
+	mapResponse, err := g.fetchDistanceMatrix(encode(origin), encode(destination), mode)
+	if err != nil {
+		return Route{}, err
+	}
+
+	if len(mapResponse.Rows) == 0 {
+		return Route{}, fmt.Errorf("Google Maps response missing rows")
+	}
+	firstRow := mapResponse.Rows[0]
+	if len(firstRow.Elements) == 0 {
+		return Route{}, fmt.Errorf("Google Maps response missing rows.elements")
+	}
+	element := firstRow.Elements[0]
+	if element.Status != "OK" {
+		return Route{}, fmt.Errorf("Google Maps found no route: %s", element.Status)
+	}
+	return Route{Distance: element.Distance.Value, Duration: element.Duration.Value}, nil
+}
+
+// fetchDistanceMatrix calls the distancematrix API, rotating to the next key in
+// the pool whenever Google reports that a key is over its quota. origin and
+// destination must be URL-encoded strings, mode a travel mode or "".
+func (g *googleDistance) fetchDistanceMatrix(origin, destination, mode string) (*GoogleMapsResponse, error) {
+	for attempt := 0; attempt < g.keys.Len(); attempt++ {
+		key, keyID, err := g.keys.Acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		baseURL := g.baseURL
+		if baseURL == "" {
+			baseURL = defaultMapsBaseURL
+		}
+		url := fmt.Sprintf("%s/maps/api/distancematrix/json?origins=%s&destinations=%s&key=%s",
+			baseURL, origin, destination, key)
+		if mode != "" {
+			url += "&mode=" + mode
+		}
+		response, err := g.client.Get(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed http.Client{}.Get() key=%s: %s", keyID, err)
+		}
+
+		var mapResponse GoogleMapsResponse
+		err = json.NewDecoder(response.Body).Decode(&mapResponse)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode response: %s", err)
+		}
+
+		switch mapResponse.Status {
+		case "OK":
+			return &mapResponse, nil
+		case "OVER_QUERY_LIMIT", "OVER_DAILY_LIMIT":
+			g.keys.Exhausted(keyID)
+			continue
+		default:
+			return nil, fmt.Errorf("Google Maps returned %s for key=%s: %s", mapResponse.Status, keyID,
+				mapResponse.ErrorMessage)
+		}
+	}
+	return nil, errNoMapsKeys
+}
+
+// haversineDistance is the great-circle distance between the two points,
+// travelled at haversineSpeed. It needs no API key and is useful for tenants
+// who do not need road distances and for local development.
+type haversineDistance struct{}
+
+const (
+	// earthRadius is the mean radius of the earth in meters.
+	earthRadius = 6371000
+	// haversineSpeed is the assumed average speed in meters per second, 25
+	// km/h.
+	haversineSpeed = 25 * 1000 / 3600.0
+	// haversineBicyclingSpeed is that of bicycles, 15 km/h.
+	haversineBicyclingSpeed = 15 * 1000 / 3600.0
+)
+
+func (h haversineDistance) Route(origin, destination []string) (Route, error) {
+	return h.RouteMode(origin, destination, "")
+}
+
+// RouteMode travels at haversineBicyclingSpeed by bicycle, at
+// haversineSpeed otherwise.
+func (haversineDistance) RouteMode(origin, destination []string, mode string) (Route, error) {
+	lat1, lng1, err := parseLatLng(origin)
+	if err != nil {
+		return Route{}, err
+	}
+	lat2, lng2, err := parseLatLng(destination)
+	if err != nil {
+		return Route{}, err
+	}
+	meters := haversine(lat1, lng1, lat2, lng2)
+	speed := haversineSpeed
+	if mode == travelBicycling {
+		speed = haversineBicyclingSpeed
+	}
+	return Route{Distance: int64(math.Round(meters)), Duration: int64(math.Round(meters / speed))}, nil
+}
+
+// haversine returns the great-circle distance in meters between two points
+// given in degrees.
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLng := toRadians(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// parseLatLng parses a [latitude, longitude] pair.
+func parseLatLng(point []string) (float64, float64, error) {
+	if len(point) != 2 {
+		return 0, 0, fmt.Errorf("expected [latitude, longitude], got %d values", len(point))
+	}
+	lat, err := strconv.ParseFloat(point[0], 64)
+	// NaN compares false with everything, so check the range inclusively.
+	if err != nil || !(lat >= -90 && lat <= 90) {
+		return 0, 0, fmt.Errorf("invalid latitude %q", point[0])
+	}
+	lng, err := strconv.ParseFloat(point[1], 64)
+	if err != nil || !(lng >= -180 && lng <= 180) {
+		return 0, 0, fmt.Errorf("invalid longitude %q", point[1])
+	}
+	return lat, lng, nil
+}
+
+// distanceProvider returns the provider configured for tenant, falling back to
+// the global default when the tenant has no settings. Tenants with their own
+// Google Maps key get a key pool of their own so their usage is tracked
+// separately from the global keys.
+func (s *OrderService) distanceProvider(tenant string) (DistanceProvider, error) {
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := settings.DistanceProvider
+	if provider == "" && settings.MapsAPIKey != "" {
+		provider = providerGoogle
+	}
+	switch provider {
+	case "":
+		return s.defaultDistance, nil
+	case providerHaversine:
+		return haversineDistance{}, nil
+	case providerGoogle:
+		if settings.MapsAPIKey == "" {
+			if s.mapsKeys == nil {
+				return nil, fmt.Errorf("tenant %q uses %s but no global key is configured", tenant, provider)
+			}
+			return &googleDistance{keys: s.mapsKeys, client: s.Client, baseURL: s.config.MapsBaseURL}, nil
+		}
+		pool, err := s.tenantKeyPool(settings.MapsAPIKey)
+		if err != nil {
+			return nil, err
+		}
+		return &googleDistance{keys: pool, client: s.Client, baseURL: s.config.MapsBaseURL}, nil
+	default:
+		return nil, fmt.Errorf("tenant %q has unknown distance provider %q", tenant, provider)
+	}
+}
+
+// DistanceSetting is the body of /admin/tenants/{tenant}/distance. The Maps
+// key is write-only, GET returns its fingerprint.
+type DistanceSetting struct {
+	// "google" or "haversine", null for the global default, or Google if
+	// the tenant has a key.
+	Provider *string `json:"provider"`
+	// The tenant's own Google Maps API key, SECRET. Only read by PUT, where
+	// null keeps the current key and "" removes it.
+	MapsAPIKey *string `json:"maps_api_key,omitempty"`
+	// Fingerprint of the tenant's key, as in the key usage.
+	MapsKeyID string `json:"maps_key_id,omitempty"`
+}
+
+// SetDistanceSettings sets the distance provider of tenant, "" for the
+// default, and its Maps key unless mapsKey is nil, "" for none. The key is
+// encrypted with the Config.FieldKey.
+func (s *OrderService) SetDistanceSettings(tenant, provider string, mapsKey *string) error {
+	var err error
+	if mapsKey == nil {
+		_, err = s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, distance_provider) VALUES (?, NULLIF(?, ''))
+			ON CONFLICT (tenant_id) DO UPDATE SET distance_provider = excluded.distance_provider`, tenant, provider)
+	} else {
+		var sealed string
+		if sealed, err = sealField(s.config.FieldKey, *mapsKey); err != nil {
+			return fmt.Errorf("unable to encrypt Maps key of tenant %q: %s", tenant, err)
+		}
+		_, err = s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, distance_provider, maps_api_key)
+			VALUES (?, NULLIF(?, ''), NULLIF(?, '')) ON CONFLICT (tenant_id) DO UPDATE SET
+			distance_provider = excluded.distance_provider, maps_api_key = excluded.maps_api_key`,
+			tenant, provider, sealed)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set distance provider of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantDistance serves /admin/tenants/{tenant}/distance.
+//
+//	GET /admin/tenants/{tenant}/distance  returns the DistanceSetting, without the key.
+//	PUT /admin/tenants/{tenant}/distance  sets it, {"provider": "google", "maps_api_key": "..."}.
+func (s *OrderService) handleTenantDistance(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var setting DistanceSetting
+		if err := json.Unmarshal(buf.Bytes(), &setting); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		var provider string
+		if setting.Provider != nil {
+			provider = *setting.Provider
+			if provider != providerGoogle && provider != providerHaversine {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+					Detail: "provider must be google or haversine"}, "provider %q", provider)
+				return
+			}
+		}
+		if err := s.SetDistanceSettings(tenant, provider, setting.MapsAPIKey); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetDistanceSettings(): %s", err)
+			return
+		}
+	default:
+		respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+		return
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	var setting DistanceSetting
+	if settings.DistanceProvider != "" {
+		setting.Provider = &settings.DistanceProvider
+	}
+	if settings.MapsAPIKey != "" {
+		setting.MapsKeyID = keyFingerprint(settings.MapsAPIKey)
+	}
+	respond(w, req, 200, setting, "tenant %q distance provider %q, key %q", tenant, settings.DistanceProvider,
+		setting.MapsKeyID)
+}
+
+// tenantKeyPool returns the key pool for a tenant's own Google Maps key,
+// creating it on first use.
+func (s *OrderService) tenantKeyPool(secret string) (*KeyPool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := keyFingerprint(secret)
+	if pool, ok := s.tenantKeys[id]; ok {
+		return pool, nil
+	}
+	pool, err := NewKeyPool([]string{secret}, 0, s.DB)
+	if err != nil {
+		return nil, err
+	}
+	s.tenantKeys[id] = pool
+	return pool, nil
+}
+
+// newDistanceProvider returns the global provider with the given name. keys
+// may be nil unless name is "google", baseURL is that of the Google Maps API.
+func newDistanceProvider(name string, keys *KeyPool, client *http.Client, baseURL string) (DistanceProvider,
+	error) {
+	switch name {
+	case providerGoogle:
+		if keys == nil {
+			return nil, fmt.Errorf("distance provider %s needs a Google Maps API key", name)
+		}
+		return &googleDistance{keys: keys, client: client, baseURL: baseURL}, nil
+	case providerHaversine:
+		return haversineDistance{}, nil
+	default:
+		return nil, fmt.Errorf("unknown distance provider %q", name)
+	}
+}
@@ -0,0 +1,164 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHaversineDistance(t *testing.T) {
+	// The two journeys in createOrderDetails are ~1.8km apart as the crow
+	// flies, Google reports 2489m by road.
+	route, err := haversineDistance{}.Route([]string{"37.8093475", "-122.2740787"},
+		[]string{"37.8061044", "-122.2943356"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Distance < 1800 || route.Distance > 1850 {
+		t.Errorf("unexpected distance %d", route.Distance)
+	}
+	if route.Duration < 259 || route.Duration > 266 {
+		t.Errorf("unexpected duration %d", route.Duration)
+	}
+	bike, err := routeMode(haversineDistance{}, []string{"37.8093475", "-122.2740787"},
+		[]string{"37.8061044", "-122.2943356"}, travelBicycling)
+	if err != nil || bike.Distance != route.Distance || bike.Duration < 432 || bike.Duration > 443 {
+		t.Errorf("unexpected route by bicycle %+v, %v", bike, err)
+	}
+
+	if _, err := (haversineDistance{}).Route([]string{"91", "0"}, []string{"0", "0"}); err == nil {
+		t.Error("expected error for out of range latitude")
+	}
+}
+
+func TestTenantDistanceProvider(t *testing.T) {
+	db := openTestDB(t)
+	svc, err := NewOrderService(db, Config{DistanceProvider: providerHaversine}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO tenant_settings (tenant_id, distance_provider, maps_api_key) VALUES
+		('byok', NULL, 'tenant-key'), ('broken', 'carrier-pigeon', NULL), ('google', 'google', NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if provider, err := svc.distanceProvider("unknown"); err != nil || provider != svc.defaultDistance {
+		t.Errorf("expected default provider, got %v %v", provider, err)
+	}
+
+	provider, err := svc.distanceProvider("byok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	google, ok := provider.(*googleDistance)
+	if !ok {
+		t.Fatalf("expected Google provider, got %T", provider)
+	}
+	if key, _, _ := google.keys.Acquire(); key != "tenant-key" {
+		t.Errorf("expected tenant's key, got %q", key)
+	}
+
+	if _, err := svc.distanceProvider("broken"); err == nil {
+		t.Error("expected error for unknown provider")
+	}
+	// Google without a tenant key needs a global key.
+	if _, err := svc.distanceProvider("google"); err == nil {
+		t.Error("expected error without global key")
+	}
+}
+
+func TestTenantDistanceSettings(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	svc := newTestService(t, Config{AdminToken: "secret", FieldKey: key})
+	for _, body := range []string{`{"provider": "carrier-pigeon"}`, `{"provider": ""}`, `{"provider": 1}`} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/distance", body); w.Code != 400 {
+			t.Errorf("PUT %s returned %d", body, w.Code)
+		}
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/distance", ""); w.Code != 200 ||
+		strings.TrimSpace(w.Body.String()) != `{"provider":null}` {
+		t.Errorf("GET without settings returned %d: %s", w.Code, w.Body)
+	}
+
+	w := serveAdmin(svc, "PUT", "/admin/tenants/acme/distance", `{"provider": "google", "maps_api_key": "tenant-key"}`)
+	expect := `{"provider":"google","maps_key_id":"` + keyFingerprint("tenant-key") + `"}`
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != expect {
+		t.Fatalf("PUT returned %d: %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/distance", ""); strings.TrimSpace(w.Body.String()) != expect {
+		t.Errorf("GET returned %s", w.Body)
+	}
+	var stored string
+	svc.DB.QueryRow("SELECT maps_api_key FROM tenant_settings WHERE tenant_id = 'acme'").Scan(&stored)
+	if !strings.HasPrefix(stored, sealedFieldPrefix) {
+		t.Errorf("stored key %q is not encrypted", stored)
+	}
+	provider, err := svc.distanceProvider("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if google, ok := provider.(*googleDistance); !ok {
+		t.Errorf("expected Google provider, got %T", provider)
+	} else if secret, _, _ := google.keys.Acquire(); secret != "tenant-key" {
+		t.Errorf("expected tenant's key, got %q", secret)
+	}
+
+	// The key is kept unless given.
+	w = serveAdmin(svc, "PUT", "/admin/tenants/acme/distance", `{"provider": "haversine"}`)
+	if expect := `{"provider":"haversine","maps_key_id":"` + keyFingerprint("tenant-key") + `"}`; w.Code != 200 ||
+		strings.TrimSpace(w.Body.String()) != expect {
+		t.Errorf("PUT without a key returned %d: %s", w.Code, w.Body)
+	}
+	w = serveAdmin(svc, "PUT", "/admin/tenants/acme/distance", `{"provider": null, "maps_api_key": ""}`)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"provider":null}` {
+		t.Errorf("PUT removing the key returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "PUT", "/admin/tenants/acme/distance", "acme", `{"provider": "google"}`); w.Code != 401 {
+		t.Errorf("PUT without admin returned %d", w.Code)
+	}
+}
+
+func TestMapsBaseURL(t *testing.T) {
+	var requested, mode string
+	maps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requested, mode = req.URL.Path, req.URL.Query().Get("mode")
+		fmt.Fprint(w, `{"status": "OK", "rows": [{"elements": [{"status": "OK", "distance": {"value": 2489},
+			"duration": {"value": 420}}]}]}`)
+	}))
+	defer maps.Close()
+
+	keys, err := NewKeyPool([]string{"key"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewOrderService(openTestDB(t), Config{DistanceProvider: providerGoogle, MapsKeys: keys,
+		MapsBaseURL: maps.URL + "/proxy/"}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	route, err := svc.defaultDistance.Route([]string{"1", "2"}, []string{"3", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Distance != 2489 || requested != "/proxy/maps/api/distancematrix/json" || mode != "" {
+		t.Errorf("got %+v from %s mode %q", route, requested, mode)
+	}
+	if _, err := routeMode(svc.defaultDistance, []string{"1", "2"}, []string{"3", "4"}, travelBicycling); err != nil ||
+		mode != travelBicycling {
+		t.Errorf("routeMode() requested mode %q, %v", mode, err)
+	}
+
+	for _, base := range []string{"maps.internal", "ftp://maps.internal", "https://maps.internal/?x=1"} {
+		if _, err := parseMapsBaseURL(base); err == nil {
+			t.Errorf("no error for base URL %q", base)
+		}
+	}
+}
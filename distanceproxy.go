@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// distanceProxyClientKeysEnv names the environment variable holding the keys
+// clients of the distance proxy must send, comma separated. Without it any
+// key is accepted.
+const distanceProxyClientKeysEnv = "ORDERSERVICE_PROXY_CLIENT_KEYS"
+
+// distanceProxyVars are the hits, misses and errors of the distance proxy.
+var distanceProxyVars = expvar.NewMap("distance_proxy")
+
+// DistanceProxyConfig configures "orderservice distance-proxy", which serves
+// the distancematrix API of Google Maps from a cache, so several deployments
+// share one set of keys and quotas. Its clients point -maps-base-url at it.
+type DistanceProxyConfig struct {
+	// How long responses are served from the cache.
+	CacheTTL time.Duration
+	// Responses kept in the cache, the oldest are evicted first.
+	CacheSize int
+	// Requests to Google at once, beyond it requests are refused with 503.
+	// 0 is unlimited.
+	MaxConcurrent int
+	// Keys clients must send as the key parameter, SECRET. Empty accepts
+	// any key.
+	ClientKeys []string
+}
+
+// cachedMatrix is a response in the cache of a distanceProxy.
+type cachedMatrix struct {
+	body    []byte
+	expires time.Time
+}
+
+// distanceProxy is an http.Handler serving GET
+// /maps/api/distancematrix/json with the keys of its own pool. Only
+// successful responses are cached, keyed by origins and destinations.
+type distanceProxy struct {
+	config   DistanceProxyConfig
+	google   *googleDistance
+	upstream limiter
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedMatrix
+	order []string // Keys of cache, oldest first.
+}
+
+func newDistanceProxy(config DistanceProxyConfig, google *googleDistance) *distanceProxy {
+	return &distanceProxy{config: config, google: google, upstream: newLimiter(config.MaxConcurrent), now: time.Now,
+		cache: map[string]cachedMatrix{}}
+}
+
+// authorized returns true if key is one of config.ClientKeys, or there are
+// none.
+func (p *distanceProxy) authorized(key string) bool {
+	if len(p.config.ClientKeys) == 0 {
+		return true
+	}
+	for _, clientKey := range p.config.ClientKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(clientKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// cached returns the response cached for key, nil if there is none.
+func (p *distanceProxy) cached(key string) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, ok := p.cache[key]
+	if !ok || !p.now().Before(entry.expires) {
+		return nil
+	}
+	return entry.body
+}
+
+// store caches body for key, evicting the oldest responses beyond
+// config.CacheSize.
+func (p *distanceProxy) store(key string, body []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.cache[key]; !ok {
+		p.order = append(p.order, key)
+	}
+	p.cache[key] = cachedMatrix{body: body, expires: p.now().Add(p.config.CacheTTL)}
+	for len(p.order) > p.config.CacheSize {
+		delete(p.cache, p.order[0])
+		p.order = p.order[1:]
+	}
+}
+
+// respondMatrix writes a distancematrix response, errors have the status
+// and error_message members clients of Google expect.
+func respondMatrix(w http.ResponseWriter, req *http.Request, code int, body []byte, format string,
+	args ...interface{}) {
+	fmt.Printf("Method:%s; Path:%s, %d %s\n", req.Method, req.URL.Path, code, fmt.Sprintf(format, args...))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func (p *distanceProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	matrixError := func(status, message string) []byte {
+		body, _ := json.Marshal(GoogleMapsResponse{Status: status, ErrorMessage: message})
+		return body
+	}
+	if req.URL.Path != "/maps/api/distancematrix/json" {
+		respondMatrix(w, req, 404, matrixError("NOT_FOUND", "unknown path"), "")
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		respondMatrix(w, req, 405, matrixError("INVALID_REQUEST", "only GET is allowed"), "")
+		return
+	}
+	query := req.URL.Query()
+	if !p.authorized(query.Get("key")) {
+		respondMatrix(w, req, 403, matrixError("REQUEST_DENIED", "invalid key"), "unknown client key")
+		return
+	}
+	origins, destinations := query.Get("origins"), query.Get("destinations")
+	if origins == "" || destinations == "" {
+		respondMatrix(w, req, 400, matrixError("INVALID_REQUEST", "origins and destinations are required"), "")
+		return
+	}
+
+	mode := query.Get("mode")
+	key := origins + "|" + destinations
+	if mode != "" {
+		key += "|" + mode
+	}
+	if body := p.cached(key); body != nil {
+		distanceProxyVars.Add("hits", 1)
+		respondMatrix(w, req, 200, body, "cached %s", key)
+		return
+	}
+	distanceProxyVars.Add("misses", 1)
+	if !p.upstream.tryAcquire() {
+		w.Header().Set("Retry-After", "1")
+		respondMatrix(w, req, 503, matrixError("UNKNOWN_ERROR", "overloaded"), "overloaded")
+		return
+	}
+	response, err := p.google.fetchDistanceMatrix(url.QueryEscape(origins), url.QueryEscape(destinations),
+		url.QueryEscape(mode))
+	p.upstream.release()
+	switch {
+	case err == errNoMapsKeys:
+		// Clients treat it like Google's own quota errors.
+		distanceProxyVars.Add("errors", 1)
+		respondMatrix(w, req, 200, matrixError("OVER_QUERY_LIMIT", "every key is over its quota"), "%s", err)
+		return
+	case err != nil:
+		distanceProxyVars.Add("errors", 1)
+		respondMatrix(w, req, 502, matrixError("UNKNOWN_ERROR", "upstream failed"), "%s", err)
+		return
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		respondMatrix(w, req, 500, matrixError("UNKNOWN_ERROR", "internal error"), "json.Marshal(): %s", err)
+		return
+	}
+	p.store(key, body)
+	respondMatrix(w, req, 200, body, "fetched %s", key)
+}
+
+// distanceProxyMain implements "orderservice distance-proxy", serving the
+// Google Maps distancematrix API from a cache until interrupted.
+func distanceProxyMain(args []string) error {
+	flags := flag.NewFlagSet("distance-proxy", flag.ContinueOnError)
+	port := flags.Int("port", 8081, "Port number to listen on")
+	dbpath := flags.String("dbpath", "", "Count the usage of each key in this database, in memory only if empty")
+	quota := flags.Int64("maps-key-daily-quota", 0, "Requests allowed per Google Maps API key per day, 0 is unlimited")
+	mapsBaseURL := flags.String("maps-base-url", defaultMapsBaseURL, "Base URL of the Google Maps API")
+	cacheTTL := flags.Duration("cache-ttl", 24*time.Hour, "How long responses are served from the cache")
+	cacheSize := flags.Int("cache-size", 100000, "Responses kept in the cache")
+	maxConcurrent := flags.Int("max-concurrent", 0, "Requests to Google at once, 0 is unlimited")
+	httpProxy := flags.String("http-proxy", "", "Call Google through this proxy")
+	httpCAFile := flags.String("http-ca-file", "", "Trust the CAs in this PEM file when calling Google")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	mapsAPIKey := os.Getenv("GOOGLE_MAPS_API_KEY")
+	if mapsAPIKey == "" {
+		return fmt.Errorf("missing environment variable GOOGLE_MAPS_API_KEY")
+	}
+	var db *sql.DB
+	if *dbpath != "" {
+		var err error
+		if db, err = sql.Open("sqlite3", *dbpath); err != nil {
+			return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+		}
+		defer db.Close()
+	}
+	keys, err := NewKeyPool(parseMapsKeys(mapsAPIKey), *quota, db)
+	if err != nil {
+		return fmt.Errorf("failed to create Google Maps key pool: %s", err)
+	}
+	baseURL, err := parseMapsBaseURL(*mapsBaseURL)
+	if err != nil {
+		return err
+	}
+	client, err := newHTTPClient(HTTPClientConfig{ProxyURL: *httpProxy, CAFile: *httpCAFile})
+	if err != nil {
+		return err
+	}
+	proxy := newDistanceProxy(DistanceProxyConfig{CacheTTL: *cacheTTL, CacheSize: *cacheSize,
+		MaxConcurrent: *maxConcurrent, ClientKeys: parseMapsKeys(os.Getenv(distanceProxyClientKeysEnv))},
+		&googleDistance{keys: keys, client: client, baseURL: baseURL})
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", *port), Handler: proxy}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFn()
+		server.Shutdown(ctx)
+	}()
+	fmt.Printf("Distance proxy listening on %s.\n", server.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
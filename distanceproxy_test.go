@@ -0,0 +1,74 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDistanceProxy(t *testing.T) {
+	calls := 0
+	status := "OK"
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if req.URL.Query().Get("key") != "proxy-key" {
+			t.Errorf("proxy called Google with key %q", req.URL.Query().Get("key"))
+		}
+		fmt.Fprintf(w, `{"status": %q, "rows": [{"elements": [{"status": "OK", "distance": {"value": 2489},
+			"duration": {"value": 420}}]}]}`, status)
+	}))
+	defer google.Close()
+
+	proxyKeys, err := NewKeyPool([]string{"proxy-key"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(newDistanceProxy(DistanceProxyConfig{CacheTTL: time.Hour, CacheSize: 1,
+		ClientKeys: []string{"client-key"}}, &googleDistance{keys: proxyKeys, client: google.Client(),
+		baseURL: google.URL}))
+	defer proxy.Close()
+	client := func(key string) *googleDistance {
+		keys, err := NewKeyPool([]string{key}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &googleDistance{keys: keys, client: proxy.Client(), baseURL: proxy.URL}
+	}
+
+	// Repeated routes are served from the cache.
+	origin, destination := []string{"37.8093475", "-122.2740787"}, []string{"37.8061044", "-122.2943356"}
+	for i := 0; i < 2; i++ {
+		route, err := client("client-key").Route(origin, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route != (Route{Distance: 2489, Duration: 420}) {
+			t.Errorf("got %+v", route)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Google called %d times, want 1", calls)
+	}
+	// The cache holds one response, a second route evicts the first.
+	if _, err := client("client-key").Route(destination, origin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client("client-key").Route(origin, destination); err != nil || calls != 3 {
+		t.Errorf("got %v after %d calls, want 3", err, calls)
+	}
+
+	if _, err := client("other-key").Route(origin, destination); err == nil {
+		t.Errorf("unknown client key accepted")
+	}
+
+	// Once the proxy's keys are over quota, so are the clients'.
+	status = "OVER_QUERY_LIMIT"
+	if _, err := client("client-key").Route([]string{"1", "2"}, []string{"3", "4"}); err != errNoMapsKeys {
+		t.Errorf("got %v, want %v", err, errNoMapsKeys)
+	}
+}
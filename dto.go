@@ -0,0 +1,74 @@
+package main
+
+import "time"
+
+// OrderDTO is the wire format of an Order. Order is what orders are stored
+// and projected as; names and fields of the API change here, without touching
+// the database code. appendOrderJSON must encode the same members, which
+// TestAppendOrderJSON checks against json.Marshal.
+type OrderDTO struct {
+	ID            int64       `json:"id"`
+	UID           string      `json:"uid,omitempty"` // Set unless orders use sequential ids only.
+	Distance      float64     `json:"distance"`
+	DistanceText  string      `json:"distance_text,omitempty"` // Only for a single order, e.g. "1.8 km".
+	Status        OrderState  `json:"status"`
+	DuplicateOf   int64       `json:"duplicate_of,omitempty"`    // Possible duplicate of this order.
+	LinkedOrderID int64       `json:"linked_order_id,omitempty"` // Outbound order of a return leg.
+	Duration      int64       `json:"duration,omitempty"`        // Expected travel time in seconds.
+	Price         int64       `json:"price,omitempty"`           // In minor units of Currency.
+	Currency      string      `json:"currency,omitempty"`
+	Surge         float64     `json:"surge,omitempty"` // Multiplier of price, omitted for no surge.
+	PromoCode     string      `json:"promo_code,omitempty"`
+	Discount      int64       `json:"discount,omitempty"`       // Taken off price by promo_code.
+	FinalPrice    *int64      `json:"final_price,omitempty"`    // Price plus adjustments, omitted without any.
+	PaymentStatus string      `json:"payment_status,omitempty"` // PAID or UNPAID, omitted until known.
+	SLABreached   bool        `json:"sla_breached,omitempty"`   // Not taken within its tenant's SLA.
+	Links         []OrderLink `json:"links,omitempty"`          // Only in GET /orders/{id}.
+
+	Notes       string            `json:"notes,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Priority    int64             `json:"priority,omitempty"`
+	ScheduledAt *time.Time        `json:"scheduled_at,omitempty"`
+	Weight      int64             `json:"weight,omitempty"` // Grams.
+	Volume      int64             `json:"volume,omitempty"` // Liters.
+}
+
+// newOrderDTO returns the wire format of order.
+func newOrderDTO(order *Order) *OrderDTO {
+	return &OrderDTO{
+		ID:            order.Id,
+		UID:           order.UID,
+		Distance:      order.Distance,
+		DistanceText:  order.DistanceText,
+		Status:        order.State,
+		DuplicateOf:   order.DuplicateOf,
+		LinkedOrderID: order.LinkedOrderID,
+		Duration:      order.Duration,
+		Price:         order.Price,
+		Currency:      order.Currency,
+		Surge:         order.Surge,
+		PromoCode:     order.PromoCode,
+		Discount:      order.Discount,
+		FinalPrice:    order.FinalPrice,
+		PaymentStatus: order.PaymentStatus,
+		SLABreached:   order.SLABreached,
+		Links:         order.Links,
+		Notes:         order.Notes,
+		Metadata:      order.Metadata,
+		Tags:          order.Tags,
+		Priority:      order.Priority,
+		ScheduledAt:   order.ScheduledAt,
+		Weight:        order.Weight,
+		Volume:        order.Volume,
+	}
+}
+
+// newOrderDTOs returns the wire format of orders.
+func newOrderDTOs(orders []Order) []OrderDTO {
+	dtos := make([]OrderDTO, len(orders))
+	for idx := range orders {
+		dtos[idx] = *newOrderDTO(&orders[idx])
+	}
+	return dtos
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var errDuplicateOrder = fmt.Errorf("duplicate order")
+
+// findDuplicate looks for an UNASSIGNED order of tenant created within the
+// configured window whose origin and destination are both within the
+// configured radius of the new journey. Returns the id of the most recent such
+// order, or 0 if there is none or detection is disabled.
+func (s *OrderService) findDuplicate(tenant string, origin, destination []string) (int64, error) {
+	if s.config.DuplicateWindow <= 0 {
+		return 0, nil
+	}
+	originLat, originLng, err := parseLatLng(origin)
+	if err != nil {
+		return 0, err
+	}
+	destinationLat, destinationLng, err := parseLatLng(destination)
+	if err != nil {
+		return 0, err
+	}
+
+	since := time.Now().Add(-s.config.DuplicateWindow).Unix()
+	rows, err := s.DB.Query(`SELECT id, origin_lat, origin_lng, destination_lat, destination_lng FROM orders
+		WHERE tenant_id = ? AND status = ? AND created_at >= ? ORDER BY id DESC`,
+		tenant, string(StateUnassigned), since)
+	if err != nil {
+		return 0, fmt.Errorf("unable to query recent orders: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var lat1, lng1, lat2, lng2 float64
+		if err := rows.Scan(&id, &lat1, &lng1, &lat2, &lng2); err != nil {
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if haversine(lat1, lng1, originLat, originLng) <= s.config.DuplicateRadius &&
+			haversine(lat2, lng2, destinationLat, destinationLng) <= s.config.DuplicateRadius {
+			return id, nil
+		}
+	}
+	return 0, rows.Err()
+}
@@ -0,0 +1,79 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicateOrdersFlagged(t *testing.T) {
+	svc := newTestService(t, Config{DuplicateWindow: time.Minute, DuplicateRadius: 50})
+	details, err := parseCreateOrderDetails(createOrderDetails, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := svc.Insert("acme", *details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.DuplicateOf != 0 {
+		t.Errorf("first order flagged as duplicate of %d", first.DuplicateOf)
+	}
+
+	// A few meters away from the first order.
+	nearby := *details
+	nearby.Origin = []string{"37.8093480", "-122.2740790"}
+	second, err := svc.Insert("acme", nearby)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.DuplicateOf != first.Id {
+		t.Errorf("expected duplicate of %d, got %d", first.Id, second.DuplicateOf)
+	}
+
+	// Other tenants' orders are never duplicates.
+	other, err := svc.Insert("globex", *details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.DuplicateOf != 0 {
+		t.Errorf("order of another tenant flagged as duplicate of %d", other.DuplicateOf)
+	}
+
+	// Neither are orders that have been taken.
+	if err := svc.Take(other.Id); err != nil {
+		t.Fatal(err)
+	}
+	again, err := svc.Insert("globex", *details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.DuplicateOf != 0 {
+		t.Errorf("order flagged as duplicate of taken order %d", again.DuplicateOf)
+	}
+}
+
+func TestDuplicateOrdersRejected(t *testing.T) {
+	svc := newTestService(t, Config{DuplicateWindow: time.Minute, DuplicateRadius: 50, RejectDuplicates: true})
+	details, err := parseCreateOrderDetails(createOrderDetails, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Insert("", *details); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Insert("", *details); err != errDuplicateOrder {
+		t.Errorf("expected errDuplicateOrder, got %v", err)
+	}
+
+	// Orders outside the window are not duplicates.
+	if _, err := svc.DB.Exec("UPDATE orders SET created_at = created_at - 120"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Insert("", *details); err != nil {
+		t.Errorf("expected order outside window to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// emailWebhookTokenEnv names the environment variable holding the token
+// inbound email webhooks are configured with, ?token=. The webhook is
+// disabled without it.
+const emailWebhookTokenEnv = "ORDERSERVICE_EMAIL_WEBHOOK_TOKEN"
+
+// emailWebhookPath is where the mail provider posts inbound email, as
+// SendGrid's Inbound Parse does.
+const emailWebhookPath = "/webhooks/email"
+
+// maxEmailBytes bounds the inbound emails read.
+const maxEmailBytes = 1 << 20
+
+// emailOrders counts inbound emails by outcome: "created", or the error code
+// they were refused with.
+var emailOrders = expvar.NewMap("email_orders")
+
+// WebhookResult is the body of POST /webhooks/email and
+// /webhooks/stores/{id}. Emails and orders that cannot become orders are
+// acknowledged all the same, the sender retrying would not help.
+type WebhookResult struct {
+	Status  string `json:"status"` // CREATED, REJECTED, or DUPLICATE for redeliveries.
+	OrderID int64  `json:"order_id,omitempty"`
+	Error   string `json:"error,omitempty"` // An error code of POST /orders.
+}
+
+// inboundEmail is what is used of an inbound email.
+type inboundEmail struct {
+	From string // The sender's address, lower case.
+	Text string // The text/plain body.
+}
+
+// parseInboundEmail reads an email posted as SendGrid's Inbound Parse
+// multipart form: "from" and "text", or the whole message in "email" when
+// raw delivery is enabled.
+func parseInboundEmail(req *http.Request) (*inboundEmail, error) {
+	req.Body = http.MaxBytesReader(nil, req.Body, maxEmailBytes)
+	if err := req.ParseMultipartForm(maxEmailBytes); err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+	if err := req.ParseForm(); err != nil {
+		return nil, err
+	}
+	from, text := req.FormValue("from"), req.FormValue("text")
+	if raw := req.FormValue("email"); raw != "" {
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid raw email: %s", err)
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(msg.Body, maxEmailBytes))
+		if err != nil {
+			return nil, fmt.Errorf("invalid raw email: %s", err)
+		}
+		if mediaType := msg.Header.Get("Content-Type"); mediaType != "" &&
+			!strings.HasPrefix(strings.ToLower(mediaType), "text/plain") {
+			return nil, fmt.Errorf("raw emails must be text/plain, got %s", mediaType)
+		}
+		from, text = msg.Header.Get("From"), string(body)
+	}
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %s", from, err)
+	}
+	return &inboundEmail{From: strings.ToLower(address.Address), Text: text}, nil
+}
+
+// parseEmailOrder reads the order in the body of an email, "Key: value"
+// lines with keys Origin, Destination and optionally Promo-Code, case
+// insensitive. Points are "latitude, longitude". Other lines are ignored,
+// e.g. signatures.
+func parseEmailOrder(text string) (*CreateOrderDetails, error) {
+	var details CreateOrderDetails
+	for _, line := range strings.Split(text, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "origin":
+			details.Origin = splitPoint(value)
+		case "destination":
+			details.Destination = splitPoint(value)
+		case "promo-code":
+			details.PromoCode = value
+		}
+	}
+	if err := validateCreateOrderDetails(&details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// splitPoint splits "latitude, longitude" into its coordinates.
+func splitPoint(value string) []string {
+	parts := strings.Split(value, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// emailSenderTenant returns the tenant address may send orders for, "" if
+// none.
+func (s *OrderService) emailSenderTenant(address string) (string, error) {
+	var tenant string
+	err := s.DB.QueryRow("SELECT tenant_id FROM email_senders WHERE address = ?", address).Scan(&tenant)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("unable to look up email sender %q: %s", address, err)
+	}
+	return tenant, nil
+}
+
+// handleEmailWebhook serves POST /webhooks/email?token=, creating an order
+// from an email of a registered sender.
+func (s *OrderService) handleEmailWebhook(w http.ResponseWriter, req *http.Request) {
+	if s.config.EmailWebhookToken == "" {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "no %s", emailWebhookTokenEnv)
+		return
+	}
+	if !hmac.Equal([]byte(req.URL.Query().Get("token")), []byte(s.config.EmailWebhookToken)) {
+		respond(w, req, 401, HTTPResponseError{Error: "INVALID_TOKEN"}, "invalid email webhook token")
+		return
+	}
+	reject := func(code, format string, args ...interface{}) {
+		emailOrders.Add(code, 1)
+		respond(w, req, 200, WebhookResult{Status: "REJECTED", Error: code}, format, args...)
+	}
+	email, err := parseInboundEmail(req)
+	if err != nil {
+		reject("MALFORMED_EMAIL", "%s", err)
+		return
+	}
+	tenant, err := s.emailSenderTenant(email.From)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "%s", err)
+		return
+	}
+	if tenant == "" {
+		reject("UNKNOWN_SENDER", "email from unknown sender %q", email.From)
+		return
+	}
+	details, err := parseEmailOrder(email.Text)
+	if err != nil {
+		reject(err.Error(), "email from %q: %s", email.From, err)
+		return
+	}
+	order, err := s.Insert(tenant, *details)
+	switch err.(type) {
+	case nil:
+		emailOrders.Add("created", 1)
+		respond(w, req, 200, WebhookResult{Status: "CREATED", OrderID: order.Id}, "email from %q created order %d",
+			email.From, order.Id)
+	case errInvalidPromoCode:
+		reject("INVALID_PROMO_CODE", "email from %q: %s", email.From, err)
+	case errOutOfServiceArea:
+		reject("OUT_OF_SERVICE_AREA", "email from %q: %s", email.From, err)
+	case errQuotaExceeded:
+		reject("QUOTA_EXCEEDED", "email from %q: %s", email.From, err)
+	default:
+		if err == errDuplicateOrder {
+			reject("DUPLICATE_ORDER", "email from %q: %s", email.From, err)
+			return
+		}
+		// The provider retries, which may succeed once the distance
+		// provider is back.
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Insert(): %s", err)
+	}
+}
+
+// EmailSender is an address allowed to send orders for a tenant, an item of
+// GET /admin/tenants/{tenant}/email-senders.
+type EmailSender struct {
+	Address string `json:"address"`
+}
+
+// EmailSenders returns the senders of tenant by address.
+func (s *OrderService) EmailSenders(tenant string) ([]EmailSender, error) {
+	rows, err := s.DB.Query("SELECT address FROM email_senders WHERE tenant_id = ? ORDER BY address", tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query email senders of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	senders := []EmailSender{}
+	for rows.Next() {
+		var sender EmailSender
+		if err := rows.Scan(&sender.Address); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		senders = append(senders, sender)
+	}
+	return senders, rows.Err()
+}
+
+// SetEmailSender lets address send orders for tenant, and no other tenant.
+func (s *OrderService) SetEmailSender(tenant, address string) error {
+	_, err := s.DB.Exec(`INSERT INTO email_senders (address, tenant_id) VALUES (?, ?)
+		ON CONFLICT (address) DO UPDATE SET tenant_id = excluded.tenant_id`, strings.ToLower(address), tenant)
+	if err != nil {
+		return fmt.Errorf("unable to set email sender %q of tenant %q: %s", address, tenant, err)
+	}
+	return nil
+}
+
+// DeleteEmailSender removes a sender of tenant, returning false if it has no
+// such sender.
+func (s *OrderService) DeleteEmailSender(tenant, address string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM email_senders WHERE address = ? AND tenant_id = ?",
+		strings.ToLower(address), tenant)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete email sender %q of tenant %q: %s", address, tenant, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// handleTenantEmailSenders serves /admin/tenants/{tenant}/email-senders, the
+// addresses whose emails become orders of tenant, and PUT and DELETE
+// /admin/tenants/{tenant}/email-senders/{address}.
+func (s *OrderService) handleTenantEmailSenders(w http.ResponseWriter, req *http.Request, tenant, address string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if address != "" {
+		if parsed, err := mail.ParseAddress(address); err != nil || parsed.Address != address {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: "invalid email address"},
+				"email sender %q", address)
+			return
+		}
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			if err := s.SetEmailSender(tenant, address); err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetEmailSender(): %s", err)
+				return
+			}
+		case http.MethodDelete:
+			deleted, err := s.DeleteEmailSender(tenant, address)
+			if err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DeleteEmailSender(): %s", err)
+				return
+			}
+			if !deleted {
+				respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_SENDER"}, "tenant %q sender %q", tenant,
+					address)
+				return
+			}
+		}
+	}
+	senders, err := s.EmailSenders(tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "EmailSenders(): %s", err)
+		return
+	}
+	respond(w, req, 200, senders, "tenant %q %d email senders", tenant, len(senders))
+}
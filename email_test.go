@@ -0,0 +1,93 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postEmail delivers an inbound email as a form with fields.
+func postEmail(svc *OrderService, token string, fields url.Values) (*httptest.ResponseRecorder, WebhookResult) {
+	req := httptest.NewRequest("POST", emailWebhookPath+"?token="+token, strings.NewReader(fields.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	var result WebhookResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w, result
+}
+
+func TestParseEmailOrder(t *testing.T) {
+	details, err := parseEmailOrder("Hello,\r\n\r\norigin: 37.8093475, -122.2740787\r\n" +
+		"DESTINATION:37.8061044,-122.2943356\r\nPromo-Code: SPRING\r\n\r\n-- \r\nAcme Ltd: est. 1999\r\n")
+	if err != nil || details.Origin[1] != "-122.2740787" || details.Destination[0] != "37.8061044" ||
+		details.PromoCode != "SPRING" {
+		t.Errorf("unexpected details %+v, %v", details, err)
+	}
+	if _, err := parseEmailOrder("Origin: 37.8, -122.27\n"); err == nil || err.Error() != "MALFORMED_DESTINATION" {
+		t.Errorf("expected MALFORMED_DESTINATION, got %v", err)
+	}
+}
+
+func TestEmailWebhook(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", EmailWebhookToken: "mailtoken"})
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/email-senders/orders@partner.example", ""); w.Code != 200 {
+		t.Fatalf("PUT email sender returned %d: %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/email-senders/not-an-address", ""); w.Code != 400 {
+		t.Errorf("PUT invalid email sender returned %d", w.Code)
+	}
+	text := "Origin: 37.8093475, -122.2740787\nDestination: 37.8061044, -122.2943356\n"
+
+	if w, _ := postEmail(svc, "wrong", url.Values{"from": {"orders@partner.example"}, "text": {text}}); w.Code != 401 {
+		t.Errorf("wrong token returned %d", w.Code)
+	}
+	w, result := postEmail(svc, "mailtoken", url.Values{"from": {"Orders <Orders@Partner.example>"}, "text": {text}})
+	if w.Code != 200 || result.Status != "CREATED" || result.OrderID != 1 {
+		t.Fatalf("unexpected result %d %+v", w.Code, result)
+	}
+	if order, err := svc.Get(1); err != nil || order.State != StateUnassigned {
+		t.Errorf("unexpected order %+v, %v", order, err)
+	}
+	if w := serve(svc, "GET", "/orders/1", "acme", ""); w.Code != 200 {
+		t.Errorf("expected the order to belong to the sender's tenant, got %d", w.Code)
+	}
+
+	raw := "From: orders@partner.example\r\nSubject: order\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + text
+	if _, result := postEmail(svc, "mailtoken", url.Values{"email": {raw}}); result.Status != "CREATED" {
+		t.Errorf("unexpected result of a raw email %+v", result)
+	}
+
+	for name, fields := range map[string]url.Values{
+		"UNKNOWN_SENDER":        {"from": {"someone@elsewhere.example"}, "text": {text}},
+		"MALFORMED_ORIGIN":      {"from": {"orders@partner.example"}, "text": {"Please send a courier"}},
+		"MALFORMED_EMAIL":       {"from": {"nobody"}, "text": {text}},
+		"MALFORMED_DESTINATION": {"from": {"orders@partner.example"}, "text": {"Origin: 37.8, -122.27"}},
+	} {
+		w, result := postEmail(svc, "mailtoken", fields)
+		if w.Code != 200 || result.Status != "REJECTED" || result.Error != name {
+			t.Errorf("%s: unexpected result %d %+v", name, w.Code, result)
+		}
+	}
+	if got := emailOrders.Get("UNKNOWN_SENDER"); got == nil {
+		t.Error("expected rejections to be counted")
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/email-senders", "")
+	if body := strings.TrimSpace(w.Body.String()); body != `[{"address":"orders@partner.example"}]` {
+		t.Errorf("unexpected senders %s", body)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/other/email-senders/orders@partner.example", ""); w.Code != 404 {
+		t.Errorf("deleting the sender of another tenant returned %d", w.Code)
+	}
+
+	disabled := newTestService(t, Config{})
+	if w, _ := postEmail(disabled, "", url.Values{"text": {text}}); w.Code != 404 {
+		t.Errorf("expected the webhook to be disabled without a token, got %d", w.Code)
+	}
+}
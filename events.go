@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// EventType names a change to an order.
+type EventType string
+
+// Order events. Every mutation of an order is recorded as one of these.
+const (
+	EventCreated  EventType = "created"
+	EventTaken    EventType = "taken"
+	EventRequoted EventType = "requoted"
+	// An order created before uids were enabled is given one.
+	EventIdentified EventType = "identified"
+	// The OrderFields of an order are changed, data is the new fields.
+	EventUpdated EventType = "updated"
+	// The order was not taken within its tenant's SLA, data is the
+	// slaBreach.
+	EventSLABreached EventType = "sla_breached"
+	// The price charged for the order was changed, data is the
+	// orderAdjusted.
+	EventAdjusted EventType = "adjusted"
+	// The payment provider said the order was paid for or not, data is the
+	// orderPayment.
+	EventPayment EventType = "payment"
+)
+
+// Event is an entry in the append-only events table. The orders table is a
+// projection of the events, see project.
+type Event struct {
+	ID      int64           `json:"id"`
+	OrderID int64           `json:"order_id"`
+	Type    EventType       `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// orderCreated is the data of an EventCreated.
+type orderCreated struct {
+	UID            string  `json:"uid,omitempty"`
+	TenantID       string  `json:"tenant_id,omitempty"`
+	OriginLat      float64 `json:"origin_lat"`
+	OriginLng      float64 `json:"origin_lng"`
+	DestinationLat float64 `json:"destination_lat"`
+	DestinationLng float64 `json:"destination_lng"`
+	DuplicateOf    int64   `json:"duplicate_of,omitempty"`
+	LinkedOrderID  int64   `json:"linked_order_id,omitempty"`
+	PricedRoute
+}
+
+// orderTaken is the data of an EventTaken sent with the courier's id.
+type orderTaken struct {
+	Courier string `json:"courier"`
+	Vehicle string `json:"vehicle,omitempty"`
+	// Expected travel time in seconds by the courier's vehicle, replaces the
+	// duration of the order if set.
+	Duration int64 `json:"duration,omitempty"`
+}
+
+// orderIdentified is the data of an EventIdentified.
+type orderIdentified struct {
+	UID string `json:"uid"`
+}
+
+// newEvent returns an event with data encoded as JSON. data may be nil.
+func newEvent(orderID int64, eventType EventType, data interface{}) (*Event, error) {
+	event := &Event{OrderID: orderID, Type: eventType, Time: time.Now()}
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode %s event: %s", eventType, err)
+		}
+		event.Data = encoded
+	}
+	return event, nil
+}
+
+// record applies event to the orders table and appends it to the events
+// table. An EventCreated with no OrderID is assigned the id of the new order.
+// key is the Config.FieldKey the sensitive columns are encrypted with.
+func record(tx *sql.Tx, key []byte, event *Event) error {
+	if err := project(tx, key, event); err != nil {
+		return err
+	}
+	// The data of updated events holds notes and metadata.
+	data := string(event.Data)
+	if event.Type == EventUpdated {
+		var err error
+		if data, err = sealField(key, data); err != nil {
+			return fmt.Errorf("unable to encrypt %s event: %s", event.Type, err)
+		}
+	}
+	result, err := tx.Exec("INSERT INTO events (order_id, type, data, created_at) VALUES (?, ?, ?, ?)",
+		event.OrderID, string(event.Type), data, event.Time.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to append %s event: %s", event.Type, err)
+	}
+	event.ID, err = result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("unable to append %s event, no row: %s", event.Type, err)
+	}
+	return nil
+}
+
+// project applies a single event to the orders table, encrypting the
+// sensitive columns with key.
+func project(tx *sql.Tx, key []byte, event *Event) error {
+	switch event.Type {
+	case EventCreated:
+		var created orderCreated
+		if err := json.Unmarshal(event.Data, &created); err != nil {
+			return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+		}
+		result, err := tx.Exec(`INSERT INTO orders (id, uid, distance, status, tenant_id, origin_lat, origin_lng,
+			destination_lat, destination_lng, created_at, duplicate_of, linked_order_id, duration, price, currency,
+			surge, promo_code, discount) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			sql.NullInt64{Int64: event.OrderID, Valid: event.OrderID != 0},
+			sql.NullString{String: created.UID, Valid: created.UID != ""}, created.Distance,
+			string(StateUnassigned), created.TenantID, created.OriginLat, created.OriginLng, created.DestinationLat,
+			created.DestinationLng, event.Time.Unix(),
+			sql.NullInt64{Int64: created.DuplicateOf, Valid: created.DuplicateOf != 0},
+			sql.NullInt64{Int64: created.LinkedOrderID, Valid: created.LinkedOrderID != 0}, created.Duration,
+			created.Price, created.Currency, sql.NullFloat64{Float64: created.Surge, Valid: created.Surge != 0},
+			sql.NullString{String: created.PromoCode, Valid: created.PromoCode != ""},
+			sql.NullInt64{Int64: created.Discount, Valid: created.Discount != 0})
+		if err != nil {
+			return fmt.Errorf("unable to insert: %s", err)
+		}
+		if event.OrderID == 0 {
+			event.OrderID, err = result.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("unable to insert, no row: %s", err)
+			}
+		}
+		return nil
+	case EventTaken:
+		var taken orderTaken
+		if len(event.Data) > 0 {
+			if err := json.Unmarshal(event.Data, &taken); err != nil {
+				return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+			}
+		}
+		_, err := tx.Exec("UPDATE orders SET status = ?, duration = COALESCE(?, duration) WHERE id = ?",
+			string(StateTaken), sql.NullInt64{Int64: taken.Duration, Valid: taken.Duration != 0}, event.OrderID)
+		return err
+	case EventRequoted:
+		var route PricedRoute
+		if err := json.Unmarshal(event.Data, &route); err != nil {
+			return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+		}
+		_, err := tx.Exec(`UPDATE orders SET distance = ?, duration = ?, price = ?, currency = ?, surge = ?,
+			promo_code = ?, discount = ? WHERE id = ?`, route.Distance, route.Duration, route.Price, route.Currency,
+			sql.NullFloat64{Float64: route.Surge, Valid: route.Surge != 0},
+			sql.NullString{String: route.PromoCode, Valid: route.PromoCode != ""},
+			sql.NullInt64{Int64: route.Discount, Valid: route.Discount != 0}, event.OrderID)
+		return err
+	case EventIdentified:
+		var identified orderIdentified
+		if err := json.Unmarshal(event.Data, &identified); err != nil {
+			return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+		}
+		_, err := tx.Exec("UPDATE orders SET uid = ? WHERE id = ?", identified.UID, event.OrderID)
+		return err
+	case EventUpdated:
+		var fields OrderFields
+		if err := json.Unmarshal(event.Data, &fields); err != nil {
+			return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+		}
+		values, err := fields.fieldValues(key)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE orders SET notes = ?, metadata = ?, tags = ?, priority = ?, scheduled_at = ?, "+
+			"weight = ?, volume = ? WHERE id = ?", append(values, event.OrderID)...)
+		return err
+	case EventSLABreached:
+		_, err := tx.Exec("UPDATE orders SET sla_breached_at = ? WHERE id = ?", event.Time.Unix(), event.OrderID)
+		return err
+	case EventAdjusted:
+		var adjusted orderAdjusted
+		if err := json.Unmarshal(event.Data, &adjusted); err != nil {
+			return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+		}
+		_, err := tx.Exec("UPDATE orders SET price_adjustments = COALESCE(price_adjustments, 0) + ? WHERE id = ?",
+			adjusted.Amount, event.OrderID)
+		return err
+	case EventPayment:
+		var payment orderPayment
+		if err := json.Unmarshal(event.Data, &payment); err != nil {
+			return fmt.Errorf("invalid %s event for order %d: %s", event.Type, event.OrderID, err)
+		}
+		_, err := tx.Exec("UPDATE orders SET payment_status = ? WHERE id = ?", payment.Status, event.OrderID)
+		return err
+	default:
+		return fmt.Errorf("unknown event type %q for order %d", event.Type, event.OrderID)
+	}
+}
+
+// History returns the events of an order, oldest first. Returns
+// errNoSuchOrder if the order has no events.
+func (s *OrderService) History(orderID int64) (_ []Event, err error) {
+	defer observeStore("History", time.Now(), &err)
+	query, args, err := selectFrom("id, order_id, type, data, created_at", "events").where("order_id = ?", orderID).
+		order("id").build()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query events: %s", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		event, err := scanEvent(s.config.FieldKey, rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query events: %s", err)
+	}
+	if len(events) == 0 {
+		return nil, errNoSuchOrder
+	}
+	return events, nil
+}
+
+// scanEvent reads an event selected as id, order_id, type, data, created_at,
+// decrypting its data with key.
+func scanEvent(key []byte, row interface{ Scan(...interface{}) error }) (*Event, error) {
+	var (
+		event     Event
+		eventType string
+		data      sql.NullString
+		createdAt int64
+	)
+	if err := row.Scan(&event.ID, &event.OrderID, &eventType, &data, &createdAt); err != nil {
+		return nil, fmt.Errorf("row.Scan() failed: %s", err)
+	}
+	event.Type = EventType(eventType)
+	if data.String != "" {
+		plaintext, err := openField(key, []byte(data.String))
+		if err != nil {
+			return nil, fmt.Errorf("invalid event %d: %s", event.ID, err)
+		}
+		event.Data = json.RawMessage(plaintext)
+	}
+	event.Time = time.Unix(createdAt, 0).UTC()
+	return &event, nil
+}
+
+// handleHistory serves GET /orders/{id}/history.
+func (s *OrderService) handleHistory(w http.ResponseWriter, req *http.Request, orderID int64) {
+	events, err := s.History(orderID)
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case nil:
+		respond(w, req, 200, events, "order %d history, %d events", orderID, len(events))
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "History() %d failed: %s", orderID, err)
+	}
+}
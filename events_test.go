@@ -0,0 +1,88 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Fatalf("PATCH /orders/1 returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "POST", "/orders/1/requote", ""); w.Code != 200 {
+		t.Fatalf("POST /orders/1/requote returned %d", w.Code)
+	}
+
+	w := serve(svc, "GET", "/orders/1/history", "", "")
+	if w.Code != 200 {
+		t.Fatalf("GET /orders/1/history returned %d: %s", w.Code, w.Body)
+	}
+	var events []Event
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	var types []EventType
+	for _, event := range events {
+		if event.OrderID != 1 {
+			t.Errorf("event %d belongs to order %d", event.ID, event.OrderID)
+		}
+		types = append(types, event.Type)
+	}
+	if len(types) != 3 || types[0] != EventCreated || types[1] != EventTaken || types[2] != EventRequoted {
+		t.Errorf("unexpected events %v", types)
+	}
+
+	if w := serve(svc, "GET", "/orders/2/history", "", ""); w.Code != 404 {
+		t.Errorf("expected 404 for missing order, got %d", w.Code)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if err := svc.Take(1); err != nil {
+		t.Fatal(err)
+	}
+	want, err := svc.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilding the orders table from the events gives the same order.
+	events, err := svc.History(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM orders"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range events {
+		if err := project(tx, svc.config.FieldKey, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := svc.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("projection gave %+v, want %+v", got, want)
+	}
+}
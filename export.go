@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// exportRowGroup is the number of rows of each Parquet row group exported.
+const exportRowGroup = 100000
+
+// exportTables are the tables "orderservice export" exports.
+var exportTables = map[string]bool{"orders": true, "orders_archive": true}
+
+// exportColumns returns the columns of table, typed by their declared type:
+// INTEGER as int64, REAL as double, anything else as UTF-8 text.
+func exportColumns(db *sql.DB, table string) ([]parquetColumn, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []parquetColumn
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		column := parquetColumn{name: name, typ: parquetByteArray, utf8: true}
+		switch strings.ToUpper(typ) {
+		case "INTEGER":
+			column = parquetColumn{name: name, typ: parquetInt64}
+		case "REAL":
+			column = parquetColumn{name: name, typ: parquetDouble}
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no such table %s", table)
+	}
+	return columns, nil
+}
+
+// exportValue converts a value scanned from SQLite to the type of column.
+func exportValue(column parquetColumn, value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+	switch v := value.(type) {
+	case int64:
+		switch column.typ {
+		case parquetDouble:
+			return float64(v)
+		case parquetByteArray:
+			return strconv.FormatInt(v, 10)
+		}
+	case float64:
+		switch column.typ {
+		case parquetInt64:
+			return int64(v)
+		case parquetByteArray:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	case string:
+		switch column.typ {
+		case parquetInt64:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil
+			}
+			return n
+		case parquetDouble:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil
+			}
+			return f
+		}
+	}
+	return value
+}
+
+// exportTable writes the rows of table to w in order of id, as Parquet or
+// CSV with a header, returning the number of rows written.
+func exportTable(db *sql.DB, key []byte, table, format string, w io.Writer) (int, error) {
+	if !exportTables[table] {
+		return 0, fmt.Errorf("cannot export table %s", table)
+	}
+	columns, err := exportColumns(db, table)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, len(columns))
+	sealed := map[int]bool{}
+	for i, column := range columns {
+		names[i] = column.name
+		for _, c := range sealedColumns {
+			if c.table == table && c.column == column.name {
+				sealed[i] = true
+			}
+		}
+	}
+
+	var (
+		parquet *parquetWriter
+		out     *csv.Writer
+		group   [][]interface{}
+	)
+	switch format {
+	case "parquet":
+		if parquet, err = newParquetWriter(w, columns); err != nil {
+			return 0, err
+		}
+	case "csv":
+		out = csv.NewWriter(w)
+		out.Write(names)
+	default:
+		return 0, fmt.Errorf("unknown format %s, want parquet or csv", format)
+	}
+
+	query, args, err := selectFrom(strings.Join(names, ", "), table).order("id").build()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return n, err
+		}
+		for i, column := range columns {
+			if s, ok := values[i].(string); ok && sealed[i] {
+				values[i] = []byte(s)
+			}
+			if b, ok := values[i].([]byte); ok && sealed[i] {
+				if values[i], err = openField(key, b); err != nil {
+					return n, fmt.Errorf("column %s: %s", column.name, err)
+				}
+			}
+			values[i] = exportValue(column, values[i])
+		}
+		n++
+		if out != nil {
+			record := make([]string, len(values))
+			for i, value := range values {
+				if value != nil {
+					record[i] = fmt.Sprint(value)
+				}
+			}
+			out.Write(record)
+			continue
+		}
+		if group = append(group, values); len(group) == exportRowGroup {
+			if err := parquet.WriteRowGroup(group); err != nil {
+				return n, err
+			}
+			group = group[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if out != nil {
+		out.Flush()
+		return n, out.Error()
+	}
+	if err := parquet.WriteRowGroup(group); err != nil {
+		return n, err
+	}
+	return n, parquet.Close()
+}
+
+// exportMain implements "orderservice export", writing the archived orders,
+// or the orders of another table, to a file.
+func exportMain(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbpath := flags.String("dbpath", "", "Path to database")
+	table := flags.String("table", "orders_archive", "orders_archive or orders")
+	format := flags.String("format", "parquet", "parquet or csv")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *dbpath == "" {
+		return fmt.Errorf("missing db name")
+	}
+	key, err := loadFieldKey(context.Background(), http.DefaultClient, "")
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: orderservice export -dbpath orders.db [-table TABLE] [-format FORMAT] FILE")
+	}
+	path := flags.Arg(0)
+
+	db, err := sql.Open("sqlite3", *dbpath)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+	}
+	defer db.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create export file: %s", err)
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+	n, err := exportTable(db, key, *table, *format, buffered)
+	if err != nil {
+		return fmt.Errorf("export of %s failed: %s", *table, err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("export of %s failed: %s", *table, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("export of %s failed: %s", *table, err)
+	}
+	fmt.Printf("Exported %d rows of %s to %s.\n", n, *table, path)
+	return nil
+}
@@ -0,0 +1,67 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestExportTable(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for i := 0; i < 3; i++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	for _, id := range []int64{1, 3} {
+		if err := svc.Take(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := newArchiver(ArchiveConfig{After: time.Hour}, svc.DB)
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if n, err := a.archive(context.Background()); err != nil || n != 2 {
+		t.Fatalf("archived %d orders, %v", n, err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := exportTable(svc.DB, svc.config.FieldKey, "orders_archive", "parquet", &buf); err != nil || n != 2 {
+		t.Fatalf("exported %d rows, %v", n, err)
+	}
+	names, rows := readParquet(t, buf.Bytes())
+	column := map[string]int{}
+	for i, name := range names {
+		column[name] = i
+	}
+	if len(rows) != 2 || rows[1][column["id"]] != int64(3) || rows[0][column["tenant_id"]] != "acme" ||
+		rows[0][column["status"]] != string(StateTaken) || rows[0][column["uid"]] != nil {
+		t.Fatalf("unexpected rows %v of columns %v", rows, names)
+	}
+	if _, ok := rows[0][column["distance"]].(float64); !ok {
+		t.Errorf("unexpected distance %v", rows[0][column["distance"]])
+	}
+	if _, ok := rows[0][column["archived_at"]].(int64); !ok {
+		t.Errorf("unexpected archived_at %v", rows[0][column["archived_at"]])
+	}
+
+	buf.Reset()
+	if n, err := exportTable(svc.DB, svc.config.FieldKey, "orders", "csv", &buf); err != nil || n != 1 {
+		t.Fatalf("exported %d rows, %v", n, err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 2 || records[0][0] != "id" || records[1][0] != "2" {
+		t.Errorf("unexpected CSV %v, %v", records, err)
+	}
+
+	if _, err := exportTable(svc.DB, svc.config.FieldKey, "api_keys", "parquet", &buf); err == nil {
+		t.Error("expected other tables to be refused")
+	}
+	if _, err := exportTable(svc.DB, svc.config.FieldKey, "orders", "xlsx", &buf); err == nil {
+		t.Error("expected an unknown format to fail")
+	}
+}
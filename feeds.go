@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// googleSheetRE matches the path of a Google Sheet, capturing its id.
+var googleSheetRE = regexp.MustCompile(`^/spreadsheets/d/([^/]+)`)
+
+// feedRetried are the import errors of rows tried again at the next poll,
+// the others are recorded and the row is not imported again.
+var feedRetried = map[string]bool{"DISTANCE_UNAVAILABLE": true, "INTERNAL_FAILURE": true,
+	"QUOTA_EXCEEDED": true, "ANOMALY_THROTTLED": true}
+
+// Feed is the body of GET and PUT /admin/tenants/{tenant}/feed: a CSV file
+// polled for new orders, as imported by POST /orders/import with an extra
+// external_id column.
+type Feed struct {
+	URL      string     `json:"url"` // Of the CSV file or Google Sheet.
+	PolledAt *time.Time `json:"polled_at,omitempty"`
+	Error    string     `json:"error,omitempty"` // Why the last poll failed.
+	Created  int        `json:"created"`         // Orders created from rows.
+	Failed   int        `json:"failed"`          // Rows that will not be imported.
+}
+
+// FeedRow is an imported row of a feed, an item of GET
+// /admin/tenants/{tenant}/feed/rows.
+type FeedRow struct {
+	ExternalID string    `json:"external_id"`
+	OrderID    int64     `json:"order_id,omitempty"`
+	Error      string    `json:"error,omitempty"` // An error code of POST /orders.
+	ImportedAt time.Time `json:"imported_at"`
+}
+
+var errNoSuchFeed = fmt.Errorf("no such feed")
+
+// feedCSVURL returns the URL the CSV of a feed is downloaded from: that of
+// the CSV export of Google Sheets, which must be shared by link, or raw
+// itself.
+func feedCSVURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("feed URL must be an http or https URL")
+	}
+	match := googleSheetRE.FindStringSubmatch(u.Path)
+	if u.Host != "docs.google.com" || match == nil {
+		return raw, nil
+	}
+	gid := u.Query().Get("gid")
+	if fragment, err := url.ParseQuery(u.Fragment); err == nil && fragment.Get("gid") != "" {
+		gid = fragment.Get("gid")
+	}
+	export := url.Values{"format": {"csv"}}
+	if gid != "" {
+		export.Set("gid", gid)
+	}
+	return fmt.Sprintf("https://docs.google.com/spreadsheets/d/%s/export?%s", match[1], export.Encode()), nil
+}
+
+// feedPoller periodically creates the orders of the new rows of every feed.
+type feedPoller struct {
+	interval time.Duration
+	svc      *OrderService
+}
+
+func newFeedPoller(interval time.Duration, svc *OrderService) *feedPoller {
+	return &feedPoller{interval: interval, svc: svc}
+}
+
+// run polls every interval until ctx is done.
+func (p *feedPoller) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.poll(ctx); err != nil {
+				fmt.Printf("Feed poller: %s\n", err)
+			}
+		}
+	}
+}
+
+// poll polls every feed once, recording when and how each went. Returns
+// the number of orders created.
+func (p *feedPoller) poll(ctx context.Context) (int, error) {
+	rows, err := p.svc.DB.QueryContext(ctx, "SELECT tenant_id, url FROM feeds ORDER BY tenant_id")
+	if err != nil {
+		return 0, fmt.Errorf("unable to query feeds: %s", err)
+	}
+	feeds := map[string]string{}
+	for rows.Next() {
+		var tenant, feedURL string
+		if err := rows.Scan(&tenant, &feedURL); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		feeds[tenant] = feedURL
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to query feeds: %s", err)
+	}
+
+	total := 0
+	for tenant, feedURL := range feeds {
+		created, err := p.svc.pollFeed(ctx, tenant, feedURL)
+		total += created
+		var pollError sql.NullString
+		if err != nil {
+			fmt.Printf("Feed poller: tenant %q: %s\n", tenant, err)
+			pollError = sql.NullString{String: err.Error(), Valid: true}
+		}
+		_, err = p.svc.DB.ExecContext(ctx, "UPDATE feeds SET polled_at = ?, error = ? WHERE tenant_id = ?",
+			time.Now().Unix(), pollError, tenant)
+		if err != nil {
+			return total, fmt.Errorf("unable to update feed of tenant %q: %s", tenant, err)
+		}
+	}
+	return total, nil
+}
+
+// pollFeed downloads the feed of tenant and creates the orders of the rows
+// whose external_id was not imported yet, as POST /orders would. Rows that
+// are not valid orders yet are skipped until they are, e.g. while being
+// typed. Returns the number of orders created.
+func (s *OrderService) pollFeed(ctx context.Context, tenant, feedURL string) (int, error) {
+	csvURL, err := feedCSVURL(feedURL)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, csvURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("invalid feed URL: %s", err)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("unable to download feed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unable to download feed: HTTP %d", resp.StatusCode)
+	}
+	rows, err := parseImportCSV(io.LimitReader(resp.Body, importMaxBytes), true)
+	if err != nil {
+		return 0, err
+	}
+
+	imported, err := s.feedExternalIDs(tenant)
+	if err != nil {
+		return 0, err
+	}
+	created, invalid := 0, 0
+	for _, row := range rows {
+		if row.externalID == "" || imported[row.externalID] {
+			continue
+		}
+		if row.err != nil {
+			invalid++
+			continue
+		}
+		imported[row.externalID] = true
+		result := FeedRow{ExternalID: row.externalID}
+		if order, err := s.Insert(tenant, *row.details); err != nil {
+			result.Error = importError(err)
+			if feedRetried[result.Error] {
+				fmt.Printf("Feed of tenant %q: row %q: %s\n", tenant, row.externalID, err)
+				continue
+			}
+		} else {
+			result.OrderID = order.Id
+			created++
+		}
+		if err := s.saveFeedRow(tenant, result); err != nil {
+			return created, err
+		}
+	}
+	if created > 0 || invalid > 0 {
+		fmt.Printf("Feed of tenant %q: created %d orders, %d rows invalid\n", tenant, created, invalid)
+	}
+	return created, nil
+}
+
+// feedExternalIDs returns the external ids of the rows of tenant's feed
+// imported so far.
+func (s *OrderService) feedExternalIDs(tenant string) (map[string]bool, error) {
+	rows, err := s.DB.Query("SELECT external_id FROM feed_rows WHERE tenant_id = ?", tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query feed rows of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	ids := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// saveFeedRow records an imported row of tenant's feed.
+func (s *OrderService) saveFeedRow(tenant string, row FeedRow) error {
+	var (
+		orderID   sql.NullInt64
+		importErr sql.NullString
+	)
+	if row.OrderID != 0 {
+		orderID = sql.NullInt64{Int64: row.OrderID, Valid: true}
+	}
+	if row.Error != "" {
+		importErr = sql.NullString{String: row.Error, Valid: true}
+	}
+	_, err := s.DB.Exec(`INSERT INTO feed_rows (tenant_id, external_id, order_id, error, imported_at)
+		VALUES (?, ?, ?, ?, ?)`, tenant, row.ExternalID, orderID, importErr, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("unable to record feed row %q of tenant %q: %s", row.ExternalID, tenant, err)
+	}
+	return nil
+}
+
+// GetFeed returns the feed of tenant, or errNoSuchFeed.
+func (s *OrderService) GetFeed(tenant string) (*Feed, error) {
+	var (
+		feed      Feed
+		polledAt  sql.NullInt64
+		pollError sql.NullString
+	)
+	err := s.DB.QueryRow(`SELECT url, polled_at, error,
+			(SELECT COUNT(*) FROM feed_rows r WHERE r.tenant_id = f.tenant_id AND r.order_id IS NOT NULL),
+			(SELECT COUNT(*) FROM feed_rows r WHERE r.tenant_id = f.tenant_id AND r.order_id IS NULL)
+		FROM feeds f WHERE tenant_id = ?`, tenant).Scan(&feed.URL, &polledAt, &pollError, &feed.Created,
+		&feed.Failed)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchFeed
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load feed of tenant %q: %s", tenant, err)
+	}
+	if polledAt.Valid {
+		t := time.Unix(polledAt.Int64, 0).UTC()
+		feed.PolledAt = &t
+	}
+	feed.Error = pollError.String
+	return &feed, nil
+}
+
+// SetFeed sets the URL of tenant's feed. Rows already imported from a
+// previous URL are not imported again.
+func (s *OrderService) SetFeed(tenant, feedURL string) error {
+	_, err := s.DB.Exec(`INSERT INTO feeds (tenant_id, url) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET url = excluded.url, polled_at = NULL, error = NULL`, tenant, feedURL)
+	if err != nil {
+		return fmt.Errorf("unable to set feed of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// DeleteFeed stops polling the feed of tenant, returning false if it has
+// none. The rows imported are kept.
+func (s *OrderService) DeleteFeed(tenant string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM feeds WHERE tenant_id = ?", tenant)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete feed of tenant %q: %s", tenant, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// FeedRows returns the imported rows of tenant's feed, most recent first.
+func (s *OrderService) FeedRows(tenant string) ([]FeedRow, error) {
+	rows, err := s.DB.Query(`SELECT external_id, order_id, error, imported_at FROM feed_rows WHERE tenant_id = ?
+		ORDER BY imported_at DESC, external_id`, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query feed rows of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	result := []FeedRow{}
+	for rows.Next() {
+		var (
+			row        FeedRow
+			orderID    sql.NullInt64
+			importErr  sql.NullString
+			importedAt int64
+		)
+		if err := rows.Scan(&row.ExternalID, &orderID, &importErr, &importedAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		row.OrderID, row.Error, row.ImportedAt = orderID.Int64, importErr.String, time.Unix(importedAt, 0).UTC()
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// handleTenantFeed serves /admin/tenants/{tenant}/feed.
+//
+//	GET    /admin/tenants/{tenant}/feed       returns the Feed.
+//	PUT    /admin/tenants/{tenant}/feed       sets it, {"url": "https://..."}.
+//	DELETE /admin/tenants/{tenant}/feed       stops polling it.
+//	GET    /admin/tenants/{tenant}/feed/rows  returns the rows imported.
+func (s *OrderService) handleTenantFeed(w http.ResponseWriter, req *http.Request, tenant string, rows bool) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if rows {
+		result, err := s.FeedRows(tenant)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "FeedRows(): %s", err)
+			return
+		}
+		respond(w, req, 200, result, "tenant %q %d feed rows", tenant, len(result))
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var feed Feed
+		if err := json.Unmarshal(buf.Bytes(), &feed); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if _, err := feedCSVURL(feed.URL); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: err.Error()}, "%s", err)
+			return
+		}
+		if err := s.SetFeed(tenant, strings.TrimSpace(feed.URL)); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetFeed(): %s", err)
+			return
+		}
+	case http.MethodDelete:
+		deleted, err := s.DeleteFeed(tenant)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DeleteFeed(): %s", err)
+			return
+		}
+		if !deleted {
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_FEED"}, "tenant %q has no feed", tenant)
+			return
+		}
+		respond(w, req, 200, HTTPResponseStatus{"SUCCESS"}, "deleted feed of tenant %q", tenant)
+		return
+	}
+	feed, err := s.GetFeed(tenant)
+	if err == errNoSuchFeed {
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_FEED"}, "tenant %q has no feed", tenant)
+		return
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "GetFeed(): %s", err)
+		return
+	}
+	respond(w, req, 200, feed, "tenant %q feed %s", tenant, feed.URL)
+}
@@ -0,0 +1,113 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFeedCSVURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://example.com/orders.csv": "https://example.com/orders.csv",
+		"https://docs.google.com/spreadsheets/d/abc123/edit#gid=42": "https://docs.google.com/spreadsheets/d/abc123/" +
+			"export?format=csv&gid=42",
+		"https://docs.google.com/spreadsheets/d/abc123/edit?usp=sharing": "https://docs.google.com/spreadsheets/d/" +
+			"abc123/export?format=csv",
+		"ftp://example.com/orders.csv": "",
+		"orders.csv":                   "",
+	} {
+		if got, err := feedCSVURL(raw); got != want || (err == nil) != (want != "") {
+			t.Errorf("%s: got %q, %v, want %q", raw, got, err, want)
+		}
+	}
+}
+
+func TestFeedPoller(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		sheet = "external_id,customer,origin_lat,origin_lng,destination_lat,destination_lng\n" +
+			"A1,Ann,37.8093475,-122.2740787,37.8061044,-122.2943356\n" +
+			"A2,Bob,37.8093475,-122.2740787,,\n" +
+			",Cy,37.8093475,-122.2740787,37.8061044,-122.2943356\n"
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, sheet)
+	}))
+	defer server.Close()
+
+	svc := newTestService(t, Config{AdminToken: "secret", DuplicateWindow: time.Minute, DuplicateRadius: 50,
+		RejectDuplicates: true})
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/feed", ""); w.Code != 404 {
+		t.Errorf("GET a missing feed returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/feed", `{"url": "file:///etc/passwd"}`); w.Code != 400 {
+		t.Errorf("PUT an invalid feed returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/feed", `{"url": "`+server.URL+`"}`); w.Code != 200 {
+		t.Fatalf("PUT feed returned %d: %s", w.Code, w.Body)
+	}
+
+	poller := newFeedPoller(0, svc)
+	for _, want := range []int{1, 0} {
+		if n, err := poller.poll(context.Background()); err != nil || n != want {
+			t.Errorf("created %d orders, want %d: %v", n, want, err)
+		}
+	}
+	if w := serve(svc, "GET", "/orders/1", "acme", ""); w.Code != 200 {
+		t.Errorf("expected the order to belong to the feed's tenant, got %d", w.Code)
+	}
+
+	// A2 is imported once complete, A3 as a duplicate of A1 is not.
+	mu.Lock()
+	sheet = "external_id,customer,origin_lat,origin_lng,destination_lat,destination_lng\n" +
+		"A1,Ann,37.8093475,-122.2740787,37.8061044,-122.2943356\n" +
+		"A2,Bob,37.8093475,-122.2740787,37.80,-122.29\n" +
+		"A3,Dee,37.8093475,-122.2740787,37.8061044,-122.2943356\n"
+	mu.Unlock()
+	if n, err := poller.poll(context.Background()); err != nil || n != 1 {
+		t.Errorf("created %d orders, want 1: %v", n, err)
+	}
+
+	w := serveAdmin(svc, "GET", "/admin/tenants/acme/feed", "")
+	var feed Feed
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil || feed.Created != 2 || feed.Failed != 1 ||
+		feed.PolledAt == nil || feed.Error != "" {
+		t.Errorf("unexpected feed %+v, %v", feed, err)
+	}
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/feed/rows", "")
+	var rows []FeedRow
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil || len(rows) != 3 {
+		t.Fatalf("unexpected rows %s, %v", w.Body, err)
+	}
+	for _, row := range rows {
+		if row.ExternalID == "A3" && row.Error != "DUPLICATE_ORDER" {
+			t.Errorf("unexpected row %+v", row)
+		}
+	}
+
+	// Failed downloads are recorded on the feed.
+	server.Close()
+	if _, err := poller.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if feed, err := svc.GetFeed("acme"); err != nil || feed.Error == "" {
+		t.Errorf("expected the failed poll to be recorded, got %+v, %v", feed, err)
+	}
+
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/feed", ""); w.Code != 200 {
+		t.Errorf("DELETE feed returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/feed", ""); w.Code != 404 {
+		t.Errorf("DELETE a missing feed returned %d", w.Code)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Environment variables holding the key of the sensitive columns, either
+// the key itself, 32 bytes in base64, or the key encrypted with AWS KMS, the
+// base64 CiphertextBlob of a GenerateDataKey or Encrypt call.
+const (
+	fieldKeyEnv    = "ORDERSERVICE_FIELD_KEY"
+	fieldKeyKMSEnv = "ORDERSERVICE_FIELD_KEY_KMS"
+)
+
+// sealedFieldPrefix prefixes encrypted column values, in front of the
+// sealedPrefix of sealSecret. Values without it are read as plaintext, e.g.
+// those written before encryption was turned on.
+const sealedFieldPrefix = "enc:"
+
+// loadFieldKey returns the key of fieldKeyEnv, or that of fieldKeyKMSEnv
+// decrypted with AWS KMS in the region of AWS_REGION with the AWS_*
+// credentials of the environment, nil if neither is set.
+func loadFieldKey(ctx context.Context, client *http.Client, kmsBaseURL string) ([]byte, error) {
+	if encoded := os.Getenv(fieldKeyEnv); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s must be 32 bytes in base64", fieldKeyEnv)
+		}
+		return key, nil
+	}
+	blob := os.Getenv(fieldKeyKMSEnv)
+	if blob == "" {
+		return nil, nil
+	}
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fieldKeyKMSEnv, err)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	if kmsBaseURL == "" {
+		kmsBaseURL = fmt.Sprintf("https://kms.%s.amazonaws.com", region)
+	}
+	key, err := kmsDecrypt(ctx, client, kmsBaseURL, region, creds, blob)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fieldKeyKMSEnv, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s: the key is %d bytes, want 32", fieldKeyKMSEnv, len(key))
+	}
+	return key, nil
+}
+
+// kmsDecrypt decrypts blob, a base64 CiphertextBlob, with the Decrypt action
+// of AWS KMS at baseURL.
+func kmsDecrypt(ctx context.Context, client *http.Client, baseURL, region string, creds AWSCredentials,
+	blob string) ([]byte, error) {
+	body, _ := json.Marshal(map[string]string{"CiphertextBlob": blob})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(baseURL, "/")+"/",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	signAWSv4(req, sha256Hex(body), "kms", region, creds, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("KMS Decrypt failed: %s", err)
+	}
+	defer resp.Body.Close()
+	response, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS Decrypt failed: HTTP %d: %s", resp.StatusCode, response)
+	}
+	var decrypted struct {
+		Plaintext []byte // Base64 in JSON.
+	}
+	if err := json.Unmarshal(response, &decrypted); err != nil {
+		return nil, fmt.Errorf("invalid KMS Decrypt response: %s", err)
+	}
+	return decrypted.Plaintext, nil
+}
+
+// sealField encrypts value with key, the Config.FieldKey of the sensitive
+// columns, see sealedColumns. Returns value as is if there is no key or value
+// is empty.
+func sealField(key []byte, value string) (string, error) {
+	if key == nil || value == "" {
+		return value, nil
+	}
+	sealed, err := sealSecret(key, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return sealedFieldPrefix + sealed, nil
+}
+
+// openField decrypts a value of sealField, returning plaintext values as
+// they are.
+func openField(key, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(sealedFieldPrefix+sealedPrefix)) {
+		return value, nil
+	}
+	if key == nil {
+		return nil, fmt.Errorf("encrypted column and no %s", fieldKeyEnv)
+	}
+	plaintext, err := openSecret(key, string(value[len(sealedFieldPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt column, wrong %s?", fieldKeyEnv)
+	}
+	return plaintext, nil
+}
+
+// sealedColumns are the columns sealField encrypts, and the condition on the
+// rows it encrypts them in.
+var sealedColumns = []struct{ table, column, where string }{
+	{"orders", "notes", ""},
+	{"orders", "metadata", ""},
+	{"orders_archive", "notes", ""},
+	{"orders_archive", "metadata", ""},
+	{"order_comments", "body", ""},
+	{"tenant_settings", "maps_api_key", ""},
+	{"tenant_settings", "signing_secret", ""},
+	{"events", "data", "type = '" + string(EventUpdated) + "'"},
+}
+
+// sealColumns encrypts the values of sealedColumns still in plaintext with
+// key, returning the number of values encrypted.
+func sealColumns(db *sql.DB, key []byte) (int, error) {
+	if key == nil {
+		return 0, fmt.Errorf("no %s or %s", fieldKeyEnv, fieldKeyKMSEnv)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	total := 0
+	for _, c := range sealedColumns {
+		where := fmt.Sprintf("%s <> '' AND %s NOT LIKE '%s%%'", c.column, c.column, sealedFieldPrefix)
+		if c.where != "" {
+			where += " AND " + c.where
+		}
+		rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE %s", c.column, c.table, where))
+		if err != nil {
+			return total, fmt.Errorf("unable to read %s.%s: %s", c.table, c.column, err)
+		}
+		sealed := map[int64]string{}
+		for rows.Next() {
+			var (
+				rowID int64
+				value string
+			)
+			if err := rows.Scan(&rowID, &value); err != nil {
+				rows.Close()
+				return total, fmt.Errorf("row.Scan() failed: %s", err)
+			}
+			if sealed[rowID], err = sealField(key, value); err != nil {
+				rows.Close()
+				return total, err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, fmt.Errorf("unable to read %s.%s: %s", c.table, c.column, err)
+		}
+		for rowID, value := range sealed {
+			if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", c.table, c.column), value,
+				rowID); err != nil {
+				return total, fmt.Errorf("unable to update %s.%s: %s", c.table, c.column, err)
+			}
+		}
+		total += len(sealed)
+	}
+	return total, tx.Commit()
+}
+
+// encryptFieldsMain implements "orderservice encrypt-fields", encrypting
+// the sensitive columns written before encryption was turned on.
+func encryptFieldsMain(args []string) error {
+	flags := flag.NewFlagSet("encrypt-fields", flag.ContinueOnError)
+	dbpath := flags.String("dbpath", "", "Path to database")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dbpath == "" {
+		return fmt.Errorf("missing db name")
+	}
+	key, err := loadFieldKey(context.Background(), http.DefaultClient, "")
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", *dbpath)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+	}
+	defer db.Close()
+	n, err := sealColumns(db, key)
+	if err != nil {
+		return fmt.Errorf("encrypt-fields failed: %s", err)
+	}
+	fmt.Printf("Encrypted %d values.\n", n)
+	return nil
+}
@@ -0,0 +1,164 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	svc := newTestService(t, Config{FieldKey: key})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if w := servePatch(svc, "/orders/1", `{"notes": "ring twice", "metadata": {"phone": "+15551234567"}}`); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	if _, err := svc.AddComment(1, "support", "customer called"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored encrypted...
+	var notes, metadata, data, body string
+	svc.DB.QueryRow("SELECT notes, metadata FROM orders WHERE id = 1").Scan(&notes, &metadata)
+	svc.DB.QueryRow("SELECT data FROM events WHERE type = ?", string(EventUpdated)).Scan(&data)
+	svc.DB.QueryRow("SELECT body FROM order_comments").Scan(&body)
+	for _, value := range []string{notes, metadata, data, body} {
+		if !strings.HasPrefix(value, sealedFieldPrefix+sealedPrefix) || strings.Contains(value, "555") ||
+			strings.Contains(value, "ring") || strings.Contains(value, "called") {
+			t.Errorf("value in plaintext: %s", value)
+		}
+	}
+
+	// ...and read in plaintext.
+	order, err := svc.Get(1)
+	if err != nil || order.Notes != "ring twice" || order.Metadata["phone"] != "+15551234567" {
+		t.Errorf("unexpected order %+v, %v", order, err)
+	}
+	events, err := svc.History(1)
+	if err != nil || !strings.Contains(string(events[1].Data), "ring twice") {
+		t.Errorf("unexpected history %+v, %v", events, err)
+	}
+	if comments, err := svc.Comments(1); err != nil || comments[0].Body != "customer called" {
+		t.Errorf("unexpected comments %+v, %v", comments, err)
+	}
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 200 {
+		t.Errorf("GET /orders returned %d", w.Code)
+	}
+	// Replaying encrypts the columns anew, with other nonces.
+	if problems, err := Verify(svc.DB, key); err != nil || len(problems) != 0 {
+		t.Errorf("Verify() = %v, %v", problems, err)
+	}
+
+	svc.config.FieldKey = bytes.Repeat([]byte{8}, 32)
+	if w := serve(svc, "GET", "/orders/1", "", ""); w.Code != 500 {
+		t.Errorf("GET with the wrong key returned %d", w.Code)
+	}
+}
+
+func TestSealColumns(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if w := servePatch(svc, "/orders/1", `{"notes": "ring twice", "tags": ["vip"]}`); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	if _, err := svc.DB.Exec(`INSERT INTO tenant_settings (tenant_id, maps_api_key, signing_secret)
+		VALUES ('acme', 'AIza-acme', 'whsec-acme')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sealColumns(svc.DB, nil); err == nil {
+		t.Error("expected sealing without a key to fail")
+	}
+
+	key := bytes.Repeat([]byte{7}, 32)
+	if n, err := sealColumns(svc.DB, key); err != nil || n != 4 {
+		t.Fatalf("sealed %d values, %v", n, err)
+	}
+	if n, err := sealColumns(svc.DB, key); err != nil || n != 0 {
+		t.Errorf("sealed %d values again, %v", n, err)
+	}
+	var notes, tags string
+	svc.DB.QueryRow("SELECT notes, tags FROM orders WHERE id = 1").Scan(&notes, &tags)
+	if !strings.HasPrefix(notes, sealedFieldPrefix) || tags != `["vip"]` {
+		t.Errorf("unexpected notes %s and tags %s", notes, tags)
+	}
+	svc.config.FieldKey = key
+	if order, err := svc.Get(1); err != nil || order.Notes != "ring twice" {
+		t.Errorf("unexpected order %+v, %v", order, err)
+	}
+
+	var mapsKey, secret string
+	svc.DB.QueryRow("SELECT maps_api_key, signing_secret FROM tenant_settings").Scan(&mapsKey, &secret)
+	if strings.Contains(mapsKey, "acme") || strings.Contains(secret, "acme") {
+		t.Errorf("tenant secrets in plaintext: %s, %s", mapsKey, secret)
+	}
+	settings, err := loadTenantSettings(svc.DB, key, "acme")
+	if err != nil || settings.MapsAPIKey != "AIza-acme" || settings.SigningSecret != "whsec-acme" {
+		t.Errorf("unexpected settings %+v, %v", settings, err)
+	}
+	if _, err := loadTenantSettings(svc.DB, nil, "acme"); err == nil {
+		t.Error("expected loading sealed settings without a key to fail")
+	}
+}
+
+func TestLoadFieldKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	defer os.Unsetenv(fieldKeyEnv)
+	defer os.Unsetenv(fieldKeyKMSEnv)
+	if key, err := loadFieldKey(context.Background(), nil, ""); key != nil || err != nil {
+		t.Errorf("unexpected key %v, %v", key, err)
+	}
+	os.Setenv(fieldKeyEnv, "c2hvcnQ=")
+	if _, err := loadFieldKey(context.Background(), nil, ""); err == nil {
+		t.Error("expected a short key to fail")
+	}
+	os.Setenv(fieldKeyEnv, base64.StdEncoding.EncodeToString(key))
+	if got, err := loadFieldKey(context.Background(), nil, ""); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("unexpected key %v, %v", got, err)
+	}
+	os.Unsetenv(fieldKeyEnv)
+
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var decrypt struct{ CiphertextBlob string }
+		json.Unmarshal(body, &decrypt)
+		if req.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || decrypt.CiphertextBlob != "YmxvYg==" ||
+			!strings.Contains(req.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request") {
+			w.WriteHeader(400)
+			fmt.Fprint(w, `{"__type": "InvalidCiphertextException"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"KeyId": "arn:aws:kms:eu-west-1:1:key/k", "Plaintext": "%s"}`,
+			base64.StdEncoding.EncodeToString(key))
+	}))
+	defer kms.Close()
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("AWS_REGION", "eu-west-1")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	defer os.Unsetenv("AWS_REGION")
+	os.Setenv(fieldKeyKMSEnv, "YmxvYg==")
+	if got, err := loadFieldKey(context.Background(), kms.Client(), kms.URL); err != nil || !bytes.Equal(got, key) {
+		t.Errorf("unexpected key %v, %v", got, err)
+	}
+	os.Setenv(fieldKeyKMSEnv, "b3RoZXI=")
+	if _, err := loadFieldKey(context.Background(), kms.Client(), kms.URL); err == nil ||
+		!strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// orderFields maps the JSON name of each OrderDTO field to its index in the
+// struct.
+var orderFields = jsonFieldIndex(reflect.TypeOf(OrderDTO{}))
+
+// jsonFieldIndex returns the JSON names of the exported fields of struct type
+// t mapped to their field index.
+func jsonFieldIndex(t reflect.Type) map[string]int {
+	index := map[string]int{}
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		index[name] = idx
+	}
+	return index
+}
+
+// unknownJSONFields returns the sorted names of the top-level members of the
+// JSON object input that don't match a field of struct type t.
+func unknownJSONFields(input []byte, t reflect.Type) ([]string, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(input, &members); err != nil {
+		return nil, err
+	}
+	known := jsonFieldIndex(t)
+	var unknown []string
+	for name := range members {
+		if _, ok := known[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// Fieldset is the set of Order fields requested with "?fields=". A nil
+// Fieldset selects every field.
+type Fieldset map[string]bool
+
+// parseFieldset reads the comma separated "fields" query parameter. Unknown
+// field names are an error naming them.
+func parseFieldset(queryParams url.Values) (Fieldset, error) {
+	if len(queryParams["fields"]) == 0 {
+		return nil, nil
+	}
+	if len(queryParams["fields"]) > 1 {
+		return nil, fmt.Errorf("fields given more than once")
+	}
+	fields := Fieldset{}
+	var unknown []string
+	for _, name := range strings.Split(queryParams["fields"][0], ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := orderFields[name]; !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		fields[name] = true
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ","))
+	}
+	return fields, nil
+}
+
+// Apply returns the value to encode for orders: their OrderDTOs when every
+// field is selected, otherwise a list that encodes only the selected fields.
+func (f Fieldset) Apply(orders []Order) interface{} {
+	dtos := newOrderDTOs(orders)
+	if f == nil {
+		return dtos
+	}
+	sparse := make([]sparseOrder, len(dtos))
+	for idx := range dtos {
+		sparse[idx] = sparseOrder{order: &dtos[idx], fields: f}
+	}
+	return sparse
+}
+
+// sparseOrder encodes the selected fields of an order, in struct order.
+type sparseOrder struct {
+	order  *OrderDTO
+	fields Fieldset
+}
+
+func (s sparseOrder) MarshalJSON() ([]byte, error) {
+	value := reflect.ValueOf(s.order).Elem()
+	orderType := value.Type()
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	for idx := 0; idx < orderType.NumField(); idx++ {
+		name := strings.Split(orderType.Field(idx).Tag.Get("json"), ",")[0]
+		if !s.fields[name] {
+			continue
+		}
+		encoded, err := json.Marshal(value.Field(idx).Interface())
+		if err != nil {
+			return nil, err
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		fmt.Fprintf(&buf, "%q:", name)
+		buf.Write(encoded)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,45 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func TestFieldsetApply(t *testing.T) {
+	fields, err := parseFieldset(url.Values{"fields": {"status,id"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := []Order{{Id: 1, Distance: 2489, State: StateUnassigned}}
+	encoded, err := json.Marshal(fields.Apply(orders))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[{"id":1,"status":"UNASSIGNED"}]`; string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+
+	// No fields parameter selects everything.
+	fields, err = parseFieldset(url.Values{})
+	if err != nil || fields != nil {
+		t.Fatalf("expected nil fieldset, got %v %v", fields, err)
+	}
+	encoded, _ = json.Marshal(fields.Apply(orders))
+	if expected := `[{"id":1,"distance":2489,"status":"UNASSIGNED"}]`; string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+}
+
+func TestFieldsetUnknown(t *testing.T) {
+	_, err := parseFieldset(url.Values{"fields": {"id,stauts,colour"}})
+	if err == nil || err.Error() != "unknown fields: colour,stauts" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if w := serve(newTestService(t, Config{}), "GET", "/orders?fields=nope", "", ""); w.Code != 400 {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// OrderFilter restricts the orders returned by List. Zero values don't filter.
+type OrderFilter struct {
+	Status      OrderState `json:"status,omitempty"`
+	MinDistance float64    `json:"min_distance,omitempty"`
+	MaxDistance float64    `json:"max_distance,omitempty"`
+	// Tenant restricts the orders to those of one tenant if set, see
+	// orderScope.
+	Tenant *string `json:"-"`
+}
+
+// Validate returns a non-nil error if the filter can't match anything sensible.
+func (f OrderFilter) Validate() error {
+	switch f.Status {
+	case "", StateUnassigned, StateTaken:
+	default:
+		return fmt.Errorf("unknown status %q", f.Status)
+	}
+	if f.MinDistance < 0 || f.MaxDistance < 0 {
+		return fmt.Errorf("distances must not be negative")
+	}
+	if f.MaxDistance != 0 && f.MinDistance > f.MaxDistance {
+		return fmt.Errorf("min_distance is greater than max_distance")
+	}
+	return nil
+}
+
+// apply adds the conditions of the filter to a query of the orders table.
+// The zero filter adds none.
+func (f OrderFilter) apply(q *sqlQuery) *sqlQuery {
+	if f.Status != "" {
+		q.where("status = ?", string(f.Status))
+	}
+	if f.MinDistance != 0 {
+		q.where("distance >= ?", f.MinDistance)
+	}
+	if f.MaxDistance != 0 {
+		q.where("distance <= ?", f.MaxDistance)
+	}
+	if f.Tenant != nil {
+		q.where("tenant_id = ?", *f.Tenant)
+	}
+	return q
+}
+
+// parseOrderFilter reads the "status", "min_distance" and "max_distance" query
+// parameters.
+func parseOrderFilter(queryParams url.Values) (OrderFilter, error) {
+	var filter OrderFilter
+	for _, name := range []string{"status", "min_distance", "max_distance"} {
+		if len(queryParams[name]) > 1 {
+			return filter, fmt.Errorf("%s given more than once", name)
+		}
+	}
+	filter.Status = queryParams.Get("status")
+	for name, dest := range map[string]*float64{"min_distance": &filter.MinDistance, "max_distance": &filter.MaxDistance} {
+		if value := queryParams.Get(name); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %s", name, err)
+			}
+			*dest = parsed
+		}
+	}
+	return filter, filter.Validate()
+}
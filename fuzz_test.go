@@ -0,0 +1,108 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets below parse untrusted input. Plain go test runs their seed
+// inputs, make fuzz explores further.
+
+func FuzzParseCreateOrderDetails(f *testing.F) {
+	f.Add(createOrderDetails, false)
+	f.Add(`{"origin": ["37.7", "-122.2"], "destination": ["37.8", "-122.3"], "extra": 1}`, true)
+	f.Add(`{"origin": ["NaN", "0"], "destination": ["0", "0"]}`, false)
+	f.Add(`{"origin": ["1e400", "0"], "destination": ["0", "0"]}`, false)
+	f.Add(`{"origin": null}`, false)
+	f.Add("malformed", false)
+	f.Fuzz(func(t *testing.T, input string, strict bool) {
+		details, err := parseCreateOrderDetails(input, strict)
+		if err != nil {
+			return
+		}
+		for _, point := range [][]string{details.Origin, details.Destination} {
+			lat, lng, err := parseLatLng(point)
+			if err != nil || math.IsNaN(lat) || math.IsNaN(lng) || math.Abs(lat) > 90 || math.Abs(lng) > 180 {
+				t.Fatalf("accepted %q, point %q: %f, %f, %v", input, point, lat, lng, err)
+			}
+		}
+		if strict {
+			if _, err := parseCreateOrderDetails(input, false); err != nil {
+				t.Fatalf("%q passes strict parsing but not lenient: %s", input, err)
+			}
+		}
+	})
+}
+
+func FuzzOrderPath(f *testing.F) {
+	svc := newTestService(f, Config{IDStrategy: idULID})
+	if _, err := svc.Insert("", CreateOrderDetails{Origin: []string{"37.7", "-122.2"},
+		Destination: []string{"37.8", "-122.3"}}); err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range []string{"1", "2", "-1", "01", "1/history", "1/requote", "abc", "9223372036854775808",
+		"1/../2", "%2F", "01ARZ3NDEKTSV4RRFFQ69G5FAV", ""} {
+		f.Add("GET", path)
+		f.Add("PATCH", path)
+	}
+	f.Fuzz(func(t *testing.T, method, path string) {
+		if method != "GET" && method != "PATCH" && method != "POST" {
+			return
+		}
+		req, err := http.NewRequest(method, "http://orders.test/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Path = "/orders/" + path
+		req.RequestURI = req.URL.RequestURI()
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		if w.Code >= 500 {
+			t.Fatalf("%s %q returned %d: %s", method, req.URL.Path, w.Code, w.Body)
+		}
+	})
+}
+
+func FuzzListQuery(f *testing.F) {
+	for _, query := range []string{"", "page=2&limit=5", "limit=0", "limit=1000", "page=-1", "page=1&page=2",
+		"status=TAKEN&min_distance=1&max_distance=2", "fields=id,status", "limit=99999999999999999999"} {
+		f.Add(query, false)
+		f.Add(query, true)
+	}
+	f.Fuzz(func(t *testing.T, rawQuery string, clamp bool) {
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return
+		}
+		limits := ListLimits{Default: 10, Max: 200, Clamp: clamp}
+		page, limit, err := parseQueryParametersForList(query, limits)
+		if err == nil && (page < 1 || limit < 1 || limit > limits.Max) {
+			t.Fatalf("%q: page %d, limit %d", rawQuery, page, limit)
+		}
+		parseOrderFilter(query)
+		parseFieldset(query)
+	})
+}
+
+func FuzzParseRange(f *testing.F) {
+	for _, header := range []string{"orders=0-9", "orders=5-", "orders=-5", "bytes=0-9", "orders=9-0",
+		"orders=1-2-3", " orders = 1-2", "orders=0-9223372036854775807"} {
+		f.Add(header)
+	}
+	f.Fuzz(func(t *testing.T, header string) {
+		first, last, ok, err := parseRange(header)
+		if ok && err == nil && (first < 0 || last < first) {
+			t.Fatalf("%q: range %d-%d", header, first, last)
+		}
+		if !ok && strings.HasPrefix(strings.TrimSpace(header), rangeUnit+"=") {
+			t.Fatalf("%q: ignored", header)
+		}
+	})
+}
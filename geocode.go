@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Geocoder finds the point of a postal address, as a [latitude, longitude]
+// pair accepted by POST /orders.
+type Geocoder interface {
+	Geocode(address string) ([]string, error)
+}
+
+// errAddressNotFound is returned by Geocode for addresses that have no
+// point.
+var errAddressNotFound = fmt.Errorf("address not found")
+
+// googleGeocoder uses the Google Maps geocoding API, with the keys of the
+// distancematrix API.
+type googleGeocoder struct {
+	keys    *KeyPool
+	client  *http.Client
+	baseURL string // Empty for defaultMapsBaseURL.
+}
+
+// googleGeocodeResponse is the part of a geocoding API response used.
+type googleGeocodeResponse struct {
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error_message"`
+	Results      []struct {
+		Geometry struct {
+			Location struct {
+				Lat float64 `json:"lat"`
+				Lng float64 `json:"lng"`
+			} `json:"location"`
+		} `json:"geometry"`
+	} `json:"results"`
+}
+
+// Geocode returns the point of the first result, rotating to the next key in
+// the pool whenever Google reports that a key is over its quota.
+func (g *googleGeocoder) Geocode(address string) ([]string, error) {
+	baseURL := g.baseURL
+	if baseURL == "" {
+		baseURL = defaultMapsBaseURL
+	}
+	for attempt := 0; attempt < g.keys.Len(); attempt++ {
+		key, keyID, err := g.keys.Acquire()
+		if err != nil {
+			return nil, err
+		}
+		response, err := g.client.Get(fmt.Sprintf("%s/maps/api/geocode/json?address=%s&key=%s", baseURL,
+			url.QueryEscape(address), key))
+		if err != nil {
+			return nil, fmt.Errorf("failed http.Client{}.Get() key=%s: %s", keyID, err)
+		}
+		var geocoded googleGeocodeResponse
+		err = json.NewDecoder(response.Body).Decode(&geocoded)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode response: %s", err)
+		}
+
+		switch geocoded.Status {
+		case "OK":
+			if len(geocoded.Results) == 0 {
+				return nil, errAddressNotFound
+			}
+			location := geocoded.Results[0].Geometry.Location
+			return []string{strconv.FormatFloat(location.Lat, 'f', -1, 64),
+				strconv.FormatFloat(location.Lng, 'f', -1, 64)}, nil
+		case "ZERO_RESULTS":
+			return nil, errAddressNotFound
+		case "OVER_QUERY_LIMIT", "OVER_DAILY_LIMIT":
+			g.keys.Exhausted(keyID)
+			continue
+		default:
+			return nil, fmt.Errorf("Google Maps returned %s for key=%s: %s", geocoded.Status, keyID,
+				geocoded.ErrorMessage)
+		}
+	}
+	return nil, errNoMapsKeys
+}
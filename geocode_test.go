@@ -0,0 +1,47 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGoogleGeocoder(t *testing.T) {
+	maps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/maps/api/geocode/json" {
+			t.Errorf("unexpected path %s", req.URL.Path)
+		}
+		if req.URL.Query().Get("address") == "Nowhere" {
+			fmt.Fprint(w, `{"status": "ZERO_RESULTS", "results": []}`)
+			return
+		}
+		fmt.Fprint(w, `{"status": "OK", "results": [{"geometry": {"location": {"lat": 37.8061044,
+			"lng": -122.2943356}}}]}`)
+	}))
+	defer maps.Close()
+
+	keys, err := NewKeyPool([]string{"key"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewOrderService(openTestDB(t), Config{DistanceProvider: providerGoogle, MapsKeys: keys,
+		MapsBaseURL: maps.URL}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, err := svc.geocoder.Geocode("1 Main St, Oakland, CA")
+	if err != nil || point[0] != "37.8061044" || point[1] != "-122.2943356" {
+		t.Errorf("unexpected point %v, %v", point, err)
+	}
+	if _, err := svc.geocoder.Geocode("Nowhere"); err != errAddressNotFound {
+		t.Errorf("expected errAddressNotFound, got %v", err)
+	}
+	if svc := newTestService(t, Config{}); svc.geocoder != nil {
+		t.Error("expected no geocoder without Google Maps keys")
+	}
+}
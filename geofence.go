@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// areaNameRE matches the names of service areas and zones.
+var areaNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Geometry is a GeoJSON Polygon or MultiPolygon. Positions are [longitude,
+// latitude]; the first ring of a polygon is its outline, the others holes.
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// polygon is a list of closed rings of [longitude, latitude] positions.
+type polygon [][][2]float64
+
+// parseGeometry returns the polygons of a GeoJSON Polygon or MultiPolygon.
+func parseGeometry(geometry Geometry) ([]polygon, error) {
+	var polygons []polygon
+	switch geometry.Type {
+	case "Polygon":
+		var p polygon
+		if err := json.Unmarshal(geometry.Coordinates, &p); err != nil {
+			return nil, fmt.Errorf("invalid Polygon coordinates: %s", err)
+		}
+		polygons = []polygon{p}
+	case "MultiPolygon":
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("invalid MultiPolygon coordinates: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("geometry must be a Polygon or MultiPolygon, got %q", geometry.Type)
+	}
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("no polygons")
+	}
+	for _, p := range polygons {
+		if len(p) == 0 {
+			return nil, fmt.Errorf("polygon without rings")
+		}
+		for _, ring := range p {
+			if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+				return nil, fmt.Errorf("rings must be closed and have at least 4 positions")
+			}
+			for _, position := range ring {
+				if !(position[0] >= -180 && position[0] <= 180 && position[1] >= -90 && position[1] <= 90) {
+					return nil, fmt.Errorf("invalid position %v", position)
+				}
+			}
+		}
+	}
+	return polygons, nil
+}
+
+// ringContains returns whether the point is inside ring, by counting the
+// edges a ray from the point crosses. Coordinates are treated as planar,
+// which is close enough for city sized areas.
+func ringContains(ring [][2]float64, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > lat) != (b[1] > lat) && lng < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// polygonsContain returns whether the point is inside one of polygons, and
+// outside its holes.
+func polygonsContain(polygons []polygon, lat, lng float64) bool {
+	for _, p := range polygons {
+		if !ringContains(p[0], lat, lng) {
+			continue
+		}
+		inHole := false
+		for _, hole := range p[1:] {
+			if ringContains(hole, lat, lng) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// Tables of named areas.
+const (
+	serviceAreasTable = "service_areas"
+	pricingZonesTable = "pricing_zones"
+)
+
+// Area is a named area of a tenant, a service area or a pricing zone, an item
+// of GET /admin/tenants/{tenant}/areas and /zones.
+type Area struct {
+	Name     string   `json:"name"`
+	Geometry Geometry `json:"geometry"`
+}
+
+// errOutOfServiceArea is returned by Insert when an end of the journey is
+// outside all of the tenant's service areas.
+type errOutOfServiceArea struct {
+	Point string // "origin" or "destination".
+}
+
+func (e errOutOfServiceArea) Error() string {
+	return e.Point + " is outside the service area"
+}
+
+// ServiceAreas returns the service areas of tenant, by name.
+func (s *OrderService) ServiceAreas(tenant string) ([]Area, error) {
+	return loadAreas(s.DB, serviceAreasTable, tenant)
+}
+
+// loadAreas returns the areas of tenant in table, by name.
+func loadAreas(db *sql.DB, table, tenant string) ([]Area, error) {
+	rows, err := db.Query("SELECT name, geometry FROM "+table+" WHERE tenant_id = ? ORDER BY name", tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query %s of tenant %q: %s", table, tenant, err)
+	}
+	defer rows.Close()
+	areas := []Area{}
+	for rows.Next() {
+		var (
+			area     Area
+			geometry string
+		)
+		if err := rows.Scan(&area.Name, &geometry); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if err := json.Unmarshal([]byte(geometry), &area.Geometry); err != nil {
+			return nil, fmt.Errorf("invalid geometry of area %q: %s", area.Name, err)
+		}
+		areas = append(areas, area)
+	}
+	return areas, rows.Err()
+}
+
+// checkServiceArea returns errOutOfServiceArea if tenant has service areas
+// and an end of the journey is outside all of them.
+func (s *OrderService) checkServiceArea(tenant string, originLat, originLng, destinationLat,
+	destinationLng float64) error {
+	areas, err := loadAreas(s.DB, serviceAreasTable, tenant)
+	if err != nil || len(areas) == 0 {
+		return err
+	}
+	var polygons []polygon
+	for _, area := range areas {
+		p, err := parseGeometry(area.Geometry)
+		if err != nil {
+			return fmt.Errorf("invalid service area %q: %s", area.Name, err)
+		}
+		polygons = append(polygons, p...)
+	}
+	if !polygonsContain(polygons, originLat, originLng) {
+		return errOutOfServiceArea{Point: "origin"}
+	}
+	if !polygonsContain(polygons, destinationLat, destinationLng) {
+		return errOutOfServiceArea{Point: "destination"}
+	}
+	return nil
+}
+
+// SetArea adds or replaces an area of tenant in table.
+func (s *OrderService) SetArea(table, tenant string, area Area) error {
+	geometry, err := json.Marshal(area.Geometry)
+	if err != nil {
+		return fmt.Errorf("unable to encode geometry: %s", err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO `+table+` (tenant_id, name, geometry) VALUES (?, ?, ?)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET geometry = excluded.geometry`, tenant, area.Name, string(geometry))
+	if err != nil {
+		return fmt.Errorf("unable to set area %q of tenant %q: %s", area.Name, tenant, err)
+	}
+	return nil
+}
+
+// DeleteArea removes an area of tenant from table, returning false if it has
+// no such area.
+func (s *OrderService) DeleteArea(table, tenant, name string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM "+table+" WHERE tenant_id = ? AND name = ?", tenant, name)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete area %q of tenant %q: %s", name, tenant, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// handleTenantAreas serves /admin/tenants/{tenant}/areas, the service areas in
+// table serviceAreasTable, and /admin/tenants/{tenant}/zones, the pricing
+// zones in pricingZonesTable. Without service areas a tenant's orders may go
+// anywhere.
+//
+//	GET    /admin/tenants/{tenant}/areas         lists the service areas.
+//	PUT    /admin/tenants/{tenant}/areas/{name}  sets one, a GeoJSON Polygon or
+//	                                             MultiPolygon.
+//	DELETE /admin/tenants/{tenant}/areas/{name}  removes one.
+func (s *OrderService) handleTenantAreas(w http.ResponseWriter, req *http.Request, table, tenant, name string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if name != "" {
+		if !areaNameRE.MatchString(name) {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: "names are 1 to 64 letters, digits, - and _"}, "area name %q", name)
+			return
+		}
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			var buf bytes.Buffer
+			io.Copy(&buf, req.Body)
+			var geometry Geometry
+			if err := json.Unmarshal(buf.Bytes(), &geometry); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+				return
+			}
+			if _, err := parseGeometry(geometry); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_GEOMETRY", Detail: err.Error()}, "%s", err)
+				return
+			}
+			if err := s.SetArea(table, tenant, Area{Name: name, Geometry: geometry}); err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetArea(): %s", err)
+				return
+			}
+		case http.MethodDelete:
+			deleted, err := s.DeleteArea(table, tenant, name)
+			if err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DeleteArea(): %s", err)
+				return
+			}
+			if !deleted {
+				respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_AREA"}, "tenant %q area %q", tenant, name)
+				return
+			}
+		}
+	}
+	areas, err := loadAreas(s.DB, table, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadAreas(): %s", err)
+		return
+	}
+	respond(w, req, 200, areas, "tenant %q %d %s", tenant, len(areas), table)
+}
@@ -0,0 +1,87 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPolygonsContain(t *testing.T) {
+	// A square with a square hole.
+	polygons, err := parseGeometry(Geometry{Type: "Polygon",
+		Coordinates: json.RawMessage(`[[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]], [[4, 4], [6, 4], [6, 6], [4, 6], [4, 4]]]`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		lat, lng float64
+		inside   bool
+	}{{1, 1, true}, {9, 2, true}, {5, 5, false}, {11, 5, false}, {5, -1, false}} {
+		if got := polygonsContain(polygons, test.lat, test.lng); got != test.inside {
+			t.Errorf("(%v, %v): got %t", test.lat, test.lng, got)
+		}
+	}
+
+	for _, geometry := range []string{
+		`{"type": "Point", "coordinates": [0, 0]}`,
+		`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1]]]}`,
+		`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1]]]}`,
+		`{"type": "Polygon", "coordinates": [[[0, 0], [190, 0], [1, 1], [0, 0]]]}`,
+		`{"type": "MultiPolygon", "coordinates": []}`,
+	} {
+		var g Geometry
+		json.Unmarshal([]byte(geometry), &g)
+		if _, err := parseGeometry(g); err == nil {
+			t.Errorf("%s: expected an error", geometry)
+		}
+	}
+}
+
+func TestServiceAreas(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	// Oakland, where createOrderDetails starts and ends.
+	oakland := `{"type": "Polygon", "coordinates": [[[-122.35, 37.75], [-122.2, 37.75], [-122.2, 37.85],
+		[-122.35, 37.85], [-122.35, 37.75]]]}`
+	// Around the origin only.
+	origin := `{"type": "MultiPolygon", "coordinates": [[[[-122.28, 37.8], [-122.27, 37.8], [-122.27, 37.82],
+		[-122.28, 37.82], [-122.28, 37.8]]]]}`
+
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/areas/origin", origin); w.Code != 200 {
+		t.Fatalf("PUT area returned %d: %s", w.Code, w.Body)
+	}
+	w := serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), `"detail":"destination is outside the service area"`) {
+		t.Errorf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "POST", "/orders", "other", createOrderDetails); w.Code != 200 {
+		t.Errorf("POST /orders of a tenant without areas returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/areas/oakland", oakland); w.Code != 200 {
+		t.Fatalf("PUT area returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Errorf("POST /orders inside an area returned %d: %s", w.Code, w.Body)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/areas", "")
+	var areas []Area
+	if err := json.NewDecoder(w.Body).Decode(&areas); err != nil || len(areas) != 2 || areas[0].Name != "oakland" ||
+		areas[1].Geometry.Type != "MultiPolygon" {
+		t.Errorf("unexpected areas %+v, %v", areas, err)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/areas/bad", `{"type": "Polygon", "coordinates": [[]]}`); w.Code != 400 {
+		t.Errorf("PUT invalid area returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/areas/oakland", ""); w.Code != 200 {
+		t.Errorf("DELETE area returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/areas/oakland", ""); w.Code != 404 {
+		t.Errorf("DELETE deleted area returned %d", w.Code)
+	}
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 422 {
+		t.Errorf("POST /orders after DELETE returned %d", w.Code)
+	}
+}
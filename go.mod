@@ -1,6 +1,7 @@
 module kojustin/orderservice
 
-require (
-	github.com/mattn/go-sqlite3 v1.9.0
-	golang.org/x/tools v0.0.0-20181030000716-a0a13e073c7b // indirect
-)
+go 1.27.1
+
+require github.com/mattn/go-sqlite3 v1.9.0
+
+require golang.org/x/tools v0.0.0-20181030000716-a0a13e073c7b // indirect
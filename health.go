@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errDistanceUnavailable = fmt.Errorf("distance provider unavailable")
+
+// DistanceHealthConfig decides when the distance provider is considered down.
+// While it is, the service is degraded: creating orders and quotes fails
+// with 503 right away while reads keep working.
+type DistanceHealthConfig struct {
+	// Consecutive failures after which the provider is down, 0 never.
+	MaxFailures int
+	// While the provider is down one request per ProbeInterval is still
+	// sent to it, the first to succeed brings it back.
+	ProbeInterval time.Duration
+}
+
+// distanceHealth is a circuit breaker around the distance provider.
+type distanceHealth struct {
+	config   DistanceHealthConfig
+	inFlight int32 // Requests waiting on the provider, accessed atomically.
+
+	mu        sync.Mutex
+	failures  int       // Consecutive failures.
+	down      bool      // Set once failures reaches MaxFailures.
+	lastProbe time.Time // When the last request was let through while down.
+	now       func() time.Time
+}
+
+func newDistanceHealth(config DistanceHealthConfig) *distanceHealth {
+	return &distanceHealth{config: config, now: time.Now}
+}
+
+// acquire returns false if the provider is down and it is not time for a
+// probe. Every successful call must be followed by release.
+func (h *distanceHealth) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.down {
+		now := h.now()
+		if now.Sub(h.lastProbe) < h.config.ProbeInterval {
+			return false
+		}
+		h.lastProbe = now
+	}
+	atomic.AddInt32(&h.inFlight, 1)
+	return true
+}
+
+// release records the outcome of a request to the provider.
+func (h *distanceHealth) release(err error) {
+	atomic.AddInt32(&h.inFlight, -1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		if h.down {
+			fmt.Printf("Distance provider recovered\n")
+		}
+		h.failures, h.down = 0, false
+		return
+	}
+	h.failures++
+	if !h.down && h.config.MaxFailures > 0 && h.failures >= h.config.MaxFailures {
+		fmt.Printf("Distance provider down after %d failures, last: %s\n", h.failures, err)
+		h.down = true
+		h.lastProbe = h.now()
+	}
+}
+
+// isDown returns true while the provider is considered down.
+func (h *distanceHealth) isDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.down
+}
+
+// respondDistanceUnavailable writes the 503 for requests that need the
+// distance provider while it is down.
+func (s *OrderService) respondDistanceUnavailable(w http.ResponseWriter, req *http.Request) {
+	retryAfter := int64(s.distanceHealth.config.ProbeInterval/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	respond(w, req, 503, HTTPResponseError{Error: "DISTANCE_UNAVAILABLE",
+		Detail: "orders cannot be created or quoted right now, reads still work"}, "%s", errDistanceUnavailable)
+}
+
+// Readiness is the body of GET /readyz.
+type Readiness struct {
+	// "ok", "degraded" while the distance provider or Redis is down, the
+	// database failed its integrity check or is not replicated, or "unavailable"
+	// without a database.
+	Status string `json:"status"`
+	DB     string `json:"db"`   // "ok", "corrupt" or "unavailable".
+	Maps   string `json:"maps"` // The distance provider, "ok" or "degraded".
+	// Requests waiting on the distance provider.
+	QueueDepth int32 `json:"queue_depth"`
+	// "ok" while litestream runs, "down" while it does not, empty without
+	// replication.
+	Replication string `json:"replication,omitempty"`
+	// "ok" or "down", empty without Redis. Bans and cached orders are
+	// skipped while Redis is down.
+	Redis string `json:"redis,omitempty"`
+	// The last maintenance of the database, if any ran.
+	Maintenance *DBMaintenanceReport `json:"maintenance,omitempty"`
+	// Of the build serving, see GET /version.
+	Version string `json:"version"`
+}
+
+// Readiness checks the service's dependencies.
+func (s *OrderService) Readiness(ctx context.Context) Readiness {
+	ready := Readiness{Status: "ok", DB: "ok", Maps: "ok", QueueDepth: atomic.LoadInt32(&s.distanceHealth.inFlight),
+		Version: version}
+	if s.distanceHealth.isDown() {
+		ready.Status, ready.Maps = "degraded", "degraded"
+	}
+	if ready.Maintenance = s.dbMaintainer.Last(); ready.Maintenance != nil && ready.Maintenance.Integrity != "ok" &&
+		ready.Maintenance.Error == "" {
+		ready.Status, ready.DB = "degraded", "corrupt"
+	}
+	if s.replication != nil {
+		ready.Replication = "ok"
+		if !s.replication.Up() {
+			ready.Status, ready.Replication = "degraded", "down"
+		}
+	}
+	ctx, cancelFn := context.WithTimeout(ctx, time.Second)
+	defer cancelFn()
+	if s.redis != nil {
+		ready.Redis = "ok"
+		if _, err := s.redis.do(ctx, "PING"); err != nil {
+			fmt.Printf("Readiness: Redis unreachable: %s\n", err)
+			ready.Status, ready.Redis = "degraded", "down"
+		}
+	}
+	if err := s.DB.PingContext(ctx); err != nil {
+		fmt.Printf("Readiness: database unreachable: %s\n", err)
+		ready.Status, ready.DB = "unavailable", "unavailable"
+	}
+	return ready
+}
+
+// handleReadyz serves GET /readyz for load balancers, without credentials. It
+// is 200 while the service can serve reads, even if degraded.
+func (s *OrderService) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	ready := s.Readiness(req.Context())
+	code := 200
+	if ready.Status == "unavailable" {
+		code = 503
+	}
+	respond(w, req, code, ready, "%s", ready.Status)
+}
@@ -0,0 +1,82 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// flakyDistance fails while down is set.
+type flakyDistance struct {
+	down  *bool
+	calls *int
+}
+
+func (f flakyDistance) Route(origin, destination []string) (Route, error) {
+	*f.calls++
+	if *f.down {
+		return Route{}, fmt.Errorf("connection refused")
+	}
+	return Route{Distance: 1000, Duration: 60}, nil
+}
+
+func TestDegradedMode(t *testing.T) {
+	svc := newTestService(t, Config{DistanceHealth: DistanceHealthConfig{MaxFailures: 2, ProbeInterval: time.Minute}})
+	down, calls := true, 0
+	svc.defaultDistance = flakyDistance{down: &down, calls: &calls}
+	now := time.Unix(1600000000, 0)
+	svc.distanceHealth.now = func() time.Time { return now }
+
+	readiness := func() (int, Readiness) {
+		w := serve(svc, "GET", "/readyz", "", "")
+		var ready Readiness
+		if err := json.NewDecoder(w.Body).Decode(&ready); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, ready
+	}
+	if code, ready := readiness(); code != 200 || ready != (Readiness{Status: "ok", DB: "ok", Maps: "ok", Version: version}) {
+		t.Errorf("healthy readiness %d %+v", code, ready)
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 500 {
+			t.Errorf("POST with failing provider returned %d", w.Code)
+		}
+	}
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 503 || w.Header().Get("Retry-After") != "61" {
+		t.Errorf("POST while degraded returned %d", w.Code)
+	}
+	if w := serve(svc, "POST", "/orders/quote", "", createOrderDetails); w.Code != 503 {
+		t.Errorf("quote while degraded returned %d", w.Code)
+	}
+	if calls != 2 {
+		t.Errorf("provider called %d times, want 2", calls)
+	}
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 200 {
+		t.Errorf("GET while degraded returned %d", w.Code)
+	}
+	if code, ready := readiness(); code != 200 || ready.Status != "degraded" || ready.Maps != "degraded" {
+		t.Errorf("degraded readiness %d %+v", code, ready)
+	}
+
+	// A probe is let through once per interval, the first to succeed ends
+	// the degradation.
+	down = false
+	now = now.Add(time.Minute)
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Errorf("probe returned %d: %s", w.Code, w.Body)
+	}
+	if code, ready := readiness(); code != 200 || ready.Status != "ok" {
+		t.Errorf("recovered readiness %d %+v", code, ready)
+	}
+
+	svc.DB.Close()
+	if code, ready := readiness(); code != 503 || ready.DB != "unavailable" {
+		t.Errorf("readiness without database %d %+v", code, ready)
+	}
+}
@@ -0,0 +1,78 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPClientProxy(t *testing.T) {
+	// Requests to plain HTTP upstreams reach the proxy with the absolute URL.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(407)
+			return
+		}
+		fmt.Fprintf(w, "proxied %s", req.URL)
+	}))
+	defer proxy.Close()
+
+	client, err := newHTTPClient(HTTPClientConfig{ProxyURL: strings.Replace(proxy.URL, "//", "//user:pass@", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://maps.example.invalid/distance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "proxied http://maps.example.invalid/distance" {
+		t.Errorf("got %d %q", resp.StatusCode, body)
+	}
+
+	_, err = newHTTPClient(HTTPClientConfig{ProxyURL: "user:secret@proxy"})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("invalid proxy URL: %v", err)
+	}
+}
+
+func TestHTTPClientCAFile(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+
+	client, err := newHTTPClient(HTTPClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(upstream.URL); err == nil {
+		t.Errorf("trusted a certificate from an unknown CA")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err = newHTTPClient(HTTPClientConfig{CAFile: caFile, MaxIdleConns: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, err := newHTTPClient(HTTPClientConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Errorf("no error for a missing CA file")
+	}
+}
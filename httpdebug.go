@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// debugBodyLimit caps the bytes of each body logged in HTTP debug mode, so a
+// large upstream response doesn't flood the log.
+const debugBodyLimit = 2048
+
+// redactedQuery and redactedHeaders are never logged in HTTP debug mode,
+// e.g. the Google Maps API key.
+var (
+	redactedQuery   = []string{"key", "signature", "token", "access_token", "client_secret"}
+	redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Goog-Api-Key"}
+)
+
+// debugTransport is the http.RoundTripper of the service's HTTP client. While
+// enabled it logs every upstream request and its response, with secrets
+// redacted and bodies capped at debugBodyLimit. It is toggled at runtime
+// with PUT /admin/debug/http or SIGUSR1.
+type debugTransport struct {
+	next    http.RoundTripper
+	enabled int32 // 1 while logging, accessed atomically.
+}
+
+func newDebugTransport(next http.RoundTripper) *debugTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &debugTransport{next: next}
+}
+
+// SetEnabled turns logging on or off.
+func (t *debugTransport) SetEnabled(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&t.enabled, value)
+}
+
+// Enabled returns true if logging is on.
+func (t *debugTransport) Enabled() bool {
+	return atomic.LoadInt32(&t.enabled) == 1
+}
+
+// Toggle flips logging and returns whether it is now on.
+func (t *debugTransport) Toggle() bool {
+	for {
+		old := atomic.LoadInt32(&t.enabled)
+		if atomic.CompareAndSwapInt32(&t.enabled, old, 1-old) {
+			return old == 0
+		}
+	}
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.Enabled() {
+		return t.next.RoundTrip(req)
+	}
+	var body []byte
+	if req.GetBody != nil {
+		// A copy, a RoundTripper must not consume the request.
+		if copied, err := req.GetBody(); err == nil {
+			body, _ = ioutil.ReadAll(io.LimitReader(copied, debugBodyLimit+1))
+			copied.Close()
+		}
+	}
+	fmt.Printf("HTTP debug: > %s %s%s%s\n", req.Method, redactURL(req.URL), redactHeaders(req.Header),
+		debugBody(body, -1))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fmt.Printf("HTTP debug: < %s %s: %s\n", req.Method, redactURL(req.URL), err)
+		return nil, err
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response to log: %s", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fmt.Printf("HTTP debug: < %s %s%s%s\n", resp.Status, redactURL(req.URL), redactHeaders(resp.Header),
+		debugBody(body, len(body)))
+	return resp, nil
+}
+
+// redactURL returns u with the values of redactedQuery replaced.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	query := redacted.Query()
+	for _, name := range redactedQuery {
+		if _, ok := query[name]; ok {
+			query.Set(name, "REDACTED")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// redactHeaders formats header one per line, sorted, with the values of
+// redactedHeaders replaced.
+func redactHeaders(header http.Header) string {
+	var lines []string
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		for _, secret := range redactedHeaders {
+			if strings.EqualFold(name, secret) {
+				value = "REDACTED"
+			}
+		}
+		lines = append(lines, fmt.Sprintf("\n  %s: %s", name, value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
+
+// debugBody formats body cut to debugBodyLimit. size is the full size of the
+// body, -1 if unknown.
+func debugBody(body []byte, size int) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if len(body) <= debugBodyLimit {
+		return "\n" + string(body)
+	}
+	if size < 0 {
+		return fmt.Sprintf("\n%s... (truncated)", body[:debugBodyLimit])
+	}
+	return fmt.Sprintf("\n%s... (%d of %d bytes)", body[:debugBodyLimit], debugBodyLimit, size)
+}
+
+// HTTPDebugStatus is the body of GET and PUT /admin/debug/http.
+type HTTPDebugStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleHTTPDebug serves /admin/debug/http.
+//
+//	GET /admin/debug/http  returns the HTTPDebugStatus.
+//	PUT /admin/debug/http  sets it, e.g. {"enabled": true}.
+func (s *OrderService) handleHTTPDebug(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var status HTTPDebugStatus
+		if err := json.Unmarshal(buf.Bytes(), &status); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		s.httpDebug.SetEnabled(status.Enabled)
+	}
+	status := HTTPDebugStatus{Enabled: s.httpDebug.Enabled()}
+	respond(w, req, 200, status, "http debug=%t", status.Enabled)
+}
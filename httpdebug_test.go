@@ -0,0 +1,70 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPDebug(t *testing.T) {
+	large := strings.Repeat("x", debugBodyLimit+100)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Set-Cookie", "session=cookie-secret")
+		fmt.Fprint(w, large)
+	}))
+	defer upstream.Close()
+
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	get := func() string {
+		stdout := os.Stdout
+		r, w, _ := os.Pipe()
+		os.Stdout = w
+		req, _ := http.NewRequest("GET", upstream.URL+"/maps?origins=1,2&key=key-secret", nil)
+		req.Header.Set("Authorization", "Bearer token-secret")
+		resp, err := svc.Client.Do(req)
+		os.Stdout = stdout
+		w.Close()
+		logged, _ := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != large {
+			t.Errorf("got a body of %d bytes, want %d", len(body), len(large))
+		}
+		return string(logged)
+	}
+
+	if logged := get(); logged != "" {
+		t.Errorf("logged while disabled: %q", logged)
+	}
+
+	if w := serveAdmin(svc, "PUT", "/admin/debug/http", `{"enabled": true}`); w.Code != 200 {
+		t.Fatalf("PUT /admin/debug/http returned %d", w.Code)
+	}
+	logged := get()
+	for _, want := range []string{"> GET", "key=REDACTED", "Authorization: REDACTED", "< 200 OK",
+		"Set-Cookie: REDACTED", fmt.Sprintf("(%d of %d bytes)", debugBodyLimit, len(large))} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("log lacks %q: %q", want, logged)
+		}
+	}
+	if strings.Contains(logged, "secret") {
+		t.Errorf("log has a secret: %q", logged)
+	}
+
+	if svc.httpDebug.Toggle() {
+		t.Errorf("Toggle() did not turn debugging off")
+	}
+	if w := serveAdmin(svc, "GET", "/admin/debug/http", ""); !strings.Contains(w.Body.String(), `"enabled":false`) {
+		t.Errorf("GET /admin/debug/http returned %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is the language of error messages for clients that don't
+// ask for one of errorMessages.
+const defaultLanguage = "en"
+
+// errorMessages are the human readable messages of error codes, by language
+// then code, given to clients sending Accept-Language. Codes stay the same in every language, clients should match on
+// them; messages are meant to be shown to people, e.g. couriers. Every
+// language has the codes of defaultLanguage.
+var errorMessages = map[string]map[string]string{
+	"en": {
+		"ANOMALY_THROTTLED":        "Too many unusual orders were created. Try again later.",
+		"API_KEY_REQUIRED":         "An API key is required.",
+		"BANNED":                   "Too many failed requests. Try again later.",
+		"COURIER_BLOCKED":          "You can't take orders in this zone.",
+		"DISALLOWED_METHOD":        "This method is not allowed here.",
+		"DISTANCE_UNAVAILABLE":     "Distances can't be computed right now. Try again later.",
+		"DUPLICATE_ORDER":          "This order looks like a duplicate of a recent one.",
+		"IDEMPOTENCY_KEY_REUSED":   "This Idempotency-Key was used for another request.",
+		"IMMUTABLE_FIELDS":         "Some of these fields can't be changed.",
+		"INSUFFICIENT_SCOPE":       "You are not allowed to do this.",
+		"INTERNAL_ERROR":           "Something went wrong. Try again later.",
+		"INTERNAL_FAILURE":         "Something went wrong. Try again later.",
+		"INVALID_API_KEY":          "The API key is invalid.",
+		"INVALID_COURIER":          "The courier id is invalid.",
+		"INVALID_FIELD":            "A field has an invalid value.",
+		"INVALID_FIELDS":           "Some of the requested fields don't exist.",
+		"INVALID_LINKED_ORDER":     "The linked order doesn't exist.",
+		"INVALID_ORDER_ID":         "The order id is invalid.",
+		"INVALID_PARAMETERS":       "Some parameters are invalid.",
+		"INVALID_PATH":             "This address doesn't exist.",
+		"INVALID_PROMO_CODE":       "The promo code can't be used.",
+		"INVALID_RANGE":            "The Range header is invalid.",
+		"LINKED_ORDER_PENDING":     "This return trip can't be taken before its outbound order.",
+		"MAINTENANCE":              "The service is under maintenance. Try again later.",
+		"MALFORMED_DESTINATION":    "The destination must be a latitude and a longitude.",
+		"MALFORMED_ORIGIN":         "The origin must be a latitude and a longitude.",
+		"MALFORMED_PAYLOAD":        "The request body is not valid JSON.",
+		"MALFORMED_PROMO_CODE":     "The promo code is malformed.",
+		"NO_SUCH_ORDER":            "This order doesn't exist.",
+		"ORDER_ALREADY_BEEN_TAKEN": "This order has already been taken.",
+		"ORDER_ARCHIVED":           "This order is archived and can't be changed.",
+		"OUT_OF_SERVICE_AREA":      "This address is outside the service area.",
+		"OVERLOADED":               "The service is busy. Try again in a moment.",
+		"PAYMENT_REQUIRED":         "This order must be paid before it is taken.",
+		"POLICY_DENIED":            "This action is not allowed for this order.",
+		"QUOTA_EXCEEDED":           "The order quota is used up. Try again later.",
+		"RANGE_NOT_SATISFIABLE":    "There are no orders in this range.",
+		"REQUEST_IN_PROGRESS":      "The same request is still being processed.",
+		"TENANT_MISMATCH":          "This key belongs to another account.",
+		"TRACKING_DISABLED":        "Tracking is not available.",
+		"UNAUTHORIZED":             "Authentication is required.",
+		"UNKNOWN_FIELDS":           "Some fields are unknown.",
+		"UNSUPPORTED_API_VERSION":  "This API version is not supported.",
+		"UNSUPPORTED_MEDIA_TYPE":   "This content type is not supported.",
+		"VEHICLE_TOO_SMALL":        "This order doesn't fit in your vehicle.",
+	},
+	"es": {
+		"ANOMALY_THROTTLED":        "Se crearon demasiados pedidos inusuales. Inténtalo más tarde.",
+		"API_KEY_REQUIRED":         "Se requiere una clave de API.",
+		"BANNED":                   "Demasiadas solicitudes fallidas. Inténtalo más tarde.",
+		"COURIER_BLOCKED":          "No puedes tomar pedidos en esta zona.",
+		"DISALLOWED_METHOD":        "Este método no está permitido aquí.",
+		"DISTANCE_UNAVAILABLE":     "No se pueden calcular distancias ahora. Inténtalo más tarde.",
+		"DUPLICATE_ORDER":          "Este pedido parece un duplicado de uno reciente.",
+		"IDEMPOTENCY_KEY_REUSED":   "Esta Idempotency-Key se usó para otra solicitud.",
+		"IMMUTABLE_FIELDS":         "Algunos de estos campos no se pueden cambiar.",
+		"INSUFFICIENT_SCOPE":       "No tienes permiso para hacer esto.",
+		"INTERNAL_ERROR":           "Algo salió mal. Inténtalo más tarde.",
+		"INTERNAL_FAILURE":         "Algo salió mal. Inténtalo más tarde.",
+		"INVALID_API_KEY":          "La clave de API no es válida.",
+		"INVALID_COURIER":          "El identificador del repartidor no es válido.",
+		"INVALID_FIELD":            "Un campo tiene un valor no válido.",
+		"INVALID_FIELDS":           "Algunos de los campos pedidos no existen.",
+		"INVALID_LINKED_ORDER":     "El pedido vinculado no existe.",
+		"INVALID_ORDER_ID":         "El identificador del pedido no es válido.",
+		"INVALID_PARAMETERS":       "Algunos parámetros no son válidos.",
+		"INVALID_PATH":             "Esta dirección no existe.",
+		"INVALID_PROMO_CODE":       "El código promocional no se puede usar.",
+		"INVALID_RANGE":            "El encabezado Range no es válido.",
+		"LINKED_ORDER_PENDING":     "Este viaje de vuelta no se puede tomar antes que su pedido de ida.",
+		"MAINTENANCE":              "El servicio está en mantenimiento. Inténtalo más tarde.",
+		"MALFORMED_DESTINATION":    "El destino debe ser una latitud y una longitud.",
+		"MALFORMED_ORIGIN":         "El origen debe ser una latitud y una longitud.",
+		"MALFORMED_PAYLOAD":        "El cuerpo de la solicitud no es JSON válido.",
+		"MALFORMED_PROMO_CODE":     "El código promocional está mal formado.",
+		"NO_SUCH_ORDER":            "Este pedido no existe.",
+		"ORDER_ALREADY_BEEN_TAKEN": "Este pedido ya fue tomado.",
+		"ORDER_ARCHIVED":           "Este pedido está archivado y no se puede cambiar.",
+		"OUT_OF_SERVICE_AREA":      "Esta dirección está fuera del área de servicio.",
+		"OVERLOADED":               "El servicio está ocupado. Inténtalo en un momento.",
+		"PAYMENT_REQUIRED":         "Este pedido debe pagarse antes de tomarlo.",
+		"POLICY_DENIED":            "Esta acción no está permitida para este pedido.",
+		"QUOTA_EXCEEDED":           "Se agotó la cuota de pedidos. Inténtalo más tarde.",
+		"RANGE_NOT_SATISFIABLE":    "No hay pedidos en este rango.",
+		"REQUEST_IN_PROGRESS":      "La misma solicitud aún se está procesando.",
+		"TENANT_MISMATCH":          "Esta clave pertenece a otra cuenta.",
+		"TRACKING_DISABLED":        "El seguimiento no está disponible.",
+		"UNAUTHORIZED":             "Se requiere autenticación.",
+		"UNKNOWN_FIELDS":           "Algunos campos son desconocidos.",
+		"UNSUPPORTED_API_VERSION":  "Esta versión de la API no es compatible.",
+		"UNSUPPORTED_MEDIA_TYPE":   "Este tipo de contenido no es compatible.",
+		"VEHICLE_TOO_SMALL":        "Este pedido no cabe en tu vehículo.",
+	},
+	"zh": {
+		"ANOMALY_THROTTLED":        "创建的异常订单过多，请稍后再试。",
+		"API_KEY_REQUIRED":         "需要 API 密钥。",
+		"BANNED":                   "失败的请求过多，请稍后再试。",
+		"COURIER_BLOCKED":          "您不能接取此区域的订单。",
+		"DISALLOWED_METHOD":        "此处不允许使用该方法。",
+		"DISTANCE_UNAVAILABLE":     "暂时无法计算距离，请稍后再试。",
+		"DUPLICATE_ORDER":          "此订单似乎与最近的订单重复。",
+		"IDEMPOTENCY_KEY_REUSED":   "此 Idempotency-Key 已用于其他请求。",
+		"IMMUTABLE_FIELDS":         "其中一些字段无法更改。",
+		"INSUFFICIENT_SCOPE":       "您无权执行此操作。",
+		"INTERNAL_ERROR":           "出现问题，请稍后再试。",
+		"INTERNAL_FAILURE":         "出现问题，请稍后再试。",
+		"INVALID_API_KEY":          "API 密钥无效。",
+		"INVALID_COURIER":          "配送员 ID 无效。",
+		"INVALID_FIELD":            "某个字段的值无效。",
+		"INVALID_FIELDS":           "请求的某些字段不存在。",
+		"INVALID_LINKED_ORDER":     "关联的订单不存在。",
+		"INVALID_ORDER_ID":         "订单 ID 无效。",
+		"INVALID_PARAMETERS":       "部分参数无效。",
+		"INVALID_PATH":             "此地址不存在。",
+		"INVALID_PROMO_CODE":       "此优惠码无法使用。",
+		"INVALID_RANGE":            "Range 请求头无效。",
+		"LINKED_ORDER_PENDING":     "去程订单被接取之前，不能接取此返程订单。",
+		"MAINTENANCE":              "服务正在维护，请稍后再试。",
+		"MALFORMED_DESTINATION":    "目的地必须是纬度和经度。",
+		"MALFORMED_ORIGIN":         "起点必须是纬度和经度。",
+		"MALFORMED_PAYLOAD":        "请求内容不是有效的 JSON。",
+		"MALFORMED_PROMO_CODE":     "优惠码格式错误。",
+		"NO_SUCH_ORDER":            "此订单不存在。",
+		"ORDER_ALREADY_BEEN_TAKEN": "此订单已被接取。",
+		"ORDER_ARCHIVED":           "此订单已归档，无法更改。",
+		"OUT_OF_SERVICE_AREA":      "此地址不在服务范围内。",
+		"OVERLOADED":               "服务繁忙，请稍后再试。",
+		"PAYMENT_REQUIRED":         "此订单需先付款才能接取。",
+		"POLICY_DENIED":            "此订单不允许执行该操作。",
+		"QUOTA_EXCEEDED":           "订单配额已用完，请稍后再试。",
+		"RANGE_NOT_SATISFIABLE":    "此范围内没有订单。",
+		"REQUEST_IN_PROGRESS":      "相同的请求仍在处理中。",
+		"TENANT_MISMATCH":          "此密钥属于其他账户。",
+		"TRACKING_DISABLED":        "无法使用跟踪功能。",
+		"UNAUTHORIZED":             "需要身份验证。",
+		"UNKNOWN_FIELDS":           "部分字段未知。",
+		"UNSUPPORTED_API_VERSION":  "不支持此 API 版本。",
+		"UNSUPPORTED_MEDIA_TYPE":   "不支持此内容类型。",
+		"VEHICLE_TOO_SMALL":        "此订单无法装入您的车辆。",
+	},
+}
+
+// acceptLanguages returns the language tags of an Accept-Language header in
+// lower case, most preferred first, without "*" and those with q=0.
+func acceptLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			ranges = append(ranges, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	tags := make([]string, len(ranges))
+	for i, r := range ranges {
+		tags[i] = r.tag
+	}
+	return tags
+}
+
+// negotiateLanguage returns the language of errorMessages the Accept-Language
+// header prefers, e.g. "es" for "es-MX,en;q=0.8", defaultLanguage if none.
+func negotiateLanguage(header string) string {
+	for _, tag := range acceptLanguages(header) {
+		language := strings.SplitN(tag, "-", 2)[0]
+		if _, ok := errorMessages[language]; ok {
+			return language
+		}
+	}
+	return defaultLanguage
+}
+
+// errorMessage returns the message of an error code in the language
+// Accept-Language header prefers, and that language. Codes without a message
+// return "".
+func errorMessage(code, header string) (string, string) {
+	language := negotiateLanguage(header)
+	return errorMessages[language][code], language
+}
+
+// Units of distance texts.
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+)
+
+// imperialRegions are the regions whose road distances are in miles.
+var imperialRegions = map[string]bool{"us": true, "gb": true, "lr": true, "mm": true}
+
+// numberSeparators are the digit group and decimal separators of languages
+// that don't write numbers like English, "1,735.5".
+var numberSeparators = map[string][2]string{
+	"cs": {" ", ","}, "da": {".", ","}, "de": {".", ","}, "es": {".", ","}, "fi": {" ", ","},
+	"fr": {" ", ","}, "id": {".", ","}, "it": {".", ","}, "nb": {" ", ","}, "nl": {".", ","},
+	"pl": {" ", ","}, "pt": {".", ","}, "ru": {" ", ","}, "sv": {" ", ","}, "tr": {".", ","},
+	"uk": {" ", ","},
+}
+
+// formatDistance returns meters as people of locale, a language tag such as
+// "en-us", read it: "850 m", "1.8 km" or "1,735 km" in metric units, "528
+// ft", "1.1 mi" or "1,078 mi" in imperial ones. units is unitsMetric or
+// unitsImperial, or empty for those of the locale's region.
+func formatDistance(meters float64, locale, units string) string {
+	parts := strings.SplitN(strings.ToLower(locale), "-", 3)
+	if units == "" {
+		units = unitsMetric
+		for _, subtag := range parts[1:] {
+			if imperialRegions[subtag] {
+				units = unitsImperial
+			}
+		}
+	}
+	separators, ok := numberSeparators[parts[0]]
+	if !ok {
+		separators = [2]string{",", "."}
+	}
+	number := func(value float64, decimals int) string {
+		text := strconv.FormatFloat(value, 'f', decimals, 64)
+		whole, fraction := text, ""
+		if i := strings.IndexByte(text, '.'); i >= 0 {
+			whole, fraction = text[:i], separators[1]+text[i+1:]
+		}
+		for i := len(whole) - 3; i > 0; i -= 3 {
+			whole = whole[:i] + separators[0] + whole[i:]
+		}
+		return whole + fraction
+	}
+	if units == unitsImperial {
+		switch miles := meters / 1609.344; {
+		case miles < 0.1:
+			return number(math.Round(meters/0.3048), 0) + " ft"
+		case miles < 10:
+			return number(miles, 1) + " mi"
+		default:
+			return number(math.Round(miles), 0) + " mi"
+		}
+	}
+	switch {
+	case meters < 1000:
+		return number(math.Round(meters), 0) + " m"
+	case meters < 10000:
+		return number(meters/1000, 1) + " km"
+	default:
+		return number(math.Round(meters/1000), 0) + " km"
+	}
+}
+
+// distanceText formats meters for the client of req, in the locale its
+// Accept-Language prefers and the units of ?units=, metric or imperial, if
+// valid.
+func distanceText(req *http.Request, meters float64) string {
+	locale := defaultLanguage
+	if tags := acceptLanguages(req.Header.Get("Accept-Language")); len(tags) > 0 {
+		locale = tags[0]
+	}
+	units := req.URL.Query().Get("units")
+	if units != unitsMetric && units != unitsImperial {
+		units = ""
+	}
+	return formatDistance(meters, locale, units)
+}
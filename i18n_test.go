@@ -0,0 +1,131 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                     "en",
+		"es":                   "es",
+		"es-MX,en;q=0.8":       "es",
+		"en;q=0.5, zh-CN":      "zh",
+		"fr-CH, fr;q=0.9, *":   "en",
+		"de, es;q=0.3":         "es",
+		"ZH-Hans;q=0.9,es;q=0": "zh",
+	} {
+		if got := negotiateLanguage(header); got != want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	for language, messages := range errorMessages {
+		for code := range errorMessages[defaultLanguage] {
+			if messages[code] == "" {
+				t.Errorf("no %s message for %s", language, code)
+			}
+		}
+		if len(messages) != len(errorMessages[defaultLanguage]) {
+			t.Errorf("%s has %d messages, %s %d", language, len(messages), defaultLanguage,
+				len(errorMessages[defaultLanguage]))
+		}
+	}
+
+	svc := newTestService(t, Config{})
+	get := func(language, accept string) (*httptest.ResponseRecorder, HTTPResponseError) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/orders/9", nil)
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		var body HTTPResponseError
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+	for language, want := range map[string]string{
+		"es-ES": "Este pedido no existe.",
+		"zh-CN": "此订单不存在。",
+		"fr":    "This order doesn't exist.",
+	} {
+		w, body := get(language, "")
+		if w.Code != 404 || body.Error != "NO_SUCH_ORDER" || body.Message != want {
+			t.Errorf("GET in %s returned %d %+v", language, w.Code, body)
+		}
+		if got := w.Header().Get("Content-Language"); got != negotiateLanguage(language) {
+			t.Errorf("GET in %s has Content-Language %q", language, got)
+		}
+	}
+	if w, body := get("", ""); body.Message != "" || w.Header().Get("Content-Language") != "" ||
+		w.Header().Get("Vary") != "Accept-Language" {
+		t.Errorf("GET without Accept-Language returned %+v %v", body, w.Header())
+	}
+	if w, _ := get("es", jsonAPIMediaType); !strings.Contains(w.Body.String(), `"title":"Este pedido no existe."`) {
+		t.Errorf("JSON:API error is %s", w.Body)
+	}
+}
+
+func TestFormatDistance(t *testing.T) {
+	for _, c := range []struct {
+		meters        float64
+		locale, units string
+		want          string
+	}{
+		{850, "en", "", "850 m"},
+		{1816, "en", "", "1.8 km"},
+		{12345678, "en", "", "12,346 km"},
+		{1735000, "fr-fr", "", "1 735 km"},
+		{1735000, "de", "", "1.735 km"},
+		{1816, "es-es", "", "1,8 km"},
+		{1735000, "zh-hans-cn", "", "1,735 km"},
+		{1735000, "en-us", "", "1,078 mi"},
+		{1816, "en-gb", "", "1.1 mi"},
+		{50, "en-us", "", "164 ft"},
+		{1816, "en-us", unitsMetric, "1.8 km"},
+		{1735000, "fr", unitsImperial, "1 078 mi"},
+	} {
+		if got := formatDistance(c.meters, c.locale, c.units); got != c.want {
+			t.Errorf("formatDistance(%v, %q, %q) = %q, want %q", c.meters, c.locale, c.units, got, c.want)
+		}
+	}
+
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	for path, want := range map[string]string{
+		"/orders/1":                "1.8 km",
+		"/orders/1?units=imperial": "1.1 mi",
+		"/orders/1?units=furlongs": "1.8 km",
+	} {
+		w := serve(svc, "GET", path, "", "")
+		var order OrderDTO
+		if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.DistanceText != want {
+			t.Errorf("GET %s has distance_text %q, want %q", path, order.DistanceText, want)
+		}
+	}
+	req := httptest.NewRequest("POST", "/orders/quote", strings.NewReader(createOrderDetails))
+	req.Header.Set("Accept-Language", "es-ES, en;q=0.5")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	var quote Quote
+	if err := json.NewDecoder(w.Body).Decode(&quote); err != nil || quote.DistanceText != "1,8 km" {
+		t.Errorf("quote in Spanish has distance_text %q, %v", quote.DistanceText, err)
+	}
+	w = serve(svc, "GET", "/orders", "", "")
+	if strings.Contains(w.Body.String(), "distance_text") {
+		t.Errorf("GET /orders has distance_text: %s", w.Body)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	// idempotencyKeyHeader names a POST so that retries of it are answered
+	// with the response of the first rather than repeated.
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader is set on responses replayed for a retry.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKey is the longest key accepted.
+	maxIdempotencyKey = 255
+	// idempotencyLockTimeout is how long a request may hold its key, a
+	// replica that died serving it leaves it held at most that long.
+	idempotencyLockTimeout = time.Minute
+)
+
+// IdempotencyConfig configures the Idempotency-Key of POST requests.
+type IdempotencyConfig struct {
+	// How long keys and their responses are kept, 0 ignores Idempotency-Key.
+	TTL time.Duration
+	// Largest response body kept. Retries of a request with a larger
+	// response get 409 IDEMPOTENT_RESPONSE_TOO_LARGE.
+	MaxBody int
+}
+
+// storedResponse is what an idempotencyStore keeps of a request and its
+// response.
+type storedResponse struct {
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"` // 0 while the request is in progress.
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	Truncated   bool      `json:"truncated,omitempty"` // Body was too large to keep.
+	Created     time.Time `json:"created"`
+}
+
+// idempotencyStore keeps the responses of requests by key, shared by the
+// replicas.
+type idempotencyStore interface {
+	// reserve claims key for a request with fingerprint at now. It returns
+	// nil if the request is the first with key, the response stored for
+	// the first otherwise, with Status 0 while it is in progress.
+	reserve(ctx context.Context, key, fingerprint string, now time.Time) (*storedResponse, error)
+	// save stores the response of the request that reserved key.
+	save(ctx context.Context, key string, resp *storedResponse) error
+	// release forgets key, so that the request can be retried.
+	release(ctx context.Context, key string) error
+	// purge forgets the keys reserved before, returning how many.
+	purge(ctx context.Context, before time.Time) (int64, error)
+}
+
+// dbIdempotencyStore keeps the responses in the idempotency_keys table.
+type dbIdempotencyStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func (s *dbIdempotencyStore) reserve(ctx context.Context, key, fingerprint string, now time.Time) (*storedResponse,
+	error) {
+	// Takes over keys that expired but were not purged yet, or whose
+	// request was abandoned.
+	result, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (key, fingerprint, status, created_at)
+		VALUES (?, ?, 0, ?) ON CONFLICT (key) DO UPDATE SET fingerprint = excluded.fingerprint, status = 0,
+		content_type = NULL, body = NULL, truncated = 0, created_at = excluded.created_at
+		WHERE created_at < ? OR (status = 0 AND created_at < ?)`,
+		key, fingerprint, now.Unix(), now.Add(-s.ttl).Unix(), now.Add(-idempotencyLockTimeout).Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to reserve idempotency key: %s", err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 1 {
+		return nil, err
+	}
+	var (
+		resp        storedResponse
+		contentType sql.NullString
+		created     int64
+	)
+	err = s.db.QueryRowContext(ctx, `SELECT fingerprint, status, content_type, body, truncated, created_at
+		FROM idempotency_keys WHERE key = ?`, key).Scan(&resp.Fingerprint, &resp.Status, &contentType, &resp.Body,
+		&resp.Truncated, &created)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query idempotency key: %s", err)
+	}
+	resp.ContentType = contentType.String
+	resp.Created = time.Unix(created, 0)
+	return &resp, nil
+}
+
+func (s *dbIdempotencyStore) save(ctx context.Context, key string, resp *storedResponse) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET status = ?, content_type = ?, body = ?, truncated = ?
+		WHERE key = ?`, resp.Status, resp.ContentType, resp.Body, resp.Truncated, key)
+	if err != nil {
+		return fmt.Errorf("unable to save idempotent response: %s", err)
+	}
+	return nil
+}
+
+func (s *dbIdempotencyStore) release(ctx context.Context, key string) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = ?", key); err != nil {
+		return fmt.Errorf("unable to release idempotency key: %s", err)
+	}
+	return nil
+}
+
+func (s *dbIdempotencyStore) purge(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at < ?", before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("unable to purge idempotency keys: %s", err)
+	}
+	return result.RowsAffected()
+}
+
+// redisIdempotencyStore keeps the responses in Redis, as JSON
+// storedResponses under "idempotency:{key}", which Redis expires.
+type redisIdempotencyStore struct {
+	redis *redisClient
+	ttl   time.Duration
+}
+
+func (s *redisIdempotencyStore) reserve(ctx context.Context, key, fingerprint string, now time.Time) (*storedResponse,
+	error) {
+	pending, _ := json.Marshal(storedResponse{Fingerprint: fingerprint, Created: now})
+	reply, err := s.redis.do(ctx, "SET", "idempotency:"+key, pending, "NX", "PX", s.ttl.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("unable to reserve idempotency key: %s", err)
+	}
+	if reply == "OK" {
+		return nil, nil
+	}
+	stored, err := redisString(s.redis.do(ctx, "GET", "idempotency:"+key))
+	if err != nil {
+		return nil, fmt.Errorf("unable to query idempotency key: %s", err)
+	}
+	var resp storedResponse
+	if stored == "" || json.Unmarshal([]byte(stored), &resp) != nil ||
+		(resp.Status == 0 && now.Sub(resp.Created) > idempotencyLockTimeout) {
+		// Expired in between, or abandoned.
+		if _, err := s.redis.do(ctx, "SET", "idempotency:"+key, pending, "PX", s.ttl.Milliseconds()); err != nil {
+			return nil, fmt.Errorf("unable to reserve idempotency key: %s", err)
+		}
+		return nil, nil
+	}
+	return &resp, nil
+}
+
+func (s *redisIdempotencyStore) save(ctx context.Context, key string, resp *storedResponse) error {
+	encoded, _ := json.Marshal(resp)
+	if _, err := s.redis.do(ctx, "SET", "idempotency:"+key, encoded, "PX", s.ttl.Milliseconds()); err != nil {
+		return fmt.Errorf("unable to save idempotent response: %s", err)
+	}
+	return nil
+}
+
+func (s *redisIdempotencyStore) release(ctx context.Context, key string) error {
+	if _, err := s.redis.do(ctx, "DEL", "idempotency:"+key); err != nil {
+		return fmt.Errorf("unable to release idempotency key: %s", err)
+	}
+	return nil
+}
+
+// purge does nothing, Redis expires the keys.
+func (s *redisIdempotencyStore) purge(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// idempotencyRecorder keeps a copy of a response, up to max bytes of body.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	if !r.truncated {
+		if r.body.Len()+len(b) > r.max {
+			r.truncated = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses working through an idempotencyRecorder.
+func (r *idempotencyRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// idempotencyFingerprint identifies the request a key is used for, by its
+// method, URL and body.
+func idempotencyFingerprint(req *http.Request, body []byte) string {
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %s\n", req.Method, req.URL.RequestURI())
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// serveIdempotent serves a POST with an Idempotency-Key with next the first
+// time, and the response of the first to its retries within the TTL. Keys
+// are per tenant. Failures, 5xx responses, are not kept so the request can
+// be retried.
+func (s *OrderService) serveIdempotent(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	key := req.Header.Get(idempotencyKeyHeader)
+	if key == "" || s.idempotency == nil || req.Method != http.MethodPost {
+		next.ServeHTTP(w, req)
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_IDEMPOTENCY_KEY",
+			Detail: fmt.Sprintf("%s is longer than %d bytes", idempotencyKeyHeader, maxIdempotencyKey)},
+			"idempotency key too long")
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+		return
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fingerprint := idempotencyFingerprint(req, body)
+	key = tenantFromRequest(req) + "/" + key
+
+	ctx := req.Context()
+	stored, err := s.idempotency.reserve(ctx, key, fingerprint, time.Now())
+	switch {
+	case err != nil:
+		w.Header().Set("Retry-After", "1")
+		respond(w, req, 503, HTTPResponseError{Error: "IDEMPOTENCY_UNAVAILABLE"}, "%s", err)
+		return
+	case stored == nil:
+	case stored.Fingerprint != fingerprint:
+		respond(w, req, 422, HTTPResponseError{Error: "IDEMPOTENCY_KEY_REUSED",
+			Detail: "the key was used for another request"}, "idempotency key %q reused", key)
+		return
+	case stored.Status == 0:
+		w.Header().Set("Retry-After", "1")
+		respond(w, req, 409, HTTPResponseError{Error: "REQUEST_IN_PROGRESS",
+			Detail: "a request with the same key is in progress"}, "idempotency key %q in progress", key)
+		return
+	case stored.Truncated:
+		respond(w, req, 409, HTTPResponseError{Error: "IDEMPOTENT_RESPONSE_TOO_LARGE",
+			Detail: "the request was served but its response was too large to keep"}, "idempotency key %q", key)
+		return
+	default:
+		if stored.ContentType != "" {
+			w.Header().Set("Content-Type", stored.ContentType)
+		}
+		w.Header().Set(idempotentReplayedHeader, "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		fmt.Printf("Method:%s; Path:%s, %d replayed for idempotency key %q\n", req.Method, req.URL.Path,
+			stored.Status, key)
+		return
+	}
+
+	recorder := &idempotencyRecorder{ResponseWriter: w, max: s.config.Idempotency.MaxBody}
+	next.ServeHTTP(recorder, req)
+	// The client may be gone, the response must still be kept.
+	ctx = context.Background()
+	if recorder.code == 0 {
+		recorder.code = http.StatusOK
+	}
+	if recorder.code >= 500 {
+		err = s.idempotency.release(ctx, key)
+	} else {
+		resp := &storedResponse{Fingerprint: fingerprint, Status: recorder.code,
+			ContentType: recorder.Header().Get("Content-Type"), Truncated: recorder.truncated}
+		if !recorder.truncated {
+			resp.Body = recorder.body.Bytes()
+		}
+		err = s.idempotency.save(ctx, key, resp)
+	}
+	if err != nil {
+		fmt.Printf("Idempotency: %s\n", err)
+	}
+}
+
+// purgeIdempotencyKeys forgets expired idempotency keys every interval until
+// ctx is done.
+func (s *OrderService) purgeIdempotencyKeys(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.idempotency.purge(ctx, time.Now().Add(-s.config.Idempotency.TTL))
+			if err != nil {
+				fmt.Printf("Idempotency: %s\n", err)
+			} else if n > 0 {
+				fmt.Printf("Idempotency: purged %d expired keys\n", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveIdempotencyKey sends a POST with an Idempotency-Key as tenant.
+func serveIdempotencyKey(svc *OrderService, path, tenant, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set(tenantHeader, tenant)
+	req.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func testIdempotency(t *testing.T, svc *OrderService) {
+	first := serveIdempotencyKey(svc, "/orders", "acme", "k1", createOrderDetails)
+	if first.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", first.Code, first.Body)
+	}
+	retry := serveIdempotencyKey(svc, "/orders", "acme", "k1", createOrderDetails)
+	if retry.Code != 200 || retry.Body.String() != first.Body.String() ||
+		retry.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("retry returned %d %q: %s", retry.Code, retry.Header(), retry.Body)
+	}
+	var orders int
+	svc.DB.QueryRow("SELECT COUNT(*) FROM orders").Scan(&orders)
+	if orders != 1 {
+		t.Errorf("got %d orders after a retry, want 1", orders)
+	}
+
+	if w := serveIdempotencyKey(svc, "/orders", "acme", "k1", `{}`); w.Code != 422 ||
+		!strings.Contains(w.Body.String(), "IDEMPOTENCY_KEY_REUSED") {
+		t.Errorf("key reused for another request returned %d %s", w.Code, w.Body)
+	}
+	if w := serveIdempotencyKey(svc, "/orders", "beta", "k1", createOrderDetails); w.Code != 200 ||
+		w.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("key of another tenant returned %d %q", w.Code, w.Header())
+	}
+	if w := serveIdempotencyKey(svc, "/orders", "acme", strings.Repeat("k", 256), createOrderDetails); w.Code != 400 {
+		t.Errorf("long key returned %d", w.Code)
+	}
+
+	// A request in progress.
+	fingerprint := idempotencyFingerprint(httptest.NewRequest("POST", "/orders", nil), []byte(createOrderDetails))
+	if _, err := svc.idempotency.reserve(context.Background(), "acme/k2", fingerprint, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveIdempotencyKey(svc, "/orders", "acme", "k2", createOrderDetails); w.Code != 409 ||
+		!strings.Contains(w.Body.String(), "REQUEST_IN_PROGRESS") {
+		t.Errorf("key in progress returned %d %s", w.Code, w.Body)
+	}
+	// Abandoned by a replica that died.
+	if _, err := svc.idempotency.reserve(context.Background(), "acme/k3", fingerprint,
+		time.Now().Add(-2*idempotencyLockTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveIdempotencyKey(svc, "/orders", "acme", "k3", createOrderDetails); w.Code != 200 {
+		t.Errorf("abandoned key returned %d %s", w.Code, w.Body)
+	}
+
+	// Failures are not kept.
+	failures := 0
+	fail := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		failures++
+		w.WriteHeader(500)
+	})
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader(createOrderDetails))
+		req.Header.Set(idempotencyKeyHeader, "k4")
+		svc.serveIdempotent(httptest.NewRecorder(), req, fail)
+	}
+	if failures != 2 {
+		t.Errorf("failed request served %d times, want 2", failures)
+	}
+
+	// Responses too large to keep.
+	svc.config.Idempotency.MaxBody = 10
+	if w := serveIdempotencyKey(svc, "/orders", "acme", "k5", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if w := serveIdempotencyKey(svc, "/orders", "acme", "k5", createOrderDetails); w.Code != 409 ||
+		!strings.Contains(w.Body.String(), "IDEMPOTENT_RESPONSE_TOO_LARGE") {
+		t.Errorf("retry of a large response returned %d %s", w.Code, w.Body)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	svc := newTestService(t, Config{Idempotency: IdempotencyConfig{TTL: time.Hour, MaxBody: 1 << 10}})
+	testIdempotency(t, svc)
+
+	// Expired keys are taken over, then purged.
+	ctx := context.Background()
+	if stored, err := svc.idempotency.reserve(ctx, "acme/k1", "other", time.Now().Add(2*time.Hour)); err != nil ||
+		stored != nil {
+		t.Errorf("reserve() of an expired key returned %+v, %v", stored, err)
+	}
+	n, err := svc.idempotency.purge(ctx, time.Now().Add(time.Minute))
+	if err != nil || n == 0 {
+		t.Errorf("purge() returned %d, %v", n, err)
+	}
+	var left int
+	svc.DB.QueryRow("SELECT COUNT(*) FROM idempotency_keys").Scan(&left)
+	if left != 1 {
+		t.Errorf("got %d keys after purge, want the 1 reserved in the future", left)
+	}
+}
+
+func TestIdempotencyRedis(t *testing.T) {
+	server := newFakeRedis(t, "")
+	svc := newTestService(t, Config{Redis: server.URL(),
+		Idempotency: IdempotencyConfig{TTL: time.Hour, MaxBody: 1 << 10}})
+	if _, ok := svc.idempotency.(*redisIdempotencyStore); !ok {
+		t.Fatalf("got idempotency store %T", svc.idempotency)
+	}
+	testIdempotency(t, svc)
+
+	server.Close()
+	svc.redis.Close()
+	if w := serveIdempotencyKey(svc, "/orders", "acme", "k6", createOrderDetails); w.Code != 503 {
+		t.Errorf("POST while Redis is down returned %d", w.Code)
+	}
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Errorf("POST without a key while Redis is down returned %d", w.Code)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Names of the ID strategies. Orders always have a sequential integer id,
+// the other strategies add a text uid that does not reveal how many orders
+// there are and does not collide when databases are merged.
+const (
+	idSequential = "sequential"
+	idUUIDv7     = "uuidv7"
+	idULID       = "ulid"
+)
+
+// IDGenerator makes uids for new orders.
+type IDGenerator interface {
+	NewID() string
+}
+
+// newIDGenerator returns the generator for strategy, nil for sequential ids.
+func newIDGenerator(strategy string) (IDGenerator, error) {
+	switch strategy {
+	case "", idSequential:
+		return nil, nil
+	case idUUIDv7:
+		return uuidV7{now: time.Now}, nil
+	case idULID:
+		return ulid{now: time.Now}, nil
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q", strategy)
+	}
+}
+
+// timeOrderedID returns 16 random bytes starting with the big-endian 48-bit
+// Unix time in milliseconds, the layout shared by UUIDv7 and ULID.
+func timeOrderedID(now time.Time) [16]byte {
+	var id [16]byte
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %s", err))
+	}
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(now.UnixNano()/int64(time.Millisecond)))
+	copy(id[:6], ms[2:])
+	return id
+}
+
+// uuidV7 makes RFC 9562 version 7 UUIDs.
+type uuidV7 struct {
+	now func() time.Time
+}
+
+func (g uuidV7) NewID() string {
+	return formatUUIDv7(timeOrderedID(g.now()))
+}
+
+func formatUUIDv7(id [16]byte) string {
+	id[6] = id[6]&0x0f | 0x70 // Version 7.
+	id[8] = id[8]&0x3f | 0x80 // Variant 10.
+	encoded := hex.EncodeToString(id[:])
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+}
+
+// ulid makes ULIDs, https://github.com/ulid/spec.
+type ulid struct {
+	now func() time.Time
+}
+
+func (g ulid) NewID() string {
+	return formatULID(timeOrderedID(g.now()))
+}
+
+// formatULID encodes the 128 bits of id as 26 characters of Crockford's
+// base32.
+func formatULID(id [16]byte) string {
+	const alphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = alphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// orderIDFromPath resolves the order reference in a URL, either the integer
+// id or the uid, to the order's id. Orders of other tenants than tenant, if
+// set, don't exist for it, see orderScope. Responds with an error and returns
+// false if it can't.
+func (s *OrderService) orderIDFromPath(w http.ResponseWriter, req *http.Request, ref string,
+	tenant *string) (int64, bool) {
+	if ref == "" {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_ORDER_ID"}, "invalid id")
+		return 0, false
+	}
+	column := "uid"
+	if _, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		column = "id"
+	}
+	orderID, err := s.tenantOrderID(tenant, column, ref)
+	switch {
+	case err == errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %s", ref)
+		return 0, false
+	case err != nil:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_ERROR"}, "%s", err)
+		return 0, false
+	}
+	return orderID, true
+}
+
+// tenantOrderID returns the id of the order, current or archived, whose
+// column, id or uid, is value, or errNoSuchOrder. If tenant is set the order
+// must be one of tenant.
+func (s *OrderService) tenantOrderID(tenant *string, column string, value interface{}) (int64, error) {
+	// NULL matches every tenant.
+	var orderID int64
+	err := s.DB.QueryRow("SELECT id FROM orders WHERE "+column+" = ? AND tenant_id = COALESCE(?, tenant_id) UNION ALL "+
+		"SELECT id FROM orders_archive WHERE "+column+" = ? AND tenant_id = COALESCE(?, tenant_id)", value, tenant, value,
+		tenant).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return 0, errNoSuchOrder
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to look up order %s %v: %s", column, value, err)
+	}
+	return orderID, nil
+}
+
+// AssignUIDs gives a uid made by ids to every order without one, e.g. after
+// switching a database from sequential ids. Returns the number of orders
+// updated.
+func AssignUIDs(db *sql.DB, ids IDGenerator) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed at Begin: %s", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM orders WHERE uid IS NULL ORDER BY id")
+	if err != nil {
+		return 0, fmt.Errorf("unable to query orders: %s", err)
+	}
+	var orderIDs []int64
+	for rows.Next() {
+		var orderID int64
+		if err := rows.Scan(&orderID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to query orders: %s", err)
+	}
+
+	for _, orderID := range orderIDs {
+		event, err := newEvent(orderID, EventIdentified, orderIdentified{UID: ids.NewID()})
+		if err != nil {
+			return 0, err
+		}
+		// Identified events hold nothing encrypted, no need for a key.
+		if err := record(tx, nil, event); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit uids: %s", err)
+	}
+	return len(orderIDs), nil
+}
+
+// assignUIDsMain implements "orderservice assign-uids".
+func assignUIDsMain(args []string) error {
+	flags := flag.NewFlagSet("assign-uids", flag.ContinueOnError)
+	dbpath := flags.String("dbpath", "", "Path to database")
+	strategy := flags.String("id-strategy", idULID, "uuidv7 or ulid")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dbpath == "" {
+		return fmt.Errorf("missing db name")
+	}
+	ids, err := newIDGenerator(*strategy)
+	if err != nil {
+		return err
+	}
+	if ids == nil {
+		return fmt.Errorf("-id-strategy %s does not make uids", *strategy)
+	}
+	db, err := sql.Open("sqlite3", *dbpath)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+	}
+	defer db.Close()
+
+	n, err := AssignUIDs(db, ids)
+	if err != nil {
+		return fmt.Errorf("assign-uids failed: %s", err)
+	}
+	fmt.Printf("Assigned uids to %d orders.\n", n)
+	return nil
+}
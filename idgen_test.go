@@ -0,0 +1,97 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatULID(t *testing.T) {
+	// Timestamp from the example in the ULID spec.
+	id := timeOrderedID(time.Unix(0, 1469918176385*int64(time.Millisecond)))
+	for i := 6; i < len(id); i++ {
+		id[i] = 0
+	}
+	if got := formatULID(id); got != "01ARYZ6S410000000000000000" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestUUIDv7(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	gen := uuidV7{now: func() time.Time { return now }}
+	first := gen.NewID()
+	uuidRE := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	if !uuidRE.MatchString(first) {
+		t.Errorf("not a UUIDv7: %s", first)
+	}
+	now = now.Add(time.Millisecond)
+	if second := gen.NewID(); second <= first {
+		t.Errorf("%s does not sort after %s", second, first)
+	}
+}
+
+func TestOrderUIDs(t *testing.T) {
+	svc := newTestService(t, Config{IDStrategy: idULID, AdminToken: "secret"})
+	w := serve(svc, "POST", "/orders", "", createOrderDetails)
+	var created OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.UID) != 26 {
+		t.Fatalf("expected a ULID, got %+v", created)
+	}
+
+	// Orders are reachable by uid and by id.
+	for _, path := range []string{"/orders/" + created.UID, "/orders/1"} {
+		w := serve(svc, "GET", path, "", "")
+		var order OrderDTO
+		if err := json.NewDecoder(w.Body).Decode(&order); err != nil || !reflect.DeepEqual(order, created) {
+			t.Errorf("GET %s: %+v, %v", path, order, err)
+		}
+	}
+	if w := serve(svc, "GET", "/orders/"+created.UID+"/history", "", ""); w.Code != 200 {
+		t.Errorf("GET history by uid returned %d", w.Code)
+	}
+	if w := serve(svc, "PATCH", "/orders/"+created.UID, "", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Errorf("PATCH by uid returned %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/orders/01ARYZ6S410000000000000000", "", ""); w.Code != 404 {
+		t.Errorf("expected 404 for unknown uid, got %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/orders?fields=uid", "", ""); !strings.Contains(w.Body.String(), created.UID) {
+		t.Errorf("listing is missing the uid: %s", w.Body)
+	}
+}
+
+func TestAssignUIDs(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for i := 0; i < 2; i++ {
+		serve(svc, "POST", "/orders", "", createOrderDetails)
+	}
+	if order, _ := svc.Get(1); order.UID != "" {
+		t.Fatalf("sequential ids made uid %s", order.UID)
+	}
+
+	n, err := AssignUIDs(svc.DB, uuidV7{now: time.Now})
+	if err != nil || n != 2 {
+		t.Fatalf("AssignUIDs: %d, %v", n, err)
+	}
+	order, err := svc.Get(2)
+	if err != nil || order.UID == "" {
+		t.Fatalf("order 2 has no uid: %+v, %v", order, err)
+	}
+	// The uids survive a replay.
+	if problems, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(problems) != 0 {
+		t.Errorf("verify: %v, %v", problems, err)
+	}
+	if n, err := AssignUIDs(svc.DB, uuidV7{now: time.Now}); err != nil || n != 0 {
+		t.Errorf("second AssignUIDs: %d, %v", n, err)
+	}
+}
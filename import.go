@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of an import.
+const (
+	importRunning = "RUNNING"
+	importDone    = "DONE"
+)
+
+// Formats of import files.
+const (
+	importCSV    = "csv"
+	importNDJSON = "ndjson"
+)
+
+// Limits of import files, larger files are rejected with 413.
+const (
+	importMaxRows  = 10000
+	importMaxBytes = 10 << 20
+)
+
+// importColumns are the columns of CSV import files, in any order.
+var importColumns = []string{"origin_lat", "origin_lng", "destination_lat", "destination_lng"}
+
+// ImportResult is the outcome of one row of an import file.
+type ImportResult struct {
+	Row     int    `json:"row"` // 1 is the first order in the file.
+	OrderID int64  `json:"order_id,omitempty"`
+	Error   string `json:"error,omitempty"` // An error code of POST /orders.
+}
+
+// ImportReport is the body of GET /orders/imports/{id}. Results are filled
+// in once Status is DONE.
+type ImportReport struct {
+	ID         string         `json:"id"`
+	TenantID   string         `json:"tenant_id,omitempty"`
+	Status     string         `json:"status"`
+	Rows       int            `json:"rows"`
+	Created    int            `json:"created"`
+	Failed     int            `json:"failed"`
+	Results    []ImportResult `json:"results,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// importRow is a parsed row of an import file, with details or the reason it
+// is invalid.
+type importRow struct {
+	details    *CreateOrderDetails
+	externalID string // Of feeds only.
+	err        error
+}
+
+// errImportTooLarge is returned for files over importMaxRows.
+var errImportTooLarge = fmt.Errorf("more than %d rows", importMaxRows)
+
+// importFormat returns the format of a file from its media type, or failing
+// that its name.
+func importFormat(mediaType, name string) (string, bool) {
+	mediaType, _, _ = mime.ParseMediaType(mediaType)
+	switch mediaType {
+	case "text/csv":
+		return importCSV, true
+	case ndjsonMediaType, "application/jsonl":
+		return importNDJSON, true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return importCSV, true
+	case ".ndjson", ".jsonl":
+		return importNDJSON, true
+	}
+	return "", false
+}
+
+// parseImport reads an import file. Rows that are not valid orders are
+// returned with an error, the file is only rejected as a whole if it can't
+// be read, a CSV header is wrong or it is too large.
+func parseImport(r io.Reader, format string) ([]importRow, error) {
+	var rows []importRow
+	switch format {
+	case importCSV:
+		return parseImportCSV(r, false)
+	case importNDJSON:
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			details, err := parseCreateOrderDetails(line, true)
+			rows = append(rows, importRow{details: details, err: err})
+			if len(rows) > importMaxRows {
+				return nil, errImportTooLarge
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("unable to read JSON lines: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+	return rows, nil
+}
+
+// parseImportCSV reads a CSV import file. The rows of feeds also have an
+// external_id column, and may have columns of their own which are ignored.
+func parseImportCSV(r io.Reader, feed bool) ([]importRow, error) {
+	columns := importColumns
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(importColumns)
+	if feed {
+		columns = append(columns[:len(columns):len(columns)], "external_id")
+		reader.FieldsPerRecord = 0
+	}
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CSV header: %s", err)
+	}
+	column := map[string]int{}
+	for i, name := range header {
+		column[strings.TrimSpace(name)] = i
+	}
+	for _, name := range columns {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("CSV header must have the columns %s", strings.Join(columns, ","))
+		}
+	}
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			rows = append(rows, importRow{err: fmt.Errorf("MALFORMED_PAYLOAD")})
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read CSV: %s", err)
+		} else {
+			details := &CreateOrderDetails{
+				Origin:      []string{record[column["origin_lat"]], record[column["origin_lng"]]},
+				Destination: []string{record[column["destination_lat"]], record[column["destination_lng"]]},
+			}
+			row := importRow{details: details, err: validateCreateOrderDetails(details)}
+			if feed {
+				row.externalID = strings.TrimSpace(record[column["external_id"]])
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) > importMaxRows {
+			return nil, errImportTooLarge
+		}
+	}
+	return rows, nil
+}
+
+// validateCreateOrderDetails checks the coordinates of an order, returning
+// the error code of POST /orders.
+func validateCreateOrderDetails(details *CreateOrderDetails) error {
+	if _, _, err := parseLatLng(details.Origin); err != nil {
+		return fmt.Errorf("MALFORMED_ORIGIN")
+	}
+	if _, _, err := parseLatLng(details.Destination); err != nil {
+		return fmt.Errorf("MALFORMED_DESTINATION")
+	}
+	if details.PromoCode != "" && !promoCodeRE.MatchString(details.PromoCode) {
+		return fmt.Errorf("MALFORMED_PROMO_CODE")
+	}
+	return nil
+}
+
+// StartImport records a new import of rows for tenant.
+func (s *OrderService) StartImport(tenant string, rows []importRow) (*ImportReport, error) {
+	report := &ImportReport{ID: randomHex(8), TenantID: tenant, Status: importRunning, Rows: len(rows),
+		CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	if err := s.saveImport(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// runImport creates the orders of an import one by one, as POST /orders
+// would, and saves the report when done.
+func (s *OrderService) runImport(report *ImportReport, rows []importRow) error {
+	for i, row := range rows {
+		result := ImportResult{Row: i + 1}
+		if row.err != nil {
+			result.Error = row.err.Error()
+		} else if order, err := s.Insert(report.TenantID, *row.details); err != nil {
+			result.Error = importError(err)
+			if result.Error == "INTERNAL_FAILURE" {
+				fmt.Printf("Import %s: row %d: %s\n", report.ID, result.Row, err)
+			}
+		} else {
+			result.OrderID = order.Id
+		}
+		if result.Error != "" {
+			report.Failed++
+		} else {
+			report.Created++
+		}
+		report.Results = append(report.Results, result)
+	}
+	finished := time.Now().UTC().Truncate(time.Second)
+	report.Status, report.FinishedAt = importDone, &finished
+	fmt.Printf("Import %s: created %d orders, %d rows failed\n", report.ID, report.Created, report.Failed)
+	return s.saveImport(report)
+}
+
+// importError returns the error code POST /orders responds with for an
+// error of Insert.
+func importError(err error) string {
+	switch err.(type) {
+	case errQuotaExceeded:
+		return "QUOTA_EXCEEDED"
+	case errInvalidPromoCode:
+		return "INVALID_PROMO_CODE"
+	case errOutOfServiceArea:
+		return "OUT_OF_SERVICE_AREA"
+	case errInvalidLinkedOrder:
+		return "INVALID_LINKED_ORDER"
+	case errAnomalyThrottled:
+		return "ANOMALY_THROTTLED"
+	}
+	switch err {
+	case errDuplicateOrder:
+		return "DUPLICATE_ORDER"
+	case errDistanceUnavailable:
+		return "DISTANCE_UNAVAILABLE"
+	}
+	return "INTERNAL_FAILURE"
+}
+
+// saveImport writes report to the imports table.
+func (s *OrderService) saveImport(report *ImportReport) error {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("unable to encode import %s: %s", report.ID, err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO imports (id, tenant_id, status, report, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, report = excluded.report`,
+		report.ID, report.TenantID, report.Status, string(encoded), report.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to save import %s: %s", report.ID, err)
+	}
+	return nil
+}
+
+// GetImport returns the report of an import of tenant, or errNoSuchImport.
+func (s *OrderService) GetImport(tenant, id string) (*ImportReport, error) {
+	var encoded string
+	err := s.DB.QueryRow("SELECT report FROM imports WHERE id = ? AND tenant_id = ?", id, tenant).Scan(&encoded)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchImport
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load import %s: %s", id, err)
+	}
+	var report ImportReport
+	if err := json.Unmarshal([]byte(encoded), &report); err != nil {
+		return nil, fmt.Errorf("invalid report of import %s: %s", id, err)
+	}
+	return &report, nil
+}
+
+var errNoSuchImport = fmt.Errorf("no such import")
+
+// handleImport serves POST /orders/import. The file is either the body,
+// with Content-Type text/csv or application/x-ndjson, or the "file" part of
+// a multipart/form-data body. Rows are checked right away, the orders are
+// created in the background; the response is the report to poll at its
+// Location.
+func (s *OrderService) handleImport(w http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(w, req.Body, importMaxBytes)
+	var (
+		file            io.Reader = req.Body
+		mediaType, name           = req.Header.Get("Content-Type"), ""
+	)
+	if parsed, _, _ := mime.ParseMediaType(mediaType); parsed == "multipart/form-data" {
+		if err := req.ParseMultipartForm(importMaxBytes); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		part, header, err := req.FormFile("file")
+		if err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD", Detail: "missing file"}, "%s", err)
+			return
+		}
+		defer part.Close()
+		file, mediaType, name = part, header.Header.Get("Content-Type"), header.Filename
+	}
+	format, ok := importFormat(mediaType, name)
+	if !ok {
+		respond(w, req, 415, HTTPResponseError{Error: "UNSUPPORTED_MEDIA_TYPE",
+			Detail: "import text/csv or application/x-ndjson"}, "media type %q, file %q", mediaType, name)
+		return
+	}
+	rows, err := parseImport(file, format)
+	if err == errImportTooLarge {
+		respond(w, req, 413, HTTPResponseError{Error: "IMPORT_TOO_LARGE", Detail: err.Error()}, "%s", err)
+		return
+	}
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD", Detail: err.Error()}, "%s", err)
+		return
+	}
+
+	report, err := s.StartImport(tenantFromRequest(req), rows)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "StartImport(): %s", err)
+		return
+	}
+	go func() {
+		if err := s.runImport(report, rows); err != nil {
+			fmt.Printf("Import %s failed: %s\n", report.ID, err)
+		}
+	}()
+	w.Header().Set("Location", "/orders/imports/"+report.ID)
+	respond(w, req, 202, report, "import %s of %d rows", report.ID, report.Rows)
+}
+
+// handleImportReport serves GET /orders/imports/{id}, the report as JSON, or
+// as CSV with format=csv or Accept: text/csv.
+func (s *OrderService) handleImportReport(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/orders/imports/")
+	report, err := s.GetImport(tenantFromRequest(req), id)
+	if err == errNoSuchImport {
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_IMPORT"}, "no such import %q", id)
+		return
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "GetImport(): %s", err)
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" && accepts(req, "text/csv") {
+		format = "csv"
+	}
+	switch format {
+	case "", "json":
+		respond(w, req, 200, report, "import %s %s", report.ID, report.Status)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="import-%s.csv"`, report.ID))
+		fmt.Printf("Method:%s; Path:%s, %d import %s %s\n", req.Method, req.URL.Path, 200, report.ID, report.Status)
+		writeImportResults(w, report)
+	default:
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: "format must be csv or json"},
+			"invalid format %q", format)
+	}
+}
+
+// writeImportResults writes the results of an import as CSV.
+func writeImportResults(w io.Writer, report *ImportReport) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"row", "order_id", "error"})
+	for _, result := range report.Results {
+		orderID := ""
+		if result.OrderID != 0 {
+			orderID = strconv.FormatInt(result.OrderID, 10)
+		}
+		out.Write([]string{strconv.Itoa(result.Row), orderID, result.Error})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// importMain implements "orderservice import", creating the orders of a file
+// directly in the database and printing the rows that failed. The report is
+// kept for GET /orders/imports/{id}.
+func importMain(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbpath := flags.String("dbpath", "", "Path to database")
+	tenant := flags.String("tenant", "", "Tenant the orders belong to")
+	distanceProvider := flags.String("distance-provider", providerGoogle, "Distance provider, google or haversine")
+	mapsBaseURL := flags.String("maps-base-url", defaultMapsBaseURL, "Base URL of the Google Maps API")
+	format := flags.String("format", "", "csv or ndjson, by default from the file name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dbpath == "" {
+		return fmt.Errorf("missing db name")
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: orderservice import -dbpath orders.db [-tenant TENANT] FILE")
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		var ok bool
+		if *format, ok = importFormat("", path); !ok {
+			return fmt.Errorf("unknown format of %s, use -format", path)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", *dbpath)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+	}
+	defer db.Close()
+	var mapsKeys *KeyPool
+	if *distanceProvider == providerGoogle {
+		mapsAPIKey := os.Getenv("GOOGLE_MAPS_API_KEY")
+		if mapsAPIKey == "" {
+			return fmt.Errorf("missing environment variable GOOGLE_MAPS_API_KEY")
+		}
+		if mapsKeys, err = NewKeyPool(parseMapsKeys(mapsAPIKey), 0, db); err != nil {
+			return fmt.Errorf("failed to create Google Maps key pool: %s", err)
+		}
+	}
+	svc, err := NewOrderService(db, Config{MapsKeys: mapsKeys, DistanceProvider: *distanceProvider,
+		MapsBaseURL: *mapsBaseURL}, context.Background())
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open import file: %s", err)
+	}
+	defer file.Close()
+	rows, err := parseImport(file, *format)
+	if err != nil {
+		return fmt.Errorf("invalid import file %s: %s", path, err)
+	}
+	report, err := svc.StartImport(*tenant, rows)
+	if err != nil {
+		return err
+	}
+	if err := svc.runImport(report, rows); err != nil {
+		return err
+	}
+	for _, result := range report.Results {
+		if result.Error != "" {
+			fmt.Printf("Row %d: %s\n", result.Row, result.Error)
+		}
+	}
+	fmt.Printf("Report: GET /orders/imports/%s\n", report.ID)
+	if report.Failed > 0 {
+		return fmt.Errorf("import %s: %d of %d rows failed", report.ID, report.Failed, report.Rows)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveImport posts an import file and waits for the import to finish.
+func serveImport(t *testing.T, svc *OrderService, contentType, body string) *ImportReport {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/orders/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(tenantHeader, "acme")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if w.Code != 202 {
+		t.Fatalf("POST /orders/import returned %d: %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := serve(svc, "GET", location, "acme", "")
+		var report ImportReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("GET %s returned %d: %s", location, w.Code, w.Body)
+		}
+		if report.Status == importDone {
+			return &report
+		}
+	}
+	t.Fatalf("import %s did not finish", location)
+	return nil
+}
+
+func TestImport(t *testing.T) {
+	svc := newTestService(t, Config{})
+
+	csvFile := "destination_lat,destination_lng,origin_lat,origin_lng\n" +
+		"37.8061044,-122.2943356,37.8093475,-122.2740787\n" +
+		"37.8061044,-122.2943356,91,-122.2740787\n" +
+		"37.8061044,-122.2943356\n" +
+		"37.7,-122.4,37.8,-122.3\n"
+	report := serveImport(t, svc, "text/csv", csvFile)
+	if report.Rows != 4 || report.Created != 2 || report.Failed != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	want := []ImportResult{{Row: 1, OrderID: 1}, {Row: 2, Error: "MALFORMED_ORIGIN"}, {Row: 3, Error: "MALFORMED_PAYLOAD"},
+		{Row: 4, OrderID: 2}}
+	for i, result := range report.Results {
+		if result != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i+1, result, want[i])
+		}
+	}
+	if order, err := svc.Get(2); err != nil || order.Distance == 0 {
+		t.Errorf("imported order 2: %+v, %v", order, err)
+	}
+
+	// The report is only visible to the tenant, and downloadable as CSV.
+	if w := serve(svc, "GET", "/orders/imports/"+report.ID, "globex", ""); w.Code != 404 {
+		t.Errorf("other tenant got %d", w.Code)
+	}
+	w := serve(svc, "GET", "/orders/imports/"+report.ID+"?format=csv", "acme", "")
+	if w.Code != 200 || w.Body.String() != "row,order_id,error\n1,1,\n2,,MALFORMED_ORIGIN\n3,,MALFORMED_PAYLOAD\n4,2,\n" {
+		t.Errorf("CSV report %d: %q", w.Code, w.Body)
+	}
+
+	// JSON lines in a multipart form.
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "orders.jsonl")
+	part.Write([]byte(`{"origin": ["37.8093475", "-122.2740787"], "destination": ["37.8061044", "-122.2943356"]}` +
+		"\n\n{\"origin\": [\"37.8\", \"-122.3\"], \"destination\": []}\n" +
+		`{"origin": ["1", "2"], "destination": ["3", "4"], "priority": 1}` + "\n"))
+	writer.Close()
+	report = serveImport(t, svc, writer.FormDataContentType(), form.String())
+	if report.Rows != 3 || report.Created != 1 || report.Results[1].Error != "MALFORMED_DESTINATION" ||
+		report.Results[2].Error != "UNKNOWN_FIELDS" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	for _, tc := range []struct {
+		contentType, body string
+		code              int
+	}{
+		{"application/json", createOrderDetails, 415},
+		{"text/csv", "origin,destination\n1,2\n", 400},
+		{"text/csv", "origin_lat,origin_lng,destination_lat,destination_lng\n" +
+			strings.Repeat("1,2,3,4\n", importMaxRows+1), 413},
+	} {
+		req := httptest.NewRequest("POST", "/orders/import", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s %.40q: got %d, want %d", tc.contentType, tc.body, w.Code, tc.code)
+		}
+	}
+}
@@ -1,61 +1,116 @@
 // This test file has the tag "integ" and implements the integration tests.
+//go:build integ
 // +build integ
 
 package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"os"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 )
 
 const contentType = "application/json"
 
-var (
-	svcHostNameFlag = flag.String("svcHostName", "localhost:8081", "Hostname to use when connecting to the service")
-)
+// integServer is an OrderService with a database of its own, served over
+// HTTP. Tests using one may run in parallel.
+type integServer struct {
+	URL    string
+	svc    *OrderService
+	client http.Client
+}
 
-func TestMain(m *testing.M) {
-	fmt.Printf("Running integ test, exits with non-zero exit code if tests fail.\n")
-	fmt.Printf("Tests should run with a empty database.\n")
+// startServer boots an OrderService in-process on a fresh sqlite file, with
+// fakeDistance as its distance provider. It is shut down when the test ends.
+func startServer(t *testing.T, config Config) *integServer {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(schemaSQL); err != nil {
+		t.Fatalf("unable to create schema: %s", err)
+	}
+	config.DistanceProvider = providerHaversine
+	svc, err := NewOrderService(db, config, context.Background())
+	if err != nil {
+		t.Fatalf("NewOrderService failed: %s", err)
+	}
+	svc.defaultDistance = fakeDistance{}
+	server := httptest.NewServer(svc)
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return &integServer{URL: server.URL, svc: svc}
+}
 
-	flag.Parse()
+// fakeDistance is a deterministic distance provider: a meter per 1e-5
+// degrees of latitude plus longitude, covered at 10 m/s.
+type fakeDistance struct{}
 
-	fmt.Printf("Using hostname '%s'.\n", *svcHostNameFlag)
-	os.Exit(m.Run())
+func (fakeDistance) Route(origin, destination []string) (Route, error) {
+	lat1, lng1, err := parseLatLng(origin)
+	if err != nil {
+		return Route{}, err
+	}
+	lat2, lng2, err := parseLatLng(destination)
+	if err != nil {
+		return Route{}, err
+	}
+	meters := int64(math.Round((math.Abs(lat1-lat2) + math.Abs(lng1-lng2)) * 1e5))
+	return Route{Distance: meters, Duration: meters / 10}, nil
+}
+
+// fakeDistanceOf returns the distance fakeDistance gives an order.
+func fakeDistanceOf(t *testing.T, details CreateOrderDetails) float64 {
+	route, err := fakeDistance{}.Route(details.Origin, details.Destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return float64(route.Distance)
 }
 
 func TestIntegration(t *testing.T) {
-	c := http.Client{}
+	t.Parallel()
+	srv := startServer(t, Config{})
 
-	// The test requires that the db start off empty. Empty db should return
-	// zero-length list.
-	assertEmptyList(t, c)
+	// Empty db should return zero-length list.
+	srv.assertEmptyList(t)
 
 	// Try to insert an invalid item, check that it fails.
-	assertInsertMalformedFailure(t, c)
+	srv.assertInsertMalformedFailure(t)
 
 	// Insert an item, check that the item returns the right response.
-	assertInsertSuccess(t, c)
+	srv.assertInsertSuccess(t)
 
 	// Taking a non-existent item should fail.
-	assertTakeNonExistentFails(t, c)
+	srv.assertTakeNonExistentFails(t)
 
 	// Take the first item and check that it succeeds.
-	assertTakeSuccess(t, c)
+	srv.assertTakeSuccess(t)
 
 	// Take a the first item (again) and check it fails.
-	assertTakeAgainFails(t, c)
+	srv.assertTakeAgainFails(t)
+}
+
+func TestIntegrationPagination(t *testing.T) {
+	t.Parallel()
+	srv := startServer(t, Config{})
 
 	// Insert a bunch of journeys that are not exactly the same.
 	originLat := 37.8093475    // North-South
 	originLong := -122.2740787 // East-West
+	var inserted []CreateOrderDetails
 	for idx := 0; idx < 14; idx++ {
 
 		newLat := originLat + (float64(idx) * 0.02)
@@ -65,36 +120,37 @@ func TestIntegration(t *testing.T) {
 			Origin:      []string{fmt.Sprintf("%f", newLat), fmt.Sprintf("%f", newLong)},
 			Destination: []string{"37.8061044", "-122.2943356"},
 		}
-		insertOrder(t, c, createOrderDetails)
+		srv.insertOrder(t, createOrderDetails)
+		inserted = append(inserted, createOrderDetails)
 	}
 
 	// Fetch some items from the middle to test pagination.
-	items := getList(t, c, 3, 3)
+	items := srv.getList(t, 3, 3)
 	if len(items) != 3 {
-		t.Error(len(items))
+		t.Fatal(len(items))
 	}
 
-	expectedResult := []Order{
-		{Id: 4, Distance: 6601, State: "UNASSIGNED"},
-		{Id: 5, Distance: 9318, State: "UNASSIGNED"},
-		{Id: 6, Distance: 22475, State: "UNASSIGNED"},
+	expectedResult := []OrderDTO{
+		{ID: 7, Distance: fakeDistanceOf(t, inserted[6]), Status: "UNASSIGNED"},
+		{ID: 8, Distance: fakeDistanceOf(t, inserted[7]), Status: "UNASSIGNED"},
+		{ID: 9, Distance: fakeDistanceOf(t, inserted[8]), Status: "UNASSIGNED"},
 	}
 	for idx, elem := range items {
 		expected := expectedResult[idx]
-		if elem.Id != expected.Id {
-			t.Error(idx, elem.Id, expected.Id)
+		if elem.ID != expected.ID {
+			t.Error(idx, elem.ID, expected.ID)
 		}
 		if elem.Distance != expected.Distance {
 			t.Error(idx, elem.Distance, expected.Distance)
 		}
-		if elem.State != expected.State {
-			t.Error(idx, elem.State, expected.State)
+		if elem.Status != expected.Status {
+			t.Error(idx, elem.Status, expected.Status)
 		}
 	}
 }
 
-func assertEmptyList(t *testing.T, client http.Client) {
-	resp, err := client.Get(fmt.Sprintf("http://%s/orders", *svcHostNameFlag))
+func (srv *integServer) assertEmptyList(t *testing.T) {
+	resp, err := srv.client.Get(srv.URL + "/orders")
 	if err != nil {
 		t.Errorf("GET /orders failed: %s", err)
 	}
@@ -112,8 +168,8 @@ func assertEmptyList(t *testing.T, client http.Client) {
 	}
 }
 
-func assertInsertMalformedFailure(t *testing.T, client http.Client) {
-	resp, err := client.Post(fmt.Sprintf("http://%s/orders", *svcHostNameFlag), contentType, strings.NewReader("malformed"))
+func (srv *integServer) assertInsertMalformedFailure(t *testing.T) {
+	resp, err := srv.client.Post(srv.URL+"/orders", contentType, strings.NewReader("malformed"))
 	if err != nil {
 		t.Errorf("POST /orders failed: %s", err)
 	}
@@ -123,8 +179,8 @@ func assertInsertMalformedFailure(t *testing.T, client http.Client) {
 	}
 }
 
-func assertInsertSuccess(t *testing.T, client http.Client) {
-	resp, err := client.Post(fmt.Sprintf("http://%s/orders", *svcHostNameFlag), contentType, strings.NewReader(createOrderDetails))
+func (srv *integServer) assertInsertSuccess(t *testing.T) {
+	resp, err := srv.client.Post(srv.URL+"/orders", contentType, strings.NewReader(createOrderDetails))
 	if err != nil {
 		t.Errorf("POST /orders failed: %s", err)
 	}
@@ -135,32 +191,34 @@ func assertInsertSuccess(t *testing.T, client http.Client) {
 	if resp.StatusCode != 200 {
 		t.Errorf("POST /orders returned %d", resp.StatusCode)
 	}
-	var order Order
+	var order OrderDTO
 	if err := json.NewDecoder(strings.NewReader(buf.String())).Decode(&order); err != nil {
 		t.Errorf("POST /orders response body malformed")
 	}
-	if order.Id != 1 || order.Distance != 2489 || order.State != string(StateUnassigned) {
+	var details CreateOrderDetails
+	json.Unmarshal([]byte(createOrderDetails), &details)
+	if order.ID != 1 || order.Distance != fakeDistanceOf(t, details) || order.Status != string(StateUnassigned) {
 		t.Errorf("POST /orders incorrect response, %+v", order)
 	}
 }
 
-func assertTakeNonExistentFails(t *testing.T, client http.Client) {
-	patchRequest, err := http.NewRequest("PATCH", fmt.Sprintf("http://%s/orders/23", *svcHostNameFlag), nil)
+func (srv *integServer) assertTakeNonExistentFails(t *testing.T) {
+	patchRequest, err := http.NewRequest("PATCH", srv.URL+"/orders/23", nil)
 	if err != nil {
 		t.Error(err)
 	}
-	resp, err := client.Do(patchRequest)
+	resp, err := srv.client.Do(patchRequest)
 	if resp.StatusCode == 200 {
 		t.Error("success on non-existent order")
 	}
 }
 
-func assertTakeSuccess(t *testing.T, client http.Client) {
-	patchRequest, err := http.NewRequest("PATCH", fmt.Sprintf("http://%s/orders/1", *svcHostNameFlag), nil)
+func (srv *integServer) assertTakeSuccess(t *testing.T) {
+	patchRequest, err := http.NewRequest("PATCH", srv.URL+"/orders/1", nil)
 	if err != nil {
 		t.Error(err)
 	}
-	resp, err := client.Do(patchRequest)
+	resp, err := srv.client.Do(patchRequest)
 	if err != nil {
 		t.Error(err)
 	}
@@ -180,12 +238,12 @@ func assertTakeSuccess(t *testing.T, client http.Client) {
 	}
 }
 
-func assertTakeAgainFails(t *testing.T, client http.Client) {
-	patchRequest, err := http.NewRequest("PATCH", fmt.Sprintf("http://%s/orders/1", *svcHostNameFlag), nil)
+func (srv *integServer) assertTakeAgainFails(t *testing.T) {
+	patchRequest, err := http.NewRequest("PATCH", srv.URL+"/orders/1", nil)
 	if err != nil {
 		t.Error(err)
 	}
-	resp, err := client.Do(patchRequest)
+	resp, err := srv.client.Do(patchRequest)
 	if err != nil {
 		t.Error(err)
 	}
@@ -206,12 +264,12 @@ func assertTakeAgainFails(t *testing.T, client http.Client) {
 }
 
 // Inserts over HTTP
-func insertOrder(t *testing.T, client http.Client, createOrder CreateOrderDetails) {
+func (srv *integServer) insertOrder(t *testing.T, createOrder CreateOrderDetails) {
 	var buf bytes.Buffer
 	if err := json.NewEncoder(&buf).Encode(createOrder); err != nil {
 		t.Errorf("unable to encode %+v: %s", createOrder, err)
 	}
-	resp, err := client.Post(fmt.Sprintf("http://%s/orders", *svcHostNameFlag), contentType, strings.NewReader(buf.String()))
+	resp, err := srv.client.Post(srv.URL+"/orders", contentType, strings.NewReader(buf.String()))
 	if err != nil {
 		t.Errorf("POST /orders failed: %s", err)
 	}
@@ -222,14 +280,14 @@ func insertOrder(t *testing.T, client http.Client, createOrder CreateOrderDetail
 	if resp.StatusCode != 200 {
 		t.Errorf("POST /orders returned %d", resp.StatusCode)
 	}
-	var order Order
+	var order OrderDTO
 	if err := json.NewDecoder(strings.NewReader(buf.String())).Decode(&order); err != nil {
 		t.Errorf("POST /orders response body malformed")
 	}
 }
 
-func getList(t *testing.T, client http.Client, page int, limit int) []Order {
-	resp, err := client.Get(fmt.Sprintf("http://%s/orders?page=%d&limit=%d", *svcHostNameFlag, page, limit))
+func (srv *integServer) getList(t *testing.T, page int, limit int) []OrderDTO {
+	resp, err := srv.client.Get(fmt.Sprintf("%s/orders?page=%d&limit=%d", srv.URL, page, limit))
 	if err != nil {
 		t.Errorf("GET /orders failed: %s", err)
 	}
@@ -239,7 +297,7 @@ func getList(t *testing.T, client http.Client, page int, limit int) []Order {
 		t.Errorf("GET /orders returned %d", resp.StatusCode)
 	}
 
-	var orders []Order
+	var orders []OrderDTO
 	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
 		t.Error("unable to decode items.")
 	}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jsonAPIMediaType is the media type of JSON:API documents
+// (https://jsonapi.org/format/). Clients opt in to JSON:API responses by
+// sending it in the Accept header.
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// Relationships of orders, which the include parameter of JSON:API requests
+// may name to get the related resources in the included member.
+const (
+	relLinkedOrder = "linked_order" // Outbound order of a return leg.
+	relCourier     = "courier"      // Courier that took the order.
+)
+
+// jsonAPIDocument is the top-level JSON:API document.
+type jsonAPIDocument struct {
+	Data     interface{}       `json:"data,omitempty"`
+	Errors   []jsonAPIError    `json:"errors,omitempty"`
+	Links    map[string]string `json:"links,omitempty"`
+	Included []jsonAPIResource `json:"included,omitempty"`
+}
+
+// jsonAPIResource is a resource object.
+type jsonAPIResource struct {
+	Type          string                         `json:"type"`
+	ID            string                         `json:"id"`
+	Attributes    interface{}                    `json:"attributes,omitempty"`
+	Relationships map[string]jsonAPIRelationship `json:"relationships,omitempty"`
+	Links         map[string]string              `json:"links,omitempty"`
+}
+
+// jsonAPIIdentifier identifies a resource in a relationship.
+type jsonAPIIdentifier struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// jsonAPIRelationship is a to-one relationship object, Data is null if there
+// is no related resource.
+type jsonAPIRelationship struct {
+	Data  *jsonAPIIdentifier `json:"data"`
+	Links map[string]string  `json:"links,omitempty"`
+}
+
+// courierAttributes are the attributes of a courier resource.
+type courierAttributes struct {
+	Vehicle string `json:"vehicle,omitempty"` // A vehicleProfiles name, empty for none.
+}
+
+// jsonAPIError is an error object.
+type jsonAPIError struct {
+	Status string `json:"status"`
+	Code   string `json:"code"`
+	Title  string `json:"title,omitempty"` // The message of the error.
+	Detail string `json:"detail,omitempty"`
+}
+
+// wantsJSONAPI returns true if the client accepts JSON:API documents.
+func wantsJSONAPI(req *http.Request) bool {
+	return accepts(req, jsonAPIMediaType)
+}
+
+// accepts returns true if the Accept header of req lists mediaType.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		accepted, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && accepted == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonAPIErrorDocument converts an error response into a JSON:API document.
+func jsonAPIErrorDocument(code int, httpErr HTTPResponseError) jsonAPIDocument {
+	return jsonAPIDocument{Errors: []jsonAPIError{
+		{Status: strconv.Itoa(code), Code: httpErr.Error, Title: httpErr.Message, Detail: httpErr.Detail},
+	}}
+}
+
+// parseInclude returns the relationships named by the include parameter,
+// comma separated.
+func parseInclude(queryParams url.Values) (map[string]bool, error) {
+	include := map[string]bool{}
+	if queryParams.Get("include") == "" {
+		return include, nil
+	}
+	for _, name := range strings.Split(queryParams.Get("include"), ",") {
+		name = strings.TrimSpace(name)
+		if name != relLinkedOrder && name != relCourier {
+			return nil, fmt.Errorf("unknown relationship %q, want %s or %s", name, relLinkedOrder, relCourier)
+		}
+		include[name] = true
+	}
+	return include, nil
+}
+
+// orderResourceID is the id of order as a resource. Prefers the uid, which
+// does not reveal the number of orders.
+func orderResourceID(order *Order) string {
+	if order.UID != "" {
+		return order.UID
+	}
+	return strconv.FormatInt(order.Id, 10)
+}
+
+// orderResource converts order into a resource object. The id is not repeated
+// in the attributes. Its relationships are those of related, nil for none.
+func orderResource(order *Order, fields Fieldset, related *orderRelated) jsonAPIResource {
+	attributes := Fieldset{}
+	for name := range orderFields {
+		if name != "id" && (fields == nil || fields[name]) {
+			attributes[name] = true
+		}
+	}
+	id := orderResourceID(order)
+	resource := jsonAPIResource{
+		Type:       "orders",
+		ID:         id,
+		Attributes: sparseOrder{order: newOrderDTO(order), fields: attributes},
+		Links:      map[string]string{"self": "/orders/" + id},
+	}
+	if related == nil {
+		return resource
+	}
+	linked := jsonAPIRelationship{}
+	if order.LinkedOrderID != 0 {
+		linked.Links = map[string]string{"related": "/orders/" + strconv.FormatInt(order.LinkedOrderID, 10)}
+		if outbound := related.orders[order.LinkedOrderID]; outbound != nil {
+			linked.Data = &jsonAPIIdentifier{Type: "orders", ID: orderResourceID(outbound)}
+		}
+	}
+	courier := jsonAPIRelationship{}
+	if id, ok := related.couriers[order.Id]; ok {
+		courier.Data = &jsonAPIIdentifier{Type: "couriers", ID: id}
+	}
+	resource.Relationships = map[string]jsonAPIRelationship{relLinkedOrder: linked, relCourier: courier}
+	return resource
+}
+
+// orderRelated are the resources related to a page of orders.
+type orderRelated struct {
+	orders   map[int64]*Order  // Linked orders by id.
+	couriers map[int64]string  // Courier that took each order, by order id.
+	vehicles map[string]string // Vehicle of each courier, if couriers are included.
+}
+
+// loadRelated loads the resources related to orders, the vehicles of their
+// couriers only if include names them.
+func (s *OrderService) loadRelated(orders []Order, include map[string]bool) (*orderRelated, error) {
+	related := &orderRelated{orders: map[int64]*Order{}, couriers: map[int64]string{}, vehicles: map[string]string{}}
+	var taken []interface{}
+	for idx := range orders {
+		order := &orders[idx]
+		if id := order.LinkedOrderID; id != 0 && related.orders[id] == nil {
+			outbound, err := s.Get(id)
+			if err == errNoSuchOrder {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			related.orders[id] = outbound
+		}
+		if order.State == StateTaken {
+			taken = append(taken, order.Id)
+		}
+	}
+	if len(taken) == 0 {
+		return related, nil
+	}
+
+	// The courier is in the data of the taken event, its vehicle in the
+	// couriers of the order's tenant.
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(taken)), ", ")
+	rows, err := s.DB.Query(`SELECT e.order_id, e.data, o.tenant_id FROM events e
+		JOIN (SELECT id, tenant_id FROM orders UNION ALL SELECT id, tenant_id FROM orders_archive) o ON o.id = e.order_id
+		WHERE e.type = ? AND e.order_id IN (`+placeholders+`) ORDER BY e.id`,
+		append([]interface{}{string(EventTaken)}, taken...)...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query couriers: %s", err)
+	}
+	defer rows.Close()
+	tenants := map[string]string{}
+	for rows.Next() {
+		var (
+			orderID int64
+			data    sql.NullString
+			tenant  string
+		)
+		if err := rows.Scan(&orderID, &data, &tenant); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if data.String == "" {
+			continue
+		}
+		plaintext, err := openField(s.config.FieldKey, []byte(data.String))
+		if err != nil {
+			return nil, fmt.Errorf("invalid taken event of order %d: %s", orderID, err)
+		}
+		var takenBy orderTaken
+		if err := json.Unmarshal(plaintext, &takenBy); err != nil {
+			return nil, fmt.Errorf("invalid taken event of order %d: %s", orderID, err)
+		}
+		if takenBy.Courier != "" {
+			related.couriers[orderID] = takenBy.Courier
+			tenants[takenBy.Courier] = tenant
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query couriers: %s", err)
+	}
+	if !include[relCourier] {
+		return related, nil
+	}
+	for courier, tenant := range tenants {
+		vehicle, _, err := courierVehicle(s.DB, tenant, courier)
+		if err != nil {
+			return nil, err
+		}
+		related.vehicles[courier] = vehicle
+	}
+	return related, nil
+}
+
+// included returns the resources of related that include names, once each
+// and leaving out those of primary, sorted by type and id. Orders are
+// rendered with fields in loc.
+func (related *orderRelated) included(include map[string]bool, primary []jsonAPIResource, fields Fieldset,
+	loc *time.Location) []jsonAPIResource {
+	seen := map[jsonAPIIdentifier]bool{}
+	for _, resource := range primary {
+		seen[jsonAPIIdentifier{Type: resource.Type, ID: resource.ID}] = true
+	}
+	var resources []jsonAPIResource
+	add := func(resource jsonAPIResource) {
+		if id := (jsonAPIIdentifier{Type: resource.Type, ID: resource.ID}); !seen[id] {
+			seen[id] = true
+			resources = append(resources, resource)
+		}
+	}
+	if include[relLinkedOrder] {
+		for _, order := range related.orders {
+			add(orderResource(localize(order, loc), fields, nil))
+		}
+	}
+	if include[relCourier] {
+		for courier, vehicle := range related.vehicles {
+			add(jsonAPIResource{Type: "couriers", ID: courier, Attributes: courierAttributes{Vehicle: vehicle}})
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].Type != resources[j].Type {
+			return resources[i].Type < resources[j].Type
+		}
+		return resources[i].ID < resources[j].ID
+	})
+	return resources
+}
+
+// renderOrder returns the response body for a single order, with its
+// distance_text and times in the time zone of the tenant. JSON:API documents
+// have its relationships and the related resources of include=.
+func (s *OrderService) renderOrder(req *http.Request, order *Order) (interface{}, error) {
+	loc := s.requestLocation(req)
+	withText := *localize(order, loc)
+	withText.DistanceText = distanceText(req, order.Distance)
+	order = &withText
+	if !wantsJSONAPI(req) {
+		return newOrderDTO(order), nil
+	}
+	include, err := parseInclude(req.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	related, err := s.loadRelated([]Order{*order}, include)
+	if err != nil {
+		return nil, err
+	}
+	resource := orderResource(order, nil, related)
+	return jsonAPIDocument{Data: resource,
+		Included: related.included(include, []jsonAPIResource{resource}, nil, loc)}, nil
+}
+
+// respondOrder responds with code and the body of renderOrder.
+func (s *OrderService) respondOrder(w http.ResponseWriter, req *http.Request, code int, order *Order, format string,
+	args ...interface{}) {
+	body, err := s.renderOrder(req, order)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "renderOrder(): %s", err)
+		return
+	}
+	respond(w, req, code, body, format, args...)
+}
+
+// checkInclude refuses JSON:API requests whose include parameter names
+// unknown relationships, before they change anything. Returns false after
+// responding with an error.
+func checkInclude(w http.ResponseWriter, req *http.Request) bool {
+	if !wantsJSONAPI(req) {
+		return true
+	}
+	if _, err := parseInclude(req.URL.Query()); err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: err.Error()}, "%s", err)
+		return false
+	}
+	return true
+}
+
+// renderOrders returns the response body for a page of orders, in loc. JSON:API
+// documents link to the neighbouring pages, and have the relationships of the
+// orders and the related resources of include=.
+func (s *OrderService) renderOrders(req *http.Request, orders []Order, fields Fieldset, page, limit int,
+	loc *time.Location) (interface{}, error) {
+	if !wantsJSONAPI(req) {
+		return fields.Apply(orders), nil
+	}
+	include, err := parseInclude(req.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	related, err := s.loadRelated(orders, include)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]jsonAPIResource, len(orders))
+	for idx := range orders {
+		resources[idx] = orderResource(&orders[idx], fields, related)
+	}
+	pageLink := func(page int) string {
+		u := *req.URL
+		query := u.Query()
+		query.Set("page", strconv.Itoa(page))
+		u.RawQuery = query.Encode()
+		return u.RequestURI()
+	}
+	links := map[string]string{"self": pageLink(page)}
+	if page > 1 {
+		links["prev"] = pageLink(page - 1)
+	}
+	if limit > 0 && len(orders) == limit {
+		links["next"] = pageLink(page + 1)
+	}
+	return jsonAPIDocument{Data: resources, Links: links, Included: related.included(include, resources, fields, loc)},
+		nil
+}
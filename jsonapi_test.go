@@ -0,0 +1,109 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONAPIListing(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for idx := 0; idx < 3; idx++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/orders?page=2&limit=1&fields=status", nil)
+	req.Header.Set("Accept", "application/json, application/vnd.api+json")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("GET /orders returned %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != jsonAPIMediaType {
+		t.Errorf("unexpected Content-Type %q", contentType)
+	}
+	expected := `{"data":[{"type":"orders","id":"2","attributes":{"status":"UNASSIGNED"},` +
+		`"relationships":{"courier":{"data":null},"linked_order":{"data":null}},"links":{"self":"/orders/2"}}],"links":{"next":"/orders?fields=status&limit=1&page=3",` +
+		`"prev":"/orders?fields=status&limit=1&page=1","self":"/orders?fields=status&limit=1&page=2"}}`
+	if got := strings.TrimSpace(w.Body.String()); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestJSONAPIRelationships(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	returnLeg := `{"origin": ["37.8061044", "-122.2943356"], "destination": ["37.8093475", "-122.2740787"],
+		"linked_order_id": 1}`
+	for _, body := range []string{createOrderDetails, returnLeg} {
+		if w := serve(svc, "POST", "/orders", "acme", body); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+		}
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/couriers/c1", `{"vehicle": "car"}`); w.Code != 200 {
+		t.Fatalf("PUT courier returned %d: %s", w.Code, w.Body)
+	}
+	if w := serveTake(svc, "/orders/1", "acme", "c1"); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", jsonAPIMediaType)
+		req.Header.Set(tenantHeader, "acme")
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/orders/2?include=linked_order")
+	var single struct {
+		Data     jsonAPIResource
+		Included []struct {
+			Type, ID      string
+			Relationships map[string]jsonAPIRelationship
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &single); err != nil || w.Code != 200 {
+		t.Fatalf("GET returned %d: %s", w.Code, w.Body)
+	}
+	linked := single.Data.Relationships[relLinkedOrder]
+	if linked.Data == nil || *linked.Data != (jsonAPIIdentifier{Type: "orders", ID: "1"}) ||
+		linked.Links["related"] != "/orders/1" || single.Data.Relationships[relCourier].Data != nil {
+		t.Errorf("relationships %+v", single.Data.Relationships)
+	}
+	if len(single.Included) != 1 || single.Included[0].Type != "orders" || single.Included[0].ID != "1" {
+		t.Errorf("included %+v", single.Included)
+	}
+
+	expected := `"relationships":{"courier":{"data":{"type":"couriers","id":"c1"}},"linked_order":{"data":null}}`
+	if w := get("/orders?fields=status"); !strings.Contains(w.Body.String(), expected) ||
+		strings.Contains(w.Body.String(), `"included"`) {
+		t.Errorf("GET /orders returned %s", w.Body)
+	}
+	// Orders of the page aren't included again.
+	expected = `"included":[{"type":"couriers","id":"c1","attributes":{"vehicle":"car"}}]`
+	if w := get("/orders?fields=status&include=courier,linked_order"); !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("GET /orders with include returned %s", w.Body)
+	}
+	if w := get("/orders?include=items"); w.Code != 400 {
+		t.Errorf("unknown relationship returned %d", w.Code)
+	}
+}
+
+func TestJSONAPIErrors(t *testing.T) {
+	req := httptest.NewRequest("GET", "/orders/42", nil)
+	req.Header.Set("Accept", jsonAPIMediaType)
+	w := httptest.NewRecorder()
+	newTestService(t, Config{}).ServeHTTP(w, req)
+
+	expected := `{"errors":[{"status":"404","code":"NO_SUCH_ORDER"}]}`
+	if w.Code != 404 || strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoMapsKeys = fmt.Errorf("all Google Maps API keys are exhausted")
+
+// mapsKey is a single Google Maps API key in a KeyPool.
+type mapsKey struct {
+	secret         string    // The API key itself, SECRET.
+	id             string    // Fingerprint of the key, safe to log and persist.
+	used           int64     // Number of requests made with this key today.
+	unflushed      int64     // Requests of used not persisted yet.
+	exhaustedUntil time.Time // Key is skipped until this time.
+}
+
+// KeyPool hands out Google Maps API keys in round-robin order, skipping keys
+// that have run out of quota. Usage is counted per key per (UTC) day and, if
+// the pool has a database, added to the maps_key_usage table so counts
+// survive restarts and add up across replicas sharing the database.
+type KeyPool struct {
+	mu         sync.Mutex
+	keys       []*mapsKey
+	next       int     // Index of the next key to try.
+	day        string  // Day the usage counters belong to, YYYY-MM-DD.
+	dailyQuota int64   // Requests per key per day, 0 is unlimited.
+	db         *sql.DB // Optional, persists usage counters.
+	now        func() time.Time
+}
+
+// keyFingerprint returns a short identifier for a key that does not reveal the
+// key itself.
+func keyFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:4])
+}
+
+// parseMapsKeys splits a comma separated list of API keys, ignoring blanks.
+func parseMapsKeys(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// NewKeyPool creates a pool from a non-empty list of keys. dailyQuota is the
+// number of requests allowed per key per day, 0 means unlimited. db may be
+// nil, in which case usage is only tracked in memory.
+func NewKeyPool(secrets []string, dailyQuota int64, db *sql.DB) (*KeyPool, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("no Google Maps API keys provided")
+	}
+	pool := &KeyPool{dailyQuota: dailyQuota, db: db, now: time.Now}
+	for _, secret := range secrets {
+		pool.keys = append(pool.keys, &mapsKey{secret: secret, id: keyFingerprint(secret)})
+	}
+	pool.day = pool.today()
+	if err := pool.load(); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (p *KeyPool) today() string {
+	return p.now().UTC().Format("2006-01-02")
+}
+
+// load reads today's usage counters from the database.
+func (p *KeyPool) load() error {
+	if p.db == nil {
+		return nil
+	}
+	for _, key := range p.keys {
+		err := p.db.QueryRow("SELECT requests FROM maps_key_usage WHERE key_id = ? AND day = ?",
+			key.id, p.day).Scan(&key.used)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("unable to load usage for key %s: %s", key.id, err)
+		}
+	}
+	return nil
+}
+
+// rollover resets the counters when the day changes. Must hold p.mu.
+func (p *KeyPool) rollover() {
+	if today := p.today(); today != p.day {
+		p.day = today
+		for _, key := range p.keys {
+			key.used = 0
+			key.unflushed = 0
+			key.exhaustedUntil = time.Time{}
+		}
+	}
+}
+
+// Acquire returns the next usable key and counts one request against it.
+// Returns errNoMapsKeys if every key is exhausted or over quota.
+func (p *KeyPool) Acquire() (secret string, id string, err error) {
+	p.mu.Lock()
+	p.rollover()
+
+	now := p.now()
+	for range p.keys {
+		key := p.keys[p.next]
+		p.next = (p.next + 1) % len(p.keys)
+		if now.Before(key.exhaustedUntil) {
+			continue
+		}
+		if p.dailyQuota > 0 && key.used >= p.dailyQuota {
+			continue
+		}
+		key.used++
+		key.unflushed++
+		day, delta := p.day, key.unflushed
+		key.unflushed = 0
+		p.mu.Unlock()
+		p.persist(key, day, delta)
+		return key.secret, key.id, nil
+	}
+	p.mu.Unlock()
+	return "", "", errNoMapsKeys
+}
+
+// persist adds delta requests to the counter of key for day in the database.
+// Must not hold p.mu, other requests go on while it writes. A delta that
+// fails to persist is logged and added to the next one of the same day, it
+// does not fail the request.
+func (p *KeyPool) persist(key *mapsKey, day string, delta int64) {
+	if p.db == nil {
+		return
+	}
+	_, err := p.db.Exec(`INSERT INTO maps_key_usage (key_id, day, requests) VALUES (?, ?, ?)
+		ON CONFLICT (key_id, day) DO UPDATE SET requests = requests + excluded.requests`, key.id, day, delta)
+	if err != nil {
+		fmt.Printf("KeyPool: unable to persist usage for key %s: %s\n", key.id, err)
+		p.mu.Lock()
+		if p.day == day {
+			key.unflushed += delta
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Exhausted marks the key with the given id as out of quota until the end of
+// the current UTC day.
+func (p *KeyPool) Exhausted(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	midnight := p.now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	for _, key := range p.keys {
+		if key.id == id {
+			fmt.Printf("KeyPool: key %s exhausted until %s\n", id, midnight.Format(time.RFC3339))
+			key.exhaustedUntil = midnight
+		}
+	}
+}
+
+// Len returns the number of keys in the pool.
+func (p *KeyPool) Len() int {
+	return len(p.keys)
+}
+
+// Usage returns today's request count per key fingerprint.
+func (p *KeyPool) Usage() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rollover()
+	usage := make(map[string]int64, len(p.keys))
+	for _, key := range p.keys {
+		usage[key.id] = key.used
+	}
+	return usage
+}
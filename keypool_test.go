@@ -0,0 +1,114 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyPoolRoundRobin(t *testing.T) {
+	pool, err := NewKeyPool([]string{"a", "b", "c"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for idx := 0; idx < 4; idx++ {
+		key, _, err := pool.Acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, key)
+	}
+	if got[0] != "a" || got[1] != "b" || got[2] != "c" || got[3] != "a" {
+		t.Errorf("unexpected rotation %v", got)
+	}
+}
+
+func TestKeyPoolSkipsExhausted(t *testing.T) {
+	now := time.Date(2018, 10, 30, 12, 0, 0, 0, time.UTC)
+	pool, err := NewKeyPool([]string{"a", "b"}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.now = func() time.Time { return now }
+	pool.day = pool.today()
+
+	pool.Exhausted(keyFingerprint("a"))
+	for idx := 0; idx < 3; idx++ {
+		if key, _, err := pool.Acquire(); err != nil || key != "b" {
+			t.Errorf("expected key b, got %q %v", key, err)
+		}
+	}
+
+	pool.Exhausted(keyFingerprint("b"))
+	if _, _, err := pool.Acquire(); err != errNoMapsKeys {
+		t.Errorf("expected errNoMapsKeys, got %v", err)
+	}
+
+	// Keys come back on the next day.
+	now = now.Add(24 * time.Hour)
+	if _, _, err := pool.Acquire(); err != nil {
+		t.Errorf("expected key after rollover, got %v", err)
+	}
+}
+
+func TestKeyPoolQuotaPersisted(t *testing.T) {
+	db := openTestDB(t)
+	pool, err := NewKeyPool([]string{"a"}, 2, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 2; idx++ {
+		if _, _, err := pool.Acquire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new pool, e.g. after a restart, picks up today's usage.
+	pool, err = NewKeyPool([]string{"a"}, 2, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := pool.Usage()[keyFingerprint("a")]; used != 2 {
+		t.Errorf("expected 2 requests, got %d", used)
+	}
+	if _, _, err := pool.Acquire(); err != errNoMapsKeys {
+		t.Errorf("expected quota to be enforced, got %v", err)
+	}
+}
+
+func TestKeyPoolUsageAddsUp(t *testing.T) {
+	db := openTestDB(t)
+	// Two replicas sharing the database.
+	first, err := NewKeyPool([]string{"a"}, 0, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewKeyPool([]string{"a"}, 0, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if _, _, err := first.Acquire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := second.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int64
+	err = db.QueryRow("SELECT requests FROM maps_key_usage WHERE key_id = ?", keyFingerprint("a")).Scan(&requests)
+	if err != nil || requests != 4 {
+		t.Errorf("persisted %d requests, %v, expected 4", requests, err)
+	}
+}
+
+func TestParseMapsKeys(t *testing.T) {
+	keys := parseMapsKeys(" a,,b ,")
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("unexpected keys %q", keys)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keyUsageRetentionDays is how long usage of API keys is kept.
+	keyUsageRetentionDays = 30
+	// keyUsageFlushEvery is how often usage counted in memory is written.
+	keyUsageFlushEvery = time.Minute
+)
+
+// keyUsageCount is the usage of a key on an endpoint during a day.
+type keyUsageCount struct {
+	keyID, day, endpoint string
+}
+
+// keyUsageRecorder counts the requests of API keys per UTC day and endpoint
+// in memory, and periodically adds the counts to the api_key_usage table.
+type keyUsageRecorder struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	requests map[keyUsageCount]int64
+	errors   map[keyUsageCount]int64
+	now      func() time.Time
+}
+
+func newKeyUsageRecorder(db *sql.DB) *keyUsageRecorder {
+	return &keyUsageRecorder{db: db, requests: map[keyUsageCount]int64{}, errors: map[keyUsageCount]int64{},
+		now: time.Now}
+}
+
+// routeEndpoint returns the endpoint req is for, its method and route with
+// path parameters replaced by "*", e.g. "GET /orders/*/history".
+func routeEndpoint(req *http.Request) string {
+	r := findRoute(req.URL.Path)
+	if r == nil {
+		return req.Method + " other"
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(r.pattern.String(), "^"), "$")
+	path = strings.NewReplacer("[[:alnum:]-]+", "*", "[^/]+", "*", ".+", "*").Replace(path)
+	return req.Method + " " + path
+}
+
+// record counts a request of key answered with code. Responses of 400 and
+// above are errors.
+func (r *keyUsageRecorder) record(keyID string, req *http.Request, code int) {
+	count := keyUsageCount{keyID: keyID, day: r.now().UTC().Format("2006-01-02"), endpoint: routeEndpoint(req)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[count]++
+	if code >= 400 {
+		r.errors[count]++
+	}
+}
+
+// flush writes the counts since the last flush and deletes usage older than
+// keyUsageRetentionDays. Counts that fail to be written are kept for the next
+// flush.
+func (r *keyUsageRecorder) flush() error {
+	r.mu.Lock()
+	requests, errors := r.requests, r.errors
+	r.requests, r.errors = map[keyUsageCount]int64{}, map[keyUsageCount]int64{}
+	r.mu.Unlock()
+
+	tx, err := r.db.Begin()
+	if err == nil {
+		err = writeKeyUsage(tx, requests, errors)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		r.mu.Lock()
+		for count, n := range requests {
+			r.requests[count] += n
+		}
+		for count, n := range errors {
+			r.errors[count] += n
+		}
+		r.mu.Unlock()
+		return fmt.Errorf("unable to write API key usage: %s", err)
+	}
+
+	oldest := r.now().UTC().AddDate(0, 0, -keyUsageRetentionDays+1).Format("2006-01-02")
+	if _, err := r.db.Exec("DELETE FROM api_key_usage WHERE day < ?", oldest); err != nil {
+		return fmt.Errorf("unable to purge API key usage: %s", err)
+	}
+	return nil
+}
+
+// writeKeyUsage adds counts to the api_key_usage table.
+func writeKeyUsage(tx *sql.Tx, requests, errors map[keyUsageCount]int64) error {
+	for count, n := range requests {
+		_, err := tx.Exec(`INSERT INTO api_key_usage (key_id, day, endpoint, requests, errors) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (key_id, day, endpoint) DO UPDATE SET requests = requests + excluded.requests,
+			errors = errors + excluded.errors`, count.keyID, count.day, count.endpoint, n, errors[count])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run flushes every keyUsageFlushEvery until ctx is done, and once more then.
+func (r *keyUsageRecorder) run(ctx context.Context) {
+	ticker := time.NewTicker(keyUsageFlushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.flush(); err != nil {
+				fmt.Printf("Key usage: %s\n", err)
+			}
+			return
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				fmt.Printf("Key usage: %s\n", err)
+			}
+		}
+	}
+}
+
+// EndpointUsage is the usage of an API key on one endpoint.
+type EndpointUsage struct {
+	Endpoint  string  `json:"endpoint"` // e.g. "GET /orders/*/history".
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"` // Responses of 400 and above.
+	ErrorRate float64 `json:"error_rate"`
+	LastDay   string  `json:"last_day"` // Last UTC day it was used, YYYY-MM-DD.
+}
+
+// DailyUsage is the usage of an API key during a UTC day.
+type DailyUsage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+}
+
+// KeyUsage is the body of GET /admin/keys/{id}/usage.
+type KeyUsage struct {
+	KeyID     string          `json:"key_id"`
+	TenantID  string          `json:"tenant_id"`
+	Since     string          `json:"since"` // First UTC day counted.
+	Requests  int64           `json:"requests"`
+	Errors    int64           `json:"errors"`
+	ErrorRate float64         `json:"error_rate"`
+	Endpoints []EndpointUsage `json:"endpoints"` // Most used first.
+	Days      []DailyUsage    `json:"days"`      // Oldest first, days without requests omitted.
+}
+
+// errorRate returns errors out of requests, 0 without requests.
+func errorRate(errors, requests int64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(errors) / float64(requests)
+}
+
+// KeyUsage returns the usage of key during the last days UTC days, today
+// included.
+func (s *OrderService) KeyUsage(key *APIKey, days int) (*KeyUsage, error) {
+	since := time.Now().UTC().AddDate(0, 0, -days+1).Format("2006-01-02")
+	usage := &KeyUsage{KeyID: key.ID, TenantID: key.TenantID, Since: since, Endpoints: []EndpointUsage{},
+		Days: []DailyUsage{}}
+	rows, err := s.DB.Query(`SELECT endpoint, SUM(requests), SUM(errors), MAX(day) FROM api_key_usage
+		WHERE key_id = ? AND day >= ? GROUP BY endpoint ORDER BY SUM(requests) DESC, endpoint`, key.ID, since)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query usage of key %s: %s", key.ID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var endpoint EndpointUsage
+		if err := rows.Scan(&endpoint.Endpoint, &endpoint.Requests, &endpoint.Errors, &endpoint.LastDay); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		endpoint.ErrorRate = errorRate(endpoint.Errors, endpoint.Requests)
+		usage.Requests += endpoint.Requests
+		usage.Errors += endpoint.Errors
+		usage.Endpoints = append(usage.Endpoints, endpoint)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query usage of key %s: %s", key.ID, err)
+	}
+	usage.ErrorRate = errorRate(usage.Errors, usage.Requests)
+
+	dayRows, err := s.DB.Query(`SELECT day, SUM(requests), SUM(errors) FROM api_key_usage
+		WHERE key_id = ? AND day >= ? GROUP BY day ORDER BY day`, key.ID, since)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query usage of key %s: %s", key.ID, err)
+	}
+	defer dayRows.Close()
+	for dayRows.Next() {
+		var day DailyUsage
+		if err := dayRows.Scan(&day.Day, &day.Requests, &day.Errors); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		usage.Days = append(usage.Days, day)
+	}
+	return usage, dayRows.Err()
+}
+
+// handleKeys serves /admin/keys/.
+//
+//	GET /admin/keys/{id}/usage?days=30  requests, errors and endpoints used by
+//	                                    a key, per day for at most 30 days.
+func (s *OrderService) handleKeys(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/admin/keys/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "usage" {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+		return
+	}
+	key, _, err := s.loadAPIKey(parts[0])
+	if err == errNoSuchAPIKey {
+		// Only admins learn whether a key exists.
+		if s.requireAdmin(w, req) {
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_KEY"}, "no such key %s", parts[0])
+		}
+		return
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadAPIKey(): %s", err)
+		return
+	}
+	if !s.requireTenantAdmin(w, req, key.TenantID) {
+		return
+	}
+	days := keyUsageRetentionDays
+	if param := req.URL.Query().Get("days"); param != "" {
+		if days, err = strconv.Atoi(param); err != nil || days < 1 || days > keyUsageRetentionDays {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: fmt.Sprintf("days must be 1 to %d", keyUsageRetentionDays)}, "days %q", param)
+			return
+		}
+	}
+	if err := s.keyUsage.flush(); err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "%s", err)
+		return
+	}
+	usage, err := s.KeyUsage(key, days)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "KeyUsage(): %s", err)
+		return
+	}
+	respond(w, req, 200, usage, "key %s %d requests", key.ID, usage.Requests)
+}
@@ -0,0 +1,59 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestKeyUsage(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	key := createKey(t, svc, "acme", scopeRead, scopeWrite)
+	other := createKey(t, svc, "other", scopeRead, scopeAdmin)
+
+	serveKey(svc, "POST", "/orders", key.Key, createOrderDetails)
+	serveKey(svc, "GET", "/orders/1", key.Key, "")
+	serveKey(svc, "GET", "/orders/1", key.Key, "")
+	if w := serveKey(svc, "GET", "/orders/2", key.Key, ""); w.Code != 404 {
+		t.Fatalf("GET /orders/2 returned %d", w.Code)
+	}
+	// Usage older than the retention is purged.
+	svc.keyUsage.now = func() time.Time { return time.Now().AddDate(0, 0, -keyUsageRetentionDays) }
+	serveKey(svc, "GET", "/orders", key.Key, "")
+	if err := svc.keyUsage.flush(); err != nil {
+		t.Fatal(err)
+	}
+	svc.keyUsage.now = time.Now
+
+	if w := serveKey(svc, "GET", "/admin/keys/"+key.ID+"/usage", other.Key, ""); w.Code != 401 {
+		t.Errorf("usage with another tenant's key returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/keys/nope/usage", ""); w.Code != 404 {
+		t.Errorf("usage of an unknown key returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/keys/"+key.ID+"/usage?days=31", ""); w.Code != 400 {
+		t.Errorf("usage of 31 days returned %d", w.Code)
+	}
+	w := serveAdmin(svc, "GET", "/admin/keys/"+key.ID+"/usage", "")
+	if w.Code != 200 {
+		t.Fatalf("usage returned %d: %s", w.Code, w.Body)
+	}
+	var usage KeyUsage
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	if usage.TenantID != "acme" || usage.Requests != 4 || usage.Errors != 1 || usage.ErrorRate != 0.25 ||
+		len(usage.Days) != 1 || usage.Days[0].Day != today || len(usage.Endpoints) != 2 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	if e := usage.Endpoints[0]; e.Endpoint != "GET /orders/*" || e.Requests != 3 || e.Errors != 1 || e.LastDay != today {
+		t.Errorf("unexpected endpoint %+v", e)
+	}
+	if e := usage.Endpoints[1]; e.Endpoint != "POST /orders" || e.Requests != 1 || e.Errors != 0 {
+		t.Errorf("unexpected endpoint %+v", e)
+	}
+}
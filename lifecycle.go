@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultStopTimeout is how long a component has to stop unless it says
+// otherwise.
+const defaultStopTimeout = 5 * time.Second
+
+// component is a part of the service started and stopped by a lifecycle.
+type component struct {
+	name    string
+	timeout time.Duration
+	stop    func(ctx context.Context) error
+}
+
+// lifecycle starts the components of the service in the order they depend on
+// each other and stops them in reverse, so the database outlives the
+// workers using it and the HTTP server drains before them. Each component
+// gets its own stop timeout; errors of all of them are returned together.
+type lifecycle struct {
+	ctx        context.Context
+	components []component
+
+	once sync.Once
+	err  error
+}
+
+// newLifecycle returns a lifecycle whose components run under ctx.
+func newLifecycle(ctx context.Context) *lifecycle {
+	return &lifecycle{ctx: ctx}
+}
+
+// start starts a component with start, if not nil, then registers stop, if
+// not nil, to run within timeout when the lifecycle stops. Components must be
+// started after those they depend on. A component failing to start isn't
+// registered.
+func (l *lifecycle) start(name string, timeout time.Duration, start, stop func(ctx context.Context) error) error {
+	if start != nil {
+		if err := start(l.ctx); err != nil {
+			return fmt.Errorf("unable to start %s: %s", name, err)
+		}
+	}
+	if stop != nil {
+		l.components = append(l.components, component{name: name, timeout: timeout, stop: stop})
+	}
+	return nil
+}
+
+// onStop registers stop for a component started already, such as an open
+// database.
+func (l *lifecycle) onStop(name string, stop func() error) {
+	l.start(name, defaultStopTimeout, nil, func(context.Context) error { return stop() })
+}
+
+// run runs a background worker until the lifecycle stops, when its context is
+// canceled and it has defaultStopTimeout to return.
+func (l *lifecycle) run(name string, worker func(ctx context.Context)) {
+	ctx, cancelFn := context.WithCancel(l.ctx)
+	done := make(chan struct{})
+	l.start(name, defaultStopTimeout, func(context.Context) error {
+		go func() {
+			defer close(done)
+			worker(ctx)
+		}()
+		return nil
+	}, func(stopCtx context.Context) error {
+		cancelFn()
+		select {
+		case <-done:
+			return nil
+		case <-stopCtx.Done():
+			return stopCtx.Err()
+		}
+	})
+}
+
+// stop stops the components, last started first, each within its timeout. A
+// component that doesn't stop in time is left behind and the next one
+// stopped. Returns the errors of all components. Calls after the first return
+// the same.
+func (l *lifecycle) stop() error {
+	l.once.Do(func() {
+		var errs []string
+		for i := len(l.components) - 1; i >= 0; i-- {
+			c := l.components[i]
+			start := time.Now()
+			if err := stopWithin(c); err != nil {
+				fmt.Printf("Shutdown: %s failed after %s: %s\n", c.name, time.Since(start).Round(time.Millisecond),
+					err)
+				errs = append(errs, c.name+": "+err.Error())
+			}
+		}
+		if len(errs) > 0 {
+			l.err = fmt.Errorf("shutdown failed: %s", strings.Join(errs, "; "))
+		}
+	})
+	return l.err
+}
+
+// stopWithin stops c, giving up after its timeout.
+func stopWithin(c component) error {
+	ctx, cancelFn := context.WithTimeout(context.Background(), c.timeout)
+	defer cancelFn()
+	stopped := make(chan error, 1)
+	go func() { stopped <- c.stop(ctx) }()
+	select {
+	case err := <-stopped:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("did not stop within %s", c.timeout)
+	}
+}
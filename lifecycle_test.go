@@ -0,0 +1,55 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifecycle(t *testing.T) {
+	lc := newLifecycle(context.Background())
+	var stopped []string
+	stopper := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			stopped = append(stopped, name)
+			return err
+		}
+	}
+	if err := lc.start("database", time.Second, nil, stopper("database", nil)); err != nil {
+		t.Fatal(err)
+	}
+	workerDone := false
+	lc.run("worker", func(ctx context.Context) {
+		<-ctx.Done()
+		// Stopped after the server, before the database.
+		stopped = append(stopped, "worker")
+		workerDone = true
+	})
+	err := lc.start("broken", time.Second, func(context.Context) error { return fmt.Errorf("no disk") },
+		stopper("broken", nil))
+	if err == nil || err.Error() != "unable to start broken: no disk" {
+		t.Errorf("start returned %v", err)
+	}
+	lc.start("webhooks", time.Second, nil, stopper("webhooks", fmt.Errorf("queue not flushed")))
+	lc.start("stuck", 10*time.Millisecond, nil, func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	lc.start("server", time.Second, nil, stopper("server", nil))
+
+	err = lc.stop()
+	if got := strings.Join(stopped, ", "); got != "server, webhooks, worker, database" || !workerDone {
+		t.Errorf("stopped %s", got)
+	}
+	if err == nil || err.Error() != "shutdown failed: stuck: did not stop within 10ms; webhooks: queue not flushed" {
+		t.Errorf("stop returned %v", err)
+	}
+	if again := lc.stop(); again != err || len(stopped) != 4 {
+		t.Errorf("second stop returned %v, stopped %v", again, stopped)
+	}
+}
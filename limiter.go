@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ConcurrencyLimits bound the number of requests served at once. Zero means
+// unlimited.
+type ConcurrencyLimits struct {
+	// Requests of any kind, except to /admin/ so operators can still get in.
+	Global int
+	// POST /orders and POST /orders/quote, each of which waits on the
+	// distance provider.
+	Distance int
+}
+
+// limiter is a counting semaphore. A nil limiter admits everything.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+// tryAcquire takes a slot if one is free, it never blocks. Every successful
+// call must be followed by release.
+func (l limiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// needsDistance returns true for requests that call the distance provider.
+func needsDistance(req *http.Request) bool {
+	return req.Method == http.MethodPost && (req.URL.Path == "/orders" || req.URL.Path == "/orders/quote")
+}
+
+// limit calls next unless the global or per-route limit is reached, in which
+// case the request is shed with 503 OVERLOADED rather than queued: when the
+// distance provider is slow, waiting requests would only pile up.
+func (s *OrderService) limit(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	var limiters []limiter
+	if !strings.HasPrefix(req.URL.Path, "/admin/") {
+		limiters = append(limiters, s.globalLimiter)
+	}
+	if needsDistance(req) {
+		limiters = append(limiters, s.distanceLimiter)
+	}
+	for i, l := range limiters {
+		if !l.tryAcquire() {
+			for _, acquired := range limiters[:i] {
+				acquired.release()
+			}
+			w.Header().Set("Retry-After", "1")
+			respond(w, req, 503, HTTPResponseError{Error: "OVERLOADED"}, "concurrency limit reached")
+			return
+		}
+	}
+	defer func() {
+		for _, l := range limiters {
+			l.release()
+		}
+	}()
+	next.ServeHTTP(w, req)
+}
@@ -0,0 +1,64 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// blockingDistance blocks Route until release is closed.
+type blockingDistance struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingDistance) Route(origin, destination []string) (Route, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return Route{Distance: 1000, Duration: 60}, nil
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Concurrency: ConcurrencyLimits{Global: 2, Distance: 1}})
+	blocking := blockingDistance{started: make(chan struct{}, 2), release: make(chan struct{})}
+	svc.defaultDistance = blocking
+
+	done := make(chan int)
+	go func() {
+		done <- serve(svc, "POST", "/orders", "", createOrderDetails).Code
+	}()
+	<-blocking.started
+
+	// The distance slot is taken, a second order is shed.
+	w := serve(svc, "POST", "/orders/quote", "", createOrderDetails)
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "OVERLOADED") {
+		t.Errorf("expected 503 OVERLOADED, got %d %s", w.Code, w.Body)
+	}
+	// Other requests still fit under the global limit.
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 200 {
+		t.Errorf("GET /orders returned %d", w.Code)
+	}
+
+	close(blocking.release)
+	if code := <-done; code != 200 {
+		t.Errorf("first POST /orders returned %d", code)
+	}
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Errorf("POST /orders after release returned %d", w.Code)
+	}
+}
+
+func TestGlobalLimitExemptsAdmin(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Concurrency: ConcurrencyLimits{Global: 1}})
+	svc.globalLimiter.tryAcquire()
+	defer svc.globalLimiter.release()
+
+	if w := serve(svc, "GET", "/orders", "", ""); w.Code != 503 {
+		t.Errorf("expected 503, got %d", w.Code)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/maintenance", ""); w.Code != 200 {
+		t.Errorf("GET /admin/maintenance returned %d", w.Code)
+	}
+}
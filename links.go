@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Relations of an OrderLink.
+const (
+	linkOutbound = "outbound" // The order this one returns from.
+	linkReturn   = "return"   // A return leg of this order.
+)
+
+// OrderLink is an order linked to another, e.g. the return leg of a round
+// trip. GET /orders/{id} lists the links of the order.
+type OrderLink struct {
+	ID       int64      `json:"id"`
+	Status   OrderState `json:"status"`
+	Relation string     `json:"relation"` // "outbound" or "return".
+}
+
+// errInvalidLinkedOrder is returned by Insert when the linked_order_id of an
+// order is not an order of its tenant.
+type errInvalidLinkedOrder struct {
+	ID int64
+}
+
+func (e errInvalidLinkedOrder) Error() string {
+	return fmt.Sprintf("no order %d to link to", e.ID)
+}
+
+// errLinkedOrderPending is returned by Take for return legs whose outbound
+// order hasn't been taken yet.
+var errLinkedOrderPending = fmt.Errorf("linked order not taken")
+
+// checkLinkedOrder returns errInvalidLinkedOrder unless orderID is an order
+// of tenant, archived or not.
+func checkLinkedOrder(db *sql.DB, tenant string, orderID int64) error {
+	var n int
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM orders WHERE id = ? AND tenant_id = ?) +
+		(SELECT COUNT(*) FROM orders_archive WHERE id = ? AND tenant_id = ?)`,
+		orderID, tenant, orderID, tenant).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("unable to query linked order %d: %s", orderID, err)
+	}
+	if n == 0 {
+		return errInvalidLinkedOrder{orderID}
+	}
+	return nil
+}
+
+// linkedOrderTaken returns true if the outbound order orderID has been taken,
+// it is archived once it is.
+func linkedOrderTaken(tx *sql.Tx, orderID int64) (bool, error) {
+	var status string
+	err := tx.QueryRow("SELECT status FROM orders WHERE id = ?", orderID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to query linked order %d: %s", orderID, err)
+	}
+	return status != string(StateUnassigned), nil
+}
+
+// orderLinks returns the outbound order of order, if any, then its return
+// legs, archived or not.
+func (s *OrderService) orderLinks(order *Order) ([]OrderLink, error) {
+	rows, err := s.DB.Query(`SELECT id, status, ? FROM orders WHERE id = ?
+		UNION ALL SELECT id, status, ? FROM orders_archive WHERE id = ?
+		UNION ALL SELECT id, status, ? FROM orders WHERE linked_order_id = ?
+		UNION ALL SELECT id, status, ? FROM orders_archive WHERE linked_order_id = ?
+		ORDER BY 3, 1`,
+		linkOutbound, order.LinkedOrderID, linkOutbound, order.LinkedOrderID,
+		linkReturn, order.Id, linkReturn, order.Id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query links of order %d: %s", order.Id, err)
+	}
+	defer rows.Close()
+	var links []OrderLink
+	for rows.Next() {
+		var link OrderLink
+		if err := rows.Scan(&link.ID, &link.Status, &link.Relation); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
@@ -0,0 +1,78 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLinkedOrders(t *testing.T) {
+	svc := newTestService(t, Config{})
+	returnLeg := func(outbound int64) string {
+		return fmt.Sprintf(`{"origin": ["37.8061044", "-122.2943356"], "destination": ["37.8093475", "-122.2740787"],
+			"linked_order_id": %d}`, outbound)
+	}
+	for _, body := range []string{createOrderDetails, returnLeg(1), createOrderDetails, returnLeg(3)} {
+		if w := serve(svc, "POST", "/orders", "acme", body); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+		}
+	}
+	if w := serve(svc, "POST", "/orders", "other", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	for _, outbound := range []int64{5, 99} {
+		w := serve(svc, "POST", "/orders", "acme", returnLeg(outbound))
+		if w.Code != 422 || !strings.Contains(w.Body.String(), "INVALID_LINKED_ORDER") {
+			t.Errorf("POST linked to order %d returned %d %s", outbound, w.Code, w.Body)
+		}
+	}
+
+	get := func(id int64) OrderDTO {
+		t.Helper()
+		w := serve(svc, "GET", fmt.Sprintf("/orders/%d", id), "acme", "")
+		var order OrderDTO
+		if err := json.NewDecoder(w.Body).Decode(&order); err != nil || w.Code != 200 {
+			t.Fatalf("GET order %d returned %d, %v", id, w.Code, err)
+		}
+		return order
+	}
+	if order := get(2); order.LinkedOrderID != 1 ||
+		fmt.Sprint(order.Links) != "[{1 UNASSIGNED outbound}]" {
+		t.Errorf("return leg is %+v", order)
+	}
+	if order := get(1); order.LinkedOrderID != 0 || fmt.Sprint(order.Links) != "[{2 UNASSIGNED return}]" {
+		t.Errorf("outbound order is %+v", order)
+	}
+
+	if w := serve(svc, "PATCH", "/orders/2", "acme", ""); w.Code != 409 ||
+		!strings.Contains(w.Body.String(), "LINKED_ORDER_PENDING") {
+		t.Errorf("take of a return leg before its outbound returned %d %s", w.Code, w.Body)
+	}
+	for _, id := range []string{"1", "2"} {
+		if w := serve(svc, "PATCH", "/orders/"+id, "acme", ""); w.Code != 200 {
+			t.Errorf("take of order %s returned %d %s", id, w.Code, w.Body)
+		}
+	}
+	if order := get(1); fmt.Sprint(order.Links) != "[{2 TAKEN return}]" {
+		t.Errorf("outbound order after takes is %+v", order)
+	}
+
+	// A batch takes the outbound order first.
+	if w := serve(svc, "POST", "/couriers/bob/batch-take", "acme", `{"orders": [4, 3]}`); w.Code != 409 {
+		t.Errorf("batch take of a return leg first returned %d %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "POST", "/couriers/bob/batch-take", "acme", `{"orders": [3, 4]}`); w.Code != 200 {
+		t.Errorf("batch take of a round trip returned %d %s", w.Code, w.Body)
+	}
+
+	w := serve(svc, "GET", "/orders?limit=10", "acme", "")
+	var orders []OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&orders); err != nil || len(orders) != 4 ||
+		orders[3].LinkedOrderID != 3 || orders[3].Links != nil {
+		t.Errorf("GET /orders returned %+v, %v", orders, err)
+	}
+}
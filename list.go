@@ -0,0 +1,344 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// orderStates maps the status column to its OrderState. Looking up a
+// []byte converted to string does not allocate.
+var orderStates = map[string]OrderState{
+	string(StateUnassigned): StateUnassigned,
+	string(StateTaken):      StateTaken,
+}
+
+// orderScanner scans rows of orderColumns into the same Order over and over,
+// avoiding an allocation per row and column where it can.
+type orderScanner struct {
+	key                          []byte // Config.FieldKey.
+	order                        Order
+	uid, status, currency        sql.RawBytes
+	duplicateOf, duration, price sql.NullInt64
+	linkedOrderID                sql.NullInt64
+	surge                        sql.NullFloat64
+	promoCode, paymentStatus     sql.RawBytes
+	discount, adjustments        sql.NullInt64
+	notes, metadata, tags        sql.RawBytes
+	priority, scheduledAt        sql.NullInt64
+	weight, volume               sql.NullInt64
+	dest                         []interface{}
+}
+
+func newOrderScanner(key []byte) *orderScanner {
+	s := &orderScanner{key: key}
+	s.dest = []interface{}{&s.order.Id, &s.uid, &s.order.Distance, &s.status, &s.duplicateOf, &s.linkedOrderID, &s.duration, &s.price,
+		&s.currency, &s.surge, &s.promoCode, &s.discount, &s.adjustments, &s.paymentStatus, &s.notes, &s.metadata, &s.tags, &s.priority, &s.scheduledAt, &s.weight, &s.volume, &s.order.SLABreached}
+	return s
+}
+
+// scan reads the current row. The returned Order is overwritten by the next
+// call.
+func (s *orderScanner) scan(rows *sql.Rows) (*Order, error) {
+	if err := rows.Scan(s.dest...); err != nil {
+		return nil, fmt.Errorf("row.Scan() failed: %s", err)
+	}
+	state, ok := orderStates[string(s.status)]
+	if !ok {
+		return nil, fmt.Errorf("found unknown status %s", s.status)
+	}
+	s.order.State = state
+	s.order.UID = string(s.uid)
+	s.order.DuplicateOf = s.duplicateOf.Int64
+	s.order.LinkedOrderID = s.linkedOrderID.Int64
+	s.order.Duration = s.duration.Int64
+	s.order.Price = s.price.Int64
+	// Nearly every order has the same currency, keep the previous string.
+	if string(s.currency) != s.order.Currency {
+		s.order.Currency = string(s.currency)
+	}
+	s.order.Surge = s.surge.Float64
+	if string(s.promoCode) != s.order.PromoCode {
+		s.order.PromoCode = string(s.promoCode)
+	}
+	s.order.Discount = s.discount.Int64
+	if string(s.paymentStatus) != s.order.PaymentStatus {
+		s.order.PaymentStatus = string(s.paymentStatus)
+	}
+	s.order.FinalPrice = nil
+	if s.adjustments.Valid {
+		finalPrice := s.order.Price + s.adjustments.Int64
+		s.order.FinalPrice = &finalPrice
+	}
+	if err := scanFields(s.key, &s.order, s.notes, s.metadata, s.tags, s.priority, s.scheduledAt, s.weight,
+		s.volume); err != nil {
+		return nil, err
+	}
+	return &s.order, nil
+}
+
+// EachOrder calls fn with each order on the given page. The Order passed to
+// fn is only valid until fn returns. A negative limit selects every order,
+// ignoring page.
+func (s *OrderService) EachOrder(filter OrderFilter, page int, limit int, fn func(*Order) error) error {
+	return s.eachOrder(filter, pageOffset(page, limit), limit, fn)
+}
+
+// pageOffset returns the number of orders before page.
+func pageOffset(page, limit int) int {
+	if limit < 0 {
+		return 0
+	}
+	return (page - 1) * limit
+}
+
+// eachOrder calls fn with limit orders, or every order if limit is negative,
+// after skipping offset orders.
+func (s *OrderService) eachOrder(filter OrderFilter, offset int, limit int, fn func(*Order) error) error {
+	query, args, err := filter.apply(selectFrom(orderColumns, "orders")).page(limit, offset).build()
+	if err != nil {
+		return err
+	}
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("SELECT ... FROM failed: %s", err)
+	}
+	defer rows.Close()
+
+	scanner := newOrderScanner(s.config.FieldKey)
+	for rows.Next() {
+		order, err := scanner.scan(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Count returns the number of orders matching filter.
+func (s *OrderService) Count(filter OrderFilter) (_ int, err error) {
+	defer observeStore("Count", time.Now(), &err)
+	query, args, err := filter.apply(selectFrom("COUNT(*)", "orders")).build()
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if err := s.DB.QueryRow(query, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("unable to count orders: %s", err)
+	}
+	return count, nil
+}
+
+// listBuffers holds buffers for encoding listings.
+var listBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// respondOrders serves a page of orders. Plain JSON listings are encoded
+// straight from the rows, JSON:API documents go through renderOrders.
+func (s *OrderService) respondOrders(w http.ResponseWriter, req *http.Request, filter OrderFilter, fields Fieldset,
+	page, limit int, format string, args ...interface{}) {
+	if wantsNDJSON(req) {
+		s.streamOrders(w, req, filter, fields, pageOffset(page, limit), limit, 200, format, args...)
+		return
+	}
+	if wantsJSONAPI(req) {
+		orders, err := s.List(filter, page, limit)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "failed orderService.List(): %s", err)
+			return
+		}
+		loc := s.requestLocation(req)
+		for idx := range orders {
+			orders[idx] = *localize(&orders[idx], loc)
+		}
+		body, err := s.renderOrders(req, orders, fields, page, limit, loc)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "renderOrders(): %s", err)
+			return
+		}
+		respond(w, req, 200, body, format, args...)
+		return
+	}
+	s.writeOrders(w, req, filter, fields, pageOffset(page, limit), limit, 200, format, args...)
+}
+
+// writeOrders responds with code and a JSON array of limit orders after the
+// first offset, their times in the time zone of the tenant.
+func (s *OrderService) writeOrders(w http.ResponseWriter, req *http.Request, filter OrderFilter, fields Fieldset,
+	offset, limit, code int, format string, args ...interface{}) {
+	buf := listBuffers.Get().(*[]byte)
+	defer listBuffers.Put(buf)
+	encoded := append((*buf)[:0], '[')
+	first := true
+	loc := s.requestLocation(req)
+	err := s.eachOrder(filter, offset, limit, func(order *Order) error {
+		if !first {
+			encoded = append(encoded, ',')
+		}
+		first = false
+		encoded = appendOrderJSON(encoded, localize(order, loc), fields)
+		return nil
+	})
+	encoded = append(encoded, ']')
+	*buf = encoded // Keep the grown buffer for the next listing.
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "failed orderService.EachOrder(): %s", err)
+		return
+	}
+	respond(w, req, code, json.RawMessage(encoded), format, args...)
+}
+
+// appendOrderJSON appends the JSON encoding of the selected fields of order to
+// dst, the same as json.Marshal(fields.Apply([]Order{*order})[0]) would.
+func appendOrderJSON(dst []byte, order *Order, fields Fieldset) []byte {
+	dst = append(dst, '{')
+	n := 0
+	member := func(name string) bool {
+		if fields != nil && !fields[name] {
+			return false
+		}
+		if n > 0 {
+			dst = append(dst, ',')
+		}
+		n++
+		dst = append(dst, '"')
+		dst = append(dst, name...)
+		dst = append(dst, '"', ':')
+		return true
+	}
+	// Without a fieldset omitempty applies, a fieldset asks for its fields
+	// whatever their values.
+	omit := func(empty bool) bool { return fields == nil && empty }
+
+	if member("id") {
+		dst = strconv.AppendInt(dst, order.Id, 10)
+	}
+	if !omit(order.UID == "") && member("uid") {
+		dst = appendJSONString(dst, order.UID)
+	}
+	if member("distance") {
+		dst = appendJSONFloat(dst, order.Distance)
+	}
+	if !omit(order.DistanceText == "") && member("distance_text") {
+		dst = appendJSONString(dst, order.DistanceText)
+	}
+	if member("status") {
+		dst = appendJSONString(dst, string(order.State))
+	}
+	if !omit(order.DuplicateOf == 0) && member("duplicate_of") {
+		dst = strconv.AppendInt(dst, order.DuplicateOf, 10)
+	}
+	if !omit(order.LinkedOrderID == 0) && member("linked_order_id") {
+		dst = strconv.AppendInt(dst, order.LinkedOrderID, 10)
+	}
+	if !omit(order.Duration == 0) && member("duration") {
+		dst = strconv.AppendInt(dst, order.Duration, 10)
+	}
+	if !omit(order.Price == 0) && member("price") {
+		dst = strconv.AppendInt(dst, order.Price, 10)
+	}
+	if !omit(order.Currency == "") && member("currency") {
+		dst = appendJSONString(dst, order.Currency)
+	}
+	if !omit(order.Surge == 0) && member("surge") {
+		dst = appendJSONFloat(dst, order.Surge)
+	}
+	if !omit(order.PromoCode == "") && member("promo_code") {
+		dst = appendJSONString(dst, order.PromoCode)
+	}
+	if !omit(order.Discount == 0) && member("discount") {
+		dst = strconv.AppendInt(dst, order.Discount, 10)
+	}
+	if !omit(order.FinalPrice == nil) && member("final_price") {
+		if order.FinalPrice == nil {
+			dst = append(dst, "null"...)
+		} else {
+			dst = strconv.AppendInt(dst, *order.FinalPrice, 10)
+		}
+	}
+	if !omit(order.PaymentStatus == "") && member("payment_status") {
+		dst = appendJSONString(dst, order.PaymentStatus)
+	}
+	if !omit(!order.SLABreached) && member("sla_breached") {
+		dst = strconv.AppendBool(dst, order.SLABreached)
+	}
+	if !omit(len(order.Links) == 0) && member("links") {
+		dst = appendJSON(dst, order.Links)
+	}
+	if !omit(order.Notes == "") && member("notes") {
+		dst = appendJSONString(dst, order.Notes)
+	}
+	if !omit(len(order.Metadata) == 0) && member("metadata") {
+		dst = appendJSON(dst, order.Metadata)
+	}
+	if !omit(len(order.Tags) == 0) && member("tags") {
+		dst = appendJSON(dst, order.Tags)
+	}
+	if !omit(order.Priority == 0) && member("priority") {
+		dst = strconv.AppendInt(dst, order.Priority, 10)
+	}
+	if !omit(order.ScheduledAt == nil) && member("scheduled_at") {
+		dst = appendJSON(dst, order.ScheduledAt)
+	}
+	if !omit(order.Weight == 0) && member("weight") {
+		dst = strconv.AppendInt(dst, order.Weight, 10)
+	}
+	if !omit(order.Volume == 0) && member("volume") {
+		dst = strconv.AppendInt(dst, order.Volume, 10)
+	}
+	return append(dst, '}')
+}
+
+// appendJSON appends v encoded by encoding/json, for the members orders
+// rarely have.
+func appendJSON(dst []byte, v interface{}) []byte {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return append(dst, "null"...)
+	}
+	return append(dst, encoded...)
+}
+
+// appendJSONFloat formats f like encoding/json does.
+func appendJSONFloat(dst []byte, f float64) []byte {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		// Not valid JSON, like json.Marshal refuses them.
+		return append(dst, "null"...)
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	start := len(dst)
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9.
+		if n := len(dst) - start; n >= 4 && dst[len(dst)-4] == 'e' && dst[len(dst)-3] == '-' &&
+			dst[len(dst)-2] == '0' {
+			dst[len(dst)-2] = dst[len(dst)-1]
+			dst = dst[:len(dst)-1]
+		}
+	}
+	return dst
+}
+
+// appendJSONString appends s as a JSON string. Strings that need escaping
+// are left to encoding/json.
+func appendJSONString(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == '"' || c == '\\' || c >= 0x80 {
+			encoded, _ := json.Marshal(s)
+			return append(dst, encoded...)
+		}
+	}
+	dst = append(dst, '"')
+	dst = append(dst, s...)
+	return append(dst, '"')
+}
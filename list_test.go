@@ -0,0 +1,110 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendOrderJSON(t *testing.T) {
+	finalPrice, scheduledAt := int64(1150), time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	orders := []Order{
+		{Id: 1, Distance: 1816, State: StateUnassigned},
+		{Id: 2, UID: "01ARYZ6S410000000000000000", Distance: 0.5, State: StateTaken, DuplicateOf: 1, LinkedOrderID: 1, Duration: 60, Price: 250, Currency: "USD"},
+		{Id: 3, Distance: 1e21, State: StateTaken, Currency: "a\"b"},
+		{Id: 4, Distance: 1e-7, State: StateTaken, Currency: "€"},
+		{Id: 5, UID: "01ARYZ6S410000000000000001", Distance: 1816, DistanceText: "1.8 km", State: StateTaken,
+			DuplicateOf: 1, LinkedOrderID: 2, Duration: 261, Price: 1250, Currency: "EUR", Surge: 1.5,
+			PromoCode: "SPRING", Discount: 100, FinalPrice: &finalPrice, PaymentStatus: paymentPaid, SLABreached: true,
+			Links: []OrderLink{{ID: 2, Status: StateTaken, Relation: "return"}}, Notes: "ring \"twice\"",
+			Metadata: map[string]string{"phone": "+15551234567", "floor": "3"}, Tags: []string{"vip", "fragile"},
+			Priority: 2, ScheduledAt: &scheduledAt, Weight: 1200, Volume: 30},
+	}
+	// Every member of OrderDTO, so that new members must be encoded too.
+	all := Fieldset{}
+	dto := reflect.TypeOf(OrderDTO{})
+	for idx := 0; idx < dto.NumField(); idx++ {
+		all[strings.Split(dto.Field(idx).Tag.Get("json"), ",")[0]] = true
+	}
+	// Order 5 sets all of them, so that a member appendOrderJSON leaves out
+	// differs from json.Marshal instead of both omitting it.
+	full := reflect.ValueOf(newOrderDTO(&orders[4])).Elem()
+	for idx := 0; idx < full.NumField(); idx++ {
+		if full.Field(idx).IsZero() {
+			t.Fatalf("order %d leaves %s unset", orders[4].Id, dto.Field(idx).Name)
+		}
+	}
+	fieldsets := []Fieldset{nil, all, {"status": true, "price": true, "currency": true},
+		{"id": true, "notes": true, "tags": true}, {"metadata": true, "scheduled_at": true, "sla_breached": true}}
+	for name := range all {
+		fieldsets = append(fieldsets, Fieldset{name: true})
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Listings localize orders before encoding them, in any offset.
+	locations := []*time.Location{time.UTC, newYork, time.FixedZone("", 5*3600+45*60)}
+	for _, fields := range fieldsets {
+		for _, loc := range locations {
+			for idx := range orders {
+				order := localize(&orders[idx], loc)
+				want, err := json.Marshal(fields.Apply([]Order{*order}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				want = want[1 : len(want)-1] // Strip the array.
+				if got := appendOrderJSON(nil, order, fields); string(got) != string(want) {
+					t.Errorf("fields %v in %s: got %s, want %s", fields, loc, got, want)
+				}
+			}
+		}
+	}
+}
+
+// newServiceWithOrders returns a service with n orders, every other one
+// taken.
+func newServiceWithOrders(b testing.TB, n int) *OrderService {
+	b.Helper()
+	svc := newTestService(b, Config{})
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		status := StateUnassigned
+		if i%2 == 0 {
+			status = StateTaken
+		}
+		_, err := tx.Exec("INSERT INTO orders (id, distance, status, duration, price, currency) VALUES (?, ?, ?, ?, ?, ?)",
+			i, 1000+i, string(status), 60+i, 250+i, "USD")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	return svc
+}
+
+func benchmarkList(b *testing.B, query string) {
+	svc := newServiceWithOrders(b, 200)
+	path := fmt.Sprintf("/orders?limit=200%s", query)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if w := serve(svc, "GET", path, "", ""); w.Code != 200 {
+			b.Fatalf("GET %s returned %d", path, w.Code)
+		}
+	}
+}
+
+func BenchmarkList(b *testing.B)       { benchmarkList(b, "") }
+func BenchmarkListFields(b *testing.B) { benchmarkList(b, "&fields=id,status,price") }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd socket
+	// activation, see sd_listen_fds(3).
+	listenFDsStart = 3
+	// readyFDEnv names the environment variable with the file descriptor a
+	// process started by handoff() writes to once it is ready to serve.
+	readyFDEnv = "ORDERSERVICE_READY_FD"
+	// handoffTimeout is how long the old process waits for the new one.
+	handoffTimeout = 30 * time.Second
+)
+
+// listen returns the listener to serve on. In order of preference it is the
+// socket passed by systemd (LISTEN_FDS) or by a previous process during a
+// handoff, the file descriptor listenFD if positive, a new listener on address
+// (see listenAddress) if not empty, or a new TCP listener on port.
+func listen(address string, port int, listenFD int, socketMode os.FileMode) (net.Listener, error) {
+	if fds := os.Getenv("LISTEN_FDS"); fds != "" {
+		pid := os.Getenv("LISTEN_PID")
+		if pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			// Don't pass the variables on to child processes.
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDNAMES")
+			if fds != "1" {
+				return nil, fmt.Errorf("expected one socket from LISTEN_FDS, got %s", fds)
+			}
+			return fileListener(listenFDsStart)
+		}
+	}
+	if listenFD > 0 {
+		return fileListener(listenFD)
+	}
+	if address != "" {
+		return listenAddress(address, socketMode)
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+// listenAddress listens on "unix:PATH", a unix domain socket with permissions
+// socketMode, or on "tcp:HOST:PORT" or "HOST:PORT", a TCP socket. A stale unix
+// socket left behind by a crashed process is replaced.
+func listenAddress(address string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", strings.TrimPrefix(address, "tcp:"))
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+	if path == "" {
+		return nil, fmt.Errorf("missing socket path in %q", address)
+	}
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, socketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("unable to chmod %s: %s", path, err)
+	}
+	return listener, nil
+}
+
+// fileListener returns a listener for the inherited socket fd.
+func fileListener(fd int) (net.Listener, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("listener-fd-%d", fd))
+	if file == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not a listening socket: %s", fd, err)
+	}
+	return listener, nil
+}
+
+// notifyReady tells the process that started us through handoff() that we
+// are serving. Does nothing if we weren't started by a handoff.
+func notifyReady() {
+	value := os.Getenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("Ignoring invalid %s=%q\n", readyFDEnv, value)
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "ready")
+	ready.Write([]byte("ready\n"))
+	ready.Close()
+}
+
+// handoff starts a new instance of the running binary, with the same
+// arguments, that serves on listener. It returns once the new process reports
+// it is ready, after which the caller should shut down gracefully; both
+// processes accept connections on the shared socket in the meantime so no
+// connection is refused. Returns an error, and the caller should keep serving,
+// if the new process fails to come up.
+func handoff(listener net.Listener) error {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("cannot pass %T to another process", listener)
+	}
+	socket, err := filer.File()
+	if err != nil {
+		return fmt.Errorf("unable to get listener file: %s", err)
+	}
+	defer socket.Close()
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("unable to create pipe: %s", err)
+	}
+	defer readyRead.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find executable: %s", err)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// ExtraFiles start at file descriptor 3.
+	cmd.ExtraFiles = []*os.File{socket, readyWrite}
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", fmt.Sprintf("%s=%d", readyFDEnv, listenFDsStart+1))
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return fmt.Errorf("unable to start %s: %s", executable, err)
+	}
+	// Reap the child if it exits before we do.
+	go cmd.Wait()
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyRead.Read(buf); err != nil {
+			result <- fmt.Errorf("new process %d exited before becoming ready", cmd.Process.Pid)
+			return
+		}
+		result <- nil
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+		// The socket file now belongs to the new process, closing our
+		// listener must not remove it.
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+		fmt.Printf("Handed off listener to process %d.\n", cmd.Process.Pid)
+		return nil
+	case <-time.After(handoffTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d not ready after %s", cmd.Process.Pid, handoffTimeout)
+	}
+}
@@ -1,15 +1,50 @@
+//go:build !integ
 // +build !integ
 
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 )
 
+// openTestDB returns a database in a temporary directory initialized with
+// schema.sql. It is closed when the test finishes.
+func openTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatalf("unable to open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(schemaSQL); err != nil {
+		t.Fatalf("unable to apply schema: %s", err)
+	}
+	return db
+}
+
+// newTestService returns an OrderService backed by a fresh test database.
+// Unless the config says otherwise, distances are computed by the haversine
+// provider so no Google Maps key is needed.
+func newTestService(t testing.TB, config Config) *OrderService {
+	t.Helper()
+	if config.DistanceProvider == "" {
+		config.DistanceProvider = providerHaversine
+	}
+	svc, err := NewOrderService(openTestDB(t), config, context.Background())
+	if err != nil {
+		t.Fatalf("NewOrderService failed: %s", err)
+	}
+	return svc
+}
+
 // Literal from (https://developers.google.com/maps/documentation/distance-matrix/intro#DistanceMatrixResponses).
 const gmapsResponse = `{
   "status": "OK",
@@ -84,7 +119,7 @@ func TestDeserializeGoogleMapsResponse(t *testing.T) {
 }
 
 func TestDeserializeCreateOrderDetails(t *testing.T) {
-	details, err := parseCreateOrderDetails(createOrderDetails)
+	details, err := parseCreateOrderDetails(createOrderDetails, true)
 	if err != nil {
 		t.Errorf("parseCreateOrderDetails failed: %s", err)
 	}
@@ -92,12 +127,41 @@ func TestDeserializeCreateOrderDetails(t *testing.T) {
 
 }
 
+func TestParseCreateOrderDetailsStrict(t *testing.T) {
+	typo := `{"origin": ["37.80", "-122.27"], "destination": ["37.80", "-122.29"], "destiantion": [], "extra": 1}`
+	if _, err := parseCreateOrderDetails(typo, false); err != nil {
+		t.Errorf("lenient parsing failed: %s", err)
+	}
+	_, err := parseCreateOrderDetails(typo, true)
+	unknown, ok := err.(errUnknownFields)
+	if !ok || len(unknown) != 2 || unknown[0] != "destiantion" || unknown[1] != "extra" {
+		t.Errorf("expected unknown fields, got %v", err)
+	}
+
+	svc := newTestService(t, Config{})
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader(typo))
+	req.Header.Set(apiVersionHeader, "2")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	expected := `{"error":"UNKNOWN_FIELDS","detail":"destiantion,extra"}`
+	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body)
+	}
+
+	req.Header.Set(apiVersionHeader, "4")
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if w.Code != 400 {
+		t.Errorf("expected 400 for unsupported version, got %d", w.Code)
+	}
+}
+
 func TestParseQueryParametersForList(t *testing.T) {
 	qparams := url.Values{}
 	qparams["page"] = []string{"3"}
 	qparams["limit"] = []string{"5"}
 
-	p, l, err := parseQueryParametersForList(qparams)
+	p, l, err := parseQueryParametersForList(qparams, defaultListLimits)
 	if err != nil {
 		t.Error(err)
 	}
@@ -108,8 +172,53 @@ func TestParseQueryParametersForList(t *testing.T) {
 		t.Error(l)
 	}
 
-	p, l, err = parseQueryParametersForList(url.Values{})
+	p, l, err = parseQueryParametersForList(url.Values{}, defaultListLimits)
 	if p != 1 || l != 10 || err != nil {
 		t.Error(p, l, err)
 	}
 }
+
+func TestParseQueryParametersForListInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		query  string
+		detail string
+	}{
+		{"page=0", "page must be at least 1, got 0"},
+		{"page=-3", "page must be at least 1, got -3"},
+		{"limit=0", "limit must be at least 1, got 0"},
+		{"limit=-1", "limit must be at least 1, got -1"},
+		{"page=one", `page must be an integer, got "one"`},
+		{"limit=1.5", `limit must be an integer, got "1.5"`},
+		{"page=1&page=2", "page given more than once"},
+		{"limit=", `limit must be an integer, got ""`},
+	} {
+		query, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = parseQueryParametersForList(query, defaultListLimits)
+		if err == nil || err.Error() != tc.detail {
+			t.Errorf("%s: expected %q, got %v", tc.query, tc.detail, err)
+		}
+	}
+
+	w := serve(newTestService(t, Config{}), "GET", "/orders?page=0", "", "")
+	expected := `{"error":"INVALID_PARAMETERS","detail":"page must be at least 1, got 0"}`
+	if w.Code != 400 || strings.TrimSpace(w.Body.String()) != expected {
+		t.Errorf("unexpected response %d %s", w.Code, w.Body)
+	}
+}
+
+func TestParseQueryParametersForListLimits(t *testing.T) {
+	limits := ListLimits{Default: 25, Max: 100}
+	if _, l, err := parseQueryParametersForList(url.Values{}, limits); l != 25 || err != nil {
+		t.Error(l, err)
+	}
+	if _, _, err := parseQueryParametersForList(url.Values{"limit": {"10000000"}}, limits); err == nil {
+		t.Error("expected limit above maximum to fail")
+	}
+	limits.Clamp = true
+	if _, l, err := parseQueryParametersForList(url.Values{"limit": {"10000000"}}, limits); l != 100 || err != nil {
+		t.Error(l, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Modes of a mapsRecorder.
+const (
+	mapsRecord = "record"
+	mapsReplay = "replay"
+)
+
+// mapsRecording is a golden file, a response of the Google Maps API.
+type mapsRecording struct {
+	Request    string          `json:"request"` // URL without the key.
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// mapsRecorder is an http.RoundTripper for the distance client. When
+// recording it passes requests on and saves each response to a golden file
+// in dir; when replaying it answers from the golden files and never goes to
+// the network. API keys are not part of recordings, so any key replays them.
+type mapsRecorder struct {
+	mode string
+	dir  string
+	next http.RoundTripper // Makes the requests being recorded.
+}
+
+func newMapsRecorder(mode, dir string, next http.RoundTripper) (*mapsRecorder, error) {
+	if mode != mapsRecord && mode != mapsReplay {
+		return nil, fmt.Errorf("unknown Maps recorder mode %q", mode)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &mapsRecorder{mode: mode, dir: dir, next: next}, nil
+}
+
+// recordingRequest returns the URL of a request without its key parameter.
+func recordingRequest(u *url.URL) string {
+	stripped := *u
+	query := stripped.Query()
+	query.Del("key")
+	stripped.RawQuery = query.Encode()
+	return stripped.String()
+}
+
+// recordingPath returns the golden file of a request.
+func (r *mapsRecorder) recordingPath(request string) string {
+	sum := sha256.Sum256([]byte(request))
+	return filepath.Join(r.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+func (r *mapsRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	request := recordingRequest(req.URL)
+	path := r.recordingPath(request)
+	if r.mode == mapsReplay {
+		return r.replay(req, request, path)
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response to record: %s", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return nil, fmt.Errorf("unable to record %s, response is not JSON: %s", request, err)
+	}
+	encoded, err := json.MarshalIndent(mapsRecording{Request: request, StatusCode: resp.StatusCode,
+		Body: indented.Bytes()}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode recording of %s: %s", request, err)
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create recordings directory: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(encoded, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("unable to save recording of %s: %s", request, err)
+	}
+	fmt.Printf("Maps recorder: recorded %s to %s\n", request, path)
+	return resp, nil
+}
+
+// replay returns the recorded response of a request.
+func (r *mapsRecorder) replay(req *http.Request, request, path string) (*http.Response, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recording of %s in %s, record it with -record-maps", request, r.dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read recording of %s: %s", request, err)
+	}
+	var recording mapsRecording
+	if err := json.Unmarshal(encoded, &recording); err != nil {
+		return nil, fmt.Errorf("invalid recording %s: %s", path, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recording.StatusCode, http.StatusText(recording.StatusCode)),
+		StatusCode:    recording.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(recording.Body)),
+		ContentLength: int64(len(recording.Body)),
+		Request:       req,
+	}, nil
+}
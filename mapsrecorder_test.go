@@ -0,0 +1,113 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var recordMapsFlag = flag.Bool("record-maps", false,
+	"Record testdata/maps from Google instead of replaying it, needs GOOGLE_MAPS_API_KEY")
+
+// TestMapsRecordings runs the Google distance provider against the responses
+// in testdata/maps, so changes in their shape show up without credentials.
+func TestMapsRecordings(t *testing.T) {
+	mode, key := mapsReplay, "replay-key"
+	if *recordMapsFlag {
+		mode, key = mapsRecord, os.Getenv("GOOGLE_MAPS_API_KEY")
+		if key == "" {
+			t.Fatal("-record-maps needs GOOGLE_MAPS_API_KEY")
+		}
+	}
+	recorder, err := newMapsRecorder(mode, filepath.Join("testdata", "maps"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyPool([]string{key}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	google := &googleDistance{keys: keys, client: &http.Client{Transport: recorder}}
+
+	tests := []struct {
+		name                string
+		origin, destination []string
+		want                Route
+		wantErr             string
+	}{
+		{"route", []string{"37.8093475", "-122.2740787"}, []string{"37.8061044", "-122.2943356"},
+			Route{Distance: 2489, Duration: 426}, ""},
+		{"no route", []string{"0", "0"}, []string{"37.8061044", "-122.2943356"}, Route{}, "ZERO_RESULTS"},
+		{"invalid origin", []string{"91", "0"}, []string{"37.8061044", "-122.2943356"}, Route{}, "NOT_FOUND"},
+	}
+	for _, test := range tests {
+		route, err := google.Route(test.origin, test.destination)
+		switch {
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.wantErr)
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case *recordMapsFlag:
+			// Live distances change as roads do.
+		case route != test.want:
+			t.Errorf("%s: got %+v, want %+v", test.name, route, test.want)
+		}
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestMapsRecorder(t *testing.T) {
+	dir := t.TempDir()
+	var calls int
+	google := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(`{"status":"OK"}`))}, nil
+	})
+	recorder, _ := newMapsRecorder(mapsRecord, dir, google)
+	client := &http.Client{Transport: recorder}
+	if _, err := client.Get("https://maps.example/json?origins=1&key=SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("got recordings %v", files)
+	}
+	recorded, _ := ioutil.ReadFile(files[0])
+	if strings.Contains(string(recorded), "SECRET") {
+		t.Errorf("recording contains the key: %s", recorded)
+	}
+
+	replayer, _ := newMapsRecorder(mapsReplay, dir, google)
+	client = &http.Client{Transport: replayer}
+	resp, err := client.Get("https://maps.example/json?key=OTHER&origins=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var compact bytes.Buffer
+	json.Compact(&compact, body)
+	if resp.StatusCode != 200 || compact.String() != `{"status":"OK"}` {
+		t.Errorf("replayed %d %s", resp.StatusCode, body)
+	}
+	if _, err := client.Get("https://maps.example/json?origins=2"); err == nil {
+		t.Error("expected an error replaying a request without recording")
+	}
+	if calls != 1 {
+		t.Errorf("Google called %d times, want 1", calls)
+	}
+}
@@ -0,0 +1,35 @@
+-- Schema version 1: tenants, their settings and saved views, where and when
+-- orders start and end, Maps key usage and the version of the schema, checked
+-- at startup. Databases from before it have the first orders table, of id,
+-- distance and status only.
+
+ALTER TABLE orders ADD COLUMN tenant_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE orders ADD COLUMN origin_lat REAL;
+ALTER TABLE orders ADD COLUMN origin_lng REAL;
+ALTER TABLE orders ADD COLUMN destination_lat REAL;
+ALTER TABLE orders ADD COLUMN destination_lng REAL;
+-- Unix time in seconds.
+ALTER TABLE orders ADD COLUMN created_at INTEGER;
+ALTER TABLE orders ADD COLUMN duplicate_of INTEGER;
+
+CREATE TABLE IF NOT EXISTS maps_key_usage (
+    key_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (key_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS tenant_settings (
+    tenant_id TEXT NOT NULL PRIMARY KEY,
+    distance_provider TEXT,
+    maps_api_key TEXT
+);
+
+CREATE TABLE IF NOT EXISTS views (
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    filter TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+
+PRAGMA user_version = 1;
@@ -0,0 +1,7 @@
+-- Schema version 2: the duration and price of orders.
+
+ALTER TABLE orders ADD COLUMN duration INTEGER;
+ALTER TABLE orders ADD COLUMN price INTEGER;
+ALTER TABLE orders ADD COLUMN currency TEXT;
+
+PRAGMA user_version = 2;
@@ -0,0 +1,12 @@
+-- Schema version 3: the audit log of changes to orders.
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    details TEXT,
+    created_at INTEGER NOT NULL
+);
+
+PRAGMA user_version = 3;
@@ -0,0 +1,14 @@
+-- Schema version 4: the events of orders, which the orders table is a
+-- projection of.
+
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    data TEXT,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_order_id ON events (order_id);
+
+PRAGMA user_version = 4;
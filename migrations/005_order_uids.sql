@@ -0,0 +1,8 @@
+-- Schema version 5: the uid of orders. sqlite can't add a UNIQUE column, the
+-- index makes it unique instead.
+
+ALTER TABLE orders ADD COLUMN uid TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS orders_uid ON orders (uid);
+
+PRAGMA user_version = 5;
@@ -0,0 +1,5 @@
+-- Schema version 7: the secret tenants sign requests with.
+
+ALTER TABLE tenant_settings ADD COLUMN signing_secret TEXT;
+
+PRAGMA user_version = 7;
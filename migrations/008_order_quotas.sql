@@ -0,0 +1,14 @@
+-- Schema version 8: the order quotas of tenants, and the orders they created
+-- per day.
+
+ALTER TABLE tenant_settings ADD COLUMN daily_order_quota INTEGER;
+ALTER TABLE tenant_settings ADD COLUMN monthly_order_quota INTEGER;
+
+CREATE TABLE IF NOT EXISTS order_usage (
+    tenant_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    orders INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant_id, day)
+);
+
+PRAGMA user_version = 8;
@@ -0,0 +1,15 @@
+-- Schema version 9: the billable events of tenants.
+
+CREATE TABLE IF NOT EXISTS billing_events (
+    id INTEGER NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    order_id INTEGER,
+    amount INTEGER NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS billing_events_created_at ON billing_events (created_at);
+
+PRAGMA user_version = 9;
@@ -0,0 +1,27 @@
+-- Schema version 10: the archive of old orders, and indexes of the columns
+-- orders are filtered by.
+
+CREATE TABLE IF NOT EXISTS orders_archive (
+    id INTEGER NOT NULL PRIMARY KEY,
+    uid TEXT UNIQUE,
+    distance REAL,
+    status TEXT NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    origin_lat REAL,
+    origin_lng REAL,
+    destination_lat REAL,
+    destination_lng REAL,
+    created_at INTEGER,
+    duplicate_of INTEGER,
+    duration INTEGER,
+    price INTEGER,
+    currency TEXT,
+    -- Unix time in seconds.
+    archived_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS orders_status ON orders (status);
+CREATE INDEX IF NOT EXISTS orders_created_at ON orders (created_at);
+CREATE INDEX IF NOT EXISTS orders_tenant_id ON orders (tenant_id);
+
+PRAGMA user_version = 10;
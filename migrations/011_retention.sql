@@ -0,0 +1,5 @@
+-- Schema version 11: per-tenant data retention.
+
+ALTER TABLE tenant_settings ADD COLUMN retention_days INTEGER;
+
+PRAGMA user_version = 11;
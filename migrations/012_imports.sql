@@ -0,0 +1,12 @@
+-- Schema version 12: reports of order imports.
+
+CREATE TABLE IF NOT EXISTS imports (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    report TEXT NOT NULL,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+PRAGMA user_version = 12;
@@ -0,0 +1,17 @@
+-- Schema version 13: fields clients may change with a merge patch.
+
+ALTER TABLE orders ADD COLUMN notes TEXT;
+ALTER TABLE orders ADD COLUMN metadata TEXT;
+ALTER TABLE orders ADD COLUMN tags TEXT;
+ALTER TABLE orders ADD COLUMN priority INTEGER;
+ALTER TABLE orders ADD COLUMN scheduled_at INTEGER;
+
+ALTER TABLE orders_archive ADD COLUMN notes TEXT;
+ALTER TABLE orders_archive ADD COLUMN metadata TEXT;
+ALTER TABLE orders_archive ADD COLUMN tags TEXT;
+ALTER TABLE orders_archive ADD COLUMN priority INTEGER;
+ALTER TABLE orders_archive ADD COLUMN scheduled_at INTEGER;
+
+CREATE INDEX IF NOT EXISTS orders_status_priority ON orders (status, priority);
+
+PRAGMA user_version = 13;
@@ -0,0 +1,7 @@
+-- Schema version 14: SLAs of tenants and the orders breaching them.
+
+ALTER TABLE tenant_settings ADD COLUMN take_sla_seconds INTEGER;
+ALTER TABLE orders ADD COLUMN sla_breached_at INTEGER;
+ALTER TABLE orders_archive ADD COLUMN sla_breached_at INTEGER;
+
+PRAGMA user_version = 14;
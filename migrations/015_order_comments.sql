@@ -0,0 +1,13 @@
+-- Schema version 15: internal comments on orders.
+
+CREATE TABLE IF NOT EXISTS order_comments (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    author TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_comments_order_id ON order_comments (order_id);
+
+PRAGMA user_version = 15;
@@ -0,0 +1,5 @@
+-- Schema version 16: text messages to tenants' customers.
+
+ALTER TABLE tenant_settings ADD COLUMN sms_notifications INTEGER;
+
+PRAGMA user_version = 16;
@@ -0,0 +1,11 @@
+-- Schema version 17: tenants' own wording of notifications.
+
+CREATE TABLE IF NOT EXISTS notification_templates (
+    tenant_id TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    template TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, channel, event_type)
+);
+
+PRAGMA user_version = 17;
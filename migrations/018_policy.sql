@@ -0,0 +1,5 @@
+-- Schema version 18: tenants' authorization policies.
+
+ALTER TABLE tenant_settings ADD COLUMN policy TEXT;
+
+PRAGMA user_version = 18;
@@ -0,0 +1,12 @@
+-- Schema version 19: requests per API key, day and endpoint.
+
+CREATE TABLE IF NOT EXISTS api_key_usage (
+    key_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    errors INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (key_id, day, endpoint)
+);
+
+PRAGMA user_version = 19;
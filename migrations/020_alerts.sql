@@ -0,0 +1,12 @@
+-- Schema version 20: anomalies detected in order creation.
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    detail TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS alerts_tenant_id ON alerts (tenant_id, id);
+
+PRAGMA user_version = 20;
@@ -0,0 +1,10 @@
+-- Schema version 21: service areas of tenants.
+
+CREATE TABLE IF NOT EXISTS service_areas (
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    geometry TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+
+PRAGMA user_version = 21;
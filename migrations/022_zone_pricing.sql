@@ -0,0 +1,12 @@
+-- Schema version 22: zone-based pricing.
+
+CREATE TABLE IF NOT EXISTS pricing_zones (
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    geometry TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+
+ALTER TABLE tenant_settings ADD COLUMN pricing TEXT;
+
+PRAGMA user_version = 22;
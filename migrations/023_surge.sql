@@ -0,0 +1,6 @@
+-- Schema version 23: surge multipliers of orders.
+
+ALTER TABLE orders ADD COLUMN surge REAL;
+ALTER TABLE orders_archive ADD COLUMN surge REAL;
+
+PRAGMA user_version = 23;
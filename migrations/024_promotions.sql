@@ -0,0 +1,18 @@
+-- Schema version 24: promotions and the discounts of orders.
+
+CREATE TABLE IF NOT EXISTS promotions (
+    tenant_id TEXT NOT NULL,
+    code TEXT NOT NULL,
+    percent INTEGER,
+    amount INTEGER,
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at INTEGER,
+    PRIMARY KEY (tenant_id, code)
+);
+ALTER TABLE orders ADD COLUMN promo_code TEXT;
+ALTER TABLE orders ADD COLUMN discount INTEGER;
+ALTER TABLE orders_archive ADD COLUMN promo_code TEXT;
+ALTER TABLE orders_archive ADD COLUMN discount INTEGER;
+
+PRAGMA user_version = 24;
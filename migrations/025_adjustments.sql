@@ -0,0 +1,6 @@
+-- Schema version 25: adjustments of the prices of orders.
+
+ALTER TABLE orders ADD COLUMN price_adjustments INTEGER;
+ALTER TABLE orders_archive ADD COLUMN price_adjustments INTEGER;
+
+PRAGMA user_version = 25;
@@ -0,0 +1,13 @@
+-- Schema version 26: payment statuses of orders and prepayment of tenants.
+
+ALTER TABLE orders ADD COLUMN payment_status TEXT;
+ALTER TABLE orders_archive ADD COLUMN payment_status TEXT;
+ALTER TABLE tenant_settings ADD COLUMN require_prepayment INTEGER;
+CREATE TABLE IF NOT EXISTS payment_events (
+    id TEXT NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    received_at INTEGER NOT NULL
+);
+
+PRAGMA user_version = 26;
@@ -0,0 +1,8 @@
+-- Schema version 27: senders of orders by email.
+
+CREATE TABLE IF NOT EXISTS email_senders (
+    address TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL
+);
+
+PRAGMA user_version = 27;
@@ -0,0 +1,23 @@
+-- Schema version 28: feeds of orders polled from CSV files.
+
+CREATE TABLE IF NOT EXISTS feeds (
+    tenant_id TEXT NOT NULL PRIMARY KEY,
+    url TEXT NOT NULL,
+    -- Unix time in seconds.
+    polled_at INTEGER,
+    error TEXT
+);
+
+-- Rows of feeds imported, with the order created or the error code of the
+-- rows that will not be.
+CREATE TABLE IF NOT EXISTS feed_rows (
+    tenant_id TEXT NOT NULL,
+    external_id TEXT NOT NULL,
+    order_id INTEGER,
+    error TEXT,
+    -- Unix time in seconds.
+    imported_at INTEGER NOT NULL,
+    PRIMARY KEY (tenant_id, external_id)
+);
+
+PRAGMA user_version = 28;
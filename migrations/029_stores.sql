@@ -0,0 +1,31 @@
+-- Schema version 29: online stores and the orders they delivered.
+
+-- Online stores whose orders become orders of tenant_id, picked up at the
+-- origin. credentials are the JSON StoreCredentials sealed with the secrets
+-- key.
+CREATE TABLE IF NOT EXISTS stores (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    platform TEXT NOT NULL,
+    url TEXT NOT NULL,
+    origin_lat TEXT NOT NULL,
+    origin_lng TEXT NOT NULL,
+    credentials TEXT NOT NULL,
+    webhook_id TEXT NOT NULL,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+-- Orders delivered by stores, with the order created or the error code they
+-- were refused with, so redeliveries are not created twice.
+CREATE TABLE IF NOT EXISTS store_orders (
+    store_id TEXT NOT NULL,
+    external_id TEXT NOT NULL,
+    order_id INTEGER,
+    error TEXT,
+    -- Unix time in seconds.
+    received_at INTEGER NOT NULL,
+    PRIMARY KEY (store_id, external_id)
+);
+
+PRAGMA user_version = 29;
@@ -0,0 +1,8 @@
+-- Schema version 30: progress of the warehouse exporter.
+
+CREATE TABLE IF NOT EXISTS warehouse_cursors (
+    sink TEXT NOT NULL PRIMARY KEY,
+    event_id INTEGER NOT NULL
+);
+
+PRAGMA user_version = 30;
@@ -0,0 +1,15 @@
+-- Schema version 31: responses of requests made with an Idempotency-Key.
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT NOT NULL PRIMARY KEY,
+    fingerprint TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    content_type TEXT,
+    body BLOB,
+    truncated INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+
+PRAGMA user_version = 31;
@@ -0,0 +1,11 @@
+-- Schema version 32: couriers preferred or blocked by tenants, per zone.
+
+CREATE TABLE IF NOT EXISTS courier_preferences (
+    tenant_id TEXT NOT NULL,
+    courier_id TEXT NOT NULL,
+    zone TEXT NOT NULL,
+    preference TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, courier_id, zone)
+);
+
+PRAGMA user_version = 32;
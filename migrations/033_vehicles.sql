@@ -0,0 +1,16 @@
+-- Schema version 33: vehicles of couriers, weight and volume of orders.
+
+ALTER TABLE orders ADD COLUMN weight INTEGER;
+ALTER TABLE orders ADD COLUMN volume INTEGER;
+
+ALTER TABLE orders_archive ADD COLUMN weight INTEGER;
+ALTER TABLE orders_archive ADD COLUMN volume INTEGER;
+
+CREATE TABLE IF NOT EXISTS couriers (
+    tenant_id TEXT NOT NULL,
+    courier_id TEXT NOT NULL,
+    vehicle TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, courier_id)
+);
+
+PRAGMA user_version = 33;
@@ -0,0 +1,8 @@
+-- Schema version 34: return legs linked to their outbound order.
+
+ALTER TABLE orders ADD COLUMN linked_order_id INTEGER;
+ALTER TABLE orders_archive ADD COLUMN linked_order_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS orders_linked_order_id ON orders (linked_order_id);
+
+PRAGMA user_version = 34;
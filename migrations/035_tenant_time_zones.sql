@@ -0,0 +1,5 @@
+-- Schema version 35: time zones of tenants, their business day.
+
+ALTER TABLE tenant_settings ADD COLUMN time_zone TEXT;
+
+PRAGMA user_version = 35;
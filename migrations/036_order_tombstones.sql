@@ -0,0 +1,16 @@
+-- Schema version 36: tombstones of orders gone from the orders table, for
+-- GET /orders?updated_since=.
+
+CREATE TABLE IF NOT EXISTS order_tombstones (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    -- archived or purged.
+    reason TEXT NOT NULL,
+    -- Unix time in seconds.
+    deleted_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_created_at ON events (created_at);
+
+PRAGMA user_version = 36;
@@ -0,0 +1,40 @@
+-- Schema version 37: created and taken events for the orders from before the
+-- events table, which orderservice replay deleted.
+--
+-- The events are numbered before every other event, as replay applies events
+-- in id order and such an order may have later events, e.g. updated. Columns
+-- the created event can't hold are set to what projecting it gives first:
+-- distance in whole meters and 0 or '' for NULL.
+
+UPDATE orders SET distance = ROUND(COALESCE(distance, 0)), duration = COALESCE(duration, 0),
+    price = COALESCE(price, 0), currency = COALESCE(currency, ''), created_at = COALESCE(created_at, 0)
+WHERE id NOT IN (SELECT order_id FROM events WHERE type = 'created');
+
+INSERT INTO events (id, order_id, type, data, created_at)
+SELECT 2 * (o.id - (SELECT MAX(id) FROM orders)) - 3, o.id, 'created',
+    '{"uid":"' || replace(replace(COALESCE(o.uid, ''), '\', '\\'), '"', '\"') ||
+    '","tenant_id":"' || replace(replace(o.tenant_id, '\', '\\'), '"', '\"') ||
+    '","origin_lat":' || quote(COALESCE(o.origin_lat, 0)) ||
+    ',"origin_lng":' || quote(COALESCE(o.origin_lng, 0)) ||
+    ',"destination_lat":' || quote(COALESCE(o.destination_lat, 0)) ||
+    ',"destination_lng":' || quote(COALESCE(o.destination_lng, 0)) ||
+    ',"duplicate_of":' || COALESCE(o.duplicate_of, 0) ||
+    ',"linked_order_id":' || COALESCE(o.linked_order_id, 0) ||
+    ',"distance":' || CAST(o.distance AS INTEGER) ||
+    ',"duration":' || o.duration ||
+    ',"price":' || o.price ||
+    ',"currency":"' || replace(replace(o.currency, '\', '\\'), '"', '\"') ||
+    '","surge":' || quote(COALESCE(o.surge, 0)) ||
+    ',"promo_code":"' || replace(replace(COALESCE(o.promo_code, ''), '\', '\\'), '"', '\"') ||
+    '","discount":' || COALESCE(o.discount, 0) || '}',
+    o.created_at
+FROM orders o
+WHERE o.id NOT IN (SELECT order_id FROM events WHERE type = 'created');
+
+INSERT INTO events (id, order_id, type, data, created_at)
+SELECT 2 * (o.id - (SELECT MAX(id) FROM orders)) - 2, o.id, 'taken', NULL, o.created_at
+FROM orders o
+WHERE o.status = 'TAKEN' AND o.id NOT IN (SELECT order_id FROM events WHERE type = 'taken')
+    AND o.id IN (SELECT order_id FROM events WHERE id < 0);
+
+PRAGMA user_version = 37;
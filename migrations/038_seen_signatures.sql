@@ -0,0 +1,12 @@
+-- Schema version 38: the signatures of recent signed requests, shared by the
+-- replicas to refuse replays.
+
+CREATE TABLE IF NOT EXISTS seen_signatures (
+    signature TEXT NOT NULL PRIMARY KEY,
+    -- Unix time in seconds.
+    expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS seen_signatures_expires_at ON seen_signatures (expires_at);
+
+PRAGMA user_version = 38;
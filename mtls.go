@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// CertIdentity is what a client certificate is mapped to. A Tenant binds the
+// client to that tenant, like an API key with Roles as scopes, otherwise it
+// may act for any tenant within its roles, like a dashboard user.
+type CertIdentity struct {
+	Tenant string
+	Roles  []string
+}
+
+// parseCertIdentities parses "SAN=TENANT:ROLE+ROLE,..." where SAN is a URI,
+// DNS name or email address in the client certificate and TENANT is "*" for
+// any tenant.
+func parseCertIdentities(value string) (map[string]CertIdentity, error) {
+	identities := map[string]CertIdentity{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		idx := strings.LastIndex(entry, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("expected SAN=TENANT:ROLE+ROLE, got %q", entry)
+		}
+		san, mapping := entry[:idx], entry[idx+1:]
+		parts := strings.SplitN(mapping, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected SAN=TENANT:ROLE+ROLE, got %q", entry)
+		}
+		identity := CertIdentity{Tenant: parts[0], Roles: strings.Split(parts[1], "+")}
+		if identity.Tenant == "*" {
+			identity.Tenant = ""
+		}
+		for _, role := range identity.Roles {
+			if !validScopes[role] {
+				return nil, fmt.Errorf("unknown role %q for %s", role, san)
+			}
+		}
+		identities[san] = identity
+	}
+	return identities, nil
+}
+
+// serverTLSConfig returns the TLS configuration for serving with the given
+// certificate. With a clientCAFile clients must present a certificate signed
+// by one of its CAs, unless optional is set in which case they may present
+// none and authenticate with bearer tokens instead.
+func serverTLSConfig(certFile, keyFile, clientCAFile string, optional bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load TLS certificate: %s", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client CAs: %s", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if optional {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// certSANs returns the subject alternative names of the verified client
+// certificate of req, if any.
+func certSANs(req *http.Request) []string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	var sans []string
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	return sans
+}
+
+// checkClientCert authenticates a request by its client certificate. Returns
+// the request to serve, or nil after responding with an error.
+func (s *OrderService) checkClientCert(w http.ResponseWriter, req *http.Request, sans []string) *http.Request {
+	for _, san := range sans {
+		identity, ok := s.config.ClientCertIdentities[san]
+		if !ok {
+			continue
+		}
+		scope := requiredScope(req)
+		if identity.Tenant == "" {
+			user := &DashboardUser{Subject: san, Roles: identity.Roles}
+			if scope != "" && !user.HasRole(scope) {
+				respond(w, req, 403, HTTPResponseError{Error: "INSUFFICIENT_SCOPE", Detail: scope + " role required"},
+					"client %s lacks %s", san, scope)
+				return nil
+			}
+			return req.WithContext(context.WithValue(req.Context(), dashboardUserContextKey{}, user))
+		}
+		key := &APIKey{ID: "cert:" + san, TenantID: identity.Tenant, Scopes: identity.Roles, Certificate: true}
+		if tenant := strings.TrimSpace(req.Header.Get(tenantHeader)); tenant != "" && tenant != key.TenantID {
+			respond(w, req, 403, HTTPResponseError{Error: "TENANT_MISMATCH"}, "client %s belongs to tenant %q, not %q",
+				san, key.TenantID, tenant)
+			return nil
+		}
+		if scope != "" && !key.HasScope(scope) {
+			respond(w, req, 403, HTTPResponseError{Error: "INSUFFICIENT_SCOPE", Detail: scope + " scope required"},
+				"client %s lacks %s", san, scope)
+			return nil
+		}
+		return req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, key))
+	}
+	respond(w, req, 403, HTTPResponseError{Error: "UNKNOWN_CLIENT_CERTIFICATE"}, "no identity for %v", sans)
+	return nil
+}
@@ -0,0 +1,156 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert makes a certificate from template, signed by parent or self
+// signed if parent is nil.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// writePEM writes the certificate and key to dir and returns their paths.
+func (c *testCert) writePEM(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "mesh CA"},
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	server := newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(2), IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	serverCert, serverKey := server.writePEM(t, dir, "server")
+	client := func(uri string) *testCert {
+		u, _ := url.Parse(uri)
+		return newTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(3), URIs: []*url.URL{u},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	}
+
+	identities, err := parseCertIdentities("spiffe://mesh/billing=acme:read, spiffe://mesh/ops=*:read+write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := newTestService(t, Config{ClientCertIdentities: identities})
+	ts := httptest.NewUnstartedServer(svc)
+	ts.TLS, err = serverTLSConfig(serverCert, serverKey, caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	do := func(cert *testCert, method, path, tenant string) (int, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		config := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{cert.tlsCertificate()}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(createOrderDetails))
+		if tenant != "" {
+			req.Header.Set(tenantHeader, tenant)
+		}
+		response, err := httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+
+	billing, ops := client("spiffe://mesh/billing"), client("spiffe://mesh/ops")
+	tests := []struct {
+		name         string
+		cert         *testCert
+		method, path string
+		tenant       string
+		code         int
+	}{
+		{"tenant client reads", billing, "GET", "/orders", "", 200},
+		{"tenant client may not write", billing, "POST", "/orders", "", 403},
+		{"tenant client is bound to its tenant", billing, "GET", "/orders", "other", 403},
+		{"any-tenant client writes", ops, "POST", "/orders", "other", 200},
+		{"unknown client", client("spiffe://mesh/unknown"), "GET", "/orders", "", 403},
+	}
+	for _, test := range tests {
+		if code, err := do(test.cert, test.method, test.path, test.tenant); err != nil || code != test.code {
+			t.Errorf("%s: got %d, %v, want %d", test.name, code, err, test.code)
+		}
+	}
+	if _, err := do(nil, "GET", "/orders", ""); err == nil {
+		t.Errorf("expected the handshake to fail without a client certificate")
+	}
+	// Certificates are not API keys and are left out of their usage.
+	svc.keyUsage.mu.Lock()
+	defer svc.keyUsage.mu.Unlock()
+	if len(svc.keyUsage.requests) != 0 {
+		t.Errorf("certificates counted as API keys: %v", svc.keyUsage.requests)
+	}
+}
+
+func TestParseCertIdentities(t *testing.T) {
+	for _, value := range []string{"spiffe://x", "spiffe://x=acme", "spiffe://x=acme:root", "spiffe://x=:read"} {
+		if _, err := parseCertIdentities(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
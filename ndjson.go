@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ndjsonMediaType is newline delimited JSON, one order per line.
+const ndjsonMediaType = "application/x-ndjson"
+
+// ndjsonFlushEvery is the number of orders written between flushes.
+const ndjsonFlushEvery = 100
+
+// ndjsonListLimits apply to NDJSON listings. Orders are written as they are
+// read so there is no reason to cap the page size, without a limit every
+// matching order is returned.
+var ndjsonListLimits = ListLimits{Default: -1}
+
+// wantsNDJSON returns true if the client accepts NDJSON listings.
+func wantsNDJSON(req *http.Request) bool {
+	return accepts(req, ndjsonMediaType)
+}
+
+// listLimits returns the limits on the page size of the listing asked for by
+// req.
+func (s *OrderService) listLimits(req *http.Request) ListLimits {
+	if wantsNDJSON(req) {
+		return ndjsonListLimits
+	}
+	return s.config.ListLimits
+}
+
+// streamOrders responds with code and limit orders after the first offset as
+// NDJSON, their times in the time zone of the tenant, writing them while the
+// rows are scanned.
+// Writes block while the client is slow to read, which in turn holds back
+// the query. Errors after the first order can only be logged, the status has
+// been sent by then.
+func (s *OrderService) streamOrders(w http.ResponseWriter, req *http.Request, filter OrderFilter, fields Fieldset,
+	offset, limit, code int, format string, args ...interface{}) {
+	flusher, _ := w.(http.Flusher)
+	var (
+		line    []byte
+		written int
+		quote   = stringIDs(req)
+	)
+	loc := s.requestLocation(req)
+	err := s.eachOrder(filter, offset, limit, func(order *Order) error {
+		if written == 0 {
+			w.Header().Set("Content-Type", ndjsonMediaType)
+			w.WriteHeader(code)
+		}
+		line = appendOrderJSON(line[:0], localize(order, loc), fields)
+		if quote {
+			if quoted, err := rewriteIDs(line, true); err == nil {
+				line = append(line[:0], quoted...)
+			}
+		}
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return req.Context().Err()
+	})
+	switch {
+	case err != nil && written == 0:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "failed orderService.EachOrder(): %s", err)
+	case err != nil:
+		fmt.Printf("Method:%s; Path:%s, %d %s, aborted after %d orders: %s\n", req.Method, req.URL.Path, code,
+			fmt.Sprintf(format, args...), written, err)
+	default:
+		if written == 0 {
+			w.Header().Set("Content-Type", ndjsonMediaType)
+			w.WriteHeader(code)
+		}
+		fmt.Printf("Method:%s; Path:%s, %d %s, %d orders\n", req.Method, req.URL.Path, code,
+			fmt.Sprintf(format, args...), written)
+	}
+}
@@ -0,0 +1,62 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func getNDJSON(t *testing.T, svc *OrderService, path string) []OrderDTO {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept", ndjsonMediaType)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if w.Code != 200 || w.Header().Get("Content-Type") != ndjsonMediaType {
+		t.Fatalf("GET %s returned %d %s", path, w.Code, w.Header().Get("Content-Type"))
+	}
+	var orders []OrderDTO
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var order OrderDTO
+		if err := json.Unmarshal(scanner.Bytes(), &order); err != nil {
+			t.Fatalf("line %q: %s", scanner.Text(), err)
+		}
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+func TestNDJSON(t *testing.T) {
+	svc := newServiceWithOrders(t, 250)
+
+	// Without a limit every order is streamed, well over -max-list-limit.
+	if orders := getNDJSON(t, svc, "/orders"); len(orders) != 250 || orders[249].ID != 250 {
+		t.Errorf("expected 250 orders, got %d", len(orders))
+	}
+	orders := getNDJSON(t, svc, "/orders?page=2&limit=5&status=TAKEN")
+	if len(orders) != 5 || orders[0].ID != 12 || orders[0].Status != StateTaken {
+		t.Errorf("unexpected page %+v", orders)
+	}
+	if orders := getNDJSON(t, svc, "/orders?status=TAKEN&min_distance=2000"); len(orders) != 0 {
+		t.Errorf("expected no orders, got %d", len(orders))
+	}
+
+	req := httptest.NewRequest("GET", "/orders?limit=1&fields=id", nil)
+	req.Header.Set("Accept", "application/json, "+ndjsonMediaType)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	if body := w.Body.String(); body != "{\"id\":1}\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// Plain listings are still capped.
+	if w := serve(svc, "GET", "/orders?limit=250", "", ""); w.Code != 400 || !strings.Contains(w.Body.String(), "maximum") {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Environment variables holding the Twilio account text messages are sent
+// with. Without them no messages are sent.
+const (
+	twilioAccountSIDEnv = "ORDERSERVICE_TWILIO_ACCOUNT_SID"
+	twilioAuthTokenEnv  = "ORDERSERVICE_TWILIO_AUTH_TOKEN"
+)
+
+// defaultTwilioBaseURL is where the Twilio API is called by default.
+const defaultTwilioBaseURL = "https://api.twilio.com"
+
+// phoneMetadataKey is the order metadata key holding the customer's phone
+// number, in E.164 format.
+const phoneMetadataKey = "phone"
+
+// e164RE matches phone numbers in E.164 format.
+var e164RE = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// smsNotifications counts the text messages sent and failed.
+var smsNotifications = expvar.NewMap("sms_notifications")
+
+// Notifier sends a message to a customer.
+type Notifier interface {
+	Notify(ctx context.Context, to, message string) error
+}
+
+// twilioNotifier sends text messages with Twilio's Messages API.
+type twilioNotifier struct {
+	client     *http.Client
+	baseURL    string
+	accountSID string
+	authToken  string // SECRET.
+	from       string // Phone number messages are sent from.
+}
+
+// Notify sends message to the phone number to.
+func (n *twilioNotifier) Notify(ctx context.Context, to, message string) error {
+	form := url.Values{"From": {n.from}, "To": {to}, "Body": {message}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		n.baseURL+"/2010-04-01/Accounts/"+url.PathEscape(n.accountSID)+"/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+	req.SetBasicAuth(n.accountSID, n.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Twilio: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Twilio returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// NotificationData is what message templates are executed with.
+type NotificationData struct {
+	OrderID  int64
+	TenantID string
+	Status   OrderState
+	// Expected arrival, once the order is taken.
+	ETA *time.Time
+}
+
+// defaultSMSTemplates are the text messages sent per event type, unless the
+// tenant has templates of its own. Other events are not notified.
+var defaultSMSTemplates = map[EventType]string{
+	EventCreated: "Order {{.OrderID}} has been received.",
+	EventTaken:   `Order {{.OrderID}} is on its way{{with .ETA}}, expected at {{.Format "15:04 MST"}}{{end}}.`,
+}
+
+// smsDispatcher periodically texts the customers of tenants with SMS
+// notifications enabled when their orders are created or taken, to the phone
+// number in the order's metadata. Failed messages are logged and not retried.
+// Only events recorded after the dispatcher started are notified.
+type smsDispatcher struct {
+	interval time.Duration
+	db       *sql.DB
+	fieldKey []byte // Config.FieldKey, order metadata is encrypted with.
+	notifier Notifier
+	lastID   int64 // Id of the last event dispatched.
+}
+
+// newSMSDispatcher returns a dispatcher of the events recorded from now on.
+func newSMSDispatcher(interval time.Duration, db *sql.DB, fieldKey []byte, notifier Notifier) (*smsDispatcher,
+	error) {
+	d := &smsDispatcher{interval: interval, db: db, fieldKey: fieldKey, notifier: notifier}
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM events").Scan(&d.lastID); err != nil {
+		return nil, fmt.Errorf("unable to find the last event: %s", err)
+	}
+	return d, nil
+}
+
+// run dispatches every interval until ctx is done.
+func (d *smsDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.dispatch(ctx); err != nil {
+				fmt.Printf("SMS notifier: %s\n", err)
+			}
+		}
+	}
+}
+
+// smsEvent is an event to notify.
+type smsEvent struct {
+	eventID  int64
+	typ      EventType
+	data     NotificationData
+	metadata sql.NullString
+}
+
+// dispatch sends the messages of the events recorded since the last
+// dispatch. Returns the number of messages sent.
+func (d *smsDispatcher) dispatch(ctx context.Context) (int, error) {
+	var upTo int64
+	if err := d.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM events").Scan(&upTo); err != nil {
+		return 0, fmt.Errorf("unable to find the last event: %s", err)
+	}
+	rows, err := d.db.QueryContext(ctx, `SELECT e.id, e.type, e.created_at, o.id, o.tenant_id, o.status, o.duration,
+			o.metadata FROM events e
+		JOIN orders o ON o.id = e.order_id
+		JOIN tenant_settings s ON s.tenant_id = o.tenant_id
+		WHERE e.id > ? AND e.id <= ? AND s.sms_notifications = 1 AND e.type IN (?, ?)
+		ORDER BY e.id`, d.lastID, upTo, string(EventCreated), string(EventTaken))
+	if err != nil {
+		return 0, fmt.Errorf("unable to query events: %s", err)
+	}
+	var events []smsEvent
+	for rows.Next() {
+		var (
+			event     smsEvent
+			createdAt int64
+			duration  sql.NullInt64
+		)
+		if err := rows.Scan(&event.eventID, &event.typ, &createdAt, &event.data.OrderID, &event.data.TenantID,
+			&event.data.Status, &duration, &event.metadata); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if event.typ == EventTaken {
+			eta := time.Unix(createdAt+duration.Int64, 0).UTC()
+			event.data.ETA = &eta
+		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to query events: %s", err)
+	}
+	templates := map[string]map[EventType]*template.Template{}
+	for _, event := range events {
+		if _, ok := templates[event.data.TenantID]; !ok {
+			if templates[event.data.TenantID], err = loadNotificationTemplates(d.db, event.data.TenantID,
+				channelSMS); err != nil {
+				return 0, err
+			}
+		}
+	}
+	// Messages are sent at most once, failed ones are not retried.
+	d.lastID = upTo
+
+	sent := 0
+	for _, event := range events {
+		var metadata map[string]string
+		if event.metadata.Valid {
+			plaintext, err := openField(d.fieldKey, []byte(event.metadata.String))
+			if err != nil {
+				fmt.Printf("SMS notifier: order %d: %s\n", event.data.OrderID, err)
+				continue
+			}
+			json.Unmarshal(plaintext, &metadata)
+		}
+		phone := metadata[phoneMetadataKey]
+		if phone == "" {
+			continue
+		}
+		if !e164RE.MatchString(phone) {
+			fmt.Printf("SMS notifier: order %d: invalid phone number %s\n", event.data.OrderID, maskPhone(phone))
+			continue
+		}
+		var message strings.Builder
+		if err := templates[event.data.TenantID][event.typ].Execute(&message, event.data); err != nil {
+			fmt.Printf("SMS notifier: order %d: %s\n", event.data.OrderID, err)
+			continue
+		}
+		if err := d.notifier.Notify(ctx, phone, message.String()); err != nil {
+			smsNotifications.Add("failed", 1)
+			fmt.Printf("SMS notifier: order %d: %s message to %s failed: %s\n", event.data.OrderID, event.typ,
+				maskPhone(phone), err)
+			continue
+		}
+		smsNotifications.Add("sent", 1)
+		sent++
+	}
+	return sent, nil
+}
+
+// maskPhone hides all but the last 4 digits of a phone number, for logs.
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return strings.Repeat("*", len(phone))
+	}
+	return strings.Repeat("*", len(phone)-4) + phone[len(phone)-4:]
+}
+
+// NotificationSettings is the body of GET and PUT
+// /admin/tenants/{tenant}/notifications.
+type NotificationSettings struct {
+	// Text customers when their orders are created and taken.
+	SMS bool `json:"sms"`
+}
+
+// SetNotifications sets the notification settings of tenant.
+func (s *OrderService) SetNotifications(tenant string, settings NotificationSettings) error {
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, sms_notifications) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET sms_notifications = excluded.sms_notifications`, tenant, settings.SMS)
+	if err != nil {
+		return fmt.Errorf("unable to set notifications of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantNotifications serves /admin/tenants/{tenant}/notifications.
+//
+//	GET /admin/tenants/{tenant}/notifications  returns the NotificationSettings.
+//	PUT /admin/tenants/{tenant}/notifications  sets them, {"sms": true}.
+func (s *OrderService) handleTenantNotifications(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var settings NotificationSettings
+		if err := json.Unmarshal(buf.Bytes(), &settings); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if err := s.SetNotifications(tenant, settings); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetNotifications(): %s", err)
+			return
+		}
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	respond(w, req, 200, NotificationSettings{SMS: settings.SMSNotifications}, "tenant %q SMS %t", tenant,
+		settings.SMSNotifications)
+}
@@ -0,0 +1,74 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSMSNotifications(t *testing.T) {
+	type message struct{ to, body string }
+	var messages []message
+	twilio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if sid, token, _ := req.BasicAuth(); sid != "AC1" || token != "token" ||
+			req.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		if to := req.FormValue("To"); to == "+15550000000" {
+			http.Error(w, `{"message": "unreachable"}`, 400)
+			return
+		}
+		messages = append(messages, message{req.FormValue("To"), req.FormValue("Body")})
+		w.WriteHeader(201)
+	}))
+	defer twilio.Close()
+
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	dispatcher, err := newSMSDispatcher(0, svc.DB, svc.config.FieldKey, &twilioNotifier{client: twilio.Client(), baseURL: twilio.URL,
+		accountSID: "AC1", authToken: "token", from: "+15559999999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/notifications", `{"sms": true}`); w.Code != 200 ||
+		!strings.Contains(w.Body.String(), `"sms":true`) {
+		t.Fatalf("enabling SMS returned %d: %s", w.Code, w.Body)
+	}
+
+	// Orders 1 and 3 of acme have phones, the second one unreachable; order 2
+	// has none and order 4 is of a tenant without SMS.
+	for _, tenant := range []string{"acme", "acme", "acme", "other"} {
+		if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	for id, phone := range map[int64]string{1: "+15551234567", 3: "+15550000000", 4: "+15557654321"} {
+		if _, err := svc.Update(id, []byte(`{"metadata": {"phone": "`+phone+`"}}`), "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "acme", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Fatalf("take returned %d: %s", w.Code, w.Body)
+	}
+
+	sent, err := dispatcher.dispatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || len(messages) != 2 {
+		t.Fatalf("sent %d messages: %v", sent, messages)
+	}
+	if messages[0].to != "+15551234567" || messages[0].body != "Order 1 has been received." ||
+		!strings.HasPrefix(messages[1].body, "Order 1 is on its way, expected at ") {
+		t.Errorf("messages %v", messages)
+	}
+	// Nothing is sent twice, failures included.
+	if sent, err := dispatcher.dispatch(context.Background()); err != nil || sent != 0 {
+		t.Errorf("second dispatch sent %d: %v", sent, err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures validation of ID tokens issued by the corporate
+// identity provider to dashboard users. An empty Issuer disables it.
+type OIDCConfig struct {
+	Issuer   string
+	ClientID string // Expected audience of ID tokens.
+	// URL of the provider's signing keys. Found through the provider's
+	// discovery document when empty.
+	JWKSURL string
+	// Claim listing the user's groups, "groups" when empty.
+	GroupsClaim string
+	// Role given to members of each group, one of read, write or admin.
+	GroupRoles map[string]string
+}
+
+// parseGroupRoles parses "group=role,group=role".
+func parseGroupRoles(value string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		idx := strings.LastIndex(pair, "=")
+		if idx <= 0 || !validScopes[pair[idx+1:]] {
+			return nil, fmt.Errorf("expected GROUP=read|write|admin, got %q", pair)
+		}
+		roles[pair[:idx]] = pair[idx+1:]
+	}
+	return roles, nil
+}
+
+const (
+	// oidcLeeway is the clock skew tolerated when checking token times.
+	oidcLeeway = time.Minute
+	// jwksRefreshEvery limits fetches of the signing keys when tokens name
+	// unknown keys.
+	jwksRefreshEvery = time.Minute
+)
+
+var errInvalidIDToken = fmt.Errorf("invalid ID token")
+
+// DashboardUser is a person signed in through the identity provider.
+type DashboardUser struct {
+	Subject string
+	Email   string
+	Roles   []string // read, write or admin, from the user's groups.
+}
+
+// HasRole returns true if the user has role. Admins have every role.
+func (u *DashboardUser) HasRole(role string) bool {
+	for _, granted := range u.Roles {
+		if granted == role || granted == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcVerifier validates RS256-signed ID tokens.
+type oidcVerifier struct {
+	config OIDCConfig
+	client *http.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey // By key id.
+	fetchedAt time.Time
+}
+
+func newOIDCVerifier(config OIDCConfig, client *http.Client) *oidcVerifier {
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return &oidcVerifier{config: config, client: client, now: time.Now, keys: map[string]*rsa.PublicKey{}}
+}
+
+// looksLikeJWT returns true for tokens of three dot separated parts.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature, issuer, audience and lifetime of an ID token
+// and returns the user it identifies.
+func (v *oidcVerifier) Verify(token string) (*DashboardUser, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidIDToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%s: header: %s", errInvalidIDToken, err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%s: unsupported algorithm %q", errInvalidIDToken, header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%s: signature: %s", errInvalidIDToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%s: bad signature", errInvalidIDToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%s: claims: %s", errInvalidIDToken, err)
+	}
+	if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+		return nil, fmt.Errorf("%s: issuer %q", errInvalidIDToken, iss)
+	}
+	if !audienceContains(claims["aud"], v.config.ClientID) {
+		return nil, fmt.Errorf("%s: audience %v", errInvalidIDToken, claims["aud"])
+	}
+	now := v.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(oidcLeeway)) {
+		return nil, fmt.Errorf("%s: expired", errInvalidIDToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%s: not valid yet", errInvalidIDToken)
+	}
+
+	user := &DashboardUser{}
+	user.Subject, _ = claims["sub"].(string)
+	user.Email, _ = claims["email"].(string)
+	groups, _ := claims[v.config.GroupsClaim].([]interface{})
+	for _, group := range groups {
+		name, _ := group.(string)
+		if role, ok := v.config.GroupRoles[name]; ok {
+			user.Roles = append(user.Roles, role)
+		}
+	}
+	return user, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+// audienceContains returns true if the aud claim, a string or an array of
+// strings, contains clientID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, value := range aud {
+			if value == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the given id, fetching the provider's
+// keys if it is unknown.
+func (v *oidcVerifier) key(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if !v.fetchedAt.IsZero() && v.now().Sub(v.fetchedAt) < jwksRefreshEvery {
+		return nil, fmt.Errorf("%s: unknown key %q", errInvalidIDToken, kid)
+	}
+	v.fetchedAt = v.now()
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unknown key %q", errInvalidIDToken, kid)
+}
+
+// fetchKeys downloads the provider's RSA signing keys.
+func (v *oidcVerifier) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	jwksURL := v.config.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.config.Issuer, "/")+"/.well-known/openid-configuration",
+			&discovery); err != nil {
+			return nil, err
+		}
+		jwksURL = discovery.JWKSURI
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %s", jwk.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS: %s", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, dest interface{}) error {
+	response, err := v.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed http.Client{}.Get() %s: %s", url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d", url, response.StatusCode)
+	}
+	if err := json.NewDecoder(response.Body).Decode(dest); err != nil {
+		return fmt.Errorf("unable to decode %s: %s", url, err)
+	}
+	return nil
+}
+
+// dashboardUserContextKey is the context key of the DashboardUser a request
+// is made by.
+type dashboardUserContextKey struct{}
+
+// dashboardUserFromRequest returns the signed in user making req, or nil.
+func dashboardUserFromRequest(req *http.Request) *DashboardUser {
+	user, _ := req.Context().Value(dashboardUserContextKey{}).(*DashboardUser)
+	return user
+}
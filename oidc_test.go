@@ -0,0 +1,117 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testIdP is an identity provider serving its discovery document and keys.
+type testIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": idp.URL, "jwks_uri": idp.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// token returns an ID token signed by the IdP with the given claims on top of
+// valid defaults.
+func (idp *testIdP) token(t *testing.T, claims map[string]interface{}) string {
+	all := map[string]interface{}{"iss": idp.URL, "aud": "dashboard", "sub": "u1",
+		"exp": time.Now().Add(time.Hour).Unix()}
+	for name, value := range claims {
+		all[name] = value
+	}
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "k1"}) + "." + encode(all)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newTestIdP(t)
+	svc := newTestService(t, Config{AdminToken: "secret", OIDC: OIDCConfig{Issuer: idp.URL, ClientID: "dashboard",
+		GroupRoles: map[string]string{"support": scopeRead, "ops": scopeAdmin}}})
+
+	support := idp.token(t, map[string]interface{}{"groups": []string{"support", "sales"}})
+	ops := idp.token(t, map[string]interface{}{"groups": []string{"ops"}})
+	tests := []struct {
+		name, method, path, token string
+		code                      int
+	}{
+		{"read role may list", "GET", "/orders", support, 200},
+		{"read role may not create", "POST", "/orders", support, 403},
+		{"read role is not admin", "GET", "/admin/maintenance", support, 401},
+		{"admin role may create", "POST", "/orders", ops, 200},
+		{"admin role is admin", "GET", "/admin/maintenance", ops, 200},
+		{"no groups", "GET", "/orders", idp.token(t, nil), 403},
+		{"expired", "GET", "/orders", idp.token(t, map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}), 401},
+		{"other audience", "GET", "/orders", idp.token(t, map[string]interface{}{"aud": []string{"other"}}), 401},
+		{"other issuer", "GET", "/orders", idp.token(t, map[string]interface{}{"iss": "https://evil"}), 401},
+		{"tampered", "GET", "/orders", support[:len(support)-4] + "AAAA", 401},
+	}
+	for _, test := range tests {
+		body := ""
+		if test.method == "POST" {
+			body = createOrderDetails
+		}
+		if w := serveKey(svc, test.method, test.path, test.token, body); w.Code != test.code {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.code, w.Body)
+		}
+	}
+
+	// Machine clients keep using API keys.
+	key := createKey(t, svc, "acme", scopeRead)
+	if w := serveKey(svc, "GET", "/orders", key.Key, ""); w.Code != 200 {
+		t.Errorf("GET with API key returned %d", w.Code)
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := parseGroupRoles("ops=admin, support=read,")
+	if err != nil || len(roles) != 2 || roles["ops"] != scopeAdmin || roles["support"] != scopeRead {
+		t.Errorf("got %v, %v", roles, err)
+	}
+	if _, err := parseGroupRoles("ops=root"); err == nil {
+		t.Errorf("expected an error for an unknown role")
+	}
+}
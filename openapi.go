@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPISpec describes the orders API, see openapi.json.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Modes of Config.OpenAPIValidation.
+const (
+	// openAPILog logs requests and responses not matching openAPISpec.
+	openAPILog = "log"
+	// openAPIStrict also rejects such requests with 400 and replaces such
+	// responses with 500.
+	openAPIStrict = "strict"
+)
+
+// openAPIMismatches counts the requests and responses not matching
+// openAPISpec.
+var openAPIMismatches = expvar.NewMap("openapi_mismatches")
+
+// jsonSchema is the subset of the OpenAPI 3.0 schema object openAPISpec
+// uses.
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Type       string                 `json:"type"`
+	Format     string                 `json:"format"`
+	Nullable   bool                   `json:"nullable"`
+	Enum       []interface{}          `json:"enum"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	// false, or the schema of properties not in Properties.
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	Items                *jsonSchema     `json:"items"`
+	OneOf                []*jsonSchema   `json:"oneOf"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Ref     string                      `json:"$ref"`
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Required bool                        `json:"required"`
+		Content  map[string]openAPIMediaType `json:"content"`
+	} `json:"requestBody"`
+	// By status code or "default".
+	Responses map[string]*openAPIResponse `json:"responses"`
+}
+
+// openAPIPath is a path of the spec with its operations by lower case method.
+type openAPIPath struct {
+	path       string
+	re         *regexp.Regexp // Matches the path with its {parameters}.
+	operations map[string]*openAPIOperation
+}
+
+// openAPIValidator checks requests and responses against openAPISpec.
+type openAPIValidator struct {
+	mode      string
+	paths     []openAPIPath // Paths without parameters first.
+	schemas   map[string]*jsonSchema
+	responses map[string]*openAPIResponse
+}
+
+// openAPIMethods are the path item members that are operations.
+var openAPIMethods = []string{"get", "put", "post", "delete", "patch"}
+
+// newOpenAPIValidator parses spec and checks that its references resolve.
+func newOpenAPIValidator(mode string, spec []byte) (*openAPIValidator, error) {
+	if mode != openAPILog && mode != openAPIStrict {
+		return nil, fmt.Errorf("invalid OpenAPI validation %q, expected %s or %s", mode, openAPILog, openAPIStrict)
+	}
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas   map[string]*jsonSchema      `json:"schemas"`
+			Responses map[string]*openAPIResponse `json:"responses"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI spec: %s", err)
+	}
+	v := &openAPIValidator{mode: mode, schemas: doc.Components.Schemas, responses: doc.Components.Responses}
+	for name, schema := range v.schemas {
+		if err := v.checkSchemaRefs(schema); err != nil {
+			return nil, fmt.Errorf("schema %s: %s", name, err)
+		}
+	}
+	for path, item := range doc.Paths {
+		p := openAPIPath{path: path, operations: map[string]*openAPIOperation{}}
+		pattern := regexp.MustCompile(`\\\{[^/]+\\\}`).ReplaceAllString(regexp.QuoteMeta(path), "[^/]+")
+		p.re = regexp.MustCompile("^" + pattern + "$")
+		for _, method := range openAPIMethods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var operation openAPIOperation
+			if err := json.Unmarshal(raw, &operation); err != nil {
+				return nil, fmt.Errorf("invalid OpenAPI operation %s %s: %s", method, path, err)
+			}
+			if err := v.checkRefs(&operation); err != nil {
+				return nil, fmt.Errorf("%s %s: %s", method, path, err)
+			}
+			p.operations[method] = &operation
+		}
+		v.paths = append(v.paths, p)
+	}
+	sort.Slice(v.paths, func(i, j int) bool {
+		iParams, jParams := strings.Contains(v.paths[i].path, "{"), strings.Contains(v.paths[j].path, "{")
+		if iParams != jParams {
+			return jParams
+		}
+		return v.paths[i].path < v.paths[j].path
+	})
+	return v, nil
+}
+
+// checkRefs returns an error if a reference of operation does not resolve.
+func (v *openAPIValidator) checkRefs(operation *openAPIOperation) error {
+	var schemas []*jsonSchema
+	if operation.RequestBody != nil {
+		for _, media := range operation.RequestBody.Content {
+			schemas = append(schemas, media.Schema)
+		}
+	}
+	for code, response := range operation.Responses {
+		if response = v.response(response); response == nil {
+			return fmt.Errorf("unresolved response %s", code)
+		}
+		for _, media := range response.Content {
+			schemas = append(schemas, media.Schema)
+		}
+	}
+	for _, schema := range schemas {
+		if err := v.checkSchemaRefs(schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSchemaRefs returns an error if a reference of schema does not
+// resolve. Referenced schemas are checked by themselves.
+func (v *openAPIValidator) checkSchemaRefs(schema *jsonSchema) error {
+	if schema == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		if v.schema(schema) == nil {
+			return fmt.Errorf("unresolved reference %s", schema.Ref)
+		}
+		return nil
+	}
+	for _, property := range schema.Properties {
+		if err := v.checkSchemaRefs(property); err != nil {
+			return err
+		}
+	}
+	for _, s := range append([]*jsonSchema{schema.Items}, schema.OneOf...) {
+		if err := v.checkSchemaRefs(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schema resolves a reference to a component schema, nil if there is none.
+func (v *openAPIValidator) schema(schema *jsonSchema) *jsonSchema {
+	if schema == nil || schema.Ref == "" {
+		return schema
+	}
+	return v.schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+}
+
+// response resolves a reference to a component response, nil if there is
+// none.
+func (v *openAPIValidator) response(response *openAPIResponse) *openAPIResponse {
+	if response == nil || response.Ref == "" {
+		return response
+	}
+	return v.responses[strings.TrimPrefix(response.Ref, "#/components/responses/")]
+}
+
+// operation returns the operation of method on path, nil if undocumented.
+func (v *openAPIValidator) operation(method, path string) *openAPIOperation {
+	for _, p := range v.paths {
+		if p.re.MatchString(path) {
+			return p.operations[strings.ToLower(method)]
+		}
+	}
+	return nil
+}
+
+// validate returns an error describing where value does not match schema.
+func (v *openAPIValidator) validate(schema *jsonSchema, value interface{}, at string) error {
+	schema = v.schema(schema)
+	if schema == nil {
+		return nil
+	}
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return fmt.Errorf("%s: must not be null", at)
+	}
+	if len(schema.OneOf) > 0 {
+		matches := 0
+		for _, option := range schema.OneOf {
+			if v.validate(option, value, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: matches %d of the oneOf schemas, want 1", at, matches)
+		}
+		return nil
+	}
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, allowed := range schema.Enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, value, schema.Enum)
+		}
+	}
+
+	switch schema.Type {
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: must be a string", at)
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return fmt.Errorf("%s: must be an RFC 3339 time", at)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && n != math.Trunc(n)) {
+			return fmt.Errorf("%s: must be an %s", at, schema.Type)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: must be a boolean", at)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an array", at)
+		}
+		for i, item := range items {
+			if err := v.validate(schema.Items, item, at+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: must be an object", at)
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		var additional *jsonSchema
+		closed := string(schema.AdditionalProperties) == "false"
+		if !closed && len(schema.AdditionalProperties) > 0 {
+			json.Unmarshal(schema.AdditionalProperties, &additional)
+		}
+		for name, member := range object {
+			property, ok := schema.Properties[name]
+			switch {
+			case ok:
+			case closed:
+				return fmt.Errorf("%s: unknown member %s", at, name)
+			default:
+				property = additional
+			}
+			if err := v.validate(property, member, at+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateJSON validates the JSON document body against schema.
+func (v *openAPIValidator) validateJSON(schema *jsonSchema, body []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err)
+	}
+	return v.validate(schema, value, "$")
+}
+
+// checkRequest validates the body of req, which is left for the handler to
+// read. Bodies with an undocumented Content-Type are validated as
+// application/json, the handlers read them as JSON regardless.
+func (v *openAPIValidator) checkRequest(operation *openAPIOperation, req *http.Request) error {
+	if operation.RequestBody == nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to read body: %s", err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	media, ok := operation.RequestBody.Content[mediaType]
+	if !ok {
+		media = operation.RequestBody.Content["application/json"]
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if operation.RequestBody.Required {
+			return fmt.Errorf("missing body")
+		}
+		return nil
+	}
+	return v.validateJSON(media.Schema, body)
+}
+
+// checkResponse validates a response of operation. Only JSON bodies are
+// validated.
+func (v *openAPIValidator) checkResponse(operation *openAPIOperation, code int, header http.Header, body []byte) error {
+	response, ok := operation.Responses[strconv.Itoa(code)]
+	if !ok {
+		if response, ok = operation.Responses["default"]; !ok {
+			return fmt.Errorf("undocumented status %d", code)
+		}
+	}
+	media, ok := v.response(response).Content["application/json"]
+	if !ok || media.Schema == nil {
+		return nil
+	}
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/json" {
+			return nil
+		}
+	}
+	if err := v.validateJSON(media.Schema, body); err != nil {
+		return fmt.Errorf("status %d: %s", code, err)
+	}
+	return nil
+}
+
+// contractRecorder keeps the status and body of a response. Unless it
+// buffers them, they are also written through.
+type contractRecorder struct {
+	http.ResponseWriter
+	buffer bool
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *contractRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	if !r.buffer {
+		r.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (r *contractRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.WriteHeader(200)
+	}
+	r.body.Write(b)
+	if r.buffer {
+		return len(b), nil
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// serve validates req and the response of next to it. JSON:API and NDJSON
+// responses are not described by the spec and left alone.
+func (v *openAPIValidator) serve(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	operation := v.operation(req.Method, req.URL.Path)
+	if operation == nil {
+		next.ServeHTTP(w, req)
+		return
+	}
+	if err := v.checkRequest(operation, req); err != nil {
+		openAPIMismatches.Add("request", 1)
+		fmt.Printf("OpenAPI: %s %s request: %s\n", req.Method, req.URL.Path, err)
+		if v.mode == openAPIStrict {
+			respond(w, req, 400, HTTPResponseError{Error: "OPENAPI_MISMATCH", Detail: err.Error()}, "%s", err)
+			return
+		}
+	}
+	if wantsJSONAPI(req) || wantsNDJSON(req) {
+		next.ServeHTTP(w, req)
+		return
+	}
+
+	recorder := &contractRecorder{ResponseWriter: w, buffer: v.mode == openAPIStrict}
+	next.ServeHTTP(recorder, req)
+	if recorder.code == 0 {
+		recorder.WriteHeader(200)
+	}
+	if err := v.checkResponse(operation, recorder.code, w.Header(), recorder.body.Bytes()); err != nil {
+		openAPIMismatches.Add("response", 1)
+		fmt.Printf("OpenAPI: %s %s response: %s\n", req.Method, req.URL.Path, err)
+		if v.mode == openAPIStrict {
+			w.Header().Del("Content-Length")
+			respond(w, req, 500, HTTPResponseError{Error: "OPENAPI_MISMATCH", Detail: err.Error()}, "%s", err)
+			return
+		}
+	}
+	if recorder.buffer {
+		w.WriteHeader(recorder.code)
+		w.Write(recorder.body.Bytes())
+	}
+}
@@ -0,0 +1,85 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIValidation(t *testing.T) {
+	svc := newTestService(t, Config{OpenAPIValidation: openAPIStrict})
+	tests := []struct {
+		name, method, path, body string
+		code                     int
+	}{
+		{"valid create", "POST", "/orders", createOrderDetails, 200},
+		{"origin not an array", "POST", "/orders", `{"origin": "1,2", "destination": ["3", "4"]}`, 400},
+		{"missing destination", "POST", "/orders/quote", `{"origin": ["1", "2"]}`, 400},
+		{"missing body", "POST", "/orders", "", 400},
+		{"invalid take", "PATCH", "/orders/1", `{"status": "DONE"}`, 400},
+		{"valid take", "PATCH", "/orders/1", `{"status": "TAKEN"}`, 200},
+		{"take without body", "PATCH", "/orders/1", "", 409},
+		{"valid get", "GET", "/orders/1", "", 200},
+		{"documented error", "GET", "/orders/2", "", 404},
+		{"list", "GET", "/orders?fields=id,status", "", 200},
+	}
+	for _, test := range tests {
+		w := serve(svc, test.method, test.path, "", test.body)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.code, w.Body)
+		}
+		if test.code == 400 && !strings.Contains(w.Body.String(), "OPENAPI_MISMATCH") {
+			t.Errorf("%s: %s", test.name, w.Body)
+		}
+	}
+	if w := servePatch(svc, "/orders/1", `{"priority": "high"}`); w.Code != 400 {
+		t.Errorf("invalid merge patch: %d %s", w.Code, w.Body)
+	}
+	if w := servePatch(svc, "/orders/1", `{"priority": 2, "notes": null}`); w.Code != 200 {
+		t.Errorf("valid merge patch: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOpenAPIResponses(t *testing.T) {
+	// A handler drifting from the spec.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/orders/1":
+			w.Write([]byte(`{"id": 1, "status": "LOST"}`))
+		case "/orders/2":
+			w.WriteHeader(418)
+			w.Write([]byte(`{"error": "TEAPOT"}`))
+		case "/orders/3":
+			w.Write([]byte(`{"id": 3, "distance": 12.5, "status": "TAKEN", "tags": ["vip"]}`))
+		}
+	})
+	for _, mode := range []string{openAPILog, openAPIStrict} {
+		v, err := newOpenAPIValidator(mode, openAPISpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, strictCode := range map[string]int{"/orders/1": 500, "/orders/2": 418, "/orders/3": 200} {
+			want, wantBody := 200, "{"
+			if path == "/orders/2" {
+				want = 418
+			}
+			if mode == openAPIStrict {
+				want = strictCode
+			}
+			w := httptest.NewRecorder()
+			v.serve(w, httptest.NewRequest("GET", path, nil), handler)
+			if w.Code != want || !strings.HasPrefix(w.Body.String(), wantBody) {
+				t.Errorf("%s %s: got %d %s, want %d", mode, path, w.Code, w.Body, want)
+			}
+		}
+	}
+
+	if _, err := newOpenAPIValidator(openAPILog, []byte(`{"paths": {"/x": {"get": {"responses":
+		{"200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Missing"}}}}}}}}}`)); err == nil {
+		t.Errorf("unresolved reference accepted")
+	}
+}
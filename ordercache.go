@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// orderCacheVars count the hits, misses and invalidations of the order
+// caches, served with the other expvar variables by GET /admin/metrics.
+var orderCacheVars = expvar.NewMap("order_cache")
+
+// OrderCacheConfig keeps single orders in memory for GET /orders/{id} and
+// the tracking page, which read the same orders over and over.
+type OrderCacheConfig struct {
+	// Orders kept, the least recently read are evicted first. 0 disables
+	// the cache. Orders are kept in Redis instead if the service has one,
+	// evicted as Redis sees fit.
+	Size int
+	// How long an order is served from the cache at most, which bounds how
+	// stale it gets when changed outside of the event stream, e.g. purged.
+	TTL time.Duration
+	// Time between reads of the events appended by other replicas, whose
+	// orders are dropped from the cache. 0 for a single replica, whose own
+	// writes drop them.
+	Poll time.Duration
+}
+
+// orderCacheVersionTTL is how long the version of an order is kept in Redis
+// after it changed, it must exceed OrderCacheConfig.TTL.
+const orderCacheVersionTTL = 24 * time.Hour
+
+// orderCache is a read-through LRU cache of Get.
+type orderCache struct {
+	config OrderCacheConfig
+	now    func() time.Time
+	// Keeps the orders instead, under prefix, if set.
+	redis  *redisClient
+	prefix string
+
+	mu      sync.Mutex
+	entries map[int64]*list.Element // Of cachedOrder, by order id.
+	lru     list.List               // Most recently read first.
+	// Incremented by every invalidation, so that an order read before one
+	// is not cached after it.
+	generation uint64
+}
+
+type cachedOrder struct {
+	order   *Order
+	expires time.Time
+}
+
+func newOrderCache(config OrderCacheConfig) *orderCache {
+	return &orderCache{config: config, now: time.Now, entries: map[int64]*list.Element{}, prefix: "order:"}
+}
+
+// get returns the order orderID from the cache, or reads it with load and
+// caches it. The order is shared and must not be modified.
+func (c *orderCache) get(orderID int64, load func(int64) (*Order, error)) (*Order, error) {
+	if c.config.Size <= 0 {
+		return load(orderID)
+	}
+	if c.redis != nil {
+		return c.getRedis(orderID, load)
+	}
+	c.mu.Lock()
+	now := c.now()
+	if elem, ok := c.entries[orderID]; ok {
+		if cached := elem.Value.(*cachedOrder); now.Before(cached.expires) {
+			c.lru.MoveToFront(elem)
+			c.mu.Unlock()
+			orderCacheVars.Add("hits", 1)
+			return cached.order, nil
+		}
+		c.remove(elem)
+	}
+	generation := c.generation
+	c.mu.Unlock()
+	orderCacheVars.Add("misses", 1)
+
+	order, err := load(orderID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return order, nil
+	}
+	if elem, ok := c.entries[orderID]; ok {
+		c.remove(elem)
+	}
+	c.entries[orderID] = c.lru.PushFront(&cachedOrder{order: order, expires: now.Add(c.config.TTL)})
+	for c.lru.Len() > c.config.Size {
+		c.remove(c.lru.Back())
+	}
+	return order, nil
+}
+
+// getRedis is get with the orders in Redis. An order is cached with the
+// version it had before it was read, which every change replaces, so that
+// an order read before a change is never served after it. Orders are read
+// from the database while Redis is down.
+func (c *orderCache) getRedis(orderID int64, load func(int64) (*Order, error)) (*Order, error) {
+	ctx := context.Background()
+	key := c.prefix + strconv.FormatInt(orderID, 10)
+	reply, err := c.redis.do(ctx, "MGET", key, key+":v")
+	values, _ := reply.([]interface{})
+	if err != nil || len(values) != 2 {
+		fmt.Printf("Order cache: %v\n", err)
+		return load(orderID)
+	}
+	version, _ := values[1].([]byte)
+	if cached, ok := values[0].([]byte); ok {
+		if i := bytes.IndexByte(cached, '\n'); i >= 0 && bytes.Equal(cached[:i], version) {
+			var order Order
+			if err := json.Unmarshal(cached[i+1:], &order); err == nil {
+				orderCacheVars.Add("hits", 1)
+				return &order, nil
+			}
+		}
+	}
+	orderCacheVars.Add("misses", 1)
+
+	order, err := load(orderID)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(order)
+	if err != nil {
+		return order, nil
+	}
+	value := append(append(version, '\n'), encoded...)
+	if _, err := c.redis.do(ctx, "SET", key, value, "PX", c.config.TTL.Milliseconds()); err != nil {
+		fmt.Printf("Order cache: %s\n", err)
+	}
+	return order, nil
+}
+
+// remove drops elem from the cache, c.mu held.
+func (c *orderCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cachedOrder).order.Id)
+}
+
+// invalidate drops orders from the cache once they have changed.
+func (c *orderCache) invalidate(orderIDs ...int64) {
+	if c.config.Size <= 0 {
+		return
+	}
+	orderCacheVars.Add("invalidations", int64(len(orderIDs)))
+	if c.redis != nil {
+		for _, orderID := range orderIDs {
+			key := c.prefix + strconv.FormatInt(orderID, 10)
+			if _, err := c.redis.do(context.Background(), "SET", key+":v", randomHex(8), "PX",
+				orderCacheVersionTTL.Milliseconds()); err != nil {
+				fmt.Printf("Order cache: unable to invalidate order %d: %s\n", orderID, err)
+			}
+		}
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, orderID := range orderIDs {
+		if elem, ok := c.entries[orderID]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// listen invalidates the orders published on changes until it is closed.
+func (c *orderCache) listen(changes <-chan []int64) {
+	for orderIDs := range changes {
+		c.invalidate(orderIDs...)
+	}
+}
+
+// eventTail follows the events table, which every replica appends to, and
+// publishes the ids of the orders changed to its subscribers.
+type eventTail struct {
+	db       *sql.DB
+	interval time.Duration
+	last     int64 // Id of the last event published.
+
+	mu          sync.Mutex
+	subscribers []chan []int64
+}
+
+// newEventTail returns an eventTail publishing the events appended after
+// those already in db.
+func newEventTail(db *sql.DB, interval time.Duration) (*eventTail, error) {
+	t := &eventTail{db: db, interval: interval}
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM events").Scan(&t.last); err != nil {
+		return nil, fmt.Errorf("unable to query last event: %s", err)
+	}
+	return t, nil
+}
+
+// subscribe returns a channel receiving the ids of the orders of new events,
+// closed when run returns.
+func (t *eventTail) subscribe() <-chan []int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := make(chan []int64, 16)
+	t.subscribers = append(t.subscribers, ch)
+	return ch
+}
+
+// run polls the events table every interval until ctx is done.
+func (t *eventTail) run(ctx context.Context) {
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, ch := range t.subscribers {
+			close(ch)
+		}
+	}()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.poll(ctx); err != nil {
+				fmt.Printf("Event tail: %s\n", err)
+			}
+		}
+	}
+}
+
+// poll publishes the orders of the events appended since the last poll.
+func (t *eventTail) poll(ctx context.Context) error {
+	rows, err := t.db.QueryContext(ctx, "SELECT id, order_id FROM events WHERE id > ? ORDER BY id", t.last)
+	if err != nil {
+		return fmt.Errorf("unable to query events: %s", err)
+	}
+	defer rows.Close()
+	var orderIDs []int64
+	last := t.last
+	for rows.Next() {
+		var orderID int64
+		if err := rows.Scan(&last, &orderID); err != nil {
+			return fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to query events: %s", err)
+	}
+	t.last = last
+	if len(orderIDs) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ch := range t.subscribers {
+		select {
+		case ch <- orderIDs:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// cachedGet returns the order with the given id like Get, from the order
+// cache if it is there. The order must not be modified.
+func (s *OrderService) cachedGet(orderID int64) (*Order, error) {
+	return s.orderCache.get(orderID, s.Get)
+}
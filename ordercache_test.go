@@ -0,0 +1,115 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := newOrderCache(OrderCacheConfig{Size: 2, TTL: time.Minute})
+	c.now = func() time.Time { return now }
+	loads := 0
+	load := func(id int64) (*Order, error) {
+		loads++
+		return &Order{Id: id}, nil
+	}
+	get := func(id int64) {
+		t.Helper()
+		if order, err := c.get(id, load); err != nil || order.Id != id {
+			t.Fatalf("get(%d) returned %+v, %v", id, order, err)
+		}
+	}
+
+	get(1)
+	get(1)
+	if loads != 1 {
+		t.Errorf("got %d loads of a cached order, want 1", loads)
+	}
+	get(2)
+	get(1)
+	get(3) // Evicts 2, the least recently read.
+	get(1)
+	if loads != 3 {
+		t.Errorf("got %d loads, want 3", loads)
+	}
+	get(2)
+	if loads != 4 {
+		t.Errorf("got %d loads after eviction, want 4", loads)
+	}
+
+	c.invalidate(2)
+	get(2)
+	if loads != 5 {
+		t.Errorf("got %d loads after invalidation, want 5", loads)
+	}
+	now = now.Add(2 * time.Minute)
+	get(2)
+	if loads != 6 {
+		t.Errorf("got %d loads after expiry, want 6", loads)
+	}
+
+	// An order read while it is invalidated is not cached.
+	c.get(4, func(id int64) (*Order, error) {
+		c.invalidate(id)
+		return &Order{Id: id}, nil
+	})
+	loads = 0
+	get(4)
+	if loads != 1 {
+		t.Errorf("got %d loads of an order invalidated while read, want 1", loads)
+	}
+}
+
+func TestOrderCacheInvalidation(t *testing.T) {
+	svc := newTestService(t, Config{OrderCache: OrderCacheConfig{Size: 10, TTL: time.Hour}})
+	// Another replica on the same database.
+	other, err := NewOrderService(svc.DB, Config{DistanceProvider: providerHaversine}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := newEventTail(svc.DB, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := tail.subscribe()
+
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	notes := func() string {
+		t.Helper()
+		w := serve(svc, "GET", "/orders/1", "", "")
+		if w.Code != 200 {
+			t.Fatalf("GET /orders/1 returned %d", w.Code)
+		}
+		return w.Body.String()
+	}
+	notes()
+
+	if w := servePatch(svc, "/orders/1", `{"notes": "ring twice"}`); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	if body := notes(); !strings.Contains(body, "ring twice") {
+		t.Errorf("GET after a write returned %s", body)
+	}
+
+	if w := servePatch(other, "/orders/1", `{"notes": "leave at door"}`); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	if body := notes(); !strings.Contains(body, "ring twice") {
+		t.Errorf("expected the cached order before the event tail polls, got %s", body)
+	}
+	if err := tail.poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	svc.orderCache.invalidate(<-changes...)
+	if body := notes(); !strings.Contains(body, "leave at door") {
+		t.Errorf("GET after the event tail polled returned %s", body)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// mergePatchMediaType is the Content-Type of PATCH /orders/{id} requests
+// that update fields rather than take the order, see RFC 7396.
+const mergePatchMediaType = "application/merge-patch+json"
+
+// Limits of the fields clients may set.
+const (
+	maxNotesLength    = 2000
+	maxTags           = 20
+	maxTagLength      = 64
+	maxMetadataKeys   = 32
+	maxMetadataKey    = 64
+	maxMetadataLength = 512
+)
+
+// OrderFields are the fields of an order clients may change at any time,
+// independently of its state. They are the data of an EventUpdated.
+type OrderFields struct {
+	Notes       string            `json:"notes,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Priority    int64             `json:"priority,omitempty"` // Higher is more urgent.
+	ScheduledAt *time.Time        `json:"scheduled_at,omitempty"`
+	// Of the parcel, matched against the vehicles of couriers.
+	Weight int64 `json:"weight,omitempty"` // Grams.
+	Volume int64 `json:"volume,omitempty"` // Liters.
+}
+
+// mutableFields maps the JSON names of OrderFields to their field index.
+var mutableFields = jsonFieldIndex(reflect.TypeOf(OrderFields{}))
+
+// fields returns the mutable fields of order.
+func (order *Order) fields() OrderFields {
+	return OrderFields{Notes: order.Notes, Metadata: order.Metadata, Tags: order.Tags, Priority: order.Priority,
+		ScheduledAt: order.ScheduledAt, Weight: order.Weight, Volume: order.Volume}
+}
+
+// fieldColumns are the columns of orders that hold OrderFields.
+const fieldColumns = "notes, metadata, tags, priority, scheduled_at, weight, volume"
+
+// fieldValues returns the values of fieldColumns, NULL for empty fields.
+// Notes and metadata are encrypted with key, if any.
+func (f OrderFields) fieldValues(key []byte) ([]interface{}, error) {
+	notes, err := sealField(key, f.Notes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt notes: %s", err)
+	}
+	values := []interface{}{sql.NullString{String: notes, Valid: notes != ""}, nil, nil,
+		sql.NullInt64{Int64: f.Priority, Valid: f.Priority != 0}, nil,
+		sql.NullInt64{Int64: f.Weight, Valid: f.Weight != 0}, sql.NullInt64{Int64: f.Volume, Valid: f.Volume != 0}}
+	if len(f.Metadata) > 0 {
+		encoded, err := json.Marshal(f.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode metadata: %s", err)
+		}
+		if values[1], err = sealField(key, string(encoded)); err != nil {
+			return nil, fmt.Errorf("unable to encrypt metadata: %s", err)
+		}
+	}
+	if len(f.Tags) > 0 {
+		encoded, err := json.Marshal(f.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode tags: %s", err)
+		}
+		values[2] = string(encoded)
+	}
+	if f.ScheduledAt != nil {
+		values[4] = f.ScheduledAt.Unix()
+	}
+	return values, nil
+}
+
+// scanFields fills in the fields of order from the values of fieldColumns,
+// decrypting notes and metadata with key. Empty columns reset the field, so
+// an Order can be reused between rows.
+func scanFields(key []byte, order *Order, notes, metadata, tags []byte, priority, scheduledAt, weight,
+	volume sql.NullInt64) error {
+	notes, err := openField(key, notes)
+	if err != nil {
+		return fmt.Errorf("invalid notes of order %d: %s", order.Id, err)
+	}
+	if metadata, err = openField(key, metadata); err != nil {
+		return fmt.Errorf("invalid metadata of order %d: %s", order.Id, err)
+	}
+	order.Notes = string(notes)
+	order.Metadata, order.Tags, order.ScheduledAt = nil, nil, nil
+	if len(metadata) > 0 {
+		if err := json.Unmarshal(metadata, &order.Metadata); err != nil {
+			return fmt.Errorf("invalid metadata of order %d: %s", order.Id, err)
+		}
+	}
+	if len(tags) > 0 {
+		if err := json.Unmarshal(tags, &order.Tags); err != nil {
+			return fmt.Errorf("invalid tags of order %d: %s", order.Id, err)
+		}
+	}
+	order.Priority = priority.Int64
+	order.Weight, order.Volume = weight.Int64, volume.Int64
+	if scheduledAt.Valid {
+		t := time.Unix(scheduledAt.Int64, 0).UTC()
+		order.ScheduledAt = &t
+	}
+	return nil
+}
+
+// errInvalidPatch is a merge patch that can't be applied, Code is the error
+// of the 400 response.
+type errInvalidPatch struct {
+	Code, Detail string
+}
+
+func (e errInvalidPatch) Error() string {
+	return e.Code + ": " + e.Detail
+}
+
+// mergePatch applies the JSON merge patch patch to fields. Members set to
+// null are removed, metadata is merged key by key and tags are replaced as a
+// whole. A scheduled_at without an offset is a time in loc.
+func mergePatch(fields OrderFields, patch []byte, loc *time.Location) (OrderFields, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil {
+		return fields, errInvalidPatch{"MALFORMED_PAYLOAD", "a merge patch must be a JSON object"}
+	}
+	var unknown, immutable []string
+	for name := range members {
+		if _, ok := mutableFields[name]; ok {
+			continue
+		}
+		if _, ok := orderFields[name]; ok {
+			immutable = append(immutable, name)
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(immutable) > 0 {
+		sort.Strings(immutable)
+		return fields, errInvalidPatch{"IMMUTABLE_FIELDS", fmt.Sprintf("%v cannot be patched", immutable)}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fields, errInvalidPatch{"UNKNOWN_FIELDS", fmt.Sprintf("%v", unknown)}
+	}
+
+	patched := fields
+	decode := func(name string, dest interface{}) error {
+		if err := json.Unmarshal(members[name], dest); err != nil {
+			return errInvalidPatch{"INVALID_FIELD", fmt.Sprintf("%s: %s", name, err)}
+		}
+		return nil
+	}
+	isNull := func(name string) bool { return string(bytes.TrimSpace(members[name])) == "null" }
+	for name := range members {
+		var err error
+		switch {
+		case isNull(name):
+			switch name {
+			case "notes":
+				patched.Notes = ""
+			case "metadata":
+				patched.Metadata = nil
+			case "tags":
+				patched.Tags = nil
+			case "priority":
+				patched.Priority = 0
+			case "scheduled_at":
+				patched.ScheduledAt = nil
+			case "weight":
+				patched.Weight = 0
+			case "volume":
+				patched.Volume = 0
+			}
+		case name == "notes":
+			err = decode(name, &patched.Notes)
+		case name == "tags":
+			patched.Tags = nil
+			err = decode(name, &patched.Tags)
+		case name == "priority":
+			err = decode(name, &patched.Priority)
+		case name == "weight":
+			err = decode(name, &patched.Weight)
+		case name == "volume":
+			err = decode(name, &patched.Volume)
+		case name == "scheduled_at":
+			var value string
+			if err = decode(name, &value); err != nil {
+				break
+			}
+			t, parseErr := parseLocalTime(value, loc)
+			if parseErr != nil {
+				err = errInvalidPatch{"INVALID_FIELD", fmt.Sprintf("%s: %s", name, parseErr)}
+				break
+			}
+			t = t.UTC()
+			patched.ScheduledAt = &t
+		case name == "metadata":
+			var changes map[string]*string
+			if err = decode(name, &changes); err != nil {
+				break
+			}
+			merged := map[string]string{}
+			for key, value := range fields.Metadata {
+				merged[key] = value
+			}
+			for key, value := range changes {
+				if value == nil {
+					delete(merged, key)
+				} else {
+					merged[key] = *value
+				}
+			}
+			patched.Metadata = merged
+			if len(merged) == 0 {
+				patched.Metadata = nil
+			}
+		}
+		if err != nil {
+			return fields, err
+		}
+	}
+	return patched, patched.validate()
+}
+
+// validate checks fields against the limits.
+func (f OrderFields) validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return errInvalidPatch{"INVALID_FIELD", fmt.Sprintf(format, args...)}
+	}
+	if len(f.Notes) > maxNotesLength {
+		return invalid("notes: longer than %d bytes", maxNotesLength)
+	}
+	if len(f.Tags) > maxTags {
+		return invalid("tags: more than %d", maxTags)
+	}
+	seen := map[string]bool{}
+	for _, tag := range f.Tags {
+		if tag == "" || len(tag) > maxTagLength {
+			return invalid("tags: %q is empty or longer than %d bytes", tag, maxTagLength)
+		}
+		if seen[tag] {
+			return invalid("tags: %q appears twice", tag)
+		}
+		seen[tag] = true
+	}
+	if len(f.Metadata) > maxMetadataKeys {
+		return invalid("metadata: more than %d keys", maxMetadataKeys)
+	}
+	for key, value := range f.Metadata {
+		if key == "" || len(key) > maxMetadataKey || len(value) > maxMetadataLength {
+			return invalid("metadata: %q is empty, longer than %d bytes or its value longer than %d", key,
+				maxMetadataKey, maxMetadataLength)
+		}
+	}
+	if f.Priority < 0 {
+		return invalid("priority: must not be negative")
+	}
+	if f.Weight < 0 || f.Volume < 0 {
+		return invalid("weight and volume: must not be negative")
+	}
+	return nil
+}
+
+var errOrderArchived = fmt.Errorf("order archived")
+
+// Update applies a JSON merge patch to the mutable fields of an order. The
+// previous values are kept in the audit log, a scheduled_at without an offset
+// is in the time zone of the order's tenant. Returns errNoSuchOrder,
+// errOrderArchived or an errInvalidPatch.
+func (s *OrderService) Update(orderID int64, patch []byte, actor string) (_ *Order, err error) {
+	defer observeStore("Update", time.Now(), &err)
+	ctx, cancelFn := context.WithTimeout(s.Context, 2*time.Second)
+	defer cancelFn()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed at BeginTx: %s", err)
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(s.config.FieldKey, tx.QueryRow("SELECT "+orderColumns+" FROM orders WHERE id = ?", orderID))
+	if err == sql.ErrNoRows {
+		var archived int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM orders_archive WHERE id = ?", orderID).Scan(&archived); err != nil {
+			return nil, fmt.Errorf("unable to query archive for order %d: %s", orderID, err)
+		}
+		if archived > 0 {
+			return nil, errOrderArchived
+		}
+		return nil, errNoSuchOrder
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query order %d: %s", orderID, err)
+	}
+	var tenant string
+	if err := tx.QueryRow("SELECT tenant_id FROM orders WHERE id = ?", orderID).Scan(&tenant); err != nil {
+		return nil, fmt.Errorf("unable to query tenant of order %d: %s", orderID, err)
+	}
+	loc, err := tenantLocation(tx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	old := order.fields()
+	updated, err := mergePatch(old, patch, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := newEvent(orderID, EventUpdated, updated)
+	if err == nil {
+		err = record(tx, s.config.FieldKey, event)
+	}
+	if err == nil {
+		err = audit(tx, orderID, "update", actor, map[string]OrderFields{"old": old, "new": updated})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to update order %d: %s", orderID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit update of order %d: %s", orderID, err)
+	}
+	s.orderCache.invalidate(orderID)
+	return s.Get(orderID)
+}
+
+// isMergePatch returns true for PATCH requests with a merge patch body.
+func isMergePatch(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return req.Method == http.MethodPatch && mediaType == mergePatchMediaType
+}
+
+// handleUpdate serves PATCH /orders/{id} with Content-Type
+// application/merge-patch+json.
+func (s *OrderService) handleUpdate(w http.ResponseWriter, req *http.Request, orderID int64) {
+	var buf bytes.Buffer
+	io.Copy(&buf, req.Body)
+	order, err := s.Update(orderID, buf.Bytes(), s.auditActor(req))
+	if invalid, ok := err.(errInvalidPatch); ok {
+		respond(w, req, 400, HTTPResponseError{Error: invalid.Code, Detail: invalid.Detail}, "order %d: %s",
+			orderID, invalid)
+		return
+	}
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case errOrderArchived:
+		respond(w, req, 409, HTTPResponseError{Error: "ORDER_ARCHIVED"}, "order %d archived", orderID)
+	case nil:
+		s.respondOrder(w, req, 200, order, "updated order %d", orderID)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_ERROR"}, "Update() %d failed: %s", orderID, err)
+	}
+}
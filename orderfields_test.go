@@ -0,0 +1,95 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// servePatch sends a merge patch to an order.
+func servePatch(svc *OrderService, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PATCH", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", mergePatchMediaType)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func TestMergePatch(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+
+	w := servePatch(svc, "/orders/1", `{"notes": "ring twice", "tags": ["fragile", "vip"], "priority": 3,
+		"metadata": {"po": "1234", "dock": "B"}, "scheduled_at": "2024-05-01T09:00:00+02:00"}`)
+	if w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	var order OrderDTO
+	if err := json.Unmarshal(w.Body.Bytes(), &order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Notes != "ring twice" || order.Priority != 3 || len(order.Tags) != 2 || order.Metadata["dock"] != "B" ||
+		order.ScheduledAt.Format("2006-01-02T15:04:05Z07:00") != "2024-05-01T07:00:00Z" || order.Status != StateUnassigned {
+		t.Errorf("unexpected order %+v", order)
+	}
+
+	// null removes, metadata merges key by key, tags are replaced.
+	w = servePatch(svc, "/orders/1", `{"notes": null, "tags": ["vip"], "metadata": {"dock": null, "gate": "4"}}`)
+	if w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	got, err := svc.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Notes != "" || !reflect.DeepEqual(got.Tags, []string{"vip"}) ||
+		!reflect.DeepEqual(got.Metadata, map[string]string{"po": "1234", "gate": "4"}) || got.Priority != 3 {
+		t.Errorf("unexpected order %+v", got)
+	}
+
+	for _, tc := range []struct {
+		patch, code string
+	}{
+		{`[1]`, "MALFORMED_PAYLOAD"},
+		{`{"status": "TAKEN"}`, "IMMUTABLE_FIELDS"},
+		{`{"colour": "red"}`, "UNKNOWN_FIELDS"},
+		{`{"priority": -1}`, "INVALID_FIELD"},
+		{`{"priority": "high"}`, "INVALID_FIELD"},
+		{`{"tags": ["a", "a"]}`, "INVALID_FIELD"},
+		{`{"metadata": {"po": 1}}`, "INVALID_FIELD"},
+		{`{"scheduled_at": "tomorrow"}`, "INVALID_FIELD"},
+	} {
+		w := servePatch(svc, "/orders/1", tc.patch)
+		if w.Code != 400 || !strings.Contains(w.Body.String(), tc.code) {
+			t.Errorf("%s: got %d %s, want 400 %s", tc.patch, w.Code, w.Body, tc.code)
+		}
+	}
+	if w := servePatch(svc, "/orders/2", `{}`); w.Code != 404 {
+		t.Errorf("PATCH of missing order returned %d", w.Code)
+	}
+
+	// Without a merge patch PATCH still takes the order, keeping its fields.
+	if w := serve(svc, "PATCH", "/orders/1", "", ""); w.Code != 200 {
+		t.Fatalf("take returned %d", w.Code)
+	}
+	if got, err := svc.Get(1); err != nil || got.State != StateTaken || got.Priority != 3 {
+		t.Errorf("taken order %+v, %v", got, err)
+	}
+
+	// Changes are events, with the previous values in the audit log.
+	var updates int
+	if err := svc.DB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE order_id = 1 AND action = 'update' AND actor = ?",
+		"tenant:").Scan(&updates); err != nil || updates != 2 {
+		t.Errorf("%d updates in the audit log, %v", updates, err)
+	}
+	if problems, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(problems) != 0 {
+		t.Errorf("verify: %v, %v", problems, err)
+	}
+}
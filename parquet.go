@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// parquetMagic starts and ends Parquet files.
+const parquetMagic = "PAR1"
+
+// parquetMediaType is the media type of Parquet files.
+const parquetMediaType = "application/vnd.apache.parquet"
+
+// Physical types of Parquet columns written.
+const (
+	parquetInt64     int32 = 2
+	parquetDouble    int32 = 5
+	parquetByteArray int32 = 6
+)
+
+// Parquet enums from parquet.thrift.
+const (
+	parquetOptional        = 1 // FieldRepetitionType
+	parquetConvertedUTF8   = 0 // ConvertedType
+	parquetConvertedMillis = 9 // ConvertedType TIMESTAMP_MILLIS
+	parquetPlain           = 0 // Encoding
+	parquetRLE             = 3 // Encoding
+	parquetGzip            = 2 // CompressionCodec
+	parquetDataPage        = 0 // PageType
+)
+
+// parquetColumn is a column of a Parquet file. Every column is optional, its
+// values nil, int64, float64, string or time.Time according to its type.
+type parquetColumn struct {
+	name      string
+	typ       int32 // parquetInt64, parquetDouble or parquetByteArray.
+	utf8      bool  // A byte array of text.
+	timestamp bool  // An int64 of milliseconds since the epoch, from time.Time values.
+}
+
+// parquetWriter writes a Parquet file of row groups, one data page per
+// column of each, PLAIN encoded and compressed with gzip, the codec the
+// standard library has. Close writes the footer.
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []parquetColumn
+	rowGroups []parquetRowGroup
+	rows      int64
+}
+
+// parquetRowGroup is the metadata of a row group written.
+type parquetRowGroup struct {
+	chunks []parquetChunk
+	bytes  int64
+	rows   int64
+}
+
+// parquetChunk is the metadata of a column chunk written.
+type parquetChunk struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+}
+
+func newParquetWriter(w io.Writer, columns []parquetColumn) (*parquetWriter, error) {
+	p := &parquetWriter{w: w, columns: columns}
+	return p, p.write([]byte(parquetMagic))
+}
+
+func (p *parquetWriter) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+// WriteRowGroup writes rows, each with a value per column.
+func (p *parquetWriter) WriteRowGroup(rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	group := parquetRowGroup{rows: int64(len(rows))}
+	for i, column := range p.columns {
+		page, err := parquetPage(column, rows, i)
+		if err != nil {
+			return err
+		}
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(page)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		var header thriftWriter
+		header.begin()
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(compressed.Len()))
+		header.structField(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		chunk := parquetChunk{offset: p.offset, uncompressed: int64(header.buf.Len() + len(page)),
+			compressed: int64(header.buf.Len() + compressed.Len())}
+		if err := p.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(compressed.Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.bytes += chunk.uncompressed
+	}
+	p.rowGroups = append(p.rowGroups, group)
+	p.rows += group.rows
+	return nil
+}
+
+// parquetPage encodes the values of column i of rows as a data page: the
+// definition levels, 1 for values and 0 for nulls, then the values.
+func parquetPage(column parquetColumn, rows [][]interface{}, i int) ([]byte, error) {
+	levels := make([]byte, (len(rows)+7)/8)
+	var values bytes.Buffer
+	for r, row := range rows {
+		value := row[i]
+		if value == nil {
+			continue
+		}
+		levels[r/8] |= 1 << uint(r%8)
+		var err error
+		switch column.typ {
+		case parquetInt64:
+			var n int64
+			switch v := value.(type) {
+			case int64:
+				n = v
+			case time.Time:
+				n = v.UnixNano() / int64(time.Millisecond)
+			default:
+				err = fmt.Errorf("column %s: %T is not an int64", column.name, value)
+			}
+			binary.Write(&values, binary.LittleEndian, n)
+		case parquetDouble:
+			f, ok := value.(float64)
+			if !ok {
+				err = fmt.Errorf("column %s: %T is not a float64", column.name, value)
+			}
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(f))
+		case parquetByteArray:
+			s, ok := value.(string)
+			if !ok {
+				err = fmt.Errorf("column %s: %T is not a string", column.name, value)
+			}
+			binary.Write(&values, binary.LittleEndian, uint32(len(s)))
+			values.WriteString(s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The levels are a single bit-packed run of bit width 1, prefixed with
+	// its length.
+	var run bytes.Buffer
+	writeUvarint(&run, uint64(len(levels))<<1|1)
+	run.Write(levels)
+	page := make([]byte, 4, 4+run.Len()+values.Len())
+	binary.LittleEndian.PutUint32(page, uint32(run.Len()))
+	page = append(page, run.Bytes()...)
+	return append(page, values.Bytes()...), nil
+}
+
+// Close writes the footer, the FileMetaData of the file.
+func (p *parquetWriter) Close() error {
+	var meta thriftWriter
+	meta.begin()
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(p.columns)+1)
+	meta.begin()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(p.columns)))
+	meta.end()
+	for _, column := range p.columns {
+		meta.begin()
+		meta.i32(1, column.typ)
+		meta.i32(3, parquetOptional)
+		meta.str(4, column.name)
+		switch {
+		case column.utf8:
+			meta.i32(6, parquetConvertedUTF8)
+		case column.timestamp:
+			meta.i32(6, parquetConvertedMillis)
+		}
+		meta.end()
+	}
+	meta.i64(3, p.rows)
+	meta.list(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		meta.begin()
+		meta.list(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			meta.begin()
+			meta.i64(2, chunk.offset)
+			meta.structField(3)
+			meta.i32(1, column.typ)
+			meta.list(2, thriftI32, 2)
+			meta.elemI32(parquetPlain)
+			meta.elemI32(parquetRLE)
+			meta.list(3, thriftBinary, 1)
+			meta.elemStr(column.name)
+			meta.i32(4, parquetGzip)
+			meta.i64(5, group.rows)
+			meta.i64(6, chunk.uncompressed)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, group.bytes)
+		meta.i64(3, group.rows)
+		meta.end()
+	}
+	meta.str(6, "orderservice")
+	meta.end()
+
+	footer := meta.buf.Bytes()
+	if err := p.write(footer); err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(footer)))
+	if err := p.write(length); err != nil {
+		return err
+	}
+	return p.write([]byte(parquetMagic))
+}
+
+// Types of the Thrift compact protocol.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, the
+// encoding of Parquet metadata. Structs, including those of lists, are
+// written between begin and end.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // Id of the last field written of each struct begun.
+}
+
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		writeUvarint(&t.buf, zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.elemI32(v)
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	writeUvarint(&t.buf, zigzag(v))
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.elemStr(s)
+}
+
+// structField starts a struct field, ended with end.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// list starts a list field of n elements of type elem, written next.
+func (t *thriftWriter) list(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		writeUvarint(&t.buf, uint64(n))
+	}
+}
+
+func (t *thriftWriter) elemI32(v int32) {
+	writeUvarint(&t.buf, zigzag(int64(v)))
+}
+
+func (t *thriftWriter) elemStr(s string) {
+	writeUvarint(&t.buf, uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
@@ -0,0 +1,217 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// thriftReader decodes structs of the Thrift compact protocol into maps of
+// field ids to int64, string, []interface{} and map[int16]interface{}
+// values.
+type thriftReader struct {
+	t    *testing.T
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("invalid varint at %d", r.pos)
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case thriftI32, thriftI64:
+		v := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := int(r.uvarint())
+		s := string(r.data[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		header := r.data[r.pos]
+		r.pos++
+		n, elem := int(header>>4), header&0x0f
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(elem)
+		}
+		return list
+	case thriftStruct:
+		fields := map[int16]interface{}{}
+		var last int16
+		for {
+			header := r.data[r.pos]
+			r.pos++
+			if header == 0 {
+				return fields
+			}
+			id := last + int16(header>>4)
+			if header>>4 == 0 {
+				v := r.uvarint()
+				id = int16(int64(v>>1) ^ -int64(v&1))
+			}
+			fields[id], last = r.value(header&0x0f), id
+		}
+	}
+	r.t.Fatalf("unexpected Thrift type %d at %d", typ, r.pos)
+	return nil
+}
+
+// readParquet decodes a file written by parquetWriter, returning the names
+// of its columns and its rows.
+func readParquet(t *testing.T, data []byte) ([]string, [][]interface{}) {
+	t.Helper()
+	if string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		t.Fatal("missing magic")
+	}
+	length := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := &thriftReader{t: t, data: data[len(data)-8-length : len(data)-8]}
+	meta := footer.value(thriftStruct).(map[int16]interface{})
+	if footer.pos != length {
+		t.Fatalf("footer of %d bytes, read %d", length, footer.pos)
+	}
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[5].(int64) != int64(len(schema)-1) {
+		t.Fatalf("unexpected root %v", root)
+	}
+	var names []string
+	var types []int64
+	for _, element := range schema[1:] {
+		fields := element.(map[int16]interface{})
+		names, types = append(names, fields[4].(string)), append(types, fields[1].(int64))
+	}
+
+	var rows [][]interface{}
+	for _, group := range meta[4].([]interface{}) {
+		groupFields := group.(map[int16]interface{})
+		n := int(groupFields[3].(int64))
+		groupRows := make([][]interface{}, n)
+		for i := range groupRows {
+			groupRows[i] = make([]interface{}, len(names))
+		}
+		for c, chunk := range groupFields[1].([]interface{}) {
+			columnMeta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			if columnMeta[3].([]interface{})[0] != names[c] || columnMeta[4].(int64) != parquetGzip {
+				t.Fatalf("unexpected column metadata %v", columnMeta)
+			}
+			offset := int(columnMeta[9].(int64))
+			page := &thriftReader{t: t, data: data, pos: offset}
+			header := page.value(thriftStruct).(map[int16]interface{})
+			compressed := data[page.pos : page.pos+int(header[3].(int64))]
+			if int64(page.pos-offset+len(compressed)) != columnMeta[7].(int64) {
+				t.Fatalf("column %s: unexpected total_compressed_size %v", names[c], columnMeta[7])
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(zr)
+			if int64(len(body)) != header[2].(int64) {
+				t.Fatalf("column %s: page of %d bytes, header says %v", names[c], len(body), header[2])
+			}
+			if header[5].(map[int16]interface{})[1].(int64) != int64(n) {
+				t.Fatalf("column %s: unexpected data page header %v", names[c], header[5])
+			}
+
+			levelsLength := int(binary.LittleEndian.Uint32(body))
+			levels := &thriftReader{t: t, data: body[4 : 4+levelsLength]}
+			run := levels.uvarint()
+			if run&1 != 1 || int(run>>1) != (n+7)/8 {
+				t.Fatalf("column %s: unexpected levels run %d", names[c], run)
+			}
+			bits, values := body[4+levels.pos:4+levelsLength], body[4+levelsLength:]
+			for r := 0; r < n; r++ {
+				if bits[r/8]&(1<<uint(r%8)) == 0 {
+					continue
+				}
+				switch types[c] {
+				case int64(parquetInt64):
+					groupRows[r][c] = int64(binary.LittleEndian.Uint64(values))
+					values = values[8:]
+				case int64(parquetDouble):
+					groupRows[r][c] = math.Float64frombits(binary.LittleEndian.Uint64(values))
+					values = values[8:]
+				case int64(parquetByteArray):
+					size := int(binary.LittleEndian.Uint32(values))
+					groupRows[r][c] = string(values[4 : 4+size])
+					values = values[4+size:]
+				}
+			}
+			if len(values) != 0 {
+				t.Fatalf("column %s: %d bytes of values left", names[c], len(values))
+			}
+		}
+		rows = append(rows, groupRows...)
+	}
+	if int(meta[3].(int64)) != len(rows) {
+		t.Fatalf("num_rows %v, read %d rows", meta[3], len(rows))
+	}
+	return names, rows
+}
+
+func TestParquetWriter(t *testing.T) {
+	columns := []parquetColumn{{name: "id", typ: parquetInt64}, {name: "price", typ: parquetDouble},
+		{name: "tenant_id", typ: parquetByteArray, utf8: true}, {name: "time", typ: parquetInt64, timestamp: true}}
+	when := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	var rows [][]interface{}
+	for i := int64(1); i <= 20; i++ {
+		var tenant interface{} = "acme"
+		if i%3 == 0 {
+			tenant = nil
+		}
+		rows = append(rows, []interface{}{i, float64(i) / 2, tenant, when})
+	}
+
+	var buf bytes.Buffer
+	p, err := newParquetWriter(&buf, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteRowGroup(rows[:17]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteRowGroup(rows[17:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, read := readParquet(t, buf.Bytes())
+	if !reflect.DeepEqual(names, []string{"id", "price", "tenant_id", "time"}) {
+		t.Errorf("unexpected columns %v", names)
+	}
+	for i := range rows {
+		rows[i][3] = when.UnixNano() / int64(time.Millisecond)
+	}
+	if !reflect.DeepEqual(read, rows) {
+		t.Errorf("read %v, want %v", read, rows)
+	}
+
+	p, _ = newParquetWriter(&bytes.Buffer{}, columns)
+	if err := p.WriteRowGroup([][]interface{}{{"1", nil, nil, nil}}); err == nil {
+		t.Error("expected a string in an int64 column to fail")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paymentWebhookSecretEnv names the environment variable holding the secret
+// the payment provider signs its webhooks with. The webhook is disabled
+// without it.
+const paymentWebhookSecretEnv = "ORDERSERVICE_PAYMENT_WEBHOOK_SECRET"
+
+// paymentWebhookPath is where the payment provider delivers its webhooks.
+const paymentWebhookPath = "/webhooks/payments"
+
+// paymentSignatureHeader holds the signature of a webhook,
+// "t=TIMESTAMP,v1=SIGNATURE", where SIGNATURE is the hex HMAC-SHA256, keyed
+// with the webhook secret, of TIMESTAMP "." BODY. There may be several v1
+// while the provider rotates its secret.
+const paymentSignatureHeader = "X-Payment-Signature"
+
+// Payment statuses of orders. Orders the provider never told about have
+// none.
+const (
+	paymentPaid   = "PAID"
+	paymentUnpaid = "UNPAID"
+)
+
+// paymentStatuses are the payment statuses set by the types of webhook
+// events, other types are acknowledged and ignored.
+var paymentStatuses = map[string]string{
+	"payment.succeeded": paymentPaid,
+	"payment.failed":    paymentUnpaid,
+	"payment.refunded":  paymentUnpaid,
+}
+
+// errPaymentRequired is returned by Take for unpaid orders of tenants
+// requiring prepayment.
+var errPaymentRequired = fmt.Errorf("payment required")
+
+// PaymentEvent is the body of a payment webhook.
+type PaymentEvent struct {
+	ID      string `json:"id"` // Unique per event, redeliveries have the same.
+	Type    string `json:"type"`
+	OrderID string `json:"order_id"` // The id or uid of the order paid for.
+}
+
+// orderPayment is the data of an EventPayment.
+type orderPayment struct {
+	Status    string `json:"status"`
+	PaymentID string `json:"payment_id"` // The PaymentEvent setting it.
+}
+
+// signPayment returns the v1 signature of a webhook, see
+// paymentSignatureHeader.
+func signPayment(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPaymentSignature checks the paymentSignatureHeader of a webhook with
+// body.
+func verifyPaymentSignature(header, secret string, body []byte, now time.Time) error {
+	var (
+		timestamp  int64
+		signatures []string
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return fmt.Errorf("missing or invalid %s", paymentSignatureHeader)
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > signatureWindow || skew < -signatureWindow {
+		return fmt.Errorf("timestamp %d is too far from now", timestamp)
+	}
+	expected := signPayment(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature mismatch")
+}
+
+// RecordPayment sets the payment status of an order from a webhook event.
+// Events are applied once, redeliveries return false. Returns
+// errNoSuchOrder if the order does not exist or was archived.
+func (s *OrderService) RecordPayment(orderID int64, event PaymentEvent, status string) (bool, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed at Begin: %s", err)
+	}
+	defer tx.Rollback()
+	var current sql.NullString
+	err = tx.QueryRow("SELECT payment_status FROM orders WHERE id = ?", orderID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return false, errNoSuchOrder
+	}
+	if err != nil {
+		return false, fmt.Errorf("unable to query order %d: %s", orderID, err)
+	}
+	result, err := tx.Exec(`INSERT INTO payment_events (id, order_id, type, received_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`, event.ID, orderID, event.Type, time.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf("unable to record payment event %s: %s", event.ID, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if status != "" && status != current.String {
+		e, err := newEvent(orderID, EventPayment, orderPayment{Status: status, PaymentID: event.ID})
+		if err == nil {
+			err = record(tx, s.config.FieldKey, e)
+		}
+		if err != nil {
+			return false, fmt.Errorf("unable to update payment of order %d: %s", orderID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("unable to commit payment of order %d: %s", orderID, err)
+	}
+	s.orderCache.invalidate(orderID)
+	return true, nil
+}
+
+// handlePaymentWebhook serves POST /webhooks/payments, authenticated by
+// paymentSignatureHeader rather than credentials.
+func (s *OrderService) handlePaymentWebhook(w http.ResponseWriter, req *http.Request) {
+	if s.config.PaymentWebhookSecret == "" {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "no %s", paymentWebhookSecretEnv)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBody))
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+		return
+	}
+	err = verifyPaymentSignature(req.Header.Get(paymentSignatureHeader), s.config.PaymentWebhookSecret, body,
+		time.Now())
+	if err != nil {
+		respond(w, req, 401, HTTPResponseError{Error: "INVALID_SIGNATURE", Detail: err.Error()}, "%s", err)
+		return
+	}
+	var event PaymentEvent
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&event); err != nil || event.ID == "" {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "payment event %q: %v", event.ID, err)
+		return
+	}
+	orderID, ok := s.orderIDFromPath(w, req, event.OrderID, nil)
+	if !ok {
+		return
+	}
+	applied, err := s.RecordPayment(orderID, event, paymentStatuses[event.Type])
+	switch {
+	case err == errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case err != nil:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "RecordPayment() %d: %s", orderID, err)
+	case !applied:
+		respond(w, req, 200, HTTPResponseStatus{"DUPLICATE"}, "payment event %s already applied", event.ID)
+	default:
+		respond(w, req, 200, HTTPResponseStatus{"SUCCESS"}, "payment event %s %s of order %d", event.ID,
+			event.Type, orderID)
+	}
+}
+
+// PaymentSettings is the body of GET and PUT /admin/tenants/{tenant}/payments.
+type PaymentSettings struct {
+	// Orders may only be taken once PAID.
+	RequirePrepayment bool `json:"require_prepayment"`
+}
+
+// SetPaymentSettings sets the payment settings of tenant.
+func (s *OrderService) SetPaymentSettings(tenant string, settings PaymentSettings) error {
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, require_prepayment) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET require_prepayment = excluded.require_prepayment`, tenant,
+		settings.RequirePrepayment)
+	if err != nil {
+		return fmt.Errorf("unable to set payments of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantPayments serves /admin/tenants/{tenant}/payments.
+//
+//	GET /admin/tenants/{tenant}/payments  returns the PaymentSettings.
+//	PUT /admin/tenants/{tenant}/payments  sets them, {"require_prepayment": true}.
+func (s *OrderService) handleTenantPayments(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var settings PaymentSettings
+		if err := json.Unmarshal(buf.Bytes(), &settings); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if err := s.SetPaymentSettings(tenant, settings); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetPaymentSettings(): %s", err)
+			return
+		}
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	respond(w, req, 200, PaymentSettings{RequirePrepayment: settings.RequirePrepayment},
+		"tenant %q prepayment %t", tenant, settings.RequirePrepayment)
+}
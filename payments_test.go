@@ -0,0 +1,97 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postPayment delivers a payment webhook signed with secret.
+func postPayment(svc *OrderService, secret string, event PaymentEvent) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(event)
+	timestamp := time.Now().Unix()
+	req := httptest.NewRequest("POST", paymentWebhookPath, strings.NewReader(string(body)))
+	req.Header.Set(paymentSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, signPayment(secret, timestamp, body)))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func TestVerifyPaymentSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id": "evt_1"}`)
+	valid := signPayment("secret", now.Unix(), body)
+	for header, ok := range map[string]bool{
+		fmt.Sprintf("t=%d,v1=%s", now.Unix(), valid):                                           true,
+		fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(), strings.Repeat("0", 64), valid):            true,
+		fmt.Sprintf("t=%d,v1=%s", now.Unix()+1, valid):                                         false,
+		fmt.Sprintf("t=%d,v1=%s", now.Unix()-600, signPayment("secret", now.Unix()-600, body)): false,
+		"v1=" + valid: false,
+		"":            false,
+	} {
+		if err := verifyPaymentSignature(header, "secret", body, now); (err == nil) != ok {
+			t.Errorf("%q: expected valid %t, got %v", header, ok, err)
+		}
+	}
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", PaymentWebhookSecret: "whsec"})
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/payments", `{"require_prepayment": true}`); w.Code != 200 {
+		t.Fatalf("PUT payments returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "acme", `{"status": "TAKEN"}`); w.Code != 402 {
+		t.Errorf("taking an unpaid order returned %d", w.Code)
+	}
+
+	if w := postPayment(svc, "wrong", PaymentEvent{ID: "evt_1", Type: "payment.succeeded", OrderID: "1"}); w.Code != 401 {
+		t.Errorf("badly signed webhook returned %d", w.Code)
+	}
+	if w := postPayment(svc, "whsec", PaymentEvent{ID: "evt_0", Type: "payment.succeeded", OrderID: "2"}); w.Code != 404 {
+		t.Errorf("webhook for a missing order returned %d", w.Code)
+	}
+	w := postPayment(svc, "whsec", PaymentEvent{ID: "evt_1", Type: "payment.succeeded", OrderID: "1"})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "SUCCESS") {
+		t.Fatalf("webhook returned %d: %s", w.Code, w.Body)
+	}
+	order, err := svc.Get(1)
+	if err != nil || order.PaymentStatus != paymentPaid {
+		t.Fatalf("expected a PAID order, got %+v, %v", order, err)
+	}
+
+	// Redeliveries are acknowledged without applying them again.
+	postPayment(svc, "whsec", PaymentEvent{ID: "evt_2", Type: "payment.failed", OrderID: "1"})
+	w = postPayment(svc, "whsec", PaymentEvent{ID: "evt_1", Type: "payment.succeeded", OrderID: "1"})
+	if !strings.Contains(w.Body.String(), "DUPLICATE") {
+		t.Errorf("redelivery returned %d: %s", w.Code, w.Body)
+	}
+	if order, _ := svc.Get(1); order.PaymentStatus != paymentUnpaid {
+		t.Errorf("expected the redelivery to be ignored, got %q", order.PaymentStatus)
+	}
+	postPayment(svc, "whsec", PaymentEvent{ID: "evt_3", Type: "payment.succeeded", OrderID: "1"})
+	if w := serve(svc, "PATCH", "/orders/1", "acme", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Errorf("taking a paid order returned %d", w.Code)
+	}
+
+	// Tenants not requiring prepayment take unpaid orders.
+	if w := serve(svc, "POST", "/orders", "other", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if w := serve(svc, "PATCH", "/orders/2", "other", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Errorf("taking an order of another tenant returned %d", w.Code)
+	}
+
+	disabled := newTestService(t, Config{})
+	if w := postPayment(disabled, "", PaymentEvent{ID: "evt_1", Type: "payment.succeeded", OrderID: "1"}); w.Code != 404 {
+		t.Errorf("expected the webhook to be disabled without a secret, got %d", w.Code)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Actions policies may deny.
+const (
+	policyTake   = "take"
+	policyUpdate = "update"
+)
+
+// Kinds of actors policy rules may apply to, the prefixes of audit log
+// actors. Admins are never denied.
+var policyActors = map[string]bool{"key": true, "user": true, "tenant": true}
+
+// PolicyCondition compares a field of the order with a value. Fields are
+// distance (meters), duration (seconds), price and priority, compared with
+// ==, !=, <, <=, > and >= to a number; status, currency and metadata.{key},
+// compared with == and != to a string; and tags, with contains.
+type PolicyCondition struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// PolicyRule denies an action when all its conditions hold.
+type PolicyRule struct {
+	Action string `json:"action"` // "take" or "update".
+	// Kinds of actors the rule applies to, "key", "user" or "tenant". All of
+	// them if empty.
+	Actors []string          `json:"actors,omitempty"`
+	When   []PolicyCondition `json:"when"`
+	Reason string            `json:"reason,omitempty"` // Shown to the client denied.
+}
+
+// Policy is the body of GET and PUT /admin/tenants/{tenant}/policy.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyInput is what a PolicyEngine decides on.
+type PolicyInput struct {
+	Tenant string // Tenant the request is made on behalf of.
+	Action string
+	Actor  string // An audit log actor, e.g. "key:{id}".
+	Order  *Order // As it is before the action.
+}
+
+// errPolicyDenied is returned by PolicyEngines denying an action.
+type errPolicyDenied struct {
+	Reason string
+}
+
+func (e errPolicyDenied) Error() string {
+	return "denied by policy: " + e.Reason
+}
+
+// PolicyEngine authorizes actions on orders beyond the roles of API keys
+// and users. Authorize returns nil to allow the action, errPolicyDenied to
+// deny it.
+type PolicyEngine interface {
+	Authorize(input PolicyInput) error
+}
+
+// rulesEngine is the default PolicyEngine, denying what the rules of the
+// tenant's Policy match.
+type rulesEngine struct {
+	db       *sql.DB
+	fieldKey []byte // Config.FieldKey.
+}
+
+// Authorize applies the first rule of the tenant matching input.
+func (e *rulesEngine) Authorize(input PolicyInput) error {
+	actorKind := strings.SplitN(input.Actor, ":", 2)[0]
+	if actorKind == auditActorAdmin {
+		return nil
+	}
+	settings, err := loadTenantSettings(e.db, e.fieldKey, input.Tenant)
+	if err != nil || settings.Policy == "" {
+		return err
+	}
+	var policy Policy
+	if err := json.Unmarshal([]byte(settings.Policy), &policy); err != nil {
+		return fmt.Errorf("invalid policy of tenant %q: %s", input.Tenant, err)
+	}
+	for _, rule := range policy.Rules {
+		if rule.Action != input.Action || (len(rule.Actors) > 0 && !containsString(rule.Actors, actorKind)) {
+			continue
+		}
+		matches := true
+		for _, condition := range rule.When {
+			if !condition.holds(input.Order) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			reason := rule.Reason
+			if reason == "" {
+				reason = "not allowed"
+			}
+			return errPolicyDenied{Reason: reason}
+		}
+	}
+	return nil
+}
+
+// containsString returns whether values has value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// number returns the numeric field of order, false if the field is not
+// numeric.
+func (c PolicyCondition) number(order *Order) (float64, bool) {
+	switch c.Field {
+	case "distance":
+		return order.Distance, true
+	case "duration":
+		return float64(order.Duration), true
+	case "price":
+		return float64(order.Price), true
+	case "priority":
+		return float64(order.Priority), true
+	}
+	return 0, false
+}
+
+// text returns the string field of order, false if the field is not a
+// string.
+func (c PolicyCondition) text(order *Order) (string, bool) {
+	switch {
+	case c.Field == "status":
+		return string(order.State), true
+	case c.Field == "currency":
+		return order.Currency, true
+	case strings.HasPrefix(c.Field, "metadata."):
+		return order.Metadata[strings.TrimPrefix(c.Field, "metadata.")], true
+	}
+	return "", false
+}
+
+// validate returns an error unless the condition can be evaluated.
+func (c PolicyCondition) validate() error {
+	var order Order
+	if _, ok := c.number(&order); ok {
+		if _, ok := c.Value.(float64); !ok {
+			return fmt.Errorf("%s must be compared to a number", c.Field)
+		}
+		switch c.Op {
+		case "==", "!=", "<", "<=", ">", ">=":
+			return nil
+		}
+		return fmt.Errorf("invalid op %q for %s", c.Op, c.Field)
+	}
+	if _, ok := c.text(&order); ok || c.Field == "tags" {
+		if _, ok := c.Value.(string); !ok {
+			return fmt.Errorf("%s must be compared to a string", c.Field)
+		}
+		if (c.Field == "tags") != (c.Op == "contains") || (c.Field != "tags" && c.Op != "==" && c.Op != "!=") {
+			return fmt.Errorf("invalid op %q for %s", c.Op, c.Field)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown field %q", c.Field)
+}
+
+// holds returns whether the condition holds for order. Conditions are
+// validated when the policy is set.
+func (c PolicyCondition) holds(order *Order) bool {
+	if value, ok := c.number(order); ok {
+		want, _ := c.Value.(float64)
+		switch c.Op {
+		case "==":
+			return value == want
+		case "!=":
+			return value != want
+		case "<":
+			return value < want
+		case "<=":
+			return value <= want
+		case ">":
+			return value > want
+		case ">=":
+			return value >= want
+		}
+		return false
+	}
+	want, _ := c.Value.(string)
+	if c.Field == "tags" {
+		return containsString(order.Tags, want)
+	}
+	value, _ := c.text(order)
+	if c.Op == "!=" {
+		return value != want
+	}
+	return value == want
+}
+
+// validatePolicy returns an error describing the first invalid rule.
+func validatePolicy(policy Policy) error {
+	for i, rule := range policy.Rules {
+		if rule.Action != policyTake && rule.Action != policyUpdate {
+			return fmt.Errorf("rule %d: action must be %s or %s", i, policyTake, policyUpdate)
+		}
+		for _, actor := range rule.Actors {
+			if !policyActors[actor] {
+				return fmt.Errorf("rule %d: unknown actor %q", i, actor)
+			}
+		}
+		for _, condition := range rule.When {
+			if err := condition.validate(); err != nil {
+				return fmt.Errorf("rule %d: %s", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// authorize writes an error and returns false unless the policy engine
+// allows req to make action on the order.
+func (s *OrderService) authorize(w http.ResponseWriter, req *http.Request, action string, orderID int64) bool {
+	order, err := s.Get(orderID)
+	if err == nil {
+		err = s.policy.Authorize(PolicyInput{Tenant: tenantFromRequest(req), Action: action, Actor: s.auditActor(req),
+			Order: order})
+	}
+	if denied, ok := err.(errPolicyDenied); ok {
+		respond(w, req, 403, HTTPResponseError{Error: "POLICY_DENIED", Detail: denied.Reason}, "order %d: %s",
+			orderID, denied)
+		return false
+	}
+	switch err {
+	case nil:
+		return true
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Authorize() %d failed: %s", orderID, err)
+	}
+	return false
+}
+
+// SetPolicy sets the policy of tenant, one without rules removes it.
+func (s *OrderService) SetPolicy(tenant string, policy Policy) error {
+	var encoded interface{}
+	if len(policy.Rules) > 0 {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			return fmt.Errorf("unable to encode policy: %s", err)
+		}
+		encoded = string(b)
+	}
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, policy) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET policy = excluded.policy`, tenant, encoded)
+	if err != nil {
+		return fmt.Errorf("unable to set policy of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantPolicy serves /admin/tenants/{tenant}/policy.
+//
+//	GET /admin/tenants/{tenant}/policy  returns the Policy.
+//	PUT /admin/tenants/{tenant}/policy  sets it, {"rules": [{"action": "take",
+//	                                    "actors": ["key"], "when": [{"field":
+//	                                    "distance", "op": ">", "value": 20000}],
+//	                                    "reason": "over 20km"}]}.
+func (s *OrderService) handleTenantPolicy(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var policy Policy
+		if err := json.Unmarshal(buf.Bytes(), &policy); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if err := validatePolicy(policy); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_POLICY", Detail: err.Error()}, "%s", err)
+			return
+		}
+		if err := s.SetPolicy(tenant, policy); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetPolicy(): %s", err)
+			return
+		}
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	policy := Policy{Rules: []PolicyRule{}}
+	if settings.Policy != "" {
+		if err := json.Unmarshal([]byte(settings.Policy), &policy); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "invalid policy: %s", err)
+			return
+		}
+	}
+	respond(w, req, 200, policy, "tenant %q %d policy rules", tenant, len(policy.Rules))
+}
@@ -0,0 +1,86 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	for _, body := range []string{
+		`{"rules": [{"action": "delete", "when": []}]}`,
+		`{"rules": [{"action": "take", "actors": ["courier"]}]}`,
+		`{"rules": [{"action": "take", "when": [{"field": "distance", "op": ">", "value": "far"}]}]}`,
+		`{"rules": [{"action": "take", "when": [{"field": "status", "op": "<", "value": "TAKEN"}]}]}`,
+		`{"rules": [{"action": "take", "when": [{"field": "tags", "op": "==", "value": "vip"}]}]}`,
+		`{"rules": [{"action": "take", "when": [{"field": "courier", "op": "==", "value": "bob"}]}]}`,
+	} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/policy", body); w.Code != 400 {
+			t.Errorf("%s: got %d, want 400", body, w.Code)
+		}
+	}
+	// API keys may not take orders over 1km, nor update orders tagged vip.
+	policy := `{"rules": [
+		{"action": "take", "actors": ["key"], "when": [{"field": "distance", "op": ">", "value": 1000}],
+			"reason": "too far"},
+		{"action": "update", "when": [{"field": "tags", "op": "contains", "value": "vip"}]}]}`
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/policy", policy); w.Code != 200 {
+		t.Fatalf("PUT policy returned %d: %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/policy", ""); !strings.Contains(w.Body.String(), "too far") {
+		t.Errorf("GET policy: %s", w.Body)
+	}
+
+	// createOrderDetails is hundreds of kilometers long.
+	for i := 0; i < 2; i++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if _, err := svc.Update(2, []byte(`{"tags": ["vip"]}`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	key := createKey(t, svc, "acme", scopeWrite)
+	w := serveKey(svc, "PATCH", "/orders/1", key.Key, `{"status": "TAKEN"}`)
+	if w.Code != 403 || !strings.Contains(w.Body.String(), "POLICY_DENIED") || !strings.Contains(w.Body.String(), "too far") {
+		t.Errorf("key take: %d %s", w.Code, w.Body)
+	}
+	// The rule only applies to API keys.
+	if w := serve(svc, "PATCH", "/orders/1", "acme", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Errorf("tenant take: %d %s", w.Code, w.Body)
+	}
+	patch := `{"notes": "hi"}`
+	if w := servePatchTenant(svc, "/orders/2", "acme", patch); w.Code != 403 {
+		t.Errorf("update of a vip order: %d %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "POST", "/orders", "other", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if _, err := svc.Update(3, []byte(`{"tags": ["vip"]}`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if w := servePatchTenant(svc, "/orders/3", "other", patch); w.Code != 200 {
+		t.Errorf("update by a tenant without policy: %d %s", w.Code, w.Body)
+	}
+
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/policy", `{"rules": []}`); w.Code != 200 {
+		t.Fatalf("clearing policy returned %d", w.Code)
+	}
+	if w := servePatchTenant(svc, "/orders/2", "acme", patch); w.Code != 200 {
+		t.Errorf("update without policy: %d %s", w.Code, w.Body)
+	}
+}
+
+// servePatchTenant sends a merge patch to an order on behalf of tenant.
+func servePatchTenant(svc *OrderService, path, tenant, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PATCH", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", mergePatchMediaType)
+	req.Header.Set(tenantHeader, tenant)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
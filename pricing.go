@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tariff prices journeys by distance. Amounts are in minor units of Currency,
+// e.g. cents.
+type Tariff struct {
+	BaseFare int64  // Charged for every order.
+	PerKm    int64  // Charged per kilometer, pro rata.
+	Currency string // ISO 4217 code.
+}
+
+// Price returns the price of a journey of the given length in meters,
+// rounded to the nearest minor unit.
+func (t Tariff) Price(meters int64) int64 {
+	return t.BaseFare + (meters*t.PerKm+500)/1000
+}
+
+// Quote is what an order would cost, returned by POST /orders/quote.
+type Quote struct {
+	Distance  int64          `json:"distance"` // Meters.
+	Duration  int64          `json:"duration"` // Expected travel time in seconds.
+	ETA       time.Time      `json:"eta"`      // Expected arrival if the journey started now.
+	Price     int64          `json:"price"`    // In minor units of Currency.
+	Currency  string         `json:"currency,omitempty"`
+	Breakdown PriceBreakdown `json:"breakdown"`
+
+	DistanceText string `json:"distance_text,omitempty"` // Distance for the client, see distanceText.
+}
+
+// Quote computes the route and price of the journey in details using the
+// distance provider configured for tenant. Nothing is stored.
+func (s *OrderService) Quote(tenant string, details CreateOrderDetails) (*Quote, error) {
+	provider, err := s.distanceProvider(tenant)
+	if err != nil {
+		return nil, err
+	}
+	// Straight-line distances are computed locally and cannot go down.
+	_, local := provider.(haversineDistance)
+	if !local && !s.distanceHealth.acquire() {
+		return nil, errDistanceUnavailable
+	}
+	route, err := provider.Route(details.Origin, details.Destination)
+	if !local {
+		s.distanceHealth.release(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Not billing a computation is better than failing the request.
+	if err := bill(s.DB, tenant, billDistanceComputed, 0, 0, "", time.Now()); err != nil {
+		fmt.Printf("Quote: %s\n", err)
+	}
+	price, breakdown, err := s.price(tenant, details.Origin, details.Destination, route.Distance)
+	if err != nil {
+		return nil, err
+	}
+	if multiplier := s.surge(tenant, details, time.Now()); multiplier != 1 {
+		price = applySurge(price, multiplier)
+		breakdown.Surge = multiplier
+	}
+	quote := &Quote{
+		Distance:  route.Distance,
+		Duration:  route.Duration,
+		ETA:       time.Now().Add(time.Duration(route.Duration) * time.Second).UTC().Truncate(time.Second),
+		Price:     price,
+		Currency:  s.config.Tariff.Currency,
+		Breakdown: breakdown,
+	}
+	if details.PromoCode != "" {
+		promotion, err := s.promotion(tenant, details.PromoCode, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		promotion.apply(quote)
+	}
+	return quote, nil
+}
+
+// handleQuote serves POST /orders/quote. The body is the same as for POST
+// /orders and is validated the same way.
+func (s *OrderService) handleQuote(w http.ResponseWriter, req *http.Request) {
+	version, err := apiVersion(req)
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "UNSUPPORTED_API_VERSION", Detail: err.Error()}, "%s", err)
+		return
+	}
+	var buf bytes.Buffer
+	io.Copy(&buf, req.Body)
+
+	details, err := parseCreateOrderDetails(buf.String(), strictDecoding(version))
+	if unknown, ok := err.(errUnknownFields); ok {
+		respond(w, req, 400, HTTPResponseError{Error: err.Error(), Detail: strings.Join(unknown, ",")},
+			"unknown fields %v", unknown)
+		return
+	}
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: err.Error()}, "parseCreateOrderDetails(): %s", err)
+		return
+	}
+	quote, err := s.Quote(tenantFromRequest(req), *details)
+	if err == errDistanceUnavailable {
+		s.respondDistanceUnavailable(w, req)
+		return
+	}
+	if invalid, ok := err.(errInvalidPromoCode); ok {
+		respond(w, req, 422, HTTPResponseError{Error: "INVALID_PROMO_CODE", Detail: invalid.Reason}, "%s", invalid)
+		return
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Quote(): %s", err)
+		return
+	}
+	quote.DistanceText = distanceText(req, float64(quote.Distance))
+	respond(w, req, 200, quote, "quote %+v", *quote)
+}
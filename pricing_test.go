@@ -0,0 +1,63 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTariffPrice(t *testing.T) {
+	tariff := Tariff{BaseFare: 250, PerKm: 120}
+	for _, tc := range []struct{ meters, price int64 }{
+		{0, 250},
+		{1000, 370},
+		{2489, 549},
+		{4, 250},
+		{5, 251},
+	} {
+		if price := tariff.Price(tc.meters); price != tc.price {
+			t.Errorf("%dm: expected %d, got %d", tc.meters, tc.price, price)
+		}
+	}
+}
+
+func TestQuoteDoesNotPersist(t *testing.T) {
+	svc := newTestService(t, Config{Tariff: Tariff{BaseFare: 250, PerKm: 120, Currency: "USD"}})
+
+	w := serve(svc, "POST", "/orders/quote", "", createOrderDetails)
+	if w.Code != 200 {
+		t.Fatalf("POST /orders/quote returned %d: %s", w.Code, w.Body)
+	}
+	var quote Quote
+	if err := json.NewDecoder(w.Body).Decode(&quote); err != nil {
+		t.Fatal(err)
+	}
+	if quote.Distance != 1816 || quote.Price != 468 || quote.Currency != "USD" || quote.Duration == 0 ||
+		quote.ETA.IsZero() {
+		t.Errorf("unexpected quote %+v", quote)
+	}
+
+	var count int
+	if err := svc.DB.QueryRow("SELECT COUNT(*) FROM orders").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("quote stored %d orders", count)
+	}
+
+	// Orders created afterwards carry the same price.
+	order, err := svc.Insert("", CreateOrderDetails{Origin: []string{"37.8093475", "-122.2740787"},
+		Destination: []string{"37.8061044", "-122.2943356"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Price != quote.Price || order.Duration != quote.Duration {
+		t.Errorf("order %+v does not match quote %+v", order, quote)
+	}
+
+	if w := serve(svc, "POST", "/orders/quote", "", `{"origin": ["x", "y"]}`); w.Code != 400 {
+		t.Errorf("expected 400 for invalid body, got %d", w.Code)
+	}
+}
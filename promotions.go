@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// promoCodeRE matches promotion codes, which are case insensitive and stored
+// upper case.
+var promoCodeRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Promotion is a discount code of a tenant, given as promo_code when
+// quoting or creating orders.
+type Promotion struct {
+	Code      string     `json:"code"`
+	Percent   int64      `json:"percent,omitempty"`  // Off the price, 1 to 100.
+	Amount    int64      `json:"amount,omitempty"`   // Off the price, in minor units.
+	MaxUses   int64      `json:"max_uses,omitempty"` // Orders that may use it, 0 for unlimited.
+	Uses      int64      `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// discount returns the amount taken off price, never more than price.
+func (p Promotion) discount(price int64) int64 {
+	discount := p.Amount
+	if p.Percent != 0 {
+		discount = (price*p.Percent + 50) / 100
+	}
+	if discount > price {
+		discount = price
+	}
+	return discount
+}
+
+// apply takes the discount off quote and records it in its breakdown.
+func (p Promotion) apply(quote *Quote) {
+	discount := p.discount(quote.Price)
+	quote.Price -= discount
+	quote.Breakdown.PromoCode = p.Code
+	quote.Breakdown.Discount = discount
+}
+
+// errInvalidPromoCode is returned by Quote and Insert for codes that cannot
+// be used.
+type errInvalidPromoCode struct {
+	Code   string
+	Reason string // "unknown", "expired" or "exhausted".
+}
+
+func (e errInvalidPromoCode) Error() string {
+	return fmt.Sprintf("promo code %s is %s", e.Code, e.Reason)
+}
+
+// loadPromotion returns the promotion of tenant with code, nil if there is
+// none.
+func loadPromotion(db *sql.DB, tenant, code string) (*Promotion, error) {
+	promotions, err := loadPromotions(db, tenant, strings.ToUpper(code))
+	if err != nil || len(promotions) == 0 {
+		return nil, err
+	}
+	return &promotions[0], nil
+}
+
+// loadPromotions returns the promotions of tenant by code, or only the one
+// with code if not empty.
+func loadPromotions(db *sql.DB, tenant, code string) ([]Promotion, error) {
+	rows, err := db.Query(`SELECT code, percent, amount, max_uses, uses, expires_at FROM promotions
+		WHERE tenant_id = ? AND (? = '' OR code = ?) ORDER BY code`, tenant, code, code)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query promotions of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	promotions := []Promotion{}
+	for rows.Next() {
+		var (
+			p                                   Promotion
+			percent, amount, maxUses, expiresAt sql.NullInt64
+		)
+		if err := rows.Scan(&p.Code, &percent, &amount, &maxUses, &p.Uses, &expiresAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		p.Percent, p.Amount, p.MaxUses = percent.Int64, amount.Int64, maxUses.Int64
+		if expiresAt.Valid {
+			t := time.Unix(expiresAt.Int64, 0).UTC()
+			p.ExpiresAt = &t
+		}
+		promotions = append(promotions, p)
+	}
+	return promotions, rows.Err()
+}
+
+// promotion returns the promotion of tenant with code if it may be used at
+// now, errInvalidPromoCode otherwise.
+func (s *OrderService) promotion(tenant, code string, now time.Time) (*Promotion, error) {
+	code = strings.ToUpper(code)
+	p, err := loadPromotion(s.DB, tenant, code)
+	switch {
+	case err != nil:
+		return nil, err
+	case p == nil:
+		return nil, errInvalidPromoCode{Code: code, Reason: "unknown"}
+	case p.ExpiresAt != nil && !now.Before(*p.ExpiresAt):
+		return nil, errInvalidPromoCode{Code: code, Reason: "expired"}
+	case p.MaxUses != 0 && p.Uses >= p.MaxUses:
+		return nil, errInvalidPromoCode{Code: code, Reason: "exhausted"}
+	}
+	return p, nil
+}
+
+// redeemPromotion counts a use of the promotion of tenant with code, as part
+// of creating an order in tx. Returns errInvalidPromoCode if it was used up
+// or expired since it was quoted.
+func redeemPromotion(tx *sql.Tx, tenant, code string, now time.Time) error {
+	result, err := tx.Exec(`UPDATE promotions SET uses = uses + 1 WHERE tenant_id = ? AND code = ?
+		AND (max_uses IS NULL OR uses < max_uses) AND (expires_at IS NULL OR expires_at > ?)`,
+		tenant, code, now.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to redeem promo code %s of tenant %q: %s", code, tenant, err)
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return errInvalidPromoCode{Code: code, Reason: "exhausted"}
+	}
+	return nil
+}
+
+// validatePromotion returns an error describing what is wrong with p.
+func validatePromotion(p Promotion) error {
+	switch {
+	case (p.Percent == 0) == (p.Amount == 0):
+		return fmt.Errorf("exactly one of percent and amount must be set")
+	case p.Percent < 0 || p.Percent > 100:
+		return fmt.Errorf("percent must be 1 to 100")
+	case p.Amount < 0:
+		return fmt.Errorf("amount must be positive")
+	case p.MaxUses < 0:
+		return fmt.Errorf("max_uses must be positive, or 0 for unlimited")
+	}
+	return nil
+}
+
+// SetPromotion adds or replaces a promotion of tenant, keeping its uses.
+func (s *OrderService) SetPromotion(tenant string, p Promotion) error {
+	var expiresAt sql.NullInt64
+	if p.ExpiresAt != nil {
+		expiresAt = sql.NullInt64{Int64: p.ExpiresAt.Unix(), Valid: true}
+	}
+	_, err := s.DB.Exec(`INSERT INTO promotions (tenant_id, code, percent, amount, max_uses, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (tenant_id, code) DO UPDATE SET percent = excluded.percent,
+		amount = excluded.amount, max_uses = excluded.max_uses, expires_at = excluded.expires_at`,
+		tenant, strings.ToUpper(p.Code), sql.NullInt64{Int64: p.Percent, Valid: p.Percent != 0},
+		sql.NullInt64{Int64: p.Amount, Valid: p.Amount != 0}, sql.NullInt64{Int64: p.MaxUses, Valid: p.MaxUses != 0},
+		expiresAt)
+	if err != nil {
+		return fmt.Errorf("unable to set promotion %s of tenant %q: %s", p.Code, tenant, err)
+	}
+	return nil
+}
+
+// DeletePromotion removes a promotion of tenant, returning false if it has
+// no such promotion. Orders keep their discount.
+func (s *OrderService) DeletePromotion(tenant, code string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM promotions WHERE tenant_id = ? AND code = ?", tenant,
+		strings.ToUpper(code))
+	if err != nil {
+		return false, fmt.Errorf("unable to delete promotion %s of tenant %q: %s", code, tenant, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// handleTenantPromotions serves /admin/tenants/{tenant}/promotions, the list
+// of promotions, and PUT and DELETE /admin/tenants/{tenant}/promotions/{code}.
+func (s *OrderService) handleTenantPromotions(w http.ResponseWriter, req *http.Request, tenant, code string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if code != "" {
+		if !promoCodeRE.MatchString(code) {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: "codes are 1 to 32 letters, digits, - and _"}, "promo code %q", code)
+			return
+		}
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			var buf bytes.Buffer
+			io.Copy(&buf, req.Body)
+			var p Promotion
+			if err := json.Unmarshal(buf.Bytes(), &p); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+				return
+			}
+			if err := validatePromotion(p); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_PROMOTION", Detail: err.Error()}, "%s", err)
+				return
+			}
+			p.Code = code
+			if err := s.SetPromotion(tenant, p); err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetPromotion(): %s", err)
+				return
+			}
+		case http.MethodDelete:
+			deleted, err := s.DeletePromotion(tenant, code)
+			if err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DeletePromotion(): %s", err)
+				return
+			}
+			if !deleted {
+				respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_PROMOTION"}, "tenant %q promotion %q",
+					tenant, code)
+				return
+			}
+		}
+	}
+	promotions, err := loadPromotions(s.DB, tenant, "")
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadPromotions(): %s", err)
+		return
+	}
+	respond(w, req, 200, promotions, "tenant %q %d promotions", tenant, len(promotions))
+}
@@ -0,0 +1,93 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPromotions(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Tariff: Tariff{BaseFare: 250, PerKm: 120, Currency: "USD"}})
+	withCode := func(code string) string {
+		return `{"origin": ["37.8093475", "-122.2740787"], "destination": ["37.8061044", "-122.2943356"],
+			"promo_code": "` + code + `"}`
+	}
+
+	for _, body := range []string{`{}`, `{"percent": 10, "amount": 100}`, `{"percent": 101}`, `{"amount": -1}`,
+		`{"amount": 1, "max_uses": -1}`} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/promotions/TENOFF", body); w.Code != 400 {
+			t.Errorf("PUT %s returned %d", body, w.Code)
+		}
+	}
+	for code, body := range map[string]string{
+		"tenoff": `{"percent": 10, "max_uses": 1}`,
+		"FLAT":   `{"amount": 1000}`,
+		"OLD":    `{"amount": 100, "expires_at": "2020-01-01T00:00:00Z"}`,
+	} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/promotions/"+code, body); w.Code != 200 {
+			t.Fatalf("PUT promotion returned %d: %s", w.Code, w.Body)
+		}
+	}
+	w := serveAdmin(svc, "GET", "/admin/tenants/acme/promotions", "")
+	var promotions []Promotion
+	if err := json.NewDecoder(w.Body).Decode(&promotions); err != nil || len(promotions) != 3 ||
+		promotions[2].Code != "TENOFF" {
+		t.Fatalf("unexpected promotions %+v, %v", promotions, err)
+	}
+
+	// createOrderDetails is priced 468.
+	w = serve(svc, "POST", "/orders/quote", "acme", withCode("TenOff"))
+	var quote Quote
+	if err := json.NewDecoder(w.Body).Decode(&quote); err != nil || quote.Price != 421 ||
+		quote.Breakdown.Discount != 47 || quote.Breakdown.PromoCode != "TENOFF" {
+		t.Errorf("unexpected quote %+v, %v", quote, err)
+	}
+	w = serve(svc, "POST", "/orders", "acme", withCode("tenoff"))
+	var order OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 421 || order.Discount != 47 {
+		t.Fatalf("unexpected order %+v, %v", order, err)
+	}
+	w = serve(svc, "GET", "/orders/1", "acme", "")
+	order = OrderDTO{}
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.PromoCode != "TENOFF" || order.Discount != 47 {
+		t.Errorf("expected the discount recorded on the order, got %+v, %v", order, err)
+	}
+
+	// Discounts never make prices negative.
+	w = serve(svc, "POST", "/orders", "acme", withCode("FLAT"))
+	order = OrderDTO{}
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 0 || order.Discount != 468 {
+		t.Errorf("unexpected order %+v, %v", order, err)
+	}
+
+	for code, reason := range map[string]string{"TENOFF": "exhausted", "OLD": "expired", "NONE": "unknown"} {
+		w := serve(svc, "POST", "/orders", "acme", withCode(code))
+		var body HTTPResponseError
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || w.Code != 422 ||
+			body.Error != "INVALID_PROMO_CODE" || body.Detail != reason {
+			t.Errorf("%s: expected 422 %s, got %d %+v", code, reason, w.Code, body)
+		}
+	}
+	if w := serve(svc, "POST", "/orders", "other", withCode("FLAT")); w.Code != 422 {
+		t.Errorf("expected promotions to be per tenant, got %d", w.Code)
+	}
+	if w := serve(svc, "POST", "/orders", "acme", withCode("not a code")); w.Code != 400 {
+		t.Errorf("expected a malformed code to be refused, got %d", w.Code)
+	}
+
+	// Requotes keep the discount of exhausted promotions.
+	w = serveAdmin(svc, "POST", "/orders/1/requote", "")
+	order = OrderDTO{}
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 421 || order.Discount != 47 {
+		t.Errorf("unexpected requoted order %+v, %v", order, err)
+	}
+
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/promotions/flat", ""); w.Code != 200 {
+		t.Errorf("DELETE promotion returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/promotions/FLAT", ""); w.Code != 404 {
+		t.Errorf("DELETE missing promotion returned %d", w.Code)
+	}
+}
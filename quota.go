@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// OrderQuota caps the orders a tenant may create per day and month of its
+// time zone. Zero is unlimited.
+type OrderQuota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// errQuotaExceeded is returned by Insert when the tenant has used up a quota.
+type errQuotaExceeded struct {
+	Period string    // "daily" or "monthly".
+	Quota  int64     // Orders allowed in the period.
+	Reset  time.Time // Start of the next period.
+}
+
+func (e errQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s quota of %d orders exceeded", e.Period, e.Quota)
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// orderQuota returns the quota of tenant, its settings overriding the global
+// configuration.
+func (s *OrderService) orderQuota(settings *TenantSettings) OrderQuota {
+	quota := s.config.OrderQuota
+	if settings.DailyOrderQuota.Valid {
+		quota.Daily = settings.DailyOrderQuota.Int64
+	}
+	if settings.MonthlyOrderQuota.Valid {
+		quota.Monthly = settings.MonthlyOrderQuota.Int64
+	}
+	return quota
+}
+
+// orderUsage returns the orders tenant created on the day of now and in its
+// month, in the location of now.
+func orderUsage(q querier, tenant string, now time.Time) (daily, monthly int64, err error) {
+	day := now.Format("2006-01-02")
+	err = q.QueryRow(`SELECT COALESCE(SUM(CASE WHEN day = ? THEN orders END), 0), COALESCE(SUM(orders), 0)
+		FROM order_usage WHERE tenant_id = ? AND day LIKE ?`, day, tenant, day[:len("2006-01")]+"-%").
+		Scan(&daily, &monthly)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to load order usage of tenant %q: %s", tenant, err)
+	}
+	return daily, monthly, nil
+}
+
+// checkQuota returns an errQuotaExceeded if tenant has used up a quota, given
+// that it created daily orders today and monthly this month. Days and months
+// are those of the location of now.
+func checkQuota(quota OrderQuota, daily, monthly int64, now time.Time) error {
+	if quota.Daily > 0 && daily > quota.Daily {
+		_, tomorrow := businessDay(now, now.Location())
+		return errQuotaExceeded{Period: "daily", Quota: quota.Daily, Reset: tomorrow}
+	}
+	if quota.Monthly > 0 && monthly > quota.Monthly {
+		return errQuotaExceeded{Period: "monthly", Quota: quota.Monthly,
+			Reset: time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())}
+	}
+	return nil
+}
+
+// chargeQuota counts a new order of tenant in tx on the day of now, in its
+// location. It fails with
+// errQuotaExceeded, and tx must be rolled back, if the order is over quota.
+// Counting first takes the write lock, so concurrent inserts cannot both
+// squeeze in under the quota.
+func chargeQuota(tx *sql.Tx, tenant string, quota OrderQuota, now time.Time) error {
+	_, err := tx.Exec(`INSERT INTO order_usage (tenant_id, day, orders) VALUES (?, ?, 1)
+		ON CONFLICT (tenant_id, day) DO UPDATE SET orders = orders + 1`, tenant, now.Format("2006-01-02"))
+	if err != nil {
+		return fmt.Errorf("unable to count order of tenant %q: %s", tenant, err)
+	}
+	if quota == (OrderQuota{}) {
+		return nil
+	}
+	daily, monthly, err := orderUsage(tx, tenant, now)
+	if err != nil {
+		return err
+	}
+	return checkQuota(quota, daily, monthly, now)
+}
+
+// TenantUsage is the body of GET /admin/tenants/{tenant}/usage.
+type TenantUsage struct {
+	TenantID     string           `json:"tenant_id"`
+	Month        string           `json:"month"`  // YYYY-MM in TimeZone.
+	Orders       int64            `json:"orders"` // Created in Month.
+	Days         map[string]int64 `json:"days"`   // Orders per day of Month with any.
+	DailyQuota   int64            `json:"daily_quota,omitempty"`
+	MonthlyQuota int64            `json:"monthly_quota,omitempty"`
+	TimeZone     string           `json:"time_zone"` // Of the tenant's days, "UTC" by default.
+}
+
+// Usage returns the orders tenant created in month, YYYY-MM.
+func (s *OrderService) Usage(tenant, month string) (*TenantUsage, error) {
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		return nil, err
+	}
+	quota := s.orderQuota(settings)
+	usage := &TenantUsage{TenantID: tenant, Month: month, Days: map[string]int64{},
+		DailyQuota: quota.Daily, MonthlyQuota: quota.Monthly, TimeZone: settings.location().String()}
+	rows, err := s.DB.Query("SELECT day, orders FROM order_usage WHERE tenant_id = ? AND day LIKE ?",
+		tenant, month+"-%")
+	if err != nil {
+		return nil, fmt.Errorf("unable to load order usage of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var orders int64
+		if err := rows.Scan(&day, &orders); err != nil {
+			return nil, fmt.Errorf("unable to scan order usage: %s", err)
+		}
+		usage.Days[day] = orders
+		usage.Orders += orders
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to load order usage of tenant %q: %s", tenant, err)
+	}
+	return usage, nil
+}
+
+// handleTenantUsage serves GET /admin/tenants/{tenant}/usage?month=YYYY-MM,
+// the current month of the tenant's time zone by default.
+func (s *OrderService) handleTenantUsage(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	month := req.URL.Query().Get("month")
+	if month == "" {
+		loc, err := tenantLocation(s.DB, tenant)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "tenantLocation(): %s", err)
+			return
+		}
+		month = time.Now().In(loc).Format("2006-01")
+	} else if _, err := time.Parse("2006-01", month); err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: "month must be YYYY-MM"},
+			"invalid month %q", month)
+		return
+	}
+	usage, err := s.Usage(tenant, month)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Usage(): %s", err)
+		return
+	}
+	respond(w, req, 200, usage, "tenant %q created %d orders in %s", tenant, usage.Orders, month)
+}
@@ -0,0 +1,82 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderQuota(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", OrderQuota: OrderQuota{Monthly: 3}})
+	_, err := svc.DB.Exec(`INSERT INTO tenant_settings (tenant_id, daily_order_quota, monthly_order_quota)
+		VALUES ('acme', 2, NULL), ('big', NULL, 0)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("order %d returned %d: %s", i, w.Code, w.Body)
+		}
+	}
+	w := serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	if w.Code != 429 || !strings.Contains(w.Body.String(), "QUOTA_EXCEEDED") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("order over daily quota returned %d %s", w.Code, w.Body)
+	}
+
+	// The global monthly quota applies to tenants without settings, a 0 in
+	// the settings lifts it.
+	for i := 0; i < 4; i++ {
+		want := 200
+		if i == 3 {
+			want = 429
+		}
+		if w := serve(svc, "POST", "/orders", "other", createOrderDetails); w.Code != want {
+			t.Errorf("order %d of other returned %d, want %d", i, w.Code, want)
+		}
+		if w := serve(svc, "POST", "/orders", "big", createOrderDetails); w.Code != 200 {
+			t.Errorf("order %d of big returned %d", i, w.Code)
+		}
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/usage", "")
+	var usage TenantUsage
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil {
+		t.Fatalf("GET usage returned %d: %s", w.Code, err)
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	if usage.Orders != 2 || usage.Days[today] != 2 || usage.DailyQuota != 2 || usage.MonthlyQuota != 3 ||
+		usage.Month != today[:7] {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/usage?month=2001-01", ""); w.Code != 200 ||
+		!strings.Contains(w.Body.String(), `"orders":0`) {
+		t.Errorf("GET usage of another month returned %d %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/usage?month=jan", ""); w.Code != 400 {
+		t.Errorf("GET usage with invalid month returned %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/admin/tenants/acme/usage", "acme", ""); w.Code != 401 {
+		t.Errorf("GET usage without credentials returned %d", w.Code)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	now := time.Date(2024, 12, 31, 15, 0, 0, 0, time.UTC)
+	quota := OrderQuota{Daily: 10, Monthly: 100}
+	if err := checkQuota(quota, 10, 100, now); err != nil {
+		t.Errorf("at quota: %s", err)
+	}
+	err, _ := checkQuota(quota, 11, 50, now).(errQuotaExceeded)
+	if err.Period != "daily" || !err.Reset.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("over daily quota: %+v", err)
+	}
+	err, _ = checkQuota(quota, 5, 101, now).(errQuotaExceeded)
+	if err.Period != "monthly" || !err.Reset.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("over monthly quota: %+v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeUnit is the unit of Range requests on listings, counted in orders from
+// 0. "Range: orders=100-199" is the 101st to the 200th order.
+const rangeUnit = "orders"
+
+// parseRange parses a Range header in rangeUnit. ok is false for other units,
+// which are ignored as RFC 7233 asks.
+func parseRange(header string) (first, last int, ok bool, err error) {
+	unit, spec := header, ""
+	if idx := strings.Index(header, "="); idx >= 0 {
+		unit, spec = header[:idx], header[idx+1:]
+	}
+	if strings.TrimSpace(unit) != rangeUnit {
+		return 0, 0, false, nil
+	}
+	bounds := strings.Split(strings.TrimSpace(spec), "-")
+	if len(bounds) != 2 {
+		return 0, 0, true, fmt.Errorf("expected %s=FIRST-LAST, got %q", rangeUnit, header)
+	}
+	first, err = strconv.Atoi(bounds[0])
+	if err != nil || first < 0 {
+		return 0, 0, true, fmt.Errorf("invalid first order %q", bounds[0])
+	}
+	last, err = strconv.Atoi(bounds[1])
+	if err != nil || last < first {
+		return 0, 0, true, fmt.Errorf("invalid last order %q", bounds[1])
+	}
+	return first, last, true, nil
+}
+
+// respondRange serves GET /orders with a Range header, responding 206 with
+// the orders in the range, shortened to the end of the listing and to the
+// maximum page size, and a Content-Range header saying which orders they are.
+// Returns false if the Range header does not apply and the request should be
+// served as a plain listing.
+func (s *OrderService) respondRange(w http.ResponseWriter, req *http.Request, filter OrderFilter,
+	fields Fieldset) bool {
+	header := req.Header.Get("Range")
+	if header == "" || wantsJSONAPI(req) {
+		return false
+	}
+	first, last, ok, err := parseRange(header)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_RANGE", Detail: err.Error()}, "%s", err)
+		return true
+	}
+	query := req.URL.Query()
+	if len(query["page"]) > 0 || len(query["limit"]) > 0 {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_RANGE",
+			Detail: "Range cannot be combined with page or limit"}, "range with page or limit")
+		return true
+	}
+
+	total, err := s.Count(filter)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Count() failed: %s", err)
+		return true
+	}
+	if first >= total {
+		w.Header().Set("Content-Range", fmt.Sprintf("%s */%d", rangeUnit, total))
+		respond(w, req, 416, HTTPResponseError{Error: "RANGE_NOT_SATISFIABLE"}, "range %d-%d of %d", first, last,
+			total)
+		return true
+	}
+	if last >= total {
+		last = total - 1
+	}
+	if max := s.listLimits(req).Max; max > 0 && last-first+1 > max {
+		last = first + max - 1
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("%s %d-%d/%d", rangeUnit, first, last, total))
+	if wantsNDJSON(req) {
+		s.streamOrders(w, req, filter, fields, first, last-first+1, 206, "range %d-%d/%d", first, last, total)
+	} else {
+		s.writeOrders(w, req, filter, fields, first, last-first+1, 206, "range %d-%d/%d", first, last, total)
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func getRange(svc *OrderService, path, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Range", rangeHeader)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func TestRange(t *testing.T) {
+	svc := newServiceWithOrders(t, 300)
+
+	tests := []struct {
+		path, rangeHeader string
+		code              int
+		contentRange      string
+		first, n          int64
+	}{
+		{"/orders", "orders=100-199", 206, "orders 100-199/300", 101, 100},
+		{"/orders?status=TAKEN", "orders=0-9", 206, "orders 0-9/150", 2, 10},
+		// Shortened to the end of the listing and to -max-list-limit.
+		{"/orders", "orders=290-400", 206, "orders 290-299/300", 291, 10},
+		{"/orders", "orders=0-299", 206, "orders 0-199/300", 1, 200},
+		{"/orders", "orders=300-310", 416, "orders */300", 0, 0},
+		{"/orders", "orders=5-1", 400, "", 0, 0},
+		{"/orders?limit=5", "orders=0-1", 400, "", 0, 0},
+		// Other units are ignored.
+		{"/orders?limit=3", "bytes=0-1", 200, "", 1, 3},
+	}
+	for _, test := range tests {
+		w := getRange(svc, test.path, test.rangeHeader)
+		if w.Code != test.code || w.Header().Get("Content-Range") != test.contentRange {
+			t.Errorf("%s %s: got %d %q, want %d %q", test.path, test.rangeHeader, w.Code,
+				w.Header().Get("Content-Range"), test.code, test.contentRange)
+			continue
+		}
+		if test.n == 0 {
+			continue
+		}
+		var orders []OrderDTO
+		if err := json.NewDecoder(w.Body).Decode(&orders); err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(orders)) != test.n || orders[0].ID != test.first {
+			t.Errorf("%s %s: got %d orders from %d", test.path, test.rangeHeader, len(orders), orders[0].ID)
+		}
+	}
+
+	if w := serve(svc, "GET", "/orders", "", ""); w.Header().Get("Accept-Ranges") != rangeUnit {
+		t.Errorf("missing Accept-Ranges")
+	}
+}
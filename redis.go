@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// redisTimeout bounds each Redis command, which are all small.
+	redisTimeout = time.Second
+	// redisMaxIdle is the number of connections kept open between commands.
+	redisMaxIdle = 8
+)
+
+// redisError is an error reply of Redis, e.g. "WRONGTYPE ...".
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient is a minimal RESP client of Redis, shared by the replicas of
+// a deployment for the state they must agree on: bans and cached orders.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	tls      *tls.Config // nil for plain TCP.
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisClient returns a client of the Redis at rawurl,
+// redis://[:PASSWORD@]HOST[:PORT][/DB], or rediss:// for TLS. Connections are
+// made on demand.
+func newRedisClient(rawurl string) (*redisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %s", err)
+	}
+	c := &redisClient{addr: u.Host}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("invalid Redis URL %q, want redis:// or rediss://", rawurl)
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// dial opens a connection, authenticated and on the database of the URL.
+func (c *redisClient) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to Redis: %s", err)
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do(ctx, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do(ctx, "SELECT", c.db); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command and returns its reply: a string for status replies, an
+// int64, a []byte or nil for bulk strings, or a []interface{} of these. Error
+// replies are returned as a redisError.
+func (c *redisClient) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	c.mu.Lock()
+	var conn *redisConn
+	if n := len(c.idle); n > 0 {
+		conn, c.idle = c.idle[n-1], c.idle[:n-1]
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		var err error
+		if conn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.do(ctx, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection is in an unknown state.
+		conn.Close()
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.idle) < redisMaxIdle {
+		c.idle = append(c.idle, conn)
+		conn = nil
+	}
+	c.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return reply, err
+}
+
+// Close closes the idle connections.
+func (c *redisClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+}
+
+func (conn *redisConn) do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		default:
+			s = fmt.Sprint(v)
+		}
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(s), s)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis %v failed: %s", args[0], err)
+	}
+	reply, err := readRedisReply(conn.r)
+	if _, ok := err.(redisError); err != nil && !ok {
+		return nil, fmt.Errorf("redis %v failed: %s", args[0], err)
+	}
+	return reply, err
+}
+
+// readRedisReply reads a RESP2 reply.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = readRedisReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				elems[i] = err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("invalid reply type %q", kind)
+}
+
+// redisInt returns an integer reply, or a bulk string holding one.
+func redisInt(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unexpected Redis reply %v", reply)
+}
+
+// redisString returns a bulk or status reply, "" for nil.
+func redisString(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch v := reply.(type) {
+	case []byte:
+		return string(v), nil
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	}
+	return "", fmt.Errorf("unexpected Redis reply %v", reply)
+}
@@ -0,0 +1,306 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the Redis commands the service uses from memory. Keys do
+// not expire.
+type fakeRedis struct {
+	net.Listener
+	password string
+
+	mu       sync.Mutex
+	strings  map[string]string
+	sets     map[string]map[string]float64
+	commands []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{Listener: l, password: password, strings: map[string]string{},
+		sets: map[string]map[string]float64{}}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) URL() string {
+	if r.password != "" {
+		return "redis://:" + r.password + "@" + r.Addr().String() + "/2"
+	}
+	return "redis://" + r.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	authenticated := r.password == ""
+	for {
+		reply, err := readRedisReply(in)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			authenticated = args[1] == r.password
+		} else if !authenticated {
+			fmt.Fprintf(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		conn.Write([]byte(r.do(cmd, args[1:])))
+	}
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func (r *fakeRedis) do(cmd string, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, cmd)
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "AUTH", "SELECT", "PEXPIRE":
+		return "+OK\r\n"
+	case "SET":
+		if _, ok := r.strings[args[0]]; ok && len(args) > 2 && strings.ToUpper(args[2]) == "NX" {
+			return "$-1\r\n"
+		}
+		r.strings[args[0]] = args[1]
+		return "+OK\r\n"
+	case "GET", "MGET":
+		if cmd == "GET" {
+			if v, ok := r.strings[args[0]]; ok {
+				return bulk(v)
+			}
+			return "$-1\r\n"
+		}
+		reply := fmt.Sprintf("*%d\r\n", len(args))
+		for _, key := range args {
+			if v, ok := r.strings[key]; ok {
+				reply += bulk(v)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if _, ok := r.strings[key]; ok {
+				n++
+			}
+			if _, ok := r.sets[key]; ok {
+				n++
+			}
+			delete(r.strings, key)
+			delete(r.sets, key)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "ZADD":
+		if r.sets[args[0]] == nil {
+			r.sets[args[0]] = map[string]float64{}
+		}
+		score, _ := strconv.ParseFloat(args[1], 64)
+		r.sets[args[0]][args[2]] = score
+		return ":1\r\n"
+	case "ZREMRANGEBYSCORE":
+		max, _ := strconv.ParseFloat(args[2], 64)
+		for member, score := range r.sets[args[0]] {
+			if score <= max {
+				delete(r.sets[args[0]], member)
+			}
+		}
+		return ":0\r\n"
+	case "ZCARD":
+		return fmt.Sprintf(":%d\r\n", len(r.sets[args[0]]))
+	case "SCAN":
+		var keys []string
+		for key := range r.strings {
+			if ok, _ := path.Match(args[2], key); ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		reply := fmt.Sprintf("*2\r\n%s*%d\r\n", bulk("0"), len(keys))
+		for _, key := range keys {
+			reply += bulk(key)
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func TestNewRedisClient(t *testing.T) {
+	type target struct {
+		addr, password string
+		db             int
+	}
+	for rawurl, want := range map[string]target{
+		"redis://cache":                   {addr: "cache:6379"},
+		"redis://:hunter2@cache:6380/3":   {addr: "cache:6380", password: "hunter2", db: 3},
+		"rediss://cache.example.com:6379": {addr: "cache.example.com:6379"},
+	} {
+		c, err := newRedisClient(rawurl)
+		if err != nil {
+			t.Errorf("newRedisClient(%s) failed: %s", rawurl, err)
+			continue
+		}
+		if c.addr != want.addr || c.password != want.password || c.db != want.db {
+			t.Errorf("newRedisClient(%s) = %+v", rawurl, c)
+		}
+	}
+	for _, rawurl := range []string{"http://cache", "redis://cache/one"} {
+		if _, err := newRedisClient(rawurl); err == nil {
+			t.Errorf("newRedisClient(%s) succeeded", rawurl)
+		}
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	server := newFakeRedis(t, "hunter2")
+	c, err := newRedisClient(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	if _, err := c.do(ctx, "SET", "greeting", "hello\r\nworld"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := redisString(c.do(ctx, "GET", "greeting")); err != nil || s != "hello\r\nworld" {
+		t.Errorf("GET returned %q, %v", s, err)
+	}
+	if s, err := redisString(c.do(ctx, "GET", "missing")); err != nil || s != "" {
+		t.Errorf("GET of a missing key returned %q, %v", s, err)
+	}
+	if _, err := c.do(ctx, "FLUSHALL"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+	// The connection survives error replies.
+	if n, err := redisInt(c.do(ctx, "DEL", "greeting")); err != nil || n != 1 {
+		t.Errorf("DEL returned %d, %v", n, err)
+	}
+	if len(c.idle) != 1 {
+		t.Errorf("got %d idle connections, want 1", len(c.idle))
+	}
+	if got := strings.Join(server.commands, " "); got != "AUTH SELECT SET GET GET FLUSHALL DEL" {
+		t.Errorf("got commands %s", got)
+	}
+
+	wrong, _ := newRedisClient("redis://:wrong@" + server.Addr().String())
+	if _, err := wrong.do(ctx, "PING"); err == nil {
+		t.Errorf("PING with the wrong password succeeded")
+	}
+}
+
+func TestAbuseTrackerRedis(t *testing.T) {
+	server := newFakeRedis(t, "")
+	limits := AbuseLimits{MaxErrors: 2, Window: time.Minute, Ban: time.Hour}
+	var replicas []*abuseTracker
+	for i := 0; i < 2; i++ {
+		tracker := newAbuseTracker(limits)
+		tracker.redis, _ = newRedisClient(server.URL())
+		replicas = append(replicas, tracker)
+	}
+
+	replicas[0].observe("ip:10.0.0.7", 400)
+	if !replicas[1].bannedUntil("ip:10.0.0.7").IsZero() {
+		t.Fatalf("banned after a single error")
+	}
+	replicas[1].observe("ip:10.0.0.7", 409)
+	if until := replicas[0].bannedUntil("ip:10.0.0.7"); until.IsZero() {
+		t.Fatalf("not banned after errors on two replicas")
+	}
+	bans, err := replicas[1].Bans()
+	if err != nil || len(bans) != 1 || bans[0].Client != "ip:10.0.0.7" {
+		t.Errorf("Bans() returned %+v, %v", bans, err)
+	}
+	if banned, err := replicas[1].Unban("ip:10.0.0.7"); err != nil || !banned {
+		t.Errorf("Unban() returned %v, %v", banned, err)
+	}
+	if !replicas[0].bannedUntil("ip:10.0.0.7").IsZero() {
+		t.Errorf("still banned after Unban()")
+	}
+
+	// Requests are let through while Redis is down.
+	server.Close()
+	replicas[0].redis.Close()
+	if !replicas[0].bannedUntil("ip:10.0.0.7").IsZero() {
+		t.Errorf("banned while Redis is down")
+	}
+}
+
+func TestOrderCacheRedis(t *testing.T) {
+	server := newFakeRedis(t, "")
+	config := Config{Redis: server.URL(), OrderCache: OrderCacheConfig{Size: 1, TTL: time.Hour}}
+	svc := newTestService(t, config)
+	config.DistanceProvider = providerHaversine
+	other, err := NewOrderService(svc.DB, config, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2"} {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+		if w := serve(svc, "GET", "/orders/"+id, "", ""); w.Code != 200 {
+			t.Fatalf("GET /orders/%s returned %d", id, w.Code)
+		}
+	}
+	server.mu.Lock()
+	_, ok := server.strings["order:1"]
+	server.mu.Unlock()
+	if !ok {
+		t.Fatalf("order 1 not cached in Redis, got %v", server.strings)
+	}
+
+	// A write of another replica is seen right away.
+	if w := servePatch(other, "/orders/1", `{"notes": "leave at door"}`); w.Code != 200 {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "GET", "/orders/1", "", ""); !strings.Contains(w.Body.String(), "leave at door") {
+		t.Errorf("GET after a write of another replica returned %s", w.Body)
+	}
+	if w := serveAdmin(svc, "GET", "/readyz", ""); !strings.Contains(w.Body.String(), `"redis":"ok"`) {
+		t.Errorf("GET /readyz returned %s", w.Body)
+	}
+
+	server.Close()
+	svc.redis.Close()
+	if w := serve(svc, "GET", "/orders/1", "", ""); w.Code != 200 {
+		t.Errorf("GET /orders/1 while Redis is down returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "GET", "/readyz", ""); !strings.Contains(w.Body.String(), `"redis":"down"`) {
+		t.Errorf("GET /readyz while Redis is down returned %s", w.Body)
+	}
+}
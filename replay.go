@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// projectionColumns are the columns of orders that are derived from events.
+const projectionColumns = `id, uid, distance, status, tenant_id, origin_lat, origin_lng, destination_lat,
+	destination_lng, created_at, duplicate_of, linked_order_id, duration, price, currency, surge, promo_code, discount,
+	price_adjustments, payment_status, ` +
+	fieldColumns + `, sla_breached_at`
+
+// loadEvents returns every event, oldest first, decrypted with key.
+func loadEvents(tx *sql.Tx, key []byte) ([]Event, error) {
+	rows, err := tx.Query("SELECT id, order_id, type, data, created_at FROM events ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query events: %s", err)
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		event, err := scanEvent(key, rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query events: %s", err)
+	}
+	return events, nil
+}
+
+// rebuild empties the orders table and projects every event into it again,
+// leaving out archived orders. key is the Config.FieldKey. Returns the number
+// of events replayed.
+func rebuild(tx *sql.Tx, key []byte) (int, error) {
+	events, err := loadEvents(tx, key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM orders"); err != nil {
+		return 0, fmt.Errorf("unable to empty orders: %s", err)
+	}
+	for i := range events {
+		if err := project(tx, key, &events[i]); err != nil {
+			return 0, fmt.Errorf("event %d: %s", events[i].ID, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM orders WHERE id IN (SELECT id FROM orders_archive)"); err != nil {
+		return 0, fmt.Errorf("unable to leave out archived orders: %s", err)
+	}
+	return len(events), nil
+}
+
+// Replay rebuilds the orders table from the events table, e.g. after fixing a
+// bug in project. Returns the number of events replayed.
+func Replay(db *sql.DB, key []byte) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed at Begin: %s", err)
+	}
+	n, err := rebuild(tx, key)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit replay: %s", err)
+	}
+	return n, nil
+}
+
+// snapshotOrders returns the projected columns of every order as
+// column=value, keyed by id. Encrypted columns are decrypted with key, as
+// sealField encrypts the same value differently every time.
+func snapshotOrders(tx *sql.Tx, key []byte) (map[int64][]string, error) {
+	rows, err := tx.Query("SELECT " + projectionColumns + " FROM orders")
+	if err != nil {
+		return nil, fmt.Errorf("unable to query orders: %s", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("unable to query orders: %s", err)
+	}
+	sealed := map[int]bool{}
+	for i, column := range columns {
+		for _, c := range sealedColumns {
+			if c.table == "orders" && c.column == column {
+				sealed[i] = true
+			}
+		}
+	}
+
+	snapshot := map[int64][]string{}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		id, _ := values[0].(int64)
+		for i := range sealed {
+			if s, ok := values[i].(string); ok {
+				values[i] = []byte(s)
+			}
+			if b, ok := values[i].([]byte); ok {
+				plaintext, err := openField(key, b)
+				if err != nil {
+					return nil, fmt.Errorf("order %d: column %s: %s", id, columns[i], err)
+				}
+				values[i] = string(plaintext)
+			}
+		}
+		row := make([]string, len(columns))
+		for i, value := range values {
+			switch v := value.(type) {
+			case nil:
+				row[i] = columns[i] + "=NULL"
+			case []byte:
+				row[i] = columns[i] + "=" + strconv.Quote(string(v))
+			case string:
+				row[i] = columns[i] + "=" + strconv.Quote(v)
+			default:
+				row[i] = fmt.Sprintf("%s=%v", columns[i], v)
+			}
+		}
+		snapshot[id] = row
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query orders: %s", err)
+	}
+	return snapshot, nil
+}
+
+// Verify checks that the orders table matches a projection of the events
+// table. It replays the events in a transaction that is rolled back, so the
+// database is left untouched. Returns one line per order that differs, with
+// the columns that do.
+func Verify(db *sql.DB, key []byte) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed at Begin: %s", err)
+	}
+	defer tx.Rollback()
+
+	stored, err := snapshotOrders(tx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rebuild(tx, key); err != nil {
+		return nil, err
+	}
+	projected, err := snapshotOrders(tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for id, row := range stored {
+		want, ok := projected[id]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("order %d has no events", id))
+			continue
+		}
+		var got, expected []string
+		for i := range row {
+			if row[i] != want[i] {
+				got, expected = append(got, row[i]), append(expected, want[i])
+			}
+		}
+		if len(got) > 0 {
+			problems = append(problems, fmt.Sprintf("order %d has %s, events give %s", id, strings.Join(got, " "),
+				strings.Join(expected, " ")))
+		}
+	}
+	for id := range projected {
+		if _, ok := stored[id]; !ok {
+			problems = append(problems, fmt.Sprintf("order %d is missing", id))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// replayMain implements "orderservice replay" and "orderservice verify".
+func replayMain(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	dbpath := flags.String("dbpath", "", "Path to database")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dbpath == "" {
+		return fmt.Errorf("missing db name")
+	}
+	key, err := loadFieldKey(context.Background(), http.DefaultClient, "")
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", *dbpath)
+	if err != nil {
+		return fmt.Errorf("failed to open sqlite3 database (%s) : %s", *dbpath, err)
+	}
+	defer db.Close()
+
+	switch command {
+	case "replay":
+		n, err := Replay(db, key)
+		if err != nil {
+			return fmt.Errorf("replay failed: %s", err)
+		}
+		fmt.Printf("Replayed %d events.\n", n)
+	case "verify":
+		problems, err := Verify(db, key)
+		if err != nil {
+			return fmt.Errorf("verify failed: %s", err)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d orders do not match their events, run orderservice replay", len(problems))
+		}
+		fmt.Println("Orders match events.")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplayAndVerify(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for i := 0; i < 3; i++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if err := svc.Take(2); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := Verify(svc.DB, svc.config.FieldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+
+	// Break the projection.
+	if _, err := svc.DB.Exec("UPDATE orders SET status = 'UNASSIGNED' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.DB.Exec("DELETE FROM orders WHERE id = 3"); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = Verify(svc.DB, svc.config.FieldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{`order 2 has status="UNASSIGNED", events give status="TAKEN"`, "order 3 is missing"}
+	if !reflect.DeepEqual(problems, expect) {
+		t.Fatalf("problems %q, expected %q", problems, expect)
+	}
+
+	n, err := Replay(svc.DB, svc.config.FieldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("replayed %d events, want 4", n)
+	}
+	if order, err := svc.Get(2); err != nil || order.State != StateTaken {
+		t.Errorf("order 2 after replay: %+v, %v", order, err)
+	}
+	if problems, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(problems) != 0 {
+		t.Errorf("after replay: %v, %v", problems, err)
+	}
+}
+
+func TestReplayBackfilledOrders(t *testing.T) {
+	svc := newTestService(t, Config{})
+	// Orders written before the events table, one of them updated since.
+	_, err := svc.DB.Exec(`INSERT INTO orders (id, uid, distance, status, tenant_id, origin_lat, origin_lng,
+		destination_lat, destination_lng, created_at, price, currency) VALUES
+		(1, NULL, 1816, 'UNASSIGNED', 'acme', 37.8061044, -122.2943356, 37.8093475, -122.2740787, 1500000000, 250, 'USD'),
+		(2, 'a"b\c', 1816.4, 'TAKEN', '', 37.8061044, -122.2943356, 37.8093475, -122.2740787, 1500000060, NULL, NULL),
+		(3, NULL, 900, 'TAKEN', 'acme', 1e-7, 0.1, 0.2, 0.3, 1500000120, 100, 'EUR')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Update(3, []byte(`{"notes": "ring twice"}`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := Verify(svc.DB, nil); err != nil || len(problems) != 3 {
+		t.Fatalf("before the backfill: %v, %v", problems, err)
+	}
+
+	script, err := migrationFiles.ReadFile("migrations/037_backfill_order_events.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.DB.Exec(string(script)); err != nil {
+		t.Fatalf("backfill failed: %s", err)
+	}
+	if problems, err := Verify(svc.DB, nil); err != nil || len(problems) != 0 {
+		t.Errorf("after the backfill: %v, %v", problems, err)
+	}
+	if n, err := Replay(svc.DB, nil); err != nil || n != 6 {
+		t.Fatalf("replayed %d events, %v", n, err)
+	}
+	for id, state := range map[int64]OrderState{1: StateUnassigned, 2: StateTaken, 3: StateTaken} {
+		if order, err := svc.Get(id); err != nil || order.State != state {
+			t.Errorf("order %d after replay: %+v, %v", id, order, err)
+		}
+	}
+	if order, _ := svc.Get(2); order.UID != `a"b\c` || order.Distance != 1816 {
+		t.Errorf("order 2 after replay: %+v", order)
+	}
+	if order, _ := svc.Get(3); order.Notes != "ring twice" {
+		t.Errorf("order 3 after replay: %+v", order)
+	}
+	if events, err := svc.History(1); err != nil || len(events) != 1 || events[0].Type != EventCreated ||
+		events[0].Time.Unix() != 1500000000 {
+		t.Errorf("history of order 1: %+v, %v", events, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// replicationVars are the state of replication and of the WAL checkpoints,
+// served with the other expvar variables by GET /admin/metrics.
+var replicationVars = expvar.NewMap("replication")
+
+// maxReplicationBackoff bounds the delay before restarting litestream.
+const maxReplicationBackoff = time.Minute
+
+// ReplicationConfig streams the WAL of the database to a replica with
+// litestream, so that a single node survives the loss of its disk losing
+// at most the last seconds of writes.
+type ReplicationConfig struct {
+	// Replica URL of litestream, e.g. s3://BUCKET/orders.db, empty disables
+	// replication.
+	Replica string
+	// Path of the litestream binary.
+	Litestream string
+	// Time between passive WAL checkpoints, 0 leaves checkpoints to SQLite.
+	CheckpointInterval time.Duration
+}
+
+// replicator runs "litestream replicate" for the database, restarting it
+// when it exits, and checkpoints the WAL.
+type replicator struct {
+	config  ReplicationConfig
+	dbpath  string
+	db      *sql.DB
+	command func(name string, args ...string) *exec.Cmd
+	backoff time.Duration // Before the first restart, doubling after each.
+	now     func() time.Time
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd // Running litestream, nil if none.
+	stopped bool
+	done    chan struct{} // Closed when run returns.
+}
+
+func newReplicator(config ReplicationConfig, dbpath string) *replicator {
+	if config.Litestream == "" {
+		config.Litestream = "litestream"
+	}
+	return &replicator{config: config, dbpath: dbpath, command: exec.Command, backoff: time.Second, now: time.Now,
+		done: make(chan struct{})}
+}
+
+// restore restores the database from the replica if the database does not
+// exist and the replica does, e.g. on a new disk.
+func (r *replicator) restore() error {
+	cmd := r.command(r.config.Litestream, "restore", "-if-db-not-exists", "-if-replica-exists", "-o", r.dbpath,
+		r.config.Replica)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("litestream restore failed: %s", err)
+	}
+	return nil
+}
+
+// start puts db in WAL mode, which litestream replicates, then runs
+// litestream and the checkpoints until ctx is done or stop is called.
+func (r *replicator) start(ctx context.Context, db *sql.DB) error {
+	var mode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode = WAL").Scan(&mode); err != nil {
+		return fmt.Errorf("unable to turn on WAL mode: %s", err)
+	}
+	if mode != "wal" {
+		return fmt.Errorf("unable to turn on WAL mode, journal mode is %s", mode)
+	}
+	r.db = db
+	go r.run(ctx)
+	if r.config.CheckpointInterval > 0 {
+		go r.checkpoints(ctx)
+	}
+	return nil
+}
+
+// run runs litestream until ctx is done or stop is called, restarting it
+// with a growing delay while it keeps failing.
+func (r *replicator) run(ctx context.Context) {
+	defer close(r.done)
+	delay := r.backoff
+	for {
+		started := r.now()
+		err := r.replicate()
+		if r.isStopped() || ctx.Err() != nil {
+			return
+		}
+		if r.now().Sub(started) > maxReplicationBackoff {
+			delay = r.backoff
+		}
+		replicationVars.Add("restarts", 1)
+		fmt.Printf("Replication: litestream exited (%v), restarting in %s\n", err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReplicationBackoff {
+			delay = maxReplicationBackoff
+		}
+	}
+}
+
+// replicate runs litestream once, until it exits.
+func (r *replicator) replicate() error {
+	cmd := r.command(r.config.Litestream, "replicate", r.dbpath, r.config.Replica)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.cmd = cmd
+	r.mu.Unlock()
+	setReplicationVar("up", 1)
+
+	err := cmd.Wait()
+	setReplicationVar("up", 0)
+	r.mu.Lock()
+	r.cmd = nil
+	r.mu.Unlock()
+	return err
+}
+
+func (r *replicator) isStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped
+}
+
+// Up returns true while litestream is running.
+func (r *replicator) Up() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cmd != nil
+}
+
+// stop asks litestream to exit with SIGTERM, letting it ship the last
+// writes, and kills it if it has not exited after timeout.
+func (r *replicator) stop(timeout time.Duration) {
+	r.mu.Lock()
+	r.stopped = true
+	cmd := r.cmd
+	r.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+		fmt.Printf("Replication: litestream did not exit after %s, killing it\n", timeout)
+		cmd.Process.Kill()
+	}
+}
+
+// checkpoints checkpoints the WAL every config.CheckpointInterval until ctx
+// is done.
+func (r *replicator) checkpoints(ctx context.Context) {
+	ticker := time.NewTicker(r.config.CheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.checkpoint(ctx); err != nil {
+				fmt.Printf("Replication: %s\n", err)
+			}
+		}
+	}
+}
+
+// checkpoint runs a passive checkpoint, which copies the WAL frames that no
+// reader, litestream included, still needs into the database without
+// waiting for locks, and publishes its outcome.
+func (r *replicator) checkpoint(ctx context.Context) error {
+	var busy, frames, checkpointed int64
+	err := r.db.QueryRowContext(ctx, "PRAGMA wal_checkpoint(PASSIVE)").Scan(&busy, &frames, &checkpointed)
+	if err != nil {
+		replicationVars.Add("checkpoint_failures", 1)
+		return fmt.Errorf("checkpoint failed: %s", err)
+	}
+	replicationVars.Add("checkpoints", 1)
+	setReplicationVar("wal_frames", frames)
+	setReplicationVar("checkpointed_frames", checkpointed)
+	setReplicationVar("last_checkpoint", r.now().Unix())
+	if info, err := os.Stat(r.dbpath + "-wal"); err == nil {
+		setReplicationVar("wal_bytes", info.Size())
+	}
+	return nil
+}
+
+func setReplicationVar(name string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	replicationVars.Set(name, v)
+}
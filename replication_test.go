@@ -0,0 +1,133 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLitestreamHelper stands in for litestream when run by fakeLitestream.
+func TestLitestreamHelper(t *testing.T) {
+	if os.Getenv("LITESTREAM_HELPER_LOG") == "" {
+		return
+	}
+	args := os.Args[len(os.Args)-1]
+	ioutil.WriteFile(os.Getenv("LITESTREAM_HELPER_LOG"), []byte(args), 0644)
+	if strings.HasPrefix(args, "replicate") {
+		if os.Getenv("LITESTREAM_HELPER_FAIL") != "" {
+			os.Exit(1)
+		}
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGTERM)
+		<-c
+	}
+	os.Exit(0)
+}
+
+// fakeLitestream makes commands of r run TestLitestreamHelper, which writes
+// its arguments to the returned file.
+func fakeLitestream(t *testing.T, r *replicator, fail bool) string {
+	log := filepath.Join(t.TempDir(), "litestream.log")
+	r.command = func(name string, args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLitestreamHelper$", "--", strings.Join(args, " "))
+		cmd.Env = append(os.Environ(), "LITESTREAM_HELPER_LOG="+log)
+		if fail {
+			cmd.Env = append(cmd.Env, "LITESTREAM_HELPER_FAIL=1")
+		}
+		return cmd
+	}
+	return log
+}
+
+func TestReplicator(t *testing.T) {
+	svc := newTestService(t, Config{})
+	r := newReplicator(ReplicationConfig{Replica: "s3://backups/orders.db"}, "orders.db")
+	log := fakeLitestream(t, r, false)
+	if err := r.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if args, _ := ioutil.ReadFile(log); string(args) !=
+		"restore -if-db-not-exists -if-replica-exists -o orders.db s3://backups/orders.db" {
+		t.Errorf("unexpected restore %q", args)
+	}
+
+	if err := r.start(context.Background(), svc.DB); err != nil {
+		t.Fatal(err)
+	}
+	svc.replication = r
+	for i := 0; !r.Up() && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := serve(svc, "GET", "/readyz", "", "")
+	var ready Readiness
+	if err := json.NewDecoder(w.Body).Decode(&ready); err != nil || ready.Replication != "ok" || ready.Status != "ok" {
+		t.Errorf("unexpected readiness %+v, %v", ready, err)
+	}
+
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if err := r.checkpoint(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if replicationVars.Get("checkpoints") == nil || replicationVars.Get("wal_frames") == nil {
+		t.Errorf("unexpected metrics %s", replicationVars)
+	}
+
+	// SIGTERM lets litestream exit, it is not restarted.
+	r.stop(5 * time.Second)
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replicator still running")
+	}
+	if r.Up() {
+		t.Error("litestream still up after stop")
+	}
+}
+
+func TestReplicatorRestarts(t *testing.T) {
+	svc := newTestService(t, Config{})
+	r := newReplicator(ReplicationConfig{Replica: "s3://backups/orders.db"}, "orders.db")
+	fakeLitestream(t, r, true)
+	r.backoff = time.Millisecond
+	restarts := func() int64 {
+		if v := replicationVars.Get("restarts"); v != nil {
+			return v.(*expvar.Int).Value()
+		}
+		return 0
+	}
+	before := restarts()
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.start(ctx, svc.DB); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; restarts() < before+2 && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if restarts() < before+2 {
+		t.Errorf("litestream restarted %d times", restarts()-before)
+	}
+	cancel()
+	<-r.done
+
+	svc.replication = r
+	w := serve(svc, "GET", "/readyz", "", "")
+	var ready Readiness
+	json.NewDecoder(w.Body).Decode(&ready)
+	if ready.Status != "degraded" || ready.Replication != "down" {
+		t.Errorf("unexpected readiness %+v", ready)
+	}
+}
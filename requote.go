@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// PricedRoute is the part of an order recomputed by Requote.
+type PricedRoute struct {
+	Distance int64   `json:"distance"`
+	Duration int64   `json:"duration"`
+	Price    int64   `json:"price"`
+	Currency string  `json:"currency,omitempty"`
+	Surge    float64 `json:"surge,omitempty"` // Multiplier of Price, 0 for no surge.
+	// Promotion taken off Price, given at creation.
+	PromoCode string `json:"promo_code,omitempty"`
+	Discount  int64  `json:"discount,omitempty"`
+}
+
+// Requote recomputes the distance and price of an existing order with the
+// tenant's current distance provider and the current tariff, e.g. after a
+// tariff change. The discount of the order's promotion is recomputed, without
+// checking its expiry or uses again. The previous values are kept in the
+// audit log. Returns errNoSuchOrder if there is no such order.
+func (s *OrderService) Requote(orderID int64, actor string) (*Order, error) {
+	var (
+		tenant                                               string
+		originLat, originLng, destinationLat, destinationLng sql.NullFloat64
+		old                                                  PricedRoute
+		duration, price                                      sql.NullInt64
+		currency, promoCode                                  sql.NullString
+		surge                                                sql.NullFloat64
+		discount                                             sql.NullInt64
+	)
+	err := s.DB.QueryRow(`SELECT tenant_id, origin_lat, origin_lng, destination_lat, destination_lng,
+		distance, duration, price, currency, surge, promo_code, discount FROM orders WHERE id = ?`,
+		orderID).Scan(&tenant, &originLat, &originLng, &destinationLat, &destinationLng, &old.Distance, &duration,
+		&price, &currency, &surge, &promoCode, &discount)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchOrder
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query order %d: %s", orderID, err)
+	}
+	if !originLat.Valid || !destinationLat.Valid {
+		return nil, fmt.Errorf("order %d has no stored route", orderID)
+	}
+	old.Duration, old.Price, old.Currency = duration.Int64, price.Int64, currency.String
+	old.Surge, old.PromoCode, old.Discount = surge.Float64, promoCode.String, discount.Int64
+
+	formatPoint := func(lat, lng sql.NullFloat64) []string {
+		return []string{strconv.FormatFloat(lat.Float64, 'f', -1, 64), strconv.FormatFloat(lng.Float64, 'f', -1, 64)}
+	}
+	quote, err := s.Quote(tenant, CreateOrderDetails{
+		Origin:      formatPoint(originLat, originLng),
+		Destination: formatPoint(destinationLat, destinationLng),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if old.PromoCode != "" {
+		promotion, err := loadPromotion(s.DB, tenant, old.PromoCode)
+		if err != nil {
+			return nil, err
+		}
+		if promotion != nil {
+			promotion.apply(quote)
+		}
+	}
+	updated := PricedRoute{Distance: quote.Distance, Duration: quote.Duration, Price: quote.Price,
+		Currency: quote.Currency, Surge: quote.Breakdown.Surge, PromoCode: quote.Breakdown.PromoCode,
+		Discount: quote.Breakdown.Discount}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed at Begin: %s", err)
+	}
+	event, err := newEvent(orderID, EventRequoted, updated)
+	if err == nil {
+		err = record(tx, s.config.FieldKey, event)
+	}
+	if err == nil {
+		err = audit(tx, orderID, "requote", actor, map[string]PricedRoute{"old": old, "new": updated})
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("unable to update order %d: %s", orderID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("unable to commit requote of order %d: %s", orderID, err)
+	}
+	s.orderCache.invalidate(orderID)
+	return s.Get(orderID)
+}
+
+// handleRequote serves POST /orders/{id}/requote, admin only.
+func (s *OrderService) handleRequote(w http.ResponseWriter, req *http.Request, orderID int64) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	order, err := s.Requote(orderID, auditActorAdmin)
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case errDistanceUnavailable:
+		s.respondDistanceUnavailable(w, req)
+	case nil:
+		s.respondOrder(w, req, 200, order, "requoted order %d", orderID)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Requote() %d failed: %s", orderID, err)
+	}
+}
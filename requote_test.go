@@ -0,0 +1,52 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRequote(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Tariff: Tariff{BaseFare: 100, PerKm: 100}})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+
+	// Prices go up.
+	svc.config.Tariff.PerKm = 200
+	if w := serve(svc, "POST", "/orders/1/requote", "", ""); w.Code != 401 {
+		t.Errorf("expected 401 without admin token, got %d", w.Code)
+	}
+	w := serveAdmin(svc, "POST", "/orders/1/requote", "")
+	if w.Code != 200 {
+		t.Fatalf("POST /orders/1/requote returned %d: %s", w.Code, w.Body)
+	}
+	var order OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order.Price != 100+363 {
+		t.Errorf("unexpected price %d", order.Price)
+	}
+
+	var action, actor, details string
+	err := svc.DB.QueryRow("SELECT action, actor, details FROM audit_log WHERE order_id = 1").Scan(
+		&action, &actor, &details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes map[string]PricedRoute
+	if err := json.Unmarshal([]byte(details), &changes); err != nil {
+		t.Fatal(err)
+	}
+	if action != "requote" || actor != auditActorAdmin || changes["old"].Price != 100+182 ||
+		changes["new"].Price != order.Price {
+		t.Errorf("unexpected audit entry %s %s %s", action, actor, details)
+	}
+
+	if w := serveAdmin(svc, "POST", "/orders/9/requote", ""); w.Code != 404 {
+		t.Errorf("expected 404 for missing order, got %d", w.Code)
+	}
+}
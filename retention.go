@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetentionConfig configures how long orders are kept. Orders, archived or
+// not, are purged with their events, audit log and comments once they are older than
+// the retention of their tenant. Usage and billing totals are kept.
+type RetentionConfig struct {
+	// Days orders are kept for tenants without a retention of their own, 0
+	// keeps them forever.
+	Days int64
+	// Time between purges, 0 disables purging.
+	Interval time.Duration
+}
+
+// RetentionPolicy is the body of GET /admin/tenants/{tenant}/retention.
+type RetentionPolicy struct {
+	TenantID string `json:"tenant_id"`
+	// Days orders of the tenant are kept, 0 is forever.
+	RetentionDays int64 `json:"retention_days"`
+	// "tenant" if the tenant set its own retention, "default" otherwise.
+	Source string `json:"source"`
+	// Creation time of the tenant's oldest order, if it has any.
+	OldestOrder *time.Time `json:"oldest_order,omitempty"`
+	// Estimate of when the oldest order will be purged, omitted if nothing
+	// is due to be.
+	NextPurge *time.Time `json:"next_purge,omitempty"`
+}
+
+// purger periodically deletes orders past their tenant's retention.
+type purger struct {
+	config   RetentionConfig
+	db       *sql.DB
+	fieldKey []byte // Config.FieldKey.
+	now      func() time.Time
+
+	mu      sync.Mutex
+	nextRun time.Time // Zero until run starts.
+}
+
+func newPurger(config RetentionConfig, db *sql.DB, fieldKey []byte) *purger {
+	return &purger{config: config, db: db, fieldKey: fieldKey, now: time.Now}
+}
+
+// run purges every config.Interval until ctx is done.
+func (p *purger) run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	p.scheduled(p.now().Add(p.config.Interval))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := p.purge(ctx)
+			if err != nil {
+				fmt.Printf("Purger: %s\n", err)
+			}
+			if n > 0 {
+				fmt.Printf("Purger: purged %d orders\n", n)
+			}
+			p.scheduled(p.now().Add(p.config.Interval))
+		}
+	}
+}
+
+func (p *purger) scheduled(next time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextRun = next
+}
+
+// nextPurge returns when the next purge will run, zero if purging is not
+// running.
+func (p *purger) nextPurge() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.nextRun
+}
+
+// retentionDays returns the effective retention of a tenant and whether it
+// is the tenant's own.
+func (p *purger) retentionDays(settings *TenantSettings) (int64, bool) {
+	if settings.RetentionDays.Valid {
+		return settings.RetentionDays.Int64, true
+	}
+	return p.config.Days, false
+}
+
+// purge deletes the orders of every tenant that are past its retention.
+// Returns the number of orders deleted.
+func (p *purger) purge(ctx context.Context) (int, error) {
+	rows, err := p.db.QueryContext(ctx, `SELECT tenant_id FROM orders UNION SELECT tenant_id FROM orders_archive`)
+	if err != nil {
+		return 0, fmt.Errorf("unable to list tenants: %s", err)
+	}
+	var tenants []string
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		tenants = append(tenants, tenant)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to list tenants: %s", err)
+	}
+
+	total := 0
+	for _, tenant := range tenants {
+		settings, err := loadTenantSettings(p.db, p.fieldKey, tenant)
+		if err != nil {
+			return total, err
+		}
+		days, _ := p.retentionDays(settings)
+		if days == 0 {
+			continue
+		}
+		n, err := p.purgeTenant(ctx, tenant, p.now().AddDate(0, 0, -int(days)))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// purgeTenant deletes the orders of tenant created before cutoff, with their
+// events, audit log and comments, in one transaction.
+func (p *purger) purgeTenant(ctx context.Context, tenant string, cutoff time.Time) (int, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed at BeginTx: %s", err)
+	}
+	defer tx.Rollback()
+
+	const expired = `SELECT id FROM orders WHERE tenant_id = ? AND created_at < ?
+		UNION SELECT id FROM orders_archive WHERE tenant_id = ? AND created_at < ?`
+	args := []interface{}{tenant, cutoff.Unix(), tenant, cutoff.Unix()}
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM ("+expired+")", args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("unable to count expired orders of tenant %q: %s", tenant, err)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	for _, table := range []string{"events", "audit_log", "order_comments"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE order_id IN ("+expired+")", args...); err != nil {
+			return 0, fmt.Errorf("unable to purge %s of tenant %q: %s", table, tenant, err)
+		}
+	}
+	// Archived orders got their tombstone when archived.
+	err = recordTombstones(tx, tombstonePurged, p.now(),
+		"SELECT id, tenant_id FROM orders WHERE tenant_id = ? AND created_at < ?", tenant, cutoff.Unix())
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range []string{"orders", "orders_archive"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE tenant_id = ? AND created_at < ?", tenant, cutoff.Unix())
+		if err != nil {
+			return 0, fmt.Errorf("unable to purge %s of tenant %q: %s", table, tenant, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit purge of tenant %q: %s", tenant, err)
+	}
+	return n, nil
+}
+
+// RetentionPolicy returns the effective retention of tenant.
+func (s *OrderService) RetentionPolicy(tenant string) (*RetentionPolicy, error) {
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		return nil, err
+	}
+	policy := &RetentionPolicy{TenantID: tenant, Source: "default"}
+	var own bool
+	policy.RetentionDays, own = s.purger.retentionDays(settings)
+	if own {
+		policy.Source = "tenant"
+	}
+
+	var oldest sql.NullInt64
+	err = s.DB.QueryRow(`SELECT MIN(created_at) FROM (SELECT created_at FROM orders WHERE tenant_id = ?
+		UNION ALL SELECT created_at FROM orders_archive WHERE tenant_id = ?)`, tenant, tenant).Scan(&oldest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find oldest order of tenant %q: %s", tenant, err)
+	}
+	if !oldest.Valid {
+		return policy, nil
+	}
+	oldestOrder := time.Unix(oldest.Int64, 0).UTC()
+	policy.OldestOrder = &oldestOrder
+
+	nextRun := s.purger.nextPurge()
+	if policy.RetentionDays == 0 || nextRun.IsZero() {
+		return policy, nil
+	}
+	// The oldest order is purged by the first run after it expires.
+	nextPurge := nextRun.UTC()
+	if expires := oldestOrder.AddDate(0, 0, int(policy.RetentionDays)); expires.After(nextRun) {
+		runs := expires.Sub(nextRun)/s.purger.config.Interval + 1
+		nextPurge = nextRun.Add(runs * s.purger.config.Interval).UTC()
+	}
+	policy.NextPurge = &nextPurge
+	return policy, nil
+}
+
+// SetRetention sets the retention of tenant in days, nil falls back to the
+// default.
+func (s *OrderService) SetRetention(tenant string, days *int64) error {
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, retention_days) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET retention_days = excluded.retention_days`, tenant, days)
+	if err != nil {
+		return fmt.Errorf("unable to set retention of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantRetention serves /admin/tenants/{tenant}/retention.
+//
+//	GET /admin/tenants/{tenant}/retention  returns the RetentionPolicy.
+//	PUT /admin/tenants/{tenant}/retention  sets it, {"retention_days": 90}, or
+//	                                       {"retention_days": null} for the default.
+func (s *OrderService) handleTenantRetention(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var body struct {
+			RetentionDays *int64 `json:"retention_days"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if body.RetentionDays != nil && *body.RetentionDays < 0 {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: "retention_days must not be negative"}, "retention_days %d", *body.RetentionDays)
+			return
+		}
+		if err := s.SetRetention(tenant, body.RetentionDays); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetRetention(): %s", err)
+			return
+		}
+	default:
+		respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+		return
+	}
+	policy, err := s.RetentionPolicy(tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "RetentionPolicy(): %s", err)
+		return
+	}
+	respond(w, req, 200, policy, "tenant %q keeps orders %d days", tenant, policy.RetentionDays)
+}
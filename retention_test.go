@@ -0,0 +1,90 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Retention: RetentionConfig{Days: 30, Interval: time.Hour}})
+	for _, tenant := range []string{"acme", "acme", "globex"} {
+		if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	// Orders 1 and 3 are 40 days old, 1 is archived.
+	old := time.Now().AddDate(0, 0, -40).Unix()
+	_, err := svc.DB.Exec(`UPDATE orders SET created_at = ? WHERE id IN (1, 3);
+		UPDATE events SET created_at = ? WHERE order_id IN (1, 3)`, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Take(1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := newArchiver(ArchiveConfig{After: time.Hour}, svc.DB).archive(context.Background()); err != nil || n != 1 {
+		t.Fatalf("archived %d orders, %v", n, err)
+	}
+
+	// globex keeps its orders forever.
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/globex/retention", `{"retention_days": -1}`); w.Code != 400 {
+		t.Errorf("negative retention returned %d", w.Code)
+	}
+	w := serveAdmin(svc, "PUT", "/admin/tenants/globex/retention", `{"retention_days": 0}`)
+	if w.Code != 200 {
+		t.Fatalf("PUT retention returned %d: %s", w.Code, w.Body)
+	}
+	var policy RetentionPolicy
+	if err := json.Unmarshal(w.Body.Bytes(), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if policy.RetentionDays != 0 || policy.Source != "tenant" || policy.OldestOrder == nil || policy.NextPurge != nil {
+		t.Errorf("globex policy %+v", policy)
+	}
+
+	// acme has the default, and is due at the next run.
+	svc.purger.scheduled(time.Now().Add(time.Hour))
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/retention", "")
+	policy = RetentionPolicy{}
+	if err := json.Unmarshal(w.Body.Bytes(), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if policy.RetentionDays != 30 || policy.Source != "default" || policy.NextPurge == nil ||
+		!policy.NextPurge.Equal(svc.purger.nextPurge().UTC()) {
+		t.Errorf("acme policy %+v", policy)
+	}
+
+	n, err := svc.purger.purge(context.Background())
+	if err != nil || n != 1 {
+		t.Fatalf("purged %d orders, %v", n, err)
+	}
+	if _, err := svc.Get(1); err != errNoSuchOrder {
+		t.Errorf("purged order 1: %v", err)
+	}
+	if _, err := svc.History(1); err != errNoSuchOrder {
+		t.Errorf("history of purged order 1: %v", err)
+	}
+	for _, id := range []int64{2, 3} {
+		if _, err := svc.Get(id); err != nil {
+			t.Errorf("order %d: %v", id, err)
+		}
+	}
+	if problems, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(problems) != 0 {
+		t.Errorf("verify: %v, %v", problems, err)
+	}
+
+	// The next order of acme expires in 30 days, on the first run after.
+	policy2, err := svc.RetentionPolicy("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := policy2.OldestOrder.AddDate(0, 0, 30)
+	if policy2.NextPurge == nil || policy2.NextPurge.Before(expires) || policy2.NextPurge.Sub(expires) > time.Hour {
+		t.Errorf("acme next purge %v, oldest order expires %s", policy2.NextPurge, expires)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// route is an endpoint of the API and the methods it serves. HEAD and
+// OPTIONS are implied.
+type route struct {
+	pattern *regexp.Regexp
+	methods []string
+}
+
+// routes are the endpoints of the service. ServeHTTP answers OPTIONS for
+// them and rejects the methods they don't serve with 405, so handlers only
+// see their own methods. The first match wins.
+var routes = []route{
+	{regexp.MustCompile(`^/orders$`), []string{http.MethodGet, http.MethodPost}},
+	{regexp.MustCompile(`^/orders/quote$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/orders/import$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/orders/imports/[^/]+$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+$`), []string{http.MethodGet, http.MethodPatch}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/history$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/timeline$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/comments$`), []string{http.MethodGet, http.MethodPost}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/tracking$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/requote$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/clone$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/orders/[[:alnum:]-]+/adjustments$`), []string{http.MethodGet, http.MethodPost}},
+	{regexp.MustCompile(`^/couriers/[^/]+/suggested-orders$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/couriers/[^/]+/route-suggestion$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/couriers/[^/]+/batch-take$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/changes$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/views$`), []string{http.MethodGet, http.MethodPost}},
+	{regexp.MustCompile(`^/views/[^/]+/orders$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/readyz$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/version$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/track/[^/]+$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/webhooks/payments$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/webhooks/email$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/webhooks/stores/[^/]+$`), []string{http.MethodPost}},
+	{regexp.MustCompile(`^/admin/maintenance$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/metrics$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/debug/http$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/bans$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/bans/.+$`), []string{http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/billing/export$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/shards$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/schema$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/keys/[^/]+/usage$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/keys$`), []string{http.MethodGet, http.MethodPost}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/keys/[^/]+$`), []string{http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/usage$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/retention$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/sla$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/sla/breaches$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/time-zone$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/alerts$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/areas$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/areas/[^/]+$`), []string{http.MethodPut, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/zones$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/zones/[^/]+$`), []string{http.MethodPut, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/pricing$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/courier-preferences$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/couriers$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/couriers/[^/]+$`), []string{http.MethodPut, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/promotions$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/promotions/[^/]+$`), []string{http.MethodPut, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/email-senders$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/email-senders/[^/]+$`), []string{http.MethodPut, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/feed$`), []string{http.MethodGet, http.MethodPut, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/feed/rows$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/stores$`), []string{http.MethodGet, http.MethodPost}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/stores/[^/]+$`), []string{http.MethodGet, http.MethodDelete}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/payments$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/notifications$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/templates$`), []string{http.MethodGet}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/policy$`), []string{http.MethodGet, http.MethodPut}},
+	{regexp.MustCompile(`^/admin/tenants/[^/]+/templates/[^/]+/[^/]+$`), []string{http.MethodPut, http.MethodDelete}},
+}
+
+// findRoute returns the route of path, nil if there is none.
+func findRoute(path string) *route {
+	for i := range routes {
+		if routes[i].pattern.MatchString(path) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// allows returns true if r serves method. HEAD is served as GET.
+func (r *route) allows(method string) bool {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	for _, m := range r.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allow returns the value of the Allow header of r.
+func (r *route) allow() string {
+	var methods []string
+	for _, method := range r.methods {
+		methods = append(methods, method)
+		if method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	return strings.Join(append(methods, http.MethodOptions), ", ")
+}
+
+// handleOptions answers OPTIONS requests with the methods of the route in
+// Allow. It needs no credentials, so CORS preflights and API gateways can
+// discover the API.
+func handleOptions(w http.ResponseWriter, req *http.Request) {
+	r := findRoute(req.URL.Path)
+	if r == nil {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+		return
+	}
+	w.Header().Set("Allow", r.allow())
+	w.WriteHeader(http.StatusNoContent)
+	fmt.Printf("Method:%s; Path:%s, %d allow %s\n", req.Method, req.URL.Path, http.StatusNoContent, r.allow())
+}
+
+// respondDisallowed answers a request for a method r does not serve with 405
+// and the methods it does in Allow.
+func respondDisallowed(w http.ResponseWriter, req *http.Request, r *route) {
+	w.Header().Set("Allow", r.allow())
+	respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "allow %s", r.allow())
+}
+
+// asGet returns a HEAD request as a GET request, so it gets the status and
+// headers of a GET. The http.Server drops the body of responses to HEAD
+// requests.
+func asGet(req *http.Request) *http.Request {
+	get := req.Clone(req.Context())
+	get.Method = http.MethodGet
+	return get
+}
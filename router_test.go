@@ -0,0 +1,106 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	svc := newTestService(t, Config{RequireAPIKeys: true})
+	for _, tc := range []struct {
+		path  string
+		code  int
+		allow string
+	}{
+		{"/orders", 204, "GET, HEAD, POST, OPTIONS"},
+		{"/orders/quote", 204, "POST, OPTIONS"},
+		{"/orders/1", 204, "GET, HEAD, PATCH, OPTIONS"},
+		{"/orders/01HV3K5ZQ0000000000000000Z/history", 204, "GET, HEAD, OPTIONS"},
+		{"/views/busy/orders", 204, "GET, HEAD, OPTIONS"},
+		{"/admin/bans/ip:10.0.0.7", 204, "DELETE, OPTIONS"},
+		{"/nowhere", 404, ""},
+	} {
+		// Preflights carry no credentials.
+		w := serve(svc, "OPTIONS", tc.path, "", "")
+		if w.Code != tc.code || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("OPTIONS %s: got %d %q, want %d %q", tc.path, w.Code, w.Header().Get("Allow"), tc.code, tc.allow)
+		}
+		if tc.code == 204 && w.Body.Len() != 0 {
+			t.Errorf("OPTIONS %s has a body %q", tc.path, w.Body)
+		}
+	}
+}
+
+func TestDisallowedMethods(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for _, tc := range []struct {
+		method, path string
+		code         int
+		allow        string
+	}{
+		{"DELETE", "/orders", 405, "GET, HEAD, POST, OPTIONS"},
+		{"PUT", "/orders/1", 405, "GET, HEAD, PATCH, OPTIONS"},
+		{"GET", "/orders/quote", 405, "POST, OPTIONS"},
+		{"HEAD", "/orders/1/requote", 405, "POST, OPTIONS"},
+		{"POST", "/orders/1/history", 405, "GET, HEAD, OPTIONS"},
+		{"DELETE", "/views", 405, "GET, HEAD, POST, OPTIONS"},
+		// Checked before credentials.
+		{"POST", "/admin/metrics", 405, "GET, HEAD, OPTIONS"},
+		{"GET", "/admin/tenants/acme/keys/k1", 405, "DELETE, OPTIONS"},
+		// Paths that don't exist are 404 whatever the method.
+		{"DELETE", "/orders/1/receipt", 404, ""},
+		{"PUT", "/nowhere", 404, ""},
+	} {
+		w := serve(svc, tc.method, tc.path, "", "")
+		if w.Code != tc.code || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s: got %d %q, want %d %q", tc.method, tc.path, w.Code, w.Header().Get("Allow"), tc.code,
+				tc.allow)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	server := httptest.NewServer(svc)
+	defer server.Close()
+	for _, tc := range []struct {
+		path string
+		code int
+	}{
+		{"/orders", 200},
+		{"/orders/1", 200},
+		{"/orders/1/history", 200},
+		{"/orders/2", 404},
+		{"/readyz", 200},
+	} {
+		resp, err := http.Head(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code || len(body) != 0 {
+			t.Errorf("HEAD %s: got %d %q, want %d without a body", tc.path, resp.StatusCode, body, tc.code)
+		}
+		get, err := http.Get(server.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		get.Body.Close()
+		if resp.Header.Get("Content-Type") != get.Header.Get("Content-Type") {
+			t.Errorf("HEAD %s: Content-Type %q, GET has %q", tc.path, resp.Header.Get("Content-Type"),
+				get.Header.Get("Content-Type"))
+		}
+		if tc.path == "/orders" && resp.Header.Get("Accept-Ranges") != rangeUnit {
+			t.Errorf("HEAD /orders lacks the headers of GET: %v", resp.Header)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles are the scripts of `make migrate`, described by GET
+// /admin/schema.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a script of migrations/. It is applied if the schema version
+// of the database is at least its version, as `make migrate` applies scripts
+// in order and each one sets the version.
+type Migration struct {
+	Version     int    `json:"version"`
+	Name        string `json:"name"`
+	Description string `json:"description"` // Its leading comment.
+	Applied     bool   `json:"applied"`
+}
+
+// TableSchema is the definition of a table and its indexes, as created.
+type TableSchema struct {
+	Name    string   `json:"name"`
+	SQL     string   `json:"sql"`
+	Indexes []string `json:"indexes"` // CREATE INDEX statements.
+}
+
+// DatabaseSchema is the body of GET /admin/schema.
+type DatabaseSchema struct {
+	Version         int           `json:"version"`          // PRAGMA user_version of the database.
+	ExpectedVersion int           `json:"expected_version"` // Of schema.sql in this binary.
+	Migrations      []Migration   `json:"migrations"`
+	Tables          []TableSchema `json:"tables"`
+}
+
+// migrations returns the embedded migrations by version, marked applied up
+// to version.
+func migrations(version int) ([]Migration, error) {
+	names, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list migrations: %s", err)
+	}
+	var list []Migration
+	for _, entry := range names {
+		name := entry.Name()
+		number, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s isn't numbered: %s", name, err)
+		}
+		script, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read migration %s: %s", name, err)
+		}
+		list = append(list, Migration{Version: number, Name: name, Description: migrationDescription(string(script)),
+			Applied: number <= version})
+	}
+	return list, nil
+}
+
+// migrationDescription returns the leading comment of a migration script,
+// without its "Schema version N:" prefix.
+func migrationDescription(script string) string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, "--")))
+	}
+	description := strings.Join(lines, " ")
+	if idx := strings.Index(description, ": "); strings.HasPrefix(description, "Schema version") && idx >= 0 {
+		description = description[idx+2:]
+	}
+	return description
+}
+
+// DescribeSchema returns the schema version, migrations and tables of db.
+func DescribeSchema(ctx context.Context, db *sql.DB) (*DatabaseSchema, error) {
+	var schema DatabaseSchema
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&schema.Version); err != nil {
+		return nil, fmt.Errorf("unable to read database schema version: %s", err)
+	}
+	expected, err := openExpectedSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer expected.Close()
+	if err := expected.QueryRowContext(ctx, "PRAGMA user_version").Scan(&schema.ExpectedVersion); err != nil {
+		return nil, fmt.Errorf("unable to read schema version: %s", err)
+	}
+	if schema.Migrations, err = migrations(schema.Version); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT type, name, tbl_name, sql FROM sqlite_master
+		WHERE type IN ('table', 'index') AND sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY type = 'index', tbl_name, name`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %s", err)
+	}
+	defer rows.Close()
+	schema.Tables = []TableSchema{}
+	tables := map[string]int{}
+	for rows.Next() {
+		var objectType, name, table, definition string
+		if err := rows.Scan(&objectType, &name, &table, &definition); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if objectType == "table" {
+			tables[name] = len(schema.Tables)
+			schema.Tables = append(schema.Tables, TableSchema{Name: name, SQL: definition, Indexes: []string{}})
+		} else if idx, ok := tables[table]; ok {
+			schema.Tables[idx].Indexes = append(schema.Tables[idx].Indexes, definition)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list tables: %s", err)
+	}
+	return &schema, nil
+}
+
+// handleSchema serves GET /admin/schema, what the database of this
+// deployment runs.
+func (s *OrderService) handleSchema(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	schema, err := DescribeSchema(req.Context(), s.DB)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DescribeSchema(): %s", err)
+		return
+	}
+	respond(w, req, 200, schema, "schema version %d, %d tables", schema.Version, len(schema.Tables))
+}
@@ -1,9 +1,418 @@
 -- sqlite3 database schema.
 
+-- Lets the maintenance return free pages with PRAGMA incremental_vacuum. Only
+-- takes effect in a new database, or with a VACUUM.
+PRAGMA auto_vacuum = INCREMENTAL;
+
 DROP TABLE IF EXISTS orders;
 
 CREATE TABLE IF NOT EXISTS orders (
     id INTEGER NOT NULL PRIMARY KEY,
+    -- Text id made by -id-strategy, NULL with sequential ids.
+    uid TEXT UNIQUE,
+    distance REAL,
+    status TEXT NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    origin_lat REAL,
+    origin_lng REAL,
+    destination_lat REAL,
+    destination_lng REAL,
+    -- Unix time in seconds.
+    created_at INTEGER,
+    -- Set when the order looks like a duplicate of an earlier order.
+    duplicate_of INTEGER,
+    -- Outbound order of a return leg, taken before it.
+    linked_order_id INTEGER,
+    -- Expected travel time in seconds.
+    duration INTEGER,
+    -- Price in minor units of currency.
+    price INTEGER,
+    currency TEXT,
+    -- Fields clients may change with a merge patch. metadata is a JSON object
+    -- of strings, tags a JSON array of strings, scheduled_at Unix seconds,
+    -- weight grams and volume liters.
+    notes TEXT,
+    metadata TEXT,
+    tags TEXT,
+    priority INTEGER,
+    scheduled_at INTEGER,
+    weight INTEGER,
+    volume INTEGER,
+    -- Unix time in seconds the order breached its tenant's SLA.
+    sla_breached_at INTEGER,
+    -- Multiplier of price at busy times, NULL for no surge.
+    surge REAL,
+    -- Promotion given at creation and the amount it took off price.
+    promo_code TEXT,
+    discount INTEGER,
+    -- Sum of the amounts of adjustments, NULL without any.
+    price_adjustments INTEGER,
+    -- PAID or UNPAID as told by the payment provider, NULL until it does.
+    payment_status TEXT
+);
+
+-- Orders moved out of orders by the archiver, with the columns of orders.
+-- Their events stay in events.
+CREATE TABLE IF NOT EXISTS orders_archive (
+    id INTEGER NOT NULL PRIMARY KEY,
+    uid TEXT UNIQUE,
     distance REAL,
-    status TEXT NOT NULL
+    status TEXT NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    origin_lat REAL,
+    origin_lng REAL,
+    destination_lat REAL,
+    destination_lng REAL,
+    created_at INTEGER,
+    duplicate_of INTEGER,
+    linked_order_id INTEGER,
+    duration INTEGER,
+    price INTEGER,
+    currency TEXT,
+    notes TEXT,
+    metadata TEXT,
+    tags TEXT,
+    priority INTEGER,
+    scheduled_at INTEGER,
+    sla_breached_at INTEGER,
+    surge REAL,
+    promo_code TEXT,
+    discount INTEGER,
+    price_adjustments INTEGER,
+    payment_status TEXT,
+    weight INTEGER,
+    volume INTEGER,
+    -- Unix time in seconds.
+    archived_at INTEGER NOT NULL
+);
+
+-- Indexes of the columns orders are filtered by. The startup check reports
+-- the ones missing.
+CREATE INDEX IF NOT EXISTS orders_status ON orders (status);
+CREATE INDEX IF NOT EXISTS orders_created_at ON orders (created_at);
+CREATE INDEX IF NOT EXISTS orders_tenant_id ON orders (tenant_id);
+CREATE INDEX IF NOT EXISTS orders_status_priority ON orders (status, priority);
+CREATE INDEX IF NOT EXISTS orders_linked_order_id ON orders (linked_order_id);
+
+-- Requests made per Google Maps API key per day. Keys are identified by a
+-- fingerprint, never by the key itself.
+CREATE TABLE IF NOT EXISTS maps_key_usage (
+    key_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (key_id, day)
+);
+
+-- Per-tenant overrides of the global configuration. NULL columns fall back to
+-- the global default.
+CREATE TABLE IF NOT EXISTS tenant_settings (
+    tenant_id TEXT NOT NULL PRIMARY KEY,
+    distance_provider TEXT,
+    maps_api_key TEXT,
+    -- Requests of the tenant must be signed with this HMAC key.
+    signing_secret TEXT,
+    -- Orders the tenant may create per day and month of its time zone, 0
+    -- is unlimited.
+    daily_order_quota INTEGER,
+    monthly_order_quota INTEGER,
+    -- Days orders of the tenant are kept, 0 is forever.
+    retention_days INTEGER,
+    -- Seconds orders of the tenant must be taken within, NULL is no SLA.
+    take_sla_seconds INTEGER,
+    -- 1 to text customers about their orders.
+    sms_notifications INTEGER,
+    -- JSON Policy denying actions on orders, NULL for none.
+    policy TEXT,
+    -- JSON PricingRules by zone, NULL to price by the tariff only.
+    pricing TEXT,
+    -- 1 to only let orders be taken once paid.
+    require_prepayment INTEGER,
+    -- IANA time zone of the tenant's business day, NULL for UTC.
+    time_zone TEXT
 );
+
+-- Tenants' own wording of notifications, a text/template of NotificationData
+-- per channel and event type.
+CREATE TABLE IF NOT EXISTS notification_templates (
+    tenant_id TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    template TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, channel, event_type)
+);
+
+-- Orders created per tenant per day of its time zone, for quotas and billing.
+CREATE TABLE IF NOT EXISTS order_usage (
+    tenant_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    orders INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (tenant_id, day)
+);
+
+-- API keys of tenants. Only the SHA-256 of the secret part is kept, scopes is a
+-- comma separated list of read, write and admin. Times are Unix seconds.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    last_used_at INTEGER,
+    revoked_at INTEGER
+);
+
+-- Requests per API key, UTC day and endpoint ("GET /orders/*"), kept 30 days.
+-- errors counts responses of 400 and above.
+CREATE TABLE IF NOT EXISTS api_key_usage (
+    key_id TEXT NOT NULL,
+    day TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    requests INTEGER NOT NULL DEFAULT 0,
+    errors INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (key_id, day, endpoint)
+);
+
+-- Anomalies detected in the order creation of tenants, kind is
+-- creation_spike or identical_orders.
+CREATE TABLE IF NOT EXISTS alerts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    detail TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS alerts_tenant_id ON alerts (tenant_id, id);
+
+-- Areas tenants serve, geometry is a GeoJSON Polygon or MultiPolygon. Orders of
+-- tenants with areas must start and end in one of them.
+CREATE TABLE IF NOT EXISTS service_areas (
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    geometry TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+
+-- Discount codes of tenants, see Promotion. One of percent and amount is set;
+-- max_uses NULL is unlimited, expires_at is Unix time in seconds, NULL never.
+CREATE TABLE IF NOT EXISTS promotions (
+    tenant_id TEXT NOT NULL,
+    code TEXT NOT NULL,
+    percent INTEGER,
+    amount INTEGER,
+    max_uses INTEGER,
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at INTEGER,
+    PRIMARY KEY (tenant_id, code)
+);
+
+-- Zones tenants price journeys between, see PricingRules. geometry is a GeoJSON
+-- Polygon or MultiPolygon.
+CREATE TABLE IF NOT EXISTS pricing_zones (
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    geometry TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+
+-- Named order filters saved by tenants, filter is the JSON OrderFilter.
+CREATE TABLE IF NOT EXISTS views (
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    filter TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, name)
+);
+
+-- Append-only log of order changes. The orders table is a projection of these
+-- events, data is a JSON object specific to the event type.
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    data TEXT,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_order_id ON events (order_id);
+CREATE INDEX IF NOT EXISTS events_created_at ON events (created_at);
+
+-- Orders gone from the orders table, for GET /orders?updated_since=.
+CREATE TABLE IF NOT EXISTS order_tombstones (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    tenant_id TEXT NOT NULL DEFAULT '',
+    -- archived or purged.
+    reason TEXT NOT NULL,
+    -- Unix time in seconds.
+    deleted_at INTEGER NOT NULL
+);
+
+-- Changes made to orders, details is a JSON object specific to the action.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    details TEXT,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+-- Internal comments of support staff on orders, never shown to tenants' API
+-- keys. author is an audit log actor.
+CREATE TABLE IF NOT EXISTS order_comments (
+    id INTEGER NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    author TEXT NOT NULL,
+    body TEXT NOT NULL,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_comments_order_id ON order_comments (order_id);
+
+-- Billable events of tenants, totalled per month by GET
+-- /admin/billing/export. amount is in minor units of currency.
+CREATE TABLE IF NOT EXISTS billing_events (
+    id INTEGER NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    order_id INTEGER,
+    amount INTEGER NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT '',
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS billing_events_created_at ON billing_events (created_at);
+
+-- Addresses whose inbound emails become orders of tenant_id, lower case.
+CREATE TABLE IF NOT EXISTS email_senders (
+    address TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL
+);
+
+-- Webhook events of the payment provider already applied, by their id, so
+-- redeliveries are ignored.
+CREATE TABLE IF NOT EXISTS payment_events (
+    id TEXT NOT NULL PRIMARY KEY,
+    order_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    -- Unix time in seconds.
+    received_at INTEGER NOT NULL
+);
+
+-- Imports of order files, report is the JSON ImportReport.
+CREATE TABLE IF NOT EXISTS imports (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    report TEXT NOT NULL,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+-- Feeds of tenants, CSV files polled for new orders. error is why the last
+-- poll failed.
+CREATE TABLE IF NOT EXISTS feeds (
+    tenant_id TEXT NOT NULL PRIMARY KEY,
+    url TEXT NOT NULL,
+    -- Unix time in seconds.
+    polled_at INTEGER,
+    error TEXT
+);
+
+-- Rows of feeds imported, with the order created or the error code of the
+-- rows that will not be.
+CREATE TABLE IF NOT EXISTS feed_rows (
+    tenant_id TEXT NOT NULL,
+    external_id TEXT NOT NULL,
+    order_id INTEGER,
+    error TEXT,
+    -- Unix time in seconds.
+    imported_at INTEGER NOT NULL,
+    PRIMARY KEY (tenant_id, external_id)
+);
+
+-- Online stores whose orders become orders of tenant_id, picked up at the
+-- origin. credentials are the JSON StoreCredentials sealed with the secrets
+-- key.
+CREATE TABLE IF NOT EXISTS stores (
+    id TEXT NOT NULL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    platform TEXT NOT NULL,
+    url TEXT NOT NULL,
+    origin_lat TEXT NOT NULL,
+    origin_lng TEXT NOT NULL,
+    credentials TEXT NOT NULL,
+    webhook_id TEXT NOT NULL,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+-- Orders delivered by stores, with the order created or the error code they
+-- were refused with, so redeliveries are not created twice.
+CREATE TABLE IF NOT EXISTS store_orders (
+    store_id TEXT NOT NULL,
+    external_id TEXT NOT NULL,
+    order_id INTEGER,
+    error TEXT,
+    -- Unix time in seconds.
+    received_at INTEGER NOT NULL,
+    PRIMARY KEY (store_id, external_id)
+);
+
+-- Progress of the warehouse exporter, the id of the last event loaded into
+-- each sink.
+CREATE TABLE IF NOT EXISTS warehouse_cursors (
+    sink TEXT NOT NULL PRIMARY KEY,
+    event_id INTEGER NOT NULL
+);
+
+-- Responses of requests made with an Idempotency-Key, by tenant and key.
+-- status is 0 while the first request is in progress, body is NULL and
+-- truncated 1 if the response was too large to keep.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT NOT NULL PRIMARY KEY,
+    fingerprint TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    content_type TEXT,
+    body BLOB,
+    truncated INTEGER NOT NULL DEFAULT 0,
+    -- Unix time in seconds.
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
+
+-- Signatures of recent signed requests, refused again until they expire.
+CREATE TABLE IF NOT EXISTS seen_signatures (
+    signature TEXT NOT NULL PRIMARY KEY,
+    -- Unix time in seconds.
+    expires_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS seen_signatures_expires_at ON seen_signatures (expires_at);
+
+-- Couriers preferred or blocked by tenants for the orders picked up in a
+-- pricing zone, or in any for zone "*".
+CREATE TABLE IF NOT EXISTS courier_preferences (
+    tenant_id TEXT NOT NULL,
+    courier_id TEXT NOT NULL,
+    zone TEXT NOT NULL,
+    -- "preferred" or "blocked".
+    preference TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, courier_id, zone)
+);
+
+-- Couriers of tenants and their vehicle, "bike", "car" or "van".
+CREATE TABLE IF NOT EXISTS couriers (
+    tenant_id TEXT NOT NULL,
+    courier_id TEXT NOT NULL,
+    vehicle TEXT NOT NULL,
+    PRIMARY KEY (tenant_id, courier_id)
+);
+
+-- Version of this schema, checked at startup. Bump it with every change to
+-- tables or columns; indexes are checked by name.
+PRAGMA user_version = 38;
@@ -0,0 +1,87 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminSchema(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	if w := serve(svc, "GET", "/admin/schema", "", ""); w.Code != 401 {
+		t.Errorf("expected 401 without token, got %d", w.Code)
+	}
+	if _, err := svc.DB.Exec("PRAGMA user_version = 37"); err != nil {
+		t.Fatal(err)
+	}
+	w := serveAdmin(svc, "GET", "/admin/schema", "")
+	var schema DatabaseSchema
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil || w.Code != 200 {
+		t.Fatalf("GET /admin/schema returned %d: %s", w.Code, w.Body)
+	}
+	if schema.Version != 37 || schema.ExpectedVersion != 38 {
+		t.Errorf("versions %d and %d", schema.Version, schema.ExpectedVersion)
+	}
+	last := schema.Migrations[len(schema.Migrations)-1]
+	if last.Version != 38 || last.Name != "038_seen_signatures.sql" || last.Applied ||
+		!strings.HasPrefix(last.Description, "the signatures of recent signed requests") || !schema.Migrations[0].Applied {
+		t.Errorf("migrations %+v", schema.Migrations)
+	}
+	var orders *TableSchema
+	for i, table := range schema.Tables {
+		if table.Name == "orders" {
+			orders = &schema.Tables[i]
+		}
+	}
+	if orders == nil || !strings.HasPrefix(orders.SQL, "CREATE TABLE orders") || len(orders.Indexes) == 0 ||
+		!strings.HasPrefix(orders.Indexes[0], "CREATE INDEX") {
+		t.Errorf("orders table %+v", orders)
+	}
+}
+
+// baselineSchema is the schema.sql of databases from before schema versions.
+const baselineSchema = `CREATE TABLE orders (
+    id INTEGER NOT NULL PRIMARY KEY,
+    distance REAL,
+    status TEXT NOT NULL
+);`
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	list, err := migrations(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range list {
+		script, err := migrationFiles.ReadFile(path.Join("migrations", migration.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(string(script)); err != nil {
+			t.Fatalf("migration %s failed: %s", migration.Name, err)
+		}
+	}
+
+	// The migrated database is what schema.sql creates.
+	if err := checkSchema(ctx, db); err != nil {
+		t.Error(err)
+	}
+	if missing, err := missingIndexes(ctx, db); err != nil || len(missing) != 0 {
+		t.Errorf("missing indexes %v, %v", missing, err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// secretsKeyEnv names the environment variable holding the key secrets
+// stored in the database are encrypted with, 32 bytes in base64. Features
+// storing secrets are disabled without it.
+const secretsKeyEnv = "ORDERSERVICE_SECRETS_KEY"
+
+// sealedPrefix prefixes sealed secrets, naming the scheme so it can change.
+const sealedPrefix = "v1:"
+
+// parseSecretsKey decodes the value of secretsKeyEnv, nil if empty.
+func parseSecretsKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes in base64", secretsKeyEnv)
+	}
+	return key, nil
+}
+
+// sealSecret encrypts plaintext with AES-256-GCM under key, returning
+// sealedPrefix and the base64 nonce and ciphertext.
+func sealSecret(key []byte, plaintext []byte) (string, error) {
+	aead, err := newSecretsAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("unable to make nonce: %s", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a secret sealed by sealSecret.
+func openSecret(key []byte, sealed string) ([]byte, error) {
+	aead, err := newSecretsAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return nil, fmt.Errorf("unknown secret format")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil || len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("malformed secret")
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt secret, wrong %s?", secretsKeyEnv)
+	}
+	return plaintext, nil
+}
+
+func newSecretsAEAD(key []byte) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, fmt.Errorf("no %s", secretsKeyEnv)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets key: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,42 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSealSecret(t *testing.T) {
+	key, err := parseSecretsKey(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealSecret(key, []byte("shpat_123"))
+	if err != nil || !strings.HasPrefix(sealed, sealedPrefix) || strings.Contains(sealed, "shpat_123") {
+		t.Fatalf("unexpected sealed secret %q, %v", sealed, err)
+	}
+	if again, _ := sealSecret(key, []byte("shpat_123")); again == sealed {
+		t.Error("expected a new nonce for every secret")
+	}
+	if plaintext, err := openSecret(key, sealed); err != nil || string(plaintext) != "shpat_123" {
+		t.Errorf("unexpected plaintext %q, %v", plaintext, err)
+	}
+	if _, err := openSecret(bytes.Repeat([]byte{8}, 32), sealed); err == nil {
+		t.Error("expected a wrong key to fail")
+	}
+	if _, err := openSecret(key, sealed[:len(sealed)-4]+"AAAA"); err == nil {
+		t.Error("expected a tampered secret to fail")
+	}
+	for _, encoded := range []string{"short", base64.StdEncoding.EncodeToString([]byte("16 bytes is AES1"))} {
+		if _, err := parseSecretsKey(encoded); err == nil {
+			t.Errorf("no error for key %q", encoded)
+		}
+	}
+	if key, err := parseSecretsKey(""); key != nil || err != nil {
+		t.Errorf("expected no key, got %v, %v", key, err)
+	}
+}
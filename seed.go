@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// SeedFile is the format of -seed-file, the known state of a demo or test
+// environment.
+type SeedFile struct {
+	Tenants []SeedTenant `json:"tenants"`
+	Orders  []SeedOrder  `json:"orders"`
+}
+
+// SeedTenant is a row of tenant_settings. Omitted fields are NULL, i.e. fall
+// back to the global configuration.
+type SeedTenant struct {
+	TenantID          string `json:"tenant_id"`
+	DistanceProvider  string `json:"distance_provider,omitempty"`
+	MapsAPIKey        string `json:"maps_api_key,omitempty"`
+	SigningSecret     string `json:"signing_secret,omitempty"`
+	DailyOrderQuota   *int64 `json:"daily_order_quota,omitempty"`
+	MonthlyOrderQuota *int64 `json:"monthly_order_quota,omitempty"`
+	RetentionDays     *int64 `json:"retention_days,omitempty"`
+}
+
+// SeedOrder is an order to create. Distances, durations and prices are taken
+// as given, the distance provider is not asked.
+type SeedOrder struct {
+	ID          int64      `json:"id,omitempty"` // Next free id if omitted.
+	UID         string     `json:"uid,omitempty"`
+	TenantID    string     `json:"tenant_id,omitempty"`
+	Origin      []string   `json:"origin"`
+	Destination []string   `json:"destination"`
+	Status      OrderState `json:"status,omitempty"` // UNASSIGNED if omitted.
+	Distance    int64      `json:"distance"`
+	Duration    int64      `json:"duration,omitempty"`
+	Price       int64      `json:"price,omitempty"`
+	Currency    string     `json:"currency,omitempty"`
+	CreatedAt   time.Time  `json:"created_at,omitempty"` // Now if omitted.
+}
+
+// readSeedFile parses a seed file, rejecting unknown fields so typos do not
+// go unnoticed.
+func readSeedFile(path string) (*SeedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open seed file: %s", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	var seed SeedFile
+	if err := decoder.Decode(&seed); err != nil {
+		return nil, fmt.Errorf("invalid seed file %s: %s", path, err)
+	}
+	return &seed, nil
+}
+
+// isEmpty returns true if db has no orders, events or tenant settings.
+func isEmpty(db *sql.DB) (bool, error) {
+	var rows int64
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM orders) + (SELECT COUNT(*) FROM events) +
+		(SELECT COUNT(*) FROM tenant_settings)`).Scan(&rows)
+	if err != nil {
+		return false, fmt.Errorf("unable to count rows: %s", err)
+	}
+	return rows == 0, nil
+}
+
+// Seed loads the seed file at path into db, unless db already has data.
+// Returns false if it was not empty. Orders are created through events, as
+// if they had been made with the API, in a single transaction. key is the
+// Config.FieldKey.
+func Seed(db *sql.DB, key []byte, path string) (bool, error) {
+	seed, err := readSeedFile(path)
+	if err != nil {
+		return false, err
+	}
+	empty, err := isEmpty(db)
+	if err != nil || !empty {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed at Begin: %s", err)
+	}
+	if err := seedTx(tx, key, seed); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("unable to commit seed data: %s", err)
+	}
+	fmt.Printf("Seed: loaded %d tenants and %d orders from %s\n", len(seed.Tenants), len(seed.Orders), path)
+	return true, nil
+}
+
+func seedTx(tx *sql.Tx, key []byte, seed *SeedFile) error {
+	nullString := func(s string) sql.NullString { return sql.NullString{String: s, Valid: s != ""} }
+	for _, tenant := range seed.Tenants {
+		if tenant.TenantID == "" {
+			return fmt.Errorf("seed tenant without tenant_id")
+		}
+		mapsKey, err := sealField(key, tenant.MapsAPIKey)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt maps_api_key of tenant %q: %s", tenant.TenantID, err)
+		}
+		signingSecret, err := sealField(key, tenant.SigningSecret)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt signing_secret of tenant %q: %s", tenant.TenantID, err)
+		}
+		_, err = tx.Exec(`INSERT INTO tenant_settings (tenant_id, distance_provider, maps_api_key, signing_secret,
+			daily_order_quota, monthly_order_quota, retention_days) VALUES (?, ?, ?, ?, ?, ?, ?)`, tenant.TenantID,
+			nullString(tenant.DistanceProvider), nullString(mapsKey), nullString(signingSecret),
+			tenant.DailyOrderQuota, tenant.MonthlyOrderQuota, tenant.RetentionDays)
+		if err != nil {
+			return fmt.Errorf("unable to seed tenant %q: %s", tenant.TenantID, err)
+		}
+	}
+
+	for i, order := range seed.Orders {
+		originLat, originLng, err := parseLatLng(order.Origin)
+		if err != nil {
+			return fmt.Errorf("seed order %d: origin: %s", i, err)
+		}
+		destinationLat, destinationLng, err := parseLatLng(order.Destination)
+		if err != nil {
+			return fmt.Errorf("seed order %d: destination: %s", i, err)
+		}
+		if order.Status != "" && order.Status != StateUnassigned && order.Status != StateTaken {
+			return fmt.Errorf("seed order %d: unknown status %q", i, order.Status)
+		}
+		created, err := newEvent(order.ID, EventCreated, orderCreated{
+			UID:            order.UID,
+			TenantID:       order.TenantID,
+			OriginLat:      originLat,
+			OriginLng:      originLng,
+			DestinationLat: destinationLat,
+			DestinationLng: destinationLng,
+			PricedRoute: PricedRoute{Distance: order.Distance, Duration: order.Duration, Price: order.Price,
+				Currency: order.Currency},
+		})
+		if err != nil {
+			return err
+		}
+		if !order.CreatedAt.IsZero() {
+			created.Time = order.CreatedAt
+		}
+		if err := record(tx, key, created); err != nil {
+			return fmt.Errorf("seed order %d: %s", i, err)
+		}
+		if order.Status == StateTaken {
+			taken, err := newEvent(created.OrderID, EventTaken, nil)
+			if err != nil {
+				return err
+			}
+			taken.Time = created.Time
+			if err := record(tx, key, taken); err != nil {
+				return fmt.Errorf("seed order %d: %s", i, err)
+			}
+		}
+	}
+	return nil
+}
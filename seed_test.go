@@ -0,0 +1,69 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSeed(t *testing.T) {
+	svc := newTestService(t, Config{})
+	seeded, err := Seed(svc.DB, svc.config.FieldKey, "fixtures.json")
+	if err != nil || !seeded {
+		t.Fatalf("Seed() = %t, %v", seeded, err)
+	}
+
+	orders, err := svc.List(OrderFilter{}, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Order{{Id: 1, Distance: 1178, State: StateUnassigned, Duration: 170},
+		{Id: 2, Distance: 1815, State: StateTaken, Duration: 261}}
+	if !reflect.DeepEqual(orders, want) {
+		t.Errorf("got orders %+v", orders)
+	}
+	settings, err := loadTenantSettings(svc.DB, svc.config.FieldKey, "demo")
+	if err != nil || settings.DistanceProvider != providerHaversine || settings.DailyOrderQuota.Int64 != 1000 ||
+		settings.MonthlyOrderQuota.Valid {
+		t.Errorf("got settings %+v, %v", settings, err)
+	}
+	history, err := svc.History(2)
+	if err != nil || len(history) != 2 || !history[1].Time.Equal(time.Date(2024, 1, 1, 9, 5, 0, 0, time.UTC)) {
+		t.Errorf("got history %+v, %v", history, err)
+	}
+	if problems, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(problems) != 0 {
+		t.Errorf("seeded orders do not match their events: %v %v", problems, err)
+	}
+
+	// A database with data is left alone.
+	if seeded, err := Seed(svc.DB, svc.config.FieldKey, "fixtures.json"); err != nil || seeded {
+		t.Errorf("second Seed() = %t, %v", seeded, err)
+	}
+}
+
+func TestSeedInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown field": `{"couriers": []}`,
+		"bad status":    `{"orders": [{"origin": ["1", "2"], "destination": ["3", "4"], "status": "LOST"}]}`,
+		"bad origin":    `{"orders": [{"origin": ["1"], "destination": ["3", "4"]}]}`,
+		"no tenant_id":  `{"tenants": [{"distance_provider": "haversine"}]}`,
+	}
+	for name, content := range tests {
+		svc := newTestService(t, Config{})
+		path := filepath.Join(t.TempDir(), "seed.json")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Seed(svc.DB, svc.config.FieldKey, path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if empty, _ := isEmpty(svc.DB); !empty {
+			t.Errorf("%s: failed seed left data behind", name)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ShardMap maps tenants to the databases holding their orders, tenant to
+// path or DSN. Tenants not in the map stay in the primary database, which
+// also keeps API keys, bans and key usage. Several tenants may share a
+// database.
+type ShardMap map[string]string
+
+// loadShardMap reads a ShardMap from a JSON file, e.g.
+// {"acme": "/data/acme.db", "globex": "/data/big.db"}.
+func loadShardMap(path string) (ShardMap, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read shard map: %s", err)
+	}
+	var shardMap ShardMap
+	if err := json.Unmarshal(data, &shardMap); err != nil {
+		return nil, fmt.Errorf("invalid shard map %s: %s", path, err)
+	}
+	for tenant, dsn := range shardMap {
+		if strings.TrimSpace(tenant) == "" || dsn == "" {
+			return nil, fmt.Errorf("invalid shard map %s: empty tenant or database", path)
+		}
+	}
+	return shardMap, nil
+}
+
+// shard is a database of a ShardMap with the OrderService serving its
+// tenants.
+type shard struct {
+	DSN     string
+	Tenants []string
+	svc     *OrderService
+}
+
+// shardSet routes tenants to their shards.
+type shardSet struct {
+	shards  []*shard          // By DSN.
+	tenants map[string]*shard // Shard of each tenant of the map.
+}
+
+// openShards opens the databases of shardMap with open, checks their schema
+// and serves each with an OrderService of config.
+func openShards(ctx context.Context, shardMap ShardMap, config Config, open func(dsn string) *sql.DB) (*shardSet,
+	error) {
+	set := &shardSet{tenants: map[string]*shard{}}
+	byDSN := map[string]*shard{}
+	for tenant, dsn := range shardMap {
+		if byDSN[dsn] == nil {
+			byDSN[dsn] = &shard{DSN: dsn}
+			set.shards = append(set.shards, byDSN[dsn])
+		}
+		byDSN[dsn].Tenants = append(byDSN[dsn].Tenants, tenant)
+		set.tenants[tenant] = byDSN[dsn]
+	}
+	sort.Slice(set.shards, func(i, j int) bool { return set.shards[i].DSN < set.shards[j].DSN })
+	for _, shard := range set.shards {
+		sort.Strings(shard.Tenants)
+		db := open(shard.DSN)
+		if err := checkSchema(ctx, db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("shard %s: %s", shard.DSN, err)
+		}
+		svc, err := NewOrderService(db, config, ctx)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("shard %s: %s", shard.DSN, err)
+		}
+		// Order ids are numbered per database.
+		svc.orderCache.prefix = "order:" + shard.DSN + ":"
+		shard.svc = svc
+	}
+	return set, nil
+}
+
+// Close closes the databases of the shards.
+func (set *shardSet) Close() {
+	for _, shard := range set.shards {
+		shard.svc.DB.Close()
+	}
+}
+
+// shardOf returns the OrderService of tenant's database, s itself for
+// tenants in the primary database.
+func (s *OrderService) shardOf(tenant string) *OrderService {
+	if s.shards == nil {
+		return s
+	}
+	if shard := s.shards.tenants[tenant]; shard != nil {
+		return shard.svc
+	}
+	return s
+}
+
+// allShards returns s and the OrderServices of its shards.
+func (s *OrderService) allShards() []*OrderService {
+	services := []*OrderService{s}
+	if s.shards != nil {
+		for _, shard := range s.shards.shards {
+			services = append(services, shard.svc)
+		}
+	}
+	return services
+}
+
+// shardTenant returns the tenant whose database serves req, "" for the
+// primary database: the tenant of /admin/tenants/{tenant}/, but for its
+// keys which authenticate requests before they are routed, none for the
+// other /admin/ endpoints, the tenant of the credentials otherwise.
+func shardTenant(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/admin/tenants/") {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/admin/tenants/"), "/")
+		if len(parts) < 2 || parts[1] == "keys" {
+			return ""
+		}
+		return parts[0]
+	}
+	if strings.HasPrefix(req.URL.Path, "/admin/") {
+		return ""
+	}
+	return tenantFromRequest(req)
+}
+
+// ShardStatus is an element of the body of GET /admin/shards.
+type ShardStatus struct {
+	// Path or DSN of the database, "" for the primary database.
+	Database string `json:"database"`
+	// Tenants of the shard map in the database, none for the primary
+	// database which has all the others.
+	Tenants []string `json:"tenants"`
+	Orders  int64    `json:"orders"`
+}
+
+// handleShards serves GET /admin/shards, the databases with their tenants
+// and number of orders, archived orders included.
+func (s *OrderService) handleShards(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	statuses := []ShardStatus{{Tenants: []string{}}}
+	if s.shards != nil {
+		for _, shard := range s.shards.shards {
+			statuses = append(statuses, ShardStatus{Database: shard.DSN, Tenants: shard.Tenants})
+		}
+	}
+	for i, svc := range s.allShards() {
+		err := svc.DB.QueryRowContext(req.Context(),
+			"SELECT (SELECT COUNT(*) FROM orders) + (SELECT COUNT(*) FROM orders_archive)").Scan(&statuses[i].Orders)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "shard %q: %s", statuses[i].Database,
+				err)
+			return
+		}
+	}
+	respond(w, req, 200, statuses, "%d shards", len(statuses))
+}
@@ -0,0 +1,129 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShards(t *testing.T) {
+	config := Config{AdminToken: "secret", DistanceProvider: providerHaversine,
+		Tariff: Tariff{BaseFare: 100, Currency: "EUR"}}
+	svc := newTestService(t, config)
+	dir := t.TempDir()
+	shardPath := filepath.Join(dir, "big.db")
+	shardDB, err := sql.Open("sqlite3", shardPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shardDB.Exec(schemaSQL); err != nil {
+		t.Fatal(err)
+	}
+	shardDB.Close()
+
+	shards, err := openShards(context.Background(), ShardMap{"acme": shardPath, "globex": shardPath}, config,
+		func(dsn string) *sql.DB {
+			db, _ := sql.Open("sqlite3", dsn)
+			return db
+		})
+	if err != nil {
+		t.Fatalf("openShards failed: %s", err)
+	}
+	defer shards.Close()
+	svc.shards = shards
+	if len(shards.shards) != 1 || !reflect.DeepEqual(shards.shards[0].Tenants, []string{"acme", "globex"}) {
+		t.Fatalf("got shards %+v", shards.shards)
+	}
+	shard := shards.shards[0].svc
+
+	for _, tenant := range []string{"acme", "acme", "initech"} {
+		if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders as %s returned %d: %s", tenant, w.Code, w.Body)
+		}
+	}
+	count := func(db *sql.DB) (n int) {
+		db.QueryRow("SELECT COUNT(*) FROM orders").Scan(&n)
+		return n
+	}
+	if n, m := count(shard.DB), count(svc.DB); n != 2 || m != 1 {
+		t.Errorf("got %d orders in the shard and %d in the primary database, want 2 and 1", n, m)
+	}
+	if w := serve(svc, "GET", "/orders/2", "acme", ""); w.Code != 200 {
+		t.Errorf("GET /orders/2 as acme returned %d", w.Code)
+	}
+	if w := serve(svc, "GET", "/orders/2", "initech", ""); w.Code != 404 {
+		t.Errorf("GET /orders/2 as initech returned %d, want 404", w.Code)
+	}
+
+	// Settings of a tenant go to its shard.
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/retention", `{"retention_days": 7}`); w.Code != 200 {
+		t.Fatalf("PUT retention returned %d: %s", w.Code, w.Body)
+	}
+	var days int
+	if err := shard.DB.QueryRow("SELECT retention_days FROM tenant_settings WHERE tenant_id = 'acme'").Scan(
+		&days); err != nil || days != 7 {
+		t.Errorf("got retention of %d days in the shard, %v", days, err)
+	}
+
+	// Cross-tenant listings fan out.
+	month := time.Now().UTC().Format("2006-01")
+	w := serveAdmin(svc, "GET", "/admin/billing/export?month="+month, "")
+	var export BillingExport
+	if err := json.NewDecoder(w.Body).Decode(&export); err != nil {
+		t.Fatalf("export returned %d: %s", w.Code, err)
+	}
+	want := []BillingLine{
+		{TenantID: "acme", Kind: billDistanceComputed, Quantity: 2},
+		{TenantID: "acme", Kind: billOrderCreated, Quantity: 2, Amount: 200, Currency: "EUR"},
+		{TenantID: "initech", Kind: billDistanceComputed, Quantity: 1},
+		{TenantID: "initech", Kind: billOrderCreated, Quantity: 1, Amount: 100, Currency: "EUR"},
+	}
+	if !reflect.DeepEqual(export.Lines, want) {
+		t.Errorf("got billing lines %+v", export.Lines)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/shards", "")
+	var statuses []ShardStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("GET /admin/shards returned %d: %s", w.Code, w.Body)
+	}
+	wantStatuses := []ShardStatus{
+		{Tenants: []string{}, Orders: 1},
+		{Database: shardPath, Tenants: []string{"acme", "globex"}, Orders: 2},
+	}
+	if !reflect.DeepEqual(statuses, wantStatuses) {
+		t.Errorf("got shards %+v", statuses)
+	}
+	if w := serve(svc, "GET", "/admin/shards", "acme", ""); w.Code != 401 {
+		t.Errorf("GET /admin/shards without admin token returned %d", w.Code)
+	}
+}
+
+func TestLoadShardMap(t *testing.T) {
+	dir := t.TempDir()
+	for body, valid := range map[string]bool{
+		`{"acme": "/data/acme.db"}`: true,
+		`{"acme": ""}`:              false,
+		`{"": "/data/acme.db"}`:     false,
+		`["acme"]`:                  false,
+	} {
+		path := filepath.Join(dir, "shards.json")
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadShardMap(path); (err == nil) != valid {
+			t.Errorf("loadShardMap(%s) returned %v", body, err)
+		}
+	}
+	if _, err := loadShardMap(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loadShardMap of a missing file succeeded")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of signed requests. The signature is the hex HMAC-SHA256, keyed
+// with the tenant's signing secret, of
+//
+//	TIMESTAMP "\n" METHOD "\n" REQUEST-URI "\n" CONTENT-SHA256
+//
+// where TIMESTAMP is Unix seconds and CONTENT-SHA256 the hex SHA-256 of the
+// body.
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	contentDigestHeader      = "X-Content-SHA256"
+)
+
+const (
+	// signatureWindow is how far the timestamp of a signed request may be
+	// from the server's clock. Signatures are remembered this long to
+	// refuse replays.
+	signatureWindow = 5 * time.Minute
+	// maxSignedBody bounds the bodies read to check their digest.
+	maxSignedBody = 1 << 20
+)
+
+// signRequest returns the signature of a request, see signatureHeader.
+func signRequest(secret string, timestamp int64, method, requestURI, contentSHA256 string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s", timestamp, method, requestURI, contentSHA256)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureStore remembers the signatures of recent requests, shared by the
+// replicas so that a request replayed to another one is refused too.
+type signatureStore interface {
+	// add records signature at now and returns false if it was seen
+	// before.
+	add(ctx context.Context, signature string, now time.Time) (bool, error)
+}
+
+// dbSignatureStore keeps the signatures in the seen_signatures table.
+type dbSignatureStore struct {
+	db *sql.DB
+}
+
+func (s *dbSignatureStore) add(ctx context.Context, signature string, now time.Time) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM seen_signatures WHERE expires_at < ?", now.Unix()); err != nil {
+		return false, fmt.Errorf("unable to forget expired signatures: %s", err)
+	}
+	result, err := s.db.ExecContext(ctx, `INSERT INTO seen_signatures (signature, expires_at) VALUES (?, ?)
+		ON CONFLICT (signature) DO NOTHING`, signature, now.Add(2*signatureWindow).Unix())
+	if err != nil {
+		return false, fmt.Errorf("unable to record signature: %s", err)
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// redisSignatureStore keeps the signatures in Redis under
+// "signature:{signature}", which Redis expires.
+type redisSignatureStore struct {
+	redis *redisClient
+}
+
+func (s *redisSignatureStore) add(ctx context.Context, signature string, now time.Time) (bool, error) {
+	reply, err := s.redis.do(ctx, "SET", "signature:"+signature, now.Unix(), "NX", "PX",
+		(2 * signatureWindow).Milliseconds())
+	if err != nil {
+		return false, fmt.Errorf("unable to record signature: %s", err)
+	}
+	return reply == "OK", nil
+}
+
+// verifySignature checks the signature of a request made with secret and
+// returns it. The body is read and put back for the
+// handlers. Replays are refused by checkSignature.
+func verifySignature(req *http.Request, secret string, now time.Time) (string, error) {
+	timestamp, err := strconv.ParseInt(req.Header.Get(signatureTimestampHeader), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("missing or invalid %s", signatureTimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > signatureWindow || skew < -signatureWindow {
+		return "", fmt.Errorf("%s is %s off", signatureTimestampHeader, skew)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+	if err != nil {
+		return "", fmt.Errorf("unable to read body: %s", err)
+	}
+	if len(body) > maxSignedBody {
+		return "", fmt.Errorf("body larger than %d bytes", maxSignedBody)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	digest := hex.EncodeToString(sum[:])
+	if !hmac.Equal([]byte(strings.ToLower(req.Header.Get(contentDigestHeader))), []byte(digest)) {
+		return "", fmt.Errorf("%s does not match the body", contentDigestHeader)
+	}
+
+	want := signRequest(secret, timestamp, req.Method, req.URL.RequestURI(), digest)
+	got := strings.ToLower(req.Header.Get(signatureHeader))
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		return "", fmt.Errorf("bad %s", signatureHeader)
+	}
+	return got, nil
+}
+
+// checkSignature refuses unsigned or badly signed requests of tenants with a
+// signing secret. Staff are not bound by the secrets of tenants: their signed
+// requests are checked against the bearer token they authenticate with.
+// Returns false after responding with an error.
+func (s *OrderService) checkSignature(w http.ResponseWriter, req *http.Request) bool {
+	if strings.HasPrefix(req.URL.Path, "/admin/") {
+		return true
+	}
+	var secret, signer string
+	if scope := s.orderScope(req); scope == nil {
+		if req.Header.Get(signatureHeader) == "" {
+			return true
+		}
+		secret, signer = bearerToken(req), "staff"
+	} else {
+		settings, err := loadTenantSettings(s.DB, s.config.FieldKey, *scope)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+			return false
+		}
+		secret, signer = settings.SigningSecret, fmt.Sprintf("tenant %q", *scope)
+	}
+	if secret == "" {
+		return true
+	}
+	now := time.Now()
+	signature, err := verifySignature(req, secret, now)
+	if err == nil {
+		var fresh bool
+		if fresh, err = s.signatures.add(req.Context(), signature, now); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "signatures.add(): %s", err)
+			return false
+		}
+		if !fresh {
+			err = fmt.Errorf("replayed request")
+		}
+	}
+	if err != nil {
+		respond(w, req, 401, HTTPResponseError{Error: "INVALID_SIGNATURE", Detail: err.Error()},
+			"%s: %s", signer, err)
+		return false
+	}
+	return true
+}
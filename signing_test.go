@@ -0,0 +1,107 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request of tenant signed with secret at time at.
+func signedRequest(secret, tenant, method, path, body string, at time.Time) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(tenantHeader, tenant)
+	sum := sha256.Sum256([]byte(body))
+	digest := hex.EncodeToString(sum[:])
+	req.Header.Set(contentDigestHeader, digest)
+	req.Header.Set(signatureTimestampHeader, strconv.FormatInt(at.Unix(), 10))
+	req.Header.Set(signatureHeader, signRequest(secret, at.Unix(), method, req.URL.RequestURI(), digest))
+	return req
+}
+
+func TestRequestSigning(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	_, err := svc.DB.Exec("INSERT INTO tenant_settings (tenant_id, signing_secret) VALUES ('bank', 's3cret')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		return w.Code
+	}
+	now := time.Now()
+
+	req := signedRequest("s3cret", "bank", "POST", "/orders", createOrderDetails, now)
+	if code := do(req); code != 200 {
+		t.Fatalf("signed POST returned %d", code)
+	}
+	replay := signedRequest("s3cret", "bank", "POST", "/orders", createOrderDetails, now)
+	if code := do(replay); code != 401 {
+		t.Errorf("replayed POST returned %d", code)
+	}
+
+	tampered := signedRequest("s3cret", "bank", "POST", "/orders", createOrderDetails, now.Add(time.Second))
+	tampered.Body = http.NoBody
+	if code := do(tampered); code != 401 {
+		t.Errorf("POST with a changed body returned %d", code)
+	}
+	tests := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"signed GET", signedRequest("s3cret", "bank", "GET", "/orders?limit=1", "", now), 200},
+		{"wrong secret", signedRequest("guess", "bank", "GET", "/orders", "", now), 401},
+		{"stale", signedRequest("s3cret", "bank", "GET", "/orders", "", now.Add(-time.Hour)), 401},
+		{"unsigned", httptest.NewRequest("GET", "/orders", nil), 200},
+	}
+	tests[3].req.Header.Set(tenantHeader, "bank")
+	tests[3].code = 401
+	for _, test := range tests {
+		if code := do(test.req); code != test.code {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.code)
+		}
+	}
+
+	// Other tenants need not sign.
+	if w := serve(svc, "GET", "/orders", "acme", ""); w.Code != 200 {
+		t.Errorf("unsigned GET of another tenant returned %d", w.Code)
+	}
+
+	// Staff need not know the secrets of tenants, and sign with their own
+	// token if at all.
+	if w := serveAdmin(svc, "GET", "/orders/1/history", ""); w.Code != 200 {
+		t.Errorf("unsigned staff GET of the tenant's order returned %d", w.Code)
+	}
+	for _, test := range []struct {
+		secret, tenant string
+		code           int
+	}{{"secret", "", 200}, {"secret", "bank", 200}, {"s3cret", "bank", 401}} {
+		// A second apart, so as not to replay each other.
+		now = now.Add(time.Second)
+		staff := signedRequest(test.secret, test.tenant, "GET", "/orders/1/history", "", now)
+		staff.Header.Set("Authorization", "Bearer secret")
+		if code := do(staff); code != test.code {
+			t.Errorf("staff GET of tenant %q signed with %q returned %d, want %d", test.tenant, test.secret, code, test.code)
+		}
+	}
+
+	// Replicas sharing the database refuse the signatures seen by this one.
+	other := &dbSignatureStore{db: svc.DB}
+	if fresh, err := other.add(context.Background(), strings.ToLower(req.Header.Get(signatureHeader)), now); fresh ||
+		err != nil {
+		t.Errorf("signature of the first POST is new to another replica: %v", err)
+	}
+	if fresh, err := other.add(context.Background(), "new", now); !fresh || err != nil {
+		t.Errorf("new signature refused: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// slaBreaches counts the orders that breached their tenant's SLA, per
+// tenant.
+var slaBreaches = expvar.NewMap("sla_breaches")
+
+// slaTake is the only SLA: orders must be taken within the tenant's
+// take_sla_seconds of being created. The service does not know when orders
+// are delivered.
+const slaTake = "take"
+
+// slaBreach is the data of an EventSLABreached.
+type slaBreach struct {
+	SLA      string    `json:"sla"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// slaMonitor periodically flags the UNASSIGNED orders that are past their
+// tenant's SLA with an EventSLABreached, logs them and counts them in
+// slaBreaches. Each order is flagged once.
+type slaMonitor struct {
+	interval time.Duration
+	db       *sql.DB
+	fieldKey []byte // Config.FieldKey.
+	now      func() time.Time
+}
+
+func newSLAMonitor(interval time.Duration, db *sql.DB, fieldKey []byte) *slaMonitor {
+	return &slaMonitor{interval: interval, db: db, fieldKey: fieldKey, now: time.Now}
+}
+
+// run checks every interval until ctx is done.
+func (m *slaMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.check(ctx); err != nil {
+				fmt.Printf("SLA monitor: %s\n", err)
+			}
+		}
+	}
+}
+
+// check flags every order past its SLA in one transaction. Returns the
+// number of orders flagged.
+func (m *slaMonitor) check(ctx context.Context) (int, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed at BeginTx: %s", err)
+	}
+	defer tx.Rollback()
+
+	now := m.now()
+	rows, err := tx.Query(`SELECT o.id, o.tenant_id, o.created_at + s.take_sla_seconds FROM orders o
+		JOIN tenant_settings s ON s.tenant_id = o.tenant_id
+		WHERE o.status = ? AND o.sla_breached_at IS NULL AND s.take_sla_seconds > 0
+			AND o.created_at + s.take_sla_seconds < ?`, string(StateUnassigned), now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("unable to query orders past their SLA: %s", err)
+	}
+	type breached struct {
+		orderID  int64
+		tenant   string
+		deadline int64
+	}
+	var orders []breached
+	for rows.Next() {
+		var b breached
+		if err := rows.Scan(&b.orderID, &b.tenant, &b.deadline); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		orders = append(orders, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("unable to query orders past their SLA: %s", err)
+	}
+
+	for _, b := range orders {
+		event, err := newEvent(b.orderID, EventSLABreached, slaBreach{SLA: slaTake,
+			Deadline: time.Unix(b.deadline, 0).UTC()})
+		if err == nil {
+			event.Time = now
+			err = record(tx, m.fieldKey, event)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unable to flag order %d: %s", b.orderID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("unable to commit SLA breaches: %s", err)
+	}
+	for _, b := range orders {
+		slaBreaches.Add(b.tenant, 1)
+		fmt.Printf("SLA monitor: order %d of tenant %q not taken by %s\n", b.orderID, b.tenant,
+			time.Unix(b.deadline, 0).UTC().Format(time.RFC3339))
+	}
+	return len(orders), nil
+}
+
+// SLAPolicy is the body of GET and PUT /admin/tenants/{tenant}/sla.
+type SLAPolicy struct {
+	// Seconds orders must be taken within, null for no SLA.
+	TakeWithinSeconds *int64 `json:"take_within_seconds"`
+}
+
+// SLABreachedOrder is an order in an SLABreachReport.
+type SLABreachedOrder struct {
+	OrderID    int64      `json:"order_id"`
+	Status     OrderState `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	BreachedAt time.Time  `json:"breached_at"`
+}
+
+// SLABreachReport is the body of GET /admin/tenants/{tenant}/sla/breaches.
+type SLABreachReport struct {
+	TenantID string             `json:"tenant_id"`
+	From     time.Time          `json:"from"`
+	To       time.Time          `json:"to"`
+	Orders   []SLABreachedOrder `json:"orders"`
+}
+
+// SetSLA sets the SLA of tenant, a nil takeWithin removes it.
+func (s *OrderService) SetSLA(tenant string, takeWithin *int64) error {
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, take_sla_seconds) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET take_sla_seconds = excluded.take_sla_seconds`, tenant, takeWithin)
+	if err != nil {
+		return fmt.Errorf("unable to set SLA of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// SLABreaches returns the orders of tenant, archived or not, that breached
+// its SLA between from and to, oldest breach first. Times are in the tenant's
+// time zone.
+func (s *OrderService) SLABreaches(tenant string, from, to time.Time) (*SLABreachReport, error) {
+	loc, err := tenantLocation(s.DB, tenant)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.DB.Query(`SELECT id, status, created_at, sla_breached_at FROM orders
+		WHERE tenant_id = ? AND sla_breached_at >= ? AND sla_breached_at <= ?
+		UNION ALL SELECT id, status, created_at, sla_breached_at FROM orders_archive
+		WHERE tenant_id = ? AND sla_breached_at >= ? AND sla_breached_at <= ?
+		ORDER BY sla_breached_at, id`, tenant, from.Unix(), to.Unix(), tenant, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("unable to query SLA breaches of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	report := &SLABreachReport{TenantID: tenant, From: from.In(loc), To: to.In(loc), Orders: []SLABreachedOrder{}}
+	for rows.Next() {
+		var (
+			order                 SLABreachedOrder
+			createdAt, breachedAt int64
+		)
+		if err := rows.Scan(&order.OrderID, &order.Status, &createdAt, &breachedAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		order.CreatedAt = time.Unix(createdAt, 0).In(loc)
+		order.BreachedAt = time.Unix(breachedAt, 0).In(loc)
+		report.Orders = append(report.Orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query SLA breaches of tenant %q: %s", tenant, err)
+	}
+	return report, nil
+}
+
+// handleTenantSLA serves /admin/tenants/{tenant}/sla.
+//
+//	GET /admin/tenants/{tenant}/sla  returns the SLAPolicy.
+//	PUT /admin/tenants/{tenant}/sla  sets it, {"take_within_seconds": 600}, or
+//	                                 {"take_within_seconds": null} for none.
+func (s *OrderService) handleTenantSLA(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var policy SLAPolicy
+		if err := json.Unmarshal(buf.Bytes(), &policy); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if policy.TakeWithinSeconds != nil && *policy.TakeWithinSeconds <= 0 {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: "take_within_seconds must be positive"}, "take_within_seconds %d", *policy.TakeWithinSeconds)
+			return
+		}
+		if err := s.SetSLA(tenant, policy.TakeWithinSeconds); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetSLA(): %s", err)
+			return
+		}
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	var policy SLAPolicy
+	if settings.TakeSLASeconds.Valid {
+		policy.TakeWithinSeconds = &settings.TakeSLASeconds.Int64
+	}
+	respond(w, req, 200, policy, "tenant %q SLA %v", tenant, settings.TakeSLASeconds)
+}
+
+// handleTenantSLABreaches serves GET /admin/tenants/{tenant}/sla/breaches,
+// the orders that breached the SLA between from, by default a week ago, and
+// to, by default now. Both are RFC 3339 times or YYYY-MM-DD business days of
+// the tenant, from their start and to their end.
+func (s *OrderService) handleTenantSLABreaches(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	loc, err := tenantLocation(s.DB, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "tenantLocation(): %s", err)
+		return
+	}
+	to, from := time.Now(), time.Time{}
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := req.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			*t = parsed
+		} else if day, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+			start, end := businessDay(day, loc)
+			*t = start
+			if name == "to" {
+				*t = end.Add(-time.Second)
+			}
+		} else {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+				Detail: name + " must be an RFC 3339 time or YYYY-MM-DD"}, "%s=%q", name, value)
+			return
+		}
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -7)
+	}
+	report, err := s.SLABreaches(tenant, from, to)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SLABreaches(): %s", err)
+		return
+	}
+	respond(w, req, 200, report, "tenant %q %d SLA breaches", tenant, len(report.Orders))
+}
@@ -0,0 +1,72 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLA(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	for _, tenant := range []string{"acme", "acme", "acme", "globex"} {
+		if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/sla", `{"take_within_seconds": 0}`); w.Code != 400 {
+		t.Errorf("zero SLA returned %d", w.Code)
+	}
+	w := serveAdmin(svc, "PUT", "/admin/tenants/acme/sla", `{"take_within_seconds": 600}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"take_within_seconds":600`) {
+		t.Fatalf("PUT SLA returned %d: %s", w.Code, w.Body)
+	}
+
+	// Orders 1 and 2 are 20 minutes old, 2 was taken in time. globex has no
+	// SLA.
+	old := time.Now().Add(-20 * time.Minute).Unix()
+	_, err := svc.DB.Exec(`UPDATE orders SET created_at = ? WHERE id IN (1, 2, 4);
+		UPDATE events SET created_at = ? WHERE order_id IN (1, 2, 4)`, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Take(2); err != nil {
+		t.Fatal(err)
+	}
+	monitor := newSLAMonitor(time.Minute, svc.DB, svc.config.FieldKey)
+	for _, want := range []int{1, 0} {
+		if n, err := monitor.check(context.Background()); err != nil || n != want {
+			t.Errorf("flagged %d orders, want %d: %v", n, want, err)
+		}
+	}
+	for id, breached := range map[int64]bool{1: true, 2: false, 3: false, 4: false} {
+		if order, err := svc.Get(id); err != nil || order.SLABreached != breached {
+			t.Errorf("order %d: %+v %v, want sla_breached %t", id, order, err, breached)
+		}
+	}
+	if diffs, err := Verify(svc.DB, svc.config.FieldKey); err != nil || len(diffs) != 0 {
+		t.Errorf("orders differ from their events: %v %v", diffs, err)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/sla/breaches", "")
+	var report SLABreachReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orders) != 1 || report.Orders[0].OrderID != 1 || report.Orders[0].Status != StateUnassigned {
+		t.Errorf("report %s", w.Body)
+	}
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/sla/breaches?to="+
+		url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)), "")
+	if report = (SLABreachReport{}); json.Unmarshal(w.Body.Bytes(), &report) != nil || len(report.Orders) != 0 {
+		t.Errorf("report before the breach %d %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/sla/breaches?from=yesterday", ""); w.Code != 400 {
+		t.Errorf("invalid from returned %d", w.Code)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Statistics per SQL statement, served with the other expvar variables by
+// GET /admin/metrics. A full scan that used to be quick shows up as a
+// statement whose time grows faster than its calls.
+var (
+	sqlCalls = expvar.NewMap("sql_calls")
+	sqlSlow  = expvar.NewMap("sql_slow_calls")
+	sqlTime  = expvar.NewMap("sql_time_us") // Microseconds, including reading the rows.
+)
+
+// openDB opens the sqlite3 database at path, counting every statement in the
+// sql_ metrics. Statements taking slowQuery or longer are logged, without
+// their arguments; 0 disables the log.
+func openDB(path string, slowQuery time.Duration) *sql.DB {
+	return sql.OpenDB(&loggedConnector{dsn: path, driver: &loggedDriver{slow: slowQuery}})
+}
+
+// normalizeQuery collapses the whitespace of a statement, making it a metric
+// key and a log line.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// observeQuery records a statement that took elapsed.
+func observeQuery(query string, args int, elapsed, slow time.Duration) {
+	statement := normalizeQuery(query)
+	sqlCalls.Add(statement, 1)
+	sqlTime.Add(statement, int64(elapsed/time.Microsecond))
+	if slow > 0 && elapsed >= slow {
+		sqlSlow.Add(statement, 1)
+		fmt.Printf("Slow query, %s: %s [%d arguments redacted]\n", elapsed.Round(time.Microsecond), statement, args)
+	}
+}
+
+// loggedDriver is the sqlite3 driver, timing every statement.
+type loggedDriver struct {
+	slow time.Duration
+}
+
+func (d *loggedDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &loggedConn{Conn: conn, slow: d.slow}, nil
+}
+
+// loggedConnector opens connections of a loggedDriver.
+type loggedConnector struct {
+	dsn    string
+	driver *loggedDriver
+}
+
+// Connect opens a connection, retrying while the database is busy: sqlite3
+// sets the journal mode of every new connection.
+func (c *loggedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var conn driver.Conn
+	err := retryBusy(ctx, func() (err error) {
+		conn, err = c.driver.Open(c.dsn)
+		return err
+	})
+	return conn, err
+}
+
+func (c *loggedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// loggedConn is a sqlite3 connection. It implements the context interfaces
+// of database/sql/driver the way sqlite3 does, so database/sql uses the same
+// code paths with or without it.
+//
+// Statements outside of transactions that fail because another connection
+// holds the database are retried, see retryBusy. Within a transaction a busy
+// statement fails at once, since the lock it waits for may be held by a
+// transaction waiting for this one.
+type loggedConn struct {
+	driver.Conn
+	slow    time.Duration
+	inTx    bool
+	attempt *txAttempt // Of the transaction, if begun by withTx.
+}
+
+// retryBusy calls fn as retryBusy does, outside of transactions.
+func (c *loggedConn) retryBusy(ctx context.Context, fn func() error) error {
+	if c.inTx {
+		return c.observeBusy(fn())
+	}
+	return retryBusy(ctx, fn)
+}
+
+// observeBusy records a busy error of the transaction in its txAttempt.
+func (c *loggedConn) observeBusy(err error) error {
+	if c.attempt != nil && isBusy(err) {
+		c.attempt.busy = true
+	}
+	return err
+}
+
+func (c *loggedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *loggedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	err := c.retryBusy(ctx, func() (err error) {
+		stmt, err = c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loggedStmt{Stmt: stmt, conn: c, query: query, slow: c.slow}, nil
+}
+
+func (c *loggedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	err := c.retryBusy(ctx, func() (err error) {
+		tx, err = c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	c.attempt, _ = ctx.Value(txAttemptKey{}).(*txAttempt)
+	return &loggedTx{Tx: tx, conn: c}, nil
+}
+
+func (c *loggedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *loggedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var result driver.Result
+	exec := func() (err error) {
+		start := time.Now()
+		result, err = c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+		observeQuery(query, len(args), time.Since(start), c.slow)
+		return err
+	}
+	if !singleStatement(query) {
+		return result, exec()
+	}
+	err := c.retryBusy(ctx, exec)
+	return result, err
+}
+
+func (c *loggedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	start := time.Now()
+	err := c.retryBusy(ctx, func() (err error) {
+		start = time.Now()
+		rows, err = c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+		if err != nil {
+			observeQuery(query, len(args), time.Since(start), c.slow)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loggedRows{Rows: rows, query: query, args: len(args), start: start, slow: c.slow}, nil
+}
+
+// loggedTx is a transaction of a loggedConn. sqlite3 rolls back a
+// transaction whose COMMIT was busy, so the commit isn't retried; withTx runs
+// the whole transaction again.
+type loggedTx struct {
+	driver.Tx
+	conn *loggedConn
+}
+
+func (t *loggedTx) Commit() error {
+	err := t.conn.observeBusy(t.Tx.Commit())
+	t.conn.inTx, t.conn.attempt = false, nil
+	return err
+}
+
+func (t *loggedTx) Rollback() error {
+	t.conn.inTx, t.conn.attempt = false, nil
+	return t.Tx.Rollback()
+}
+
+// loggedStmt is a prepared statement of a loggedConn.
+type loggedStmt struct {
+	driver.Stmt
+	conn  *loggedConn
+	query string
+	slow  time.Duration
+}
+
+func (s *loggedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *loggedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *loggedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var result driver.Result
+	err := s.conn.retryBusy(ctx, func() (err error) {
+		start := time.Now()
+		result, err = s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+		observeQuery(s.query, len(args), time.Since(start), s.slow)
+		return err
+	})
+	return result, err
+}
+
+func (s *loggedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	start := time.Now()
+	err := s.conn.retryBusy(ctx, func() (err error) {
+		start = time.Now()
+		rows, err = s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+		if err != nil {
+			observeQuery(s.query, len(args), time.Since(start), s.slow)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loggedRows{Rows: rows, query: s.query, args: len(args), start: start, slow: s.slow}, nil
+}
+
+// namedValues converts the arguments of the pre-context driver interfaces.
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// loggedRows times a query until its rows are closed, as sqlite3 does most of
+// the work of a query while the rows are read.
+type loggedRows struct {
+	driver.Rows
+	query string
+	args  int
+	start time.Time
+	slow  time.Duration
+}
+
+func (r *loggedRows) Close() error {
+	err := r.Rows.Close()
+	observeQuery(r.query, r.args, time.Since(r.start), r.slow)
+	return err
+}
@@ -0,0 +1,78 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metric returns the value of a statement in one of the sql_ maps.
+func metric(m *expvar.Map, statement string) int64 {
+	if v, ok := m.Get(statement).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestLoggedDriver(t *testing.T) {
+	db := openDB(filepath.Join(t.TempDir(), "orders.db"), time.Nanosecond)
+	defer db.Close()
+	if _, err := db.Exec(schemaSQL); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewOrderService(db, Config{DistanceProvider: providerHaversine}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every slow statement is logged, without its arguments.
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	const count = "SELECT COUNT(*) FROM orders WHERE tenant_id = ?"
+	callsBefore, slowBefore := metric(sqlCalls, count), metric(sqlSlow, count)
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*)
+		FROM orders WHERE tenant_id = ?`, "secret-tenant").Scan(&n)
+	os.Stdout = stdout
+	w.Close()
+	logged, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logged), "Slow query") || !strings.Contains(string(logged), count) ||
+		strings.Contains(string(logged), "secret-tenant") {
+		t.Errorf("unexpected log %q", logged)
+	}
+	if metric(sqlCalls, count) != callsBefore+1 || metric(sqlSlow, count) != slowBefore+1 {
+		t.Errorf("%s not counted", count)
+	}
+
+	// Transactions and prepared statements work as with the plain driver.
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "", ""); w.Code != 200 {
+		t.Fatalf("PATCH /orders/1 returned %d: %s", w.Code, w.Body)
+	}
+	stmt, err := db.Prepare("SELECT status FROM orders WHERE id = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var status string
+	if err := stmt.QueryRow(1).Scan(&status); err != nil || status != StateTaken {
+		t.Errorf("got %q, %v", status, err)
+	}
+	if metric(sqlCalls, "SELECT status FROM orders WHERE id = ?") == 0 {
+		t.Error("prepared statement not counted")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqlQuery builds a SELECT from clauses added one at a time, each with the
+// arguments of its placeholders, so that optional filters can't get their
+// arguments out of order. Clauses are SQL written by us, never input.
+type sqlQuery struct {
+	columns, from string
+	conditions    []string // Joined by AND.
+	orderBy       string
+	limit, offset *int
+	args          []interface{}
+	err           error
+}
+
+// selectFrom starts a SELECT of columns from table, which may include joins.
+func selectFrom(columns, table string) *sqlQuery {
+	return &sqlQuery{columns: columns, from: table}
+}
+
+// where adds a condition with an argument for each of its placeholders.
+func (q *sqlQuery) where(condition string, args ...interface{}) *sqlQuery {
+	if n := placeholders(condition); n != len(args) && q.err == nil {
+		q.err = fmt.Errorf("condition %q has %d placeholders for %d arguments", condition, n, len(args))
+	}
+	q.conditions = append(q.conditions, condition)
+	q.args = append(q.args, args...)
+	return q
+}
+
+// order sets the ORDER BY clause.
+func (q *sqlQuery) order(orderBy string) *sqlQuery {
+	q.orderBy = orderBy
+	return q
+}
+
+// page limits the rows to limit, after skipping offset.
+func (q *sqlQuery) page(limit, offset int) *sqlQuery {
+	q.limit, q.offset = &limit, &offset
+	return q
+}
+
+// build returns the statement and its arguments, or the first error of a
+// clause.
+func (q *sqlQuery) build() (string, []interface{}, error) {
+	if q.err != nil {
+		return "", nil, q.err
+	}
+	var statement strings.Builder
+	fmt.Fprintf(&statement, "SELECT %s FROM %s", q.columns, q.from)
+	if len(q.conditions) > 0 {
+		statement.WriteString(" WHERE " + strings.Join(q.conditions, " AND "))
+	}
+	if q.orderBy != "" {
+		statement.WriteString(" ORDER BY " + q.orderBy)
+	}
+	args := q.args
+	if q.limit != nil {
+		statement.WriteString(" LIMIT ? OFFSET ?")
+		args = append(args[:len(args):len(args)], *q.limit, *q.offset)
+	}
+	return statement.String(), args, nil
+}
+
+// placeholders counts the ? placeholders of a clause, outside of string
+// literals and quoted identifiers.
+func placeholders(clause string) int {
+	var (
+		n     int
+		quote rune
+	)
+	for _, r := range clause {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,32 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLQuery(t *testing.T) {
+	query, args, err := OrderFilter{Status: StateTaken, MaxDistance: 5000}.apply(selectFrom("id", "orders")).
+		order("id").page(10, 20).build()
+	if expect := "SELECT id FROM orders WHERE status = ? AND distance <= ? ORDER BY id LIMIT ? OFFSET ?"; err != nil ||
+		query != expect {
+		t.Errorf("built %q, %v, expected %q", query, err, expect)
+	}
+	if expect := []interface{}{"TAKEN", 5000.0, 10, 20}; !reflect.DeepEqual(args, expect) {
+		t.Errorf("arguments %v, expected %v", args, expect)
+	}
+	if query, args, err := selectFrom("COUNT(*)", "orders").build(); err != nil ||
+		query != "SELECT COUNT(*) FROM orders" || len(args) != 0 {
+		t.Errorf("built %q %v, %v", query, args, err)
+	}
+
+	if _, _, err := selectFrom("id", "orders").where("status = ? AND tenant_id = ?", "TAKEN").build(); err == nil {
+		t.Error("missing argument not detected")
+	}
+	if _, _, err := selectFrom("id", "orders").where("notes = '?' AND id = ?", 1).build(); err != nil {
+		t.Errorf("quoted ? counted: %s", err)
+	}
+}
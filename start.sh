@@ -122,7 +122,7 @@ fi
 
 dbbasename="$(basename $dbpath)"
 internalpath="/data/$dbbasename"
-opts=(--env GOOGLE_MAPS_API_KEY --detach --publish 8080:8080 --name "$cname")
+opts=(--env GOOGLE_MAPS_API_KEY --env ORDERSERVICE_ADMIN_TOKEN --detach --publish 8080:8080 --name "$cname")
 opts+=(--mount "type=bind,source=$(pwd)/$dbpath,target=$internalpath" --rm)
 
 cmd="docker run ${opts[*]} $(cat "$target") -dbpath $internalpath"
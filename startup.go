@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaSQL is the schema the binary expects, also used by the Makefile to
+// create new databases.
+//
+//go:embed schema.sql
+var schemaSQL string
+
+// selfCheck verifies at startup that the database is reachable and has the
+// schema this binary expects and, if checkMaps is set, that the default
+// distance provider answers. Missing indexes are logged, or an error if
+// strictIndexes is set. Errors say what to do about them.
+func selfCheck(ctx context.Context, svc *OrderService, checkMaps, strictIndexes bool) error {
+	ctx, cancelFn := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelFn()
+
+	if err := svc.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database unreachable: %s", err)
+	}
+	if err := checkSchema(ctx, svc.DB); err != nil {
+		return fmt.Errorf("%s; create a new database from schema.sql (make artifacts/orders.db) or apply "+
+			"migrations/ (make migrate)", err)
+	}
+	missing, err := missingIndexes(ctx, svc.DB)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		err := fmt.Errorf("database is missing indexes %s, create them as in schema.sql",
+			strings.Join(missing, ", "))
+		if strictIndexes {
+			return err
+		}
+		fmt.Printf("Startup check: %s\n", err)
+	}
+	if checkMaps {
+		// Two points a couple of kilometers apart in Oakland.
+		_, err := svc.defaultDistance.Route([]string{"37.8093475", "-122.2740787"},
+			[]string{"37.8061044", "-122.2943356"})
+		if err != nil {
+			return fmt.Errorf("distance provider %s failed, check GOOGLE_MAPS_API_KEY: %s",
+				svc.config.DistanceProvider, err)
+		}
+	}
+	return nil
+}
+
+// checkSchema compares db against a scratch database created from schemaSQL.
+// Every expected table and column must exist and the schema versions, kept in
+// PRAGMA user_version, must match.
+func checkSchema(ctx context.Context, db *sql.DB) error {
+	expected, err := openExpectedSchema(ctx)
+	if err != nil {
+		return err
+	}
+	defer expected.Close()
+
+	var wantVersion, gotVersion int
+	if err := expected.QueryRowContext(ctx, "PRAGMA user_version").Scan(&wantVersion); err != nil {
+		return fmt.Errorf("unable to read schema version: %s", err)
+	}
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&gotVersion); err != nil {
+		return fmt.Errorf("unable to read database schema version: %s", err)
+	}
+	if gotVersion != wantVersion {
+		return fmt.Errorf("database schema version is %d, expected %d", gotVersion, wantVersion)
+	}
+
+	wantTables, err := describeTables(ctx, expected)
+	if err != nil {
+		return err
+	}
+	gotTables, err := describeTables(ctx, db)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for table, columns := range wantTables {
+		gotColumns, ok := gotTables[table]
+		if !ok {
+			missing = append(missing, table)
+			continue
+		}
+		for column := range columns {
+			if !gotColumns[column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("database is missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// openExpectedSchema returns a scratch database created from schemaSQL.
+func openExpectedSchema(ctx context.Context) (*sql.DB, error) {
+	expected, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open scratch database: %s", err)
+	}
+	// Each connection to ":memory:" is a new database, stick to one.
+	expected.SetMaxOpenConns(1)
+	if _, err := expected.ExecContext(ctx, schemaSQL); err != nil {
+		expected.Close()
+		return nil, fmt.Errorf("embedded schema is invalid: %s", err)
+	}
+	return expected, nil
+}
+
+// missingIndexes returns the names of the indexes of schemaSQL that db does
+// not have, sorted. Indexes are compared by name only.
+func missingIndexes(ctx context.Context, db *sql.DB) ([]string, error) {
+	expected, err := openExpectedSchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer expected.Close()
+	want, err := listIndexes(ctx, expected)
+	if err != nil {
+		return nil, err
+	}
+	got, err := listIndexes(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for name := range want {
+		if !got[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// listIndexes returns the names of the indexes created in db, leaving out
+// those sqlite creates for primary keys and unique constraints.
+func listIndexes(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'index' AND sql IS NOT NULL")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list indexes: %s", err)
+	}
+	defer rows.Close()
+	indexes := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		indexes[name] = true
+	}
+	return indexes, rows.Err()
+}
+
+// describeTables returns the columns of every table in db.
+func describeTables(ctx context.Context, db *sql.DB) (map[string]map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tables: %s", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+
+	described := map[string]map[string]bool{}
+	for _, table := range tables {
+		columns, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%q)", table))
+		if err != nil {
+			return nil, fmt.Errorf("unable to describe %s: %s", table, err)
+		}
+		described[table] = map[string]bool{}
+		for columns.Next() {
+			var (
+				cid, notNull, pk int
+				name, colType    string
+				defaultValue     sql.NullString
+			)
+			if err := columns.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+				columns.Close()
+				return nil, fmt.Errorf("row.Scan() failed: %s", err)
+			}
+			described[table][name] = true
+		}
+		columns.Close()
+	}
+	return described, nil
+}
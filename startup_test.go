@@ -0,0 +1,72 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelfCheck(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if err := selfCheck(context.Background(), svc, true, true); err != nil {
+		t.Fatalf("self check of fresh database failed: %s", err)
+	}
+
+	if _, err := svc.DB.Exec("PRAGMA user_version = 0"); err != nil {
+		t.Fatal(err)
+	}
+	err := selfCheck(context.Background(), svc, false, false)
+	if err == nil || !strings.Contains(err.Error(), "schema version is 0, expected") {
+		t.Errorf("expected version mismatch, got %v", err)
+	}
+}
+
+func TestCheckSchemaMissingColumns(t *testing.T) {
+	db := openTestDB(t)
+	_, err := db.Exec(`DROP TABLE views;
+		DROP TABLE orders;
+		CREATE TABLE orders (id INTEGER NOT NULL PRIMARY KEY, distance REAL, status TEXT NOT NULL);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSchema(context.Background(), db)
+	if err == nil || !strings.Contains(err.Error(), "missing orders.created_at") ||
+		!strings.Contains(err.Error(), "views") {
+		t.Errorf("expected missing columns and table, got %v", err)
+	}
+}
+
+func TestMissingIndexes(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if _, err := svc.DB.Exec("DROP INDEX orders_status; DROP INDEX orders_tenant_id"); err != nil {
+		t.Fatal(err)
+	}
+	missing, err := missingIndexes(context.Background(), svc.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(missing, ",") != "orders_status,orders_tenant_id" {
+		t.Errorf("got missing indexes %v", missing)
+	}
+	if err := selfCheck(context.Background(), svc, false, false); err != nil {
+		t.Errorf("missing indexes should only be logged, got %s", err)
+	}
+	err = selfCheck(context.Background(), svc, false, true)
+	if err == nil || !strings.Contains(err.Error(), "missing indexes orders_status, orders_tenant_id") {
+		t.Errorf("expected missing indexes in strict mode, got %v", err)
+	}
+
+	for _, line := range strings.Split(schemaSQL, "\n") {
+		if strings.HasPrefix(line, "CREATE INDEX") {
+			if _, err := svc.DB.Exec(line); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := selfCheck(context.Background(), svc, false, true); err != nil {
+		t.Errorf("self check after creating the indexes failed: %s", err)
+	}
+}
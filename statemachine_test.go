@@ -0,0 +1,159 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+)
+
+// stateOp is a random step in the life of a few orders.
+type stateOp struct {
+	Kind  uint8 // Create, take or get, modulo 3.
+	Order uint8 // Which order, modulo the orders created plus one.
+}
+
+// opSequence generates random sequences of stateOps for testing/quick.
+type opSequence []stateOp
+
+func (opSequence) Generate(rand *rand.Rand, size int) reflect.Value {
+	ops := make(opSequence, rand.Intn(size+1))
+	for i := range ops {
+		ops[i] = stateOp{Kind: uint8(rand.Intn(3)), Order: uint8(rand.Intn(256))}
+	}
+	return reflect.ValueOf(ops)
+}
+
+// TestOrderStateProperties plays random sequences of requests against a
+// model of the order state machine: UNASSIGNED orders can be taken once,
+// TAKEN is terminal, and orders always match their events.
+func TestOrderStateProperties(t *testing.T) {
+	check := func(ops opSequence) bool {
+		svc := newTestService(t, Config{})
+		model := map[int64]OrderState{}
+		for step, op := range ops {
+			id := int64(op.Order)%int64(len(model)+1) + 1
+			var got, want int
+			switch op.Kind % 3 {
+			case 0:
+				got, want = serve(svc, "POST", "/orders", "", createOrderDetails).Code, 200
+				model[int64(len(model)+1)] = StateUnassigned
+			case 1:
+				got = serve(svc, "PATCH", fmt.Sprintf("/orders/%d", id), "", "").Code
+				switch model[id] {
+				case "":
+					want = 404
+				case StateTaken:
+					want = 409
+				default:
+					want = 200
+					model[id] = StateTaken
+				}
+			case 2:
+				w := serve(svc, "GET", fmt.Sprintf("/orders/%d", id), "", "")
+				got, want = w.Code, 200
+				if model[id] == "" {
+					want = 404
+				}
+				if want == 200 && !strings.Contains(w.Body.String(), `"status":"`+model[id]+`"`) {
+					t.Logf("step %d: order %d is %s, model says %s", step, id, w.Body, model[id])
+					return false
+				}
+			}
+			if got != want {
+				t.Logf("step %d %+v on order %d: got %d, want %d", step, op, id, got, want)
+				return false
+			}
+		}
+		return invariantsHold(t, svc, model)
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 30}); err != nil {
+		t.Error(err)
+	}
+}
+
+// invariantsHold checks the database against the model: every order has the
+// model's state, was created once and taken at most once, and the orders
+// table is what replaying the events gives.
+func invariantsHold(t *testing.T, svc *OrderService, model map[int64]OrderState) bool {
+	for id, state := range model {
+		history, err := svc.History(id)
+		if err != nil {
+			t.Logf("order %d: %s", id, err)
+			return false
+		}
+		counts := map[EventType]int{}
+		for _, event := range history {
+			counts[event.Type]++
+		}
+		wantTaken := 0
+		if state == StateTaken {
+			wantTaken = 1
+		}
+		if counts[EventCreated] != 1 || counts[EventTaken] != wantTaken {
+			t.Logf("order %d is %s with events %v", id, state, counts)
+			return false
+		}
+	}
+	problems, err := Verify(svc.DB, svc.config.FieldKey)
+	if err != nil || len(problems) > 0 {
+		t.Logf("orders do not match their events: %v %v", problems, err)
+		return false
+	}
+	return true
+}
+
+// TestConcurrentTakes races couriers for the same orders: each order must be
+// taken by exactly one of them, however the requests interleave.
+func TestConcurrentTakes(t *testing.T) {
+	svc := newTestService(t, Config{})
+	const orders, couriers = 5, 8
+	model := map[int64]OrderState{}
+	for i := int64(1); i <= orders; i++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+		model[i] = StateTaken
+	}
+
+	var mu sync.Mutex
+	successes := map[int64]int{}
+	var wg sync.WaitGroup
+	for c := 0; c < couriers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for _, id := range rand.New(rand.NewSource(int64(c))).Perm(orders) {
+				w := httptest.NewRecorder()
+				svc.ServeHTTP(w, httptest.NewRequest("PATCH", fmt.Sprintf("/orders/%d", id+1), nil))
+				if w.Code == 200 {
+					mu.Lock()
+					successes[int64(id+1)]++
+					mu.Unlock()
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	for id := int64(1); id <= orders; id++ {
+		if successes[id] > 1 {
+			t.Errorf("order %d taken %d times", id, successes[id])
+		}
+		if successes[id] == 0 {
+			// Every attempt lost to a locked database, the order is still
+			// free.
+			model[id] = StateUnassigned
+		}
+	}
+	if !invariantsHold(t, svc, model) {
+		t.Error("invariants violated")
+	}
+}
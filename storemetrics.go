@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Statistics per order store operation, the methods of OrderService reading
+// and writing orders, served by GET /admin/metrics. Unlike the sql_ metrics
+// they cover every statement and retry of an operation, unlike request
+// latencies none of the rendering or the distance and surge providers.
+var (
+	orderStoreCalls  = expvar.NewMap("order_store_calls")
+	orderStoreTime   = expvar.NewMap("order_store_time_us") // Microseconds.
+	orderStoreErrors = expvar.NewMap("order_store_errors")  // By "operation type", see storeErrorType.
+)
+
+// storeErrorTypes are the types of the errors order store operations return
+// for requests they refuse.
+var storeErrorTypes = map[error]string{
+	errNoSuchOrder:        "not_found",
+	errTaken:              "taken",
+	errPaymentRequired:    "payment_required",
+	errLinkedOrderPending: "linked_order_pending",
+	errDuplicateOrder:     "duplicate",
+}
+
+// storeErrorType returns the type of an error of an order store operation:
+// one of storeErrorTypes, "busy" for a database locked by another writer,
+// "timeout", or "internal".
+func storeErrorType(err error) string {
+	if errType, ok := storeErrorTypes[err]; ok {
+		return errType
+	}
+	// Most errors are wrapped as strings.
+	message := err.Error()
+	switch {
+	case isBusy(err), strings.Contains(message, sqlite3.ErrBusy.Error()),
+		strings.Contains(message, sqlite3.ErrLocked.Error()):
+		return "busy"
+	case strings.Contains(message, context.DeadlineExceeded.Error()),
+		strings.Contains(message, context.Canceled.Error()):
+		return "timeout"
+	}
+	return "internal"
+}
+
+// observeStore records an order store operation started at start, failed
+// with *err if not nil. Called deferred.
+func observeStore(operation string, start time.Time, err *error) {
+	orderStoreCalls.Add(operation, 1)
+	orderStoreTime.Add(operation, int64(time.Since(start)/time.Microsecond))
+	if *err != nil {
+		orderStoreErrors.Add(operation+" "+storeErrorType(*err), 1)
+	}
+}
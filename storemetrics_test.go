@@ -0,0 +1,54 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestStoreErrorType(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		expect string
+	}{
+		{errNoSuchOrder, "not_found"},
+		{errTaken, "taken"},
+		{fmt.Errorf("unable to append taken event: database is locked"), "busy"},
+		{fmt.Errorf("failed at BeginTx: %s", context.DeadlineExceeded), "timeout"},
+		{fmt.Errorf("row.Scan() failed: converting NULL to int64 is unsupported"), "internal"},
+	} {
+		if got := storeErrorType(c.err); got != c.expect {
+			t.Errorf("storeErrorType(%q) = %q, expected %q", c.err, got, c.expect)
+		}
+	}
+}
+
+func TestStoreMetrics(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	calls, taken, missing := metric(orderStoreCalls, "Take"), metric(orderStoreErrors, "Take taken"),
+		metric(orderStoreErrors, "Get not_found")
+	if err := svc.Take(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Take(1); err != errTaken {
+		t.Fatalf("second Take returned %v", err)
+	}
+	if _, err := svc.Get(2); err != errNoSuchOrder {
+		t.Fatalf("Get(2) returned %v", err)
+	}
+	if got := metric(orderStoreCalls, "Take") - calls; got != 2 {
+		t.Errorf("%d takes counted", got)
+	}
+	if metric(orderStoreErrors, "Take taken") != taken+1 || metric(orderStoreErrors, "Get not_found") != missing+1 {
+		t.Errorf("errors not counted: %s", orderStoreErrors)
+	}
+	if metric(orderStoreCalls, "Insert") == 0 || orderStoreTime.Get("Insert") == nil {
+		t.Errorf("insert not counted: %s, %s", orderStoreCalls, orderStoreTime)
+	}
+}
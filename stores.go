@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// storeWebhookPath prefixes the webhooks stores deliver their orders to,
+// followed by the id of the store.
+const storeWebhookPath = "/webhooks/stores/"
+
+// Platforms of stores.
+const (
+	platformShopify     = "shopify"
+	platformWooCommerce = "woocommerce"
+)
+
+// shopifyAPIVersion is the version of the Shopify Admin API called.
+const shopifyAPIVersion = "2024-01"
+
+// storeOrders counts the orders delivered by stores by outcome: "created",
+// or the error code they were refused with.
+var storeOrders = expvar.NewMap("store_orders")
+
+// storePlatforms are the platforms stores may be on, by name.
+var storePlatforms = map[string]storePlatform{
+	platformShopify:     shopify{},
+	platformWooCommerce: wooCommerce{},
+}
+
+// Store is an online store whose new orders become orders of its tenant,
+// the body of POST /admin/tenants/{tenant}/stores. Its orders are picked
+// up at Origin and delivered to their shipping address.
+type Store struct {
+	ID          string            `json:"id"`
+	Platform    string            `json:"platform"` // shopify or woocommerce.
+	URL         string            `json:"url"`      // e.g. https://acme.myshopify.com.
+	Origin      []string          `json:"origin"`
+	Credentials *StoreCredentials `json:"credentials,omitempty"` // Never returned.
+	WebhookID   string            `json:"webhook_id,omitempty"`  // Of the webhook registered with the store.
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// StoreCredentials are the credentials of a store, SECRET. They are stored
+// encrypted with the secrets key.
+type StoreCredentials struct {
+	// Shopify: the Admin API access token of the app installed in the shop,
+	// and the app's client secret, which signs its webhooks.
+	AccessToken  string `json:"access_token,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	// WooCommerce: a REST API key, and the secret the webhook is registered
+	// with, made up by the service.
+	ConsumerKey    string `json:"consumer_key,omitempty"`
+	ConsumerSecret string `json:"consumer_secret,omitempty"`
+	WebhookSecret  string `json:"webhook_secret,omitempty"`
+}
+
+// storeOrder is what is used of an order of a store.
+type storeOrder struct {
+	ExternalID string   // The id of the order in the store.
+	Address    string   // The shipping address, "" if none.
+	Point      []string // Of the shipping address if the store knows it.
+}
+
+// storePlatform registers webhooks with the stores of a platform and reads
+// the orders they deliver.
+type storePlatform interface {
+	// checkCredentials returns what is missing from the credentials.
+	checkCredentials(creds *StoreCredentials) error
+	// register creates the webhook of new orders of store, delivered to
+	// callback, returning its id in the store.
+	register(client *http.Client, store *Store, callback string) (string, error)
+	unregister(client *http.Client, store *Store) error
+	// verify checks the signature of a webhook with body.
+	verify(header http.Header, body []byte, creds *StoreCredentials) error
+	parseOrder(body []byte) (*storeOrder, error)
+}
+
+var errNoSuchStore = fmt.Errorf("no such store")
+
+// storeCall calls the API of a store, encoding in as the body if not nil
+// and decoding the response into out if not nil.
+func storeCall(client *http.Client, method, endpoint string, in, out interface{}, auth func(*http.Request)) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	auth(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", method, endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: HTTP %d: %s", method, endpoint, resp.StatusCode, detail)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: unable to decode response: %s", method, endpoint, err)
+	}
+	return nil
+}
+
+// verifyHMAC checks that signature is the base64 HMAC-SHA256 of body with
+// secret, as both platforms sign their webhooks.
+func verifyHMAC(signature, secret string, body []byte) error {
+	if signature == "" {
+		return fmt.Errorf("missing signature")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal([]byte(signature), []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// joinAddress joins the non-empty lines of an address.
+func joinAddress(lines ...string) string {
+	var parts []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			parts = append(parts, line)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// shopify registers webhooks with the Shopify Admin API.
+type shopify struct{}
+
+func (shopify) checkCredentials(creds *StoreCredentials) error {
+	if creds.AccessToken == "" || creds.ClientSecret == "" {
+		return fmt.Errorf("shopify stores need an access_token and a client_secret")
+	}
+	return nil
+}
+
+func (shopify) auth(store *Store) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("X-Shopify-Access-Token", store.Credentials.AccessToken)
+	}
+}
+
+func (p shopify) register(client *http.Client, store *Store, callback string) (string, error) {
+	var created struct {
+		Webhook struct {
+			ID json.Number `json:"id"`
+		} `json:"webhook"`
+	}
+	err := storeCall(client, http.MethodPost, fmt.Sprintf("%s/admin/api/%s/webhooks.json", store.URL,
+		shopifyAPIVersion), map[string]interface{}{"webhook": map[string]string{"topic": "orders/create",
+		"address": callback, "format": "json"}}, &created, p.auth(store))
+	return created.Webhook.ID.String(), err
+}
+
+func (p shopify) unregister(client *http.Client, store *Store) error {
+	return storeCall(client, http.MethodDelete, fmt.Sprintf("%s/admin/api/%s/webhooks/%s.json", store.URL,
+		shopifyAPIVersion, url.PathEscape(store.WebhookID)), nil, nil, p.auth(store))
+}
+
+func (shopify) verify(header http.Header, body []byte, creds *StoreCredentials) error {
+	return verifyHMAC(header.Get("X-Shopify-Hmac-Sha256"), creds.ClientSecret, body)
+}
+
+func (shopify) parseOrder(body []byte) (*storeOrder, error) {
+	var order struct {
+		ID              json.Number `json:"id"`
+		ShippingAddress *struct {
+			Address1  string   `json:"address1"`
+			Address2  string   `json:"address2"`
+			City      string   `json:"city"`
+			Province  string   `json:"province"`
+			Zip       string   `json:"zip"`
+			Country   string   `json:"country"`
+			Latitude  *float64 `json:"latitude"`
+			Longitude *float64 `json:"longitude"`
+		} `json:"shipping_address"`
+	}
+	if err := json.Unmarshal(body, &order); err != nil || order.ID == "" {
+		return nil, fmt.Errorf("invalid Shopify order: %v", err)
+	}
+	result := &storeOrder{ExternalID: order.ID.String()}
+	if address := order.ShippingAddress; address != nil {
+		result.Address = joinAddress(address.Address1, address.Address2, address.City, address.Province,
+			address.Zip, address.Country)
+		if address.Latitude != nil && address.Longitude != nil {
+			result.Point = []string{fmt.Sprint(*address.Latitude), fmt.Sprint(*address.Longitude)}
+		}
+	}
+	return result, nil
+}
+
+// wooCommerce registers webhooks with the WooCommerce REST API.
+type wooCommerce struct{}
+
+func (wooCommerce) checkCredentials(creds *StoreCredentials) error {
+	if creds.ConsumerKey == "" || creds.ConsumerSecret == "" {
+		return fmt.Errorf("woocommerce stores need a consumer_key and a consumer_secret")
+	}
+	return nil
+}
+
+func (wooCommerce) auth(store *Store) func(*http.Request) {
+	return func(req *http.Request) {
+		req.SetBasicAuth(store.Credentials.ConsumerKey, store.Credentials.ConsumerSecret)
+	}
+}
+
+func (p wooCommerce) register(client *http.Client, store *Store, callback string) (string, error) {
+	var created struct {
+		ID json.Number `json:"id"`
+	}
+	err := storeCall(client, http.MethodPost, store.URL+"/wp-json/wc/v3/webhooks", map[string]string{
+		"name": "orderservice", "topic": "order.created", "delivery_url": callback,
+		"secret": store.Credentials.WebhookSecret, "status": "active"}, &created, p.auth(store))
+	return created.ID.String(), err
+}
+
+func (p wooCommerce) unregister(client *http.Client, store *Store) error {
+	return storeCall(client, http.MethodDelete, fmt.Sprintf("%s/wp-json/wc/v3/webhooks/%s?force=true", store.URL,
+		url.PathEscape(store.WebhookID)), nil, nil, p.auth(store))
+}
+
+func (wooCommerce) verify(header http.Header, body []byte, creds *StoreCredentials) error {
+	return verifyHMAC(header.Get("X-WC-Webhook-Signature"), creds.WebhookSecret, body)
+}
+
+func (wooCommerce) parseOrder(body []byte) (*storeOrder, error) {
+	var order struct {
+		ID       json.Number `json:"id"`
+		Shipping *struct {
+			Address1 string `json:"address_1"`
+			Address2 string `json:"address_2"`
+			City     string `json:"city"`
+			State    string `json:"state"`
+			Postcode string `json:"postcode"`
+			Country  string `json:"country"`
+		} `json:"shipping"`
+	}
+	if err := json.Unmarshal(body, &order); err != nil || order.ID == "" {
+		return nil, fmt.Errorf("invalid WooCommerce order: %v", err)
+	}
+	result := &storeOrder{ExternalID: order.ID.String()}
+	if address := order.Shipping; address != nil {
+		result.Address = joinAddress(address.Address1, address.Address2, address.City, address.State,
+			address.Postcode, address.Country)
+	}
+	return result, nil
+}
+
+// storesEnabled reports whether stores can be connected: their credentials
+// need the secrets key, and their webhooks the public URL.
+func (s *OrderService) storesEnabled() bool {
+	return s.config.SecretsKey != nil && s.config.PublicURL != ""
+}
+
+// CreateStore registers the webhook of a new store of tenant and saves it.
+func (s *OrderService) CreateStore(tenant string, store *Store) error {
+	store.ID = randomHex(8)
+	store.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	if store.Platform == platformWooCommerce {
+		store.Credentials.WebhookSecret = randomHex(16)
+	}
+	callback := strings.TrimRight(s.config.PublicURL, "/") + storeWebhookPath + store.ID
+	webhookID, err := storePlatforms[store.Platform].register(s.Client, store, callback)
+	if err != nil {
+		return errStoreUnreachable{err}
+	}
+	store.WebhookID = webhookID
+
+	creds, err := json.Marshal(store.Credentials)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealSecret(s.config.SecretsKey, creds)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(`INSERT INTO stores (id, tenant_id, platform, url, origin_lat, origin_lng, credentials,
+			webhook_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, store.ID, tenant, store.Platform, store.URL,
+		store.Origin[0], store.Origin[1], sealed, store.WebhookID, store.CreatedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("unable to save store %s of tenant %q: %s", store.ID, tenant, err)
+	}
+	return nil
+}
+
+// errStoreUnreachable is returned by CreateStore when the store refused its
+// webhook or could not be called.
+type errStoreUnreachable struct {
+	err error
+}
+
+func (e errStoreUnreachable) Error() string {
+	return fmt.Sprintf("unable to register webhook: %s", e.err)
+}
+
+// storeColumns are the columns scanned by scanStore.
+const storeColumns = "id, tenant_id, platform, url, origin_lat, origin_lng, credentials, webhook_id, created_at"
+
+// scanStore reads a row of storeColumns, decrypting the credentials if
+// withCredentials. Returns the store and its tenant.
+func (s *OrderService) scanStore(row interface{ Scan(...interface{}) error }, withCredentials bool) (*Store, string,
+	error) {
+	var (
+		store                Store
+		tenant, sealed       string
+		originLat, originLng string
+		createdAt            int64
+	)
+	if err := row.Scan(&store.ID, &tenant, &store.Platform, &store.URL, &originLat, &originLng, &sealed,
+		&store.WebhookID, &createdAt); err != nil {
+		return nil, "", err
+	}
+	store.Origin, store.CreatedAt = []string{originLat, originLng}, time.Unix(createdAt, 0).UTC()
+	if withCredentials {
+		creds, err := openSecret(s.config.SecretsKey, sealed)
+		if err != nil {
+			return nil, "", fmt.Errorf("credentials of store %s: %s", store.ID, err)
+		}
+		store.Credentials = &StoreCredentials{}
+		if err := json.Unmarshal(creds, store.Credentials); err != nil {
+			return nil, "", fmt.Errorf("credentials of store %s: %s", store.ID, err)
+		}
+	}
+	return &store, tenant, nil
+}
+
+// GetStore returns a store with its credentials and its tenant, or
+// errNoSuchStore. An empty tenant matches any.
+func (s *OrderService) GetStore(tenant, id string) (*Store, string, error) {
+	store, owner, err := s.scanStore(s.DB.QueryRow("SELECT "+storeColumns+" FROM stores WHERE id = ?", id), true)
+	if err == sql.ErrNoRows || (err == nil && tenant != "" && owner != tenant) {
+		return nil, "", errNoSuchStore
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to load store %s: %s", id, err)
+	}
+	return store, owner, nil
+}
+
+// Stores returns the stores of tenant, without their credentials.
+func (s *OrderService) Stores(tenant string) ([]Store, error) {
+	rows, err := s.DB.Query("SELECT "+storeColumns+" FROM stores WHERE tenant_id = ? ORDER BY created_at, id",
+		tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query stores of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	stores := []Store{}
+	for rows.Next() {
+		store, _, err := s.scanStore(rows, false)
+		if err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		stores = append(stores, *store)
+	}
+	return stores, rows.Err()
+}
+
+// DeleteStore unregisters the webhook of a store of tenant, if the store
+// still allows it, and deletes the store.
+func (s *OrderService) DeleteStore(tenant, id string) error {
+	store, _, err := s.GetStore(tenant, id)
+	if err != nil {
+		return err
+	}
+	if err := storePlatforms[store.Platform].unregister(s.Client, store); err != nil {
+		fmt.Printf("Store %s of tenant %q: unable to unregister webhook %s: %s\n", id, tenant, store.WebhookID, err)
+	}
+	if _, err := s.DB.Exec("DELETE FROM stores WHERE id = ?", id); err != nil {
+		return fmt.Errorf("unable to delete store %s: %s", id, err)
+	}
+	return nil
+}
+
+// validateStore checks a store to create, returning what is wrong with it.
+func validateStore(store *Store) error {
+	platform, ok := storePlatforms[store.Platform]
+	if !ok {
+		return fmt.Errorf("platform must be %s or %s", platformShopify, platformWooCommerce)
+	}
+	u, err := url.Parse(store.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("url must be the http(s) URL of the store")
+	}
+	store.URL = strings.TrimRight(store.URL, "/")
+	if _, _, err := parseLatLng(store.Origin); err != nil {
+		return fmt.Errorf("origin must be the [latitude, longitude] of the pickup point")
+	}
+	if store.Credentials == nil {
+		return fmt.Errorf("missing credentials")
+	}
+	return platform.checkCredentials(store.Credentials)
+}
+
+// handleTenantStores serves /admin/tenants/{tenant}/stores.
+//
+//	GET    /admin/tenants/{tenant}/stores       lists them, without credentials.
+//	POST   /admin/tenants/{tenant}/stores       connects a Store, 201.
+//	GET    /admin/tenants/{tenant}/stores/{id}  returns one.
+//	DELETE /admin/tenants/{tenant}/stores/{id}  disconnects one.
+func (s *OrderService) handleTenantStores(w http.ResponseWriter, req *http.Request, tenant, id string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if !s.storesEnabled() {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "no %s or -public-url", secretsKeyEnv)
+		return
+	}
+	if id != "" {
+		if req.Method == http.MethodDelete {
+			err := s.DeleteStore(tenant, id)
+			switch {
+			case err == errNoSuchStore:
+				respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_STORE"}, "tenant %q store %s", tenant, id)
+			case err != nil:
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DeleteStore(): %s", err)
+			default:
+				respond(w, req, 200, HTTPResponseStatus{"SUCCESS"}, "deleted store %s of tenant %q", id, tenant)
+			}
+			return
+		}
+		store, _, err := s.GetStore(tenant, id)
+		if err == errNoSuchStore {
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_STORE"}, "tenant %q store %s", tenant, id)
+			return
+		}
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "GetStore(): %s", err)
+			return
+		}
+		store.Credentials = nil
+		respond(w, req, 200, store, "tenant %q store %s", tenant, id)
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var store Store
+		if err := json.NewDecoder(req.Body).Decode(&store); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if err := validateStore(&store); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: err.Error()}, "%s", err)
+			return
+		}
+		err := s.CreateStore(tenant, &store)
+		if unreachable, ok := err.(errStoreUnreachable); ok {
+			respond(w, req, 502, HTTPResponseError{Error: "STORE_UNREACHABLE", Detail: unreachable.Error()},
+				"%s", unreachable)
+			return
+		}
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "CreateStore(): %s", err)
+			return
+		}
+		store.Credentials = nil
+		respond(w, req, 201, store, "tenant %q connected %s store %s", tenant, store.Platform, store.ID)
+		return
+	}
+	stores, err := s.Stores(tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Stores(): %s", err)
+		return
+	}
+	respond(w, req, 200, stores, "tenant %q %d stores", tenant, len(stores))
+}
+
+// storeOrderResult returns the result of an order of a store delivered
+// before, nil if it is new.
+func (s *OrderService) storeOrderResult(storeID, externalID string) (*WebhookResult, error) {
+	var (
+		orderID sql.NullInt64
+		code    sql.NullString
+	)
+	err := s.DB.QueryRow("SELECT order_id, error FROM store_orders WHERE store_id = ? AND external_id = ?",
+		storeID, externalID).Scan(&orderID, &code)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up order %s of store %s: %s", externalID, storeID, err)
+	}
+	return &WebhookResult{Status: "DUPLICATE", OrderID: orderID.Int64, Error: code.String}, nil
+}
+
+// saveStoreOrder records the outcome of an order of a store.
+func (s *OrderService) saveStoreOrder(storeID, externalID string, orderID int64, code string) error {
+	var (
+		id        sql.NullInt64
+		codeValue sql.NullString
+	)
+	if orderID != 0 {
+		id = sql.NullInt64{Int64: orderID, Valid: true}
+	}
+	if code != "" {
+		codeValue = sql.NullString{String: code, Valid: true}
+	}
+	_, err := s.DB.Exec(`INSERT INTO store_orders (store_id, external_id, order_id, error, received_at)
+		VALUES (?, ?, ?, ?, ?)`, storeID, externalID, id, codeValue, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("unable to record order %s of store %s: %s", externalID, storeID, err)
+	}
+	return nil
+}
+
+// handleStoreWebhook serves POST /webhooks/stores/{id}, the orders created
+// in a store, authenticated by the platform's signature rather than
+// credentials. Each order of a store is created once, at the origin of the
+// store, to its shipping address; orders that cannot be are acknowledged as
+// REJECTED, unless the store retrying may help.
+func (s *OrderService) handleStoreWebhook(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, storeWebhookPath)
+	if !s.storesEnabled() {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "no %s or -public-url", secretsKeyEnv)
+		return
+	}
+	store, tenant, err := s.GetStore("", id)
+	if err == errNoSuchStore {
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_STORE"}, "no such store %s", id)
+		return
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "GetStore(): %s", err)
+		return
+	}
+	// WooCommerce pings new webhooks with an unsigned form.
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType ==
+		"application/x-www-form-urlencoded" {
+		respond(w, req, 200, HTTPResponseStatus{"SUCCESS"}, "ping of store %s", id)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSignedBody))
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+		return
+	}
+	platform := storePlatforms[store.Platform]
+	if err := platform.verify(req.Header, body, store.Credentials); err != nil {
+		respond(w, req, 401, HTTPResponseError{Error: "INVALID_SIGNATURE", Detail: err.Error()}, "store %s: %s",
+			id, err)
+		return
+	}
+
+	reject := func(code, format string, args ...interface{}) {
+		storeOrders.Add(code, 1)
+		respond(w, req, 200, WebhookResult{Status: "REJECTED", Error: code}, format, args...)
+	}
+	order, err := platform.parseOrder(body)
+	if err != nil {
+		reject("MALFORMED_PAYLOAD", "store %s: %s", id, err)
+		return
+	}
+	previous, err := s.storeOrderResult(id, order.ExternalID)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "%s", err)
+		return
+	}
+	if previous != nil {
+		respond(w, req, 200, previous, "order %s of store %s already delivered", order.ExternalID, id)
+		return
+	}
+	// Refusals are recorded, so redeliveries are refused the same.
+	refuse := func(code string, err error) {
+		if err := s.saveStoreOrder(id, order.ExternalID, 0, code); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "%s", err)
+			return
+		}
+		reject(code, "order %s of store %s: %s", order.ExternalID, id, err)
+	}
+
+	destination := order.Point
+	if destination == nil {
+		if order.Address == "" {
+			refuse("NO_SHIPPING_ADDRESS", fmt.Errorf("no shipping address"))
+			return
+		}
+		if s.geocoder == nil {
+			reject("GEOCODING_UNAVAILABLE", "order %s of store %s: no geocoder", order.ExternalID, id)
+			return
+		}
+		destination, err = s.geocoder.Geocode(order.Address)
+		if err == errAddressNotFound {
+			refuse("ADDRESS_NOT_FOUND", fmt.Errorf("%q not found", order.Address))
+			return
+		}
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Geocode(): %s", err)
+			return
+		}
+	}
+	created, err := s.Insert(tenant, CreateOrderDetails{Origin: store.Origin, Destination: destination})
+	if err != nil {
+		code := importError(err)
+		if feedRetried[code] {
+			respond(w, req, 500, HTTPResponseError{Error: code}, "order %s of store %s: Insert(): %s",
+				order.ExternalID, id, err)
+			return
+		}
+		refuse(code, err)
+		return
+	}
+	if err := s.saveStoreOrder(id, order.ExternalID, created.Id, ""); err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "%s", err)
+		return
+	}
+	storeOrders.Add("created", 1)
+	respond(w, req, 200, WebhookResult{Status: "CREATED", OrderID: created.Id}, "order %s of store %s created order %d",
+		order.ExternalID, id, created.Id)
+}
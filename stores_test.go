@@ -0,0 +1,196 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGeocoder knows the points of some addresses.
+type fakeGeocoder map[string][]string
+
+func (g fakeGeocoder) Geocode(address string) ([]string, error) {
+	if point, ok := g[address]; ok {
+		return point, nil
+	}
+	return nil, errAddressNotFound
+}
+
+// fakeStores serves the webhook APIs of Shopify and WooCommerce.
+type fakeStores struct {
+	mu        sync.Mutex
+	callbacks []string
+	secret    string // Of the last WooCommerce webhook.
+	deleted   []string
+}
+
+func (f *fakeStores) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body map[string]interface{}
+	json.NewDecoder(req.Body).Decode(&body)
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/admin/api/"+shopifyAPIVersion+"/webhooks.json":
+		if req.Header.Get("X-Shopify-Access-Token") != "shpat_1" {
+			w.WriteHeader(401)
+			return
+		}
+		webhook := body["webhook"].(map[string]interface{})
+		f.callbacks = append(f.callbacks, webhook["address"].(string))
+		w.WriteHeader(201)
+		fmt.Fprint(w, `{"webhook": {"id": 4759306, "topic": "orders/create"}}`)
+	case req.Method == "POST" && req.URL.Path == "/wp-json/wc/v3/webhooks":
+		if user, pass, _ := req.BasicAuth(); user != "ck_1" || pass != "cs_1" {
+			w.WriteHeader(401)
+			return
+		}
+		f.callbacks = append(f.callbacks, body["delivery_url"].(string))
+		f.secret = body["secret"].(string)
+		w.WriteHeader(201)
+		fmt.Fprint(w, `{"id": 142}`)
+	case req.Method == "DELETE":
+		f.deleted = append(f.deleted, req.URL.Path)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// postStoreOrder delivers an order signed with secret in header.
+func postStoreOrder(svc *OrderService, callback, header, secret, body string) (int, WebhookResult) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest("POST", strings.TrimPrefix(callback, "https://orders.example.com"),
+		strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	var result WebhookResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+func TestStores(t *testing.T) {
+	platform := &fakeStores{}
+	server := httptest.NewServer(platform)
+	defer server.Close()
+	svc := newTestService(t, Config{AdminToken: "secret", SecretsKey: bytes.Repeat([]byte{7}, 32),
+		PublicURL: "https://orders.example.com/", Geocoder: fakeGeocoder{
+			"1 Main St, Oakland, CA, 94607, US": {"37.8061044", "-122.2943356"}}})
+
+	for _, body := range []string{
+		`{"platform": "magento", "url": "` + server.URL + `", "origin": ["37.8093475", "-122.2740787"]}`,
+		`{"platform": "shopify", "url": "` + server.URL + `", "origin": ["37.8093475", "-122.2740787"],
+			"credentials": {"access_token": "shpat_1"}}`,
+		`{"platform": "shopify", "url": "acme.myshopify.com", "origin": ["37.8093475", "-122.2740787"],
+			"credentials": {"access_token": "shpat_1", "client_secret": "shpss_1"}}`,
+		`{"platform": "shopify", "url": "` + server.URL + `", "credentials": {"access_token": "shpat_1",
+			"client_secret": "shpss_1"}}`,
+	} {
+		if w := serveAdmin(svc, "POST", "/admin/tenants/acme/stores", body); w.Code != 400 {
+			t.Errorf("POST %s returned %d", body, w.Code)
+		}
+	}
+	w := serveAdmin(svc, "POST", "/admin/tenants/acme/stores", `{"platform": "shopify", "url": "`+server.URL+
+		`", "origin": ["37.8093475", "-122.2740787"], "credentials": {"access_token": "wrong", "client_secret": "x"}}`)
+	if w.Code != 502 {
+		t.Errorf("POST a store refusing the webhook returned %d", w.Code)
+	}
+
+	var shop, woo Store
+	w = serveAdmin(svc, "POST", "/admin/tenants/acme/stores", `{"platform": "shopify", "url": "`+server.URL+
+		`/", "origin": ["37.8093475", "-122.2740787"], "credentials": {"access_token": "shpat_1",
+		"client_secret": "shpss_1"}}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &shop); err != nil || w.Code != 201 || shop.WebhookID != "4759306" ||
+		strings.Contains(w.Body.String(), "shpat_1") {
+		t.Fatalf("POST Shopify store returned %d: %s", w.Code, w.Body)
+	}
+	w = serveAdmin(svc, "POST", "/admin/tenants/acme/stores", `{"platform": "woocommerce", "url": "`+server.URL+
+		`", "origin": ["37.8093475", "-122.2740787"], "credentials": {"consumer_key": "ck_1",
+		"consumer_secret": "cs_1"}}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &woo); err != nil || w.Code != 201 || woo.WebhookID != "142" {
+		t.Fatalf("POST WooCommerce store returned %d: %s", w.Code, w.Body)
+	}
+	if len(platform.callbacks) != 2 || platform.callbacks[0] != "https://orders.example.com/webhooks/stores/"+shop.ID {
+		t.Fatalf("unexpected callbacks %v", platform.callbacks)
+	}
+	var sealed string
+	svc.DB.QueryRow("SELECT credentials FROM stores WHERE id = ?", shop.ID).Scan(&sealed)
+	if strings.Contains(sealed, "shpat_1") || !strings.HasPrefix(sealed, sealedPrefix) {
+		t.Errorf("expected sealed credentials, got %q", sealed)
+	}
+
+	// Shopify knows the point of the shipping address.
+	shopifyOrder := `{"id": 820982911946154508, "shipping_address": {"address1": "1 Main St", "city": "Oakland",
+		"latitude": 37.8061044, "longitude": -122.2943356}}`
+	if code, _ := postStoreOrder(svc, platform.callbacks[0], "X-Shopify-Hmac-Sha256", "wrong", shopifyOrder); code != 401 {
+		t.Errorf("badly signed webhook returned %d", code)
+	}
+	code, result := postStoreOrder(svc, platform.callbacks[0], "X-Shopify-Hmac-Sha256", "shpss_1", shopifyOrder)
+	if code != 200 || result.Status != "CREATED" || result.OrderID != 1 {
+		t.Fatalf("unexpected result %d %+v", code, result)
+	}
+	code, result = postStoreOrder(svc, platform.callbacks[0], "X-Shopify-Hmac-Sha256", "shpss_1", shopifyOrder)
+	if code != 200 || result.Status != "DUPLICATE" || result.OrderID != 1 {
+		t.Errorf("unexpected result of a redelivery %d %+v", code, result)
+	}
+
+	// WooCommerce addresses are geocoded.
+	for body, want := range map[string]WebhookResult{
+		`{"id": 727, "shipping": {"address_1": "1 Main St", "city": "Oakland", "state": "CA", "postcode": "94607",
+			"country": "US"}}`: {Status: "CREATED", OrderID: 2},
+		`{"id": 728, "shipping": {"address_1": "Nowhere"}}`: {Status: "REJECTED", Error: "ADDRESS_NOT_FOUND"},
+		`{"id": 729, "shipping": {}}`:                       {Status: "REJECTED", Error: "NO_SHIPPING_ADDRESS"},
+		`{"total": "10.00"}`:                                {Status: "REJECTED", Error: "MALFORMED_PAYLOAD"},
+	} {
+		if code, result := postStoreOrder(svc, platform.callbacks[1], "X-WC-Webhook-Signature", platform.secret,
+			body); code != 200 || result != want {
+			t.Errorf("%s: unexpected result %d %+v", body, code, result)
+		}
+	}
+	if w := serve(svc, "GET", "/orders/2", "acme", ""); w.Code != 200 {
+		t.Errorf("expected the order to belong to the store's tenant, got %d", w.Code)
+	}
+	ping := httptest.NewRequest("POST", "/webhooks/stores/"+woo.ID, strings.NewReader("webhook_id=142"))
+	ping.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, ping)
+	if w.Code != 200 {
+		t.Errorf("ping returned %d", w.Code)
+	}
+
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/stores", "")
+	var stores []Store
+	if err := json.Unmarshal(w.Body.Bytes(), &stores); err != nil || len(stores) != 2 ||
+		stores[0].Credentials != nil || strings.Contains(w.Body.String(), "cs_1") {
+		t.Errorf("unexpected stores %s", w.Body)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/globex/stores/"+shop.ID, ""); w.Code != 404 {
+		t.Errorf("deleting the store of another tenant returned %d", w.Code)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/stores/"+shop.ID, ""); w.Code != 200 {
+		t.Errorf("DELETE store returned %d", w.Code)
+	}
+	if len(platform.deleted) != 1 || platform.deleted[0] != "/admin/api/"+shopifyAPIVersion+"/webhooks/4759306.json" {
+		t.Errorf("expected the webhook to be unregistered, got %v", platform.deleted)
+	}
+	if code, _ := postStoreOrder(svc, platform.callbacks[0], "X-Shopify-Hmac-Sha256", "shpss_1", shopifyOrder); code != 404 {
+		t.Errorf("webhook of a deleted store returned %d", code)
+	}
+
+	disabled := newTestService(t, Config{AdminToken: "secret"})
+	if w := serveAdmin(disabled, "GET", "/admin/tenants/acme/stores", ""); w.Code != 404 {
+		t.Errorf("expected stores to be disabled without a secrets key, got %d", w.Code)
+	}
+}
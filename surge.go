@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSurge bounds surge multipliers, a hook returning more is ignored.
+const maxSurge = 10
+
+// surgeFailures counts the surge multipliers that could not be had, orders
+// are then priced without surge.
+var surgeFailures = expvar.NewInt("surge_failures")
+
+// SurgeInput is what a SurgeProvider decides on, also the body POSTed to a
+// surge hook.
+type SurgeInput struct {
+	TenantID    string    `json:"tenant_id"`
+	Origin      []string  `json:"origin"`
+	Destination []string  `json:"destination"`
+	Time        time.Time `json:"time"`
+}
+
+// SurgeProvider returns the multiplier of the price of a journey, 1 for no
+// surge.
+type SurgeProvider interface {
+	Multiplier(ctx context.Context, input SurgeInput) (float64, error)
+}
+
+// SurgeRule multiplies prices on some days of the week between two times of
+// day, End excluded.
+type SurgeRule struct {
+	Days       [7]bool // By time.Weekday.
+	Start, End time.Duration
+	Multiplier float64
+}
+
+// surgeRules is the SurgeProvider of -surge-rules, the first rule matching
+// the time in location applies.
+type surgeRules struct {
+	rules    []SurgeRule
+	location *time.Location
+}
+
+// Multiplier returns the multiplier of the first rule matching input.Time.
+func (r surgeRules) Multiplier(ctx context.Context, input SurgeInput) (float64, error) {
+	t := input.Time.In(r.location)
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	for _, rule := range r.rules {
+		if rule.Days[t.Weekday()] && sinceMidnight >= rule.Start && sinceMidnight < rule.End {
+			return rule.Multiplier, nil
+		}
+	}
+	return 1, nil
+}
+
+var weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+
+// parseSurgeRules parses rules separated by semicolons, each days, a time
+// range and a multiplier, e.g. "mon-fri 07:00-09:30 1.5; sat,sun 20:00-24:00 1.2".
+func parseSurgeRules(spec string) ([]SurgeRule, error) {
+	var rules []SurgeRule
+	for _, text := range strings.Split(spec, ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		parts := strings.Fields(text)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("surge rule %q: expected days, times and multiplier", text)
+		}
+		var rule SurgeRule
+		for _, days := range strings.Split(parts[0], ",") {
+			bounds := strings.SplitN(strings.ToLower(days), "-", 2)
+			first, ok := weekdays[bounds[0]]
+			last, lastOK := first, true
+			if len(bounds) == 2 {
+				last, lastOK = weekdays[bounds[1]]
+			}
+			if !ok || !lastOK {
+				return nil, fmt.Errorf("surge rule %q: invalid days %q", text, days)
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				rule.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+		times := strings.SplitN(parts[1], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("surge rule %q: invalid times %q", text, parts[1])
+		}
+		var err error
+		if rule.Start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, fmt.Errorf("surge rule %q: %s", text, err)
+		}
+		if rule.End, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, fmt.Errorf("surge rule %q: %s", text, err)
+		}
+		if rule.End <= rule.Start {
+			return nil, fmt.Errorf("surge rule %q: end must be after start", text)
+		}
+		rule.Multiplier, err = strconv.ParseFloat(parts[2], 64)
+		if err != nil || !(rule.Multiplier > 0 && rule.Multiplier <= maxSurge) {
+			return nil, fmt.Errorf("surge rule %q: multiplier must be over 0 and at most %d", text, maxSurge)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseTimeOfDay parses "HH:MM", 00:00 to 24:00.
+func parseTimeOfDay(text string) (time.Duration, error) {
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) == 2 {
+		hours, err1 := strconv.Atoi(parts[0])
+		minutes, err2 := strconv.Atoi(parts[1])
+		d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+		if err1 == nil && err2 == nil && hours >= 0 && minutes >= 0 && minutes < 60 && d <= 24*time.Hour {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q", text)
+}
+
+// surgeHook is the SurgeProvider of -surge-url. The hook is POSTed a
+// SurgeInput and responds with {"multiplier": 1.5}.
+type surgeHook struct {
+	client *http.Client
+	url    string
+}
+
+// Multiplier calls the hook.
+func (h surgeHook) Multiplier(ctx context.Context, input SurgeInput) (float64, error) {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return 0, fmt.Errorf("unable to encode surge input: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to call surge hook: %s", err)
+	}
+	defer resp.Body.Close()
+	encoded, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("surge hook returned %s: %s", resp.Status, bytes.TrimSpace(encoded))
+	}
+	var result struct {
+		Multiplier float64 `json:"multiplier"`
+	}
+	if err := json.Unmarshal(encoded, &result); err != nil {
+		return 0, fmt.Errorf("invalid surge hook response: %s", err)
+	}
+	if !(result.Multiplier > 0 && result.Multiplier <= maxSurge) {
+		return 0, fmt.Errorf("surge hook returned multiplier %v", result.Multiplier)
+	}
+	return result.Multiplier, nil
+}
+
+// newSurgeProvider returns the provider of -surge-rules or -surge-url, nil
+// for neither.
+func newSurgeProvider(rules, location, url string, client *http.Client) (SurgeProvider, error) {
+	switch {
+	case rules != "" && url != "":
+		return nil, fmt.Errorf("-surge-rules and -surge-url are exclusive")
+	case rules != "":
+		parsed, err := parseSurgeRules(rules)
+		if err != nil {
+			return nil, err
+		}
+		loc, err := time.LoadLocation(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -surge-location: %s", err)
+		}
+		return surgeRules{rules: parsed, location: loc}, nil
+	case url != "":
+		return surgeHook{client: client, url: url}, nil
+	}
+	return nil, nil
+}
+
+// surge returns the multiplier of a journey, 1 without a surge provider or
+// when it fails: a missed surge is better than a failed order.
+func (s *OrderService) surge(tenant string, details CreateOrderDetails, at time.Time) float64 {
+	if s.config.Surge == nil {
+		return 1
+	}
+	multiplier, err := s.config.Surge.Multiplier(s.Context, SurgeInput{TenantID: tenant, Origin: details.Origin,
+		Destination: details.Destination, Time: at.UTC()})
+	if err != nil {
+		surgeFailures.Add(1)
+		fmt.Printf("Surge: tenant %q: %s, pricing without surge\n", tenant, err)
+		return 1
+	}
+	return multiplier
+}
+
+// applySurge returns price times multiplier, rounded to the nearest minor
+// unit.
+func applySurge(price int64, multiplier float64) int64 {
+	return int64(math.Round(float64(price) * multiplier))
+}
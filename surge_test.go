@@ -0,0 +1,97 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseSurgeRules(t *testing.T) {
+	rules, err := parseSurgeRules("mon-fri 07:00-09:30 1.5; sat,sun 20:00-24:00 1.2; fri-mon 23:00-24:00 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := surgeRules{rules: rules, location: time.UTC}
+	for at, expected := range map[string]float64{
+		"2024-01-15T07:00:00Z": 1.5, // Monday.
+		"2024-01-15T09:30:00Z": 1,
+		"2024-01-19T08:00:00Z": 1.5, // Friday.
+		"2024-01-20T08:00:00Z": 1,   // Saturday.
+		"2024-01-20T23:59:00Z": 1.2,
+		"2024-01-16T23:30:00Z": 1, // Tuesday.
+		"2024-01-15T23:30:00Z": 3,
+	} {
+		when, _ := time.Parse(time.RFC3339, at)
+		if m, err := provider.Multiplier(context.Background(), SurgeInput{Time: when}); err != nil || m != expected {
+			t.Errorf("at %s: expected %v, got %v, %v", at, expected, m, err)
+		}
+	}
+
+	for _, spec := range []string{
+		"mon 07:00-09:00",
+		"someday 07:00-09:00 1.5",
+		"mon 09:00-07:00 1.5",
+		"mon 07:00-25:00 1.5",
+		"mon 07:00-09:00 0",
+		"mon 07:00-09:00 11",
+	} {
+		if _, err := parseSurgeRules(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+	if _, err := newSurgeProvider("mon 07:00-09:00 1.5", "UTC", "http://surge", nil); err == nil {
+		t.Error("expected -surge-rules and -surge-url to be exclusive")
+	}
+}
+
+func TestSurgePricing(t *testing.T) {
+	multiplier := 1.5
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var input SurgeInput
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil || input.TenantID != "acme" {
+			w.WriteHeader(400)
+			return
+		}
+		if multiplier == 0 {
+			w.WriteHeader(500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]float64{"multiplier": multiplier})
+	}))
+	defer hook.Close()
+	svc := newTestService(t, Config{Tariff: Tariff{BaseFare: 250, PerKm: 120, Currency: "USD"},
+		Surge: surgeHook{client: hook.Client(), url: hook.URL}})
+
+	w := serve(svc, "POST", "/orders/quote", "acme", createOrderDetails)
+	var quote Quote
+	if err := json.NewDecoder(w.Body).Decode(&quote); err != nil || w.Code != 200 {
+		t.Fatalf("POST /orders/quote returned %d, %v", w.Code, err)
+	}
+	if quote.Price != 702 || quote.Breakdown.Surge != 1.5 {
+		t.Errorf("expected 468 surged to 702, got %+v", quote)
+	}
+
+	w = serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	var order OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 702 || order.Surge != 1.5 {
+		t.Fatalf("unexpected order %+v, %v", order, err)
+	}
+	w = serve(svc, "GET", "/orders/1", "acme", "")
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Surge != 1.5 {
+		t.Errorf("expected the surge recorded on the order, got %+v, %v", order, err)
+	}
+
+	// A failing hook prices without surge.
+	multiplier = 0
+	w = serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	order = OrderDTO{}
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 468 || order.Surge != 0 {
+		t.Errorf("expected no surge, got %+v, %v", order, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons orders leave the orders table, see Tombstone.
+const (
+	tombstoneArchived = "archived" // Moved to orders_archive, still readable by id.
+	tombstonePurged   = "purged"   // Deleted past its tenant's retention.
+)
+
+// Tombstone records an order gone from listings, so that mirrors of the
+// orders table can drop it.
+type Tombstone struct {
+	ID        int64     `json:"id"` // Of the order.
+	Reason    string    `json:"reason"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// syncCursor is a sync point of GET /orders?updated_since=: the last event
+// and tombstone seen. Clients get it as an opaque string.
+type syncCursor struct {
+	Event     int64
+	Tombstone int64
+}
+
+func (c syncCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Event, c.Tombstone)))
+}
+
+// parseSyncCursor parses a cursor made by syncCursor.String.
+func parseSyncCursor(value string) (syncCursor, error) {
+	var cursor syncCursor
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	parts := strings.Split(string(decoded), ".")
+	if err != nil || len(parts) != 2 {
+		return cursor, fmt.Errorf("invalid cursor %q", value)
+	}
+	cursor.Event, err = strconv.ParseInt(parts[0], 10, 64)
+	if err == nil {
+		cursor.Tombstone, err = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if err != nil || cursor.Event < 0 || cursor.Tombstone < 0 {
+		return cursor, fmt.Errorf("invalid cursor %q", value)
+	}
+	return cursor, nil
+}
+
+// OrderChanges is the body of GET /orders?updated_since=.
+type OrderChanges struct {
+	// Orders changed since the sync point, with their current values, least
+	// recently changed first. An order changed again later is listed again.
+	Orders  interface{} `json:"orders"`
+	Deleted []Tombstone `json:"deleted"` // Orders gone since the sync point.
+	Cursor  string      `json:"cursor"`  // updated_since of the next request.
+	HasMore bool        `json:"has_more"`
+}
+
+// recordTombstones records tombstones for reason of the orders selected by
+// query, a SELECT of their id and tenant_id, in tx.
+func recordTombstones(tx *sql.Tx, reason string, now time.Time, query string, args ...interface{}) error {
+	_, err := tx.Exec(`INSERT INTO order_tombstones (order_id, tenant_id, reason, deleted_at)
+		SELECT id, tenant_id, ?, ? FROM (`+query+`)`, append([]interface{}{reason, now.Unix()}, args...)...)
+	if err != nil {
+		return fmt.Errorf("unable to record %s tombstones: %s", reason, err)
+	}
+	return nil
+}
+
+// cursorAt returns the sync point of the changes made before t.
+func (s *OrderService) cursorAt(t time.Time) (syncCursor, error) {
+	var cursor syncCursor
+	err := s.DB.QueryRow(`SELECT (SELECT COALESCE(MAX(id), 0) FROM events WHERE created_at < ?),
+		(SELECT COALESCE(MAX(id), 0) FROM order_tombstones WHERE deleted_at < ?)`, t.Unix(), t.Unix()).
+		Scan(&cursor.Event, &cursor.Tombstone)
+	if err != nil {
+		return cursor, fmt.Errorf("unable to find the sync point of %s: %s", t.Format(time.RFC3339), err)
+	}
+	return cursor, nil
+}
+
+// seqScanner scans an order selected with orderColumns followed by the id of
+// its last event.
+type seqScanner struct {
+	rows *sql.Rows
+	seq  *int64
+}
+
+func (s seqScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.seq)...)
+}
+
+// ChangesSince returns up to limit orders changed, and up to limit orders
+// deleted, after cursor, of tenant if set. Times of the orders are in loc.
+func (s *OrderService) ChangesSince(tenant *string, cursor syncCursor, fields Fieldset, loc *time.Location,
+	limit int) (_ *OrderChanges, err error) {
+	defer observeStore("ChangesSince", time.Now(), &err)
+	rows, err := s.DB.Query(`SELECT `+orderColumns+`, changed.seq FROM orders
+		JOIN (SELECT order_id, MAX(id) AS seq FROM events WHERE id > ? GROUP BY order_id) changed
+		ON changed.order_id = orders.id WHERE orders.tenant_id = COALESCE(?, orders.tenant_id) ORDER BY changed.seq LIMIT ?`, cursor.Event, tenant,
+		limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query changed orders: %s", err)
+	}
+	defer rows.Close()
+	var orders []Order
+	for rows.Next() {
+		order, err := scanOrder(s.config.FieldKey, seqScanner{rows: rows, seq: &cursor.Event})
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *localize(order, loc))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query changed orders: %s", err)
+	}
+
+	tombstones, err := s.DB.Query(`SELECT id, order_id, reason, deleted_at FROM order_tombstones WHERE id > ?
+		AND tenant_id = COALESCE(?, tenant_id) ORDER BY id LIMIT ?`, cursor.Tombstone, tenant, limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query tombstones: %s", err)
+	}
+	defer tombstones.Close()
+	changes := &OrderChanges{Orders: fields.Apply(orders), Deleted: []Tombstone{}}
+	for tombstones.Next() {
+		var (
+			tombstone Tombstone
+			deletedAt int64
+		)
+		if err := tombstones.Scan(&cursor.Tombstone, &tombstone.ID, &tombstone.Reason, &deletedAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		tombstone.DeletedAt = time.Unix(deletedAt, 0).UTC()
+		changes.Deleted = append(changes.Deleted, tombstone)
+	}
+	if err := tombstones.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query tombstones: %s", err)
+	}
+	changes.Cursor = cursor.String()
+	changes.HasMore = len(orders) == limit || len(changes.Deleted) == limit
+	return changes, nil
+}
+
+// handleOrdersSince serves GET /orders?updated_since=, where updated_since
+// is an RFC 3339 time or the cursor of the previous response.
+func (s *OrderService) handleOrdersSince(w http.ResponseWriter, req *http.Request, filter OrderFilter,
+	fields Fieldset) {
+	query := req.URL.Query()
+	if filter != (OrderFilter{}) || query.Get("page") != "" {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+			Detail: "updated_since can't be combined with filters or page"}, "updated_since with %+v", filter)
+		return
+	}
+	_, limit, err := parseQueryParametersForList(query, s.listLimits(req))
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: err.Error()}, "invalid params")
+		return
+	}
+	since := query.Get("updated_since")
+	var cursor syncCursor
+	if t, parseErr := time.Parse(time.RFC3339, since); parseErr == nil {
+		cursor, err = s.cursorAt(t)
+		if err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "cursorAt(): %s", err)
+			return
+		}
+	} else if cursor, err = parseSyncCursor(since); err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+			Detail: "updated_since must be an RFC 3339 time or a cursor"}, "%s", err)
+		return
+	}
+	changes, err := s.ChangesSince(s.orderScope(req), cursor, fields, s.requestLocation(req), limit)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "ChangesSince(): %s", err)
+		return
+	}
+	respond(w, req, 200, changes, "changes since %+v, next %s", cursor, changes.Cursor)
+}
@@ -0,0 +1,94 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOrdersUpdatedSince(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for i := 0; i < 3; i++ {
+		if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	changesSince := func(since, query string) OrderChanges {
+		t.Helper()
+		w := serve(svc, "GET", "/orders?updated_since="+url.QueryEscape(since)+query, "", "")
+		if w.Code != 200 {
+			t.Fatalf("GET /orders?updated_since=%s%s returned %d: %s", since, query, w.Code, w.Body)
+		}
+		var changes struct {
+			OrderChanges
+			Orders []OrderDTO `json:"orders"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil {
+			t.Fatal(err)
+		}
+		changes.OrderChanges.Orders = changes.Orders
+		return changes.OrderChanges
+	}
+	ids := func(changes OrderChanges) []int64 {
+		var ids []int64
+		for _, order := range changes.Orders.([]OrderDTO) {
+			ids = append(ids, order.ID)
+		}
+		return ids
+	}
+
+	first := changesSince(time.Now().Add(-time.Hour).Format(time.RFC3339), "&limit=2")
+	if got := ids(first); len(got) != 2 || got[0] != 1 || got[1] != 2 || !first.HasMore {
+		t.Fatalf("first page %v %+v", got, first)
+	}
+	second := changesSince(first.Cursor, "&limit=2")
+	if got := ids(second); len(got) != 1 || got[0] != 3 || second.HasMore {
+		t.Fatalf("second page %v %+v", got, second)
+	}
+	if got := changesSince(second.Cursor, ""); len(ids(got)) != 0 || got.Cursor != second.Cursor {
+		t.Errorf("nothing changed, got %+v", got)
+	}
+
+	// A change lists the order again, archiving and purging leave tombstones.
+	if err := svc.Take(1); err != nil {
+		t.Fatal(err)
+	}
+	changes := changesSince(second.Cursor, "")
+	if got := ids(changes); len(got) != 1 || got[0] != 1 || changes.Orders.([]OrderDTO)[0].Status != StateTaken {
+		t.Errorf("taken order %+v", changes)
+	}
+	a := newArchiver(ArchiveConfig{After: time.Hour}, svc.DB)
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if n, err := a.archive(context.Background()); err != nil || n != 1 {
+		t.Fatalf("archived %d orders, %v", n, err)
+	}
+	if n, err := newPurger(RetentionConfig{}, svc.DB, svc.config.FieldKey).purgeTenant(context.Background(), "",
+		time.Now().Add(time.Hour)); err != nil || n != 3 {
+		t.Fatalf("purged %d orders, %v", n, err)
+	}
+	changes = changesSince(changes.Cursor, "")
+	if len(ids(changes)) != 0 || len(changes.Deleted) != 3 {
+		t.Fatalf("after archiving and purging %+v", changes)
+	}
+	for idx, want := range []Tombstone{{ID: 1, Reason: tombstoneArchived}, {ID: 2, Reason: tombstonePurged},
+		{ID: 3, Reason: tombstonePurged}} {
+		if got := changes.Deleted[idx]; got.ID != want.ID || got.Reason != want.Reason {
+			t.Errorf("tombstone %d is %+v, want %+v", idx, got, want)
+		}
+	}
+	if got := changesSince(time.Now().Add(-time.Hour).Format(time.RFC3339), ""); len(got.Deleted) != 3 {
+		t.Errorf("tombstones since a time %+v", got)
+	}
+
+	for _, query := range []string{"updated_since=yesterday", "updated_since=" + first.Cursor + "&status=TAKEN",
+		"updated_since=" + first.Cursor + "&page=2"} {
+		if w := serve(svc, "GET", "/orders?"+query, "", ""); w.Code != 400 {
+			t.Errorf("GET /orders?%s returned %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// channelSMS is the channel of text messages, the only one notifications are
+// sent on.
+const channelSMS = "sms"
+
+// maxTemplateLength is the longest notification template in bytes, about
+// what 10 concatenated text messages hold.
+const maxTemplateLength = 1600
+
+// notificationChannels are the default templates per channel and event type.
+// Only the event types listed are notified.
+var notificationChannels = map[string]map[EventType]string{
+	channelSMS: defaultSMSTemplates,
+}
+
+// NotificationTemplate is an item of GET /admin/tenants/{tenant}/templates.
+type NotificationTemplate struct {
+	Channel  string    `json:"channel"`
+	Event    EventType `json:"event"`
+	Template string    `json:"template"` // A text/template of NotificationData.
+	Default  bool      `json:"default"`  // Whether the tenant has no template of its own.
+}
+
+// parseNotificationTemplate parses text and checks that it executes with
+// sample data, so mistakes show when a template is set rather than when it
+// is sent.
+func parseNotificationTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	eta := time.Now().UTC()
+	sample := NotificationData{OrderID: 1, TenantID: "tenant", Status: StateTaken, ETA: &eta}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// NotificationTemplates returns the templates of tenant on every channel and
+// event type, its own or the defaults.
+func (s *OrderService) NotificationTemplates(tenant string) ([]NotificationTemplate, error) {
+	rows, err := s.DB.Query("SELECT channel, event_type, template FROM notification_templates WHERE tenant_id = ?",
+		tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query templates of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	own := map[string]string{}
+	for rows.Next() {
+		var channel, eventType, text string
+		if err := rows.Scan(&channel, &eventType, &text); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		own[channel+"/"+eventType] = text
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query templates of tenant %q: %s", tenant, err)
+	}
+
+	templates := []NotificationTemplate{}
+	for _, channel := range []string{channelSMS} {
+		for _, eventType := range []EventType{EventCreated, EventTaken} {
+			text, ok := own[channel+"/"+string(eventType)]
+			if !ok {
+				text = notificationChannels[channel][eventType]
+			}
+			templates = append(templates, NotificationTemplate{Channel: channel, Event: eventType, Template: text,
+				Default: !ok})
+		}
+	}
+	return templates, nil
+}
+
+// loadNotificationTemplates returns the parsed templates of tenant on
+// channel per event type. Templates that no longer parse fall back to the
+// default.
+func loadNotificationTemplates(db *sql.DB, tenant, channel string) (map[EventType]*template.Template, error) {
+	templates := map[EventType]*template.Template{}
+	for eventType, text := range notificationChannels[channel] {
+		templates[eventType] = template.Must(template.New(string(eventType)).Parse(text))
+	}
+	rows, err := db.Query("SELECT event_type, template FROM notification_templates WHERE tenant_id = ? AND channel = ?",
+		tenant, channel)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query templates of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var eventType, text string
+		if err := rows.Scan(&eventType, &text); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		tmpl, err := parseNotificationTemplate(eventType, text)
+		if err != nil {
+			fmt.Printf("Notifications: tenant %q %s %s template: %s, using the default\n", tenant, channel,
+				eventType, err)
+			continue
+		}
+		templates[EventType(eventType)] = tmpl
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query templates of tenant %q: %s", tenant, err)
+	}
+	return templates, nil
+}
+
+// SetNotificationTemplate sets the template of tenant for an event type on
+// channel, an empty text reverts to the default.
+func (s *OrderService) SetNotificationTemplate(tenant, channel string, eventType EventType, text string) error {
+	var err error
+	if text == "" {
+		_, err = s.DB.Exec("DELETE FROM notification_templates WHERE tenant_id = ? AND channel = ? AND event_type = ?",
+			tenant, channel, string(eventType))
+	} else {
+		_, err = s.DB.Exec(`INSERT INTO notification_templates (tenant_id, channel, event_type, template)
+			VALUES (?, ?, ?, ?) ON CONFLICT (tenant_id, channel, event_type) DO UPDATE SET template = excluded.template`,
+			tenant, channel, string(eventType), text)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set %s %s template of tenant %q: %s", channel, eventType, tenant, err)
+	}
+	return nil
+}
+
+// handleTenantTemplates serves /admin/tenants/{tenant}/templates.
+//
+//	GET    /admin/tenants/{tenant}/templates                  lists them.
+//	PUT    /admin/tenants/{tenant}/templates/{channel}/{event}  sets one,
+//	       {"template": "Order {{.OrderID}} is on its way."}.
+//	DELETE /admin/tenants/{tenant}/templates/{channel}/{event}  reverts it to
+//	       the default.
+func (s *OrderService) handleTenantTemplates(w http.ResponseWriter, req *http.Request, tenant, channel,
+	eventType string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if channel != "" {
+		if _, ok := notificationChannels[channel][EventType(eventType)]; !ok {
+			respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_TEMPLATE"}, "%s/%s", channel, eventType)
+			return
+		}
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var text string
+		if req.Method == http.MethodPut {
+			var buf bytes.Buffer
+			io.Copy(&buf, req.Body)
+			var body struct {
+				Template string `json:"template"`
+			}
+			if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+				return
+			}
+			if text = body.Template; strings.TrimSpace(text) == "" || len(text) > maxTemplateLength {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_TEMPLATE",
+					Detail: fmt.Sprintf("template must be 1 to %d bytes", maxTemplateLength)}, "%d bytes", len(text))
+				return
+			}
+			if _, err := parseNotificationTemplate(eventType, text); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_TEMPLATE", Detail: err.Error()}, "%s", err)
+				return
+			}
+		}
+		if err := s.SetNotificationTemplate(tenant, channel, EventType(eventType), text); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetNotificationTemplate(): %s", err)
+			return
+		}
+	}
+	templates, err := s.NotificationTemplates(tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "NotificationTemplates(): %s", err)
+		return
+	}
+	respond(w, req, 200, templates, "tenant %q %d templates", tenant, len(templates))
+}
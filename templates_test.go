@@ -0,0 +1,71 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// recordingNotifier keeps the messages it is given.
+type recordingNotifier struct{ messages []string }
+
+func (n *recordingNotifier) Notify(ctx context.Context, to, message string) error {
+	n.messages = append(n.messages, to+": "+message)
+	return nil
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	tests := []struct {
+		name, method, path, body string
+		code                     int
+	}{
+		{"set", "PUT", "/admin/tenants/acme/templates/sms/created", `{"template": "{{.TenantID}} got order {{.OrderID}}"}`, 200},
+		{"syntax error", "PUT", "/admin/tenants/acme/templates/sms/taken", `{"template": "{{.OrderID"}`, 400},
+		{"unknown field", "PUT", "/admin/tenants/acme/templates/sms/taken", `{"template": "{{.Courier}}"}`, 400},
+		{"empty", "PUT", "/admin/tenants/acme/templates/sms/taken", `{"template": " "}`, 400},
+		{"unknown channel", "PUT", "/admin/tenants/acme/templates/email/taken", `{"template": "hi"}`, 404},
+		{"not notified", "PUT", "/admin/tenants/acme/templates/sms/updated", `{"template": "hi"}`, 404},
+		{"set and revert", "PUT", "/admin/tenants/acme/templates/sms/taken", `{"template": "on its way"}`, 200},
+		{"revert", "DELETE", "/admin/tenants/acme/templates/sms/taken", "", 200},
+	}
+	for _, test := range tests {
+		if w := serveAdmin(svc, test.method, test.path, test.body); w.Code != test.code {
+			t.Errorf("%s: got %d, want %d: %s", test.name, w.Code, test.code, w.Body)
+		}
+	}
+
+	w := serveAdmin(svc, "GET", "/admin/tenants/acme/templates", "")
+	var templates []NotificationTemplate
+	if err := json.Unmarshal(w.Body.Bytes(), &templates); err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 2 || templates[0].Event != EventCreated || templates[0].Default ||
+		templates[1].Event != EventTaken || !templates[1].Default || templates[1].Template != defaultSMSTemplates[EventTaken] {
+		t.Errorf("templates %s", w.Body)
+	}
+
+	notifier := &recordingNotifier{}
+	dispatcher, err := newSMSDispatcher(0, svc.DB, svc.config.FieldKey, notifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/notifications", `{"sms": true}`); w.Code != 200 {
+		t.Fatalf("enabling SMS returned %d", w.Code)
+	}
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if _, err := svc.Update(1, []byte(`{"metadata": {"phone": "+15551234567"}}`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dispatcher.dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.messages) != 1 || notifier.messages[0] != "+15551234567: acme got order 1" {
+		t.Errorf("messages %q", notifier.messages)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// tenantHeader names the request header identifying the tenant an API call is
+// made on behalf of. Requests without it belong to the default tenant "".
+const tenantHeader = "X-Tenant-ID"
+
+// TenantSettings are the per-tenant overrides stored in the tenant_settings
+// table. Empty values fall back to the global configuration.
+type TenantSettings struct {
+	TenantID         string
+	DistanceProvider string // One of "google" or "haversine".
+	MapsAPIKey       string // Tenant's own Google Maps API key, SECRET.
+	// Requests of the tenant must be signed with this key, SECRET. See
+	// signatureHeader.
+	SigningSecret string
+	// Orders the tenant may create per day and month of TimeZone, 0 is
+	// unlimited. NULL falls back to Config.OrderQuota.
+	DailyOrderQuota   sql.NullInt64
+	MonthlyOrderQuota sql.NullInt64
+	// Days orders of the tenant are kept, 0 is forever. NULL falls back to
+	// Config.Retention.
+	RetentionDays sql.NullInt64
+	// Seconds orders of the tenant must be taken within, NULL for no SLA.
+	TakeSLASeconds sql.NullInt64
+	// Text customers about their orders, see smsDispatcher.
+	SMSNotifications bool
+	// JSON Policy of the tenant, empty for none.
+	Policy string
+	// JSON PricingRules of the tenant, empty to price by the tariff only.
+	Pricing string
+	// Orders of the tenant may only be taken once paid.
+	RequirePrepayment bool
+	// IANA time zone of the tenant's business day, empty for UTC. Times are
+	// stored in UTC and rendered in it.
+	TimeZone string
+}
+
+// tenantFromRequest returns the tenant a request is made on behalf of, the
+// tenant of its API key if it has one.
+func tenantFromRequest(req *http.Request) string {
+	if key := apiKeyFromRequest(req); key != nil {
+		return key.TenantID
+	}
+	return strings.TrimSpace(req.Header.Get(tenantHeader))
+}
+
+// orderScope returns the tenant whose orders req may reach, or nil if it may
+// reach the orders of every tenant. Only staff, the admin token and dashboard
+// users, without an API key may.
+func (s *OrderService) orderScope(req *http.Request) *string {
+	if apiKeyFromRequest(req) == nil && (dashboardUserFromRequest(req) != nil || s.isAdmin(req)) {
+		return nil
+	}
+	tenant := tenantFromRequest(req)
+	return &tenant
+}
+
+// loadTenantSettings returns the settings for tenant, its secrets decrypted
+// with key, the Config.FieldKey. A tenant without a row in tenant_settings
+// gets empty settings, i.e. the global defaults.
+func loadTenantSettings(db *sql.DB, key []byte, tenant string) (*TenantSettings, error) {
+	settings := &TenantSettings{TenantID: tenant}
+	if tenant == "" {
+		return settings, nil
+	}
+	var (
+		provider, mapsKey, signingSecret, policy, pricing, timeZone sql.NullString
+		sms, prepayment                                             sql.NullBool
+	)
+	err := db.QueryRow(`SELECT distance_provider, maps_api_key, signing_secret, daily_order_quota,
+		monthly_order_quota, retention_days, take_sla_seconds, sms_notifications, policy, pricing,
+		require_prepayment, time_zone FROM tenant_settings WHERE tenant_id = ?`, tenant).Scan(&provider, &mapsKey,
+		&signingSecret, &settings.DailyOrderQuota, &settings.MonthlyOrderQuota, &settings.RetentionDays,
+		&settings.TakeSLASeconds, &sms, &policy, &pricing, &prepayment, &timeZone)
+	switch {
+	case err == sql.ErrNoRows:
+		return settings, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to load settings for tenant %q: %s", tenant, err)
+	}
+	settings.DistanceProvider = provider.String
+	plaintext, err := openField(key, []byte(mapsKey.String))
+	if err != nil {
+		return nil, fmt.Errorf("invalid maps_api_key of tenant %q: %s", tenant, err)
+	}
+	settings.MapsAPIKey = string(plaintext)
+	if plaintext, err = openField(key, []byte(signingSecret.String)); err != nil {
+		return nil, fmt.Errorf("invalid signing_secret of tenant %q: %s", tenant, err)
+	}
+	settings.SigningSecret = string(plaintext)
+	settings.SMSNotifications = sms.Bool
+	settings.Policy = policy.String
+	settings.Pricing = pricing.String
+	settings.RequirePrepayment = prepayment.Bool
+	settings.TimeZone = timeZone.String
+	return settings, nil
+}
+
+// handleTenants serves the per-tenant admin endpoints under /admin/tenants/.
+func (s *OrderService) handleTenants(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/admin/tenants/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+		return
+	}
+	tenant := parts[0]
+	switch {
+	case parts[1] == "keys" && len(parts) == 2:
+		s.handleTenantKeys(w, req, tenant, "")
+	case parts[1] == "keys" && len(parts) == 3 && parts[2] != "":
+		s.handleTenantKeys(w, req, tenant, parts[2])
+	case parts[1] == "usage" && len(parts) == 2:
+		s.handleTenantUsage(w, req, tenant)
+	case parts[1] == "retention" && len(parts) == 2:
+		s.handleTenantRetention(w, req, tenant)
+	case parts[1] == "sla" && len(parts) == 2:
+		s.handleTenantSLA(w, req, tenant)
+	case parts[1] == "sla" && len(parts) == 3 && parts[2] == "breaches":
+		s.handleTenantSLABreaches(w, req, tenant)
+	case parts[1] == "time-zone" && len(parts) == 2:
+		s.handleTenantTimeZone(w, req, tenant)
+	case parts[1] == "distance" && len(parts) == 2:
+		s.handleTenantDistance(w, req, tenant)
+	case parts[1] == "areas" && len(parts) == 2:
+		s.handleTenantAreas(w, req, serviceAreasTable, tenant, "")
+	case parts[1] == "areas" && len(parts) == 3:
+		s.handleTenantAreas(w, req, serviceAreasTable, tenant, parts[2])
+	case parts[1] == "zones" && len(parts) == 2:
+		s.handleTenantAreas(w, req, pricingZonesTable, tenant, "")
+	case parts[1] == "zones" && len(parts) == 3:
+		s.handleTenantAreas(w, req, pricingZonesTable, tenant, parts[2])
+	case parts[1] == "pricing" && len(parts) == 2:
+		s.handleTenantPricing(w, req, tenant)
+	case parts[1] == "courier-preferences" && len(parts) == 2:
+		s.handleTenantCourierPreferences(w, req, tenant)
+	case parts[1] == "couriers" && len(parts) == 2:
+		s.handleTenantCouriers(w, req, tenant, "")
+	case parts[1] == "couriers" && len(parts) == 3 && parts[2] != "":
+		s.handleTenantCouriers(w, req, tenant, parts[2])
+	case parts[1] == "promotions" && len(parts) == 2:
+		s.handleTenantPromotions(w, req, tenant, "")
+	case parts[1] == "promotions" && len(parts) == 3:
+		s.handleTenantPromotions(w, req, tenant, parts[2])
+	case parts[1] == "alerts" && len(parts) == 2:
+		s.handleTenantAlerts(w, req, tenant)
+	case parts[1] == "email-senders" && len(parts) == 2:
+		s.handleTenantEmailSenders(w, req, tenant, "")
+	case parts[1] == "email-senders" && len(parts) == 3:
+		s.handleTenantEmailSenders(w, req, tenant, parts[2])
+	case parts[1] == "feed" && len(parts) == 2:
+		s.handleTenantFeed(w, req, tenant, false)
+	case parts[1] == "feed" && len(parts) == 3 && parts[2] == "rows":
+		s.handleTenantFeed(w, req, tenant, true)
+	case parts[1] == "stores" && len(parts) == 2:
+		s.handleTenantStores(w, req, tenant, "")
+	case parts[1] == "stores" && len(parts) == 3 && parts[2] != "":
+		s.handleTenantStores(w, req, tenant, parts[2])
+	case parts[1] == "payments" && len(parts) == 2:
+		s.handleTenantPayments(w, req, tenant)
+	case parts[1] == "notifications" && len(parts) == 2:
+		s.handleTenantNotifications(w, req, tenant)
+	case parts[1] == "policy" && len(parts) == 2:
+		s.handleTenantPolicy(w, req, tenant)
+	case parts[1] == "templates" && len(parts) == 2:
+		s.handleTenantTemplates(w, req, tenant, "", "")
+	case parts[1] == "templates" && len(parts) == 4:
+		s.handleTenantTemplates(w, req, tenant, parts[2], parts[3])
+	default:
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+	}
+}
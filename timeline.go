@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Kinds of TimelineEntry.
+const (
+	timelineEvent = "event"
+	timelineAudit = "audit"
+)
+
+// TimelineEntry is an item of GET /orders/{id}/timeline: an event of the
+// order or an entry of its audit log.
+type TimelineEntry struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// The EventType of events, the action of audit log entries.
+	Type  string          `json:"type"`
+	Actor string          `json:"actor,omitempty"` // Who made an audited change.
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Timeline returns the events and audit log of an order in one list, oldest
+// first. Events come before audit log entries of the same second, as they
+// are recorded first. Returns errNoSuchOrder if the order has no events.
+func (s *OrderService) Timeline(orderID int64) ([]TimelineEntry, error) {
+	events, err := s.History(orderID)
+	if err != nil {
+		return nil, err
+	}
+	var timeline []TimelineEntry
+	for _, event := range events {
+		timeline = append(timeline, TimelineEntry{Time: event.Time, Kind: timelineEvent, Type: string(event.Type),
+			Data: event.Data})
+	}
+
+	rows, err := s.DB.Query("SELECT action, actor, details, created_at FROM audit_log WHERE order_id = ? ORDER BY id",
+		orderID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query audit log: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			entry     = TimelineEntry{Kind: timelineAudit}
+			details   []byte
+			createdAt int64
+		)
+		if err := rows.Scan(&entry.Type, &entry.Actor, &details, &createdAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if len(details) > 0 {
+			entry.Data = json.RawMessage(details)
+		}
+		entry.Time = time.Unix(createdAt, 0).UTC()
+		timeline = append(timeline, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to query audit log: %s", err)
+	}
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].Time.Before(timeline[j].Time) })
+	return timeline, nil
+}
+
+// handleTimeline serves GET /orders/{id}/timeline.
+func (s *OrderService) handleTimeline(w http.ResponseWriter, req *http.Request, orderID int64) {
+	timeline, err := s.Timeline(orderID)
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case nil:
+		respond(w, req, 200, timeline, "order %d timeline, %d entries", orderID, len(timeline))
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Timeline() %d failed: %s", orderID, err)
+	}
+}
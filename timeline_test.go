@@ -0,0 +1,55 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimeline(t *testing.T) {
+	svc := newTestService(t, Config{})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	if w := servePatch(svc, "/orders/1", `{"notes": "ring twice"}`); w.Code != 200 {
+		t.Fatalf("merge patch returned %d: %s", w.Code, w.Body)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Fatalf("take returned %d: %s", w.Code, w.Body)
+	}
+
+	w := serve(svc, "GET", "/orders/1/timeline", "", "")
+	if w.Code != 200 {
+		t.Fatalf("GET timeline returned %d", w.Code)
+	}
+	var timeline []TimelineEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &timeline); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i, entry := range timeline {
+		got = append(got, entry.Kind+":"+entry.Type)
+		if i > 0 && entry.Time.Before(timeline[i-1].Time) {
+			t.Errorf("entry %d is older than the one before", i)
+		}
+	}
+	want := []string{"event:created", "event:updated", "event:taken", "audit:update"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+	if audit := timeline[3]; audit.Actor != "tenant:" || len(audit.Data) == 0 {
+		t.Errorf("audit entry %+v", audit)
+	}
+
+	if w := serve(svc, "GET", "/orders/2/timeline", "", ""); w.Code != 404 {
+		t.Errorf("GET timeline of a missing order returned %d", w.Code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// localTimeLayout is how clients may give times in their tenant's time zone,
+// RFC 3339 without an offset.
+const localTimeLayout = "2006-01-02T15:04:05"
+
+// TimeZoneSetting is the body of GET and PUT /admin/tenants/{tenant}/time-zone.
+type TimeZoneSetting struct {
+	// IANA name such as "America/New_York", null for UTC.
+	TimeZone *string `json:"time_zone"`
+}
+
+// loadTimeZone returns the location named by an IANA time zone name. Unlike
+// time.LoadLocation it refuses "Local", which depends on the server.
+func loadTimeZone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// location returns the time zone of the tenant, UTC if it has none.
+func (t *TenantSettings) location() *time.Location {
+	if t.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := loadTimeZone(t.TimeZone)
+	if err != nil {
+		// Checked by SetTimeZone, the zone left the tz database since.
+		fmt.Printf("tenant %q: %s, using UTC\n", t.TenantID, err)
+		return time.UTC
+	}
+	return loc
+}
+
+// tenantLocation returns the time zone of tenant, UTC if it has none.
+func tenantLocation(q querier, tenant string) (*time.Location, error) {
+	settings := &TenantSettings{TenantID: tenant}
+	var name sql.NullString
+	err := q.QueryRow("SELECT time_zone FROM tenant_settings WHERE tenant_id = ?", tenant).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("unable to load time zone of tenant %q: %s", tenant, err)
+	}
+	settings.TimeZone = name.String
+	return settings.location(), nil
+}
+
+// requestLocation returns the time zone of the tenant req is made on behalf
+// of, times in responses are rendered in it. Falls back to UTC.
+func (s *OrderService) requestLocation(req *http.Request) *time.Location {
+	loc, err := tenantLocation(s.DB, tenantFromRequest(req))
+	if err != nil {
+		fmt.Printf("requestLocation: %s\n", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// parseLocalTime parses an RFC 3339 time, or one without an offset in loc.
+func parseLocalTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(localTimeLayout, value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC 3339 nor %s in %s", value, localTimeLayout, loc)
+	}
+	return t, nil
+}
+
+// localize returns order with its times in loc, a copy if any changed.
+func localize(order *Order, loc *time.Location) *Order {
+	if order.ScheduledAt == nil || order.ScheduledAt.Location() == loc {
+		return order
+	}
+	local := *order
+	scheduledAt := order.ScheduledAt.In(loc)
+	local.ScheduledAt = &scheduledAt
+	return &local
+}
+
+// businessDay returns the start of the day of t in loc and of the next one.
+func businessDay(t time.Time, loc *time.Location) (start, end time.Time) {
+	t = t.In(loc)
+	start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// SetTimeZone sets the IANA time zone of tenant, empty for UTC.
+func (s *OrderService) SetTimeZone(tenant, name string) error {
+	if name != "" {
+		if _, err := loadTimeZone(name); err != nil {
+			return err
+		}
+	}
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, time_zone) VALUES (?, NULLIF(?, ''))
+		ON CONFLICT (tenant_id) DO UPDATE SET time_zone = excluded.time_zone`, tenant, name)
+	if err != nil {
+		return fmt.Errorf("unable to set time zone of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantTimeZone serves /admin/tenants/{tenant}/time-zone.
+//
+//	GET /admin/tenants/{tenant}/time-zone  returns the TimeZoneSetting.
+//	PUT /admin/tenants/{tenant}/time-zone  sets it, {"time_zone": "Europe/Berlin"},
+//	                                       or {"time_zone": null} for UTC.
+func (s *OrderService) handleTenantTimeZone(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var setting TimeZoneSetting
+		if err := json.Unmarshal(buf.Bytes(), &setting); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		var name string
+		if setting.TimeZone != nil {
+			name = *setting.TimeZone
+			if _, err := loadTimeZone(name); name == "" || err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS",
+					Detail: "time_zone must be an IANA time zone such as Europe/Berlin"}, "time_zone %q", name)
+				return
+			}
+		}
+		if err := s.SetTimeZone(tenant, name); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetTimeZone(): %s", err)
+			return
+		}
+	default:
+		respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+		return
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	var setting TimeZoneSetting
+	if settings.TimeZone != "" {
+		setting.TimeZone = &settings.TimeZone
+	}
+	respond(w, req, 200, setting, "tenant %q time zone %q", tenant, settings.TimeZone)
+}
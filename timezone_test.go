@@ -0,0 +1,102 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantTimeZone(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	for _, body := range []string{`{"time_zone": "Mars/Olympus_Mons"}`, `{"time_zone": "Local"}`, `{"time_zone": ""}`} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/time-zone", body); w.Code != 400 {
+			t.Errorf("PUT %s returned %d", body, w.Code)
+		}
+	}
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/time-zone", ""); w.Code != 200 ||
+		strings.TrimSpace(w.Body.String()) != `{"time_zone":null}` {
+		t.Errorf("GET without a time zone returned %d: %s", w.Code, w.Body)
+	}
+	w := serveAdmin(svc, "PUT", "/admin/tenants/acme/time-zone", `{"time_zone": "America/New_York"}`)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"time_zone":"America/New_York"}` {
+		t.Fatalf("PUT returned %d: %s", w.Code, w.Body)
+	}
+
+	// Scheduled times without an offset are New York's, stored in UTC and
+	// rendered with the offset.
+	if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d: %s", w.Code, w.Body)
+	}
+	w = servePatchTenant(svc, "/orders/1", "acme", `{"scheduled_at": "2024-06-01T09:00:00"}`)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"scheduled_at":"2024-06-01T09:00:00-04:00"`) {
+		t.Fatalf("PATCH returned %d: %s", w.Code, w.Body)
+	}
+	var stored int64
+	if err := svc.DB.QueryRow("SELECT scheduled_at FROM orders WHERE id = 1").Scan(&stored); err != nil ||
+		stored != time.Date(2024, 6, 1, 13, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("stored scheduled_at %d: %v", stored, err)
+	}
+	w = serve(svc, "GET", "/orders/1", "acme", "")
+	if !strings.Contains(w.Body.String(), `"scheduled_at":"2024-06-01T09:00:00-04:00"`) {
+		t.Errorf("GET returned %s", w.Body)
+	}
+	// Listings too, in every format.
+	for _, accept := range []string{"", ndjsonMediaType, jsonAPIMediaType} {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.Header.Set(tenantHeader, "acme")
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		if !strings.Contains(w.Body.String(), `"scheduled_at":"2024-06-01T09:00:00-04:00"`) {
+			t.Errorf("GET /orders as %q returned %s", accept, w.Body)
+		}
+	}
+	if w := servePatchTenant(svc, "/orders/1", "acme", `{"scheduled_at": "June 1st"}`); w.Code != 400 {
+		t.Errorf("invalid scheduled_at returned %d", w.Code)
+	}
+
+	// Usage counts the tenant's days.
+	w = serveAdmin(svc, "GET", "/admin/tenants/acme/usage", "")
+	var usage TenantUsage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := time.LoadLocation("America/New_York")
+	if today := time.Now().In(loc).Format("2006-01-02"); usage.TimeZone != "America/New_York" ||
+		usage.Days[today] != 1 {
+		t.Errorf("usage %s, want 1 order on %s", w.Body, today)
+	}
+
+	if w := serveAdmin(svc, "GET", "/admin/tenants/acme/sla/breaches?from=2024-06-01&to=2024-06-01", ""); w.Code != 200 ||
+		!strings.Contains(w.Body.String(), `"from":"2024-06-01T00:00:00-04:00","to":"2024-06-01T23:59:59-04:00"`) {
+		t.Errorf("breaches on a business day returned %d: %s", w.Code, w.Body)
+	}
+
+	w = serveAdmin(svc, "PUT", "/admin/tenants/acme/time-zone", `{"time_zone": null}`)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != `{"time_zone":null}` {
+		t.Errorf("PUT null returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCheckQuotaTimeZone(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 23:30 UTC on the 31st is already the 1st in Tokyo.
+	now := time.Date(2024, 12, 31, 23, 30, 0, 0, time.UTC).In(loc)
+	quota := OrderQuota{Daily: 10, Monthly: 100}
+	exceeded, _ := checkQuota(quota, 11, 50, now).(errQuotaExceeded)
+	if !exceeded.Reset.Equal(time.Date(2025, 1, 2, 0, 0, 0, 0, loc)) {
+		t.Errorf("daily reset %s", exceeded.Reset)
+	}
+	exceeded, _ = checkQuota(quota, 5, 101, now).(errQuotaExceeded)
+	if !exceeded.Reset.Equal(time.Date(2025, 2, 1, 0, 0, 0, 0, loc)) {
+		t.Errorf("monthly reset %s", exceeded.Reset)
+	}
+}
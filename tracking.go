@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trackingSecretEnv names the environment variable holding the key tracking
+// tokens are signed with. Without it tracking links are disabled; changing it
+// invalidates every link handed out.
+const trackingSecretEnv = "ORDERSERVICE_TRACKING_SECRET"
+
+// trackingPath prefixes the public tracking endpoint.
+const trackingPath = "/track/"
+
+// TrackingLink is the body of GET /orders/{id}/tracking.
+type TrackingLink struct {
+	Token string `json:"token"`
+	URL   string `json:"url"` // Path of the tracking endpoint, relative to the service.
+}
+
+// Tracking is the body of GET /track/{token}, what end customers may see of
+// an order.
+type Tracking struct {
+	Status OrderState `json:"status"`
+	// Expected arrival, once the order is taken.
+	ETA         *time.Time `json:"eta,omitempty"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+}
+
+// trackingMAC returns the signature of a tracking token payload.
+func trackingMAC(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("track:" + payload))
+	return mac.Sum(nil)[:16]
+}
+
+// trackingToken returns the tracking token of an order, the order id and its
+// signature, both base64url encoded.
+func trackingToken(secret string, orderID int64) string {
+	payload := strconv.FormatInt(orderID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(trackingMAC(secret, payload))
+}
+
+// parseTrackingToken returns the order id of a tracking token, false if the
+// token is malformed or its signature is wrong.
+func parseTrackingToken(secret, token string) (int64, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, trackingMAC(secret, string(payload))) {
+		return 0, false
+	}
+	orderID, err := strconv.ParseInt(string(payload), 10, 64)
+	return orderID, err == nil
+}
+
+// Tracking returns what end customers may see of an order. The ETA is the
+// time the order was taken plus its expected travel time.
+func (s *OrderService) Tracking(orderID int64) (*Tracking, error) {
+	order, err := s.cachedGet(orderID)
+	if err != nil {
+		return nil, err
+	}
+	tracking := &Tracking{Status: order.State, ScheduledAt: order.ScheduledAt}
+	if order.State != StateTaken {
+		return tracking, nil
+	}
+	events, err := s.History(orderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if event.Type == EventTaken {
+			eta := event.Time.Add(time.Duration(order.Duration) * time.Second).UTC()
+			tracking.ETA = &eta
+		}
+	}
+	return tracking, nil
+}
+
+// handleTrackingLink serves GET /orders/{id}/tracking, the link tenants share
+// with their customers.
+func (s *OrderService) handleTrackingLink(w http.ResponseWriter, req *http.Request, orderID int64) {
+	if s.config.TrackingSecret == "" {
+		respond(w, req, 404, HTTPResponseError{Error: "TRACKING_DISABLED"}, "no %s", trackingSecretEnv)
+		return
+	}
+	if _, err := s.Get(orderID); err == errNoSuchOrder {
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+		return
+	} else if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Get() %d failed: %s", orderID, err)
+		return
+	}
+	token := trackingToken(s.config.TrackingSecret, orderID)
+	respond(w, req, 200, TrackingLink{Token: token, URL: trackingPath + token}, "tracking link of order %d", orderID)
+}
+
+// handleTrack serves GET /track/{token} without credentials. Unknown and
+// forged tokens are both 404.
+func (s *OrderService) handleTrack(w http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.URL.Path, trackingPath)
+	orderID, ok := parseTrackingToken(s.config.TrackingSecret, token)
+	if s.config.TrackingSecret == "" || !ok {
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "invalid tracking token")
+		return
+	}
+	tracking, err := s.Tracking(orderID)
+	switch err {
+	case errNoSuchOrder:
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_ORDER"}, "no such order %d", orderID)
+	case nil:
+		// Links are shared, don't let caches keep a stale status.
+		w.Header().Set("Cache-Control", "no-store")
+		respond(w, req, 200, tracking, "tracking order %d", orderID)
+	default:
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "Tracking() %d failed: %s", orderID, err)
+	}
+}
@@ -0,0 +1,67 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTracking(t *testing.T) {
+	svc := newTestService(t, Config{TrackingSecret: "s3cret"})
+	if w := serve(svc, "POST", "/orders", "", createOrderDetails); w.Code != 200 {
+		t.Fatalf("POST /orders returned %d", w.Code)
+	}
+	w := serve(svc, "GET", "/orders/1/tracking", "", "")
+	if w.Code != 200 {
+		t.Fatalf("GET tracking link returned %d: %s", w.Code, w.Body)
+	}
+	var link TrackingLink
+	if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+		t.Fatal(err)
+	}
+	if link.URL != "/track/"+link.Token {
+		t.Errorf("link %+v", link)
+	}
+
+	// No credentials needed.
+	track := func(path string) (int, Tracking, string) {
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var tracking Tracking
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &tracking); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, tracking, w.Body.String()
+	}
+	code, tracking, body := track(link.URL)
+	if code != 200 || tracking.Status != StateUnassigned || tracking.ETA != nil {
+		t.Errorf("untaken order: %d %s", code, body)
+	}
+	if strings.Contains(body, "distance") || strings.Contains(body, "price") {
+		t.Errorf("tracking shows more than the status: %s", body)
+	}
+	if w := serve(svc, "PATCH", "/orders/1", "", `{"status": "TAKEN"}`); w.Code != 200 {
+		t.Fatalf("take returned %d: %s", w.Code, w.Body)
+	}
+	if code, tracking, body = track(link.URL); code != 200 || tracking.Status != StateTaken || tracking.ETA == nil {
+		t.Errorf("taken order: %d %s", code, body)
+	}
+
+	forged := trackingToken("other", 1)
+	for _, path := range []string{"/track/" + forged, "/track/junk", "/track/" + trackingToken("s3cret", 2)} {
+		if code, _, body := track(path); code != 404 {
+			t.Errorf("%s returned %d: %s", path, code, body)
+		}
+	}
+
+	disabled := newTestService(t, Config{})
+	if w := serve(disabled, "GET", "/orders/1/tracking", "", ""); w.Code != 404 {
+		t.Errorf("tracking link without a secret returned %d", w.Code)
+	}
+}
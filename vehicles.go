@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// vehicleProfile is how a vehicle travels and what it carries.
+type vehicleProfile struct {
+	Mode      string // Travel mode of the distance provider.
+	MaxWeight int64  // Grams.
+	MaxVolume int64  // Liters.
+}
+
+// vehicleProfiles are the vehicles couriers may have, by name.
+var vehicleProfiles = map[string]vehicleProfile{
+	"bike": {Mode: travelBicycling, MaxWeight: 10000, MaxVolume: 40},
+	"car":  {Mode: travelDriving, MaxWeight: 100000, MaxVolume: 400},
+	"van":  {Mode: travelDriving, MaxWeight: 1000000, MaxVolume: 5000},
+}
+
+// carries returns true if the order fits in the vehicle. Orders without a
+// weight or volume fit in any.
+func (v vehicleProfile) carries(order *Order) bool {
+	return order.Weight <= v.MaxWeight && order.Volume <= v.MaxVolume
+}
+
+// vehicleNames returns the names of vehicleProfiles, sorted.
+func vehicleNames() []string {
+	var names []string
+	for name := range vehicleProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Courier is a courier of a tenant, an item of GET
+// /admin/tenants/{tenant}/couriers.
+type Courier struct {
+	ID      string `json:"id"`
+	Vehicle string `json:"vehicle"` // A vehicleProfiles name.
+}
+
+// loadCouriers returns the couriers of tenant, by id.
+func loadCouriers(db *sql.DB, tenant string) ([]Courier, error) {
+	rows, err := db.Query("SELECT courier_id, vehicle FROM couriers WHERE tenant_id = ? ORDER BY courier_id", tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query couriers of tenant %q: %s", tenant, err)
+	}
+	defer rows.Close()
+	couriers := []Courier{}
+	for rows.Next() {
+		var courier Courier
+		if err := rows.Scan(&courier.ID, &courier.Vehicle); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		couriers = append(couriers, courier)
+	}
+	return couriers, rows.Err()
+}
+
+// courierVehicle returns the vehicle of a courier of tenant and its profile,
+// "" and nil for couriers without one.
+func courierVehicle(db *sql.DB, tenant, courier string) (string, *vehicleProfile, error) {
+	var vehicle string
+	err := db.QueryRow("SELECT vehicle FROM couriers WHERE tenant_id = ? AND courier_id = ?", tenant,
+		courier).Scan(&vehicle)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to query vehicle of courier %q: %s", courier, err)
+	}
+	profile, ok := vehicleProfiles[vehicle]
+	if !ok {
+		return "", nil, fmt.Errorf("courier %q has unknown vehicle %q", courier, vehicle)
+	}
+	return vehicle, &profile, nil
+}
+
+// SetCourier adds or replaces a courier of tenant.
+func (s *OrderService) SetCourier(tenant string, courier Courier) error {
+	_, err := s.DB.Exec(`INSERT INTO couriers (tenant_id, courier_id, vehicle) VALUES (?, ?, ?)
+		ON CONFLICT (tenant_id, courier_id) DO UPDATE SET vehicle = excluded.vehicle`,
+		tenant, courier.ID, courier.Vehicle)
+	if err != nil {
+		return fmt.Errorf("unable to set courier %q of tenant %q: %s", courier.ID, tenant, err)
+	}
+	return nil
+}
+
+// DeleteCourier removes a courier of tenant, returns false if there was
+// none.
+func (s *OrderService) DeleteCourier(tenant, id string) (bool, error) {
+	result, err := s.DB.Exec("DELETE FROM couriers WHERE tenant_id = ? AND courier_id = ?", tenant, id)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete courier %q of tenant %q: %s", id, tenant, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// handleTenantCouriers serves /admin/tenants/{tenant}/couriers, the vehicles
+// of the couriers of a tenant. Couriers without one may take any order.
+//
+//	GET    /admin/tenants/{tenant}/couriers       lists the couriers.
+//	PUT    /admin/tenants/{tenant}/couriers/{id}  sets one, {"vehicle": "bike"}.
+//	DELETE /admin/tenants/{tenant}/couriers/{id}  removes one.
+func (s *OrderService) handleTenantCouriers(w http.ResponseWriter, req *http.Request, tenant, id string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if id != "" {
+		if !courierIDRE.MatchString(id) {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_COURIER"}, "courier %q", id)
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			var buf bytes.Buffer
+			io.Copy(&buf, req.Body)
+			var courier Courier
+			if err := json.Unmarshal(buf.Bytes(), &courier); err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+				return
+			}
+			if _, ok := vehicleProfiles[courier.Vehicle]; !ok {
+				respond(w, req, 400, HTTPResponseError{Error: "INVALID_VEHICLE",
+					Detail: "vehicle must be one of " + strings.Join(vehicleNames(), ", ")}, "vehicle %q", courier.Vehicle)
+				return
+			}
+			courier.ID = id
+			if err := s.SetCourier(tenant, courier); err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetCourier(): %s", err)
+				return
+			}
+		case http.MethodDelete:
+			deleted, err := s.DeleteCourier(tenant, id)
+			if err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "DeleteCourier(): %s", err)
+				return
+			}
+			if !deleted {
+				respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_COURIER"}, "tenant %q courier %q", tenant, id)
+				return
+			}
+		}
+	}
+	couriers, err := loadCouriers(s.DB, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadCouriers(): %s", err)
+		return
+	}
+	respond(w, req, 200, couriers, "tenant %q %d couriers", tenant, len(couriers))
+}
@@ -0,0 +1,81 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVehicles(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	for path, body := range map[string]string{
+		"/admin/tenants/acme/couriers/bob":   `{"vehicle": "bike"}`,
+		"/admin/tenants/acme/couriers/carol": `{"vehicle": "van"}`,
+	} {
+		if w := serveAdmin(svc, "PUT", path, body); w.Code != 200 {
+			t.Fatalf("PUT %s returned %d: %s", path, w.Code, w.Body)
+		}
+	}
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/couriers/dave", `{"vehicle": "horse"}`); w.Code != 400 ||
+		!strings.Contains(w.Body.String(), "INVALID_VEHICLE") {
+		t.Errorf("PUT of an unknown vehicle returned %d %s", w.Code, w.Body)
+	}
+	if w := serveAdmin(svc, "DELETE", "/admin/tenants/acme/couriers/dave", ""); w.Code != 404 {
+		t.Errorf("DELETE of a missing courier returned %d", w.Code)
+	}
+	w := serveAdmin(svc, "GET", "/admin/tenants/acme/couriers", "")
+	var couriers []Courier
+	if err := json.NewDecoder(w.Body).Decode(&couriers); err != nil || len(couriers) != 2 ||
+		couriers[0] != (Courier{ID: "bob", Vehicle: "bike"}) {
+		t.Errorf("GET couriers returned %+v, %v", couriers, err)
+	}
+
+	// Order 2 is too heavy for a bike.
+	for i := 0; i < 2; i++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if w := servePatchTenant(svc, "/orders/2", "acme", `{"weight": 25000, "volume": 60}`); w.Code != 200 ||
+		!strings.Contains(w.Body.String(), `"weight":25000`) {
+		t.Fatalf("PATCH weight returned %d %s", w.Code, w.Body)
+	}
+	if w := servePatchTenant(svc, "/orders/2", "acme", `{"weight": -1}`); w.Code != 400 {
+		t.Errorf("PATCH of a negative weight returned %d", w.Code)
+	}
+	for courier, want := range map[string]int{"bob": 1, "carol": 2, "erin": 2} {
+		w := serve(svc, "GET", "/couriers/"+courier+"/suggested-orders", "acme", "")
+		var orders []OrderDTO
+		if err := json.NewDecoder(w.Body).Decode(&orders); err != nil || len(orders) != want {
+			t.Errorf("suggested orders of %s are %+v, %v", courier, orders, err)
+		}
+	}
+
+	if w := serveTake(svc, "/orders/2", "acme", "bob"); w.Code != 403 ||
+		!strings.Contains(w.Body.String(), "VEHICLE_TOO_SMALL") {
+		t.Errorf("take of a heavy order by bike returned %d %s", w.Code, w.Body)
+	}
+	// Taken by bike, the order takes longer than by car.
+	if w := serveTake(svc, "/orders/1", "acme", "bob"); w.Code != 200 {
+		t.Fatalf("take by bike returned %d %s", w.Code, w.Body)
+	}
+	order, err := svc.Get(1)
+	if err != nil || order.Duration < 432 || order.Duration > 443 {
+		t.Errorf("order taken by bike has duration %+v, %v", order, err)
+	}
+	history, err := svc.History(1)
+	if err != nil || len(history) != 2 ||
+		string(history[1].Data) != fmt.Sprintf(`{"courier":"bob","vehicle":"bike","duration":%d}`, order.Duration) {
+		t.Errorf("unexpected history %+v, %v", history, err)
+	}
+	if w := serveTake(svc, "/orders/2", "acme", "carol"); w.Code != 200 {
+		t.Errorf("take by van returned %d %s", w.Code, w.Body)
+	}
+	if order, err := svc.Get(2); err != nil || order.Duration > 270 {
+		t.Errorf("order taken by van has duration %+v, %v", order, err)
+	}
+}
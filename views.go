@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var (
+	errNoSuchView = fmt.Errorf("no such view")
+	// viewNameRE is what view names may look like, they appear in URLs.
+	viewNameRE = regexp.MustCompile("^[A-Za-z0-9_-]{1,64}$")
+)
+
+// View is a named OrderFilter saved by a tenant.
+type View struct {
+	Name   string      `json:"name"`
+	Filter OrderFilter `json:"filter"`
+}
+
+// SaveView creates or replaces the view of tenant with the same name.
+func (s *OrderService) SaveView(tenant string, view View) error {
+	filter, err := json.Marshal(view.Filter)
+	if err != nil {
+		return fmt.Errorf("unable to encode filter: %s", err)
+	}
+	_, err = s.DB.Exec(`INSERT INTO views (tenant_id, name, filter) VALUES (?, ?, ?)
+		ON CONFLICT (tenant_id, name) DO UPDATE SET filter = excluded.filter`, tenant, view.Name, string(filter))
+	if err != nil {
+		return fmt.Errorf("unable to save view: %s", err)
+	}
+	return nil
+}
+
+// GetView returns the named view of tenant or errNoSuchView.
+func (s *OrderService) GetView(tenant, name string) (*View, error) {
+	var filter string
+	err := s.DB.QueryRow("SELECT filter FROM views WHERE tenant_id = ? AND name = ?", tenant, name).Scan(&filter)
+	if err == sql.ErrNoRows {
+		return nil, errNoSuchView
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query view: %s", err)
+	}
+	view := &View{Name: name}
+	if err := json.Unmarshal([]byte(filter), &view.Filter); err != nil {
+		return nil, fmt.Errorf("view %q has malformed filter: %s", name, err)
+	}
+	return view, nil
+}
+
+// ListViews returns all views of tenant ordered by name.
+func (s *OrderService) ListViews(tenant string) ([]View, error) {
+	rows, err := s.DB.Query("SELECT name, filter FROM views WHERE tenant_id = ? ORDER BY name", tenant)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query views: %s", err)
+	}
+	defer rows.Close()
+
+	views := []View{}
+	for rows.Next() {
+		var view View
+		var filter string
+		if err := rows.Scan(&view.Name, &filter); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		if err := json.Unmarshal([]byte(filter), &view.Filter); err != nil {
+			return nil, fmt.Errorf("view %q has malformed filter: %s", view.Name, err)
+		}
+		views = append(views, view)
+	}
+	return views, rows.Err()
+}
+
+// parseView decodes and validates the body of POST /views.
+func parseView(body []byte) (*View, error) {
+	var view View
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&view); err != nil {
+		return nil, fmt.Errorf("MALFORMED_PAYLOAD")
+	}
+	if !viewNameRE.MatchString(view.Name) {
+		return nil, fmt.Errorf("INVALID_VIEW_NAME")
+	}
+	if err := view.Filter.Validate(); err != nil {
+		return nil, fmt.Errorf("INVALID_FILTER")
+	}
+	return &view, nil
+}
+
+// handleViews serves "/views" and "/views/{name}/orders".
+//
+//	POST /views               saves a view, body is a View.
+//	GET  /views               lists the tenant's views.
+//	GET  /views/{name}/orders lists orders through a view, takes "page" and
+//	                          "limit" and "fields" like GET /orders.
+func (s *OrderService) handleViews(w http.ResponseWriter, req *http.Request) {
+	tenant := tenantFromRequest(req)
+
+	if req.URL.Path == "/views" {
+		switch req.Method {
+		case http.MethodGet:
+			views, err := s.ListViews(tenant)
+			if err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "ListViews(): %s", err)
+				return
+			}
+			respond(w, req, 200, views, "%d views", len(views))
+		case http.MethodPost:
+			var buf bytes.Buffer
+			io.Copy(&buf, req.Body)
+			view, err := parseView(buf.Bytes())
+			if err != nil {
+				respond(w, req, 400, HTTPResponseError{Error: err.Error()}, "parseView()")
+				return
+			}
+			if err := s.SaveView(tenant, *view); err != nil {
+				respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SaveView(): %s", err)
+				return
+			}
+			respond(w, req, 200, view, "saved view %q", view.Name)
+		default:
+			respond(w, req, 405, HTTPResponseError{Error: "DISALLOWED_METHOD"}, "")
+		}
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/views/"), "/")
+	if len(parts) != 2 || parts[1] != "orders" || !viewNameRE.MatchString(parts[0]) {
+		respond(w, req, 404, HTTPResponseError{Error: "INVALID_PATH"}, "")
+		return
+	}
+	page, limit, err := parseQueryParametersForList(req.URL.Query(), s.listLimits(req))
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS", Detail: err.Error()}, "")
+		return
+	}
+	fields, err := parseFieldset(req.URL.Query())
+	if err != nil {
+		respond(w, req, 400, HTTPResponseError{Error: "INVALID_FIELDS", Detail: err.Error()}, "")
+		return
+	}
+	view, err := s.GetView(tenant, parts[0])
+	if err == errNoSuchView {
+		respond(w, req, 404, HTTPResponseError{Error: "NO_SUCH_VIEW"}, "view %q", parts[0])
+		return
+	}
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "GetView(): %s", err)
+		return
+	}
+	view.Filter.Tenant = s.orderScope(req)
+	s.respondOrders(w, req, view.Filter, fields, page, limit, "view %q page=%d limit=%d", view.Name, page, limit)
+}
@@ -0,0 +1,74 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serve sends a request to svc and returns the recorded response.
+func serve(svc http.Handler, method, path, tenant, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if tenant != "" {
+		req.Header.Set(tenantHeader, tenant)
+	}
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	return w
+}
+
+func TestViews(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for idx := 0; idx < 3; idx++ {
+		if w := serve(svc, "POST", "/orders", "acme", createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if err := svc.Take(2); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(svc, "POST", "/views", "acme", `{"name": "open", "filter": {"status": "UNASSIGNED"}}`)
+	if w.Code != 200 {
+		t.Fatalf("POST /views returned %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(svc, "GET", "/views/open/orders", "acme", "")
+	if w.Code != 200 {
+		t.Fatalf("GET /views/open/orders returned %d: %s", w.Code, w.Body)
+	}
+	var orders []OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 || orders[0].ID != 1 || orders[1].ID != 3 {
+		t.Errorf("unexpected orders %+v", orders)
+	}
+
+	// Views belong to the tenant that saved them.
+	if w := serve(svc, "GET", "/views/open/orders", "globex", ""); w.Code != 404 {
+		t.Errorf("expected 404 for other tenant, got %d", w.Code)
+	}
+	w = serve(svc, "GET", "/views", "acme", "")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"name":"open"`) {
+		t.Errorf("GET /views returned %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestParseViewRejectsInvalid(t *testing.T) {
+	for _, body := range []string{
+		`{"name": "bad name", "filter": {}}`,
+		`{"name": "x", "filter": {"status": "LOST"}}`,
+		`{"name": "x", "filter": {"min_distance": 10, "max_distance": 5}}`,
+		`{"name": "x", "filter": {"stauts": "TAKEN"}}`,
+	} {
+		if _, err := parseView([]byte(body)); err == nil {
+			t.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the files of the S3 layout.
+const (
+	warehouseJSON    = "json"
+	warehouseParquet = "parquet"
+)
+
+// warehouseColumns are the Parquet columns of WarehouseEvent.
+var warehouseColumns = []parquetColumn{{name: "event_id", typ: parquetInt64}, {name: "order_id", typ: parquetInt64},
+	{name: "tenant_id", typ: parquetByteArray, utf8: true}, {name: "type", typ: parquetByteArray, utf8: true},
+	{name: "data", typ: parquetByteArray, utf8: true}, {name: "time", typ: parquetInt64, timestamp: true}}
+
+// defaultWarehouseBatch is the number of events loaded at once unless
+// configured otherwise.
+const defaultWarehouseBatch = 10000
+
+// warehouseEvents counts the events loaded into the warehouse.
+var warehouseEvents = expvar.NewInt("warehouse_events")
+
+// WarehouseEvent is a row of the warehouse, an event of an order with the
+// tenant of the order.
+type WarehouseEvent struct {
+	EventID  int64     `json:"event_id"`
+	OrderID  int64     `json:"order_id"`
+	TenantID string    `json:"tenant_id"`
+	Type     string    `json:"type"`
+	Data     string    `json:"data"` // The JSON data of the event, "" if none.
+	Time     time.Time `json:"time"`
+}
+
+// WarehouseSink loads events into a data warehouse. Loads are retried with
+// the same events until they succeed, so they should be idempotent.
+type WarehouseSink interface {
+	Load(ctx context.Context, events []WarehouseEvent) error
+}
+
+// newWarehouseSink returns the sink of spec:
+//
+//	s3://BUCKET/PREFIX[?region=REGION&endpoint=URL]  files for Athena, AWS_* credentials.
+//	bigquery://PROJECT/DATASET/TABLE                   streamed, with the GCE service account.
+//	file:///DIR                                        the layout of s3:// in a directory.
+//
+// The files of s3:// and file:// are gzipped JSON lines, or Parquet with
+// format=parquet.
+func newWarehouseSink(spec string, client *http.Client) (WarehouseSink, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid warehouse %q: %s", spec, err)
+	}
+	format := u.Query().Get("format")
+	if format == "" {
+		format = warehouseJSON
+	}
+	if format != warehouseJSON && format != warehouseParquet {
+		return nil, fmt.Errorf("invalid warehouse %q, format must be %s or %s", spec, warehouseJSON,
+			warehouseParquet)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid warehouse %q, want file:///DIR", spec)
+		}
+		return &dirSink{dir: u.Path, format: format}, nil
+	case "s3":
+		creds, err := awsCredentialsFromEnv()
+		if err != nil {
+			return nil, fmt.Errorf("warehouse %s: %s", spec, err)
+		}
+		sink := &s3Sink{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), region: u.Query().Get("region"),
+			endpoint: strings.TrimRight(u.Query().Get("endpoint"), "/"), format: format, creds: creds,
+			client: client, now: time.Now}
+		if sink.region == "" {
+			sink.region = "us-east-1"
+		}
+		if sink.bucket == "" {
+			return nil, fmt.Errorf("invalid warehouse %q, want s3://BUCKET/PREFIX", spec)
+		}
+		return sink, nil
+	case "bigquery":
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if u.Host == "" || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid warehouse %q, want bigquery://PROJECT/DATASET/TABLE", spec)
+		}
+		return &bigQuerySink{project: u.Host, dataset: parts[0], table: parts[1], client: client,
+			baseURL: defaultBigQueryBaseURL, metadataURL: defaultGCEMetadataURL}, nil
+	default:
+		return nil, fmt.Errorf("unknown warehouse %q, want s3://, bigquery:// or file://", spec)
+	}
+}
+
+// warehouseObject is a file of the S3 layout.
+type warehouseObject struct {
+	key  string
+	body []byte
+}
+
+// warehouseObjects lays events out for Athena, partitioned by UTC day:
+// PREFIX/events/dt=YYYY-MM-DD/events-FIRST-LAST.json.gz, or .parquet, with
+// the ids of the first and last events, so that loading the same events
+// again overwrites the same files.
+func warehouseObjects(prefix, format string, events []WarehouseEvent) ([]warehouseObject, error) {
+	if prefix != "" {
+		prefix += "/"
+	}
+	var objects []warehouseObject
+	for start := 0; start < len(events); {
+		day := events[start].Time.UTC().Format("2006-01-02")
+		end := start + 1
+		for end < len(events) && events[end].Time.UTC().Format("2006-01-02") == day {
+			end++
+		}
+		var (
+			buf bytes.Buffer
+			ext string
+			err error
+		)
+		switch format {
+		case warehouseParquet:
+			ext, err = ".parquet", writeWarehouseParquet(&buf, events[start:end])
+		default:
+			ext, err = ".json.gz", writeWarehouseJSON(&buf, events[start:end])
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, warehouseObject{key: fmt.Sprintf("%sevents/dt=%s/events-%012d-%012d%s", prefix,
+			day, events[start].EventID, events[end-1].EventID, ext), body: buf.Bytes()})
+		start = end
+	}
+	return objects, nil
+}
+
+// writeWarehouseJSON writes events as gzipped JSON lines.
+func writeWarehouseJSON(w io.Writer, events []WarehouseEvent) error {
+	zw := gzip.NewWriter(w)
+	encoder := json.NewEncoder(zw)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeWarehouseParquet writes events as a Parquet file of warehouseColumns.
+func writeWarehouseParquet(w io.Writer, events []WarehouseEvent) error {
+	p, err := newParquetWriter(w, warehouseColumns)
+	if err != nil {
+		return err
+	}
+	rows := make([][]interface{}, len(events))
+	for i, event := range events {
+		var data interface{}
+		if event.Data != "" {
+			data = event.Data
+		}
+		rows[i] = []interface{}{event.EventID, event.OrderID, event.TenantID, event.Type, data, event.Time}
+	}
+	if err := p.WriteRowGroup(rows); err != nil {
+		return err
+	}
+	return p.Close()
+}
+
+// dirSink writes the S3 layout to a directory, e.g. one synced to object
+// storage by other means.
+type dirSink struct {
+	dir    string
+	format string
+}
+
+func (d *dirSink) Load(ctx context.Context, events []WarehouseEvent) error {
+	objects, err := warehouseObjects("", d.format, events)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		path := filepath.Join(d.dir, filepath.FromSlash(object.key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// Written aside and renamed, readers never see partial files.
+		if err := ioutil.WriteFile(path+".tmp", object.body, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3Sink uploads the layout of warehouseObjects to an S3 bucket, for an
+// Athena table partitioned by dt.
+type s3Sink struct {
+	bucket, prefix, region string
+	endpoint               string // Path-style endpoint, e.g. of MinIO, empty for AWS.
+	format                 string
+	creds                  AWSCredentials
+	client                 *http.Client
+	now                    func() time.Time
+}
+
+func (s *s3Sink) Load(ctx context.Context, events []WarehouseEvent) error {
+	objects, err := warehouseObjects(s.prefix, s.format, events)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, object.key)
+		if s.endpoint != "" {
+			endpoint = fmt.Sprintf("%s/%s/%s", s.endpoint, s.bucket, object.key)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(object.body))
+		if err != nil {
+			return err
+		}
+		if s.format == warehouseParquet {
+			req.Header.Set("Content-Type", parquetMediaType)
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		signAWSv4(req, sha256Hex(object.body), "s3", s.region, s.creds, s.now())
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("unable to upload %s: %s", object.key, err)
+		}
+		detail, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unable to upload %s: HTTP %d: %s", object.key, resp.StatusCode, detail)
+		}
+	}
+	return nil
+}
+
+// Where BigQuery and the access tokens of the GCE service account are.
+const (
+	defaultBigQueryBaseURL = "https://bigquery.googleapis.com"
+	defaultGCEMetadataURL  = "http://metadata.google.internal"
+)
+
+// bigQuerySink streams events into a BigQuery table with the columns of
+// WarehouseEvent, data a STRING and time a TIMESTAMP, authenticated as the
+// service account of the GCE instance or GKE workload.
+type bigQuerySink struct {
+	project, dataset, table string
+	client                  *http.Client
+	baseURL, metadataURL    string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// accessToken returns a token of the service account, cached until shortly
+// before it expires.
+func (b *bigQuerySink) accessToken(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" && time.Now().Before(b.expires) {
+		return b.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		b.metadataURL+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get an access token: %s", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to get an access token: HTTP %d, %v", resp.StatusCode, err)
+	}
+	b.token, b.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+	return b.token, nil
+}
+
+// Load streams events with insertAll, their ids as insertId so BigQuery
+// drops the events loaded again.
+func (b *bigQuerySink) Load(ctx context.Context, events []WarehouseEvent) error {
+	type row struct {
+		InsertID string         `json:"insertId"`
+		JSON     WarehouseEvent `json:"json"`
+	}
+	rows := make([]row, len(events))
+	for i, event := range events {
+		rows[i] = row{InsertID: strconv.FormatInt(event.EventID, 10), JSON: event}
+	}
+	body, err := json.Marshal(map[string]interface{}{"rows": rows})
+	if err != nil {
+		return err
+	}
+	token, err := b.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(
+		"%s/bigquery/v2/projects/%s/datasets/%s/tables/%s/insertAll", b.baseURL, url.PathEscape(b.project),
+		url.PathEscape(b.dataset), url.PathEscape(b.table)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to insert into BigQuery: %s", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		InsertErrors []json.RawMessage `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to insert into BigQuery: HTTP %d, %v", resp.StatusCode, err)
+	}
+	if len(result.InsertErrors) > 0 {
+		return fmt.Errorf("BigQuery refused %d rows, e.g. %s", len(result.InsertErrors), result.InsertErrors[0])
+	}
+	return nil
+}
+
+// warehouseExporter periodically loads the events recorded since its last
+// load into a sink, in batches. Its progress is kept in warehouse_cursors
+// under the spec of the sink, so a new sink starts from the first event.
+type warehouseExporter struct {
+	spec     string
+	sink     WarehouseSink
+	db       *sql.DB
+	fieldKey []byte // Config.FieldKey, the data of updated events is encrypted with.
+	interval time.Duration
+	batch    int
+}
+
+func newWarehouseExporter(spec string, sink WarehouseSink, db *sql.DB, fieldKey []byte, interval time.Duration,
+	batch int) *warehouseExporter {
+	if batch <= 0 {
+		batch = defaultWarehouseBatch
+	}
+	return &warehouseExporter{spec: spec, sink: sink, db: db, fieldKey: fieldKey, interval: interval, batch: batch}
+}
+
+// run exports every interval until ctx is done.
+func (e *warehouseExporter) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := e.export(ctx)
+			if err != nil {
+				fmt.Printf("Warehouse: %s\n", err)
+			}
+			if n > 0 {
+				fmt.Printf("Warehouse: loaded %d events\n", n)
+			}
+		}
+	}
+}
+
+// export loads batches until it is caught up. Returns the number of events
+// loaded.
+func (e *warehouseExporter) export(ctx context.Context) (int, error) {
+	var cursor int64
+	err := e.db.QueryRowContext(ctx, "SELECT event_id FROM warehouse_cursors WHERE sink = ?", e.spec).Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("unable to read the cursor: %s", err)
+	}
+	total := 0
+	for {
+		events, err := e.events(ctx, cursor)
+		if err != nil || len(events) == 0 {
+			return total, err
+		}
+		if err := e.sink.Load(ctx, events); err != nil {
+			return total, fmt.Errorf("unable to load events %d to %d: %s", events[0].EventID,
+				events[len(events)-1].EventID, err)
+		}
+		cursor = events[len(events)-1].EventID
+		_, err = e.db.ExecContext(ctx, `INSERT INTO warehouse_cursors (sink, event_id) VALUES (?, ?)
+			ON CONFLICT (sink) DO UPDATE SET event_id = excluded.event_id`, e.spec, cursor)
+		if err != nil {
+			return total, fmt.Errorf("unable to save the cursor: %s", err)
+		}
+		total += len(events)
+		warehouseEvents.Add(int64(len(events)))
+		if len(events) < e.batch {
+			return total, nil
+		}
+	}
+}
+
+// events returns the next batch of events after the event with id cursor.
+func (e *warehouseExporter) events(ctx context.Context, cursor int64) ([]WarehouseEvent, error) {
+	rows, err := e.db.QueryContext(ctx, `SELECT e.id, e.order_id, COALESCE(o.tenant_id, a.tenant_id, ''), e.type,
+			COALESCE(e.data, ''), e.created_at FROM events e
+		LEFT JOIN orders o ON o.id = e.order_id
+		LEFT JOIN orders_archive a ON a.id = e.order_id
+		WHERE e.id > ? ORDER BY e.id LIMIT ?`, cursor, e.batch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query events: %s", err)
+	}
+	defer rows.Close()
+	var events []WarehouseEvent
+	for rows.Next() {
+		var (
+			event     WarehouseEvent
+			createdAt int64
+		)
+		if err := rows.Scan(&event.EventID, &event.OrderID, &event.TenantID, &event.Type, &event.Data,
+			&createdAt); err != nil {
+			return nil, fmt.Errorf("row.Scan() failed: %s", err)
+		}
+		data, err := openField(e.fieldKey, []byte(event.Data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid event %d: %s", event.EventID, err)
+		}
+		event.Data = string(data)
+		event.Time = time.Unix(createdAt, 0).UTC()
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
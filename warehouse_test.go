@@ -0,0 +1,232 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readWarehouseObject decodes the events of a gzipped JSON lines file.
+func readWarehouseObject(t *testing.T, body []byte) []WarehouseEvent {
+	t.Helper()
+	zr, err := gzip.NewReader(strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []WarehouseEvent
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var event WarehouseEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestWarehouseObjects(t *testing.T) {
+	day := time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC)
+	objects, err := warehouseObjects("orders", warehouseJSON, []WarehouseEvent{
+		{EventID: 1, Time: day}, {EventID: 2, Time: day}, {EventID: 5, Time: day.Add(time.Minute)},
+	})
+	if err != nil || len(objects) != 2 {
+		t.Fatalf("unexpected objects %v, %v", objects, err)
+	}
+	if objects[0].key != "orders/events/dt=2026-10-16/events-000000000001-000000000002.json.gz" ||
+		objects[1].key != "orders/events/dt=2026-10-17/events-000000000005-000000000005.json.gz" {
+		t.Errorf("unexpected keys %s, %s", objects[0].key, objects[1].key)
+	}
+	if events := readWarehouseObject(t, objects[0].body); len(events) != 2 || events[1].EventID != 2 {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestWarehouseExporter(t *testing.T) {
+	svc := newTestService(t, Config{})
+	for _, tenant := range []string{"acme", "globex"} {
+		if w := serve(svc, "POST", "/orders", tenant, createOrderDetails); w.Code != 200 {
+			t.Fatalf("POST /orders returned %d", w.Code)
+		}
+	}
+	if err := svc.Take(1); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	sink, err := newWarehouseSink("file://"+dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := newWarehouseExporter("file://"+dir, sink, svc.DB, svc.config.FieldKey, time.Minute, 2)
+	for _, want := range []int{3, 0} {
+		if n, err := exporter.export(context.Background()); err != nil || n != want {
+			t.Errorf("loaded %d events, want %d: %v", n, want, err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "events", "dt=*", "*.json.gz"))
+	if len(files) != 2 {
+		t.Fatalf("expected a file per batch, got %v", files)
+	}
+	body, _ := ioutil.ReadFile(files[1])
+	events := readWarehouseObject(t, body)
+	if len(events) != 1 || events[0].Type != string(EventTaken) || events[0].TenantID != "acme" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	body, _ = ioutil.ReadFile(files[0])
+	if events := readWarehouseObject(t, body); events[1].TenantID != "globex" ||
+		!strings.Contains(events[1].Data, `"tenant_id":"globex"`) {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	// A failed load is retried from the same event.
+	failing := newWarehouseExporter("fail", failingSink{}, svc.DB, svc.config.FieldKey, time.Minute, 0)
+	if n, err := failing.export(context.Background()); err == nil || n != 0 {
+		t.Errorf("expected the load to fail, got %d, %v", n, err)
+	}
+	var cursors int
+	svc.DB.QueryRow("SELECT COUNT(*) FROM warehouse_cursors").Scan(&cursors)
+	if cursors != 1 {
+		t.Errorf("expected the failing sink to have no cursor, got %d cursors", cursors)
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) Load(ctx context.Context, events []WarehouseEvent) error {
+	return fmt.Errorf("warehouse down")
+}
+
+func TestS3Sink(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		uploads = map[string][]byte{}
+	)
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			req.Header.Get("X-Amz-Content-Sha256") == "" || req.Method != "PUT" {
+			w.WriteHeader(403)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		uploads[req.URL.Path] = body
+		mu.Unlock()
+	}))
+	defer s3.Close()
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	sink, err := newWarehouseSink("s3://analytics/orderservice/?region=eu-west-1&endpoint="+s3.URL, s3.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Load(context.Background(), []WarehouseEvent{{EventID: 7, OrderID: 1, Type: "created",
+		Time: time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, ok := uploads["/analytics/orderservice/events/dt=2026-10-17/events-000000000007-000000000007.json.gz"]
+	if !ok {
+		t.Fatalf("unexpected uploads %v", uploads)
+	}
+	if events := readWarehouseObject(t, body); len(events) != 1 || events[0].OrderID != 1 {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	parquetSink, err := newWarehouseSink("s3://analytics/orderservice?format=parquet&endpoint="+s3.URL, s3.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parquetSink.Load(context.Background(), []WarehouseEvent{{EventID: 8, OrderID: 2, TenantID: "acme",
+		Type: "created", Time: time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, ok = uploads["/analytics/orderservice/events/dt=2026-10-17/events-000000000008-000000000008.parquet"]
+	if !ok {
+		t.Fatalf("unexpected uploads %v", uploads)
+	}
+	names, rows := readParquet(t, body)
+	if len(names) != 6 || names[5] != "time" || len(rows) != 1 || rows[0][1] != int64(2) ||
+		rows[0][2] != "acme" || rows[0][4] != nil || rows[0][5] != int64(1792224000000) {
+		t.Errorf("unexpected Parquet columns %v, rows %v", names, rows)
+	}
+
+	for _, spec := range []string{"s3:///prefix", "bigquery://project/dataset", "ftp://host/x", "file://",
+		"file:///tmp?format=xml"} {
+		if _, err := newWarehouseSink(spec, nil); err == nil {
+			t.Errorf("no error for warehouse %q", spec)
+		}
+	}
+}
+
+func TestBigQuerySink(t *testing.T) {
+	var (
+		tokens int
+		rows   []map[string]interface{}
+	)
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			if req.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(403)
+				return
+			}
+			tokens++
+			fmt.Fprint(w, `{"access_token": "ya29.token", "expires_in": 3599, "token_type": "Bearer"}`)
+		case "/bigquery/v2/projects/acme-analytics/datasets/orders/tables/events/insertAll":
+			if req.Header.Get("Authorization") != "Bearer ya29.token" {
+				w.WriteHeader(401)
+				return
+			}
+			var body struct {
+				Rows []map[string]interface{} `json:"rows"`
+			}
+			json.NewDecoder(req.Body).Decode(&body)
+			rows = append(rows, body.Rows...)
+			if len(rows) > 2 {
+				fmt.Fprint(w, `{"insertErrors": [{"index": 0, "errors": [{"reason": "invalid"}]}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"kind": "bigquery#tableDataInsertAllResponse"}`)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer google.Close()
+
+	sink, err := newWarehouseSink("bigquery://acme-analytics/orders/events", google.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bq := sink.(*bigQuerySink)
+	bq.baseURL, bq.metadataURL = google.URL, google.URL
+	for _, id := range []int64{1, 2} {
+		if err := sink.Load(context.Background(), []WarehouseEvent{{EventID: id, Type: "created"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokens != 1 || len(rows) != 2 || rows[1]["insertId"] != "2" {
+		t.Errorf("unexpected %d tokens, rows %v", tokens, rows)
+	}
+	if err := sink.Load(context.Background(), []WarehouseEvent{{EventID: 3}}); err == nil {
+		t.Error("expected insert errors to fail the load")
+	}
+}
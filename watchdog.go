@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// watchdogVars are the latest watchdog samples, served with the other expvar
+// variables by GET /admin/metrics.
+var watchdogVars = expvar.NewMap("watchdog")
+
+// profileEvery limits heap profile dumps, a process stuck over a threshold
+// would otherwise fill the disk.
+const profileEvery = time.Hour
+
+// WatchdogConfig sets the thresholds above which the watchdog reports an
+// anomaly. Zero thresholds are not checked.
+type WatchdogConfig struct {
+	Interval      time.Duration // Time between samples.
+	MaxGoroutines int
+	MaxHeapBytes  uint64
+	// Directory heap profiles are written to when a threshold is exceeded,
+	// empty disables profiles.
+	ProfileDir string
+}
+
+// watchdogSample is one measurement of the process.
+type watchdogSample struct {
+	Goroutines int
+	HeapBytes  uint64
+	DB         sql.DBStats
+}
+
+// watchdog periodically samples goroutines, heap and the database connection
+// pool, publishes the samples in watchdogVars and logs anomalies.
+type watchdog struct {
+	config      WatchdogConfig
+	db          *sql.DB
+	last        sql.DBStats // Previous sample of the pool.
+	lastProfile time.Time
+	now         func() time.Time
+}
+
+func newWatchdog(config WatchdogConfig, db *sql.DB) *watchdog {
+	return &watchdog{config: config, db: db, now: time.Now}
+}
+
+// run samples every config.Interval until ctx is done.
+func (w *watchdog) run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(w.sample())
+		}
+	}
+}
+
+func (w *watchdog) sample() watchdogSample {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return watchdogSample{Goroutines: runtime.NumGoroutine(), HeapBytes: mem.HeapAlloc, DB: w.db.Stats()}
+}
+
+// check publishes sample and returns the anomalies found in it, dumping a
+// heap profile if there are any.
+func (w *watchdog) check(sample watchdogSample) []string {
+	setInt := func(name string, value int64) {
+		v := new(expvar.Int)
+		v.Set(value)
+		watchdogVars.Set(name, v)
+	}
+	setInt("goroutines", int64(sample.Goroutines))
+	setInt("heap_bytes", int64(sample.HeapBytes))
+	setInt("db_open_connections", int64(sample.DB.OpenConnections))
+	setInt("db_in_use", int64(sample.DB.InUse))
+	setInt("db_wait_count", sample.DB.WaitCount)
+
+	var anomalies []string
+	if w.config.MaxGoroutines > 0 && sample.Goroutines > w.config.MaxGoroutines {
+		anomalies = append(anomalies, fmt.Sprintf("%d goroutines, limit %d", sample.Goroutines,
+			w.config.MaxGoroutines))
+	}
+	if w.config.MaxHeapBytes > 0 && sample.HeapBytes > w.config.MaxHeapBytes {
+		anomalies = append(anomalies, fmt.Sprintf("heap %d bytes, limit %d", sample.HeapBytes,
+			w.config.MaxHeapBytes))
+	}
+	if waits := sample.DB.WaitCount - w.last.WaitCount; waits > 0 {
+		anomalies = append(anomalies, fmt.Sprintf("%d waits for a database connection, %s in total", waits,
+			sample.DB.WaitDuration-w.last.WaitDuration))
+	}
+	w.last = sample.DB
+
+	for _, anomaly := range anomalies {
+		watchdogVars.Add("anomalies", 1)
+		fmt.Printf("Watchdog: %s\n", anomaly)
+	}
+	if len(anomalies) > 0 && w.config.ProfileDir != "" && w.now().Sub(w.lastProfile) >= profileEvery {
+		w.lastProfile = w.now()
+		if path, err := w.writeHeapProfile(); err != nil {
+			fmt.Printf("Watchdog: unable to write heap profile: %s\n", err)
+		} else {
+			fmt.Printf("Watchdog: wrote heap profile %s\n", path)
+		}
+	}
+	return anomalies
+}
+
+// writeHeapProfile writes a heap profile to config.ProfileDir and returns its
+// path.
+func (w *watchdog) writeHeapProfile() (string, error) {
+	path := filepath.Join(w.config.ProfileDir, fmt.Sprintf("heap-%s.pprof", w.now().UTC().Format("20060102T150405Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// handleMetrics serves GET /admin/metrics, the expvar variables as JSON.
+func (s *OrderService) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if !s.requireAdmin(w, req) {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, req)
+}
@@ -0,0 +1,66 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	dir := t.TempDir()
+	w := newWatchdog(WatchdogConfig{MaxGoroutines: 10, MaxHeapBytes: 1 << 20, ProfileDir: dir}, openTestDB(t))
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+
+	if anomalies := w.check(watchdogSample{Goroutines: 5, HeapBytes: 1 << 10}); len(anomalies) != 0 {
+		t.Errorf("unexpected anomalies %v", anomalies)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("unexpected profiles %v", entries)
+	}
+
+	sample := watchdogSample{Goroutines: 50, HeapBytes: 2 << 20}
+	sample.DB.WaitCount = 3
+	if anomalies := w.check(sample); len(anomalies) != 3 {
+		t.Errorf("expected 3 anomalies, got %v", anomalies)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected one profile, got %v", entries)
+	}
+
+	// Waits are counted since the previous sample and profiles are rate
+	// limited.
+	now = now.Add(time.Minute)
+	if anomalies := w.check(sample); len(anomalies) != 2 {
+		t.Errorf("expected 2 anomalies, got %v", anomalies)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected one profile, got %v", entries)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret"})
+	newWatchdog(WatchdogConfig{}, svc.DB).check(watchdogSample{Goroutines: 7})
+
+	if w := serve(svc, "GET", "/admin/metrics", "", ""); w.Code != 401 {
+		t.Errorf("expected 401 without admin token, got %d", w.Code)
+	}
+	w := serveAdmin(svc, "GET", "/admin/metrics", "")
+	if w.Code != 200 {
+		t.Fatalf("GET /admin/metrics returned %d", w.Code)
+	}
+	var metrics struct {
+		Watchdog map[string]int64 `json:"watchdog"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.Watchdog["goroutines"] != 7 {
+		t.Errorf("unexpected metrics %v", metrics.Watchdog)
+	}
+}
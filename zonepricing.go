@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// anyZone matches any origin or destination in a PricingRule, inside a zone
+// or not.
+const anyZone = "*"
+
+// DistanceBucket prices the journeys up to a distance.
+type DistanceBucket struct {
+	UpTo  int64 `json:"up_to"` // Meters, 0 for any distance.
+	Price int64 `json:"price"` // In minor units of the tariff's currency.
+}
+
+// PricingRule prices the journeys from a zone to a zone, at a flat price or
+// by distance bucket. Journeys longer than the last bucket are priced by the
+// next matching rule.
+type PricingRule struct {
+	From    string           `json:"from"` // Zone of the origin, or "*".
+	To      string           `json:"to"`   // Zone of the destination, or "*".
+	Price   int64            `json:"price,omitempty"`
+	Buckets []DistanceBucket `json:"buckets,omitempty"` // By increasing up_to, replace price.
+}
+
+// PricingRules is the body of GET and PUT /admin/tenants/{tenant}/pricing.
+// The first matching rule prices a journey, journeys no rule matches are
+// priced by the tariff.
+type PricingRules struct {
+	Rules []PricingRule `json:"rules"`
+}
+
+// PriceBreakdown tells how the price of a quote was made.
+type PriceBreakdown struct {
+	Source string `json:"source"` // "tariff", or "zone" when a pricing rule applied.
+	// Zones of the ends of the journey, omitted outside of any.
+	OriginZone      string `json:"origin_zone,omitempty"`
+	DestinationZone string `json:"destination_zone,omitempty"`
+	Rule            *int   `json:"rule,omitempty"`  // Index of the pricing rule applied.
+	UpTo            int64  `json:"up_to,omitempty"` // Distance bucket applied, if any.
+	// Parts of a tariff price.
+	BaseFare       int64 `json:"base_fare,omitempty"`
+	DistanceCharge int64 `json:"distance_charge,omitempty"`
+	// Multiplier of the price above, omitted for no surge.
+	Surge float64 `json:"surge,omitempty"`
+	// Promotion taken off the price after surge.
+	PromoCode string `json:"promo_code,omitempty"`
+	Discount  int64  `json:"discount,omitempty"`
+}
+
+// validatePricingRules returns an error describing the first invalid rule.
+func validatePricingRules(pricing PricingRules) error {
+	for i, rule := range pricing.Rules {
+		for _, zone := range []string{rule.From, rule.To} {
+			if zone != anyZone && !areaNameRE.MatchString(zone) {
+				return fmt.Errorf("rule %d: invalid zone %q", i, zone)
+			}
+		}
+		if rule.Price < 0 {
+			return fmt.Errorf("rule %d: negative price", i)
+		}
+		for j, bucket := range rule.Buckets {
+			if bucket.Price < 0 || bucket.UpTo < 0 {
+				return fmt.Errorf("rule %d: negative bucket", i)
+			}
+			if j > 0 && (rule.Buckets[j-1].UpTo == 0 || bucket.UpTo != 0 && bucket.UpTo <= rule.Buckets[j-1].UpTo) {
+				return fmt.Errorf("rule %d: buckets must be by increasing up_to, 0 last", i)
+			}
+		}
+	}
+	return nil
+}
+
+// zoneOf returns the name of the first of zones containing the point, "" if
+// none does.
+func zoneOf(zones []Area, lat, lng float64) (string, error) {
+	for _, zone := range zones {
+		polygons, err := parseGeometry(zone.Geometry)
+		if err != nil {
+			return "", fmt.Errorf("invalid zone %q: %s", zone.Name, err)
+		}
+		if polygonsContain(polygons, lat, lng) {
+			return zone.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// apply returns the price of a journey of meters if the rule prices it.
+func (r PricingRule) apply(meters int64) (int64, int64, bool) {
+	if len(r.Buckets) == 0 {
+		return r.Price, 0, true
+	}
+	for _, bucket := range r.Buckets {
+		if bucket.UpTo == 0 || meters <= bucket.UpTo {
+			return bucket.Price, bucket.UpTo, true
+		}
+	}
+	return 0, 0, false
+}
+
+// price returns the price of a journey of tenant and how it was made, by the
+// first of the tenant's pricing rules matching the zones of its ends, or by
+// the tariff.
+func (s *OrderService) price(tenant string, origin, destination []string, meters int64) (int64, PriceBreakdown,
+	error) {
+	tariff := s.config.Tariff
+	breakdown := PriceBreakdown{Source: "tariff", BaseFare: tariff.BaseFare,
+		DistanceCharge: tariff.Price(meters) - tariff.BaseFare}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil || settings.Pricing == "" {
+		return tariff.Price(meters), breakdown, err
+	}
+	var pricing PricingRules
+	if err := json.Unmarshal([]byte(settings.Pricing), &pricing); err != nil {
+		return 0, breakdown, fmt.Errorf("invalid pricing of tenant %q: %s", tenant, err)
+	}
+	zones, err := loadAreas(s.DB, pricingZonesTable, tenant)
+	if err != nil {
+		return 0, breakdown, err
+	}
+	originLat, originLng, err := parseLatLng(origin)
+	if err != nil {
+		return 0, breakdown, err
+	}
+	destinationLat, destinationLng, err := parseLatLng(destination)
+	if err != nil {
+		return 0, breakdown, err
+	}
+	if breakdown.OriginZone, err = zoneOf(zones, originLat, originLng); err != nil {
+		return 0, breakdown, err
+	}
+	if breakdown.DestinationZone, err = zoneOf(zones, destinationLat, destinationLng); err != nil {
+		return 0, breakdown, err
+	}
+	for i, rule := range pricing.Rules {
+		if (rule.From != anyZone && rule.From != breakdown.OriginZone) ||
+			(rule.To != anyZone && rule.To != breakdown.DestinationZone) {
+			continue
+		}
+		if price, upTo, ok := rule.apply(meters); ok {
+			rule := i
+			breakdown.Source, breakdown.Rule, breakdown.UpTo = "zone", &rule, upTo
+			breakdown.BaseFare, breakdown.DistanceCharge = 0, 0
+			return price, breakdown, nil
+		}
+	}
+	return tariff.Price(meters), breakdown, nil
+}
+
+// SetPricingRules sets the pricing rules of tenant, none removes them.
+func (s *OrderService) SetPricingRules(tenant string, pricing PricingRules) error {
+	var encoded interface{}
+	if len(pricing.Rules) > 0 {
+		b, err := json.Marshal(pricing)
+		if err != nil {
+			return fmt.Errorf("unable to encode pricing: %s", err)
+		}
+		encoded = string(b)
+	}
+	_, err := s.DB.Exec(`INSERT INTO tenant_settings (tenant_id, pricing) VALUES (?, ?)
+		ON CONFLICT (tenant_id) DO UPDATE SET pricing = excluded.pricing`, tenant, encoded)
+	if err != nil {
+		return fmt.Errorf("unable to set pricing of tenant %q: %s", tenant, err)
+	}
+	return nil
+}
+
+// handleTenantPricing serves /admin/tenants/{tenant}/pricing.
+//
+//	GET /admin/tenants/{tenant}/pricing  returns the PricingRules.
+//	PUT /admin/tenants/{tenant}/pricing  sets them, {"rules": [{"from":
+//	                                     "downtown", "to": "airport", "buckets":
+//	                                     [{"up_to": 20000, "price": 3500},
+//	                                     {"up_to": 0, "price": 4500}]}]}.
+func (s *OrderService) handleTenantPricing(w http.ResponseWriter, req *http.Request, tenant string) {
+	if !s.requireTenantAdmin(w, req, tenant) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		if tenant == "" {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PARAMETERS"}, "empty tenant")
+			return
+		}
+		var buf bytes.Buffer
+		io.Copy(&buf, req.Body)
+		var pricing PricingRules
+		if err := json.Unmarshal(buf.Bytes(), &pricing); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "MALFORMED_PAYLOAD"}, "%s", err)
+			return
+		}
+		if err := validatePricingRules(pricing); err != nil {
+			respond(w, req, 400, HTTPResponseError{Error: "INVALID_PRICING", Detail: err.Error()}, "%s", err)
+			return
+		}
+		if err := s.SetPricingRules(tenant, pricing); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "SetPricingRules(): %s", err)
+			return
+		}
+	}
+	settings, err := loadTenantSettings(s.DB, s.config.FieldKey, tenant)
+	if err != nil {
+		respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "loadTenantSettings(): %s", err)
+		return
+	}
+	pricing := PricingRules{Rules: []PricingRule{}}
+	if settings.Pricing != "" {
+		if err := json.Unmarshal([]byte(settings.Pricing), &pricing); err != nil {
+			respond(w, req, 500, HTTPResponseError{Error: "INTERNAL_FAILURE"}, "invalid pricing: %s", err)
+			return
+		}
+	}
+	respond(w, req, 200, pricing, "tenant %q %d pricing rules", tenant, len(pricing.Rules))
+}
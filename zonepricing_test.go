@@ -0,0 +1,77 @@
+//go:build !integ
+// +build !integ
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestZonePricing(t *testing.T) {
+	svc := newTestService(t, Config{AdminToken: "secret", Tariff: Tariff{BaseFare: 250, PerKm: 120, Currency: "USD"}})
+	quote := func(tenant string) Quote {
+		t.Helper()
+		w := serve(svc, "POST", "/orders/quote", tenant, createOrderDetails)
+		var quote Quote
+		if err := json.NewDecoder(w.Body).Decode(&quote); err != nil || w.Code != 200 {
+			t.Fatalf("POST /orders/quote returned %d, %v", w.Code, err)
+		}
+		return quote
+	}
+	// createOrderDetails goes from east to west, 1816m.
+	for name, geometry := range map[string]string{
+		"east": `{"type": "Polygon", "coordinates": [[[-122.28, 37.8], [-122.27, 37.8], [-122.27, 37.82], [-122.28, 37.82], [-122.28, 37.8]]]}`,
+		"west": `{"type": "Polygon", "coordinates": [[[-122.3, 37.8], [-122.29, 37.8], [-122.29, 37.81], [-122.3, 37.81], [-122.3, 37.8]]]}`,
+	} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/zones/"+name, geometry); w.Code != 200 {
+			t.Fatalf("PUT zone returned %d: %s", w.Code, w.Body)
+		}
+	}
+
+	if q := quote("acme"); q.Price != 468 || q.Breakdown.Source != "tariff" || q.Breakdown.BaseFare != 250 ||
+		q.Breakdown.DistanceCharge != 218 {
+		t.Errorf("unexpected quote without rules %+v", q)
+	}
+
+	for _, body := range []string{
+		`{"rules": [{"from": "", "to": "*", "price": 1}]}`,
+		`{"rules": [{"from": "*", "to": "*", "price": -1}]}`,
+		`{"rules": [{"from": "*", "to": "*", "buckets": [{"up_to": 0, "price": 1}, {"up_to": 10, "price": 2}]}]}`,
+		`{"rules": [{"from": "*", "to": "*", "buckets": [{"up_to": 10, "price": 1}, {"up_to": 5, "price": 2}]}]}`,
+	} {
+		if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/pricing", body); w.Code != 400 {
+			t.Errorf("PUT %s returned %d", body, w.Code)
+		}
+	}
+	rules := `{"rules": [
+		{"from": "west", "to": "east", "price": 900},
+		{"from": "east", "to": "west", "buckets": [{"up_to": 1000, "price": 500}]},
+		{"from": "east", "to": "*", "buckets": [{"up_to": 1000, "price": 600}, {"up_to": 5000, "price": 700}]}
+	]}`
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/pricing", rules); w.Code != 200 {
+		t.Fatalf("PUT pricing returned %d: %s", w.Code, w.Body)
+	}
+	q := quote("acme")
+	if b := q.Breakdown; q.Price != 700 || b.Source != "zone" || b.OriginZone != "east" || b.DestinationZone != "west" ||
+		b.Rule == nil || *b.Rule != 2 || b.UpTo != 5000 || b.BaseFare != 0 {
+		t.Errorf("unexpected quote %+v %+v", q, q.Breakdown)
+	}
+	if q := quote("other"); q.Price != 468 {
+		t.Errorf("unexpected quote of another tenant %+v", q)
+	}
+
+	// Orders are priced like quotes.
+	w := serve(svc, "POST", "/orders", "acme", createOrderDetails)
+	var order OrderDTO
+	if err := json.NewDecoder(w.Body).Decode(&order); err != nil || order.Price != 700 {
+		t.Errorf("unexpected order %+v, %v", order, err)
+	}
+
+	if w := serveAdmin(svc, "PUT", "/admin/tenants/acme/pricing", `{"rules": []}`); w.Code != 200 {
+		t.Fatalf("PUT pricing returned %d", w.Code)
+	}
+	if q := quote("acme"); q.Price != 468 || q.Breakdown.Source != "tariff" {
+		t.Errorf("unexpected quote after removing rules %+v", q)
+	}
+}